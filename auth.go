@@ -0,0 +1,144 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+)
+
+// If Options.PeerKey is set, nodes authenticate each other after the
+// identity handshake, using challenge-response with HMAC-SHA256:
+//
+//     client: authReq{nonce: nc}
+//     server: authResp{nonce: ns, mac: hmac(key(server), "server", cid, nc, ns)}
+//     client: authReq{mac: hmac(key(client), "client", cid, ns, nc)}
+//     server: authResp{result: success or authFailed}
+//
+// Both nonces are random, so that macs cannot be replayed. The mac of
+// each side proves that it knows its own key, without sending the key.
+// Server does not serve any other request on the connection, until
+// the client is authenticated.
+
+const authNonceSize = 32
+
+// SharedKey returns Options.PeerKey, that uses the same
+// secret key for all nodes in cluster.
+func SharedKey(key []byte) func(nid uint64) []byte {
+	return func(uint64) []byte { return key }
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func authMAC(key []byte, role string, cid uint64, nonce1, nonce2 []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(role))
+	var b [8]byte
+	byteOrder.PutUint64(b[:], cid)
+	_, _ = h.Write(b[:])
+	_, _ = h.Write(nonce1)
+	_, _ = h.Write(nonce2)
+	return h.Sum(nil)
+}
+
+// authenticate performs auth handshake on client side. It verifies
+// that server knows the key of node nid, and proves that client
+// knows the key of node src.
+func (c *conn) authenticate(peerKey func(uint64) []byte, cid, src, nid uint64, deadline time.Time) (bool, error) {
+	srcKey, nidKey := peerKey(src), peerKey(nid)
+	if len(srcKey) == 0 || len(nidKey) == 0 {
+		return false, nil
+	}
+	nc, err := newNonce()
+	if err != nil {
+		return false, err
+	}
+	resp := &authResp{}
+	if err = c.doRPC(&authReq{req: req{src: src}, nonce: nc}, resp, deadline); err != nil {
+		return false, err
+	}
+	if resp.result != success || len(resp.nonce) != authNonceSize {
+		return false, nil
+	}
+	if !hmac.Equal(resp.mac, authMAC(nidKey, "server", cid, nc, resp.nonce)) {
+		return false, nil
+	}
+	req := &authReq{req: req{src: src}, mac: authMAC(srcKey, "client", cid, resp.nonce, nc)}
+	if err = c.doRPC(req, resp, deadline); err != nil {
+		return false, err
+	}
+	return resp.result == success, nil
+}
+
+// authState tracks auth handshake on server side of connection.
+type authState struct {
+	nc, ns []byte // client and server nonces, nil if not started
+	done   bool
+}
+
+// handleAuth handles authReq from node src. It returns
+// errAuthFailed, if the node failed to authenticate.
+func (s *server) handleAuth(c *conn, src uint64, state *authState) error {
+	req := &authReq{}
+	if err := c.decodeReq(req); err != nil {
+		return err
+	}
+	s.r.nodeLogger.Debug("received", "req", req)
+	resp := &authResp{resp: resp{version: req.version, result: authFailed}}
+	var err error
+	switch {
+	case s.r.peerKey == nil || state.done || req.src != src:
+		err = errAuthFailed
+	case state.ns == nil:
+		// first request with client nonce
+		key := s.r.peerKey(s.r.nid)
+		if len(key) == 0 || len(req.nonce) != authNonceSize {
+			err = errAuthFailed
+			break
+		}
+		if state.ns, err = newNonce(); err != nil {
+			return err
+		}
+		state.nc = req.nonce
+		resp.result, resp.nonce = success, state.ns
+		resp.mac = authMAC(key, "server", s.r.cid, state.nc, state.ns)
+	default:
+		// second request with client mac
+		key := s.r.peerKey(src)
+		if len(key) == 0 || !hmac.Equal(req.mac, authMAC(key, "client", s.r.cid, state.ns, state.nc)) {
+			err = errAuthFailed
+			break
+		}
+		state.done = true
+		resp.result = success
+	}
+	if err == errAuthFailed {
+		s.r.nodeLogger.Warn("authentication failed", "peer", src)
+	}
+	s.r.nodeLogger.Debug("replying", "resp", resp)
+	if e := resp.encode(c.bufw); e != nil {
+		return e
+	}
+	if e := c.bufw.Flush(); e != nil {
+		return e
+	}
+	return err
+}
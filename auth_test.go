@@ -0,0 +1,115 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRaft_peerKey(t *testing.T) {
+	keys := map[uint64][]byte{1: []byte("key1"), 2: []byte("key2"), 3: []byte("key3")}
+	c := newCluster(t)
+	c.opt.PeerKey = func(nid uint64) []byte { return keys[nid] }
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	info := c.info(flrs[0])
+	newPool := func(peerKey func(uint64) []byte) *connPool {
+		var pool *connPool
+		_ = ldr.inspect(func(r *Raft) {
+			pool = &connPool{
+				src: r.nid, cid: r.cid, nid: flrs[0].nid,
+				resolver: r.resolver,
+				dialFn:   r.dialFn,
+				clock:    r.clock,
+				max:      1,
+				peerKey:  peerKey,
+			}
+		})
+		return pool
+	}
+	heartbeat := func(pool *connPool) error {
+		deadline := time.Now().Add(c.longTimeout)
+		conn, err := pool.getConn(deadline)
+		if err != nil {
+			return err
+		}
+		defer conn.rwc.Close()
+		areq := &appendReq{
+			req:            req{term: info.Term, src: pool.src},
+			prevLogIndex:   info.LastLogIndex,
+			prevLogTerm:    info.LastLogTerm,
+			ldrCommitIndex: info.Committed,
+		}
+		return conn.doRPC(areq, &appendResp{}, deadline)
+	}
+
+	// correct keys
+	if err := heartbeat(newPool(c.opt.PeerKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// authenticated connection must not change its identity
+	pool := newPool(c.opt.PeerKey)
+	other := flrs[1].nid
+	tests := []struct {
+		req  request
+		resp response
+	}{
+		{&identityReq{req: req{src: other}, cid: ldr.cid, nid: flrs[0].nid}, &identityResp{}},
+		{&appendReq{req: req{term: info.Term, src: other}, prevLogIndex: info.LastLogIndex, prevLogTerm: info.LastLogTerm}, &appendResp{}},
+		{&voteReq{req: req{term: info.Term, src: other}, lastLogIndex: info.LastLogIndex, lastLogTerm: info.LastLogTerm}, &voteResp{}},
+	}
+	for _, test := range tests {
+		conn, err := pool.getConn(time.Now().Add(c.longTimeout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.doRPC(test.req, test.resp, time.Now().Add(c.longTimeout)); err == nil || isTimeout(err) {
+			t.Fatalf("%T from M%d: got %v, want connection closed", test.req, other, err)
+		}
+		_ = conn.rwc.Close()
+	}
+
+	// admin tasks are not served on listener with peers
+	client := NewClient(c.id2Addr(flrs[0].nid))
+	client.dial = ldr.dialFn
+	if _, err := client.GetInfo(); err == nil {
+		t.Fatal("admin task must not be served without authentication")
+	}
+
+	// wrong key of client or server
+	for _, wrong := range []uint64{ldr.nid, flrs[0].nid} {
+		peerKey := func(nid uint64) []byte {
+			if nid == wrong {
+				return []byte("wrong")
+			}
+			return keys[nid]
+		}
+		if err := heartbeat(newPool(peerKey)); err != (AuthError{flrs[0].nid, c.id2Addr(flrs[0].nid)}) {
+			t.Fatalf("wrong key of M%d: got %v, want AuthError", wrong, err)
+		}
+	}
+
+	// without authentication
+	if err := heartbeat(newPool(nil)); err == nil || isTimeout(err) {
+		t.Fatalf("got %v, want connection closed", err)
+	}
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20)
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Backoff configures exponential backoff, used by leader between
+// retries to a follower, after replication to it fails. The wait
+// after n-th consecutive failure is Base*2^(n-1), upto Max.
+type Backoff struct {
+	// Base is the wait after first failure.
+	// Zero value means 10ms.
+	Base time.Duration
+
+	// Max is the maximum wait.
+	// Zero value means HeartbeatTimeout/2.
+	Max time.Duration
+
+	// Jitter is the fraction in range [0, 1], by which each wait is
+	// randomly reduced. This avoids retries to followers happening
+	// in lockstep. Zero value means no jitter.
+	Jitter float64
+}
+
+func (b Backoff) validate() error {
+	if b.Base < 0 || b.Max < 0 {
+		return errors.New("raft.options: negative Backoff duration")
+	}
+	if b.Jitter < 0 || b.Jitter > 1 {
+		return fmt.Errorf("raft.options: Backoff.Jitter %v is not in range [0, 1]", b.Jitter)
+	}
+	return nil
+}
+
+// withDefaults returns copy of b with zero fields
+// replaced by their defaults.
+func (b Backoff) withDefaults(hbTimeout time.Duration) Backoff {
+	if b.Base == 0 {
+		b.Base = 10 * time.Millisecond
+	}
+	if b.Max == 0 {
+		b.Max = hbTimeout / 2
+	}
+	return b
+}
+
+// wait returns the duration to wait, after given
+// number of consecutive failures.
+func (b Backoff) wait(failures uint64, rt randTime) time.Duration {
+	d := b.Base
+	for i := uint64(1); i < failures && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d -= time.Duration(b.Jitter * rt.r.Float64() * float64(d))
+	}
+	return d
+}
+
+// CircuitBreaker stops leader from connecting to a follower, whose
+// address keeps failing, for example on DNS failures or connection
+// refused. After Failures consecutive connection failures, the circuit
+// is opened, and leader does not connect for Timeout. Then the circuit
+// is half-open, and leader tries to connect once. If it succeeds the
+// circuit is closed, otherwise it is opened again.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive connection failures to
+	// open the circuit. Zero value disables circuit breaker.
+	Failures int
+
+	// Timeout is how long the circuit stays open.
+	// Zero value means 10*HeartbeatTimeout.
+	Timeout time.Duration
+}
+
+func (cb CircuitBreaker) validate() error {
+	if cb.Failures < 0 {
+		return errors.New("raft.options: negative CircuitBreaker.Failures")
+	}
+	if cb.Timeout < 0 {
+		return errors.New("raft.options: negative CircuitBreaker.Timeout")
+	}
+	return nil
+}
+
+// withDefaults returns copy of cb with zero Timeout
+// replaced by its default.
+func (cb CircuitBreaker) withDefaults(hbTimeout time.Duration) CircuitBreaker {
+	if cb.Timeout == 0 {
+		cb.Timeout = 10 * hbTimeout
+	}
+	return cb
+}
+
+// RPCTimeouts configures I/O deadlines of requests sent by leader
+// to a follower. When a request times out, the connection is closed
+// and retried. Timeouts of requests carrying data are raised to the
+// time needed to transfer the data at Options.Bandwidth, if that is more.
+type RPCTimeouts struct {
+	// Heartbeat is the deadline for AppendEntriesRequest without
+	// entries, and its response. Zero value means 2*HeartbeatTimeout.
+	Heartbeat time.Duration
+
+	// AppendEntries is the deadline for AppendEntriesRequest with
+	// entries, and its response. Zero value means 2*HeartbeatTimeout.
+	AppendEntries time.Duration
+
+	// SnapshotChunk is the deadline for sending each chunk of snapshot.
+	// Zero value means 2*HeartbeatTimeout.
+	SnapshotChunk time.Duration
+
+	// InstallSnapshot is the deadline for the response after snapshot
+	// is sent, which includes the time follower takes to save it.
+	// Zero value means 4*HeartbeatTimeout.
+	InstallSnapshot time.Duration
+}
+
+func (t RPCTimeouts) validate() error {
+	if t.Heartbeat < 0 || t.AppendEntries < 0 || t.SnapshotChunk < 0 || t.InstallSnapshot < 0 {
+		return errors.New("raft.options: negative RPCTimeouts duration")
+	}
+	return nil
+}
+
+// withDefaults returns copy of t with zero fields
+// replaced by their defaults.
+func (t RPCTimeouts) withDefaults(hbTimeout time.Duration) RPCTimeouts {
+	if t.Heartbeat == 0 {
+		t.Heartbeat = 2 * hbTimeout
+	}
+	if t.AppendEntries == 0 {
+		t.AppendEntries = 2 * hbTimeout
+	}
+	if t.SnapshotChunk == 0 {
+		t.SnapshotChunk = 2 * hbTimeout
+	}
+	if t.InstallSnapshot == 0 {
+		t.InstallSnapshot = 4 * hbTimeout
+	}
+	return t
+}
+
+// BreakerState is the state of CircuitBreaker of a follower.
+type BreakerState uint8
+
+// CircuitBreaker states.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "halfOpen"
+	}
+	return fmt.Sprintf("BreakerState(%d)", s)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(s.String())), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *BreakerState) UnmarshalJSON(data []byte) error {
+	if len(data) < 2 || data[0] != '"' {
+		return errors.New("breakerState must be json string")
+	}
+	str, err := strconv.Unquote(string(data))
+	if err != nil {
+		return err
+	}
+	for _, st := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		if st.String() == str {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid breakerState %q", str)
+}
+
+// breaker tracks CircuitBreaker state of a follower.
+// it is owned by replication goroutine.
+type breaker struct {
+	CircuitBreaker
+	failures int
+	state    BreakerState
+}
+
+// onFailure records connection failure. returns
+// true if the circuit is opened now.
+func (b *breaker) onFailure() bool {
+	if b.Failures == 0 {
+		return false
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.Failures) {
+		b.state = BreakerOpen
+		return true
+	}
+	return false
+}
+
+// onSuccess records connection success. returns
+// true if the circuit is closed now.
+func (b *breaker) onSuccess() bool {
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.state = BreakerClosed
+		return true
+	}
+	return false
+}
+
+// breakerChanged is sent to leader, when
+// state of circuit breaker is changed.
+type breakerChanged struct {
+	state BreakerState
+}
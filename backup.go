@@ -0,0 +1,296 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/santhosh-tekuri/raft/log"
+)
+
+// backupHeader identifies the stream written by Backup task.
+// backupHeaderV1 is written by older versions, without vars.
+// backupHeaderV2 is written by older versions, without results.
+const (
+	backupHeader   = "raft.backup.v3"
+	backupHeaderV2 = "raft.backup.v2"
+	backupHeaderV1 = "raft.backup.v1"
+)
+
+// ErrBackupFormat is returned by Restore, if the given stream
+// is not written by Backup task.
+var ErrBackupFormat = plainError("raft.restore: invalid backup format")
+
+// backup stream format:
+//
+//   header
+//   cid nid
+//   term votedFor
+//   numVars [key value]...
+//   hasSnapshot [snapshotMeta numResults [client seq]... snapshotData]
+//   numEntries entry...
+func (r *Raft) onBackup(t backup) {
+	r.logger.Debug("taking backup", "commitIndex", r.commitIndex)
+	var snap *snapshot
+	if r.snaps.index > 0 {
+		s, err := r.snaps.open()
+		if err != nil {
+			t.reply(opError(err, "snapshots.open"))
+			return
+		}
+		snap = s
+	}
+
+	// committed entries are never removed by removeGTE
+	from := r.log.PrevIndex() + 1
+	if snap != nil && snap.meta.index >= from {
+		from = snap.meta.index + 1
+	}
+	reader, err := r.log.NewReader(from, r.commitIndex)
+	if err != nil {
+		if snap != nil {
+			snap.release()
+		}
+		t.reply(opError(err, "Log.NewReader(%d, %d)", from, r.commitIndex))
+		return
+	}
+
+	go func(term, votedFor, commitIndex uint64, vars map[string][]byte) {
+		defer reader.Close()
+		if snap != nil {
+			defer snap.release()
+		}
+		bufw := bufio.NewWriter(t.w)
+		err := writeBackup(bufw, r.cid, r.nid, term, votedFor, vars, snap, reader)
+		if err == nil {
+			err = bufw.Flush()
+		}
+		if err != nil {
+			t.reply(err)
+		} else {
+			t.reply(commitIndex)
+		}
+	}(r.term, r.votedFor, r.commitIndex, r.vars.clone())
+}
+
+func writeBackup(w io.Writer, cid, nid, term, votedFor uint64, vars map[string][]byte, snap *snapshot, reader *log.Reader) error {
+	if err := writeString(w, backupHeader); err != nil {
+		return err
+	}
+	for _, v := range []uint64{cid, nid, term, votedFor} {
+		if err := writeUint64(w, v); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := writeString(w, key); err != nil {
+			return err
+		}
+		if err := writeBytes(w, vars[key]); err != nil {
+			return err
+		}
+	}
+	if err := writeBool(w, snap != nil); err != nil {
+		return err
+	}
+	if snap != nil {
+		if err := snap.meta.encode(w); err != nil {
+			return err
+		}
+		if err := writeResultKeys(w, snap.meta.results); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, snap.data, snap.meta.size); err != nil {
+			return err
+		}
+	}
+	if err := writeUint64(w, reader.Count()); err != nil {
+		return err
+	}
+	for {
+		b, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return opError(err, "Log.Reader.Next")
+		}
+		if err := writeBytes(w, b); err != nil {
+			return err
+		}
+	}
+}
+
+// Restore restores storageDir from the stream written by Backup task.
+// The storageDir must be empty, i.e. it must not have identity, snapshots
+// or log entries.
+//
+// If the storageDir is already in use, returns ErrLockExists.
+// If the stream is not written by Backup, returns ErrBackupFormat.
+func Restore(opt Options, storageDir string, r io.Reader) (err error) {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	d, err := os.Stat(storageDir)
+	if err != nil {
+		return err
+	}
+	if !d.IsDir() {
+		return fmt.Errorf("raft: %q is not a diretory", storageDir)
+	}
+	if err := lockDir(storageDir); err != nil {
+		return err
+	}
+	defer func() {
+		if e := unlockDir(storageDir); err == nil {
+			err = e
+		}
+	}()
+	store, err := openStorage(storageDir, opt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := store.log.Close(); err == nil {
+			err = e
+		}
+	}()
+	if store.cid != 0 || store.nid != 0 || store.snaps.index != 0 || store.lastLogIndex != 0 {
+		return errors.New("raft.restore: storageDir is not empty")
+	}
+	return store.restore(bufio.NewReader(r))
+}
+
+func (s *storage) restore(r io.Reader) error {
+	header, err := readString(r)
+	if err != nil {
+		return err
+	}
+	if header != backupHeader && header != backupHeaderV2 && header != backupHeaderV1 {
+		return ErrBackupFormat
+	}
+	var v [4]uint64
+	for i := range v {
+		if v[i], err = readUint64(r); err != nil {
+			return err
+		}
+	}
+	cid, nid, term, votedFor := v[0], v[1], v[2], v[3]
+	if cid == 0 || nid == 0 {
+		return ErrBackupFormat
+	}
+
+	// vars ----------------
+	vars := make(map[string][]byte)
+	if header != backupHeaderV1 {
+		n, err := readUint32(r)
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			key, err := readString(r)
+			if err != nil {
+				return err
+			}
+			if vars[key], err = readBytes(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// snapshot ----------------
+	hasSnap, err := readBool(r)
+	if err != nil {
+		return err
+	}
+	if hasSnap {
+		meta := snapshotMeta{}
+		if err = meta.decode(r); err != nil {
+			return err
+		}
+		if header == backupHeader {
+			if meta.results, err = readResultKeys(r); err != nil {
+				return err
+			}
+		}
+		sink, err := s.snaps.new(meta.index, meta.term, meta.config)
+		if err != nil {
+			return opError(err, "snapshots.new")
+		}
+		sink.meta.results = meta.results
+		_, err = io.CopyN(sink.data, r, meta.size)
+		if _, doneErr := sink.done(err); err != nil {
+			return err
+		} else if doneErr != nil {
+			return opError(doneErr, "snapshotSink.done")
+		}
+		if err = s.log.Reset(meta.index); err != nil {
+			return opError(err, "Log.Reset(%d)", meta.index)
+		}
+		s.lastLogIndex, s.lastLogTerm = meta.index, meta.term
+	}
+
+	// log ----------------
+	n, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		b, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		e := &entry{}
+		if err = e.decode(bytes.NewReader(b)); err != nil {
+			return err
+		}
+		if e.index != s.lastLogIndex+1 {
+			return fmt.Errorf("raft.restore: got entry %d, want %d", e.index, s.lastLogIndex+1)
+		}
+		if err = s.log.Append(b); err != nil {
+			return opError(err, "Log.Append")
+		}
+		s.lastLogIndex, s.lastLogTerm = e.index, e.term
+	}
+	if err = s.log.Commit(); err != nil {
+		return opError(err, "Log.Commit")
+	}
+
+	// vars are set after log, because configs var refers to log
+	for key, val := range vars {
+		if err = s.vars.set(key, val); err != nil {
+			return err
+		}
+	}
+
+	// term and identity ----------------
+	if err = s.termVal.set(term, votedFor); err != nil {
+		return err
+	}
+	return s.idVal.set(cid, nid)
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRaft_backupRestore(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ResultCacheSize = 2
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	if _, err := waitFSMTask(ldr, UpdateFSMOnce(7, 1, []byte("update:0")), c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(11)
+	c.takeSnapshot(ldr, 0, nil)
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(21)
+
+	// vars must be backed up
+	c.shutdown(ldr)
+	vars, err := openVars(c.storage[ldr.nid])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vars.set("test.var", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	ldr = c.restart(ldr)
+	c.waitForLeader(ldr)
+
+	buf := new(bytes.Buffer)
+	index, err := waitTask(ldr, Backup(buf), c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != ldr.lastLogIndex {
+		t.Fatalf("backupIndex: got %d, want %d", index, ldr.lastLogIndex)
+	}
+	c.shutdown(ldr)
+
+	// restore into non-empty storageDir must fail
+	if err = Restore(c.opt, c.storage[ldr.nid], bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("restore into non-empty storageDir must fail")
+	}
+
+	storageDir, err := ioutil.TempDir(tempDir, "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(c.opt, storageDir, buf); err != nil {
+		t.Fatal(err)
+	}
+	if vars, err = openVars(storageDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := vars.get("test.var"); string(got) != "value" {
+		t.Fatalf("test.var: got %q, want %q", got, "value")
+	}
+
+	// results of snapshot must be backed up
+	err = withSnapshots(c.opt, storageDir, func(s *snapshots) error {
+		meta, err := s.meta()
+		if err == nil && !reflect.DeepEqual(meta.results, []resultKey{{7, 1}}) {
+			t.Fatalf("results: got %v, want %v", meta.results, []resultKey{{7, 1}})
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.storage[ldr.nid] = storageDir
+	r := c.restart(ldr)
+	c.waitFSMLen(21, r)
+	c.ensureFSMSame(fsm(ldr).commands(), r)
+}
+
+func TestMigrate(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.takeSnapshot(ldr, 0, nil)
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20)
+	c.shutdown(ldr)
+
+	// migrate into encrypted storage, with smaller segments
+	opt := c.opt
+	opt.EncryptionKeys = StaticKey(bytes.Repeat([]byte{7}, 32))
+	opt.LogSegmentSize = 1024
+	storageDir, err := ioutil.TempDir(tempDir, "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Migrate(c.opt, c.storage[ldr.nid], opt, storageDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// migrate into non-empty storageDir must fail
+	if err = Migrate(c.opt, c.storage[ldr.nid], opt, storageDir); err == nil {
+		t.Fatal("migrate into non-empty storageDir must fail")
+	}
+
+	c.opt = opt
+	c.storage[ldr.nid] = storageDir
+	r := c.restart(ldr)
+	c.waitFSMLen(20, r)
+	c.ensureFSMSame(fsm(ldr).commands(), r)
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// ApplyBatch task is used to apply multiple commands with single task.
+// The commands are appended as consecutive log entries, in given order,
+// and each of them eventually calls FSM.Update(cmd). This saves bulk
+// loaders from paying one round trip per command.
+//
+// The task is replied, when all commands are replied. Its Result is
+// []interface{} with result of each command, in given order. A command
+// that is rejected, for example with NotLeaderError, has that error as
+// its result. Err returns the first such error, if any.
+//
+// Note that the commands are not atomic: on leadership change, some of
+// them might be applied while others are not. Use ApplyCompositeBatch,
+// if all or none of the commands must be applied.
+func ApplyBatch(cmds [][]byte) FSMTask {
+	b := &batch{task: newTask(), results: make([]interface{}, len(cmds)), pending: len(cmds)}
+	var tail *newEntry
+	for i, cmd := range cmds {
+		ne := &newEntry{
+			task:  b.task,
+			entry: &entry{typ: entryUpdate, data: cmd},
+			batch: b,
+			pos:   i,
+		}
+		if tail != nil {
+			tail.next = ne
+		} else {
+			b.head = ne
+		}
+		tail = ne
+	}
+	if b.head == nil {
+		// nothing to apply, but task must still go through raft
+		b.head = &newEntry{task: b.task, entry: &entry{typ: entryBarrier}, batch: b, pos: -1}
+		b.pending = 1
+		tail = b.head
+	}
+	b.tail = tail
+	return b
+}
+
+// ApplyCompositeBatch task is same as ApplyBatch, but the commands are
+// appended as single log entry. Thus either all or none of them are
+// applied. FSM.Update is called for each command in given order, without
+// interleaving other entries.
+//
+// With PersistentFSM or EntryFSM, all commands of the batch are given the
+// index of that entry.
+//
+// Composite entries can be replicated only to nodes that support protocol
+// version 7. Use this, only after all nodes in cluster are upgraded.
+func ApplyCompositeBatch(cmds [][]byte) FSMTask {
+	b := &batch{task: newTask(), results: make([]interface{}, len(cmds)), pending: 1}
+	b.head = &newEntry{
+		task:  b.task,
+		entry: &entry{typ: entryBatch, data: encodeBatch(cmds)},
+		batch: b,
+		pos:   -1,
+	}
+	b.tail = b.head
+	return b
+}
+
+type batch struct {
+	*task
+	head *newEntry
+	tail *newEntry // last entry, its index is returned by Index
+
+	// entries are replied from both raft
+	// and fsm goroutines
+	mu      sync.Mutex
+	results []interface{}
+	pending int
+}
+
+func (b *batch) newEntry() *newEntry {
+	return b.head
+}
+
+func (b *batch) Index() uint64 { return b.tail.Index() }
+func (b *batch) Term() uint64  { return b.tail.Term() }
+
+func (b *batch) Err() error {
+	for _, result := range b.results {
+		if err, ok := result.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batch) Result() interface{} {
+	return b.results
+}
+
+// set records the result of given entry of the batch. The
+// task is replied, when results of all entries are set.
+func (b *batch) set(ne *newEntry, result interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending == 0 {
+		return
+	}
+	if ne.pos >= 0 {
+		b.results[ne.pos] = result
+	} else if results, ok := result.([]interface{}); ok {
+		copy(b.results, results)
+	} else {
+		// composite entry is rejected
+		for i := range b.results {
+			b.results[i] = result
+		}
+	}
+	b.pending--
+	if b.pending == 0 {
+		b.task.reply(b.results)
+	}
+}
+
+// reply is used, when the batch is rejected as a whole,
+// without submitting its entries.
+func (b *batch) reply(result interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending == 0 {
+		return
+	}
+	for i := range b.results {
+		b.results[i] = result
+	}
+	b.pending = 0
+	b.task.reply(b.results)
+}
+
+// encodeBatch encodes the commands of composite entry.
+func encodeBatch(cmds [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	if err := writeUint32(buf, uint32(len(cmds))); err != nil {
+		panic(err)
+	}
+	for _, cmd := range cmds {
+		if err := writeBytes(buf, cmd); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeBatch(b []byte) ([][]byte, error) {
+	r := bytes.NewBuffer(b)
+	size, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	// each command needs atleast its length
+	if uint64(size)*4 > uint64(r.Len()) {
+		return nil, fmt.Errorf("raft: batch with %d commands exceeds %d bytes", size, r.Len())
+	}
+	cmds := make([][]byte, size)
+	for i := range cmds {
+		if cmds[i], err = readBytes(r); err != nil {
+			return nil, err
+		}
+	}
+	return cmds, nil
+}
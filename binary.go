@@ -15,35 +15,58 @@
 package raft
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"sync"
 )
 
 // byteOrder used for encode/decode
 var byteOrder = binary.LittleEndian
 
+// maxBytes is the maximum length of bytes or string decoded.
+// length is read from network/disk, so it is not trusted.
+const maxBytes = 1 << 30
+
+// scratchPool provides buffers for encoding fixed size values.
+// slices passed to io.Reader or io.Writer escape to heap, so
+// they are pooled to avoid allocation per value.
+var scratchPool = sync.Pool{
+	New: func() interface{} { return new(scratch) },
+}
+
+// scratch is large enough to hold entry header, see entry.encode.
+type scratch [64]byte
+
+func getScratch() *scratch  { return scratchPool.Get().(*scratch) }
+func putScratch(b *scratch) { scratchPool.Put(b) }
+
 func readUint64(r io.Reader) (uint64, error) {
-	b := make([]byte, 8)
-	if _, err := io.ReadFull(r, b); err != nil {
+	b := getScratch()
+	defer putScratch(b)
+	if _, err := io.ReadFull(r, b[:8]); err != nil {
 		return 0, err
 	}
-	return byteOrder.Uint64(b), nil
+	return byteOrder.Uint64(b[:8]), nil
 }
 
 func readUint32(r io.Reader) (uint32, error) {
-	b := make([]byte, 4)
-	if _, err := io.ReadFull(r, b); err != nil {
+	b := getScratch()
+	defer putScratch(b)
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
 		return 0, err
 	}
-	return byteOrder.Uint32(b), nil
+	return byteOrder.Uint32(b[:4]), nil
 }
 
 func readUint8(r io.Reader) (uint8, error) {
 	if r, ok := r.(io.ByteReader); ok {
 		return r.ReadByte()
 	}
-	b := make([]byte, 1)
-	if _, err := io.ReadFull(r, b); err != nil {
+	b := getScratch()
+	defer putScratch(b)
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
 		return 0, err
 	}
 	return b[0], nil
@@ -55,15 +78,44 @@ func readBool(r io.Reader) (bool, error) {
 }
 
 func readBytes(r io.Reader) ([]byte, error) {
+	return readBytesInto(r, nil)
+}
+
+// readBytesInto is same as readBytes, but reuses buf
+// if it has enough capacity.
+func readBytesInto(r io.Reader, buf []byte) ([]byte, error) {
 	size, err := readUint32(r)
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, size)
-	if _, err := io.ReadFull(r, b); err != nil {
+	if int(size) <= cap(buf) {
+		b := buf[:size]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	if size > maxBytes {
+		return nil, fmt.Errorf("raft: length %d exceeds limit %d", size, maxBytes)
+	}
+	if size <= 64*1024 {
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	// large size: allocate as we read, rather than trusting size
+	large := new(bytes.Buffer)
+	n, err := io.Copy(large, io.LimitReader(r, int64(size)))
+	if err != nil {
 		return nil, err
 	}
-	return b, nil
+	if n != int64(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return large.Bytes(), nil
 }
 
 func readString(r io.Reader) (string, error) {
@@ -74,16 +126,18 @@ func readString(r io.Reader) (string, error) {
 // -----------------------------------------------------
 
 func writeUint64(w io.Writer, v uint64) error {
-	b := make([]byte, 8)
-	byteOrder.PutUint64(b, v)
-	_, err := w.Write(b)
+	b := getScratch()
+	defer putScratch(b)
+	byteOrder.PutUint64(b[:8], v)
+	_, err := w.Write(b[:8])
 	return err
 }
 
 func writeUint32(w io.Writer, v uint32) error {
-	b := make([]byte, 4)
-	byteOrder.PutUint32(b, v)
-	_, err := w.Write(b)
+	b := getScratch()
+	defer putScratch(b)
+	byteOrder.PutUint32(b[:4], v)
+	_, err := w.Write(b[:4])
 	return err
 }
 
@@ -91,8 +145,10 @@ func writeUint8(w io.Writer, v uint8) error {
 	if w, ok := w.(io.ByteWriter); ok {
 		return w.WriteByte(v)
 	}
-	b := []byte{v}
-	_, err := w.Write(b)
+	b := getScratch()
+	defer putScratch(b)
+	b[0] = v
+	_, err := w.Write(b[:1])
 	return err
 }
 
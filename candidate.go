@@ -14,18 +14,87 @@
 
 package raft
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 type candidate struct {
 	*Raft
 	respCh      chan rpcResponse
 	votesNeeded int
-	transfer    bool // to set voteReq.transfer
+	transfer    bool  // to set voteReq.transfer
+	campaign    *task // see Campaign, replied when current election is over
+
+	// raft.election span of current election.
+	// nil if no election is in progress
+	span    Span
+	granted int
+	denied  int
+
+	// denied votes, by likely cause. see lostCause
+	staleLog  int
+	splitVote int
+
+	// when voteReqs are sent, used to compute vote latencies
+	sent    time.Time
+	pending int // number of voteReqs, not yet responded
+}
+
+func (c *candidate) init() { c.startElection() }
+
+func (c *candidate) onTimeout() {
+	// no quorum of votes within election timeout,
+	// probably split vote
+	c.electionLost("timeout")
+	c.startElection()
+}
+
+func (c *candidate) release() {
+	switch {
+	case c.state == Leader:
+		c.electionWon()
+	case c.leader != 0:
+		c.electionLost("leaderKnown")
+	case c.isClosed():
+		c.electionLost("shutdown")
+	default:
+		c.electionLost("staleTerm")
+	}
+	c.respCh, c.transfer = nil, false
+}
+
+func (r *Raft) onCampaign(t campaign) {
+	switch r.state {
+	case Leader:
+		t.reply(nil)
+		return
+	case Candidate:
+		if r.cnd.campaign != nil {
+			t.reply(InProgressError("campaign"))
+			return
+		}
+		r.cnd.campaign = t.task
+		return
+	}
+	if can, reason := r.flr.canStartElection(); !can {
+		t.reply(plainError("raft.campaign: " + reason))
+		return
+	}
+	r.logger.Info("campaign requested")
+	r.setState(Candidate)
+	r.setLeader(0)
+	r.cnd.campaign = t.task
 }
 
-func (c *candidate) init()      { c.startElection() }
-func (c *candidate) onTimeout() { c.startElection() }
-func (c *candidate) release()   { c.respCh, c.transfer = nil, false }
+// replyCampaign replies the pending Campaign task, if any.
+func (c *candidate) replyCampaign(err error) {
+	if c.campaign != nil {
+		c.campaign.reply(err)
+		c.campaign = nil
+	}
+}
 
 func (c *candidate) startElection() {
 	assert(c.configs.Latest.isVoter(c.nid))
@@ -40,47 +109,63 @@ func (c *candidate) startElection() {
 		from:     c.nid,
 	}
 
-	if trace {
-		println(c, "startElection")
-	}
-	d := c.rtime.duration(c.hbTimeout)
-	deadline := time.Now().Add(d)
+	c.logger.Debug("starting election")
+	d := c.electionTimeout()
+	c.sent = c.clock.Now()
+	deadline := c.sent.Add(d)
 	c.timer.reset(d)
-	c.logger.Info("started election for term", c.term)
+	c.logger.Info("started election")
 	if tracer.electionStarted != nil {
 		tracer.electionStarted(c.Raft)
 	}
+	_, c.span = c.tracing.Start(context.Background(), "raft.election")
+	c.span.SetAttribute("raft.term", c.term)
+	c.span.SetAttribute("raft.lastLogIndex", c.lastLogIndex)
+	c.span.SetAttribute("raft.lastLogTerm", c.lastLogTerm)
+	c.span.SetAttribute("raft.transfer", c.transfer)
+	c.granted, c.denied, c.pending = 0, 0, 0
+	c.staleLog, c.splitVote = 0, 0
+	c.voterLogs = make(map[uint64]uint64)
 
-	// send RequestVote RPCs to all other servers
+	// send RequestVote RPCs to all other servers concurrently.
+	// election is won as soon as quorum of votes are granted,
+	// without waiting for remaining responses
 	req := &voteReq{
-		req:          req{c.term, c.nid},
+		req:          req{term: c.term, src: c.nid},
 		lastLogIndex: c.lastLogIndex,
 		lastLogTerm:  c.lastLogTerm,
 		transfer:     c.transfer,
 	}
 	for _, n := range c.configs.Latest.Nodes {
 		if n.Voter && n.ID != c.nid {
-			if trace {
-				println(c, n, ">>", req)
-			}
+			c.logger.Debug("requesting vote", "peer", n.ID, "req", req)
 			pool := c.getConnPool(n.ID)
-			go func(ch chan<- rpcResponse) {
+			c.pending++
+			go func(req voteReq, ch chan<- rpcResponse) {
+				// req is copied, because doRPC sets its trace
 				resp := &voteResp{}
-				err := pool.doRPC(req, resp, deadline)
+				err := pool.doRPC(&req, resp, deadline)
 				ch <- rpcResponse{resp, pool.nid, err}
-			}(c.respCh)
+			}(*req, c.respCh)
 		}
 	}
 }
 
 func (c *candidate) onVoteResult(resp rpcResponse) {
-	if trace && resp.from != c.nid {
-		println(c, resp)
+	var latency time.Duration
+	if resp.from != c.nid {
+		c.pending--
+		latency = c.clock.Now().Sub(c.sent)
+		c.logger.Debug("received vote", "peer", resp.from, "resp", resp.response, "err", resp.err, "latency", latency)
+		c.span.SetAttribute(fmt.Sprintf("raft.vote.%d.latency", resp.from), latency)
 	}
 	if resp.err != nil {
-		c.logger.Warn("requestVote node", resp.from, ": "+trimPrefix(resp.err))
+		c.logger.Warn("requestVote failed", "peer", resp.from, "err", resp.err)
 		return
 	}
+	if resp.from != c.nid {
+		c.onVote(resp.from, resp.response.(*voteResp), latency)
+	}
 
 	// if response contains term T > currentTerm:
 	// set currentTerm = T, convert to follower
@@ -99,3 +184,105 @@ func (c *candidate) onVoteResult(resp rpcResponse) {
 		}
 	}
 }
+
+func (c *candidate) onVote(from uint64, resp *voteResp, latency time.Duration) {
+	if resp.version >= protocolV11 {
+		c.voterLogs[from] = resp.lastLogIndex
+	}
+	result := resp.result
+	if result == success {
+		c.granted++
+		c.logger.Debug("vote granted", "peer", from, "latency", latency)
+		if tracer.voteGranted != nil {
+			tracer.voteGranted(c.Raft, from, latency)
+		}
+		return
+	}
+	c.denied++
+	switch {
+	case result == logNotUptodate, resp.lastLogTerm > c.lastLogTerm,
+		resp.lastLogTerm == c.lastLogTerm && resp.lastLogIndex > c.lastLogIndex:
+		// voter has more up-to-date log, it never votes for us
+		c.staleLog++
+	case result == alreadyVoted:
+		c.splitVote++
+	}
+	if resp.version >= protocolV11 {
+		c.span.SetAttribute(fmt.Sprintf("raft.vote.%d.lastLogIndex", from), resp.lastLogIndex)
+		c.span.SetAttribute(fmt.Sprintf("raft.vote.%d.lastLogTerm", from), resp.lastLogTerm)
+		c.span.SetAttribute(fmt.Sprintf("raft.vote.%d.commitIndex", from), resp.commitIndex)
+		c.logger.Info("vote denied", "peer", from, "reason", result.String(),
+			"peerLastIndex", resp.lastLogIndex, "peerLastTerm", resp.lastLogTerm, "peerCommit", resp.commitIndex,
+			"lastIndex", c.lastLogIndex, "lastTerm", c.lastLogTerm)
+	} else {
+		c.logger.Info("vote denied", "peer", from, "reason", result.String())
+	}
+	if tracer.voteDenied != nil {
+		tracer.voteDenied(c.Raft, from, result.String(), latency)
+	}
+}
+
+func (c *candidate) electionWon() {
+	if c.span == nil {
+		return
+	}
+	c.logger.Info("won election")
+	if tracer.electionWon != nil {
+		tracer.electionWon(c.Raft)
+	}
+	c.endSpan("won")
+	c.replyCampaign(nil)
+}
+
+// electionLost is called when current election, if any,
+// did not make us leader.
+func (c *candidate) electionLost(reason string) {
+	if c.span == nil {
+		return
+	}
+	var cause string
+	if reason == "timeout" {
+		cause = c.lostCause()
+		c.span.SetAttribute("raft.lostCause", cause)
+		c.logger.Info("lost election", "reason", reason, "cause", cause)
+	} else {
+		c.logger.Info("lost election", "reason", reason)
+	}
+	if tracer.electionLost != nil {
+		tracer.electionLost(c.Raft, reason, cause)
+	}
+	c.endSpan(reason)
+	if reason == "shutdown" {
+		c.replyCampaign(ErrServerClosed)
+	} else {
+		c.replyCampaign(ErrCampaignLost)
+	}
+}
+
+// lostCause tells why the election timed out without quorum of votes:
+//
+//     staleLog     some voter has more up-to-date log than ours
+//     splitVote    some voter already voted for another candidate
+//     unreachable  quorum of voters did not respond
+//     denied       votes denied for other reasons, like leaderKnown
+func (c *candidate) lostCause() string {
+	switch {
+	case c.staleLog > 0:
+		return "staleLog"
+	case c.splitVote > 0:
+		return "splitVote"
+	case 1+c.granted+c.denied < c.configs.Latest.quorum():
+		return "unreachable"
+	default:
+		return "denied"
+	}
+}
+
+func (c *candidate) endSpan(result string) {
+	c.span.SetAttribute("raft.votesGranted", c.granted)
+	c.span.SetAttribute("raft.votesDenied", c.denied)
+	c.span.SetAttribute("raft.votesPending", c.pending)
+	c.span.SetAttribute("raft.result", result)
+	c.span.End()
+	c.span = nil
+}
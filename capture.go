@@ -0,0 +1,353 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// If Options.CaptureFile is set, the requests and responses sent and
+// received by node are recorded in that file, to debug problems such
+// as election storms, that are hard to reproduce. Use ReadCapture to
+// read it, and Replayer to send the recorded requests to another node.
+//
+// The file starts with header:
+//
+//     magic    6 bytes, see captureMagic
+//     version  1 byte, captureVersion
+//
+// followed by records:
+//
+//     time     8 bytes, unix nanos
+//     flags    1 byte, CaptureKind in low bits, captureInbound bit
+//     type     1 byte, rpcType
+//     version  1 byte, protocol version of message
+//     peer     8 bytes, id of other node, zero if not known
+//     size     4 bytes, length of data
+//     data     size bytes, encoded message, or raw log entry
+//
+// When file size exceeds Options.CaptureSize, it is renamed with ".1"
+// suffix, replacing the previous one, and new file is started. Auth
+// requests and snapshot data are never recorded.
+var captureMagic = [6]byte{'R', 'F', 'T', 'C', 'A', 'P'}
+
+const (
+	captureVersion     = 1
+	captureHeaderSize  = len(captureMagic) + 1
+	captureRecordSize  = 8 + 1 + 1 + 1 + 8 + 4
+	captureInbound     = 0x80
+	defaultCaptureSize = 64 * 1024 * 1024
+)
+
+// CaptureKind tells what a CaptureRecord contains.
+type CaptureKind uint8
+
+const (
+	// CaptureRequest is rpc request.
+	CaptureRequest CaptureKind = iota + 1
+
+	// CaptureResponse is rpc response.
+	CaptureResponse
+
+	// CaptureEntry is log entry sent with appendEntries request.
+	// They are recorded only if Options.CaptureEntries is set.
+	CaptureEntry
+)
+
+func (k CaptureKind) String() string {
+	switch k {
+	case CaptureRequest:
+		return "request"
+	case CaptureResponse:
+		return "response"
+	case CaptureEntry:
+		return "entry"
+	}
+	return fmt.Sprintf("CaptureKind(%d)", uint8(k))
+}
+
+// capture records rpc messages into file. Methods of nil capture
+// are no-op, so that callers need not check if it is enabled.
+type capture struct {
+	path    string
+	maxSize int64
+	entries bool // see Options.CaptureEntries
+	clock   Clock
+	logger  Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	buf  bytes.Buffer
+	err  error // first write error, disables capture
+}
+
+func openCapture(path string, maxSize int64, entries bool, clock Clock, logger Logger) (*capture, error) {
+	c := &capture{path: path, maxSize: maxSize, entries: entries, clock: clock, logger: logger}
+	if err := c.create(); err != nil {
+		return nil, opError(err, "capture.create")
+	}
+	return c, nil
+}
+
+// create truncates file, and writes header.
+func (c *capture) create() error {
+	f, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	c.f, c.w, c.size = f, bufio.NewWriter(f), int64(captureHeaderSize)
+	if _, err = c.w.Write(captureMagic[:]); err != nil {
+		return err
+	}
+	if err = c.w.WriteByte(captureVersion); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// roll moves current file aside, and starts new file.
+func (c *capture) roll() error {
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return err
+	}
+	return c.create()
+}
+
+// message records encoded m.
+func (c *capture) message(inbound bool, kind CaptureKind, typ rpcType, peer uint64, m message) {
+	if c == nil || typ == rpcAuth {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.Reset()
+	if err := m.encode(&c.buf); err != nil {
+		return
+	}
+	c.write(inbound, kind, typ, m.getVersion(), peer, c.buf.Bytes())
+}
+
+// logEntries records log entries in buffs, if Options.CaptureEntries is set.
+func (c *capture) logEntries(inbound bool, peer uint64, buffs ...[]byte) {
+	if c == nil || !c.entries {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range buffs {
+		for len(b) > 0 {
+			n, _, err := nextEntry(b)
+			if err != nil {
+				return
+			}
+			c.write(inbound, CaptureEntry, rpcAppendEntries, 0, peer, b[:n])
+			b = b[n:]
+		}
+	}
+}
+
+// must be called with c.mu locked.
+func (c *capture) write(inbound bool, kind CaptureKind, typ rpcType, version uint8, peer uint64, data []byte) {
+	if c.err != nil {
+		return
+	}
+	flags := uint8(kind)
+	if inbound {
+		flags |= captureInbound
+	}
+	var hdr [captureRecordSize]byte
+	byteOrder.PutUint64(hdr[0:], uint64(c.clock.Now().UnixNano()))
+	hdr[8], hdr[9], hdr[10] = flags, uint8(typ), version
+	byteOrder.PutUint64(hdr[11:], peer)
+	byteOrder.PutUint32(hdr[19:], uint32(len(data)))
+	err := func() error {
+		if c.size > c.maxSize {
+			if err := c.roll(); err != nil {
+				return err
+			}
+		}
+		if _, err := c.w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+		c.size += int64(len(hdr) + len(data))
+		return c.w.Flush()
+	}()
+	if err != nil {
+		c.err = err
+		c.logger.Warn("capture disabled", "err", err)
+	}
+}
+
+func (c *capture) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = errors.New("raft: capture closed")
+	}
+	return c.f.Close()
+}
+
+// respType returns the rpcType of response.
+func respType(resp response) rpcType {
+	switch resp.(type) {
+	case *identityResp:
+		return rpcIdentity
+	case *voteResp:
+		return rpcVote
+	case *appendResp:
+		return rpcAppendEntries
+	case *installSnapResp:
+		return rpcInstallSnap
+	case *timeoutNowResp:
+		return rpcTimeoutNow
+	case *sendSnapResp:
+		return rpcSendSnap
+	}
+	return rpcAuth // not recorded
+}
+
+// ------------------------------------------------------------------------
+
+// CaptureRecord is a record in file written by Options.CaptureFile.
+type CaptureRecord struct {
+	Time    time.Time
+	Inbound bool // received by node, otherwise sent
+	Kind    CaptureKind
+	Type    string // type of rpc, such as "vote" and "append"
+	Peer    uint64 // id of other node, zero if not known
+	Term    uint64 // term in message, zero for CaptureEntry
+	Data    []byte // encoded message, or raw log entry
+
+	typ     rpcType
+	version uint8
+}
+
+func (rec CaptureRecord) String() string {
+	dir := ">>"
+	if rec.Inbound {
+		dir = "<<"
+	}
+	return fmt.Sprintf("%s %s M%d %s %s term:%d size:%d", rec.Time.Format(time.RFC3339Nano), dir, rec.Peer, rec.Type, rec.Kind, rec.Term, len(rec.Data))
+}
+
+// decode returns the message in record. It returns nil for CaptureEntry.
+func (rec CaptureRecord) decode() (message, error) {
+	var m message
+	switch rec.Kind {
+	case CaptureRequest:
+		m = rec.typ.createReq()
+	case CaptureResponse:
+		switch rec.typ {
+		case rpcIdentity:
+			m = &identityResp{}
+		case rpcVote:
+			m = &voteResp{}
+		case rpcAppendEntries:
+			m = &appendResp{}
+		case rpcInstallSnap:
+			m = &installSnapResp{}
+		case rpcTimeoutNow:
+			m = &timeoutNowResp{}
+		case rpcSendSnap:
+			m = &sendSnapResp{}
+		default:
+			return nil, fmt.Errorf("raft: invalid response type %s in capture", rec.typ)
+		}
+		m.setVersion(rec.version)
+	default:
+		return nil, nil
+	}
+	r := bytes.NewReader(rec.Data)
+	if err := m.decode(r); err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("raft: %d trailing bytes in captured %s %s", r.Len(), rec.typ, rec.Kind)
+	}
+	return m, nil
+}
+
+// ReadCapture reads the records from file written by Options.CaptureFile,
+// and calls fn for each record in order.
+func ReadCapture(r io.Reader, fn func(rec CaptureRecord) error) error {
+	br := bufio.NewReader(r)
+	var hdr [captureRecordSize]byte
+	if _, err := io.ReadFull(br, hdr[:captureHeaderSize]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:len(captureMagic)], captureMagic[:]) {
+		return errors.New("raft: not a capture file")
+	}
+	if v := hdr[len(captureMagic)]; v != captureVersion {
+		return fmt.Errorf("raft: unsupported capture version %d", v)
+	}
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		kind := CaptureKind(hdr[8] &^ captureInbound)
+		typ := rpcType(hdr[9])
+		if kind < CaptureRequest || kind > CaptureEntry || !typ.isValid() {
+			return fmt.Errorf("raft: invalid capture record {flags: %d, type: %d}", hdr[8], hdr[9])
+		}
+		rec := CaptureRecord{
+			Time:    time.Unix(0, int64(byteOrder.Uint64(hdr[0:]))),
+			Inbound: hdr[8]&captureInbound != 0,
+			Kind:    kind,
+			Type:    typ.String(),
+			Peer:    byteOrder.Uint64(hdr[11:]),
+			Data:    make([]byte, byteOrder.Uint32(hdr[19:])),
+			typ:     typ,
+			version: hdr[10],
+		}
+		if _, err := io.ReadFull(br, rec.Data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		m, err := rec.decode()
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			rec.Term = m.getTerm()
+		}
+		if err = fn(rec); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRaft_capture(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCluster(t)
+	ldr, _ := c.ensureLaunch(2)
+	defer c.shutdown()
+
+	// launch M3 with capture enabled
+	c.opt.CaptureFile = filepath.Join(dir, "m3.cap")
+	c.opt.CaptureEntries = true
+	m3 := c.launch(1, false)[3]
+	c.opt.CaptureFile, c.opt.CaptureEntries = "", false
+	c.waitCommitReady(ldr)
+	c.ensure(c.waitAddNonvoter(ldr, 3, c.id2Addr(3), false))
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10, m3)
+	c.shutdown(m3)
+
+	f, err := os.Open(filepath.Join(dir, "m3.cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	count := make(map[string]int)
+	err = ReadCapture(f, func(rec CaptureRecord) error {
+		if rec.Peer != ldr.nid {
+			t.Fatalf("record from M%d, want M%d: %v", rec.Peer, ldr.nid, rec)
+		}
+		dir := "out"
+		if rec.Inbound {
+			dir = "in"
+		}
+		count[dir+" "+rec.Type+" "+rec.Kind.String()]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(count)
+	if count["in identity request"] == 0 || count["out identity response"] == 0 {
+		t.Fatal("identity handshake must be recorded")
+	}
+	if count["in append request"] == 0 || count["in append request"] != count["out append response"] {
+		t.Fatal("append requests and responses must be recorded")
+	}
+	if count["in append entry"] < 10 {
+		t.Fatalf("entries: got %d, want >=10", count["in append entry"])
+	}
+}
+
+func TestCapture_roll(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "raft.cap")
+	c, err := openCapture(path, 100, false, realClock{}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &voteReq{req: req{version: maxProtocol, term: 5, src: 2}, lastLogIndex: 10, lastLogTerm: 4}
+	for i := 0; i < 10; i++ {
+		c.message(true, CaptureRequest, rpcVote, 2, req)
+	}
+	if err = c.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both files must be readable, with records in order
+	n := 0
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ReadCapture(f, func(rec CaptureRecord) error {
+			n++
+			if !rec.Inbound || rec.Kind != CaptureRequest || rec.Type != "vote" || rec.Peer != 2 || rec.Term != 5 {
+				t.Fatalf("got %v", rec)
+			}
+			return nil
+		})
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n == 0 || n > 10 {
+		t.Fatalf("records: got %d, want in (0,10]", n)
+	}
+}
@@ -16,69 +16,91 @@ package raft
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"sort"
 	"time"
 )
 
 func (l *leader) onChangeConfig(t changeConfig) {
-	if !l.configs.IsCommitted() {
-		t.reply(InProgressError("configChange"))
+	if err := l.validateConfigChange(t.newConf); err != nil {
+		t.reply(err)
 		return
 	}
+
+	if l.precheck && !t.prechecked {
+		if nodes := l.nodesToPrecheck(t.newConf); len(nodes) > 0 {
+			go l.Raft.precheckConfig(t, nodes)
+			return
+		}
+	}
+
+	l.checkConfigActions(t.task, t.newConf)
+	if l.configs.IsCommitted() {
+		l.logger.Debug("no config actions changed")
+		// no actions changed, so commit as it is
+		l.doChangeConfig(t.task, t.newConf)
+	}
+}
+
+// validateConfigChange checks whether leader can change latest
+// config to newConf.
+func (l *leader) validateConfigChange(newConf Config) error {
+	if !l.configs.IsCommitted() {
+		return InProgressError("configChange")
+	}
 	// see https://groups.google.com/forum/#!msg/raft-dev/t4xj6dJTP6E/d2D9LrWRza8J
 	if l.commitIndex < l.startIndex {
-		t.reply(ErrNotCommitReady)
-		return
+		return ErrNotCommitReady
 	}
-	if t.newConf.Index != l.configs.Latest.Index {
-		t.reply(ErrStaleConfig)
-		return
+	if newConf.Index != l.configs.Latest.Index {
+		return ErrStaleConfig
 	}
-	if err := t.newConf.validate(); err != nil {
-		t.reply(err)
-		return
+	if err := newConf.validate(); err != nil {
+		return err
 	}
 
 	// ensure that except action, address nothing is modified
 	for id, n := range l.configs.Latest.Nodes {
-		nn, ok := t.newConf.Nodes[id]
+		nn, ok := newConf.Nodes[id]
 		if !ok {
-			t.reply(fmt.Errorf("raft.changeConfig: node %d is removed", id))
-			return
+			return fmt.Errorf("raft.changeConfig: node %d is removed", id)
 		}
 		if n.Voter != nn.Voter {
-			t.reply(fmt.Errorf("raft.changeConfig: node %d voting right changed", id))
-			return
+			return fmt.Errorf("raft.changeConfig: node %d voting right changed", id)
 		}
 	}
-	for id, n := range t.newConf.Nodes {
+	for id, n := range newConf.Nodes {
 		if _, ok := l.configs.Latest.Nodes[id]; !ok {
 			if n.Voter {
-				t.reply(fmt.Errorf("raft.changeConfig: new node %d must be nonvoter", id))
-				return
+				return fmt.Errorf("raft.changeConfig: new node %d must be nonvoter", id)
 			}
 		}
 	}
 
 	// ensure that new cluster will have at least one voter
 	var voter uint64
-	for id, n := range t.newConf.Nodes {
+	for id, n := range newConf.Nodes {
 		if n.Voter && n.Action == None {
 			voter = id
 		}
 	}
 	if voter == 0 {
-		t.reply(fmt.Errorf("raft.changeConfig: at least one voter must remain in cluster"))
-		return
+		return fmt.Errorf("raft.changeConfig: at least one voter must remain in cluster")
 	}
+	return nil
+}
 
-	l.checkConfigActions(t.task, t.newConf)
-	if l.configs.IsCommitted() {
-		if trace {
-			println(l, "no configActions changed")
+// nodesToPrecheck returns the nodes in newConf, that are new
+// or whose address is changed. see Options.PrecheckNodes
+func (l *leader) nodesToPrecheck(newConf Config) []Node {
+	var nodes []Node
+	for id, n := range newConf.Nodes {
+		if old, ok := l.configs.Latest.Nodes[id]; !ok || old.Addr != n.Addr {
+			nodes = append(nodes, n)
 		}
-		// no actions changed, so commit as it is
-		l.doChangeConfig(t.task, t.newConf)
 	}
+	return nodes
 }
 
 func (l *leader) doChangeConfig(t *task, config Config) {
@@ -93,10 +115,8 @@ func (l *leader) beginFinishedRounds() {
 	for id, repl := range l.repls {
 		r := repl.status.round
 		if r != nil && r.finished() {
-			r.begin(l.lastLogIndex)
-			if trace {
-				println(l, id, "started:", r)
-			}
+			r.begin(l.clock.Now(), repl.status.matchIndex, l.lastLogIndex)
+			l.logger.Debug("round started", "peer", id, "round", r.Ordinal)
 		}
 	}
 }
@@ -108,13 +128,12 @@ func (l *leader) beginFinishedRounds() {
 // - from leader.changeConfig
 // - from leader.setCommitIndex, if config is committed
 // - from leader.onTransferTimeout
+// - on leader.promoteTimer
 func (l *leader) checkConfigActions(t *task, config Config) {
 	// do actions on self if any
 	n := config.Nodes[l.nid]
 	if l.canChangeConfig() && n.Action != None {
-		if trace {
-			println(l, n.ID, "started", n.Action)
-		}
+		l.logger.Debug("config action started", "peer", n.ID, "action", n.Action.String())
 		if tracer.configActionStarted != nil {
 			tracer.configActionStarted(l.Raft, n.ID, n.Action)
 		}
@@ -141,7 +160,7 @@ func (l *leader) checkConfigActions(t *task, config Config) {
 }
 
 // checks whether round is completed, if so
-// promotes if threshold is satisfied.
+// promotes if PromotionPolicy is satisfied.
 //
 // - from leader.checkReplUpdates, if repl.matchIndex is updated
 // - from leader.checkConfigActions
@@ -158,66 +177,66 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 	} else if status.round == nil {
 		// start first round
 		status.round = new(round)
-		status.round.begin(l.lastLogIndex)
-		if trace {
-			println(l, status.id, "started:", status.round)
-		}
+		status.round.begin(l.clock.Now(), status.matchIndex, l.lastLogIndex)
+		l.logger.Debug("round started", "peer", status.id, "round", status.round.Ordinal)
 	}
 
 	// finish round if completed, start new round if necessary
 	if status.round != nil {
 		r := status.round
 		if !r.finished() && status.matchIndex >= r.LastIndex {
-			r.finish()
-			if trace {
-				println(l, status.id, "finished:", r)
-			}
-			l.logger.Info("nonVoter", status.id, "completed round", r.Ordinal, "in", r.Duration(), ", its lastIndex:", r.LastIndex)
+			r.finish(l.clock.Now())
+			l.logger.Info("nonvoter completed round", "peer", status.id, "round", r.Ordinal, "duration", r.Duration(), "lastIndex", r.LastIndex)
 			if tracer.roundCompleted != nil {
 				tracer.roundCompleted(l.Raft, status.id, *r)
 			}
+			l.alerts.CatchupProgress(status.id, l.catchupProgress(status))
 		}
 		if !r.finished() {
 			return
 		}
-		hasNewEntries := l.lastLogIndex > status.matchIndex
-		if hasNewEntries && r.Duration() > l.promoteThreshold {
-			r.begin(l.lastLogIndex)
-			if trace {
-				println(l, status.id, "started:", r)
+		if action == Promote {
+			p := l.promotionProgress(status)
+			if !l.promotionPolicy(n).Promote(p) {
+				l.logger.Debug("promotion postponed", "peer", status.id, "lag", p.Lag)
+				if p.Lag > 0 {
+					r.begin(l.clock.Now(), status.matchIndex, l.lastLogIndex)
+					l.logger.Debug("round started", "peer", status.id, "round", r.Ordinal)
+				} else if !l.promoteTimer.active {
+					// no new entries to start round, check later
+					l.promoteTimer.reset(l.hbTimeout / 2)
+				}
+				return
 			}
-			return
 		}
 	}
 
 	if !l.canChangeConfig() {
-		if trace {
-			println(l, status.id, "cannot", action, "now")
-		}
+		l.logger.Debug("config action postponed", "peer", status.id, "action", action.String())
 		return
 	}
 
 	// perform configAction
 	switch action {
 	case Promote:
-		l.logger.Info("promoting nonvoter ", n.ID, ", after", status.round.Ordinal, "round(s)")
+		l.logger.Info("promoting nonvoter", "peer", n.ID, "rounds", status.round.Ordinal)
 		config = config.clone()
 		n.Voter, n.Action = true, None
 		config.Nodes[n.ID] = n
 	case Remove:
 		if status.matchIndex >= l.configs.Latest.Index {
-			l.logger.Info("removing nonvoter", n.ID)
+			l.logger.Info("removing nonvoter", "peer", n.ID)
 			config = config.clone()
 			delete(config.Nodes, n.ID)
 		} else {
 			return
 		}
 	case ForceRemove:
-		l.logger.Info("force removing node", n.ID)
+		l.logger.Info("force removing node", "peer", n.ID)
 		config = config.clone()
 		delete(config.Nodes, n.ID)
 	case Demote:
-		l.logger.Info("demoting voter", n.ID)
+		l.logger.Info("demoting voter", "peer", n.ID)
 		config = config.clone()
 		n.Voter = false
 		if n.Action == Demote {
@@ -225,9 +244,7 @@ func (l *leader) checkConfigAction(t *task, config Config, status *replicationSt
 		}
 		config.Nodes[n.ID] = n
 	}
-	if trace {
-		println(l, status.id, "started", action)
-	}
+	l.logger.Debug("config action started", "peer", status.id, "action", action.String())
 	if tracer.configActionStarted != nil {
 		tracer.configActionStarted(l.Raft, n.ID, action)
 	}
@@ -246,19 +263,154 @@ func (l *leader) onWaitForStableConfig(t waitForStableConfig) {
 	l.waitStable = append(l.waitStable, t)
 }
 
+// plan ------------------------------------------------
+
+// StepKind tells what is done in a ConfigStep.
+type StepKind uint8
+
+const (
+	// StepPrecheck means that the node is checked using PrecheckNode,
+	// because it is new or its address is changed. It is planned only
+	// if Options.PrecheckNodes is true.
+	StepPrecheck StepKind = iota
+
+	// StepAddNonvoter means that the node is added as nonvoter. The
+	// node is added by StepCommit, that follows.
+	StepAddNonvoter
+
+	// StepCommit means that new config is appended and committed. Any
+	// further steps are done by leader, each as a separate config change.
+	StepCommit
+
+	// StepWaitRounds means that leader replicates to the nonvoter in
+	// rounds, until its PromotionPolicy is satisfied.
+	StepWaitRounds
+
+	// StepPromote means that the nonvoter is promoted to voter.
+	StepPromote
+
+	// StepDemote means that the voter is demoted to nonvoter.
+	StepDemote
+
+	// StepRemove means that the nonvoter is removed, once it has
+	// replicated the config.
+	StepRemove
+
+	// StepForceRemove means that the node is removed immediately.
+	StepForceRemove
+)
+
+func (k StepKind) String() string {
+	switch k {
+	case StepPrecheck:
+		return "precheck"
+	case StepAddNonvoter:
+		return "addNonvoter"
+	case StepCommit:
+		return "commit"
+	case StepWaitRounds:
+		return "waitRounds"
+	case StepPromote:
+		return "promote"
+	case StepDemote:
+		return "demote"
+	case StepRemove:
+		return "remove"
+	case StepForceRemove:
+		return "forceRemove"
+	}
+	return fmt.Sprintf("StepKind(%d)", k)
+}
+
+// ConfigStep is a step, that leader would take to apply a config change.
+// See PlanConfigChange.
+type ConfigStep struct {
+	Kind StepKind `json:"kind"`
+	Node uint64   `json:"node,omitempty"` // zero for StepCommit
+}
+
+func (s ConfigStep) String() string {
+	if s.Kind == StepCommit {
+		return s.Kind.String()
+	}
+	return fmt.Sprintf("%s M%d", s.Kind, s.Node)
+}
+
+func (l *leader) onPlanConfigChange(t planConfigChange) {
+	if err := l.validateConfigChange(t.newConf); err != nil {
+		t.reply(err)
+		return
+	}
+	t.reply(l.planConfigChange(t.newConf))
+}
+
+// planConfigChange returns the steps to change latest config to
+// newConf, which must be validated. The actions of nodes are planned
+// in the order, checkConfigActions would perform them: leader first,
+// and then others in ascending order of their ids.
+func (l *leader) planConfigChange(newConf Config) []ConfigStep {
+	var steps []ConfigStep
+	if l.precheck {
+		for _, n := range l.nodesToPrecheck(newConf) {
+			steps = append(steps, ConfigStep{StepPrecheck, n.ID})
+		}
+		sortSteps(steps)
+	}
+	added := len(steps)
+	for id := range newConf.Nodes {
+		if _, ok := l.configs.Latest.Nodes[id]; !ok {
+			steps = append(steps, ConfigStep{StepAddNonvoter, id})
+		}
+	}
+	sortSteps(steps[added:])
+	steps = append(steps, ConfigStep{Kind: StepCommit})
+
+	ids := make([]uint64, 0, len(newConf.Nodes))
+	for id := range newConf.Nodes {
+		if id != l.nid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	ids = append([]uint64{l.nid}, ids...)
+	for _, id := range ids {
+		n := newConf.Nodes[id]
+		switch n.nextAction() {
+		case Promote:
+			steps = append(steps, ConfigStep{StepWaitRounds, id}, ConfigStep{StepPromote, id})
+		case Demote:
+			steps = append(steps, ConfigStep{StepDemote, id})
+			if n.Action == Remove {
+				steps = append(steps, ConfigStep{StepRemove, id})
+			}
+		case Remove:
+			steps = append(steps, ConfigStep{StepRemove, id})
+		case ForceRemove:
+			steps = append(steps, ConfigStep{StepForceRemove, id})
+		}
+	}
+	return steps
+}
+
+func sortSteps(steps []ConfigStep) {
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Node < steps[j].Node })
+}
+
 // round ------------------------------------------------
 
 type round struct {
-	Ordinal   uint64
-	Start     time.Time
-	End       time.Time
-	LastIndex uint64
+	Ordinal    uint64
+	Start      time.Time
+	End        time.Time
+	StartIndex uint64
+	LastIndex  uint64
 }
 
-func (r *round) begin(lastIndex uint64) {
-	r.Ordinal, r.Start, r.LastIndex = r.Ordinal+1, time.Now(), lastIndex
+func (r *round) begin(now time.Time, startIndex, lastIndex uint64) {
+	r.Ordinal, r.Start, r.End = r.Ordinal+1, now, time.Time{}
+	r.StartIndex, r.LastIndex = startIndex, lastIndex
 }
-func (r *round) finish()                { r.End = time.Now() }
+func (r *round) finish(now time.Time)   { r.End = now }
 func (r *round) finished() bool         { return !r.End.IsZero() }
 func (r round) Duration() time.Duration { return r.End.Sub(r.Start) }
 
@@ -268,3 +420,121 @@ func (r round) String() string {
 	}
 	return fmt.Sprintf("round{#%d lastIndex: %d}", r.Ordinal, r.LastIndex)
 }
+
+// CatchupProgress captures progress of a nonvoter, that is catching
+// up with leader's log, before it is promoted. Leader replicates to
+// such nonvoter in rounds, see PromotionPolicy.
+type CatchupProgress struct {
+	Round      uint64        `json:"round"`      // ordinal of current round
+	StartIndex uint64        `json:"startIndex"` // matchIndex when current round started
+	LastIndex  uint64        `json:"lastIndex"`  // round completes when matchIndex reaches this
+	Start      time.Time     `json:"start"`      // time when current round started
+	Duration   time.Duration `json:"duration"`   // elapsed duration of current round
+	Finished   bool          `json:"finished,omitempty"`
+
+	// Lag is the number of entries, nonvoter is behind leader's log.
+	Lag uint64 `json:"lag"`
+
+	// Rate is the number of entries per second replicated in current
+	// round. ETA is the estimated time to catch up Lag at that rate.
+	// They are zero, if nothing is replicated in current round.
+	Rate float64       `json:"rate,omitempty"`
+	ETA  time.Duration `json:"eta,omitempty"`
+}
+
+func (p CatchupProgress) String() string {
+	return fmt.Sprintf("round #%d, %d entries behind, ETA %s", p.Round, p.Lag, p.ETA)
+}
+
+func (p *CatchupProgress) decode(r io.Reader) error {
+	var err error
+	if p.Round, err = readUint64(r); err != nil {
+		return err
+	}
+	if p.StartIndex, err = readUint64(r); err != nil {
+		return err
+	}
+	if p.LastIndex, err = readUint64(r); err != nil {
+		return err
+	}
+	unixNano, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	p.Start = time.Unix(0, int64(unixNano))
+	d, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	p.Duration = time.Duration(d)
+	if p.Finished, err = readBool(r); err != nil {
+		return err
+	}
+	if p.Lag, err = readUint64(r); err != nil {
+		return err
+	}
+	rate, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	p.Rate = math.Float64frombits(rate)
+	eta, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	p.ETA = time.Duration(eta)
+	return nil
+}
+
+func (p *CatchupProgress) encode(w io.Writer) error {
+	if err := writeUint64(w, p.Round); err != nil {
+		return err
+	}
+	if err := writeUint64(w, p.StartIndex); err != nil {
+		return err
+	}
+	if err := writeUint64(w, p.LastIndex); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(p.Start.UnixNano())); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(p.Duration)); err != nil {
+		return err
+	}
+	if err := writeBool(w, p.Finished); err != nil {
+		return err
+	}
+	if err := writeUint64(w, p.Lag); err != nil {
+		return err
+	}
+	if err := writeUint64(w, math.Float64bits(p.Rate)); err != nil {
+		return err
+	}
+	return writeUint64(w, uint64(p.ETA))
+}
+
+// catchupProgress returns the progress of nonvoter in current round.
+func (l *leader) catchupProgress(status *replicationStatus) CatchupProgress {
+	r := status.round
+	p := CatchupProgress{
+		Round:      r.Ordinal,
+		StartIndex: r.StartIndex,
+		LastIndex:  r.LastIndex,
+		Start:      time.Unix(0, r.Start.UnixNano()),
+		Finished:   r.finished(),
+	}
+	if p.Finished {
+		p.Duration = r.Duration()
+	} else {
+		p.Duration = l.clock.Now().Sub(r.Start)
+	}
+	if l.lastLogIndex > status.matchIndex {
+		p.Lag = l.lastLogIndex - status.matchIndex
+	}
+	if status.matchIndex > r.StartIndex && p.Duration > 0 {
+		p.Rate = float64(status.matchIndex-r.StartIndex) / p.Duration.Seconds()
+		p.ETA = time.Duration(float64(p.Lag) / p.Rate * float64(time.Second))
+	}
+	return p
+}
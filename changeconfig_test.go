@@ -15,6 +15,7 @@
 package raft
 
 import (
+	"context"
 	"reflect"
 	"testing"
 	"time"
@@ -97,6 +98,188 @@ func TestChangeConfig_validations(t *testing.T) {
 	}
 }
 
+func TestChangeConfig_plan(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+
+	latest := c.info(ldr).Configs.Latest
+	config := c.info(ldr).Configs.Latest
+	c.ensure(config.AddNonvoter(4, c.id2Addr(4), true))
+	c.ensure(config.SetAction(flrs[0].NID(), Remove))
+	steps, err := ldr.PlanConfigChange(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flr := flrs[0].NID()
+	want := []ConfigStep{
+		{StepAddNonvoter, 4},
+		{Kind: StepCommit},
+		{StepDemote, flr},
+		{StepRemove, flr},
+		{StepWaitRounds, 4},
+		{StepPromote, 4},
+	}
+	if !reflect.DeepEqual(steps, want) {
+		t.Fatalf("steps:\n got %v\nwant %v", steps, want)
+	}
+
+	// nothing is applied
+	if got := c.info(ldr).Configs.Latest; !reflect.DeepEqual(got, latest) {
+		t.Fatalf("latest config: got %v, want %v", got, latest)
+	}
+
+	// validated as ChangeConfig
+	stale := config.clone()
+	stale.Index--
+	if _, err := ldr.PlanConfigChange(ctx, stale); err != ErrStaleConfig {
+		t.Fatalf("err: got %v, want %v", err, ErrStaleConfig)
+	}
+	noVoter := latest.clone()
+	for id := range noVoter.Nodes {
+		c.ensure(noVoter.SetAction(id, Demote))
+	}
+	if _, err := ldr.PlanConfigChange(ctx, noVoter); err == nil {
+		t.Fatal("plan without voter must fail")
+	}
+	if _, err := flrs[1].PlanConfigChange(ctx, config); err == nil {
+		t.Fatal("plan on follower must fail")
+	}
+}
+
+func TestChangeConfig_tags(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+
+	// config without tags must be encoded as before
+	config := c.info(ldr).Configs.Latest
+	if size := byteOrder.Uint32(config.encode().data); size != uint32(len(config.Nodes)) {
+		t.Fatalf("#nodes: got %#x, want %d", size, len(config.Nodes))
+	}
+
+	// setting tags on non existing node should fail
+	if err := config.SetTags(10, map[string]string{"zone": "a"}); err == nil {
+		t.Fatal("error expected")
+	}
+	// setting tag with empty key should fail
+	if err := config.SetTags(flrs[0].nid, map[string]string{"": "a"}); err == nil {
+		t.Fatal("error expected")
+	}
+
+	tags := map[string]string{"zone": "a", "rack": "r1"}
+	if err := config.SetTags(flrs[0].nid, tags); err != nil {
+		t.Fatal(err)
+	}
+	if clone := config.clone(); !reflect.DeepEqual(clone.Nodes[flrs[0].nid].Tags, tags) {
+		t.Fatalf("clone.tags: got %v, want %v", clone.Nodes[flrs[0].nid].Tags, tags)
+	} else {
+		clone.Nodes[flrs[0].nid].Tags["zone"] = "b"
+		if config.Nodes[flrs[0].nid].Tags["zone"] != "a" {
+			t.Fatal("clone must not share tags")
+		}
+	}
+	c.ensure(waitTask(ldr, ChangeConfig(config), c.longTimeout))
+	c.ensure(waitTask(ldr, WaitForStableConfig(), c.longTimeout))
+
+	// tags must be replicated, and survive restart
+	c.waitCatchup()
+	flrs[1] = c.restart(flrs[1])
+	for _, r := range c.rr {
+		if got := c.info(r).Configs.Latest.Nodes[flrs[0].nid].Tags; !reflect.DeepEqual(got, tags) {
+			t.Fatalf("M%d: tags of M%d: got %v, want %v", r.nid, flrs[0].nid, got, tags)
+		}
+	}
+
+	// empty value removes tag
+	config = c.info(ldr).Configs.Latest
+	if err := config.SetTags(flrs[0].nid, map[string]string{"rack": ""}); err != nil {
+		t.Fatal(err)
+	}
+	c.ensure(waitTask(ldr, ChangeConfig(config), c.longTimeout))
+	want := map[string]string{"zone": "a"}
+	if got := c.info(ldr).Configs.Latest.Nodes[flrs[0].nid].Tags; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tags: got %v, want %v", got, want)
+	}
+}
+
+func TestConfig_criticalZones(t *testing.T) {
+	config := Config{Nodes: map[uint64]Node{}}
+	add := func(id uint64, voter bool, zone string) {
+		n := Node{ID: id, Voter: voter}
+		if zone != "" {
+			n.Tags = map[string]string{"zone": zone}
+		}
+		config.Nodes[id] = n
+	}
+	tests := []struct {
+		nodes []string // zone of each voter, "-" for nonvoter in zone a
+		want  []string
+	}{
+		{[]string{"", "", ""}, nil},
+		{[]string{"a", "b", "c"}, nil},
+		{[]string{"a", "a", "b"}, []string{"a"}},
+		{[]string{"a", "a", ""}, []string{"a"}},
+		{[]string{"a", "b", "-", "-"}, []string{"a", "b"}},
+		{[]string{"a", "a", "b", "b", "c"}, nil},
+		{[]string{"a", "a", "a", "b", "c"}, []string{"a"}},
+	}
+	for _, test := range tests {
+		config.Nodes = map[uint64]Node{}
+		for i, zone := range test.nodes {
+			if zone == "-" {
+				add(uint64(i+1), false, "a")
+			} else {
+				add(uint64(i+1), true, zone)
+			}
+		}
+		if got := config.CriticalZones("zone"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.nodes, got, test.want)
+		}
+	}
+}
+
+func TestChangeConfig_criticalZones(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+
+	criticalZones := c.registerFor(eventCriticalZones, ldr)
+	defer c.unregister(criticalZones)
+	setZones := func(zones ...string) {
+		t.Helper()
+		config := c.info(ldr).Configs.Latest
+		for i, r := range append([]*Raft{ldr}, flrs...) {
+			if err := config.SetTags(r.nid, map[string]string{"zone": zones[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.ensure(waitTask(ldr, ChangeConfig(config), c.longTimeout))
+	}
+
+	// two of three voters in same zone
+	setZones("a", "a", "b")
+	e, err := criticalZones.waitForEvent(c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.zones, []string{"a"}) {
+		t.Fatalf("zones: got %v, want [a]", e.zones)
+	}
+
+	// warned only when critical zones change
+	setZones("a", "a", "c")
+	setZones("a", "b", "c")
+	if e, err = criticalZones.waitForEvent(c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.zones) != 0 {
+		t.Fatalf("zones: got %v, want none", e.zones)
+	}
+}
+
 func TestChangeConfig_trace(t *testing.T) {
 	// launch 2 node cluster M1, M2
 	c, ldr, followers := launchCluster(t, 2)
@@ -250,6 +433,199 @@ func TestChangeConfig_promote_newNode_singleRound(t *testing.T) {
 	}
 }
 
+// tests that PromotionPolicy postpones promotion of nonvoter,
+// until it is satisfied, even when there are no new entries
+func TestChangeConfig_promote_policy(t *testing.T) {
+	// launch 3 node cluster, M4 needs uptime to be promoted
+	c := newCluster(t)
+	minUptime := 2 * c.heartbeatTimeout
+	c.opt.PromotionPolicy = func(n Node) PromotionPolicy {
+		if n.ID == 4 {
+			return ThresholdPolicy{MinUptime: minUptime}
+		}
+		return nil
+	}
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// wait until leader is commit ready
+	c.waitCommitReady(ldr)
+
+	roundCompleted := c.registerFor(eventRoundFinished, ldr)
+	defer c.unregister(roundCompleted)
+	promoting := c.registerFor(eventConfigActionStarted, ldr)
+	defer c.unregister(promoting)
+
+	// add M4 as nonvoter with promote=true
+	c.launch(1, false)
+	start := time.Now()
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), true))
+
+	// first round must complete, but not promote
+	if _, err := roundCompleted.waitForEvent(c.longTimeout); err != nil {
+		t.Fatalf("waitForRoundComplete: %v", err)
+	}
+
+	// wait until leader promotes M4, after its uptime
+	e, err := promoting.waitForEvent(c.longTimeout)
+	if err != nil {
+		t.Fatalf("waitForPromoting: %v", err)
+	}
+	if e.target != 4 || e.action != Promote {
+		t.Fatalf("configAction: got M%d %v, want M4 Promote", e.target, e.action)
+	}
+	if e.numRounds != 1 {
+		t.Fatalf("M4 round: got %d, want %d", e.numRounds, 1)
+	}
+	if d := time.Since(start); d < minUptime {
+		t.Fatalf("promoted after %s, want >= %s", d, minUptime)
+	}
+}
+
+// tests that progress of nonvoter catching up is reported
+// in Info and via Alerts.CatchupProgress
+func TestChangeConfig_promote_catchupProgress(t *testing.T) {
+	// launch 3 node cluster, with some updates
+	c, ldr, _ := launchCluster(t, 3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 20)
+	c.waitFSMLen(20)
+
+	progress := make(chan CatchupProgress, 10)
+	alerts := c.alerts[ldr.nid]
+	alerts.mu.Lock()
+	alerts.catchupProgress = func(id uint64, p CatchupProgress) {
+		if id == 4 {
+			progress <- p
+		}
+	}
+	alerts.mu.Unlock()
+
+	// add M4 as nonvoter with promote=true, without launching it
+	_ = c.addNonvoter(ldr, 4, c.id2Addr(4), true)
+	var catchup *CatchupProgress
+	waitForCondition(func() bool {
+		client := NewClient(c.id2Addr(ldr.nid))
+		client.dial = ldr.dialFn
+		info, err := client.GetInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		catchup = info.Followers[4].Catchup
+		return catchup != nil
+	}, c.commitTimeout, c.longTimeout)
+	if catchup == nil {
+		t.Fatal("info must report catchup progress of M4")
+	}
+	if catchup.Round != 1 || catchup.Finished {
+		t.Fatalf("catchup: got round %d finished %v, want round 1 unfinished", catchup.Round, catchup.Finished)
+	}
+	if catchup.Lag < 20 {
+		t.Fatalf("catchup.Lag: got %d, want >= 20", catchup.Lag)
+	}
+
+	// launch M4, its round must complete
+	c.launch(1, false)
+	select {
+	case p := <-progress:
+		if p.Round != 1 || !p.Finished {
+			t.Fatalf("progress: got round %d finished %v, want round 1 finished", p.Round, p.Finished)
+		}
+		if p.LastIndex != catchup.LastIndex {
+			t.Fatalf("progress.LastIndex: got %d, want %d", p.LastIndex, catchup.LastIndex)
+		}
+	case <-time.After(c.longTimeout):
+		t.Fatal("CatchupProgress alert not raised")
+	}
+
+	// once promoted, info must not report catchup
+	c.waitForStableConfig(ldr)
+	if catchup := c.info(ldr).Followers[4].Catchup; catchup != nil {
+		t.Fatalf("catchup: got %v, want nil", catchup)
+	}
+}
+
+// tests that config changes are reported on all nodes
+// via Alerts.MembershipChanged
+func TestChangeConfig_membershipChanged(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+
+	changes := make(map[uint64]chan MembershipChange)
+	for _, r := range []*Raft{ldr, flrs[0]} {
+		ch := make(chan MembershipChange, 10)
+		changes[r.nid] = ch
+		alerts := c.alerts[r.nid]
+		alerts.mu.Lock()
+		alerts.membershipChanged = func(c MembershipChange) {
+			// follower may learn commit of bootstrap config late
+			if _, ok := c.New.Nodes[4]; ok {
+				ch <- c
+			}
+		}
+		alerts.mu.Unlock()
+	}
+
+	// add M4 with promote=true, and wait until it is promoted
+	c.launch(1, false)
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), true))
+	c.waitForStableConfig(ldr)
+
+	want := []struct {
+		event  ConfigEvent
+		reason ChangeReason
+	}{
+		{ConfigChanged, ReasonAdd},
+		{ConfigCommitted, ReasonAdd},
+		{ConfigChanged, ReasonPromote},
+		{ConfigCommitted, ReasonPromote},
+	}
+	for id, ch := range changes {
+		for i, w := range want {
+			select {
+			case got := <-ch:
+				if got.Event != w.event || got.Reason != w.reason {
+					t.Fatalf("M%d change[%d]: got %s(%s), want %s(%s)", id, i, got.Event, got.Reason, w.event, w.reason)
+				}
+				if n := got.New.Nodes[4]; n.Voter != (w.reason == ReasonPromote) {
+					t.Fatalf("M%d change[%d]: got M4 %v, in %v", id, i, n, got.New)
+				}
+				if _, ok := got.Old.Nodes[4]; ok == (i < 2) {
+					t.Fatalf("M%d change[%d]: old %v", id, i, got.Old)
+				}
+			case <-time.After(c.longTimeout):
+				t.Fatalf("M%d change[%d]: timeout", id, i)
+			}
+		}
+	}
+}
+
+func TestThresholdPolicy(t *testing.T) {
+	second := time.Second
+	tests := []struct {
+		policy ThresholdPolicy
+		p      PromotionProgress
+		want   bool
+	}{
+		{ThresholdPolicy{}, PromotionProgress{Rounds: 1, Round: second, Lag: 10}, true},
+		{ThresholdPolicy{RoundThreshold: second}, PromotionProgress{Rounds: 1, Round: 2 * second, Lag: 10}, false},
+		{ThresholdPolicy{RoundThreshold: second}, PromotionProgress{Rounds: 1, Round: 2 * second}, true},
+		{ThresholdPolicy{RoundThreshold: second}, PromotionProgress{Rounds: 1, Round: second / 2, Lag: 10}, true},
+		{ThresholdPolicy{MinRounds: 3}, PromotionProgress{Rounds: 2}, false},
+		{ThresholdPolicy{MinRounds: 3}, PromotionProgress{Rounds: 3}, true},
+		{ThresholdPolicy{MaxLag: 5}, PromotionProgress{Rounds: 1, Lag: 6}, false},
+		{ThresholdPolicy{MaxLag: 5}, PromotionProgress{Rounds: 1, Lag: 5}, true},
+		{ThresholdPolicy{MinUptime: second}, PromotionProgress{Rounds: 1, Uptime: second / 2}, false},
+		{ThresholdPolicy{MinUptime: second}, PromotionProgress{Rounds: 1, Uptime: second}, true},
+	}
+	for _, test := range tests {
+		if got := test.policy.Promote(test.p); got != test.want {
+			t.Errorf("%+v.Promote(%s): got %v, want %v", test.policy, test.p, got, test.want)
+		}
+	}
+}
+
 // todo: test promote newNode multipleRounds
 
 func TestChangeConfig_promote_newNode_uptodateButConfigChangeInProgress(t *testing.T) {
@@ -345,11 +721,6 @@ func TestChangeConfig_removeVoters(t *testing.T) {
 	// wait for commit ready
 	c.waitCommitReady(ldr)
 
-	electionAborted0 := c.registerFor(eventElectionAborted, flrs[0])
-	defer c.unregister(electionAborted0)
-	electionAborted1 := c.registerFor(eventElectionAborted, flrs[1])
-	defer c.unregister(electionAborted1)
-
 	// submit ChangeConfig with two voters removed
 	config := c.info(ldr).Configs.Latest
 	if err := config.SetAction(flrs[0].nid, Remove); err != nil {
@@ -363,25 +734,16 @@ func TestChangeConfig_removeVoters(t *testing.T) {
 	// wait for stable config
 	c.ensure(waitTask(ldr, WaitForStableConfig(), c.longTimeout))
 
-	// ensure that removed nodes aborted election
-	e, err := electionAborted0.waitForEvent(c.longTimeout)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if e.reason != "not voter" {
-		c.Fatalf("reason=%q, want %q", e.reason, "not part of cluster")
-	}
-	_, err = electionAborted1.waitForEvent(c.longTimeout)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if e.reason != "not voter" {
-		c.Fatalf("reason=%q, want %q", e.reason, "not part of cluster")
+	// ensure that removed nodes learn that they are removed
+	for _, r := range flrs[:2] {
+		if !waitForCondition(r.isClosed, c.commitTimeout, c.longTimeout) {
+			t.Fatalf("M%d is not shutdown after removal", r.nid)
+		}
+		if got := c.serveError(r); got != ErrNodeRemoved {
+			t.Fatalf("M%d.serve=%v, want ErrNodeRemoved", r.nid, got)
+		}
 	}
 
-	// shutdown the removed nodes
-	c.shutdown(flrs[0], flrs[1])
-
 	// shutdown the leader
 	c.shutdown(ldr)
 
@@ -389,6 +751,29 @@ func TestChangeConfig_removeVoters(t *testing.T) {
 	c.waitForLeader(flrs[2], flrs[3])
 }
 
+// tests that new node catching up does not shutdown on committing
+// configs that were created before it is added
+func TestChangeConfig_shutdownOnRemove_newNode(t *testing.T) {
+	// launch 3 node cluster
+	c, ldr, _ := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// send more updates than that fit in single appendReq, so
+	// that new node commits bootstrap config in first batch
+	updates := 2 * maxAppendEntries
+	c.waitTaskDone(c.sendUpdates(ldr, 1, updates), c.longTimeout, nil)
+
+	// add M4 as nonvoter, and wait for it to catch up
+	m4 := c.launch(1, false)[4]
+	c.ensure(c.waitAddNonvoter(ldr, m4.nid, c.id2Addr(m4.nid), false))
+	c.waitFSMLen(uint64(updates), m4)
+
+	// ensure that M4 is not shutdown
+	if m4.isClosed() {
+		t.Fatalf("M4 is shutdown: %v", c.serveError(m4))
+	}
+}
+
 func TestChangeConfig_removeLeader(t *testing.T) {
 	// launch 3 node cluster
 	c, ldr, _ := launchCluster(t, 3)
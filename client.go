@@ -38,7 +38,8 @@ func NewClient(addr string) *Client {
 }
 
 func (c *Client) getConn() (*conn, error) {
-	netConn, err := c.dial("tcp", c.addr, 5*time.Second)
+	network, address := splitAddr(c.addr)
+	netConn, err := c.dial(network, address, 5*time.Second)
 	if err != nil {
 		return nil, err
 	}
@@ -156,6 +157,7 @@ func (c *Client) TakeSnapshot(threshold uint64) (snapIndex uint64, err error) {
 // This task returns just error if any.
 //
 // During trasfer, leader rejects any new FSMTasks with InProgressError("transferLeadership").
+// Read tasks are handled as per Options.TransferReads.
 //
 // TimeoutError: leadership failed to transfer in specified timeout.
 // ErrTransferNoVoter: number of voters in cluster is one.
@@ -186,6 +188,119 @@ func (c *Client) TransferLeadership(target uint64, timeout time.Duration) error
 	return err
 }
 
+// StepDown makes the leader convert to follower, and waits until
+// new leader is known. See StepDown task for details.
+func (c *Client) StepDown(transfer bool, timeout time.Duration) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.rwc.Close()
+
+	if err = conn.bufw.WriteByte(byte(taskStepDown)); err != nil {
+		return err
+	}
+	if err = writeBool(conn.bufw, transfer); err != nil {
+		return err
+	}
+	if err = writeUint64(conn.bufw, uint64(timeout)); err != nil {
+		return err
+	}
+	if err = conn.bufw.Flush(); err != nil {
+		return err
+	}
+	_, err = decodeTaskResp(taskStepDown, conn.bufr)
+	return err
+}
+
+// Pause puts the node in maintenance mode. If the node is leader,
+// leadership is transferred first. See Pause task for details.
+func (c *Client) Pause(timeout time.Duration) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.rwc.Close()
+
+	if err = conn.bufw.WriteByte(byte(taskPause)); err != nil {
+		return err
+	}
+	if err = writeUint64(conn.bufw, uint64(timeout)); err != nil {
+		return err
+	}
+	if err = conn.bufw.Flush(); err != nil {
+		return err
+	}
+	_, err = decodeTaskResp(taskPause, conn.bufr)
+	return err
+}
+
+// Resume resumes the node paused earlier.
+func (c *Client) Resume() error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.rwc.Close()
+
+	if err = conn.bufw.WriteByte(byte(taskResume)); err != nil {
+		return err
+	}
+	if err = conn.bufw.Flush(); err != nil {
+		return err
+	}
+	_, err = decodeTaskResp(taskResume, conn.bufr)
+	return err
+}
+
+// Campaign makes the node start election immediately, and waits
+// for its outcome. See Campaign task for details.
+func (c *Client) Campaign() error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.rwc.Close()
+
+	if err = conn.bufw.WriteByte(byte(taskCampaign)); err != nil {
+		return err
+	}
+	if err = conn.bufw.Flush(); err != nil {
+		return err
+	}
+	_, err = decodeTaskResp(taskCampaign, conn.bufr)
+	return err
+}
+
+// GetLogEntries returns log entries from index from to index to,
+// both inclusive. The range is trimmed to the entries currently
+// available in log.
+func (c *Client) GetLogEntries(from, to uint64) ([]LogEntry, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.rwc.Close()
+
+	if err = conn.bufw.WriteByte(byte(taskGetLogEntries)); err != nil {
+		return nil, err
+	}
+	if err = writeUint64(conn.bufw, from); err != nil {
+		return nil, err
+	}
+	if err = writeUint64(conn.bufw, to); err != nil {
+		return nil, err
+	}
+	if err = conn.bufw.Flush(); err != nil {
+		return nil, err
+	}
+	result, err := decodeTaskResp(taskGetLogEntries, conn.bufr)
+	if err != nil {
+		return nil, err
+	}
+	return result.([]LogEntry), nil
+}
+
 // ------------------------------------------------------------------------
 
 type taskType byte
@@ -196,49 +311,148 @@ const (
 	taskWaitForStableConfig
 	taskTakeSnapshot
 	taskTransferLdr
+	taskGetLogEntries
+	taskPause
+	taskResume
+	taskCampaign
+	taskStepDown
 )
 
 func (t taskType) isValid() bool {
 	switch t {
-	case taskInfo, taskChangeConfig, taskWaitForStableConfig, taskTakeSnapshot, taskTransferLdr:
+	case taskInfo, taskChangeConfig, taskWaitForStableConfig, taskTakeSnapshot, taskTransferLdr, taskGetLogEntries,
+		taskPause, taskResume, taskCampaign, taskStepDown:
 		return true
 	}
 	return false
 }
 
-func decodeTaskResp(typ taskType, r io.Reader) (interface{}, error) {
-	errType, err := readString(r)
+// errCode identifies the type of error in task response.
+type errCode uint8
+
+const (
+	codeNone errCode = iota
+	codeNotLeader
+	codePlain
+	codeTemporary
+	codeInProgress
+	codeTimeout
+	codeOp
+	codeOther
+)
+
+func encodeError(err error, w io.Writer) error {
+	var code errCode
+	switch err.(type) {
+	case nil:
+		return writeUint8(w, uint8(codeNone))
+	case NotLeaderError:
+		code = codeNotLeader
+	case plainError:
+		code = codePlain
+	case temporaryError:
+		code = codeTemporary
+	case InProgressError:
+		code = codeInProgress
+	case TimeoutError:
+		code = codeTimeout
+	case OpError:
+		code = codeOp
+	default:
+		code = codeOther
+	}
+	if err := writeUint8(w, uint8(code)); err != nil {
+		return err
+	}
+	switch err := err.(type) {
+	case NotLeaderError:
+		if err := err.Leader.encode(w); err != nil {
+			return err
+		}
+		if err := writeUint64(w, err.Term); err != nil {
+			return err
+		}
+		if err := writeBool(w, err.Lost); err != nil {
+			return err
+		}
+		return writeBool(w, err.Retryable)
+	case InProgressError:
+		return writeString(w, string(err))
+	case TimeoutError:
+		return writeString(w, string(err))
+	case OpError:
+		if err := writeString(w, err.Op); err != nil {
+			return err
+		}
+		return writeString(w, err.Err.Error())
+	default:
+		return writeString(w, err.Error())
+	}
+}
+
+// decodeError decodes error encoded by encodeError. The errors
+// retain their type, so plainError and temporaryError are equal
+// to the corresponding sentinel errors, such as ErrServerClosed.
+func decodeError(r io.Reader) error {
+	code, err := readUint8(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if errType != "" {
-		switch errType {
-		case "raft.NotLeaderError":
-			node := Node{}
-			if err := node.decode(r); err != nil {
-				return nil, err
-			}
-			lost, err := readBool(r)
-			if err != nil {
-				return nil, err
-			}
-			return nil, NotLeaderError{node, lost}
-		default:
-			s, err := readString(r)
-			if err != nil {
-				return nil, err
-			}
-			switch errType {
-			case "raft.plainError":
-				return nil, plainError(s)
-			case "raft.temporaryError":
-				return nil, temporaryError(s)
-			case "raft.InProgressError":
-				return nil, InProgressError(s)
-			default:
-				return nil, errors.New(s)
-			}
+	switch errCode(code) {
+	case codeNone:
+		return nil
+	case codeNotLeader:
+		node := Node{}
+		if err := node.decode(r); err != nil {
+			return err
+		}
+		term, err := readUint64(r)
+		if err != nil {
+			return err
+		}
+		lost, err := readBool(r)
+		if err != nil {
+			return err
+		}
+		retryable, err := readBool(r)
+		if err != nil {
+			return err
+		}
+		return NotLeaderError{node, term, lost, retryable}
+	case codeOp:
+		op, err := readString(r)
+		if err != nil {
+			return err
+		}
+		s, err := readString(r)
+		if err != nil {
+			return err
 		}
+		return OpError{Op: op, Err: errors.New(s)}
+	}
+	s, err := readString(r)
+	if err != nil {
+		return err
+	}
+	switch errCode(code) {
+	case codePlain:
+		return plainError(s)
+	case codeTemporary:
+		return temporaryError(s)
+	case codeInProgress:
+		return InProgressError(s)
+	case codeTimeout:
+		return TimeoutError(s)
+	case codeOther:
+		return errors.New(s)
+	}
+	return fmt.Errorf("raft: invalid error code %d", code)
+}
+
+func decodeTaskResp(typ taskType, r io.Reader) (interface{}, error) {
+	err := decodeError(r)
+	if err != nil {
+		return nil, err
 	}
 	switch typ {
 	case taskInfo:
@@ -255,30 +469,28 @@ func decodeTaskResp(typ taskType, r io.Reader) (interface{}, error) {
 			return nil, err
 		}
 		return config, nil
-	case taskChangeConfig, taskTransferLdr:
+	case taskChangeConfig, taskTransferLdr, taskPause, taskResume, taskCampaign, taskStepDown:
 		return nil, nil
 	case taskTakeSnapshot:
 		return readUint64(r)
+	case taskGetLogEntries:
+		n, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]LogEntry, n)
+		for i := range entries {
+			if err = entries[i].decode(r); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
 	}
 	return nil, errors.New("invalidTaskType")
 }
 
 func encodeTaskResp(t Task, w io.Writer) error {
-	if t.Err() != nil {
-		if err := writeString(w, fmt.Sprintf("%T", t.Err())); err != nil {
-			return err
-		}
-		switch err := t.Err().(type) {
-		case NotLeaderError:
-			if err := err.Leader.encode(w); err != nil {
-				return err
-			}
-			return writeBool(w, err.Lost)
-		default:
-			return writeString(w, err.Error())
-		}
-	}
-	if err := writeString(w, ""); err != nil {
+	if err := encodeError(t.Err(), w); err != nil || t.Err() != nil {
 		return err
 	}
 	switch r := t.Result().(type) {
@@ -290,15 +502,103 @@ func encodeTaskResp(t Task, w io.Writer) error {
 		return r.encode().encode(w)
 	case Info:
 		return r.encode(w)
+	case []LogEntry:
+		if err := writeUint32(w, uint32(len(r))); err != nil {
+			return err
+		}
+		for _, e := range r {
+			if err := e.encode(w); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 	return fmt.Errorf("unknown type: %T", t.Result())
 }
 
+func (e LogEntry) encode(w io.Writer) error {
+	if err := writeUint64(w, e.Index); err != nil {
+		return err
+	}
+	if err := writeUint64(w, e.Term); err != nil {
+		return err
+	}
+	if err := writeString(w, e.Type); err != nil {
+		return err
+	}
+	if err := writeBytes(w, e.Data); err != nil {
+		return err
+	}
+	var unixNano uint64
+	if !e.Time.IsZero() {
+		unixNano = uint64(e.Time.UnixNano())
+	}
+	if err := writeUint64(w, unixNano); err != nil {
+		return err
+	}
+	if err := writeUint64(w, e.Leader); err != nil {
+		return err
+	}
+	if err := writeUint64(w, e.Client); err != nil {
+		return err
+	}
+	return writeUint64(w, e.Seq)
+}
+
+func (e *LogEntry) decode(r io.Reader) error {
+	var err error
+	if e.Index, err = readUint64(r); err != nil {
+		return err
+	}
+	if e.Term, err = readUint64(r); err != nil {
+		return err
+	}
+	if e.Type, err = readString(r); err != nil {
+		return err
+	}
+	if e.Data, err = readBytes(r); err != nil {
+		return err
+	}
+	unixNano, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	if unixNano != 0 {
+		e.Time = time.Unix(0, int64(unixNano))
+	}
+	if e.Leader, err = readUint64(r); err != nil {
+		return err
+	}
+	if e.Client, err = readUint64(r); err != nil {
+		return err
+	}
+	e.Seq, err = readUint64(r)
+	return err
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (s State) MarshalJSON() ([]byte, error) {
 	return []byte(strconv.Quote(s.String())), nil
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *State) UnmarshalJSON(data []byte) error {
+	if len(data) < 2 || data[0] != '"' {
+		return errors.New("state must be json string")
+	}
+	str, err := strconv.Unquote(string(data))
+	if err != nil {
+		return err
+	}
+	for _, st := range []State{Follower, Candidate, Leader} {
+		if st.String() == str {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a valid state", str)
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (a Action) MarshalJSON() ([]byte, error) {
 	return []byte(strconv.Quote(a.String())), nil
@@ -33,6 +33,11 @@ func TestClient_GetInfo(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		// lease is extended with every heartbeat
+		if (got.LeaseExpiry == nil) != (want.LeaseExpiry == nil) {
+			t.Fatalf("leaseExpiry: got %v, want %v", got.LeaseExpiry, want.LeaseExpiry)
+		}
+		got.LeaseExpiry, want.LeaseExpiry = nil, nil
 		if !reflect.DeepEqual(got, want) {
 			t.Logf(" got %#v", got)
 			t.Logf("want %#v", want)
@@ -86,3 +91,73 @@ func TestClient_TransferLeadership(t *testing.T) {
 		t.Fatalf("newLdr=%d, want %d", newLdr.nid, flrs[0].nid)
 	}
 }
+
+func TestClient_notLeaderError(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	client := NewClient(c.id2Addr(flrs[0].nid))
+	client.dial = flrs[0].dialFn
+	err := client.TransferLeadership(flrs[1].nid, c.longTimeout)
+	info := c.info(ldr)
+	want := NotLeaderError{Leader: info.Configs.Latest.Nodes[ldr.nid], Term: info.Term, Retryable: true}
+	if got, ok := err.(NotLeaderError); !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", err, want)
+	}
+}
+
+func TestClient_GetLogEntries(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	client := NewClient(c.id2Addr(ldr.nid))
+	client.dial = ldr.dialFn
+	entries, err := client.GetLogEntries(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 12 {
+		t.Fatalf("len(entries)=%d, want %d", len(entries), 12)
+	}
+	for i, e := range entries {
+		if e.Index != uint64(i+1) {
+			t.Fatalf("entries[%d].Index=%d, want %d", i, e.Index, i+1)
+		}
+	}
+	if entries[0].Type != "config" || entries[1].Type != "nop" {
+		t.Fatalf("types: got %s %s, want config nop", entries[0].Type, entries[1].Type)
+	}
+	if e := entries[11]; e.Type != "update" || string(e.Data) != "update:10" {
+		t.Fatalf("entries[11]: got %s %q", e.Type, e.Data)
+	}
+
+	// entries compacted into snapshot must be trimmed
+	if _, err := client.TakeSnapshot(0); err != nil {
+		t.Fatal(err)
+	}
+	c.sendUpdates(ldr, 11, 11)
+	c.waitFSMLen(11)
+	entries, err = client.GetLogEntries(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.info(ldr).FirstLogIndex
+	if len(entries) == 0 || entries[0].Index != first {
+		t.Fatalf("entries: got %v, want first index %d", entries, first)
+	}
+
+	// client and seq of UpdateFSMOnce must be returned
+	if _, err := waitFSMTask(ldr, UpdateFSMOnce(7, 3, []byte("update:12")), c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	last := c.info(ldr).LastLogIndex
+	if entries, err = client.GetLogEntries(last, last); err != nil {
+		t.Fatal(err)
+	}
+	if e := entries[0]; e.Type != "update" || e.Client != 7 || e.Seq != 3 || string(e.Data) != "update:12" {
+		t.Fatalf("entries[0]: got %+v", e)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import "time"
+
+// Clock is the source of time for raft. All timeouts, such as
+// election timeout, heartbeats and i/o deadlines are computed
+// using it. See Options.Clock.
+//
+// Tests can use fake clock, such as sim.Clock, to run thousands
+// of elections per second without real sleeping. Note that the
+// net.Conn used must honor deadlines with respect to the same
+// clock, as sim.Network does.
+type Clock interface {
+	// Now returns current time.
+	Now() time.Time
+
+	// NewTimer creates a timer, that sends current time on
+	// its channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is similar to time.Timer.
+type Timer interface {
+	// C returns the channel on which time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns
+	// false if the timer has already expired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d.
+	// It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// after waits for the duration to elapse and then sends
+// the current time on the returned channel.
+func after(c Clock, d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// until returns the duration until t.
+func until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
@@ -46,6 +46,11 @@ func exec(c *raft.Client, args []string) {
 		errln("  config     configuration related tasks")
 		errln("  snapshot   take snapshot")
 		errln("  transfer   transfer leadership")
+		errln("  stepdown   step down leader")
+		errln("  pause      pause node for maintenance")
+		errln("  resume     resume paused node")
+		errln("  campaign   start election immediately")
+		errln("  log        dump log entries")
 	}
 	if len(args) == 0 {
 		printUsage()
@@ -63,6 +68,22 @@ func exec(c *raft.Client, args []string) {
 		snapshot(c, args)
 	case "transfer":
 		transfer(c, args)
+	case "stepdown":
+		stepDown(c, args)
+	case "pause":
+		pause(c, args)
+	case "resume":
+		if err := c.Resume(); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	case "campaign":
+		if err := c.Campaign(); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	case "log":
+		dumpLog(c, args)
 	default:
 		errln("unknown command:", cmd)
 		printUsage()
@@ -135,6 +156,7 @@ func config(c *raft.Client, args []string) {
 		errln("  force-remove   force remove node")
 		errln("  addr           change node address")
 		errln("  data           change node data")
+		errln("  tags           change node tags")
 	}
 	if len(args) == 0 {
 		printUsage()
@@ -164,6 +186,8 @@ func config(c *raft.Client, args []string) {
 		changeAddr(c, args)
 	case "data":
 		changeData(c, args)
+	case "tags":
+		changeTags(c, args)
 	default:
 		errln("unknown config command:", cmd)
 		printUsage()
@@ -486,6 +510,42 @@ func changeData(c *raft.Client, args []string) {
 	}
 }
 
+func changeTags(c *raft.Client, args []string) {
+	if len(args) < 2 {
+		errln("usage: raftctl config tags <nid> <key>=<value> ...")
+		errln("  empty value removes the tag")
+		os.Exit(1)
+	}
+	nid, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	tags := make(map[string]string)
+	for _, arg := range args[1:] {
+		i := strings.Index(arg, "=")
+		if i == -1 {
+			errln("no '=' sign in argument:", arg)
+			os.Exit(1)
+		}
+		tags[arg[:i]] = arg[i+1:]
+	}
+	info, err := c.GetInfo()
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	config := info.Configs.Latest
+	if err = config.SetTags(uint64(nid), tags); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	if err = c.ChangeConfig(config); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+}
+
 func snapshot(c *raft.Client, args []string) {
 	if len(args) != 1 {
 		errln("usage: raftctl snapshot <threshold>")
@@ -526,6 +586,74 @@ func transfer(c *raft.Client, args []string) {
 	}
 }
 
+func stepDown(c *raft.Client, args []string) {
+	printUsage := func() {
+		errln("usage: raftctl stepdown [-transfer] <timeout>")
+		errln()
+		errln("with -transfer, transfers leadership before stepping down")
+		os.Exit(1)
+	}
+	transfer := len(args) > 0 && args[0] == "-transfer"
+	if transfer {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		printUsage()
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	if err = c.StepDown(transfer, d); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+}
+
+func pause(c *raft.Client, args []string) {
+	if len(args) != 1 {
+		errln("usage: raftctl pause <timeout>")
+		errln()
+		errln("if leader, transfers leadership before pausing")
+		os.Exit(1)
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	if err = c.Pause(d); err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+}
+
+func dumpLog(c *raft.Client, args []string) {
+	if len(args) != 2 {
+		errln("usage: raftctl log <from> <to>")
+		os.Exit(1)
+	}
+	from, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	to, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	entries, err := c.GetLogEntries(from, to)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		fmt.Printf("%d\t%d\t%s\t%q\n", e.Index, e.Term, e.Type, e.Data)
+	}
+}
+
 func errln(v ...interface{}) {
 	_, _ = fmt.Fprintln(os.Stderr, v...)
 }
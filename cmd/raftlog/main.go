@@ -0,0 +1,184 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command raftlog inspects raft storage offline, i.e. when the
+// node is not running. It is useful for debugging divergence
+// between nodes.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+func main() {
+	printUsage := func() {
+		errln("usage: raftlog <command> <storageDir> [options]")
+		errln()
+		errln("list of commands:")
+		errln("  verify     check consistency of log")
+		errln("  check      cross-check storage as at startup, print report as json")
+		errln("  print      print log entries")
+		errln("  export     export log entries as json")
+		errln("  snapshots  list retained snapshots as json")
+		errln("  snapshot   write fsm state of snapshot to stdout")
+		errln("  migrate    copy storage into another storageDir")
+	}
+	if len(os.Args) < 3 {
+		printUsage()
+		os.Exit(1)
+	}
+	cmd, dir, args := os.Args[1], os.Args[2], os.Args[3:]
+	opt := raft.DefaultOptions()
+	switch cmd {
+	case "verify":
+		if err := raft.VerifyStorage(opt, dir); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	case "check":
+		report, err := raft.CheckStartup(opt, dir)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+	case "print":
+		from, to := parseRange(cmd, args)
+		err := raft.ReadLogEntries(opt, dir, from, to, func(e raft.LogEntry) error {
+			_, err := fmt.Printf("%d\t%d\t%s\t%q\n", e.Index, e.Term, e.Type, e.Data)
+			return err
+		})
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	case "export":
+		from, to := parseRange(cmd, args)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		err := raft.ReadLogEntries(opt, dir, from, to, func(e raft.LogEntry) error {
+			return enc.Encode(e)
+		})
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	case "snapshots":
+		snaps, err := raft.ListSnapshots(opt, dir)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, snap := range snaps {
+			if err := enc.Encode(snap); err != nil {
+				errln(err.Error())
+				os.Exit(1)
+			}
+		}
+	case "snapshot":
+		var index uint64
+		if len(args) > 1 {
+			errln("usage: raftlog snapshot <storageDir> [<index>]")
+			os.Exit(1)
+		} else if len(args) == 1 {
+			i, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				errln(err.Error())
+				os.Exit(1)
+			}
+			index = i
+		}
+		_, r, err := raft.OpenSnapshot(opt, dir, index)
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		_, err = io.Copy(os.Stdout, r)
+		if e := r.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+	case "migrate":
+		if len(args) < 1 || len(args) > 2 {
+			errln("usage: raftlog migrate <storageDir> <dstDir> [<segmentSize>]")
+			os.Exit(1)
+		}
+		dstOpt := opt
+		if len(args) == 2 {
+			size, err := strconv.Atoi(args[1])
+			if err != nil {
+				errln(err.Error())
+				os.Exit(1)
+			}
+			dstOpt.LogSegmentSize = size
+		}
+		if err := raft.Migrate(opt, dir, dstOpt, args[0]); err != nil {
+			errln(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+	default:
+		errln("unknown command:", cmd)
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+// parseRange returns the range of entries in args.
+// all entries are returned, if range is not specified.
+func parseRange(cmd string, args []string) (from, to uint64) {
+	if len(args) == 0 {
+		return 0, math.MaxUint64
+	}
+	if len(args) != 2 {
+		errln("usage: raftlog", cmd, "<storageDir> [<from> <to>]")
+		os.Exit(1)
+	}
+	from, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	to, err = strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		errln(err.Error())
+		os.Exit(1)
+	}
+	return from, to
+}
+
+func errln(v ...interface{}) {
+	_, _ = fmt.Fprintln(os.Stderr, v...)
+}
@@ -9,10 +9,10 @@ awk \
 '
 /\[testing\]----------------------- Test/ {print testCase $0 "\033[0m"; system(""); next}
 /\[testing\]/ {print test $0 "\033[0m"; system(""); next}
-/ R \| / {print repl $0 "\033[0m"; system(""); next}
-/ L \| / {print ldr $0 "\033[0m"; system(""); next}
-/ F \| / {print flr $0 "\033[0m"; system(""); next}
-/ C \| / {print cnd $0 "\033[0m"; system(""); next}
-/ FSM \| / {print fsm $0 "\033[0m"; system(""); next}
+/ component=repl / {print repl $0 "\033[0m"; system(""); next}
+/ state=leader/ {print ldr $0 "\033[0m"; system(""); next}
+/ state=follower/ {print flr $0 "\033[0m"; system(""); next}
+/ state=candidate/ {print cnd $0 "\033[0m"; system(""); next}
+/ component=fsm/ {print fsm $0 "\033[0m"; system(""); next}
 1; system("")
 '
\ No newline at end of file
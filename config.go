@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 )
 
@@ -80,12 +81,157 @@ func (a Action) String() string {
 
 // ------------------------------------------------------------------------------
 
+// ConfigEvent tells the step of config change, that
+// MembershipChange is raised for.
+type ConfigEvent uint8
+
+const (
+	// ConfigChanged means that new config is appended to log.
+	// It is not yet committed.
+	ConfigChanged ConfigEvent = iota
+
+	// ConfigCommitted means that new config is committed.
+	ConfigCommitted
+
+	// ConfigReverted means that uncommitted config is reverted
+	// to committed config, because leader overwrote the log.
+	ConfigReverted
+)
+
+func (e ConfigEvent) String() string {
+	switch e {
+	case ConfigChanged:
+		return "changed"
+	case ConfigCommitted:
+		return "committed"
+	case ConfigReverted:
+		return "reverted"
+	}
+	return fmt.Sprintf("ConfigEvent(%d)", e)
+}
+
+// ChangeReason tells why the config is changed. It is derived by
+// comparing configs, so it is same on all nodes.
+type ChangeReason uint8
+
+const (
+	// ReasonUpdate means that nodes are neither added nor removed,
+	// nor their voting rights changed. For example, address or
+	// action of a node is changed.
+	ReasonUpdate ChangeReason = iota
+
+	// ReasonBootstrap means that cluster is bootstrapped.
+	ReasonBootstrap
+
+	// ReasonPromote means that a nonvoter is promoted to voter.
+	ReasonPromote
+
+	// ReasonDemote means that a voter is demoted to nonvoter.
+	ReasonDemote
+
+	// ReasonAdd means that a node is added.
+	ReasonAdd
+
+	// ReasonRemove means that a nonvoter is removed.
+	ReasonRemove
+
+	// ReasonForced means that a voter is removed, without
+	// demoting it first. See ForceRemove.
+	ReasonForced
+)
+
+func (r ChangeReason) String() string {
+	switch r {
+	case ReasonUpdate:
+		return "update"
+	case ReasonBootstrap:
+		return "bootstrap"
+	case ReasonPromote:
+		return "promote"
+	case ReasonDemote:
+		return "demote"
+	case ReasonAdd:
+		return "add"
+	case ReasonRemove:
+		return "remove"
+	case ReasonForced:
+		return "forced"
+	}
+	return fmt.Sprintf("ChangeReason(%d)", r)
+}
+
+// changeReason returns the reason of change from old to new config.
+// If there are multiple changes, the one defined last in ChangeReason
+// constants is returned.
+func changeReason(old, new Config) ChangeReason {
+	if old.Index == 0 {
+		return ReasonBootstrap
+	}
+	reason := ReasonUpdate
+	for id, n := range new.Nodes {
+		r := ReasonUpdate
+		if o, ok := old.Nodes[id]; !ok {
+			r = ReasonAdd
+		} else if !o.Voter && n.Voter {
+			r = ReasonPromote
+		} else if o.Voter && !n.Voter {
+			r = ReasonDemote
+		}
+		if r > reason {
+			reason = r
+		}
+	}
+	for id, o := range old.Nodes {
+		if _, ok := new.Nodes[id]; !ok {
+			r := ReasonRemove
+			if o.Voter {
+				r = ReasonForced
+			}
+			if r > reason {
+				reason = r
+			}
+		}
+	}
+	return reason
+}
+
+// MembershipChange describes a change in cluster configuration.
+// It is raised by Alerts.MembershipChanged, so that orchestration
+// layers can reconcile external state, such as load balancers
+// and service discovery, with the cluster.
+type MembershipChange struct {
+	Event ConfigEvent
+
+	// Reason tells why Old is changed to New. For ConfigReverted,
+	// it tells the reason of the change being reverted.
+	Reason ChangeReason
+
+	Old Config
+	New Config
+}
+
+func (c MembershipChange) String() string {
+	return fmt.Sprintf("%s(%s) %s -> %s", c.Event, c.Reason, c.Old, c.New)
+}
+
+// ------------------------------------------------------------------------------
+
 // Node represents a single node in raft configuration.
 type Node struct {
 	// ID uniquely identifies this node in raft cluster.
 	ID uint64 `json:"-"`
 
 	// Addr is network address that other nodes can contact.
+	//
+	// This is the advertised address, which need not be the
+	// address the node listens on. For example, a node running
+	// in docker may listen on 0.0.0.0:7000, while advertising
+	// the address of the host port mapped to it. Unspecified
+	// addresses such as 0.0.0.0 are not allowed.
+	//
+	// Addr is tcp address of form host:port by default. Use
+	// unix:///path for unix domain sockets, and mem://name for
+	// MemNetwork.
 	Addr string `json:"addr"`
 
 	// Voter can participate in elections and its matchIndex
@@ -97,6 +243,15 @@ type Node struct {
 	// For example application address
 	Data string `json:"data,omitempty"`
 
+	// Tags are labels of node, such as zone, region or rack. Unlike Data,
+	// they are meant for placement aware decisions, for example in
+	// Options.TransferTargetSelector (see PreferTags), PromotionPolicy
+	// and Options.Resolver. Use Config.SetTags to change them.
+	//
+	// Nodes running versions without tags support cannot decode
+	// configs with tags. So set tags only after upgrading all nodes.
+	Tags map[string]string `json:"tags,omitempty"`
+
 	// Action tells the action to be taken by leader, when appropriate.
 	// None action signifies that no action to be taken.
 	Action Action `json:"action,omitempty"`
@@ -134,6 +289,63 @@ func (n Node) encode(w io.Writer) error {
 	return writeUint8(w, uint8(n.Action))
 }
 
+// encodeTags writes tags sorted by key,
+// so that encoding is deterministic.
+func (n Node) encodeTags(w io.Writer) error {
+	keys := make([]string, 0, len(n.Tags))
+	for k := range n.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := writeString(w, k); err != nil {
+			return err
+		}
+		if err := writeString(w, n.Tags[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) decodeTags(r *bytes.Buffer) error {
+	size, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	// each tag needs atleast len(key)+len(value)
+	if uint64(size)*(4+4) > uint64(r.Len()) {
+		return fmt.Errorf("raft: node %d with %d tags exceeds %d bytes", n.ID, size, r.Len())
+	}
+	n.Tags = nil
+	if size > 0 {
+		n.Tags = make(map[string]string, size)
+	}
+	for ; size > 0; size-- {
+		k, err := readString(r)
+		if err != nil {
+			return err
+		}
+		if n.Tags[k], err = readString(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasTags tells whether node has all given tags.
+func (n Node) hasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if nv, ok := n.Tags[k]; !ok || nv != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (n *Node) decode(r io.Reader) error {
 	var err error
 	if n.ID, err = readUint64(r); err != nil {
@@ -153,6 +365,9 @@ func (n *Node) decode(r io.Reader) error {
 		return err
 	}
 	n.Action = Action(action)
+	if n.Action > ForceRemove {
+		return fmt.Errorf("raft: invalid action %d", action)
+	}
 	return nil
 }
 
@@ -160,12 +375,38 @@ func (n Node) validate() error {
 	if n.ID == 0 {
 		return errors.New("raft.Config: id must be greater than zero")
 	}
-	if n.Addr == "" {
+	if err := validateAddr(n.Addr); err != nil {
+		return err
+	}
+	if n.Action == Promote && n.Voter {
+		return errors.New("raft.Config: voter can't be promoted")
+	}
+	if n.Action == Demote && !n.Voter {
+		return errors.New("raft.Config: nonvoter can't be demoted")
+	}
+	if _, ok := n.Tags[""]; ok {
+		return fmt.Errorf("raft.Config: node %d has tag with empty key", n.ID)
+	}
+	return nil
+}
+
+func validateAddr(addr string) error {
+	if addr == "" {
 		return errors.New("raft.Config: empty address")
 	}
-	_, sport, err := net.SplitHostPort(n.Addr)
+	network, address := splitAddr(addr)
+	if network != "tcp" {
+		if address == "" {
+			return fmt.Errorf("raft.Config: invalid address %s", addr)
+		}
+		return nil
+	}
+	host, sport, err := net.SplitHostPort(address)
 	if err != nil {
-		return fmt.Errorf("raft.Config: invalid address %s: %v", n.Addr, err)
+		return fmt.Errorf("raft.Config: invalid address %s: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("raft.Config: address %s is not reachable, specify advertised address", addr)
 	}
 	port, err := strconv.Atoi(sport)
 	if err != nil {
@@ -174,12 +415,6 @@ func (n Node) validate() error {
 	if port <= 0 {
 		return errors.New("raft.Config: invalid port")
 	}
-	if n.Action == Promote && n.Voter {
-		return errors.New("raft.Config: voter can't be promoted")
-	}
-	if n.Action == Demote && !n.Voter {
-		return errors.New("raft.Config: nonvoter can't be demoted")
-	}
 	return nil
 }
 
@@ -240,6 +475,28 @@ func (c Config) quorum() int {
 	return c.numVoters()/2 + 1
 }
 
+// CriticalZones returns the zones, whose loss leaves the voters without
+// quorum. For example, when two of three voters are in same zone. Zone
+// of a node is the value of given key in Node.Tags. Voters without it,
+// are assumed to be in distinct zones. The result is sorted.
+func (c Config) CriticalZones(tag string) []string {
+	voters := make(map[string]int)
+	for _, n := range c.Nodes {
+		if zone, ok := n.Tags[tag]; ok && n.Voter {
+			voters[zone]++
+		}
+	}
+	var zones []string
+	numVoters, quorum := c.numVoters(), c.quorum()
+	for zone, n := range voters {
+		if numVoters-n < quorum {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
 // AddVoter adds given node as voter.
 //
 // This call fails if config is not bootstrap.
@@ -320,24 +577,84 @@ func (c *Config) SetData(id uint64, data string) error {
 	return nil
 }
 
+// SetTags changes tags of given node. Tags with empty value
+// are removed, others are added or replaced.
+func (c *Config) SetTags(id uint64, tags map[string]string) error {
+	n, ok := c.Nodes[id]
+	if !ok {
+		return fmt.Errorf("raft.Config: node %d not found", id)
+	}
+	merged := make(map[string]string)
+	for k, v := range n.Tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		merged = nil
+	}
+	n.Tags = merged
+	if err := n.validate(); err != nil {
+		return err
+	}
+	c.Nodes[id] = n
+	return nil
+}
+
 func (c Config) clone() Config {
 	nodes := make(map[uint64]Node)
 	for id, n := range c.Nodes {
+		if n.Tags != nil {
+			tags := make(map[string]string, len(n.Tags))
+			for k, v := range n.Tags {
+				tags[k] = v
+			}
+			n.Tags = tags
+		}
 		nodes[id] = n
 	}
 	c.Nodes = nodes
 	return c
 }
 
+// configTags flag is set in the number of nodes of encoded
+// config, if nodes are followed by their tags. It is set only
+// if some node has tags, so that nodes without tags support
+// can decode configs, as long as tags are not used.
+const configTags = 1 << 31
+
 func (c Config) encode() *entry {
 	w := new(bytes.Buffer)
-	if err := writeUint32(w, uint32(len(c.Nodes))); err != nil {
+	size := uint32(len(c.Nodes))
+	for _, n := range c.Nodes {
+		if len(n.Tags) > 0 {
+			size |= configTags
+			break
+		}
+	}
+	if err := writeUint32(w, size); err != nil {
 		panic(err)
 	}
-	for _, n := range c.Nodes {
-		if err := n.encode(w); err != nil {
+	// nodes are sorted, so that encoding is deterministic
+	ids := make([]uint64, 0, len(c.Nodes))
+	for id := range c.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := c.Nodes[id].encode(w); err != nil {
 			panic(err)
 		}
+		if size&configTags != 0 {
+			if err := c.Nodes[id].encodeTags(w); err != nil {
+				panic(err)
+			}
+		}
 	}
 	return &entry{
 		typ:   entryConfig,
@@ -357,12 +674,26 @@ func (c *Config) decode(e *entry) error {
 	if err != nil {
 		return err
 	}
+	tags := size&configTags != 0
+	size &^= configTags
+	// each node needs at least id+len(addr)+voter+len(data)+action
+	if uint64(size)*(8+4+1+4+1) > uint64(r.Len()) {
+		return fmt.Errorf("raft: config with %d nodes exceeds %d bytes", size, r.Len())
+	}
 	c.Nodes = make(map[uint64]Node)
 	for ; size > 0; size-- {
 		n := Node{}
 		if err := n.decode(r); err != nil {
 			return err
 		}
+		if tags {
+			if err := n.decodeTags(r); err != nil {
+				return err
+			}
+		}
+		if _, ok := c.Nodes[n.ID]; ok {
+			return fmt.Errorf("raft: duplicate node %d in config", n.ID)
+		}
 		c.Nodes[n.ID] = n
 	}
 	return nil
@@ -442,7 +773,7 @@ func (c Configs) IsStable() bool {
 
 func (r *Raft) bootstrap(t changeConfig) {
 	if r.configs.IsBootstrapped() {
-		t.reply(notLeaderError(r, false))
+		t.reply(notLeaderError(r, false, true))
 		return
 	}
 	if err := t.newConf.validate(); err != nil {
@@ -464,9 +795,7 @@ func (r *Raft) bootstrap(t changeConfig) {
 	}
 
 	t.newConf.Index, t.newConf.Term = 1, 1
-	if trace {
-		println(r, "bootstrapping", t.newConf)
-	}
+	r.logger.Debug("bootstrapping", "config", t.newConf)
 	if err := r.storage.bootstrap(t.newConf); err != nil {
 		t.reply(err)
 		return
@@ -479,9 +808,7 @@ func (r *Raft) bootstrap(t changeConfig) {
 // ---------------------------------------------------------
 
 func (l *leader) setCommitIndex(index uint64) {
-	if trace {
-		println(l, "log.Commit", index)
-	}
+	l.logger.Debug("committing log", "index", index)
 	l.storage.commitLog(index)
 	if l.commitIndex < l.startIndex && index >= l.startIndex {
 		l.logger.Info("ready for commit")
@@ -490,11 +817,17 @@ func (l *leader) setCommitIndex(index uint64) {
 		}
 	}
 	configCommitted := l.Raft.setCommitIndex(index)
+	if configCommitted && len(l.removed) > 0 {
+		stopAt := l.clock.Now().Add(l.hbTimeout)
+		for _, repl := range l.removed {
+			if repl.status.stopAt.IsZero() {
+				repl.status.stopAt = stopAt
+			}
+		}
+		l.stopRemoved()
+	}
 	if configCommitted {
 		if l.configs.IsStable() {
-			if trace {
-				println(l, "stableConfig")
-			}
 			l.logger.Info("config is stable")
 			for _, t := range l.waitStable {
 				t.reply(l.configs.Latest)
@@ -508,22 +841,22 @@ func (l *leader) setCommitIndex(index uint64) {
 
 func (r *Raft) setCommitIndex(index uint64) (configCommitted bool) {
 	r.commitIndex = index
-	if trace {
-		println(r, "commitIndex", r.commitIndex)
-	}
+	r.logger.Debug("commitIndex updated", "commitIndex", r.commitIndex)
+	r.notifySubs()
 	if !r.configs.IsCommitted() && r.configs.Latest.Index <= r.commitIndex {
+		// new node catching up, commits configs that are created
+		// before it is added. it is removed, only if it was member
+		_, member := r.configs.Committed.Nodes[r.nid]
 		r.commitConfig()
 		configCommitted = true
 		if r.state == Leader && !r.configs.Latest.isVoter(r.nid) {
 			// if we are no longer voter after this config is committed,
 			// then what is the point of accepting fsm entries from user ????
-			if trace {
-				println(r, "leader -> follower notVoter")
-			}
+			r.logger.Debug("stepping down, not voter in committed config")
 			r.setState(Follower)
 			r.setLeader(0)
 		}
-		if r.shutdownOnRemove {
+		if r.shutdownOnRemove && member {
 			if _, ok := r.configs.Latest.Nodes[r.nid]; !ok {
 				r.doClose(ErrNodeRemoved)
 			}
@@ -537,18 +870,23 @@ func (l *leader) changeConfig(config Config) {
 	l.numVoters = l.configs.Latest.numVoters()
 	l.Raft.changeConfig(config)
 
-	// remove repls
+	// remove repls. they continue to replicate, so
+	// that removed node learns that it is removed
 	for id, repl := range l.repls {
 		if _, ok := config.Nodes[id]; !ok {
 			repl.status.removed = true
-			close(repl.stopCh)
 			delete(l.repls, id)
+			l.removed[id] = repl
 		}
 	}
 
 	// add new repls
 	for id, n := range config.Nodes {
 		if id != l.nid {
+			if repl, ok := l.removed[id]; ok { // added back
+				close(repl.stopCh)
+				delete(l.removed, id)
+			}
 			if repl, ok := l.repls[id]; !ok {
 				l.addReplication(n)
 			} else {
@@ -557,51 +895,100 @@ func (l *leader) changeConfig(config Config) {
 		}
 	}
 	l.checkConfigActions(nil, l.configs.Latest)
+	l.checkZones()
 }
 
-func (r *Raft) changeConfig(config Config) {
-	if trace {
-		println(r, "changeConfig", config)
+// checkZones warns, when latest config has critical zones, and
+// when it has none after that. See Options.ZoneTag.
+func (l *leader) checkZones() {
+	tag := l.zoneTag
+	if tag == "" {
+		tag = "zone"
+	}
+	zones := l.configs.Latest.CriticalZones(tag)
+	if equalStrings(zones, l.criticalZones) {
+		return
+	}
+	if len(zones) > 0 {
+		l.logger.Warn("voters cannot survive loss of critical zones", "tag", tag, "zones", zones)
+	} else {
+		l.logger.Info("voters can survive loss of any zone", "tag", tag)
+	}
+	if tracer.criticalZones != nil {
+		tracer.criticalZones(l.Raft, zones)
 	}
+	l.criticalZones = zones
+}
+
+func (r *Raft) changeConfig(config Config) {
 	if r.leader != 0 && !config.isVoter(r.leader) { // leader removed
 		r.setLeader(0) // for faster election
 
 	}
+	old := r.configs.Latest
 	r.configs.Committed = r.configs.Latest
 	r.setLatest(config)
+	r.saveConfigs(r.configs)
 	if r.configs.Latest.Index == 1 {
-		r.logger.Info("bootstrapped with", r.configs.Latest)
+		r.logger.Info("bootstrapped", "config", r.configs.Latest)
 	} else {
-		r.logger.Info("changed to", r.configs.Latest)
+		r.logger.Info("config changed", "config", r.configs.Latest)
 	}
 	if tracer.configChanged != nil {
 		tracer.configChanged(r)
 	}
+	r.alerts.MembershipChanged(MembershipChange{
+		Event:  ConfigChanged,
+		Reason: changeReason(old, config),
+		Old:    old,
+		New:    config,
+	})
+	if r.standby && config.isVoter(r.nid) {
+		r.activate("promoted to voter")
+	}
 }
 
 func (r *Raft) commitConfig() {
-	if trace {
-		println(r, "commitConfig", r.configs.Latest)
-	}
 	if r.leader != 0 && !r.configs.Latest.isVoter(r.leader) { // leader removed
 		r.setLeader(0) // for faster election
 	}
+	old := r.configs.Committed
 	r.configs.Committed = r.configs.Latest
-	r.logger.Info("committed", r.configs.Latest)
+	r.logger.Info("config committed", "config", r.configs.Latest)
 	if tracer.configCommitted != nil {
 		tracer.configCommitted(r)
 	}
+	r.alerts.MembershipChanged(MembershipChange{
+		Event:  ConfigCommitted,
+		Reason: changeReason(old, r.configs.Latest),
+		Old:    old,
+		New:    r.configs.Latest,
+	})
 }
 
 func (r *Raft) revertConfig() {
-	if trace {
-		println(r, "revertConfig", r.configs.Committed)
-	}
+	old := r.configs.Latest
 	r.setLatest(r.configs.Committed)
-	r.logger.Info("reverted to", r.configs.Latest)
+	r.saveConfigs(Configs{}) // config before Committed is not known
+	r.logger.Info("config reverted", "config", r.configs.Latest)
 	if tracer.configReverted != nil {
 		tracer.configReverted(r)
 	}
+	r.alerts.MembershipChanged(MembershipChange{
+		Event:  ConfigReverted,
+		Reason: changeReason(r.configs.Latest, old),
+		Old:    old,
+		New:    r.configs.Latest,
+	})
+}
+
+// saveConfigs saves configs in storage, for fast loading on next open.
+// Failure is only logged, because saved configs behind log are fixed
+// on open, see storage.loadConfigs.
+func (r *Raft) saveConfigs(configs Configs) {
+	if err := r.storage.saveConfigs(configs); err != nil {
+		r.logger.Warn("saving configs failed", "err", err)
+	}
 }
 
 func (r *Raft) setLatest(config Config) {
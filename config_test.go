@@ -15,6 +15,7 @@
 package raft
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
@@ -107,6 +108,17 @@ func TestRaft_bootstrap_validations(t *testing.T) {
 		t.Fatal("error expected")
 	}
 
+	// bootstrap with unspecified address
+	for _, addr := range []string{":7000", "0.0.0.0:7000", "[::]:7000"} {
+		config = validConfig.clone()
+		self = config.Nodes[ldr.nid]
+		self.Addr = addr
+		config.Nodes[ldr.nid] = self
+		if err := waitBootstrap(ldr, config, c.longTimeout); err == nil {
+			t.Fatalf("%s: error expected", addr)
+		}
+	}
+
 	// bootstrap without self
 	config = validConfig.clone()
 	delete(config.Nodes, ldr.nid)
@@ -132,3 +144,107 @@ func TestRaft_bootstrap_validations(t *testing.T) {
 		t.Fatal("error expected")
 	}
 }
+
+func TestStorage_configsVar(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), false))
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	want := c.info(ldr).Configs
+	c.shutdown(ldr)
+	dir := c.storage[ldr.nid]
+
+	open := func() *storage {
+		t.Helper()
+		s, err := openStorage(dir, c.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, index, ok := s.readConfigsVar(Config{}); !ok || index != s.lastLogIndex {
+			t.Fatalf("configsVar: got (%d, %v), want (%d, true)", index, ok, s.lastLogIndex)
+		}
+		return s
+	}
+	check := func(s *storage) {
+		t.Helper()
+		if got := s.configs; got.Latest.Index != want.Latest.Index || !reflect.DeepEqual(got.Latest.Nodes, want.Latest.Nodes) {
+			t.Fatalf("latest: got %v, want %v", got.Latest, want.Latest)
+		}
+		if err := s.log.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// saved on shutdown
+	s := open()
+	check(s)
+
+	// storage dir of older version, scans log and saves
+	s, err := openStorage(dir, c.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.vars.set(configsVar, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.log.Close()
+	s = open()
+	check(s)
+
+	// saved configs ahead of log, as if log is not synced before crash
+	s = open()
+	latest := s.configs.Latest.Index
+	prevTerm, err := s.getEntryTerm(latest - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.removeGTE(latest, prevTerm)
+	if err = s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	if got := s.configs.Latest.Index; got == latest {
+		t.Fatalf("latest.index: got %d, want < %d", got, latest)
+	}
+	_ = s.log.Close()
+}
+
+func TestChangeReason(t *testing.T) {
+	old := Config{Index: 5, Nodes: map[uint64]Node{
+		1: {ID: 1, Addr: "M1:8888", Voter: true},
+		2: {ID: 2, Addr: "M2:8888", Voter: true},
+		3: {ID: 3, Addr: "M3:8888"},
+	}}
+	change := func(fn func(c Config)) Config {
+		c := old.clone()
+		fn(c)
+		return c
+	}
+	tests := []struct {
+		name string
+		old  Config
+		new  Config
+		want ChangeReason
+	}{
+		{"bootstrap", Config{}, old, ReasonBootstrap},
+		{"update", old, change(func(c Config) { c.Nodes[3] = Node{ID: 3, Addr: "M3:9999"} }), ReasonUpdate},
+		{"add", old, change(func(c Config) { c.Nodes[4] = Node{ID: 4, Addr: "M4:8888"} }), ReasonAdd},
+		{"promote", old, change(func(c Config) { c.Nodes[3] = Node{ID: 3, Addr: "M3:8888", Voter: true} }), ReasonPromote},
+		{"demote", old, change(func(c Config) { c.Nodes[2] = Node{ID: 2, Addr: "M2:8888"} }), ReasonDemote},
+		{"remove", old, change(func(c Config) { delete(c.Nodes, 3) }), ReasonRemove},
+		{"forced", old, change(func(c Config) { delete(c.Nodes, 2) }), ReasonForced},
+		{"multiple", old, change(func(c Config) {
+			c.Nodes[4] = Node{ID: 4, Addr: "M4:8888"}
+			delete(c.Nodes, 3)
+		}), ReasonRemove},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := changeReason(test.old, test.new); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
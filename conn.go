@@ -16,6 +16,9 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -25,19 +28,64 @@ type conn struct {
 	rwc  net.Conn
 	bufr *bufio.Reader
 	bufw *bufio.Writer
+
+	version  uint8 // protocol version, negotiated in identity handshake
+	compress bool  // compress entries in appendReq
+	framed   bool  // requests are sent in frame, see frameMagic
+
+	frameBuf bytes.Buffer  // reused to encode or read frames
+	frame    *bytes.Reader // request frame received by server, nil if unframed
+
+	// used by connPool, to find idle connections
+	returned time.Time // when the conn is returned to pool
+	pinged   time.Time // when the conn is last pinged
+
+	capture *capture // see Options.CaptureFile
+	peer    uint64   // id of other node, zero if not known
 }
 
 type dialFn func(network, address string, timeout time.Duration) (net.Conn, error)
 
-func dial(dialFn dialFn, address string, timeout time.Duration) (*conn, error) {
-	rwc, err := dialFn("tcp", address, timeout)
+// tcpOptions are applied on tcp connections after dial.
+type tcpOptions struct {
+	keepAlive time.Duration // see Options.TCPKeepAlive
+	noDelay   bool
+}
+
+func (o tcpOptions) apply(rwc net.Conn) error {
+	tcp, ok := rwc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcp.SetNoDelay(o.noDelay); err != nil {
+		return err
+	}
+	if o.keepAlive < 0 {
+		return tcp.SetKeepAlive(false)
+	} else if o.keepAlive > 0 {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tcp.SetKeepAlivePeriod(o.keepAlive)
+	}
+	return nil
+}
+
+func dial(dialFn dialFn, address string, timeout time.Duration, opt tcpOptions) (*conn, error) {
+	network, address := splitAddr(address)
+	rwc, err := dialFn(network, address, timeout)
 	if err != nil {
 		return nil, err
 	}
+	if err = opt.apply(rwc); err != nil {
+		_ = rwc.Close()
+		return nil, err
+	}
 	return &conn{
-		rwc:  rwc,
-		bufr: bufio.NewReader(rwc),
-		bufw: bufio.NewWriter(rwc),
+		rwc:     rwc,
+		bufr:    bufio.NewReader(rwc),
+		bufw:    bufio.NewWriter(rwc),
+		version: maxProtocol,
 	}, nil
 }
 
@@ -45,6 +93,14 @@ func (c *conn) writeReq(req request, deadline time.Time) error {
 	if err := c.rwc.SetWriteDeadline(deadline); err != nil {
 		return err
 	}
+	req.setVersion(c.version)
+	c.capture.message(false, CaptureRequest, req.rpcType(), c.peer, req)
+	if c.framed {
+		if err := writeFrame(c.bufw, req, &c.frameBuf); err != nil {
+			return err
+		}
+		return c.bufw.Flush()
+	}
 	if err := writeUint8(c.bufw, uint8(req.rpcType())); err != nil {
 		return err
 	}
@@ -54,11 +110,38 @@ func (c *conn) writeReq(req request, deadline time.Time) error {
 	return c.bufw.Flush()
 }
 
+// decodeReq decodes the request received by server. It is
+// decoded from the frame, if client sent the request framed.
+func (c *conn) decodeReq(req request) error {
+	if c.frame == nil {
+		if err := req.decode(c.bufr); err != nil {
+			return err
+		}
+		c.capture.message(true, CaptureRequest, req.rpcType(), req.from(), req)
+		return nil
+	}
+	frame := c.frame
+	c.frame = nil
+	if err := req.decode(frame); err != nil {
+		return err
+	}
+	if frame.Len() > 0 {
+		return fmt.Errorf("raft: %d trailing bytes in %s frame", frame.Len(), req.rpcType())
+	}
+	c.capture.message(true, CaptureRequest, req.rpcType(), req.from(), req)
+	return nil
+}
+
 func (c *conn) readResp(resp response, deadline time.Time) error {
 	if err := c.rwc.SetReadDeadline(deadline); err != nil {
 		return err
 	}
-	return resp.decode(c.bufr)
+	resp.setVersion(c.version)
+	if err := resp.decode(c.bufr); err != nil {
+		return err
+	}
+	c.capture.message(true, CaptureResponse, respType(resp), c.peer, resp)
+	return nil
 }
 
 func (c *conn) doRPC(req request, resp response, deadline time.Time) error {
@@ -68,32 +151,93 @@ func (c *conn) doRPC(req request, resp response, deadline time.Time) error {
 	return c.readResp(resp, deadline)
 }
 
+// isTimeout tells whether err is due to i/o deadline exceeded,
+// rather than peer refusing or closing the connection.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// ping sends ping frame, and waits for the server to echo it.
+// It is used to keep idle connections alive, and to detect
+// stale connections early.
+func (c *conn) ping(deadline time.Time) error {
+	if err := c.rwc.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if err := writeUint8(c.bufw, uint8(rpcPing)); err != nil {
+		return err
+	}
+	if err := c.bufw.Flush(); err != nil {
+		return err
+	}
+	b, err := readUint8(c.bufr)
+	if err != nil {
+		return err
+	}
+	if rpcType(b) != rpcPing {
+		return fmt.Errorf("raft: ping got %d", b)
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------
 
 type resolver struct {
 	delegate Resolver // user given resolver
+
+	// see Options.DialNode
+	dialNode func(n Node) func(network, address string, timeout time.Duration) (net.Conn, error)
+
 	logger   Logger
 	alerts   Alerts
 	mu       sync.RWMutex
 	addrs    map[uint64]string
+	nodes    map[uint64]Node   // from latest config, used by dialNode
+	resolved map[uint64]string // last address returned by delegate
 }
 
 func (r *resolver) update(config Config) {
+	if dns, ok := r.delegate.(*DNSResolver); ok {
+		dns.update(config)
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	for _, n := range config.Nodes {
 		r.addrs[n.ID] = n.Addr
+		r.nodes[n.ID] = n
 	}
 }
 
+// dialFn returns the function to connect to node id.
+// see Options.DialNode
+func (r *resolver) dialFn(id uint64, dialFn dialFn) dialFn {
+	if r.dialNode == nil {
+		return dialFn
+	}
+	r.mu.RLock()
+	n, ok := r.nodes[id]
+	r.mu.RUnlock()
+	if !ok {
+		return dialFn
+	}
+	if fn := r.dialNode(n); fn != nil {
+		return fn
+	}
+	return dialFn
+}
+
 func (r *resolver) lookupID(id uint64, timeout time.Duration) string {
 	if r.delegate != nil {
 		addr, err := r.delegate.LookupID(id, timeout)
 		if err == nil {
+			r.mu.Lock()
+			r.resolved[id] = addr
+			r.mu.Unlock()
 			return addr
 		}
 		err = opError(err, "Resolver.LookupID(%d)", id)
-		r.logger.Warn(trimPrefix(err))
+		r.logger.Error("lookup failed", "peer", id, "err", err)
 		r.alerts.Error(err)
 	}
 
@@ -103,6 +247,34 @@ func (r *resolver) lookupID(id uint64, timeout time.Duration) string {
 	return r.addrs[id]
 }
 
+// refresh looks up the address of all nodes again, and calls
+// changed for each node, whose address is changed since last
+// lookup.
+func (r *resolver) refresh(timeout time.Duration, changed func(id uint64, addr string)) {
+	r.mu.RLock()
+	ids := make([]uint64, 0, len(r.addrs))
+	for id := range r.addrs {
+		ids = append(ids, id)
+	}
+	r.mu.RUnlock()
+	for _, id := range ids {
+		addr, err := r.delegate.LookupID(id, timeout)
+		if err != nil {
+			err = opError(err, "Resolver.LookupID(%d)", id)
+			r.logger.Error("lookup failed", "peer", id, "err", err)
+			r.alerts.Error(err)
+			continue
+		}
+		r.mu.Lock()
+		prev, ok := r.resolved[id]
+		r.resolved[id] = addr
+		r.mu.Unlock()
+		if ok && prev != addr {
+			changed(id, addr)
+		}
+	}
+}
+
 // --------------------------------------------------------------------
 
 type connPool struct {
@@ -111,7 +283,18 @@ type connPool struct {
 	nid      uint64
 	resolver *resolver
 	dialFn   dialFn
+	clock    Clock
+	compress bool // see Options.CompressEntries
+	tracing  Tracer
 	max      int
+	tcp      tcpOptions
+	peerKey  func(nid uint64) []byte // see Options.PeerKey
+	capture  *capture                // see Options.CaptureFile
+	logger   *logger
+
+	// see Options.IdleConnTimeout, Options.PingInterval
+	idleTimeout  time.Duration
+	pingInterval time.Duration
 
 	mu    sync.Mutex
 	conns []*conn
@@ -121,9 +304,13 @@ func (pool *connPool) getConn(deadline time.Time) (*conn, error) {
 	assert(!deadline.IsZero())
 	var c *conn
 	pool.mu.Lock()
-	if num := len(pool.conns); num > 0 {
+	for num := len(pool.conns); num > 0 && c == nil; num-- {
 		c, pool.conns[num-1] = pool.conns[num-1], nil
 		pool.conns = pool.conns[:num-1]
+		if pool.idleTimeout > 0 && pool.clock.Now().Sub(c.returned) > pool.idleTimeout {
+			_ = c.rwc.Close()
+			c = nil
+		}
 	}
 	pool.mu.Unlock()
 	if c != nil {
@@ -131,23 +318,53 @@ func (pool *connPool) getConn(deadline time.Time) (*conn, error) {
 	}
 
 	// dial ---------
-	addr := pool.resolver.lookupID(pool.nid, deadline.Sub(time.Now()))
-	c, err := dial(pool.dialFn, addr, deadline.Sub(time.Now()))
+	addr := pool.resolver.lookupID(pool.nid, until(pool.clock, deadline))
+	c, err := dial(pool.resolver.dialFn(pool.nid, pool.dialFn), addr, until(pool.clock, deadline), pool.tcp)
 	if err != nil {
 		return nil, err
 	}
+	c.capture, c.peer = pool.capture, pool.nid
+	if err = pool.handshake(c, addr, deadline); err != nil {
+		_ = c.rwc.Close()
+		return nil, err
+	}
+	return c, nil
+}
 
+// handshake checks identity of the dialed conn, negotiates
+// protocol version, and authenticates if Options.PeerKey is set.
+func (pool *connPool) handshake(c *conn, addr string, deadline time.Time) error {
 	// check identity ---------
 	resp := &identityResp{}
-	err = c.doRPC(&identityReq{req: req{src: pool.src}, cid: pool.cid, nid: pool.nid}, resp, deadline)
+	err := c.doRPC(&identityReq{req: req{src: pool.src}, cid: pool.cid, nid: pool.nid}, resp, deadline)
+	if err == nil && (resp.result == versionMismatch || resp.version < minProtocol || resp.version > c.version) {
+		return VersionError{pool.nid, addr}
+	}
 	if err != nil || resp.result != success {
-		_ = c.rwc.Close()
-		return nil, IdentityError{pool.cid, pool.nid, addr}
+		return IdentityError{pool.cid, pool.nid, addr}
 	}
-	return c, nil
+	c.version = resp.version
+	c.compress = pool.compress && c.version >= protocolV2
+	c.framed = c.version >= protocolV8
+
+	// authenticate ---------
+	if pool.peerKey != nil {
+		ok := false
+		if c.version >= protocolV9 {
+			ok, err = c.authenticate(pool.peerKey, pool.cid, pool.src, pool.nid, deadline)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return AuthError{pool.nid, addr}
+		}
+	}
+	return nil
 }
 
 func (pool *connPool) returnConn(c *conn) {
+	c.returned = pool.clock.Now()
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
@@ -158,6 +375,48 @@ func (pool *connPool) returnConn(c *conn) {
 	}
 }
 
+// checkIdle closes connections, that are idle for more than
+// idleTimeout. Connections idle for more than pingInterval
+// are pinged, and those that fail are closed.
+func (pool *connPool) checkIdle(timeout time.Duration) {
+	now := pool.clock.Now()
+	pool.mu.Lock()
+	var idle []*conn
+	conns := pool.conns[:0]
+	for _, c := range pool.conns {
+		switch {
+		case pool.idleTimeout > 0 && now.Sub(c.returned) > pool.idleTimeout:
+			_ = c.rwc.Close()
+		case pool.pingInterval > 0 && c.version >= protocolV4 &&
+			now.Sub(c.returned) > pool.pingInterval && now.Sub(c.pinged) > pool.pingInterval:
+			idle = append(idle, c)
+		default:
+			conns = append(conns, c)
+		}
+	}
+	for i := len(conns); i < len(pool.conns); i++ {
+		pool.conns[i] = nil
+	}
+	pool.conns = conns
+	pool.mu.Unlock()
+
+	for _, c := range idle {
+		if err := c.ping(now.Add(timeout)); err != nil {
+			pool.logger.Debug("ping failed, closing connection", "err", err)
+			_ = c.rwc.Close()
+			continue
+		}
+		c.pinged = now
+		pool.mu.Lock()
+		if len(pool.conns) < pool.max {
+			pool.conns = append(pool.conns, c)
+		} else {
+			_ = c.rwc.Close()
+		}
+		pool.mu.Unlock()
+	}
+}
+
 func (pool *connPool) closeAll() {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
@@ -168,6 +427,11 @@ func (pool *connPool) closeAll() {
 }
 
 func (pool *connPool) doRPC(req request, resp response, deadline time.Time) error {
+	ctx, span := pool.tracing.Start(context.Background(), "raft.rpc."+req.rpcType().String())
+	defer span.End()
+	span.SetAttribute("raft.target", pool.nid)
+	req.setTrace(pool.tracing.Inject(ctx))
+
 	c, err := pool.getConn(deadline)
 	if err != nil {
 		return err
@@ -197,9 +461,53 @@ func (r *Raft) getConnPool(nid uint64) *connPool {
 			nid:      nid,
 			resolver: r.resolver,
 			dialFn:   r.dialFn,
+			clock:    r.clock,
+			compress: r.compress,
+			tracing:  r.tracing,
 			max:      1,
+			tcp:      r.tcp,
+			peerKey:  r.peerKey,
+			capture:  r.capture,
+			logger:   newLogger(r.nodeLogger.delegate, r.nid, "pool", "peer", nid),
+
+			idleTimeout:  r.idleConnTimeout,
+			pingInterval: r.pingInterval,
 		}
 		r.connPools[nid] = pool
 	}
 	return pool
 }
+
+// checkIdleConns checks idle connections in all pools periodically,
+// until raft is closed. see connPool.checkIdle.
+func (r *Raft) checkIdleConns(interval time.Duration) {
+	timer := r.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-timer.C():
+		}
+		var pools []*connPool
+		_ = r.inspect(func(r *Raft) {
+			for _, pool := range r.connPools {
+				pools = append(pools, pool)
+			}
+		})
+		for _, pool := range pools {
+			pool.checkIdle(r.hbTimeout / 2)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// idleCheckInterval returns the interval at which idle connections
+// must be checked. Zero means no check is required.
+func idleCheckInterval(idleTimeout, pingInterval time.Duration) time.Duration {
+	d := idleTimeout
+	if pingInterval > 0 && (d == 0 || pingInterval < d) {
+		d = pingInterval
+	}
+	return d / 2
+}
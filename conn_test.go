@@ -15,7 +15,11 @@
 package raft
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"net"
 	"strings"
 	"sync"
 	"testing"
@@ -46,6 +50,275 @@ func TestConnPool_getConn_IdentityError(t *testing.T) {
 	}
 }
 
+// tests that client negotiates down to the version of older server
+func TestConnPool_getConn_olderServer(t *testing.T) {
+	for _, v := range []uint8{protocolV1, minProtocol - 1} {
+		client, server := net.Pipe()
+		pool := &connPool{
+			src: 1, cid: 2, nid: 3,
+			resolver: &resolver{},
+			dialFn: func(network, address string, timeout time.Duration) (net.Conn, error) {
+				return client, nil
+			},
+			clock:    realClock{},
+			compress: true,
+			max:      1,
+		}
+		go func() {
+			// server that supports only version v
+			defer server.Close()
+			bufr, bufw := bufio.NewReader(server), bufio.NewWriter(server)
+			if _, err := bufr.ReadByte(); err != nil {
+				return
+			}
+			req := &identityReq{}
+			if err := req.decode(bufr); err != nil {
+				return
+			}
+			resp := &identityResp{resp{version: v, result: success}}
+			if req.version < v {
+				resp.result = versionMismatch
+			}
+			_ = resp.encode(bufw)
+			_ = bufw.Flush()
+		}()
+		c, err := pool.getConn(time.Now().Add(5 * time.Second))
+		if v < minProtocol {
+			if _, ok := err.(VersionError); !ok {
+				t.Fatalf("version %d: got %v, want VersionError", v, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if c.version != v {
+			t.Fatalf("version: got %d, want %d", c.version, v)
+		}
+		if c.compress {
+			t.Fatalf("compress must be disabled for version %d", v)
+		}
+		_ = c.rwc.Close()
+	}
+}
+
+// tests that server speaks the version of older client
+func TestServer_olderClient(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 2)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+
+	info := c.info(flrs[0])
+	err := ldr.inspect(func(r *Raft) {
+		deadline := time.Now().Add(c.longTimeout)
+		for _, v := range []uint8{minProtocol - 1, protocolV1, maxProtocol + 1} {
+			conn, err := dial(r.dialFn, c.id2Addr(flrs[0].nid), c.longTimeout, r.tcp)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.version = v
+			resp := &identityResp{}
+			if err = conn.doRPC(&identityReq{req: req{src: r.nid}, cid: r.cid, nid: flrs[0].nid}, resp, deadline); err != nil {
+				t.Error(err)
+				_ = conn.rwc.Close()
+				return
+			}
+			if v < minProtocol {
+				if resp.result != versionMismatch {
+					t.Errorf("version %d: got %v, want versionMismatch", v, resp.result)
+				}
+				_ = conn.rwc.Close()
+				continue
+			}
+			if resp.result != success || resp.version != negotiate(v) {
+				t.Errorf("version %d: got %v v%d, want success v%d", v, resp.result, resp.version, negotiate(v))
+			}
+
+			// heartbeat in negotiated version
+			conn.version = resp.version
+			areq := &appendReq{
+				req:            req{term: info.Term, src: r.nid},
+				prevLogIndex:   info.LastLogIndex,
+				prevLogTerm:    info.LastLogTerm,
+				ldrCommitIndex: info.Committed,
+			}
+			aresp := &appendResp{}
+			if err = conn.doRPC(areq, aresp, deadline); err != nil {
+				t.Errorf("version %d: %v", v, err)
+			} else if aresp.result != success {
+				t.Errorf("version %d: got %v, want success", v, aresp.result)
+			}
+			_ = conn.rwc.Close()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	req := &appendReq{
+		req:            req{version: maxProtocol, term: 5, src: 1},
+		prevLogIndex:   10,
+		prevLogTerm:    4,
+		ldrCommitIndex: 9,
+	}
+	frame := func() []byte {
+		b := new(bytes.Buffer)
+		if err := writeFrame(b, req, new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+		if b.Bytes()[0] != frameMagic[0] {
+			t.Fatalf("frame must start with magic")
+		}
+		return b.Bytes()[1:] // first byte is read by server
+	}
+
+	typ, r, err := readFrame(bytes.NewReader(frame()), new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != rpcAppendEntries {
+		t.Fatalf("type: got %s, want %s", typ, rpcAppendEntries)
+	}
+	got := &appendReq{}
+	if err := got.decode(r); err != nil {
+		t.Fatal(err)
+	}
+	if got.term != req.term || got.prevLogIndex != req.prevLogIndex || got.ldrCommitIndex != req.ldrCommitIndex {
+		t.Fatalf("got %v, want %v", got, req)
+	}
+
+	// corrupted or partial frames are rejected
+	corrupt := func(i int) []byte {
+		b := frame()
+		b[i]++
+		return b
+	}
+	for name, b := range map[string][]byte{
+		"magic":    corrupt(0),
+		"version":  corrupt(1),
+		"type":     corrupt(2),
+		"length":   corrupt(6),
+		"checksum": corrupt(8),
+		"request":  corrupt(frameHeaderSize),
+		"partial":  frame()[:frameHeaderSize+2],
+	} {
+		if _, _, err := readFrame(bytes.NewReader(b), new(bytes.Buffer)); err == nil {
+			t.Errorf("%s: error expected", name)
+		}
+	}
+}
+
+// tests that server rejects non-raft traffic, without affecting raft
+func TestServer_nonRaftTraffic(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	for _, data := range []string{"GET / HTTP/1.0\r\n\r\n", "\x16\x03\x01", string(frameMagic[0]) + "garbage"} {
+		conn, err := dial(ldr.dialFn, c.id2Addr(ldr.nid), c.longTimeout, tcpOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.rwc.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.rwc.SetReadDeadline(time.Now().Add(c.longTimeout))
+		if _, err = conn.bufr.ReadByte(); err == nil || isTimeout(err) {
+			t.Fatalf("%q: got %v, want connection closed", data, err)
+		}
+		_ = conn.rwc.Close()
+	}
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+}
+
+// tests that server does not serve requests, before identity handshake
+func TestServer_noIdentity(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 2)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+
+	info := c.info(flrs[0])
+	conn, err := dial(ldr.dialFn, c.id2Addr(flrs[0].nid), c.longTimeout, tcpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.rwc.Close()
+	areq := &appendReq{
+		req:            req{term: info.Term + 1, src: 5},
+		prevLogIndex:   info.LastLogIndex,
+		prevLogTerm:    info.LastLogTerm,
+		ldrCommitIndex: info.Committed,
+	}
+	err = conn.doRPC(areq, &appendResp{}, time.Now().Add(c.longTimeout))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("got %v, want connection closed", err)
+	}
+	if got := c.info(flrs[0]).Term; got != info.Term {
+		t.Fatalf("term: got %d, want %d", got, info.Term)
+	}
+}
+
+func TestConnPool_checkIdle(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 2)
+	defer c.shutdown()
+
+	var pool *connPool
+	_ = ldr.inspect(func(r *Raft) {
+		pool = &connPool{
+			src: r.nid, cid: r.cid, nid: flrs[0].nid,
+			resolver:     r.resolver,
+			dialFn:       r.dialFn,
+			clock:        r.clock,
+			max:          1,
+			logger:       r.nodeLogger,
+			pingInterval: time.Millisecond,
+		}
+	})
+	defer pool.closeAll()
+	getConn := func() *conn {
+		t.Helper()
+		conn, err := pool.getConn(time.Now().Add(c.longTimeout))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// idle conn is pinged, and retained in pool
+	conn := getConn()
+	pool.returnConn(conn)
+	time.Sleep(5 * time.Millisecond)
+	pool.checkIdle(c.longTimeout)
+	if len(pool.conns) != 1 || conn.pinged.IsZero() {
+		t.Fatalf("ping: conns=%d pinged=%v", len(pool.conns), conn.pinged)
+	}
+
+	// stale conn is closed
+	_ = conn.rwc.Close()
+	time.Sleep(5 * time.Millisecond)
+	pool.checkIdle(c.longTimeout)
+	if len(pool.conns) != 0 {
+		t.Fatal("stale conn must be removed from pool")
+	}
+
+	// conn idle for longer than idleTimeout is not reused
+	pool.pingInterval, pool.idleTimeout = 0, time.Millisecond
+	conn = getConn()
+	pool.returnConn(conn)
+	time.Sleep(5 * time.Millisecond)
+	got := getConn()
+	pool.returnConn(got)
+	if got == conn {
+		t.Fatal("idle conn must not be reused")
+	}
+	if _, err := conn.rwc.Write([]byte{0}); err == nil {
+		t.Fatal("idle conn must be closed")
+	}
+}
+
 // tests that addr update in config is picked up by connPool
 func TestConnPool_getConn_ConfigAddrUpdate(t *testing.T) {
 	// launch 3 node cluster
@@ -185,3 +458,98 @@ func TestResolver_LookupID_failure(t *testing.T) {
 	// wait for leader to detect that follower is reachable at new addr
 	c.waitReachableDetected(ldr, flrs[0])
 }
+
+func TestDNSResolver(t *testing.T) {
+	hosts := map[string][]string{
+		"node1": {"10.0.0.2", "10.0.0.1"},
+		"node2": {},
+	}
+	d := &DNSResolver{
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			if ips, ok := hosts[host]; ok {
+				return ips, nil
+			}
+			return nil, errors.New("no such host")
+		},
+	}
+	config := Config{Nodes: map[uint64]Node{
+		1: {ID: 1, Addr: "node1:7000"},
+		2: {ID: 2, Addr: "node2:7000"},
+		3: {ID: 3, Addr: "node3:7000"},
+		4: {ID: 4, Addr: "10.0.0.4:7000"},
+	}}
+	d.update(config)
+	tests := []struct {
+		id   uint64
+		addr string
+	}{
+		{1, "10.0.0.1:7000"}, // sorted
+		{2, ""},              // no ips
+		{3, ""},              // lookup error
+		{4, "10.0.0.4:7000"}, // ip is not resolved
+		{5, ""},              // not in config
+	}
+	for _, test := range tests {
+		addr, err := d.LookupID(test.id, time.Second)
+		if test.addr == "" {
+			if err == nil {
+				t.Errorf("LookupID(%d): error expected", test.id)
+			}
+		} else if addr != test.addr || err != nil {
+			t.Errorf("LookupID(%d): got %q %v, want %q", test.id, addr, err, test.addr)
+		}
+	}
+}
+
+// tests that idle connections are closed,
+// when DNSResolver resolves to new address
+func TestConnPool_getConn_DNSResolver(t *testing.T) {
+	var mu sync.Mutex
+	hosts := make(map[string]string)
+	c := newCluster(t)
+	c.opt.Resolver = &DNSResolver{
+		Refresh: 50 * time.Millisecond,
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ip, ok := hosts[host]; ok {
+				return []string{ip}, nil
+			}
+			return []string{host}, nil
+		},
+	}
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+
+	// keep an idle connection in pool
+	var pool *connPool
+	err := ldr.inspect(func(r *Raft) {
+		pool = r.getConnPool(flrs[0].nid)
+		conn, err := pool.getConn(time.Now().Add(c.longTimeout))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pool.returnConn(conn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change address of follower
+	mu.Lock()
+	hosts[host(flrs[0])] = "M9"
+	mu.Unlock()
+	closed := waitForCondition(func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.conns) == 0
+	}, 10*time.Millisecond, c.longTimeout)
+	if !closed {
+		t.Fatal("idle connection is not closed")
+	}
+	want := strings.Replace(c.id2Addr(flrs[0].nid), host(flrs[0]), "M9", 1)
+	if got := ldr.resolver.lookupID(flrs[0].nid, time.Second); got != want {
+		t.Fatalf("addr: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeyProvider provides keys used to encrypt storage at rest.
+// see Options.EncryptionKeys
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new data, along
+	// with its id. The id is stored with the encrypted data. It must
+	// not be zero, and must not be reused for a different key.
+	//
+	// The key must be 16, 24, or 32 bytes to select AES-128, AES-192
+	// or AES-256.
+	CurrentKey() (id uint32, key []byte, err error)
+
+	// Key returns the key with given id, to decrypt data that was
+	// encrypted earlier.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKey returns KeyProvider with single key, that is never rotated.
+func StaticKey(key []byte) KeyProvider {
+	return staticKey(key)
+}
+
+type staticKey []byte
+
+func (k staticKey) CurrentKey() (uint32, []byte, error) {
+	return 1, k, nil
+}
+
+func (k staticKey) Key(id uint32) ([]byte, error) {
+	if id != 1 {
+		return nil, fmt.Errorf("raft: no key with id %d", id)
+	}
+	return k, nil
+}
+
+// crypter encrypts data using AES-GCM.
+//
+// sealed data is: keyID(4) nonce(12) ciphertext tag(16)
+type crypter struct {
+	keys KeyProvider
+
+	mu    sync.RWMutex
+	aeads map[uint32]cipher.AEAD
+}
+
+const (
+	nonceSize    = 12
+	sealOverhead = 4 + nonceSize + 16
+)
+
+var errCorrupted = errors.New("raft: encrypted data is corrupted")
+
+func newCrypter(keys KeyProvider) *crypter {
+	if keys == nil {
+		return nil
+	}
+	return &crypter{keys: keys, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// aead returns cached AEAD for given key id. if key is nil,
+// it is fetched from KeyProvider.
+func (c *crypter) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mu.RLock()
+	a := c.aeads[id]
+	c.mu.RUnlock()
+	if a != nil {
+		return a, nil
+	}
+	if key == nil {
+		var err error
+		if key, err = c.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("raft: key %d: %v", id, err)
+	}
+	if a, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.aeads[id] = a
+	c.mu.Unlock()
+	return a, nil
+}
+
+// seal encrypts and authenticates plain, using current key.
+// ad is authenticated, but not stored.
+func (c *crypter) seal(plain, ad []byte) ([]byte, error) {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, errors.New("raft: key id is zero")
+	}
+	a, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4+nonceSize, sealOverhead+len(plain))
+	byteOrder.PutUint32(b, id)
+	nonce := b[4:]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return a.Seal(b, nonce, plain, ad), nil
+}
+
+// open decrypts and authenticates data returned by seal.
+func (c *crypter) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, errCorrupted
+	}
+	a, err := c.aead(byteOrder.Uint32(sealed), nil)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := a.Open(nil, sealed[4:4+nonceSize], sealed[4+nonceSize:], ad)
+	if err != nil {
+		return nil, errCorrupted
+	}
+	return plain, nil
+}
+
+// Encrypt implements log.Cipher.
+func (c *crypter) Encrypt(index uint64, b []byte) ([]byte, error) {
+	return c.seal(b, entryAD(index))
+}
+
+// Decrypt implements log.Cipher.
+func (c *crypter) Decrypt(index uint64, b []byte) ([]byte, error) {
+	return c.open(b, entryAD(index))
+}
+
+// entryAD binds the log entry to its index, so that
+// entries cannot be moved around on disk.
+func entryAD(index uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = 'L'
+	byteOrder.PutUint64(b[1:], index)
+	return b
+}
+
+// snapshot files ----------------------------------------------------
+
+// snapshot file is encrypted in blocks of snapBlockSize bytes.
+// each block is: last(1) size(4) sealed
+//
+// the additional data of block is snapshot index, block number
+// and last flag, so that blocks cannot be reordered, moved across
+// snapshots, and the file cannot be truncated at block boundary.
+const snapBlockSize = 64 * 1024
+
+func blockAD(index, block uint64, last bool) []byte {
+	b := make([]byte, 18)
+	b[0] = 'S'
+	byteOrder.PutUint64(b[1:], index)
+	byteOrder.PutUint64(b[9:], block)
+	if last {
+		b[17] = 1
+	}
+	return b
+}
+
+// sealedSize returns size of snapshot file, for
+// given size of snapshot.
+func sealedSize(size int64) int64 {
+	blocks := (size + snapBlockSize - 1) / snapBlockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	return size + blocks*(5+sealOverhead)
+}
+
+type sealWriter struct {
+	c     *crypter
+	w     io.Writer
+	index uint64 // snapshot index
+	block uint64 // next block number
+	buf   []byte
+	size  int64 // number of bytes written
+}
+
+func newSealWriter(c *crypter, w io.Writer, index uint64) *sealWriter {
+	return &sealWriter{c: c, w: w, index: index, buf: make([]byte, 0, snapBlockSize)}
+}
+
+func (w *sealWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		// flush only when more data follows, so that
+		// last block is flushed by close
+		if len(w.buf) == snapBlockSize {
+			if err := w.flush(false); err != nil {
+				return n - len(b), err
+			}
+		}
+		m := snapBlockSize - len(w.buf)
+		if m > len(b) {
+			m = len(b)
+		}
+		w.buf = append(w.buf, b[:m]...)
+		w.size += int64(m)
+		b = b[m:]
+	}
+	return n, nil
+}
+
+func (w *sealWriter) flush(last bool) error {
+	sealed, err := w.c.seal(w.buf, blockAD(w.index, w.block, last))
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, 5)
+	if last {
+		hdr[0] = 1
+	}
+	byteOrder.PutUint32(hdr[1:], uint32(len(sealed)))
+	if _, err = w.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err = w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.block, w.buf = w.block+1, w.buf[:0]
+	return nil
+}
+
+// close flushes the last block. it does not close
+// the underlying writer.
+func (w *sealWriter) close() error {
+	return w.flush(true)
+}
+
+type openReader struct {
+	c     *crypter
+	r     io.Reader
+	index uint64 // snapshot index
+	block uint64 // next block number
+	buf   []byte
+	last  bool // last block is read
+}
+
+func newOpenReader(c *crypter, r io.Reader, index uint64) *openReader {
+	return &openReader{c: c, r: r, index: index}
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *openReader) next() error {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	last, size := hdr[0] == 1, byteOrder.Uint32(hdr[1:])
+	if hdr[0] > 1 || size > snapBlockSize+sealOverhead {
+		return errCorrupted
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := r.c.open(sealed, blockAD(r.index, r.block, last))
+	if err != nil {
+		return err
+	}
+	r.buf, r.block, r.last = plain, r.block+1, last
+	return nil
+}
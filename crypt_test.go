@@ -0,0 +1,231 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCrypter(t *testing.T) {
+	keys := newTestKeys()
+	c := newCrypter(keys)
+
+	sealed, err := c.Encrypt(5, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hello")) {
+		t.Fatal("not encrypted")
+	}
+	plain, err := c.Decrypt(5, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "hello" {
+		t.Fatalf("got %q, want %q", plain, "hello")
+	}
+
+	// entry moved to another index
+	if _, err = c.Decrypt(6, sealed); err != errCorrupted {
+		t.Fatalf("got %v, want errCorrupted", err)
+	}
+
+	// tampered entry
+	sealed[len(sealed)-1] ^= 1
+	if _, err = c.Decrypt(5, sealed); err != errCorrupted {
+		t.Fatalf("got %v, want errCorrupted", err)
+	}
+	if _, err = c.Decrypt(5, sealed[:sealOverhead-1]); err != errCorrupted {
+		t.Fatalf("got %v, want errCorrupted", err)
+	}
+
+	// rotated key, older entries must be still readable
+	keys.rotate()
+	sealed2, err := c.Encrypt(7, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := byteOrder.Uint32(sealed2); got != 2 {
+		t.Fatalf("keyID: got %d, want 2", got)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err = c.Decrypt(5, sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown key
+	keys.forget(1)
+	c = newCrypter(keys)
+	if _, err = c.Decrypt(5, sealed); err == nil {
+		t.Fatal("error expected for unknown key")
+	}
+}
+
+func TestSealWriter(t *testing.T) {
+	c := newCrypter(StaticKey(make([]byte, 32)))
+	for _, size := range []int{0, 1, snapBlockSize - 1, snapBlockSize, snapBlockSize + 1, 3 * snapBlockSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := make([]byte, size)
+			rand.Read(data)
+			buf := new(bytes.Buffer)
+			w := newSealWriter(c, buf, 10)
+			if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.close(); err != nil {
+				t.Fatal(err)
+			}
+			if w.size != int64(size) {
+				t.Fatalf("size: got %d, want %d", w.size, size)
+			}
+			if got, want := int64(buf.Len()), sealedSize(int64(size)); got != want {
+				t.Fatalf("sealedSize: got %d, want %d", got, want)
+			}
+			sealed := buf.Bytes()
+
+			got, err := ioutil.ReadAll(newOpenReader(c, bytes.NewReader(sealed), 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("data mismatch")
+			}
+
+			// sealed with another snapshot index
+			if _, err = ioutil.ReadAll(newOpenReader(c, bytes.NewReader(sealed), 11)); err != errCorrupted {
+				t.Fatalf("got %v, want errCorrupted", err)
+			}
+
+			// truncated at block boundary
+			if size > snapBlockSize {
+				truncated := sealed[:snapBlockSize+5+sealOverhead]
+				if _, err = ioutil.ReadAll(newOpenReader(c, bytes.NewReader(truncated), 10)); err != io.ErrUnexpectedEOF {
+					t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRaft_encryption(t *testing.T) {
+	keys := newTestKeys()
+	c := newCluster(t)
+	c.opt.EncryptionKeys = keys
+	c.opt.LogSegmentSize = 1024
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 20)
+	c.waitFSMLen(20)
+	c.takeSnapshot(ldr, 1, nil)
+
+	// rotate key, and rewrite snapshot with new key
+	keys.rotate()
+	c.sendUpdates(ldr, 21, 40)
+	c.waitFSMLen(40)
+	c.takeSnapshot(ldr, 1, nil)
+
+	// restart needs both keys, because log may have
+	// entries encrypted with older key
+	flrs[0] = c.restart(flrs[0])
+
+	// new node gets snapshot, which is decrypted by leader
+	// and encrypted by the new node
+	m4 := c.launch(1, false)[4]
+	c.ensure(c.waitAddNonvoter(ldr, m4.NID(), c.id2Addr(m4.NID()), false))
+	c.sendUpdates(ldr, 41, 50)
+	c.waitFSMLen(50)
+	c.ensureFSMSame(nil)
+
+	// commands must not be found on disk
+	for _, dir := range c.storage {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(b, []byte("update:")) {
+				t.Errorf("%s is not encrypted", path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// encryption cannot be disabled on non-empty storage
+	c.shutdown(ldr)
+	opt := c.opt
+	opt.EncryptionKeys = nil
+	if _, err := New(opt, c.newFSM(identity{ldr.cid, ldr.nid}), c.storage[ldr.nid]); err == nil {
+		t.Fatal("disabling encryption must fail")
+	}
+}
+
+// helpers -----------------------------------------
+
+type testKeys struct {
+	mu      sync.Mutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func newTestKeys() *testKeys {
+	k := &testKeys{keys: make(map[uint32][]byte)}
+	k.rotate()
+	return k
+}
+
+func (k *testKeys) rotate() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := make([]byte, 16)
+	rand.Read(key)
+	k.current++
+	k.keys[k.current] = key
+}
+
+func (k *testKeys) forget(id uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+}
+
+func (k *testKeys) CurrentKey() (uint32, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key %d", id)
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+// ApplyWithID task is same as UpdateFSM, but identified by id. If leader
+// receives an update with same id and same data, within
+// Options.DuplicateWindow since it received the first one, the update
+// is not appended again, and the task is replied with the result of the
+// first update. This protects against duplicates caused by aggressive
+// client retry loops.
+//
+// Unlike UpdateFSMOnce, ids are remembered only by the leader, and are
+// not part of the log. So a retry submitted to new leader, after
+// leadership change, is appended again.
+//
+// If id is empty or DuplicateWindow is zero, this behaves same as UpdateFSM.
+func ApplyWithID(id string, data []byte) FSMTask {
+	ne := fsmTask(entryUpdate, nil, data).newEntry()
+	ne.reqID = id
+	return ne
+}
+
+// dedup tracks the recent ApplyWithID entries received by leader.
+type dedup struct {
+	window time.Duration
+	reqs   map[string]*dedupReq
+	order  []*dedupReq // in order of expiry
+}
+
+type dedupReq struct {
+	id     string
+	digest [sha256.Size]byte
+	ne     *newEntry // first entry received with id
+	expiry time.Time
+}
+
+func (d *dedup) reset() {
+	d.reqs, d.order = nil, nil
+}
+
+// check returns true, if ne is duplicate of a recent entry. In that case
+// ne is replied with the result of that entry, once it is available.
+// Otherwise ne is remembered, to detect its duplicates.
+func (d *dedup) check(ne *newEntry, now time.Time) bool {
+	if d.window <= 0 || ne.reqID == "" {
+		return false
+	}
+	d.expire(now)
+	digest := sha256.Sum256(ne.data)
+	if req, ok := d.reqs[ne.reqID]; ok && req.digest == digest {
+		if isClosed(req.ne.Done()) {
+			ne.index, ne.term = req.ne.index, req.ne.term
+			ne.reply(req.ne.task.result)
+		} else {
+			req.ne.dups = append(req.ne.dups, ne)
+		}
+		return true
+	}
+	if d.reqs == nil {
+		d.reqs = make(map[string]*dedupReq)
+	}
+	req := &dedupReq{id: ne.reqID, digest: digest, ne: ne, expiry: now.Add(d.window)}
+	d.reqs[req.id] = req
+	d.order = append(d.order, req)
+	return false
+}
+
+// expire forgets the entries, whose window has ended.
+func (d *dedup) expire(now time.Time) {
+	i := 0
+	for i < len(d.order) && !now.Before(d.order[i].expiry) {
+		req := d.order[i]
+		if d.reqs[req.id] == req {
+			delete(d.reqs, req.id)
+		}
+		d.order[i] = nil
+		i++
+	}
+	d.order = d.order[i:]
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestApplyWithID(t *testing.T) {
+	c := newCluster(t)
+	c.opt.DuplicateWindow = time.Second
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	wait := func(task FSMTask) fsmReply {
+		t.Helper()
+		select {
+		case <-task.Done():
+		case <-time.After(c.longTimeout):
+			t.Fatal("task timeout")
+		}
+		if err := task.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return task.Result().(fsmReply)
+	}
+
+	// duplicate of pending entry, is replied along with it.
+	// fsm is blocked, so that first entry remains pending
+	fsm(ldr).mu.Lock()
+	t1, t2 := ApplyWithID("a", []byte("x")), ApplyWithID("a", []byte("x"))
+	_ = ldr.SubmitTask(context.Background(), t1)
+	_ = ldr.SubmitTask(context.Background(), t2)
+	fsm(ldr).mu.Unlock()
+	if r1, r2 := wait(t1), wait(t2); r1 != r2 {
+		t.Fatalf("results: %v != %v", r1, r2)
+	}
+	c.waitFSMLen(1)
+
+	// duplicate of completed entry, is replied with its result
+	t3 := ApplyWithID("a", []byte("x"))
+	_ = ldr.SubmitTask(context.Background(), t3)
+	if r1, r3 := wait(t1), wait(t3); r1 != r3 {
+		t.Fatalf("results: %v != %v", r1, r3)
+	}
+
+	// different id or data, or empty id is not duplicate
+	for i, task := range []FSMTask{ApplyWithID("b", []byte("x")), ApplyWithID("b", []byte("y")), ApplyWithID("", []byte("x")), ApplyWithID("", []byte("x"))} {
+		_ = ldr.SubmitTask(context.Background(), task)
+		wait(task)
+		c.waitFSMLen(uint64(i + 2))
+	}
+
+	// after window, same update is appended again
+	time.Sleep(c.opt.DuplicateWindow)
+	t4 := ApplyWithID("a", []byte("x"))
+	_ = ldr.SubmitTask(context.Background(), t4)
+	wait(t4)
+	c.waitFSMLen(6)
+}
+
+func TestDedup_expire(t *testing.T) {
+	d := dedup{window: time.Second}
+	now := time.Now()
+	newEntry := func(id string) *newEntry {
+		ne := ApplyWithID(id, []byte(id)).newEntry()
+		ne.index = 1
+		return ne
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		if d.check(newEntry(id), now.Add(time.Duration(i)*time.Millisecond)) {
+			t.Fatalf("%s: must not be duplicate", id)
+		}
+	}
+	d.expire(now.Add(time.Second + time.Millisecond))
+	if len(d.reqs) != 1 || len(d.order) != 1 || d.reqs["c"] == nil {
+		t.Fatalf("reqs after expire: %v", d.reqs)
+	}
+	if !d.check(newEntry("c"), now) {
+		t.Fatal("c: must be duplicate")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+// diskFree returns free space of filesystem containing given dir.
+// tests replace it to simulate full disk.
+var diskFree = statfsFree
+
+// checkDisk checks free space of storage dirs, and raises alerts
+// when disk becomes full or available again. see Options.MinFreeDisk
+//
+// while disk is full, leader transfers leadership. This avoids the
+// leader with full disk, from rejecting updates for long time.
+func (r *Raft) checkDisk() {
+	var dir string
+	var free uint64
+	for _, d := range r.diskDirs {
+		f, err := diskFree(d)
+		if err != nil {
+			r.logger.Warn("disk monitoring disabled", "err", err)
+			r.minFreeDisk = 0
+			r.diskTimer.stop()
+			return
+		}
+		if dir == "" || f < free {
+			dir, free = d, f
+		}
+	}
+	if full := free < r.minFreeDisk; full != r.diskFull {
+		r.diskFull = full
+		if full {
+			r.logger.Warn("disk is full", "dir", dir, "free", free)
+			r.alerts.DiskFull(dir, free)
+		} else {
+			r.logger.Info("disk is available", "dir", dir, "free", free)
+			r.alerts.DiskAvailable(dir, free)
+			if r.state == Follower && r.flr.electionAborted {
+				r.flr.resetTimer()
+			}
+		}
+	}
+	if r.diskFull && r.state == Leader && !r.ldr.transfer.inProgress() && r.configs.Latest.numVoters() > 1 {
+		r.logger.Info("transferring leadership, because disk is full")
+		r.ldr.onTransfer(transferLdr{task: newTask()})
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDisk_full(t *testing.T) {
+	disks := newFakeDisks()
+	defer disks.restore()
+	c := newCluster(t)
+	c.opt.MinFreeDisk = 1024
+	c.opt.DiskCheckInterval = 50 * time.Millisecond
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	c.ensure(waitUpdate(ldr, "test", c.longTimeout))
+
+	full, available := make(chan string, 10), make(chan string, 10)
+	alerts := c.alerts[ldr.nid]
+	alerts.mu.Lock()
+	alerts.diskFull = func(dir string, free uint64) { full <- dir }
+	alerts.diskAvailable = func(dir string, free uint64) { available <- dir }
+	alerts.mu.Unlock()
+
+	disks.setFull(c.storage[ldr.nid], true)
+	select {
+	case dir := <-full:
+		if !strings.HasPrefix(dir, c.storage[ldr.nid]) {
+			t.Fatalf("DiskFull.dir: got %s, want dir in %s", dir, c.storage[ldr.nid])
+		}
+	case <-time.After(c.longTimeout):
+		t.Fatal("DiskFull alert is not raised")
+	}
+
+	// updates must be rejected, but reads allowed
+	if _, err := waitUpdate(ldr, "test", c.longTimeout); err != ErrDiskFull {
+		t.Fatalf("update: got %v, want %v", err, ErrDiskFull)
+	}
+	c.ensure(waitRead(ldr, "last", c.longTimeout))
+
+	disks.setFull(c.storage[ldr.nid], false)
+	select {
+	case <-available:
+	case <-time.After(c.longTimeout):
+		t.Fatal("DiskAvailable alert is not raised")
+	}
+	c.ensure(waitUpdate(ldr, "test", c.longTimeout))
+}
+
+// tests that leader with full disk, transfers leadership
+// and does not become leader again
+func TestDisk_full_transfer(t *testing.T) {
+	disks := newFakeDisks()
+	defer disks.restore()
+	c := newCluster(t)
+	c.opt.MinFreeDisk = 1024
+	c.opt.DiskCheckInterval = 50 * time.Millisecond
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	disks.setFull(c.storage[ldr.nid], true)
+	newLdr := c.waitForLeader(flrs...)
+	c.waitForState(ldr, c.longTimeout, Follower) // old leader steps down on seeing new term
+	c.waitCatchup()                              // so that remaining follower's log is uptodate
+
+	// old leader must not win election, even if new leader is lost
+	c.shutdown(newLdr)
+	c.waitForLeader(c.exclude(newLdr, ldr)...)
+	if got := c.getState(ldr); got != Follower {
+		t.Fatalf("state: got %s, want %s", got, Follower)
+	}
+}
+
+// fakeDisks replaces diskFree, to simulate full disk
+// for storage dirs
+type fakeDisks struct {
+	mu   sync.Mutex
+	full map[string]bool
+}
+
+func newFakeDisks() *fakeDisks {
+	d := &fakeDisks{full: make(map[string]bool)}
+	diskFree = d.free
+	return d
+}
+
+func (d *fakeDisks) setFull(storageDir string, full bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.full[storageDir] = full
+}
+
+func (d *fakeDisks) free(dir string) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for storageDir, full := range d.full {
+		if full && strings.HasPrefix(dir, storageDir) {
+			return 0, nil
+		}
+	}
+	return 1 << 40, nil
+}
+
+func (d *fakeDisks) restore() {
+	diskFree = statfsFree
+}
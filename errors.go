@@ -54,6 +54,18 @@ var (
 	// since last snapshot.
 	ErrSnapshotThreshold = plainError("raft.takeSnapshot: not enough outstanding logs to snapshot")
 
+	// ErrCompacted is returned by CommitSubscription.Next, if the entry
+	// is compacted into snapshot.
+	ErrCompacted = plainError("raft: entry compacted into snapshot")
+
+	// ErrSubscriptionClosed is returned by CommitSubscription.Next, if
+	// the subscription is closed.
+	ErrSubscriptionClosed = plainError("raft: subscription closed")
+
+	// ErrMembershipClosed is returned by Membership.Wait, if
+	// the Membership is closed.
+	ErrMembershipClosed = plainError("raft: membership closed")
+
 	// ErrNoUpdates indicates that TakeSnapshot task failed because there are no edits since last snapshot.
 	ErrNoUpdates = plainError("raft.takeSnapshot: no updates since last snapshot")
 
@@ -71,13 +83,96 @@ var (
 
 	// ErrTransferInvalidTarget indicates that TransferLeadership task failed because the target node does not exist.
 	ErrTransferInvalidTarget = plainError("raft.transferLeadership: no such target found")
+
+	// ErrCampaignLost indicates that Campaign task failed because the election
+	// did not make the node leader.
+	ErrCampaignLost = plainError("raft.campaign: election lost")
+
+	// ErrBulkAborted indicates that CommitBulkFSM task failed because leader is not in bulk mode. This happens
+	// if BeginBulkFSM was not submitted, or leadership changed after it.
+	ErrBulkAborted = plainError("raft.commitBulk: bulk mode aborted")
+
+	// ErrBusy is returned for FSMTasks, if leader has too many inflight entries and
+	// Options.RejectBusy is true. User can retry the task after some time.
+	ErrBusy = temporaryError("raft: too many inflight entries")
+
+	// ErrLogFull is returned for FSMTasks, if log exceeds Options.MaxLogBytes with
+	// BlockApply policy, and Options.RejectBusy is true. User can retry the task after
+	// some time.
+	ErrLogFull = temporaryError("raft: log is full")
+
+	// ErrDiskFull is returned for FSMTasks, if free disk space of leader is below
+	// Options.MinFreeDisk. Leader transfers leadership in such case, so user can
+	// retry the task on new leader.
+	ErrDiskFull = temporaryError("raft: disk is full")
+
+	// ErrApplyLag is returned for DirtyReadFSM task submitted to follower, if its
+	// FSM is behind commitIndex by more than Options.MaxApplyLag entries. User can
+	// retry the task after some time, or submit it to another node.
+	ErrApplyLag = temporaryError("raft: fsm is lagging behind")
+
+	// ErrRateLimited is returned for UpdateFSM tasks by the Interceptor of
+	// TenantLimiter, if the tenant exceeds its RateLimit. User can retry the
+	// task after some time.
+	ErrRateLimited = temporaryError("raft: rate limited")
+
+	// ErrStandby is returned for DirtyReadFSM and TakeSnapshot tasks, if the
+	// node is in standby, see Options.Standby.
+	ErrStandby = plainError("raft: node is in standby")
+
+	// ErrUnauthenticated is replied by leader to identity update, if
+	// Options.PeerKey is not set, see Options.AdvertiseAddr.
+	ErrUnauthenticated = plainError("raft: identity update requires Options.PeerKey")
+
+	// ErrUpdateOnceUnsupported is replied by leader to UpdateFSMOnce, if any
+	// node negotiated protocol version that does not support it. This happens
+	// during rolling upgrade, until all nodes are upgraded.
+	ErrUpdateOnceUnsupported = plainError("raft: updateOnce not supported by all nodes")
+
+	// ErrResultUnknown is replied to UpdateFSMOnce, if the update is already
+	// applied, but its result is not known, because the node is restored
+	// from snapshot since then.
+	ErrResultUnknown = plainError("raft: update already applied, result unknown")
+)
+
+// Error categories. Errors returned by raft can be checked
+// against these using errors.Is:
+//
+//   ErrNotLeader   NotLeaderError
+//   ErrInProgress  InProgressError
+//   ErrTimeout     TimeoutError
+//   ErrTemporary   InProgressError, TimeoutError, ErrNotCommitReady,
+//                  ErrBusy, ErrLogFull, ErrDiskFull, ErrApplyLag
+//                  and ErrRateLimited
+//
+// OpError wraps the error returned by storage or FSM, which can be
+// checked using errors.Is and errors.As. The errors returned by Client
+// retain their type, so the same checks apply to remote task failures.
+var (
+	// ErrNotLeader matches any NotLeaderError.
+	ErrNotLeader = plainError("raft: not leader")
+
+	// ErrInProgress matches any InProgressError.
+	ErrInProgress = plainError("raft: another request in progress")
+
+	// ErrTimeout matches any TimeoutError.
+	ErrTimeout = plainError("raft: timeout")
+
+	// ErrTemporary matches any error that is temporary, and
+	// the operation can be retried after some time.
+	ErrTemporary = plainError("raft: temporary error")
 )
 
 var (
-	errAssertion   = plainError("raft: assertion failed")
-	errUnreachable = plainError("raft: unreachable")
-	errInvalidTask = plainError("raft: invalid task")
-	errStop        = plainError("raft: got stop signal")
+	errAssertion    = plainError("raft: assertion failed")
+	errUnreachable  = plainError("raft: unreachable")
+	errInvalidTask  = plainError("raft: invalid task")
+	errStop         = plainError("raft: got stop signal")
+	errStaleTerm    = plainError("raft: term changed")
+	errNoIdentity   = plainError("raft: request without identity handshake")
+	errAuthFailed   = plainError("raft: peer authentication failed")
+	errNotAllowed   = plainError("raft: request not allowed on listener")
+	errPeerMismatch = plainError("raft: request from node other than identified peer")
 )
 
 // -----------------------------------------------------------
@@ -91,6 +186,10 @@ func (e bug) Error() string {
 	return fmt.Sprintf("raft-bug: %s: %v", e.msg, e.err)
 }
 
+func (e bug) Unwrap() error {
+	return e.err
+}
+
 type plainError string
 
 func (e plainError) Error() string {
@@ -106,9 +205,19 @@ type NotLeaderError struct {
 	// who leader is.
 	Leader Node
 
+	// Term is the term, in which Leader is the leader.
+	// It is zero, if this node does not know who leader is.
+	Term uint64
+
 	// Lost is true, if the node lost its leadership before
 	// completing the request.
 	Lost bool
+
+	// Retryable is true, if the request is not applied, and it
+	// is safe to resubmit it to Leader. It is false, if the node
+	// lost its leadership after appending the update to its log,
+	// because the new leader may still commit that entry.
+	Retryable bool
 }
 
 func (e NotLeaderError) Error() string {
@@ -122,12 +231,17 @@ func (e NotLeaderError) Error() string {
 	return "raft: this node is not the leader" + contact
 }
 
-func notLeaderError(r *Raft, lost bool) NotLeaderError {
-	var ldr Node
+// Is reports whether target is ErrNotLeader.
+func (e NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+func notLeaderError(r *Raft, lost, retryable bool) NotLeaderError {
+	err := NotLeaderError{Lost: lost, Retryable: retryable}
 	if r.leader != 0 {
-		ldr = r.configs.Latest.Nodes[r.leader]
+		err.Leader, err.Term = r.configs.Latest.Nodes[r.leader], r.term
 	}
-	return NotLeaderError{Leader: ldr, Lost: lost}
+	return err
 }
 
 // -----------------------------------------------------------
@@ -146,6 +260,11 @@ func (e InProgressError) Error() string {
 // later.
 func (e InProgressError) Temporary() {}
 
+// Is reports whether target is ErrInProgress or ErrTemporary.
+func (e InProgressError) Is(target error) bool {
+	return target == ErrInProgress || target == ErrTemporary
+}
+
 // TimeoutError indicates that timeout occurred in peforming a task.
 // Its value represents the task name, for example "transferLeadership",
 // "configChange" etc.
@@ -159,6 +278,11 @@ func (e TimeoutError) Error() string {
 // later.
 func (e TimeoutError) Temporary() {}
 
+// Is reports whether target is ErrTimeout or ErrTemporary.
+func (e TimeoutError) Is(target error) bool {
+	return target == ErrTimeout || target == ErrTemporary
+}
+
 // -----------------------------------------------------------
 
 // OpError is the error type usually returned when an error
@@ -177,6 +301,11 @@ func (e OpError) Error() string {
 	return fmt.Sprintf("raft: %s: %v", e.Op, e.Err)
 }
 
+// Unwrap returns the underlying error.
+func (e OpError) Unwrap() error {
+	return e.Err
+}
+
 func opError(err error, format string, v ...interface{}) OpError {
 	return OpError{
 		Op:  fmt.Sprintf(format, v...),
@@ -184,10 +313,29 @@ func opError(err error, format string, v ...interface{}) OpError {
 	}
 }
 
+// ApplyPanicError is the result of UpdateFSM task, whose command
+// made FSM panic. What happens to the node depends on
+// Options.ApplyPanicPolicy.
+type ApplyPanicError struct {
+	// Index is the index of log entry, whose command made FSM panic.
+	Index uint64
+
+	// Value is the value recovered from panic.
+	Value interface{}
+}
+
+func (e ApplyPanicError) Error() string {
+	return fmt.Sprintf("raft: fsm panicked applying entry %d: %v", e.Index, e.Value)
+}
+
 type remoteError struct {
 	error
 }
 
+func (e remoteError) Unwrap() error {
+	return e.error
+}
+
 // -----------------------------------------------------------
 
 // IdentityError signals that identity of node at given transport
@@ -206,6 +354,54 @@ func (e IdentityError) Error() string {
 
 // -----------------------------------------------------------
 
+// AuthError signals that the node at given transport address could
+// not be authenticated, or did not accept this node's credentials.
+// This happens if the nodes do not agree on Options.PeerKey.
+type AuthError struct {
+	Node uint64
+	Addr string
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("raft: authentication with server at %s for nid=%d failed", e.Addr, e.Node)
+}
+
+// -----------------------------------------------------------
+
+// VersionError signals that node at given transport address does not
+// support any of the protocol versions supported by this node. This
+// happens during rolling upgrade, if the versions of nodes are too far
+// apart.
+type VersionError struct {
+	Node uint64
+	Addr string
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("raft: server at %s for nid=%d does not support protocol versions %d to %d", e.Addr, e.Node, minProtocol, maxProtocol)
+}
+
+// -----------------------------------------------------------
+
+// PrecheckError is returned by PrecheckNode task, and by ChangeConfig
+// when Options.PrecheckNodes is set, if the node at given address is
+// unreachable or incompatible.
+type PrecheckError struct {
+	Node uint64
+	Addr string
+	Err  error
+}
+
+func (e PrecheckError) Error() string {
+	return fmt.Sprintf("raft: precheck of node %d at %s failed: %v", e.Node, e.Addr, e.Err)
+}
+
+func (e PrecheckError) Unwrap() error {
+	return e.Err
+}
+
+// -----------------------------------------------------------
+
 // The TemporaryError interface identifies an error that is temporary.
 // This signals user to retry the operation after some time.
 type TemporaryError interface {
@@ -226,17 +422,19 @@ func (e temporaryError) Error() string {
 
 func (e temporaryError) Temporary() {}
 
+func (e temporaryError) Is(target error) bool {
+	return target == ErrTemporary
+}
+
 // -----------------------------------------------------------
 
 func assert(b bool) {
 	if !b {
-		println("barrier") // wait for tracer to finish
 		panic(errAssertion)
 	}
 }
 
 func unreachable() error {
-	println("barrier") // wait for tracer to finish
 	return errUnreachable
 }
 
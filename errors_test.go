@@ -0,0 +1,82 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestErrors_is(t *testing.T) {
+	tests := []struct {
+		err    error
+		target error
+		want   bool
+	}{
+		{NotLeaderError{Lost: true}, ErrNotLeader, true},
+		{NotLeaderError{}, ErrTemporary, false},
+		{InProgressError("transferLeadership"), ErrInProgress, true},
+		{InProgressError("transferLeadership"), ErrTemporary, true},
+		{InProgressError("transferLeadership"), InProgressError("transferLeadership"), true},
+		{InProgressError("transferLeadership"), InProgressError("bulkIngest"), false},
+		{TimeoutError("configChange"), ErrTimeout, true},
+		{TimeoutError("configChange"), ErrTemporary, true},
+		{ErrBusy, ErrTemporary, true},
+		{ErrNotCommitReady, ErrTemporary, true},
+		{ErrServerClosed, ErrTemporary, false},
+		{ErrServerClosed, ErrServerClosed, true},
+		{opError(os.ErrNotExist, "Log.Get(%d)", 1), os.ErrNotExist, true},
+		{remoteError{ErrStaleConfig}, ErrStaleConfig, true},
+	}
+	for _, test := range tests {
+		if got := errors.Is(test.err, test.target); got != test.want {
+			t.Errorf("errors.Is(%#v, %#v): got %v, want %v", test.err, test.target, got, test.want)
+		}
+	}
+
+	var nle NotLeaderError
+	if err := error(opError(NotLeaderError{Term: 3}, "test")); !errors.As(err, &nle) || nle.Term != 3 {
+		t.Errorf("errors.As: got %#v", nle)
+	}
+}
+
+func TestErrors_encode(t *testing.T) {
+	errs := []error{
+		nil,
+		NotLeaderError{Leader: Node{ID: 2, Addr: "localhost:7000"}, Term: 5, Lost: true},
+		ErrServerClosed,
+		ErrBusy,
+		InProgressError("configChange"),
+		TimeoutError("transferLeadership"),
+		OpError{Op: "Log.Get(1)", Err: errors.New("disk failure")},
+		errors.New("some error"),
+	}
+	for _, err := range errs {
+		b := new(bytes.Buffer)
+		if err := encodeError(err, b); err != nil {
+			t.Fatal(err)
+		}
+		got := decodeError(b)
+		if !reflect.DeepEqual(got, err) {
+			t.Errorf("got %#v, want %#v", got, err)
+		}
+		if b.Len() != 0 {
+			t.Errorf("%v: %d bytes are not read", err, b.Len())
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -84,10 +85,8 @@ func (h handler) replyErr(w http.ResponseWriter, r *http.Request, err error) {
 }
 
 func (h handler) execute(t raft.FSMTask) (interface{}, error) {
-	select {
-	case <-h.r.Closed():
-		return nil, raft.ErrServerClosed
-	case h.r.FSMTasks() <- t:
+	if err := h.r.SubmitTask(context.Background(), t); err != nil {
+		return nil, err
 	}
 	<-t.Done()
 	return t.Result(), t.Err()
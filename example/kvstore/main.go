@@ -30,6 +30,12 @@
 //
 // Note: we are using Node.Data to store http-addr, which enables us to enable http redirects.
 //
+// raft-addr need not be the address in raft config. For example when running
+// in docker with port mapping, listen on 0.0.0.0:7001 and use the address of
+// mapped host port in config:
+//   $ CID=1234 NID=1 kvstore data1 0.0.0.0:7001 0.0.0.0:8001
+//   $ raftctl config apply +nid=1,voter=true,addr=host1:17001,data=host1:18001 ...
+//
 // to bootstrap cluster:
 //   $ RAFT_ADDR=localhost:7001 raftctl config apply \
 //        +nid=1,voter=true,addr=localhost:7001,data=localhost:8001 \
@@ -72,6 +78,7 @@ func main() {
 
 	store := newKVStore()
 	opt := raft.DefaultOptions()
+	opt.HandoffOnShutdown = true
 	r, err := raft.New(opt, store, storageDir)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,231 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/santhosh-tekuri/raft/log"
+)
+
+// StateExportVersion is the version of StateExport format.
+// It is incremented on any incompatible change to the format.
+const StateExportVersion = 1
+
+// StateExport is the consensus relevant state of a node, meant
+// for external verification tools such as TLA+ trace checkers
+// and auditors. It is json serializable, and its format is
+// identified by Version.
+//
+// Log is summarized as ranges of consecutive entries with same
+// term. Nodes agree on log upto an index, if their ranges and
+// hashes upto that index are same.
+type StateExport struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	CID     uint64    `json:"cid"`
+	NID     uint64    `json:"nid"`
+	State   State     `json:"state"`
+
+	Term     uint64 `json:"term"`
+	VotedFor uint64 `json:"votedFor"`
+	Leader   uint64 `json:"leader"`
+
+	SnapshotIndex uint64 `json:"snapshotIndex"`
+	SnapshotTerm  uint64 `json:"snapshotTerm"`
+	CommitIndex   uint64 `json:"commitIndex"`
+	LastLogIndex  uint64 `json:"lastLogIndex"`
+	LastLogTerm   uint64 `json:"lastLogTerm"`
+
+	// Terms are the ranges of log entries after snapshot
+	Terms []TermRange `json:"terms"`
+
+	// Configs is the config history, starting with the config
+	// in snapshot if any, followed by config entries in log.
+	Configs []Config `json:"configs"`
+}
+
+// TermRange represents consecutive log entries with same term.
+type TermRange struct {
+	Term  uint64 `json:"term"`
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+
+	// Hash is hex encoded sha256 of the entries in range,
+	// computed over their binary encoding
+	Hash string `json:"hash"`
+}
+
+type exportState struct {
+	*task
+}
+
+// ExportState task is used to get StateExport of the node.
+//
+// Committed log entries are read in another goroutine, so
+// the node continues to serve while the export is in progress.
+func ExportState() Task {
+	return exportState{task: newTask()}
+}
+
+// EmitState submits ExportState task to r every interval, and
+// calls fn with the result. It returns ErrServerClosed when r is
+// closed, or the error if the task fails.
+func EmitState(r *Raft, interval time.Duration, fn func(StateExport)) error {
+	for {
+		t := ExportState()
+		result, err := r.do(context.Background(), t)
+		if err != nil {
+			return err
+		}
+		fn(result.(StateExport))
+		timer := r.clock.NewTimer(interval)
+		select {
+		case <-r.Closed():
+			timer.Stop()
+			return ErrServerClosed
+		case <-timer.C():
+		}
+	}
+}
+
+func (r *Raft) onExportState(t exportState) {
+	s := StateExport{
+		Version:       StateExportVersion,
+		Time:          r.clock.Now(),
+		CID:           r.cid,
+		NID:           r.nid,
+		State:         r.state,
+		Term:          r.term,
+		VotedFor:      r.votedFor,
+		Leader:        r.leader,
+		SnapshotIndex: r.snaps.index,
+		SnapshotTerm:  r.snaps.term,
+		CommitIndex:   r.commitIndex,
+		LastLogIndex:  r.lastLogIndex,
+		LastLogTerm:   r.lastLogTerm,
+		Terms:         []TermRange{},
+		Configs:       []Config{},
+	}
+	if r.snaps.index > 0 {
+		meta, err := r.snaps.meta()
+		if err != nil {
+			t.reply(opError(err, "snapshots.meta"))
+			return
+		}
+		s.Configs = append(s.Configs, meta.config)
+	}
+
+	// uncommitted entries can be removed by removeGTE,
+	// so they are read now, and committed entries later
+	from := r.log.PrevIndex() + 1
+	commitIndex := r.commitIndex
+	if commitIndex < from-1 {
+		commitIndex = from - 1
+	}
+	var uncommitted [][]byte
+	for i := commitIndex + 1; i <= r.lastLogIndex; i++ {
+		b, err := r.log.Get(i)
+		if err != nil {
+			t.reply(opError(err, "Log.Get(%d)", i))
+			return
+		}
+		uncommitted = append(uncommitted, append([]byte(nil), b...))
+	}
+	reader, err := r.log.NewReader(from, commitIndex)
+	if err != nil {
+		t.reply(opError(err, "Log.NewReader(%d, %d)", from, commitIndex))
+		return
+	}
+
+	go func() {
+		defer reader.Close()
+		ex := &stateExporter{s: s}
+		if err := ex.addEntries(reader); err != nil {
+			t.reply(err)
+			return
+		}
+		for _, b := range uncommitted {
+			if err := ex.add(b); err != nil {
+				t.reply(err)
+				return
+			}
+		}
+		t.reply(ex.result())
+	}()
+}
+
+// stateExporter summarizes log entries into term ranges
+// and config history.
+type stateExporter struct {
+	s    StateExport
+	cur  *TermRange
+	hash hash.Hash
+}
+
+func (ex *stateExporter) addEntries(reader *log.Reader) error {
+	for {
+		b, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return opError(err, "Log.Reader.Next")
+		}
+		if err := ex.add(b); err != nil {
+			return err
+		}
+	}
+}
+
+func (ex *stateExporter) add(b []byte) error {
+	e := &entry{}
+	if err := e.decode(bytes.NewReader(b)); err != nil {
+		return opError(err, "entry.decode")
+	}
+	if ex.cur == nil || ex.cur.Term != e.term {
+		ex.endRange()
+		ex.cur = &TermRange{Term: e.term, First: e.index}
+		ex.hash = sha256.New()
+	}
+	ex.cur.Last = e.index
+	_, _ = ex.hash.Write(b)
+	if e.typ == entryConfig {
+		config := Config{}
+		if err := config.decode(e); err != nil {
+			return opError(err, "config.decode")
+		}
+		ex.s.Configs = append(ex.s.Configs, config)
+	}
+	return nil
+}
+
+func (ex *stateExporter) endRange() {
+	if ex.cur != nil {
+		ex.cur.Hash = hex.EncodeToString(ex.hash.Sum(nil))
+		ex.s.Terms = append(ex.s.Terms, *ex.cur)
+		ex.cur = nil
+	}
+}
+
+func (ex *stateExporter) result() StateExport {
+	ex.endRange()
+	return ex.s
+}
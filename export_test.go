@@ -0,0 +1,133 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportState(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	exportState := func(r *Raft) StateExport {
+		t.Helper()
+		result, err := waitTask(r, ExportState(), c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(StateExport)
+	}
+
+	want := exportState(ldr)
+	if want.Version != StateExportVersion {
+		t.Fatalf("version: got %d, want %d", want.Version, StateExportVersion)
+	}
+	if want.State != Leader || want.Leader != ldr.nid || want.Term != c.info(ldr).Term {
+		t.Fatalf("got %+v", want)
+	}
+	if n := len(want.Terms); n == 0 || want.Terms[n-1].Last != want.LastLogIndex {
+		t.Fatalf("terms: got %+v, lastLogIndex %d", want.Terms, want.LastLogIndex)
+	}
+	if len(want.Configs) == 0 || len(want.Configs[0].Nodes) != 3 {
+		t.Fatalf("configs: got %+v", want.Configs)
+	}
+
+	// followers must have same log
+	for _, f := range flrs {
+		got := exportState(f)
+		if got.State != Follower || got.VotedFor != want.VotedFor && got.VotedFor != f.nid {
+			t.Fatalf("M%d: got %+v", f.nid, got)
+		}
+		if !reflect.DeepEqual(got.Terms, want.Terms) {
+			t.Fatalf("M%d.terms: got %+v, want %+v", f.nid, got.Terms, want.Terms)
+		}
+	}
+
+	// log hash must change with new entries
+	c.sendUpdates(ldr, 11, 11)
+	c.waitFSMLen(11)
+	got := exportState(ldr)
+	last, prev := got.Terms[len(got.Terms)-1], want.Terms[len(want.Terms)-1]
+	if last.Term == prev.Term && last.Hash == prev.Hash {
+		t.Fatalf("hash: did not change for %+v", last)
+	}
+
+	// export must survive json roundtrip
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded StateExport
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Time.Equal(got.Time) {
+		t.Fatalf("time: got %v, want %v", decoded.Time, got.Time)
+	}
+	// Node.ID is not serialized, it is the key in Config.Nodes
+	for i, config := range decoded.Configs {
+		for id, n := range config.Nodes {
+			n.ID = id
+			config.Nodes[id] = n
+		}
+		decoded.Configs[i] = config
+	}
+	decoded.Time = got.Time
+	if !reflect.DeepEqual(decoded, got) {
+		t.Fatalf("json: got %+v, want %+v", decoded, got)
+	}
+}
+
+func TestEmitState(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+
+	ch := make(chan StateExport, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- EmitState(ldr, 50*time.Millisecond, func(s StateExport) {
+			select {
+			case ch <- s:
+			default:
+			}
+		})
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-ch:
+			if s.NID != ldr.nid {
+				t.Fatalf("nid: got %d, want %d", s.NID, ldr.nid)
+			}
+		case <-time.After(c.longTimeout):
+			t.Fatal("EmitState: no export")
+		}
+	}
+
+	c.shutdown()
+	select {
+	case err := <-errCh:
+		if err != ErrServerClosed {
+			t.Fatalf("EmitState: got %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(c.longTimeout):
+		t.Fatal("EmitState: did not return after shutdown")
+	}
+}
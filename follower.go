@@ -14,13 +14,15 @@
 
 package raft
 
+import "time"
+
 type follower struct {
 	*Raft
 	electionAborted bool
 }
 
 func (f *follower) init() {
-	f.timer.reset(f.rtime.duration(f.hbTimeout))
+	f.timer.reset(f.electionTimeout())
 	f.electionAborted = false
 }
 
@@ -29,21 +31,37 @@ func (f *follower) release() {}
 func (f *follower) resetTimer() {
 	if yes, _ := f.canStartElection(); yes {
 		f.electionAborted = false
-		f.timer.reset(f.rtime.duration(f.hbTimeout))
+		f.timer.reset(f.electionTimeout())
+	} else if f.diskFull {
+		// keep timer running, so that lost leader is forgotten
+		// and votes are granted to other candidates
+		f.timer.reset(f.electionTimeout())
 	}
 }
 
-func (f *follower) onTimeout() {
-	if trace {
-		println(f, "heartbeatTimeout leader:", f.leader)
+// electionTimeout returns random duration in range
+// [Options.ElectionTimeoutMin, Options.ElectionTimeoutMax).
+// The chosen duration is reported in Info.ElectionTimeout.
+func (r *Raft) electionTimeout() time.Duration {
+	d := r.rtime.between(r.electionMin, r.electionMax)
+	r.chosenTimeout = d
+	r.logger.Debug("election timeout", "timeout", d)
+	if tracer.electionTimeout != nil {
+		tracer.electionTimeout(r, d)
 	}
+	return d
+}
+
+func (f *follower) onTimeout() {
+	f.logger.Debug("heartbeat timeout", "leader", f.leader)
 	f.setLeader(0)
+	f.replyQueuedReads(notLeaderError(f.Raft, true, true))
 	if can, reason := f.canStartElection(); !can {
-		f.electionAborted = true
-		if trace {
-			println(f, "electionAborted", reason)
+		f.logger.Debug("election aborted", "reason", reason)
+		if !f.electionAborted {
+			f.logger.Info("aborting election", "reason", reason)
 		}
-		f.logger.Info(reason+",", "aborting election")
+		f.electionAborted = true
 		if tracer.electionAborted != nil {
 			tracer.electionAborted(f.Raft, reason)
 		}
@@ -63,5 +81,14 @@ func (f *follower) canStartElection() (can bool, reason string) {
 	if !n.Voter {
 		return false, "not voter"
 	}
+	if f.paused {
+		return false, "paused"
+	}
+	if f.stepDown != nil {
+		return false, "stepped down"
+	}
+	if f.diskFull {
+		return false, "disk full"
+	}
 	return true, ""
 }
@@ -0,0 +1,117 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Since protocolV8, requests are sent in a frame:
+//
+//     magic    2 bytes, see frameMagic
+//     version  1 byte, protocol version of request
+//     type     1 byte, rpcType
+//     length   4 bytes, length of encoded request
+//     crc      4 bytes, crc32 castagnoli of version, type, length and request
+//     request  length bytes
+//
+// The bulk data of request, such as the entries of appendReq and
+// the snapshot of installSnapReq, follows the frame. Its size is
+// already known from the request. Note that the crc covers only the
+// frame, not the bulk data: neither entries nor snapshot carry any
+// checksum, so their corruption in transit is not detected.
+//
+// The identityReq is never framed, because its format must never
+// change. Client frames the requests only after the identity handshake
+// negotiates protocolV8 or later. Server accepts both framed and
+// unframed requests, and tells them apart using the first byte of magic,
+// which is neither a valid rpcType nor taskType.
+var frameMagic = [2]byte{0xC7, 0x5A}
+
+const (
+	frameHeaderSize = 12
+	maxFrameSize    = 4 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errNotRaft is returned by server, if the first byte received on
+// connection does not belong to raft protocol. This happens when
+// non-raft clients such as health checkers and port scanners connect.
+var errNotRaft = errors.New("raft: non-raft traffic")
+
+// writeFrame writes req into frame, using buf to encode it.
+func writeFrame(w io.Writer, req request, buf *bytes.Buffer) error {
+	buf.Reset()
+	if err := req.encode(buf); err != nil {
+		return err
+	}
+	if buf.Len() > maxFrameSize {
+		return fmt.Errorf("raft: %s request of size %d exceeds frame limit", req.rpcType(), buf.Len())
+	}
+	var hdr [frameHeaderSize]byte
+	hdr[0], hdr[1] = frameMagic[0], frameMagic[1]
+	hdr[2], hdr[3] = req.getVersion(), uint8(req.rpcType())
+	byteOrder.PutUint32(hdr[4:], uint32(buf.Len()))
+	byteOrder.PutUint32(hdr[8:], frameChecksum(hdr[:], buf.Bytes()))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readFrame reads the frame, whose first byte of magic is already
+// read. It returns the rpcType, and reader of the encoded request.
+func readFrame(r io.Reader, buf *bytes.Buffer) (rpcType, *bytes.Reader, error) {
+	var hdr [frameHeaderSize]byte
+	hdr[0] = frameMagic[0]
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[1] != frameMagic[1] {
+		return 0, nil, errNotRaft
+	}
+	version, typ := hdr[2], rpcType(hdr[3])
+	if version < protocolV8 || version > maxProtocol {
+		return 0, nil, fmt.Errorf("raft: unsupported protocol version %d in frame", version)
+	}
+	if !typ.isValid() || typ == rpcIdentity {
+		return 0, nil, fmt.Errorf("raft: invalid rpcType %d in frame", hdr[3])
+	}
+	size := byteOrder.Uint32(hdr[4:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("raft: frame size %d exceeds limit", size)
+	}
+	buf.Reset()
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if frameChecksum(hdr[:], buf.Bytes()) != byteOrder.Uint32(hdr[8:]) {
+		return 0, nil, fmt.Errorf("raft: checksum mismatch in %s frame", typ)
+	}
+	return typ, bytes.NewReader(buf.Bytes()), nil
+}
+
+func frameChecksum(hdr []byte, req []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr[2:8], crcTable), crcTable, req)
+}
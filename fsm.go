@@ -17,7 +17,10 @@ package raft
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/santhosh-tekuri/raft/log"
 )
@@ -30,7 +33,8 @@ type FSM interface {
 	// Update applies the given command to state machine.
 	// It is invoked once a log entry is committed.
 	// The value returned will be made available as result of
-	// UpdateFSM task.
+	// UpdateFSM task. If it panics, the task is replied with
+	// ApplyPanicError, see Options.ApplyPanicPolicy.
 	Update(cmd []byte) interface{}
 
 	// Read executes the given command to state machine.
@@ -50,6 +54,88 @@ type FSM interface {
 	Restore(io.Reader) error
 }
 
+// AsyncFSM is an FSM that applies updates asynchronously. This
+// allows FSM to pipeline writes to its own backend.
+//
+// If FSM implements AsyncFSM, UpdateAsync is called instead of Update.
+// Raft replies UpdateFSM tasks in log order, and waits for pending
+// updates to complete, before calling Read, Snapshot and Restore.
+type AsyncFSM interface {
+	FSM
+
+	// UpdateAsync applies the given command to state machine. It
+	// can return before the command is applied. done must be called
+	// exactly once, with the result of the command, after it is
+	// applied. done can be called from any goroutine and in any order.
+	UpdateAsync(cmd []byte, done func(result interface{}))
+}
+
+// PersistentFSM is an FSM that durably persists its state. On
+// restart, raft skips restoring snapshot and re-applying entries
+// that FSM already contains.
+//
+// If FSM implements PersistentFSM, UpdateIndex is called instead
+// of Update. An FSM cannot be both AsyncFSM and PersistentFSM.
+type PersistentFSM interface {
+	FSM
+
+	// UpdateIndex is same as Update, but also gets index of the
+	// log entry. FSM must persist the index atomically along with
+	// the changes made by the command.
+	UpdateIndex(index uint64, cmd []byte) interface{}
+
+	// LastApplied returns the index persisted by last UpdateIndex
+	// call. It returns 0, if no such index persisted. This is
+	// called once, when raft starts serving.
+	LastApplied() uint64
+}
+
+// EntryFSM is an FSM that needs metadata of log entries, such as
+// the time at which leader appended the entry.
+//
+// If FSM implements EntryFSM, UpdateEntry is called instead of
+// Update and UpdateIndex. An FSM cannot be both AsyncFSM and EntryFSM.
+type EntryFSM interface {
+	FSM
+
+	// UpdateEntry is same as Update, but gets the log entry with
+	// its metadata. e.Data is the command. If FSM is PersistentFSM,
+	// it must persist e.Index as in UpdateIndex.
+	UpdateEntry(e LogEntry) interface{}
+}
+
+// ForkFSM is an FSM that can capture its state without stopping
+// updates, for example by forking an immutable view of its state.
+//
+// If FSM implements ForkFSM, Fork is called instead of Snapshot, and
+// concurrently with other FSM methods. FSM must also be PersistentFSM
+// or EntryFSM, so that it knows index of the updates in the view.
+type ForkFSM interface {
+	FSM
+
+	// Fork returns FSMState with point-in-time view of FSM, along
+	// with index of the last update included in that view. This index
+	// is the one given to UpdateIndex or UpdateEntry.
+	Fork() (index uint64, state FSMState, err error)
+}
+
+// ShardedFSM is an FSM whose state is partitioned into shards, that
+// are updated independently, for example a map partitioned by key.
+//
+// If FSM implements ShardedFSM and Options.ApplyConcurrency > 1, Update
+// is called concurrently from ApplyConcurrency goroutines. Updates of
+// same shard are applied in log order, one at a time. Raft replies
+// UpdateFSM tasks in log order, and waits for pending updates to complete,
+// before calling Read, Snapshot and Restore. An FSM cannot be both
+// ShardedFSM and AsyncFSM, PersistentFSM or EntryFSM.
+type ShardedFSM interface {
+	FSM
+
+	// ShardKey returns the key of shard, that the given command
+	// updates. It is called from fsm goroutine, before Update.
+	ShardKey(cmd []byte) uint64
+}
+
 // FSMState captures the current state of FSM.
 // It is returned by an FSM in response to a Snapshot.
 // It must be safe to invoke FSMState methods with concurrent
@@ -64,92 +150,371 @@ type FSMState interface {
 }
 
 type stateMachine struct {
+	// copy of index, read by raft goroutine. accessed
+	// atomically, and must be first field for 64-bit alignment
+	index64 uint64
+
 	FSM
 	id    uint64
-	index uint64
+	index uint64 // last applied
 	term  uint64
 	ch    chan interface{}
 	snaps *snapshots
+
+	tracing Tracer
+	logger  *logger
+
+	// not nil, if FSM is PersistentFSM
+	persistent PersistentFSM
+
+	// not nil, if FSM is EntryFSM
+	entries EntryFSM
+
+	// not nil, if FSM is ForkFSM
+	fork ForkFSM
+	view *log.Log // log of recent fsmApply, to find term of forked index
+
+	// not nil, if FSM is AsyncFSM
+	async   AsyncFSM
+	pending *applyQueue
+	last    uint64 // last index given to FSM, can be >index if async
+
+	// not nil, if FSM is ShardedFSM and Options.ApplyConcurrency > 1.
+	// each shard is applied by its own goroutine. pending is used to
+	// reply in log order, as with AsyncFSM
+	sharded ShardedFSM
+	shards  []chan func()
+
+	// results of recent updateOnce entries
+	results *resultCache
+
+	// dirty reads waiting for their minIndex to be applied,
+	// see WithMinIndex
+	waiting []*newEntry
+
+	// see Options.ApplyPanicPolicy. halted is set to 1 atomically,
+	// when FSM panics with HaltNode policy. onPanic reports the
+	// recovered panic to raft goroutine.
+	panicPolicy ApplyPanicPolicy
+	halted      int32
+	onPanic     func(err ApplyPanicError)
 }
 
 func (fsm *stateMachine) runLoop() {
-	// todo: panics are not handled by Raft
-	for t := range fsm.ch {
-		if trace {
-			println(fsm, t)
+	var completed <-chan struct{}
+	if fsm.shards != nil {
+		for _, ch := range fsm.shards {
+			go runShard(ch)
 		}
+		defer func() {
+			for _, ch := range fsm.shards {
+				close(ch)
+			}
+		}()
+	}
+	if fsm.pending != nil {
+		completed = fsm.pending.notify
+		defer fsm.waitApplied()
+	}
+	for {
+		var t interface{}
+		select {
+		case <-completed:
+			fsm.onCompleted()
+			continue
+		case v, ok := <-fsm.ch:
+			if !ok {
+				for _, ne := range fsm.waiting {
+					ne.reply(ErrServerClosed)
+				}
+				return
+			}
+			t = v
+		}
+		fsm.logger.Debug("received", "task", t)
 		switch t := t.(type) {
 		case fsmApply:
 			fsm.onApply(t)
+		case *followerApply:
+			fsm.onApply(t.take())
 		case fsmDirtyRead:
-			resp := fsm.Read(t.ne.cmd)
-			t.ne.reply(resp)
+			if t.ne.minIndex > fsm.last {
+				fsm.waiting = append(fsm.waiting, t.ne)
+			} else {
+				fsm.dirtyRead(t.ne)
+			}
+		case localQuery:
+			if fsm.sharded != nil {
+				fsm.waitApplied() // Read must not run concurrently with Update
+			}
+			t.reply(QueryResult{Index: fsm.index, Result: fsm.Read(t.cmd)})
 		case fsmSnapReq:
 			fsm.onSnapReq(t)
+		case fsmViewReq:
+			t.reply(fsmView{fsm.view, fsm.results.keysAt(t.index)})
 		case fsmRestoreReq:
 			err := fsm.onRestoreReq()
-			if trace {
-				if err != nil {
-					println(fsm, "fsmRestore failed", err)
-				} else {
-					println(fsm, "restored snapshot", fsm.index)
-				}
-			}
+			fsm.logger.Debug("restored snapshot", "index", fsm.index, "err", err)
 			t.err <- err
-		case lastApplied:
-			t.reply(fsm.index)
 		}
+		if len(fsm.waiting) > 0 {
+			fsm.serveWaiting()
+		}
+	}
+}
+
+func (fsm *stateMachine) dirtyRead(ne *newEntry) {
+	if fsm.sharded != nil {
+		fsm.waitApplied() // Read must not run concurrently with Update
+	}
+	ne.reply(fsm.Read(ne.cmd))
+}
+
+// serveWaiting serves the dirty reads, whose minIndex is applied.
+func (fsm *stateMachine) serveWaiting() {
+	i := 0
+	for _, ne := range fsm.waiting {
+		if ne.minIndex > fsm.last {
+			fsm.waiting[i] = ne
+			i++
+			continue
+		}
+		fsm.dirtyRead(ne)
 	}
+	for j := i; j < len(fsm.waiting); j++ {
+		fsm.waiting[j] = nil
+	}
+	fsm.waiting = fsm.waiting[:i]
 }
 
 func (fsm *stateMachine) onApply(t fsmApply) {
-	// process all entries before t.neHead from log
-	commitIndex := t.log.LastIndex()
-	front := commitIndex + 1
-	if t.neHead != nil {
-		front = t.neHead.index
+	fsm.view = t.log
+
+	// process all entries from t.neHead if any, along with
+	// the entries before each of them from log. note that
+	// entries appended in bulk mode are not in t.neHead
+	for ne := t.neHead; ne != nil; ne = ne.next {
+		fsm.applyLog(t.log, ne.index)
+		if fsm.isHalted() {
+			for ; ne != nil; ne = ne.next {
+				ne.reply(ErrServerClosed)
+			}
+			return
+		}
+		assert(ne.index == fsm.last+1)
+		var span Span = nopSpan{}
+		if ne.span != nil {
+			_, span = fsm.tracing.Start(ne.ctx, "raft.apply")
+		}
+		if ne.isLogEntry() {
+			fsm.applyEntry(ne.entry, ne, span)
+			continue
+		}
+		fsm.waitApplied()
+		var resp interface{}
+		if ne.typ == entryRead || ne.typ == entryDirtyRead {
+			resp = fsm.Read(ne.cmd)
+		}
+		span.End()
+		ne.reply(resp)
 	}
-	for fsm.index+1 < front {
-		b, err := t.log.Get(fsm.index + 1)
+
+	// process remaining entries from log
+	commitIndex := t.log.LastIndex()
+	fsm.applyLog(t.log, commitIndex+1)
+	assert(fsm.last == commitIndex || fsm.isHalted())
+}
+
+// applyLog applies entries from log, that are before front.
+func (fsm *stateMachine) applyLog(view *log.Log, front uint64) {
+	for fsm.last+1 < front && !fsm.isHalted() {
+		b, err := view.Get(fsm.last + 1)
 		if err != nil {
-			panic(opError(err, "Log.Get(%d)", fsm.index+1))
+			panic(opError(err, "Log.Get(%d)", fsm.last+1))
 		}
 		e := &entry{}
 		if err := e.decode(bytes.NewReader(b)); err != nil {
-			panic(opError(err, "Log.Get(%d).decode", fsm.index+1))
+			panic(opError(err, "Log.Get(%d).decode", fsm.last+1))
 		}
-		assert(e.index == fsm.index+1)
-		if trace {
-			println(fsm, "apply", e.typ, e.index)
+		assert(e.index == fsm.last+1)
+		fsm.applyEntry(e, nil, nopSpan{})
+	}
+}
+
+// applyEntry applies log entry to FSM. ne is nil if
+// the entry is not submitted to this node.
+func (fsm *stateMachine) applyEntry(e *entry, ne *newEntry, span Span) {
+	if e.typ == entryBatch {
+		fsm.applyBatch(e, ne, span)
+		return
+	}
+	var resp interface{}
+	update, cache := e.isUpdate(), false
+	if e.typ == entryUpdateOnce {
+		var applied bool
+		if resp, applied = fsm.lookupResult(e); applied {
+			update = false
+		} else {
+			cache = true
 		}
-		if e.typ == entryUpdate {
-			fsm.Update(e.data)
+	}
+	fsm.last = e.index
+	if fsm.pending != nil {
+		a := &asyncApply{index: e.index, term: e.term, ne: ne, span: span}
+		if cache {
+			a.key = &resultKey{e.client, e.seq}
+		}
+		fsm.pending.add(a)
+		if update && fsm.async != nil {
+			fsm.async.UpdateAsync(e.data, func(result interface{}) {
+				fsm.pending.complete(a, result)
+			})
+		} else if update {
+			cmd := e.data
+			shard := fsm.sharded.ShardKey(cmd) % uint64(len(fsm.shards))
+			fsm.shards[shard] <- func() {
+				fsm.pending.complete(a, fsm.update(e, cmd))
+			}
+		} else {
+			fsm.pending.complete(a, resp)
+		}
+		return
+	}
+	if update {
+		resp = fsm.update(e, e.data)
+		if fsm.isHalted() {
+			span.End()
+			if ne != nil {
+				ne.reply(resp)
+			}
+			return
 		}
-		fsm.index, fsm.term = e.index, e.term
 	}
+	if cache {
+		fsm.results.set(resultKey{e.client, e.seq}, resp)
+	}
+	fsm.setApplied(e.index, e.term)
+	span.End()
+	if ne != nil {
+		ne.reply(resp)
+	}
+}
 
-	// process all entries from t.neHead if any
-	for ne := t.neHead; ne != nil; ne = ne.next {
-		assert(ne.index == fsm.index+1)
-		if trace {
-			println(fsm, "apply", ne.typ, ne.index)
+// applyBatch applies the commands of composite entry in order,
+// without interleaving commands of other entries.
+func (fsm *stateMachine) applyBatch(e *entry, ne *newEntry, span Span) {
+	cmds, err := decodeBatch(e.data)
+	if err != nil {
+		panic(opError(err, "decodeBatch(%d)", e.index))
+	}
+	results := make([]interface{}, len(cmds))
+	if fsm.pending != nil && fsm.async == nil {
+		// shards must be idle, before we update them
+		fsm.waitApplied()
+	}
+	fsm.last = e.index
+	if fsm.pending != nil {
+		a := &asyncApply{index: e.index, term: e.term, ne: ne, span: span}
+		fsm.pending.add(a)
+		if fsm.async == nil || len(cmds) == 0 {
+			for i, cmd := range cmds {
+				results[i] = fsm.update(e, cmd)
+			}
+			fsm.pending.complete(a, results)
+			return
 		}
-		var resp interface{}
-		if ne.typ == entryRead || ne.typ == entryDirtyRead {
-			resp = fsm.Read(ne.cmd)
-		} else if ne.typ == entryUpdate {
-			resp = fsm.Update(ne.data)
+		remaining := int32(len(cmds))
+		for i, cmd := range cmds {
+			i := i
+			fsm.async.UpdateAsync(cmd, func(result interface{}) {
+				results[i] = result
+				if atomic.AddInt32(&remaining, -1) == 0 {
+					fsm.pending.complete(a, results)
+				}
+			})
 		}
-		if ne.isLogEntry() {
-			fsm.index, fsm.term = ne.index, ne.term
+		return
+	}
+	for i, cmd := range cmds {
+		results[i] = fsm.update(e, cmd)
+		if fsm.isHalted() {
+			span.End()
+			if ne != nil {
+				ne.reply(results[i])
+			}
+			return
 		}
-		ne.reply(resp)
 	}
-	assert(fsm.index == commitIndex)
+	fsm.setApplied(e.index, e.term)
+	span.End()
+	if ne != nil {
+		ne.reply(results)
+	}
+}
+
+// update applies cmd of entry e to FSM, and returns its result.
+// If FSM panics, the panic is recovered and ApplyPanicError is
+// returned. It is called from fsm goroutine or shard goroutines.
+func (fsm *stateMachine) update(e *entry, cmd []byte) (result interface{}) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := ApplyPanicError{Index: e.index, Value: v}
+			if fsm.panicPolicy == HaltNode {
+				atomic.StoreInt32(&fsm.halted, 1)
+			}
+			fsm.onPanic(err)
+			result = err
+		}
+	}()
+	switch {
+	case fsm.entries != nil:
+		le := e.logEntry()
+		if e.typ == entryBatch {
+			le.Type, le.Data = entryUpdate.String(), cmd
+		}
+		return fsm.entries.UpdateEntry(le)
+	case fsm.persistent != nil:
+		return fsm.persistent.UpdateIndex(e.index, cmd)
+	}
+	return fsm.Update(cmd)
+}
+
+// isHalted tells whether FSM panicked with HaltNode policy.
+// No more entries are applied once halted.
+func (fsm *stateMachine) isHalted() bool {
+	return atomic.LoadInt32(&fsm.halted) == 1
+}
+
+// onCompleted replies the async updates completed, in log order.
+func (fsm *stateMachine) onCompleted() {
+	for _, a := range fsm.pending.popCompleted() {
+		fsm.setApplied(a.index, a.term)
+		if a.key != nil {
+			fsm.results.set(*a.key, a.result)
+		}
+		a.span.End()
+		if a.ne != nil {
+			a.ne.reply(a.result)
+		}
+	}
+}
+
+// waitApplied waits for pending async updates to complete.
+func (fsm *stateMachine) waitApplied() {
+	for fsm.index < fsm.last {
+		<-fsm.pending.notify
+		fsm.onCompleted()
+	}
 }
 
 func (fsm *stateMachine) onSnapReq(t fsmSnapReq) {
-	if fsm.index == fsm.snaps.index {
+	fsm.waitApplied()
+	if fsm.isHalted() {
+		// fsm state may be partially updated by the panicked command
+		t.reply(ErrServerClosed)
+		return
+	}
+	if snapIndex, _ := fsm.snaps.latest(); fsm.index == snapIndex {
 		t.reply(ErrNoUpdates)
 		return
 	}
@@ -159,29 +524,294 @@ func (fsm *stateMachine) onSnapReq(t fsmSnapReq) {
 	}
 	state, err := fsm.Snapshot()
 	if err != nil {
-		if trace {
-			println(fsm, "fsm.Snapshot failed", err)
-		}
+		fsm.logger.Debug("fsm.Snapshot failed", "err", err)
 		t.reply(opError(err, "fsm.Snapshot"))
 		return
 	}
 	t.reply(fsmSnapResp{
-		index: fsm.index,
-		term:  fsm.term,
-		state: state,
+		index:   fsm.index,
+		term:    fsm.term,
+		state:   state,
+		results: fsm.results.keysAt(fsm.index),
 	})
 }
 
 func (fsm *stateMachine) onRestoreReq() error {
+	fsm.waitApplied()
 	snap, err := fsm.snaps.open()
 	if err != nil {
 		return opError(err, "snapshots.open")
 	}
 	defer snap.release()
-	if err = fsm.Restore(bufio.NewReader(snap.file)); err != nil {
+	if err = fsm.Restore(bufio.NewReader(snap.data)); err != nil {
 		return opError(err, "FSM.Restore")
 	}
-	fsm.index, fsm.term = snap.meta.index, snap.meta.term
+	fsm.results.restore(snap.meta.results, snap.meta.index)
+	fsm.setApplied(snap.meta.index, snap.meta.term)
+	fsm.last = fsm.index
+	return nil
+}
+
+// asyncApply is an entry given to AsyncFSM or ShardedFSM.
+type asyncApply struct {
+	index  uint64
+	term   uint64
+	ne     *newEntry // nil if not submitted to this node
+	span   Span
+	done   bool
+	result interface{}
+	key    *resultKey // not nil, if result is to be cached
+}
+
+// applyQueue holds entries given to AsyncFSM or ShardedFSM in log
+// order. They are completed in any order, and fsm goroutine is
+// notified, which pops them in log order.
+type applyQueue struct {
+	mu     sync.Mutex
+	list   []*asyncApply
+	notify chan struct{}
+}
+
+func newApplyQueue() *applyQueue {
+	return &applyQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *applyQueue) add(a *asyncApply) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.list = append(q.list, a)
+}
+
+func (q *applyQueue) complete(a *asyncApply, result interface{}) {
+	q.mu.Lock()
+	if a.done {
+		q.mu.Unlock()
+		panic("raft: AsyncFSM called done more than once")
+	}
+	a.done, a.result = true, result
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// runShard applies the updates of a shard, in the order received.
+func runShard(ch <-chan func()) {
+	for update := range ch {
+		update()
+	}
+}
+
+// popCompleted removes the completed entries from front.
+func (q *applyQueue) popCompleted() []*asyncApply {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := 0
+	for i < len(q.list) && q.list[i].done {
+		i++
+	}
+	completed := q.list[:i:i]
+	q.list = q.list[i:]
+	return completed
+}
+
+// lookupResult returns the result of update with same client and seq
+// as e, if it is already applied. Otherwise e is added to the cache,
+// and its result must be set once it is applied.
+func (fsm *stateMachine) lookupResult(e *entry) (interface{}, bool) {
+	k := resultKey{e.client, e.seq}
+	if !fsm.results.contains(k) {
+		// ForkFSM is snapshotted at forked index, which might
+		// be before the keys evicted since latest snapshot
+		pruneLTE := e.index
+		if fsm.fork != nil {
+			pruneLTE, _ = fsm.snaps.latest()
+		}
+		fsm.results.add(k, e.index, int(e.cacheSize), pruneLTE)
+		return nil, false
+	}
+	fsm.waitApplied() // result of async update might be pending
+	return fsm.results.get(k)
+}
+
+type resultKey struct {
+	client, seq uint64
+}
+
+// resultCache holds the results of recent updateOnce entries. Keys
+// are evicted in the order they are added, i.e in log order, as per
+// the cacheSize of the entry being added, so that all nodes evict
+// the same keys.
+//
+// The keys are saved in snapshot, but not their results. Evicted
+// keys are retained until a snapshot beyond their eviction is taken,
+// so that ForkFSM can snapshot the keys at forked index.
+type resultCache struct {
+	keys    []cachedKey // in the order added, evicted keys are in front
+	evicted int         // number of evicted keys in front
+	results map[resultKey]interface{}
+}
+
+type cachedKey struct {
+	resultKey
+	index     uint64 // of entry that added the key
+	evictedAt uint64 // index of entry that evicted the key, zero if not evicted
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{results: make(map[resultKey]interface{})}
+}
+
+func (c *resultCache) contains(k resultKey) bool {
+	_, ok := c.results[k]
+	return ok
+}
+
+// add adds k with nil result, evicting the oldest keys beyond size.
+// Evicted keys, that are evicted at or before pruneLTE are removed.
+func (c *resultCache) add(k resultKey, index uint64, size int, pruneLTE uint64) {
+	i := 0
+	for i < c.evicted && c.keys[i].evictedAt <= pruneLTE {
+		i++
+	}
+	c.keys, c.evicted = c.keys[i:], c.evicted-i
+	c.keys = append(c.keys, cachedKey{resultKey: k, index: index})
+	c.results[k] = nil
+	for len(c.keys)-c.evicted > size {
+		c.keys[c.evicted].evictedAt = index
+		delete(c.results, c.keys[c.evicted].resultKey)
+		c.evicted++
+	}
+}
+
+// set sets the result of k, if k is not evicted.
+func (c *resultCache) set(k resultKey, result interface{}) {
+	if _, ok := c.results[k]; ok {
+		c.results[k] = result
+	}
+}
+
+func (c *resultCache) get(k resultKey) (interface{}, bool) {
+	result, ok := c.results[k]
+	return result, ok
+}
+
+// keysAt returns the keys, that are cached after applying
+// entry at index. index must not be before latest snapshot.
+func (c *resultCache) keysAt(index uint64) []resultKey {
+	var keys []resultKey
+	for _, k := range c.keys {
+		if k.index > index {
+			break
+		}
+		if k.evictedAt == 0 || k.evictedAt > index {
+			keys = append(keys, k.resultKey)
+		}
+	}
+	return keys
+}
+
+// restore replaces the cache with keys of snapshot at index. The
+// results of those updates are not known, so ErrResultUnknown is
+// replied to their retries.
+func (c *resultCache) restore(keys []resultKey, index uint64) {
+	c.keys, c.evicted = c.keys[:0], 0
+	c.results = make(map[resultKey]interface{}, len(keys))
+	for _, k := range keys {
+		c.keys = append(c.keys, cachedKey{resultKey: k, index: index})
+		c.results[k] = ErrResultUnknown
+	}
+}
+
+func writeResultKeys(w io.Writer, keys []resultKey) error {
+	if err := writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := writeUint64(w, k.client); err != nil {
+			return err
+		}
+		if err := writeUint64(w, k.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readResultKeys(r io.Reader) ([]resultKey, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	var keys []resultKey
+	for ; n > 0; n-- {
+		var k resultKey
+		if k.client, err = readUint64(r); err != nil {
+			return nil, err
+		}
+		if k.seq, err = readUint64(r); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// skipApplied tells fsm about entries that PersistentFSM already
+// contains. It returns false, if fsm has to be restored from
+// snapshot. Must be called before fsm goroutine is started.
+func (r *Raft) skipApplied() (bool, error) {
+	if r.fsm.persistent == nil {
+		return false, nil
+	}
+	index := r.fsm.persistent.LastApplied()
+	if index == 0 || index < r.snaps.index {
+		return false, nil
+	}
+	if index > r.lastLogIndex {
+		return false, fmt.Errorf("raft: FSM.LastApplied %d is beyond lastLogIndex %d", index, r.lastLogIndex)
+	}
+	term := r.snaps.term
+	if index > r.snaps.index {
+		var err error
+		if term, err = r.storage.getEntryTerm(index); err != nil {
+			return false, opError(err, "Log.Get(%d)", index)
+		}
+	}
+	r.logger.Debug("fsm already applied", "index", index)
+	r.fsm.setApplied(index, term)
+	r.fsm.last = index
+	if err := r.skipResults(index); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// skipResults restores the cached keys of entries, that PersistentFSM
+// already contains, from latest snapshot and the log after it.
+func (r *Raft) skipResults(index uint64) error {
+	meta, err := r.snaps.meta()
+	if err != nil {
+		return opError(err, "snapshots.meta")
+	}
+	r.fsm.results.restore(meta.results, meta.index)
+	for i := meta.index + 1; i <= index; i++ {
+		b, err := r.log.Get(i)
+		if err != nil {
+			return opError(err, "Log.Get(%d)", i)
+		}
+		e := &entry{}
+		if err = e.decode(bytes.NewReader(b)); err != nil {
+			return opError(err, "Log.Get(%d).decode", i)
+		}
+		if e.typ != entryUpdateOnce {
+			continue
+		}
+		if _, applied := r.fsm.lookupResult(e); !applied {
+			r.fsm.results.set(resultKey{e.client, e.seq}, ErrResultUnknown)
+		}
+	}
 	return nil
 }
 
@@ -194,15 +824,64 @@ type fsmDirtyRead struct {
 	ne *newEntry
 }
 
-type lastApplied struct {
-	*task
+// setApplied sets the last entry applied to FSM.
+func (fsm *stateMachine) setApplied(index, term uint64) {
+	fsm.index, fsm.term = index, term
+	atomic.StoreUint64(&fsm.index64, index)
+}
+
+// applied returns the index of last entry applied to FSM.
+// It can be called from any goroutine.
+func (fsm *stateMachine) applied() uint64 {
+	return atomic.LoadUint64(&fsm.index64)
+}
+
+// onApplyPanic is called when FSM panics applying an entry. It
+// is called from fsm goroutine or shard goroutines.
+func (r *Raft) onApplyPanic(err ApplyPanicError) {
+	if tracer.applyPanic != nil {
+		tracer.applyPanic(r, err.Index, err.Value)
+	}
+	if r.fsm.panicPolicy == HaltNode {
+		r.doClose(err)
+		return
+	}
+	r.fsm.logger.Error("skipping entry", "index", err.Index, "err", err)
 }
 
-func (r *Raft) lastApplied() uint64 {
-	t := lastApplied{newTask()}
-	r.fsm.ch <- t
-	<-t.done
-	return t.result.(uint64)
+// sendFSM sends v to fsm goroutine. Any fsmApply of follower
+// sent earlier is not updated after this, to preserve order.
+func (r *Raft) sendFSM(v interface{}) {
+	r.flrApply = nil
+	r.fsm.ch <- v
+}
+
+// followerApply is fsmApply of follower. Until fsm goroutine takes
+// it, raft goroutine replaces it with fsmApply of later commitIndex,
+// instead of sending another message. So follower is not blocked on
+// fsm.ch, when fsm is slow.
+type followerApply struct {
+	mu    sync.Mutex
+	apply fsmApply
+	taken bool
+}
+
+// update replaces the apply. Returns false, if it is already taken.
+func (a *followerApply) update(apply fsmApply) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.taken {
+		return false
+	}
+	a.apply = apply
+	return true
+}
+
+func (a *followerApply) take() fsmApply {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.taken = true
+	return a.apply
 }
 
 // raft(onRestart/onInstallSnapReq) -> fsmLoop
@@ -214,6 +893,10 @@ type fsmRestoreReq struct {
 
 // todo: trace snapshot start and finish
 func (r *Raft) onTakeSnapshot(t takeSnapshot) {
+	if r.standby {
+		t.reply(ErrStandby)
+		return
+	}
 	if r.snapTakenCh != nil {
 		t.reply(InProgressError("takeSnapshot"))
 		return
@@ -221,9 +904,7 @@ func (r *Raft) onTakeSnapshot(t takeSnapshot) {
 	r.snapTakenCh = make(chan snapTaken, 1)
 	go func(index uint64, config Config) { // tracked by r.snapTakenCh
 		meta, err := doTakeSnapshot(r.fsm, index, config)
-		if trace {
-			println(r, "doTakeSnapshot err:", err)
-		}
+		r.nodeLogger.Debug("snapshot taken", "index", meta.index, "err", err)
 		r.snapTakenCh <- snapTaken{
 			req:  t,
 			meta: meta,
@@ -232,15 +913,56 @@ func (r *Raft) onTakeSnapshot(t takeSnapshot) {
 	}(r.snaps.index+t.threshold, r.configs.Committed)
 }
 
+// checkSnapThreshold takes snapshot in background, if SnapshotThreshold
+// entries are committed since recent snapshot. It must be called after
+// committed entries are sent to fsmLoop, so that they are included
+// in snapshot.
+func (r *Raft) checkSnapThreshold() {
+	if r.snapTakenCh != nil {
+		return
+	}
+	if r.snapThreshold > 0 && r.commitIndex >= r.snaps.index+r.snapThreshold {
+		r.logger.Debug("snapshot threshold reached", "commitIndex", r.commitIndex)
+		r.onTakeSnapshot(takeSnapshot{threshold: r.snapThreshold})
+		return
+	}
+	r.checkLogFull()
+}
+
+// logFull tells whether log exceeds Options.MaxLogBytes.
+func (r *Raft) logFull() bool {
+	return r.maxLogBytes > 0 && r.log.Size() > r.maxLogBytes
+}
+
+// checkLogFull takes snapshot in background, if log is full and
+// new snapshot allows to discard more segments than recent snapshot.
+func (r *Raft) checkLogFull() {
+	if r.snapTakenCh != nil || !r.logFull() {
+		return
+	}
+	if r.log.CanLTE(r.commitIndex) > r.log.CanLTE(r.snaps.index) {
+		r.logger.Debug("log is full", "size", r.log.Size())
+		r.onTakeSnapshot(takeSnapshot{threshold: 1})
+	}
+}
+
 func doTakeSnapshot(fsm *stateMachine, index uint64, config Config) (snapshotMeta, error) {
 	// get fsm state
-	req := fsmSnapReq{task: newTask(), index: index}
-	fsm.ch <- req
-	<-req.Done()
-	if req.Err() != nil {
-		return snapshotMeta{}, req.Err()
+	var resp fsmSnapResp
+	if fsm.fork != nil {
+		var err error
+		if resp, err = fsm.forkState(index); err != nil {
+			return snapshotMeta{}, err
+		}
+	} else {
+		req := fsmSnapReq{task: newTask(), index: index}
+		fsm.ch <- req
+		<-req.Done()
+		if req.Err() != nil {
+			return snapshotMeta{}, req.Err()
+		}
+		resp = req.Result().(fsmSnapResp)
 	}
-	resp := req.Result().(fsmSnapResp)
 	defer resp.state.Release()
 
 	// write snapshot to storage
@@ -248,65 +970,129 @@ func doTakeSnapshot(fsm *stateMachine, index uint64, config Config) (snapshotMet
 	if err != nil {
 		return snapshotMeta{}, opError(err, "snapshots.new")
 	}
-	bufw := bufio.NewWriter(sink.file)
+	sink.meta.results = resp.results
+	bufw := bufio.NewWriter(sink.data)
 	err = resp.state.Persist(bufw)
 	if err == nil {
 		err = bufw.Flush()
 	}
-	meta, doneErr := sink.done(err)
+	meta, doneErr := sink.finish(err)
 	if err != nil {
 		return meta, opError(err, "FSMState.Persist")
 	}
 	if doneErr != nil {
-		return meta, opError(err, "snapshotSink.done")
+		return meta, opError(doneErr, "snapshotSink.finish")
 	}
 	return meta, nil
 }
 
+// forkState gets fsm state from ForkFSM, without pausing fsmLoop.
+// It is called from snapshot goroutine, concurrently with updates.
+func (fsm *stateMachine) forkState(index uint64) (fsmSnapResp, error) {
+	forked, state, err := fsm.fork.Fork()
+	if err != nil {
+		return fsmSnapResp{}, opError(err, "ForkFSM.Fork")
+	}
+	fail := func(err error) (fsmSnapResp, error) {
+		state.Release()
+		return fsmSnapResp{}, err
+	}
+	if snapIndex, _ := fsm.snaps.latest(); forked <= snapIndex {
+		return fail(ErrNoUpdates)
+	}
+	if forked < index {
+		return fail(ErrSnapshotThreshold)
+	}
+
+	// forked entry is in log view of fsmLoop, because
+	// fsm has not seen any entry beyond that view
+	req := fsmViewReq{newTask(), forked}
+	fsm.ch <- req
+	<-req.Done()
+	view := req.Result().(fsmView)
+	if view.log == nil {
+		return fail(opError(log.ErrNotFound, "Log.Get(%d)", forked))
+	}
+	b, err := view.log.Get(forked)
+	if err != nil {
+		return fail(opError(err, "Log.Get(%d)", forked))
+	}
+	e := rawEntry(b)
+	if e.index() != forked {
+		return fail(opError(fmt.Errorf("got %d, want %d", e.index(), forked), "Log.Get(%d).index", forked))
+	}
+	return fsmSnapResp{index: forked, term: e.term(), state: state, results: view.results}, nil
+}
+
 func (r *Raft) onSnapshotTaken(t snapTaken) {
 	r.snapTakenCh = nil // clear in progress flag
 
 	if t.err != nil {
 		if err, ok := t.err.(OpError); ok {
-			r.logger.Warn(trimPrefix(err))
+			r.logger.Error("snapshot failed", "err", err)
 			r.alerts.Error(err)
 		}
 		t.req.reply(t.err)
 		return
 	}
 
-	if r.storage.log.Contains(t.meta.index) {
+	if err := r.snaps.setLatest(t.meta.index, t.meta.term); err != nil {
+		r.logger.Warn("applying snapshots retain failed", "err", err)
+	}
+	r.logger.Info("snapshot taken", "index", t.meta.index, "term", t.meta.term)
+	r.discardSnapshotted()
+	t.req.reply(t.meta.index)
+
+	// fsm might not have applied all committed entries, when snapshot started
+	r.checkLogFull()
+}
+
+// discardSnapshotted discards log entries that are included in recent
+// snapshot. Leader discards only the entries that are replicated to all
+// followers, and is called again when their matchIndex advance or they
+// go offline, so that log does not stay full because a follower was
+// lagging when snapshot is taken. Entries needed only by offline
+// followers are discarded, once their replications switch to new
+// log view, see checkLogCompact.
+func (r *Raft) discardSnapshotted() {
+	if r.storage.log.Contains(r.snaps.index) {
 		// find compact index
 		// nowCompact: min of all matchIndex
 		// canCompact: min of online matchIndex
-		nowCompact, canCompact := t.meta.index, t.meta.index
+		//
+		// entry at matchIndex is kept, since replication
+		// reads its term for next appendReq
+		nowCompact, canCompact := r.snaps.index, r.snaps.index
 		if r.state == Leader {
-			for _, repl := range r.ldr.repls {
-				if repl.status.matchIndex < nowCompact {
-					nowCompact = repl.status.matchIndex
-				}
-				if repl.status.noContact.IsZero() && repl.status.matchIndex < canCompact {
-					canCompact = repl.status.matchIndex
+			for _, repls := range []map[uint64]*replication{r.ldr.repls, r.ldr.removed} {
+				for _, repl := range repls {
+					keep := repl.status.matchIndex
+					if keep > 0 {
+						keep--
+					}
+					if keep < nowCompact {
+						nowCompact = keep
+					}
+					if repl.status.noContact.IsZero() && keep < canCompact {
+						canCompact = keep
+					}
 				}
 			}
 		}
-		if trace {
-			println(r, "nowCompact:", nowCompact, "canCompact:", canCompact)
-		}
 		nowCompact, canCompact = r.log.CanLTE(nowCompact), r.log.CanLTE(canCompact)
-		if trace {
-			println(r, "nowCompact:", nowCompact, "canCompact:", canCompact)
-		}
+		r.logger.Debug("compacting log", "nowCompact", nowCompact, "canCompact", canCompact)
 		if nowCompact > r.log.PrevIndex() {
 			_ = r.compactLog(nowCompact)
 		}
-		if canCompact > nowCompact {
+		if r.state == Leader && canCompact > r.ldr.removeLTE {
 			// notify repls with new logView
 			r.ldr.removeLTE = canCompact
 			r.ldr.notifyFlr(false)
 		}
 	}
-	t.req.reply(t.meta.index)
+	if r.state == Leader {
+		r.ldr.storeHeld()
+	}
 }
 
 // takeSnapshot() -> fsmLoop
@@ -315,11 +1101,24 @@ type fsmSnapReq struct {
 	index uint64
 }
 
+// forkState() -> fsmLoop
+type fsmViewReq struct {
+	*task
+	index uint64 // forked index
+}
+
+// forkState() <- fsmLoop
+type fsmView struct {
+	log     *log.Log
+	results []resultKey // cached at forked index
+}
+
 // takeSnapshot() <- fsmLoop
 type fsmSnapResp struct {
-	index uint64
-	term  uint64
-	state FSMState
+	index   uint64
+	term    uint64
+	state   FSMState
+	results []resultKey
 }
 
 // snapLoop -> raft (after snapshot taken)
@@ -15,7 +15,12 @@
 package raft
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFSM_takeSnap_emptyLog(t *testing.T) {
@@ -54,6 +59,222 @@ func TestFSM_takeSnap_thresholdNotReached(t *testing.T) {
 	c.takeSnapshot(ldr, 2000, ErrSnapshotThreshold)
 }
 
+func TestFSM_takeSnap_threshold(t *testing.T) {
+	c := newCluster(t)
+	c.opt.SnapshotThreshold = 10
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 35)
+	c.waitFSMLen(35)
+
+	// all nodes must take snapshot without explicit request
+	for _, r := range append(flrs, ldr) {
+		var info Info
+		taken := waitForCondition(func() bool {
+			info = c.info(r)
+			return info.SnapshotIndex+10 > info.Committed
+		}, 10*time.Millisecond, c.longTimeout)
+		if !taken {
+			t.Fatalf("M%d.snapshotIndex: got %d, committed %d", r.nid, info.SnapshotIndex, info.Committed)
+		}
+	}
+}
+
+func TestFSM_maxLogBytes(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.MaxLogBytes = 4096
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 500)
+	c.waitFSMLen(500)
+
+	// all nodes must take snapshot and discard log without explicit request
+	for _, r := range append(flrs, ldr) {
+		var info Info
+		discarded := waitForCondition(func() bool {
+			info = c.info(r)
+			return info.SnapshotIndex > 0 && info.FirstLogIndex > 1
+		}, 10*time.Millisecond, c.longTimeout)
+		if !discarded {
+			t.Fatalf("M%d: snapshotIndex: %d, firstLogIndex: %d", r.nid, info.SnapshotIndex, info.FirstLogIndex)
+		}
+	}
+}
+
+func TestFSM_maxLogBytes_rejectApply(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 10 * time.Second
+	c.opt.LogSegmentSize = 1024
+	c.opt.MaxLogBytes = 2048
+	c.opt.RejectBusy = true
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+
+	// isolate all nodes, so that nothing gets committed and log cannot be discarded
+	c.disconnect()
+	last := c.sendUpdates(ldr, 1, 500)
+	c.waitTaskDone(last, c.longTimeout, ErrLogFull)
+
+	// once entries are committed, log must be discarded and updates accepted
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.connect()
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+	c.ensure(waitUpdate(ldr, "update:last", c.longTimeout))
+}
+
+// tests that reads are served, while updates are
+// blocked because log is full
+func TestFSM_maxLogBytes_blockApply(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.MaxLogBytes = 2048
+	lagging := throttleFollower(c, 64)
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+	flr := c.rr[lagging()]
+
+	// flr is lagging, so that log cannot be discarded
+	last := c.sendUpdates(ldr, 1, 500)
+	held := func() bool {
+		n := 0
+		_ = ldr.inspect(func(r *Raft) {
+			if r.state == Leader {
+				n = len(r.ldr.held)
+			}
+		})
+		return n > 0
+	}
+	if !waitForCondition(held, c.commitTimeout, c.longTimeout) {
+		t.Fatal("updates are not held")
+	}
+
+	// dirty read must be served, but barrier must wait for updates
+	c.ensure(waitDirtyRead(ldr, "last", c.longTimeout))
+	barrier := BarrierFSM()
+	_ = ldr.SubmitTask(context.Background(), barrier)
+	select {
+	case <-barrier.Done():
+		t.Fatalf("barrier done before updates: %v", barrier.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once flr is lost, log must be discarded and held updates applied
+	c.shutdown(flr)
+	c.waitTaskDone(last, c.longTimeout, nil)
+	c.waitTaskDone(barrier, c.longTimeout, nil)
+	c.waitFSMLen(500, c.exclude(flr)...)
+}
+
+// tests that log is discarded, once follower that was lagging
+// when snapshot is taken, catches up
+func TestFSM_maxLogBytes_laggingFollower(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	c.opt.MaxLogBytes = 4096
+	_ = throttleFollower(c, 32*1024)
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 1000)
+	c.waitFSMLen(1000)
+	if info := c.info(ldr); info.FirstLogIndex <= 1 {
+		t.Fatalf("snapshotIndex: %d, firstLogIndex: %d", info.SnapshotIndex, info.FirstLogIndex)
+	}
+}
+
+// throttleFollower throttles replication to the follower, that leader
+// starts replicating first. The returned func gives its id.
+func throttleFollower(c *cluster, bandwidth int64) func() uint64 {
+	var mu sync.Mutex
+	var id uint64
+	c.opt.ReplicationThrottle = func(n Node) Throttle {
+		mu.Lock()
+		defer mu.Unlock()
+		if id == 0 {
+			id = n.ID
+		}
+		if n.ID == id {
+			return Throttle{Bandwidth: bandwidth}
+		}
+		return Throttle{}
+	}
+	return func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return id
+	}
+}
+
+func TestFSM_applyPanic_skipEntry(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ApplyPanicPolicy = SkipEntry
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	applyPanic := c.registerFor(eventApplyPanic)
+	defer c.unregister(applyPanic)
+	task := UpdateFSM([]byte("panic"))
+	_ = ldr.SubmitTask(context.Background(), task)
+	<-task.Done()
+	want := ApplyPanicError{Index: task.Index(), Value: "fsmMock: poison command"}
+	if task.Err() != want {
+		t.Fatalf("task.Err: got %v, want %v", task.Err(), want)
+	}
+
+	// all nodes must skip the entry, and continue applying
+	for i := 0; i < 3; i++ {
+		e, err := applyPanic.waitForEvent(c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.index != want.Index {
+			t.Fatalf("M%d: applyPanic index: got %d, want %d", e.src, e.index, want.Index)
+		}
+	}
+	c.ensure(waitUpdate(ldr, "update:11", c.longTimeout))
+	c.waitFSMLen(11)
+}
+
+func TestFSM_applyPanic_haltNode(t *testing.T) {
+	c := newCluster(t)
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	shuttingDown := c.registerFor(eventShuttingDown)
+	defer c.unregister(shuttingDown)
+	task := UpdateFSM([]byte("panic"))
+	_ = ldr.SubmitTask(context.Background(), task)
+	<-task.Done()
+	want := ApplyPanicError{Index: task.Index(), Value: "fsmMock: poison command"}
+	if task.Err() != want {
+		t.Fatalf("task.Err: got %v, want %v", task.Err(), want)
+	}
+
+	// all nodes must shutdown with the panic, instead of crashing
+	for i := 0; i < 3; i++ {
+		e, err := shuttingDown.waitForEvent(c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.err != want {
+			t.Fatalf("M%d: shutdown reason: got %v, want %v", e.src, e.err, want)
+		}
+		if got := c.serveError(c.rr[e.src]); got != want {
+			t.Fatalf("M%d: serve=%v, want %v", e.src, got, want)
+		}
+	}
+}
+
 func TestFSM_takeSnap_restartSendUpdates(t *testing.T) {
 	c := newCluster(t)
 	c.opt.LogSegmentSize = 1024
@@ -93,3 +314,589 @@ func TestFSM_takeSnap_restartSendUpdates(t *testing.T) {
 	c.sendUpdates(r, 1, 3)
 	c.waitFSMLen(fsmLen+3, r)
 }
+
+func TestFSM_bulk(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// commit barrier without bulk mode must fail
+	if _, err := waitFSMTask(ldr, CommitBulkFSM(), c.longTimeout); err != ErrBulkAborted {
+		t.Fatalf("commitBulk: got %v, want %v", err, ErrBulkAborted)
+	}
+
+	c.ensure(waitFSMTask(ldr, BeginBulkFSM(), c.longTimeout))
+	if _, err := waitFSMTask(ldr, BeginBulkFSM(), c.longTimeout); err != InProgressError("bulkIngest") {
+		t.Fatalf("beginBulk: got %v, want InProgressError", err)
+	}
+
+	// updates must be replied without applying to leader's fsm
+	last := c.sendUpdates(ldr, 1, 100)
+	c.waitTaskDone(last, c.longTimeout, nil)
+	c.waitFSMLen(100, flrs...)
+	if got := fsm(ldr).len(); got != 0 {
+		t.Fatalf("ldr.fsmLen: got %d, want 0", got)
+	}
+
+	// reads must wait for commit barrier
+	read := ReadFSM("last")
+	_ = ldr.SubmitTask(context.Background(), read)
+	select {
+	case <-read.Done():
+		t.Fatalf("read.Err: got %v, want no reply", read.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// commit barrier applies all to leader's fsm
+	c.ensure(waitFSMTask(ldr, CommitBulkFSM(), c.longTimeout))
+	if got := fsm(ldr).len(); got != 100 {
+		t.Fatalf("ldr.fsmLen: got %d, want 100", got)
+	}
+	c.waitTaskDone(read, c.longTimeout, nil)
+
+	// normal semantics resumed
+	if _, err := waitUpdate(ldr, "hello", c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFSMLen(101)
+}
+
+func TestFSM_async(t *testing.T) {
+	c := newCluster(t)
+	c.asyncFSM = true
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// updates must be replied in order
+	var tasks []FSMTask
+	for i := 1; i <= 100; i++ {
+		task := UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))
+		_ = ldr.SubmitTask(context.Background(), task)
+		tasks = append(tasks, task)
+	}
+	c.waitTaskDone(tasks[len(tasks)-1], c.longTimeout, nil)
+	for i, task := range tasks {
+		select {
+		case <-task.Done():
+		default:
+			t.Fatalf("update:%d replied before update:%d", len(tasks), i+1)
+		}
+		if got := task.Result().(fsmReply).index; got != i+1 {
+			t.Fatalf("update:%d result: got %d, want %d", i+1, got, i+1)
+		}
+	}
+	c.waitFSMLen(100)
+
+	// read must see all updates
+	if reply, err := waitRead(ldr, "last", c.longTimeout); err != nil || reply.msg != "update:100" {
+		t.Fatalf("read: got %v %v, want update:100", reply, err)
+	}
+
+	// lastApplied must reach commitIndex
+	c.waitBarrier(ldr, 0)
+	if info := c.info(ldr); info.LastApplied != info.Committed {
+		t.Fatalf("lastApplied: got %d, want %d", info.LastApplied, info.Committed)
+	}
+
+	// snapshot and restart restores from it
+	c.takeSnapshot(ldr, 0, nil)
+	r := c.restart(ldr)
+	c.waitFSMLen(100, r)
+}
+
+func TestFSM_updateOnce(t *testing.T) {
+	t.Run("sync", func(t *testing.T) { testUpdateOnce(t, false) })
+	t.Run("async", func(t *testing.T) { testUpdateOnce(t, true) })
+}
+
+func testUpdateOnce(t *testing.T, async bool) {
+	c := newCluster(t)
+	c.asyncFSM = async
+	c.opt.ResultCacheSize = 2
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	update := func(r *Raft, seq uint64, want fsmReply) {
+		t.Helper()
+		reply, err := waitFSMTask(r, UpdateFSMOnce(7, seq, []byte(fmt.Sprintf("update:%d", seq))), c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != want {
+			t.Fatalf("update seq %d: got %v, want %v", seq, reply, want)
+		}
+	}
+
+	// retry must be replied with original result, without applying again
+	update(ldr, 1, fsmReply{"update:1", 1})
+	update(ldr, 1, fsmReply{"update:1", 1})
+	c.waitBarrier(ldr, 0)
+	c.waitFSMLen(1)
+
+	// retry to new leader must get original result
+	c.shutdown(ldr)
+	ldr = c.waitForLeader(flrs...)
+	update(ldr, 1, fsmReply{"update:1", 1})
+	c.waitBarrier(ldr, 0)
+	c.waitFSMLen(1, flrs...)
+
+	// once evicted, update is applied again
+	update(ldr, 2, fsmReply{"update:2", 2})
+	update(ldr, 3, fsmReply{"update:3", 3})
+	update(ldr, 1, fsmReply{"update:1", 4})
+}
+
+// retry of update compacted into snapshot must not be applied again,
+// by nodes restored from that snapshot
+func TestFSM_updateOnceSnapshot(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ResultCacheSize = 2
+	c.opt.LogSegmentSize = 1024
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	if _, err := waitFSMTask(ldr, UpdateFSMOnce(7, 1, []byte("update:1")), c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	<-c.sendUpdates(ldr, 2, 30).Done() // so that log is compacted
+	c.takeSnapshot(ldr, 0, nil)
+	retry := func(r *Raft) {
+		t.Helper()
+		_, err := waitFSMTask(r, UpdateFSMOnce(7, 1, []byte("update:1")), c.longTimeout)
+		if err != ErrResultUnknown {
+			t.Fatalf("retry: got %v, want %v", err, ErrResultUnknown)
+		}
+		c.waitBarrier(r, 0)
+		c.ensureFSMLen(30, r)
+	}
+
+	// keys are restored from snapshot on restart
+	ldr = c.restart(ldr)
+	ldr = c.waitForLeader(ldr)
+	retry(ldr)
+
+	// keys are sent to new node with snapshot
+	m2 := c.launch(1, false)[2]
+	c.ensure(c.waitAddNonvoter(ldr, 2, c.id2Addr(2), true))
+	c.ensure(waitTask(ldr, WaitForStableConfig(), c.longTimeout))
+	c.ensure(waitTask(ldr, TransferLeadership(m2.nid, c.longTimeout), c.longTimeout))
+	retry(c.waitForLeader(m2))
+}
+
+func TestFSM_resultCache(t *testing.T) {
+	c := newResultCache()
+	for seq := uint64(1); seq <= 5; seq++ {
+		c.add(resultKey{7, seq}, seq*10, 2, 0)
+	}
+	keysAt := func(index uint64, want ...resultKey) {
+		t.Helper()
+		if got := c.keysAt(index); !reflect.DeepEqual(got, want) {
+			t.Fatalf("keysAt(%d): got %v, want %v", index, got, want)
+		}
+	}
+	keysAt(50, resultKey{7, 4}, resultKey{7, 5})
+	keysAt(30, resultKey{7, 2}, resultKey{7, 3})
+
+	// shrinking size evicts oldest keys, but keeps
+	// evicted keys needed by snapshots after 30
+	c.add(resultKey{7, 6}, 60, 1, 30)
+	if c.contains(resultKey{7, 5}) || !c.contains(resultKey{7, 6}) {
+		t.Fatal("oldest keys must be evicted")
+	}
+	keysAt(40, resultKey{7, 3}, resultKey{7, 4})
+	keysAt(60, resultKey{7, 6})
+
+	// results of restored keys are not known
+	c.restore([]resultKey{{7, 1}}, 70)
+	if result, ok := c.get(resultKey{7, 1}); !ok || result != ErrResultUnknown {
+		t.Fatalf("result: got %v %v, want %v true", result, ok, ErrResultUnknown)
+	}
+	keysAt(70, resultKey{7, 1})
+}
+
+// leader must reject updateOnce, while any node does not support it
+func TestFSM_updateOnceUnsupported(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ResultCacheSize = 2
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+
+	setVersion := func(v uint8) {
+		t.Helper()
+		err := ldr.inspect(func(r *Raft) {
+			r.ldr.repls[flrs[0].nid].status.version = v
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setVersion(protocolV4)
+	if _, err := waitFSMTask(ldr, UpdateFSMOnce(7, 1, []byte("update:1")), c.longTimeout); err != ErrUpdateOnceUnsupported {
+		t.Fatalf("got %v, want %v", err, ErrUpdateOnceUnsupported)
+	}
+	setVersion(maxProtocol)
+	if _, err := waitFSMTask(ldr, UpdateFSMOnce(7, 1, []byte("update:1")), c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSM_followerApplyLag(t *testing.T) {
+	c := newCluster(t)
+	c.opt.MaxApplyLag = 5
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// block fsm of follower
+	flr := flrs[0]
+	fsm(flr).mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			fsm(flr).mu.Unlock()
+		}
+	}()
+
+	// follower must keep up with leader, even though fsm is blocked
+	c.sendUpdates(ldr, 1, 20)
+	c.waitBarrier(ldr, 0)
+	last := c.info(ldr).LastLogIndex
+	caughtUp := waitForCondition(func() bool {
+		return c.info(flr).Committed == last
+	}, c.heartbeatTimeout/10, c.longTimeout)
+	if !caughtUp {
+		t.Fatalf("follower committed: got %d, want %d", c.info(flr).Committed, last)
+	}
+	if applied := c.info(flr).LastApplied; applied+5 >= last {
+		t.Fatalf("follower lastApplied: got %d, want <%d", applied, last-5)
+	}
+
+	// dirty reads must be rejected, while fsm is lagging
+	if _, err := waitDirtyRead(flr, "last", c.longTimeout); err != ErrApplyLag {
+		t.Fatalf("dirtyRead: got %v, want %v", err, ErrApplyLag)
+	}
+
+	// once fsm catches up, dirty reads must succeed
+	fsm(flr).mu.Unlock()
+	locked = false
+	c.waitFSMLen(20, flr)
+	if reply, err := waitDirtyRead(flr, "last", c.longTimeout); err != nil || reply.msg != "update:20" {
+		t.Fatalf("dirtyRead: got %v %v, want update:20", reply, err)
+	}
+}
+
+func TestFSM_localQuery(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.waitCatchup()
+
+	query := func(r *Raft) QueryResult {
+		t.Helper()
+		result, err := waitTask(r, LocalQuery([]byte("last")), c.longTimeout)
+		if err != nil {
+			t.Fatalf("M%d localQuery: %v", r.nid, err)
+		}
+		return result.(QueryResult)
+	}
+
+	// any node can be queried
+	last := c.info(ldr).LastLogIndex
+	for _, r := range c.rr {
+		got := query(r)
+		if got.Index != last || got.Result != (fsmReply{"update:10", 9}) {
+			t.Fatalf("M%d: got %+v, want {%d update:10}", r.nid, got, last)
+		}
+	}
+
+	// isolated follower serves stale state, with its index
+	flr := flrs[0]
+	c.disconnect(flr)
+	defer c.connect()
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20, ldr, flrs[1])
+	got := query(flr)
+	if got.Index != last || got.Result != (fsmReply{"update:10", 9}) {
+		t.Fatalf("M%d: got %+v, want {%d update:10}", flr.nid, got, last)
+	}
+	if got := query(ldr); got.Index <= last || got.Result != (fsmReply{"update:20", 19}) {
+		t.Fatalf("M%d: got %+v, want update:20 after %d", ldr.nid, got, last)
+	}
+}
+
+func TestFSM_minIndex(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// update reports index and term of its entry
+	update := UpdateFSM([]byte("update:1"))
+	if _, err := waitFSMTask(ldr, update, c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if info := c.info(ldr); update.Index() != info.LastLogIndex || update.Term() != info.Term {
+		t.Fatalf("update: got %d/%d, want %d/%d", update.Index(), update.Term(), info.LastLogIndex, info.Term)
+	}
+	if read := ReadFSM("last"); read.Index() != 0 {
+		t.Fatalf("read.Index: got %d, want 0", read.Index())
+	}
+
+	// isolated follower must wait for minIndex
+	flr := flrs[0]
+	c.disconnect(flr)
+	defer c.connect()
+	update = UpdateFSM([]byte("update:2"))
+	if _, err := waitFSMTask(ldr, update, c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	read := WithMinIndex(update.Index(), DirtyReadFSM("last"))
+	_ = flr.SubmitTask(context.Background(), read)
+	select {
+	case <-read.Done():
+		t.Fatalf("read: got %v %v, want no reply", read.Result(), read.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once follower applies minIndex, read must be served
+	c.connect()
+	c.waitTaskDone(read, c.longTimeout, nil)
+	if got := read.Result().(fsmReply); got.msg != "update:2" {
+		t.Fatalf("read: got %v, want update:2", got)
+	}
+}
+
+func TestFSM_batch(t *testing.T) {
+	t.Run("sync", func(t *testing.T) { testBatch(t, false) })
+	t.Run("async", func(t *testing.T) { testBatch(t, true) })
+}
+
+func testBatch(t *testing.T, async bool) {
+	c := newCluster(t)
+	c.asyncFSM = async
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	apply := func(r *Raft, task FSMTask) ([]interface{}, error) {
+		t.Helper()
+		_ = r.SubmitTask(context.Background(), task)
+		select {
+		case <-task.Done():
+		case <-time.After(c.longTimeout):
+			t.Fatalf("M%d: batch result timeout", r.nid)
+		}
+		return task.Result().([]interface{}), task.Err()
+	}
+	cmds := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	// each command is appended as separate entry
+	last := c.info(ldr).LastLogIndex
+	results, err := apply(ldr, ApplyBatch(cmds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cmd := range cmds {
+		if want := (fsmReply{string(cmd), i + 1}); results[i] != want {
+			t.Fatalf("results[%d]: got %v, want %v", i, results[i], want)
+		}
+	}
+	if got := c.info(ldr).LastLogIndex; got != last+3 {
+		t.Fatalf("lastLogIndex: got %d, want %d", got, last+3)
+	}
+
+	// composite batch is appended as single entry
+	results, err = apply(ldr, ApplyCompositeBatch(cmds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cmd := range cmds {
+		if want := (fsmReply{string(cmd), i + 4}); results[i] != want {
+			t.Fatalf("results[%d]: got %v, want %v", i, results[i], want)
+		}
+	}
+	if got := c.info(ldr).LastLogIndex; got != last+4 {
+		t.Fatalf("lastLogIndex: got %d, want %d", got, last+4)
+	}
+	c.waitFSMLen(6)
+
+	// empty batch
+	if results, err = apply(ldr, ApplyBatch(nil)); err != nil || len(results) != 0 {
+		t.Fatalf("empty batch: got %v %v", results, err)
+	}
+
+	// follower rejects all commands
+	for _, task := range []FSMTask{ApplyBatch(cmds), ApplyCompositeBatch(cmds)} {
+		results, err = apply(flrs[0], task)
+		if _, ok := err.(NotLeaderError); !ok {
+			t.Fatalf("got %v, want NotLeaderError", err)
+		}
+		for i, result := range results {
+			if _, ok := result.(NotLeaderError); !ok {
+				t.Fatalf("results[%d]: got %v, want NotLeaderError", i, result)
+			}
+		}
+	}
+}
+
+func TestFSM_sharded(t *testing.T) {
+	c := newCluster(t)
+	c.shardedFSM = true
+	c.shardBlock = make(chan struct{})
+	c.opt.ApplyConcurrency = 2
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// update of other shard must be applied, while a shard is blocked
+	blocked, other := UpdateFSM([]byte("update:2")), UpdateFSM([]byte("update:3"))
+	_ = ldr.SubmitTask(context.Background(), blocked)
+	_ = ldr.SubmitTask(context.Background(), other)
+	c.waitFSMLen(1, ldr)
+	if got := fsm(ldr).lastCommand(); got != "update:3" {
+		t.Fatalf("applied: got %s, want update:3", got)
+	}
+
+	// updates must be replied in log order
+	select {
+	case <-other.Done():
+		t.Fatal("update:3 replied before update:2")
+	case <-time.After(c.commitTimeout):
+	}
+	close(c.shardBlock)
+	c.waitTaskDone(other, c.longTimeout, nil)
+	if got := blocked.Result().(fsmReply); got != (fsmReply{"update:2", 2}) {
+		t.Fatalf("update:2 result: got %v", got)
+	}
+
+	// composite batch waits for all shards, and applies in order
+	batch := ApplyCompositeBatch([][]byte{[]byte("batch:3"), []byte("batch:2")})
+	_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte("update:4")))
+	_ = ldr.SubmitTask(context.Background(), batch)
+	c.waitTaskDone(batch, c.longTimeout, nil)
+	want := []interface{}{fsmReply{"batch:3", 4}, fsmReply{"batch:2", 5}}
+	if got := batch.Result().([]interface{}); got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("batch result: got %v, want %v", got, want)
+	}
+
+	// snapshot and restart restores from it
+	c.sendUpdates(ldr, 5, 20)
+	c.waitFSMLen(21)
+	c.takeSnapshot(ldr, 0, nil)
+	r := c.restart(ldr)
+	c.waitFSMLen(21, r)
+}
+
+func TestFSM_fork(t *testing.T) {
+	c := newCluster(t)
+	c.forkFSM = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 100)
+	c.waitFSMLen(100)
+
+	// block fork, and take snapshot
+	fsm := ldr.FSM().(*forkFSMMock)
+	forking := make(chan uint64)
+	fsm.mu.Lock()
+	fsm.forking = forking
+	fsm.mu.Unlock()
+	takeSnap := TakeSnapshot(0)
+	_ = ldr.SubmitTask(context.Background(), takeSnap)
+	forked := <-forking
+
+	// updates must be applied, while fork is in progress
+	c.sendUpdates(ldr, 101, 110)
+	c.waitFSMLen(110)
+	fsm.mu.Lock()
+	fsm.forking = nil
+	fsm.mu.Unlock()
+	forking <- 0
+	<-takeSnap.Done()
+	if takeSnap.Err() != nil {
+		t.Fatal(takeSnap.Err())
+	}
+	if got := takeSnap.Result(); got != forked {
+		t.Fatalf("snapIndex: got %v, want %d", got, forked)
+	}
+
+	// snapshot again, then there are no updates to fork
+	c.takeSnapshot(ldr, 0, nil)
+	c.takeSnapshot(ldr, 0, ErrNoUpdates)
+}
+
+func TestFSM_persistent(t *testing.T) {
+	c := newCluster(t)
+	c.persistentFSM = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 100)
+	c.waitBarrier(ldr, 0)
+	c.takeSnapshot(ldr, 0, nil)
+	c.sendUpdates(ldr, 101, 110)
+	c.waitBarrier(ldr, 0)
+	lastApplied := ldr.FSM().(*persistentFSMMock).LastApplied()
+
+	// restart must neither restore nor reapply entries
+	r := c.restart(ldr)
+	c.waitForLeader(r)
+	c.waitBarrier(r, 0)
+	pfsm := r.FSM().(*persistentFSMMock)
+	if n := pfsm.numRestores(); n != 0 {
+		t.Fatalf("numRestores: got %d, want 0", n)
+	}
+	if got := pfsm.len(); got != 110 {
+		t.Fatalf("fsmLen: got %d, want 110", got)
+	}
+	if got := c.info(r).LastApplied; got <= lastApplied {
+		t.Fatalf("lastApplied: got %d, want >%d", got, lastApplied)
+	}
+
+	// new updates are applied
+	c.sendUpdates(r, 111, 111)
+	c.waitFSMLen(111, r)
+	if cmd := pfsm.lastCommand(); cmd != "update:111" {
+		t.Fatalf("fsm.lastCommand: got %s want update:111", cmd)
+	}
+}
+
+func TestFSM_entry(t *testing.T) {
+	c := newCluster(t)
+	c.entryFSM = true
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	before := time.Now()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	// all nodes get time and leader of entry
+	for _, r := range c.rr {
+		e := r.FSM().(*entryFSMMock).lastEntry()
+		if e.Index != ldr.lastLogIndex || string(e.Data) != "update:10" {
+			t.Fatalf("M%d entry: got %d %q, want %d update:10", r.nid, e.Index, e.Data, ldr.lastLogIndex)
+		}
+		if e.Leader != ldr.nid {
+			t.Fatalf("M%d entry.Leader: got M%d, want M%d", r.nid, e.Leader, ldr.nid)
+		}
+		if e.Time.Before(before) || e.Time.After(time.Now()) {
+			t.Fatalf("M%d entry.Time: got %v, want after %v", r.nid, e.Time, before)
+		}
+	}
+
+	// followers report replication lag
+	for _, r := range flrs {
+		if lag := c.info(r).ReplicationLag; lag <= 0 {
+			t.Fatalf("M%d replicationLag: got %s, want >0", r.nid, lag)
+		}
+	}
+	if lag := c.info(ldr).ReplicationLag; lag != 0 {
+		t.Fatalf("leader replicationLag: got %s, want 0", lag)
+	}
+
+	// GetLogEntries returns metadata
+	result, err := waitTask(flrs[0], GetLogEntries(ldr.lastLogIndex, ldr.lastLogIndex), c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := result.([]LogEntry)[0]; e.Leader != ldr.nid || e.Time.IsZero() {
+		t.Fatalf("logEntry: got leader M%d time %v", e.Leader, e.Time)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Future is a typed handle to a Task. Result of the task is
+// asserted to T, so that FSM responses are type-safe:
+//
+//     f := raft.Apply[int](r, cmd)
+//     n, err := f.Wait(ctx)
+//
+// Future is available only on Go 1.18 or later. Use Task
+// directly on older versions.
+type Future[T any] struct {
+	t Task
+}
+
+// Typed returns Future of given task, whose result is of type T.
+// The task must be submitted separately.
+func Typed[T any](t Task) Future[T] {
+	return Future[T]{t}
+}
+
+// Apply submits UpdateFSM task with cmd to r. Result of the Future
+// is the value returned by FSM for cmd. If r is closed, the Future
+// completes with ErrServerClosed.
+func Apply[T any](r *Raft, cmd []byte) Future[T] {
+	return submitFSM[T](r, UpdateFSM(cmd))
+}
+
+// Read submits ReadFSM task with cmd to r. Result of the Future is
+// the value returned by FSM for cmd. If r is closed, the Future
+// completes with ErrServerClosed.
+func Read[T any](r *Raft, cmd interface{}) Future[T] {
+	return submitFSM[T](r, ReadFSM(cmd))
+}
+
+func submitFSM[T any](r *Raft, t FSMTask) Future[T] {
+	if err := r.SubmitTask(context.Background(), t); err != nil {
+		t.reply(err)
+	}
+	return Future[T]{t}
+}
+
+// Task returns the underlying task.
+func (f Future[T]) Task() Task {
+	return f.t
+}
+
+// Done returns a channel that is closed when task is completed.
+func (f Future[T]) Done() <-chan struct{} {
+	return f.t.Done()
+}
+
+// Err returns the error if any. It also returns error, if the result
+// is not of type T. Must be called only on completed task.
+func (f Future[T]) Err() error {
+	_, err := f.result()
+	return err
+}
+
+// Result returns the result. It returns zero value, if Err is not
+// nil. Must be called only on completed task.
+func (f Future[T]) Result() T {
+	v, _ := f.result()
+	return v
+}
+
+// Wait waits until the task is completed, and returns its result.
+// It returns ctx.Err(), if ctx is done before that.
+func (f Future[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-f.t.Done():
+		return f.result()
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (f Future[T]) result() (T, error) {
+	var zero T
+	if err := f.t.Err(); err != nil {
+		return zero, err
+	}
+	result := f.t.Result()
+	if result == nil {
+		return zero, nil
+	}
+	v, ok := result.(T)
+	if !ok {
+		return zero, fmt.Errorf("raft: result of type %T is not %s", result, reflect.TypeOf((*T)(nil)).Elem())
+	}
+	return v, nil
+}
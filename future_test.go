@@ -0,0 +1,88 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFuture(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+
+	// result of expected type
+	reply, err := Apply[fsmReply](ldr, []byte("hello")).Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.msg != "hello" || reply.index != 1 {
+		t.Fatalf("reply: got %v, want {hello 1}", reply)
+	}
+	f := Read[fsmReply](ldr, "last")
+	if _, err = f.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Result(); got.msg != "hello" {
+		t.Fatalf("read: got %v, want hello", got)
+	}
+
+	// result of unexpected type
+	if s, err := Apply[string](ldr, []byte("world")).Wait(ctx); err == nil || s != "" {
+		t.Fatalf("got %q %v, want type error", s, err)
+	}
+
+	// error from fsm
+	if _, err := Read[fsmReply](ldr, 10).Wait(ctx); err != errNoCommandAt {
+		t.Fatalf("got %v, want %v", err, errNoCommandAt)
+	}
+
+	// typed task
+	task := GetInfo()
+	_ = ldr.SubmitTask(context.Background(), task)
+	info, err := Typed[Info](task).Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NID != ldr.nid {
+		t.Fatalf("info.NID: got %d, want %d", info.NID, ldr.nid)
+	}
+
+	// context done
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	if _, err := Typed[Info](newTask()).Wait(done); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// closed server
+	c.shutdown(ldr)
+	f = Apply[fsmReply](ldr, []byte("closed"))
+	select {
+	case <-f.Done():
+	case <-time.After(c.longTimeout):
+		t.Fatal("future must be done")
+	}
+	if err := f.Err(); err != ErrServerClosed {
+		t.Fatalf("got %v, want %v", err, ErrServerClosed)
+	}
+}
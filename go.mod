@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/fortytw2/leaktest v1.3.0
+	github.com/golang/snappy v0.0.1
 	github.com/santhosh-tekuri/fnet v0.0.0-20190409082608-440bab91ac8c
 	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582 // indirect
 	golang.org/x/sys v0.0.0-20191010194322-b09406accb47
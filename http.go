@@ -0,0 +1,245 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Handler returns http.Handler that exposes state of given raft
+// node as json. It serves following endpoints:
+//
+//   GET  /status     Info of the node
+//   GET  /config     committed and latest config
+//   GET  /peers      nodes in latest config, along with replication
+//                    status if the node is leader
+//   GET  /snapshot   index of latest snapshot
+//   POST /snapshot   takes snapshot. optional query param threshold
+//                    is passed to TakeSnapshot task
+//   GET  /healthz    replies 200 if the node is part of quorum,
+//                    otherwise 503
+//   GET  /state      StateExport of the node
+//
+// Use http.StripPrefix, to mount it under a path of existing server.
+func Handler(r *Raft) http.Handler {
+	return handler{r}
+}
+
+type handler struct {
+	r *Raft
+}
+
+func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/status":
+		h.get(w, req, func(info Info) interface{} {
+			return info
+		})
+	case "/config":
+		h.get(w, req, func(info Info) interface{} {
+			return info.Configs
+		})
+	case "/peers":
+		h.get(w, req, peers)
+	case "/snapshot":
+		if req.Method == http.MethodPost {
+			h.takeSnapshot(w, req)
+			return
+		}
+		h.get(w, req, func(info Info) interface{} {
+			return struct {
+				Index uint64 `json:"index"`
+			}{info.SnapshotIndex}
+		})
+	case "/healthz":
+		h.healthz(w, req)
+	case "/state":
+		h.exportState(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h handler) get(w http.ResponseWriter, req *http.Request, fn func(info Info) interface{}) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	info, err := h.info()
+	if err != nil {
+		replyJSON(w, http.StatusInternalServerError, errorJSON(err))
+		return
+	}
+	replyJSON(w, http.StatusOK, fn(info))
+}
+
+func (h handler) takeSnapshot(w http.ResponseWriter, req *http.Request) {
+	var threshold uint64
+	if s := req.URL.Query().Get("threshold"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			replyJSON(w, http.StatusBadRequest, errorJSON(err))
+			return
+		}
+		threshold = v
+	}
+	result, err := h.execute(TakeSnapshot(threshold))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(InProgressError); ok || err == ErrNoUpdates || err == ErrSnapshotThreshold {
+			status = http.StatusConflict
+		}
+		replyJSON(w, status, errorJSON(err))
+		return
+	}
+	replyJSON(w, http.StatusOK, struct {
+		Index uint64 `json:"index"`
+	}{result.(uint64)})
+}
+
+func (h handler) healthz(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	info, err := h.info()
+	if err != nil {
+		replyJSON(w, http.StatusServiceUnavailable, errorJSON(err))
+		return
+	}
+	ok, reason := health(info)
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	replyJSON(w, status, struct {
+		Healthy bool   `json:"healthy"`
+		State   State  `json:"state"`
+		Leader  uint64 `json:"leader,omitempty"`
+		Reason  string `json:"reason,omitempty"`
+	}{ok, info.State, info.Leader, reason})
+}
+
+func (h handler) exportState(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := h.execute(ExportState())
+	if err != nil {
+		replyJSON(w, http.StatusInternalServerError, errorJSON(err))
+		return
+	}
+	replyJSON(w, http.StatusOK, result)
+}
+
+func (h handler) info() (Info, error) {
+	result, err := h.execute(GetInfo())
+	if err != nil {
+		return Info{}, err
+	}
+	return result.(Info), nil
+}
+
+func (h handler) execute(t Task) (interface{}, error) {
+	return h.r.do(context.Background(), t)
+}
+
+// health tells whether the node is part of quorum.
+//
+// leader is healthy, if quorum of voters are reachable.
+// others are healthy, if they know who the leader is.
+// note that follower forgets the leader, if it does not
+// hear from leader within heartbeat timeout.
+func health(info Info) (bool, string) {
+	if !info.Configs.IsBootstrapped() {
+		return false, "not bootstrapped"
+	}
+	if info.State != Leader {
+		if info.Leader == 0 {
+			return false, "no leader"
+		}
+		return true, ""
+	}
+	config := info.Configs.Latest
+	reachable := 0
+	for id, n := range config.Nodes {
+		if !n.Voter {
+			continue
+		}
+		if id == info.NID {
+			reachable++
+		} else if repl, ok := info.Followers[id]; ok && repl.Unreachable == nil {
+			reachable++
+		}
+	}
+	if reachable < config.quorum() {
+		return false, fmt.Sprintf("quorum unreachable: %d of %d voters reachable", reachable, config.numVoters())
+	}
+	return true, ""
+}
+
+type peer struct {
+	Node
+	ID          uint64       `json:"id"`
+	Replication *Replication `json:"replication,omitempty"`
+}
+
+func peers(info Info) interface{} {
+	pp := []peer{}
+	for id, n := range info.Configs.Latest.Nodes {
+		p := peer{Node: n, ID: id}
+		if repl, ok := info.Followers[id]; ok {
+			p.Replication = &repl
+		}
+		pp = append(pp, p)
+	}
+	sort.Slice(pp, func(i, j int) bool {
+		return pp[i].ID < pp[j].ID
+	})
+	return pp
+}
+
+func errorJSON(err error) interface{} {
+	if err, ok := err.(NotLeaderError); ok {
+		return struct {
+			Error      string `json:"error"`
+			Leader     uint64 `json:"leader,omitempty"`
+			LeaderAddr string `json:"leaderAddr,omitempty"`
+			Term       uint64 `json:"term,omitempty"`
+			Retryable  bool   `json:"retryable"`
+		}{err.Error(), err.Leader.ID, err.Leader.Addr, err.Term, err.Retryable}
+	}
+	return struct {
+		Error string `json:"error"`
+	}{err.Error()}
+}
+
+func replyJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+	_, _ = w.Write([]byte("\n"))
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	serve := func(r *Raft, method, path string, v interface{}) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		Handler(r).ServeHTTP(w, req)
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return w.Code
+	}
+
+	// status
+	var status struct {
+		NID   uint64 `json:"nid"`
+		State string `json:"state"`
+	}
+	if code := serve(ldr, "GET", "/status", &status); code != http.StatusOK {
+		t.Fatalf("status: got %d, want %d", code, http.StatusOK)
+	}
+	if status.NID != ldr.nid || status.State != "leader" {
+		t.Fatalf("status: got %+v", status)
+	}
+
+	// peers
+	var peers []struct {
+		ID          uint64       `json:"id"`
+		Replication *Replication `json:"replication"`
+	}
+	serve(ldr, "GET", "/peers", &peers)
+	if len(peers) != 3 {
+		t.Fatalf("len(peers): got %d, want 3", len(peers))
+	}
+	for _, p := range peers {
+		if got, want := p.Replication != nil, p.ID != ldr.nid; got != want {
+			t.Fatalf("peer M%d: hasReplication=%v", p.ID, got)
+		}
+	}
+
+	// snapshot
+	var snap struct {
+		Index uint64 `json:"index"`
+	}
+	if code := serve(ldr, "POST", "/snapshot", &snap); code != http.StatusOK {
+		t.Fatalf("snapshot: got %d, want %d", code, http.StatusOK)
+	}
+	if snap.Index != 12 {
+		t.Fatalf("snapshot.index: got %d, want 12", snap.Index)
+	}
+	if code := serve(ldr, "POST", "/snapshot", nil); code != http.StatusConflict {
+		t.Fatalf("snapshot: got %d, want %d", code, http.StatusConflict)
+	}
+
+	// healthz
+	for _, r := range c.rr {
+		if code := serve(r, "GET", "/healthz", nil); code != http.StatusOK {
+			t.Fatalf("M%d healthz: got %d, want %d", r.nid, code, http.StatusOK)
+		}
+	}
+
+	// shutdown followers, leader should become unhealthy
+	c.shutdown(flrs...)
+	c.waitUnreachableDetected(ldr, flrs[0])
+	c.waitUnreachableDetected(ldr, flrs[1])
+	if code := serve(ldr, "GET", "/healthz", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
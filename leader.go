@@ -34,17 +34,55 @@ type leader struct {
 	// committed entries are dequeued and handed over to fsm go-routine
 	neHead, neTail *newEntry
 
+	// true if in bulk mode. see BeginBulkFSM
+	bulk bool
+
+	// recent ApplyWithID entries. see Options.DuplicateWindow
+	dedup dedup
+
+	// number of entries and their bytes in neHead
+	inflightEntries int
+	inflightBytes   int64
+
+	// entries held while log is full, and their bytes.
+	// see Options.MaxLogBytes
+	held      []*newEntry
+	heldBytes int64
+
 	// holds running replications, key is addr
 	repls map[uint64]*replication
 	wg    sync.WaitGroup
 
+	// replications of removed nodes. they are kept running
+	// for hbTimeout after the removal is committed, so that
+	// removed node learns that it is removed.
+	// see Options.ShutdownOnRemove
+	removed     map[uint64]*replication
+	removeTimer *safeTimer
+
 	// to receive updates from replicators
 	replUpdateCh chan replUpdate
 
 	transfer   transfer
 	waitStable []waitForStableConfig
 
+	// lease expiry, as of last checkLease.
+	// zero value means lease is not held.
+	lease      time.Time
+	leaseTimer *safeTimer
+
+	// to check postponed promotions again,
+	// when nonvoter has no new entries
+	promoteTimer *safeTimer
+
 	removeLTE uint64
+
+	// see checkZones
+	criticalZones []string
+
+	// see checkCommitSLO
+	appends  []appendTime
+	sloTimer *safeTimer
 }
 
 func (l *leader) init() {
@@ -54,6 +92,8 @@ func (l *leader) init() {
 	l.startIndex = l.lastLogIndex + 1
 	l.replUpdateCh = make(chan replUpdate, 1024)
 	l.removeLTE = l.log.PrevIndex()
+	l.dedup.reset()
+	l.appends = nil
 
 	// start replication routine for each follower
 	for id, n := range l.configs.Latest.Nodes {
@@ -61,7 +101,12 @@ func (l *leader) init() {
 			l.addReplication(n)
 		}
 	}
+	l.voterLogs = nil
 	l.checkConfigActions(nil, l.configs.Latest)
+	l.criticalZones = nil
+	l.checkZones()
+	l.lease = time.Time{}
+	l.checkLease()
 
 	// add a blank no-op entry into log at the start of its term
 	l.storeEntry(&newEntry{entry: &entry{typ: entryNop}})
@@ -74,37 +119,66 @@ func (l *leader) release() {
 		var err error
 		if l.term > l.transfer.term {
 			err = nil
+			if l.transfer.pause {
+				l.paused = true
+				l.logger.Info("paused")
+			}
+			if l.transfer.stepDown {
+				l.awaitLeader(l.transfer.task, l.transfer.deadline)
+				l.transfer.task = nil // replied by awaitLeader
+			}
 		} else if l.isClosed() {
 			err = ErrServerClosed
 		} else {
 			err = ErrQuorumUnreachable
 		}
+		l.logger.Debug("leadership transfer finished", "err", err)
 		l.transfer.reply(err)
 	}
+	l.leaseTimer.stop()
+	l.promoteTimer.stop()
+	l.removeTimer.stop()
+	l.sloTimer.stop()
 
-	if trace {
-		println(l, "stopping followers")
-	}
+	l.logger.Debug("stopping replications")
 	for id, repl := range l.repls {
 		close(repl.stopCh)
 		delete(l.repls, id)
 	}
+	for id, repl := range l.removed {
+		close(repl.stopCh)
+		delete(l.removed, id)
+	}
 	if l.leader == l.nid {
 		l.setLeader(0)
 	}
 
-	// respond to any pending user entries
-	var err error = notLeaderError(l.Raft, true)
+	// respond to any pending user entries. entries appended
+	// to log may be committed by new leader, so retrying
+	// them is not safe
+	var err, retryErr error = notLeaderError(l.Raft, true, false), notLeaderError(l.Raft, true, true)
 	if l.isClosed() {
-		err = ErrServerClosed
+		err, retryErr = ErrServerClosed, ErrServerClosed
 	}
 	for ne := l.neHead; ne != nil; ne = ne.next {
-		ne.reply(err)
+		if ne.isLogEntry() {
+			ne.reply(err)
+		} else {
+			ne.reply(retryErr)
+		}
 	}
 	l.neHead, l.neTail = nil, nil
+	l.inflightEntries, l.inflightBytes = 0, 0
+	l.bulk = false
+
+	// held entries are not appended, so retrying them is safe
+	for _, ne := range l.held {
+		ne.reply(retryErr)
+	}
+	l.held, l.heldBytes = nil, 0
 
 	for _, t := range l.waitStable {
-		t.reply(err)
+		t.reply(retryErr)
 	}
 	l.waitStable = nil
 
@@ -117,24 +191,69 @@ func (l *leader) storeEntry(ne *newEntry) {
 	assert(ne != nil)
 	lastIndex, configIndex := l.lastLogIndex, l.configs.Latest.Index
 	for ne != nil {
-		if l.transfer.inProgress() {
-			ne.reply(InProgressError("transferLeadership"))
+		next := ne.next
+		if l.transfer.inProgress() && !l.canServeDuringTransfer(ne) {
+			if !ne.isLogEntry() && l.transferReads == QueueReads {
+				ne.next = nil
+				l.queuedReads = append(l.queuedReads, ne)
+			} else {
+				ne.reply(InProgressError("transferLeadership"))
+			}
+		} else if l.rejectBusy && l.busy() {
+			ne.reply(ErrBusy)
+		} else if l.rejectBusy && ne.isLogEntry() && l.blockApply() {
+			ne.reply(ErrLogFull)
+		} else if l.holdEntry(ne) {
+			ne.next = nil
+			l.held = append(l.held, ne)
+			l.heldBytes += int64(len(ne.data))
+		} else if l.diskFull && ne.isLogEntry() {
+			ne.reply(ErrDiskFull)
 		} else if !l.node.Voter {
 			if _, ok := l.configs.Latest.Nodes[l.nid]; ok {
 				ne.reply(InProgressError("demoteLeader"))
 			} else {
 				ne.reply(InProgressError("removeLeader"))
 			}
+		} else if ne.typ == entryBulkBegin {
+			if l.bulk {
+				ne.reply(InProgressError("bulkIngest"))
+			} else {
+				l.bulk = true
+				ne.reply(nil)
+			}
+		} else if ne.typ == entryBulkCommit && !l.bulk {
+			ne.reply(ErrBulkAborted)
+		} else if ne.typ == entryUpdateOnce && l.updateOnceUnsupported() {
+			ne.reply(ErrUpdateOnceUnsupported)
+		} else if err := l.intercept(ne); err != nil {
+			ne.reply(err)
+		} else if l.dedup.check(ne, l.clock.Now()) {
+			// duplicate is replied along with the original entry
 		} else {
+			if ne.typ == entryBulkCommit {
+				l.bulk = false
+			}
 			ne.entry.index, ne.entry.term = l.lastLogIndex+1, l.term
-			if l.neTail != nil {
-				l.neTail.next, l.neTail = ne, ne
+			if ne.task != nil {
+				ne.startSpan(l.tracing)
+			}
+			if l.bulk && ne.isUpdate() {
+				// in bulk mode, reply as soon as appended
+				ne.reply(nil)
 			} else {
-				l.neHead, l.neTail = ne, ne
+				if l.neTail != nil {
+					l.neTail.next, l.neTail = ne, ne
+				} else {
+					l.neHead, l.neTail = ne, ne
+				}
+				l.inflightEntries++
+				l.inflightBytes += int64(len(ne.data))
 			}
 			if ne.isLogEntry() {
-				if trace {
-					println(l, "log.append", ne.typ, ne.index)
+				ne.timestamp, ne.leader = l.clock.Now().UnixNano(), l.nid
+				if ne.typ == entryUpdateOnce {
+					ne.cacheSize = l.resultCacheSize
 				}
 				l.storage.appendEntry(ne.entry)
 				if ne.typ == entryConfig {
@@ -146,15 +265,18 @@ func (l *leader) storeEntry(ne *newEntry) {
 				}
 			}
 		}
-		ne = ne.next
+		ne = next
 	}
 	if l.neTail != nil {
 		l.neTail.next = nil
 	}
-	if l.neHead != nil && !l.neHead.isLogEntry() {
+	// note: neHead can be committed, if bulk mode ended
+	if l.neHead != nil && (!l.neHead.isLogEntry() || l.neHead.index <= l.commitIndex) {
 		l.applyCommitted()
 	}
 	if l.lastLogIndex > lastIndex {
+		l.logger.Debug("appended entries", "from", lastIndex+1, "to", l.lastLogIndex)
+		l.recordAppend(lastIndex + 1)
 		l.beginFinishedRounds()
 		l.notifyFlr(l.configs.Latest.Index > configIndex)
 		if l.numVoters == 1 && l.node.Voter {
@@ -163,20 +285,176 @@ func (l *leader) storeEntry(ne *newEntry) {
 	}
 }
 
+// intercept calls Options.Interceptors for the update to be
+// appended. Data replaced by interceptors is used for ne.
+func (l *leader) intercept(ne *newEntry) error {
+	if len(l.interceptors) == 0 || !ne.isUpdate() {
+		return nil
+	}
+	le := ne.entry.logEntry()
+	le.Index, le.Term = l.lastLogIndex+1, l.term
+	le.Time, le.Leader, le.Tenant = l.clock.Now(), l.nid, ne.tenant
+	if ne.typ != entryBatch {
+		if err := l.runInterceptors(&le); err != nil {
+			return err
+		}
+		ne.data = le.Data
+		return nil
+	}
+	cmds, err := decodeBatch(ne.data)
+	if err != nil {
+		return err
+	}
+	for i, cmd := range cmds {
+		le.Type, le.Data = entryUpdate.String(), cmd
+		if err := l.runInterceptors(&le); err != nil {
+			return err
+		}
+		cmds[i] = le.Data
+	}
+	ne.data = encodeBatch(cmds)
+	return nil
+}
+
+func (l *leader) runInterceptors(e *LogEntry) error {
+	for _, fn := range l.interceptors {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainEntries appends batches that are readily available in
+// newEntryCh to given batch, so that they are stored and sent to
+// followers together. Draining stops, when maxDrain batches are
+// taken, inflight limits are reached or log is full.
+func (l *leader) drainEntries(ne *newEntry) *newEntry {
+	head, tail := ne, ne
+	entries, bytes := 0, int64(0)
+	for {
+		entries++
+		bytes += int64(len(tail.data))
+		if tail.next == nil {
+			break
+		}
+		tail = tail.next
+	}
+	for i := 1; i < maxDrain; i++ {
+		if l.Raft.busy(l.inflightEntries+entries, l.inflightBytes+bytes) || l.blockApply() {
+			break
+		}
+		select {
+		case ne, ok := <-l.newEntryCh:
+			if !ok {
+				// closed, stateLoop finds it in next iteration
+				return head
+			}
+			tail.next = ne
+			for tail.next != nil {
+				tail = tail.next
+				entries++
+				bytes += int64(len(tail.data))
+			}
+			continue
+		default:
+		}
+		break
+	}
+	return head
+}
+
+// busy tells whether inflight limits are reached.
+func (l *leader) busy() bool {
+	return l.Raft.busy(l.inflightEntries, l.inflightBytes)
+}
+
+// blockApply tells whether entries must not be appended,
+// because log is full with BlockApply policy.
+func (l *leader) blockApply() bool {
+	return l.logFullPolicy == BlockApply && l.logFull()
+}
+
+// updateOnceUnsupported tells whether any node negotiated protocol
+// version, that does not support updateOnce entry. Such entry cannot
+// be downgraded to update entry, because the nodes applying it again
+// on retry would diverge from others.
+func (l *leader) updateOnceUnsupported() bool {
+	for _, repl := range l.repls {
+		if v := repl.status.version; v != 0 && v < protocolV5 {
+			return true
+		}
+	}
+	return false
+}
+
+// holdEntry tells whether ne must be held, until log is discarded
+// below Options.MaxLogBytes. Reads are served meanwhile, but other
+// entries wait behind held entries, so that barrier and bulk entries
+// keep their order with preceding updates.
+func (l *leader) holdEntry(ne *newEntry) bool {
+	if ne.typ == entryRead || ne.typ == entryDirtyRead {
+		return false
+	}
+	return len(l.held) > 0 || (ne.isLogEntry() && l.blockApply())
+}
+
+// heldFull tells whether held entries reach inflight limits,
+// in which case leader stops taking new entries.
+func (l *leader) heldFull() bool {
+	return len(l.held) > 0 && l.Raft.busy(len(l.held), l.heldBytes)
+}
+
+// storeHeld stores the held entries, once log is not full.
+func (l *leader) storeHeld() {
+	if len(l.held) == 0 || l.blockApply() {
+		return
+	}
+	l.logger.Debug("storing held entries", "entries", len(l.held), "bytes", l.heldBytes)
+	head := l.held[0]
+	for i := 1; i < len(l.held); i++ {
+		l.held[i-1].next = l.held[i]
+	}
+	l.held, l.heldBytes = nil, 0
+	l.storeEntry(head)
+}
+
 func (l *leader) addReplication(n Node) {
 	assert(n.ID != l.nid) // no replication for leader
+	var throttle Throttle
+	if l.replThrottle != nil {
+		throttle = l.replThrottle(n)
+	}
+
+	// if voter told its lastLogIndex in this election, start from
+	// there, rather than learning it from failed AppendEntries
+	nextIndex := l.lastLogIndex + 1
+	if last, ok := l.voterLogs[n.ID]; ok && last < l.lastLogIndex {
+		nextIndex = last + 1
+		l.logger.Debug("nextIndex from vote", "peer", n.ID, "nextIndex", nextIndex)
+	}
 	repl := &replication{
 		node:           n,
-		rtime:          newRandTime(),
-		status:         replicationStatus{id: n.ID, node: n, removeLTE: l.removeLTE},
+		clock:          l.clock,
+		rtime:          newRandTime(l.clock),
+		status:         replicationStatus{id: n.ID, node: n, contact: l.clock.Now(), removeLTE: l.removeLTE, throttle: throttle},
 		ldrStartIndex:  l.startIndex,
 		ldrLastIndex:   l.lastLogIndex,
 		matchIndex:     0,
-		nextIndex:      l.lastLogIndex + 1,
+		nextIndex:      nextIndex,
 		connPool:       l.getConnPool(n.ID),
 		hbTimeout:      l.hbTimeout,
-		timer:          newSafeTimer(),
+		timer:          newSafeTimer(l.clock),
 		bandwidth:      l.bandwidth,
+		backoff:        l.backoff,
+		breaker:        breaker{CircuitBreaker: l.circuitBreaker},
+		timeouts:       l.rpcTimeouts,
+		pipeline:       l.pipelineSize,
+		maxClockSkew:   l.maxClockSkew,
+		tracing:        l.tracing,
+		logger:         newLogger(l.logger.delegate, l.nid, "repl", "peer", n.ID),
+		delegateSnaps:  l.snapshotSource != nil,
+		throttle:       newThrottle(throttle, l.clock),
 		log:            l.storage.log.ViewAt(l.removeLTE, l.lastLogIndex),
 		snaps:          l.storage.snaps,
 		stopCh:         make(chan struct{}),
@@ -187,7 +465,7 @@ func (l *leader) addReplication(n Node) {
 
 	// send initial empty AppendEntries RPCs (heartbeat) to each follower
 	req := &appendReq{
-		req:            req{l.term, l.nid},
+		req:            req{term: l.term, src: l.nid},
 		ldrCommitIndex: l.commitIndex,
 		prevLogIndex:   l.lastLogIndex,
 		prevLogTerm:    l.lastLogTerm,
@@ -197,18 +475,14 @@ func (l *leader) addReplication(n Node) {
 	go func() {
 		defer l.wg.Done()
 		repl.runLoop(req)
-		if trace {
-			println(repl, "repl.End")
-		}
+		repl.logger.Debug("replication ended")
 	}()
 }
 
 func (l *leader) checkReplUpdates(u replUpdate) {
 	matchUpdated, noContactUpdated, removeLTEUpdated := false, false, false
 	for {
-		if trace {
-			println(l, "<<", u)
-		}
+		l.logger.Debug("replication update", "update", u)
 		status := u.status
 		if !status.removed {
 			switch u := u.update.(type) {
@@ -228,15 +502,51 @@ func (l *leader) checkReplUpdates(u replUpdate) {
 				noContactUpdated = true
 				status.noContact, status.err = u.time, u.err
 				if u.time.IsZero() {
-					l.logger.Info("node", status.id, "is reachable now")
+					status.contact = l.clock.Now()
+					l.logger.Info("node is reachable now", "peer", status.id)
 					l.alerts.Reachable(status.id)
 				} else {
-					l.logger.Warn("node", status.id, "is unreachable, reason:", u.err)
+					l.logger.Warn("node is unreachable", "peer", status.id, "err", u.err)
 					l.alerts.Unreachable(status.id, u.err)
 				}
 				if tracer.unreachable != nil {
 					tracer.unreachable(l.Raft, status.id, u.time, u.err)
 				}
+			case snapSourceReq:
+				u.ch <- l.snapSource(status.id)
+			case slowRTT:
+				if u.slow {
+					l.logger.Warn("round trip time is more than half of heartbeat timeout", "peer", status.id, "rtt", u.rtt, "heartbeatTimeout", l.hbTimeout)
+				} else {
+					l.logger.Info("round trip time is within heartbeat timeout now", "peer", status.id, "rtt", u.rtt)
+				}
+				if tracer.slowRTT != nil {
+					tracer.slowRTT(l.Raft, status.id, u.rtt, u.slow)
+				}
+			case clockSkew:
+				if u.exceeded {
+					l.logger.Warn("clock skew exceeds MaxClockSkew, lease reads are unsafe", "peer", status.id, "skew", u.skew, "maxClockSkew", l.maxClockSkew)
+				} else {
+					l.logger.Info("clock skew is within MaxClockSkew now", "peer", status.id, "skew", u.skew)
+				}
+				if tracer.clockSkew != nil {
+					tracer.clockSkew(l.Raft, status.id, u.skew, u.exceeded)
+				}
+			case throttled:
+				status.throttled = u.val
+			case negotiated:
+				status.version = u.version
+			case peerView:
+				status.peers = u.peers
+				noContactUpdated = true
+			case breakerChanged:
+				status.breaker = u.state
+				switch u.state {
+				case BreakerOpen:
+					l.logger.Warn("circuit breaker is open", "peer", status.id)
+				case BreakerClosed:
+					l.logger.Info("circuit breaker is closed", "peer", status.id)
+				}
 			case newTerm:
 				// if response contains term T > currentTerm:
 				// set currentTerm = T, convert to follower
@@ -262,8 +572,13 @@ func (l *leader) checkReplUpdates(u replUpdate) {
 	if noContactUpdated {
 		l.checkQuorum(l.quorumWait)
 	}
+	if (matchUpdated || noContactUpdated) && l.state == Leader && l.log.CanLTE(l.snaps.index) > l.removeLTE {
+		// follower that limited recent discard, might have caught up or gone offline
+		l.discardSnapshotted()
+	}
 	if removeLTEUpdated && l.removeLTE > l.log.PrevIndex() {
 		l.checkLogCompact()
+		l.storeHeld()
 	}
 
 	// todo: do this in case matchIndex in above switch
@@ -275,21 +590,20 @@ func (l *leader) checkReplUpdates(u replUpdate) {
 }
 
 func (l *leader) checkQuorum(wait time.Duration) {
-	voters, reachable := 0, 0
+	voters, reachable, partitioned := 0, 0, 0
 	for id, n := range l.configs.Latest.Nodes {
 		if n.Voter {
 			voters++
 			if id == l.nid || l.repls[id].status.noContact.IsZero() {
 				reachable++
+			} else if l.partitioned(id) {
+				partitioned++
 			}
 		}
 	}
 
 	if reachable >= voters/2+1 {
 		if l.timer.active {
-			if trace {
-				println(l, "quorumReachable")
-			}
 			l.logger.Info("quorum is reachable now")
 			l.alerts.QuorumUnreachable()
 			if tracer.quorumUnreachable != nil {
@@ -301,21 +615,23 @@ func (l *leader) checkQuorum(wait time.Duration) {
 	}
 
 	if l.quorumWait == 0 || !l.timer.active {
-		l.logger.Info("quorum is unreachable")
+		l.logger.Info("quorum is unreachable", "partitioned", partitioned)
 		if tracer.quorumUnreachable != nil {
-			tracer.quorumUnreachable(l.Raft, time.Now())
+			tracer.quorumUnreachable(l.Raft, l.clock.Now())
 		}
 	}
+	if wait > 0 && partitioned > 0 && reachable+partitioned >= voters/2+1 {
+		// quorum is alive, but leader is partitioned from it.
+		// it elects new leader soon, so do not wait for contact
+		l.logger.Warn("leader is partitioned from quorum")
+		wait = 0
+	}
 	if wait == 0 {
-		if trace {
-			println(l, "quorumUnreachable: stepping down")
-		}
+		l.logger.Debug("stepping down, quorum is unreachable")
 		l.setState(Follower)
 		l.setLeader(0)
 	} else if !l.timer.active {
-		if trace {
-			println(l, "quorumUnreachable: waiting", wait)
-		}
+		l.logger.Debug("waiting for quorum", "wait", wait)
 		l.timer.reset(wait)
 	}
 }
@@ -354,18 +670,23 @@ func (l *leader) onMajorityCommit() {
 		l.setCommitIndex(majorityMatchIndex)
 		l.applyCommitted()
 		l.notifyFlr(false) // we updated commit index
+		l.checkCommitSLO()
 	}
 }
 
 // if commitIndex > lastApplied: increment lastApplied, apply
 // log[lastApplied] to state machine
 func (l *leader) applyCommitted() {
+	if l.bulk {
+		// apply is deferred until bulk commit
+		return
+	}
 	// add all entries <=commitIndex & add only non-log entries at commitIndex+1
 	var prev, ne *newEntry = nil, l.neHead
 	for ne != nil {
-		if ne.index <= l.commitIndex {
-			prev, ne = ne, ne.next
-		} else if ne.index == l.commitIndex+1 && !ne.isLogEntry() {
+		if ne.index <= l.commitIndex || (ne.index == l.commitIndex+1 && !ne.isLogEntry()) {
+			l.inflightEntries--
+			l.inflightBytes -= int64(len(ne.data))
 			prev, ne = ne, ne.next
 		} else {
 			break
@@ -382,10 +703,9 @@ func (l *leader) applyCommitted() {
 	}
 
 	apply := fsmApply{head, l.log.ViewAt(l.log.PrevIndex(), l.commitIndex)}
-	if trace {
-		println(l, apply)
-	}
-	l.fsm.ch <- apply
+	l.logger.Debug("applying", "apply", apply)
+	l.sendFSM(apply)
+	l.checkSnapThreshold()
 }
 
 func (l *leader) notifyFlr(includeConfig bool) {
@@ -396,16 +716,42 @@ func (l *leader) notifyFlr(includeConfig bool) {
 	if includeConfig {
 		update.config = &l.configs.Latest
 	}
-	for _, repl := range l.repls {
+	notify := func(repl *replication) {
 		select {
 		case repl.leaderUpdateCh <- update:
 		case <-repl.leaderUpdateCh:
 			repl.leaderUpdateCh <- update
 		}
-		if trace {
-			println(l, update, repl.status.id)
+	}
+	for _, repl := range l.repls {
+		notify(repl)
+	}
+	for _, repl := range l.removed {
+		notify(repl)
+	}
+}
+
+// stopRemoved stops the replications of removed nodes, whose
+// stopAt is reached.
+func (l *leader) stopRemoved() {
+	now := l.clock.Now()
+	var next time.Time
+	for id, repl := range l.removed {
+		stopAt := repl.status.stopAt
+		switch {
+		case stopAt.IsZero():
+			continue
+		case !now.Before(stopAt):
+			l.logger.Debug("stopping replication of removed node", "peer", id)
+			close(repl.stopCh)
+			delete(l.removed, id)
+		case next.IsZero() || stopAt.Before(next):
+			next = stopAt
 		}
 	}
+	if !next.IsZero() {
+		l.removeTimer.reset(next.Sub(now))
+	}
 }
 
 func (l *leader) checkLogCompact() {
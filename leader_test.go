@@ -15,7 +15,10 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -169,19 +172,239 @@ func TestLeader_quorumWait_reachable(t *testing.T) {
 	}
 }
 
+func TestLeader_lease(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 30 * time.Minute
+	ldr, followers := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// lease is extended with every heartbeat
+	c.waitCatchup()
+	info := c.info(ldr)
+	if info.LeaseExpiry == nil {
+		t.Fatal("leader must have lease")
+	}
+	if d := info.LeaseExpiry.Sub(time.Now()); d <= 0 || d > c.heartbeatTimeout {
+		t.Fatalf("leaseExpiry: got now+%s, want <= now+%s", d, c.heartbeatTimeout)
+	}
+	for _, flr := range followers {
+		if info := c.info(flr); info.LeaseExpiry != nil {
+			t.Fatalf("follower %d must not have lease", flr.nid)
+		}
+	}
+
+	leaseExpired := c.registerFor(eventLeaseExpired, ldr)
+	defer c.unregister(leaseExpired)
+
+	// lease must expire, even though leader waits for quorum
+	c.disconnect(ldr)
+	e, err := leaseExpired.waitForEvent(2 * c.heartbeatTimeout)
+	if err != nil {
+		t.Fatalf("waitLeaseExpired: %v", err)
+	}
+	if e.since.After(time.Now()) {
+		t.Fatalf("leaseExpired: got %s, it is in future", e.since)
+	}
+	if got := c.info(ldr); got.State != Leader || got.LeaseExpiry != nil {
+		t.Fatalf("got state %s with lease %v, want leader without lease", got.State, got.LeaseExpiry)
+	}
+}
+
+// leader must not claim lease, if followers grant votes
+// while they hear from it
+func TestLeader_lease_disableStickiness(t *testing.T) {
+	c := newCluster(t)
+	c.opt.DisableStickiness = true
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	c.waitCatchup()
+	if info := c.info(ldr); info.LeaseExpiry != nil {
+		t.Fatalf("leaseExpiry: got %v, want nil", info.LeaseExpiry)
+	}
+}
+
+// tests that leader raises Alerts.SlowCommit, when an entry is
+// not committed within CommitSLO
+func TestLeader_commitSLO(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 30 * time.Minute
+	c.opt.CommitSLO = 200 * time.Millisecond
+	ldr, followers := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	slow := make(chan SlowCommit, 10)
+	alerts := c.alerts[ldr.nid]
+	alerts.mu.Lock()
+	alerts.slowCommit = func(c SlowCommit) {
+		slow <- c
+	}
+	alerts.mu.Unlock()
+
+	// entries committed within slo, must not raise alert
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20)
+	select {
+	case e := <-slow:
+		t.Fatalf("unexpected SlowCommit: %v", e)
+	case <-time.After(2 * c.opt.CommitSLO):
+	}
+
+	// entry that cannot be committed, must raise alert
+	c.disconnect(followers...)
+	lastIndex := c.info(ldr).LastLogIndex
+	_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte("slow")))
+	var e SlowCommit
+	select {
+	case e = <-slow:
+	case <-time.After(c.longTimeout):
+		t.Fatal("SlowCommit alert not raised")
+	}
+	if e.Index != lastIndex+1 || e.LastIndex != lastIndex+1 {
+		t.Fatalf("slowCommit: got index %d lastIndex %d, want %d", e.Index, e.LastIndex, lastIndex+1)
+	}
+	if e.Latency < c.opt.CommitSLO {
+		t.Fatalf("slowCommit.Latency: got %s, want >= %s", e.Latency, c.opt.CommitSLO)
+	}
+	for _, flr := range followers {
+		if got := e.MatchIndex[flr.nid]; got != lastIndex {
+			t.Fatalf("slowCommit.MatchIndex[%d]: got %d, want %d", flr.nid, got, lastIndex)
+		}
+	}
+
+	// alert must be raised only once
+	select {
+	case e := <-slow:
+		t.Fatalf("unexpected SlowCommit: %v", e)
+	case <-time.After(2 * c.opt.CommitSLO):
+	}
+}
+
+func TestLeader_interceptors(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	var mu sync.Mutex
+	var seen []LogEntry
+	c := newCluster(t)
+	c.opt.Interceptors = []Interceptor{
+		func(e *LogEntry) error {
+			if strings.HasPrefix(string(e.Data), "bad") {
+				return errQuota
+			}
+			return nil
+		},
+		func(e *LogEntry) error {
+			mu.Lock()
+			seen = append(seen, *e)
+			mu.Unlock()
+			e.Data = append([]byte("audited:"), e.Data...)
+			return nil
+		},
+	}
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+
+	// rejected update is not appended
+	last := c.info(ldr).LastLogIndex
+	if _, err := ldr.Apply(ctx, []byte("bad")); err != errQuota {
+		t.Fatalf("err: got %v, want %v", err, errQuota)
+	}
+	if got := c.info(ldr).LastLogIndex; got != last {
+		t.Fatalf("lastLogIndex: got %d, want %d", got, last)
+	}
+
+	// replaced data is appended
+	result, err := ldr.Apply(ctx, []byte("good"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.(fsmReply).msg; got != "audited:good" {
+		t.Fatalf("result: got %q, want %q", got, "audited:good")
+	}
+	if len(seen) != 1 || seen[0].Index != last+1 || seen[0].Leader != ldr.NID() {
+		t.Fatalf("seen: %v", seen)
+	}
+
+	// composite batch is rejected as whole
+	batch := ApplyCompositeBatch([][]byte{[]byte("x"), []byte("bad")})
+	c.ensure(ldr.SubmitTask(ctx, batch))
+	<-batch.Done()
+	if batch.Err() != errQuota {
+		t.Fatalf("batch.Err: got %v, want %v", batch.Err(), errQuota)
+	}
+	batch = ApplyCompositeBatch([][]byte{[]byte("x"), []byte("y")})
+	c.ensure(ldr.SubmitTask(ctx, batch))
+	<-batch.Done()
+	c.ensure(batch.Err())
+	c.waitFSMLen(3)
+	if got, want := fsm(ldr).commands(), []string{"audited:good", "audited:x", "audited:y"}; !equalStrings(got, want) {
+		t.Fatalf("commands: got %v, want %v", got, want)
+	}
+}
+
+func TestLeader_tenantLimiter(t *testing.T) {
+	intercept := TenantLimiter(map[string]RateLimit{
+		"a": {PerSecond: 10, Burst: 2},
+		"b": {},
+	}, RateLimit{PerSecond: 1})
+	now := time.Now()
+	check := func(tenant string, d time.Duration, want error) {
+		t.Helper()
+		if err := intercept(&LogEntry{Tenant: tenant, Time: now.Add(d)}); err != want {
+			t.Fatalf("%q at %v: got %v, want %v", tenant, d, err, want)
+		}
+	}
+	check("a", 0, nil)
+	check("a", 0, nil)
+	check("a", 0, ErrRateLimited)
+	check("a", 100*time.Millisecond, nil)
+	check("a", 100*time.Millisecond, ErrRateLimited)
+	for i := 0; i < 5; i++ {
+		check("b", 0, nil) // no limit
+		check("", 0, nil)  // no tenant
+	}
+	check("c", 0, nil) // fallback
+	check("c", 500*time.Millisecond, ErrRateLimited)
+	check("c", time.Second, nil)
+
+	// through leader
+	c := newCluster(t)
+	c.opt.Interceptors = []Interceptor{TenantLimiter(nil, RateLimit{PerSecond: 0.001})}
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+	for i, want := range []error{nil, ErrRateLimited} {
+		update := WithTenant("x", UpdateFSM([]byte(fmt.Sprint(i))))
+		c.ensure(ldr.SubmitTask(ctx, update))
+		<-update.Done()
+		if update.Err() != want {
+			t.Fatalf("update%d: got %v, want %v", i, update.Err(), want)
+		}
+	}
+	if !errors.Is(ErrRateLimited, ErrTemporary) {
+		t.Fatal("ErrRateLimited must be temporary")
+	}
+}
+
 func TestLeader_updateFSM_nonLeader(t *testing.T) {
 	c, ldr, _ := launchCluster(t, 3)
 	defer c.shutdown()
 
 	// update should not work on non-leader
-	ldrAddr := c.info(ldr).Addr
+	info := c.info(ldr)
 	for _, r := range c.rr {
 		if r != ldr {
 			_, err := waitUpdate(r, "reject", c.longTimeout)
 			if nle, ok := err.(NotLeaderError); !ok {
 				t.Fatalf("got %v, want NotLeaderError", err)
-			} else if nle.Leader.Addr != ldrAddr {
-				t.Fatalf("got %s, want %s", nle.Leader.Addr, ldrAddr)
+			} else if nle.Leader.ID != ldr.nid || nle.Leader.Addr != info.Addr {
+				t.Fatalf("got %d at %s, want %d at %s", nle.Leader.ID, nle.Leader.Addr, ldr.nid, info.Addr)
+			} else if nle.Term != info.Term || nle.Lost || !nle.Retryable {
+				t.Fatalf("got term %d lost %v retryable %v, want term %d", nle.Term, nle.Lost, nle.Retryable, info.Term)
 			}
 		}
 	}
@@ -308,14 +531,14 @@ func TestLeader_readFSM(t *testing.T) {
 	// send updates, in between do queries and check query reply
 	for i := 0; i < 101; i++ {
 		cmd := fmt.Sprintf("cmd%d", i)
-		ldr.FSMTasks() <- UpdateFSM([]byte(cmd))
+		_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte(cmd)))
 		if i%10 == 0 {
 			qq := []FSMTask{
 				ReadFSM("last"),
 				ReadFSM("last"),
 			}
 			for _, q := range qq {
-				ldr.FSMTasks() <- q
+				_ = ldr.SubmitTask(context.Background(), q)
 			}
 			for _, q := range qq {
 				<-q.Done()
@@ -384,3 +607,154 @@ func TestLeader_dirtyReadFSM(t *testing.T) {
 		}
 	}
 }
+
+func TestLeader_inflight_reject(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 10 * time.Second
+	c.opt.MaxInflightEntries = 5
+	c.opt.RejectBusy = true
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+
+	// isolate leader, so that nothing gets committed
+	c.disconnect(ldr)
+
+	var tasks []FSMTask
+	for i := 0; i < 10; i++ {
+		t := UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))
+		_ = ldr.SubmitTask(context.Background(), t)
+		tasks = append(tasks, t)
+	}
+
+	// entries beyond limit must be rejected
+	for _, task := range tasks[5:] {
+		c.waitTaskDone(task, c.longTimeout, ErrBusy)
+	}
+	for _, task := range tasks[:5] {
+		select {
+		case <-task.Done():
+			t.Fatalf("task.Err: got %v, want no reply", task.Err())
+		default:
+		}
+	}
+	c.connect()
+}
+
+func TestLeader_inflight_block(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 10 * time.Second
+	c.opt.MaxInflightEntries = 2
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+
+	// isolate leader, so that nothing gets committed
+	c.disconnect(ldr)
+
+	// submission must block, once leader and batch are full.
+	// leader takes a batch when below limit, so it can hold
+	// upto 2*limit-1 entries, plus limit entries in batch
+	accepted := 0
+	for accepted < 10 {
+		ctx, cancel := withTimeout(200 * time.Millisecond)
+		err := ldr.SubmitTask(ctx, UpdateFSM([]byte("hello")))
+		cancel()
+		if err != nil {
+			break
+		}
+		accepted++
+	}
+	c.connect()
+	if accepted < 2 || accepted > 5 {
+		t.Fatalf("accepted: got %d, want 2 to 5", accepted)
+	}
+}
+
+func TestLeader_drainEntries(t *testing.T) {
+	batch := func(n int) *newEntry {
+		var head, tail *newEntry
+		for i := 0; i < n; i++ {
+			ne := UpdateFSM([]byte("hello")).newEntry()
+			if tail != nil {
+				tail.next, tail = ne, ne
+			} else {
+				head, tail = ne, ne
+			}
+		}
+		return head
+	}
+	count := func(ne *newEntry) int {
+		n := 0
+		for ; ne != nil; ne = ne.next {
+			n++
+		}
+		return n
+	}
+
+	// readily available batches are appended
+	l := &leader{Raft: &Raft{newEntryCh: make(chan *newEntry, 3)}}
+	l.newEntryCh <- batch(2)
+	l.newEntryCh <- batch(3)
+	if got := count(l.drainEntries(batch(1))); got != 6 {
+		t.Fatalf("entries: got %d, want 6", got)
+	}
+
+	// draining stops at inflight limit
+	l.maxInflight = 3
+	l.newEntryCh <- batch(2)
+	l.newEntryCh <- batch(3)
+	if got := count(l.drainEntries(batch(1))); got != 3 {
+		t.Fatalf("entries: got %d, want 3", got)
+	}
+	if got := count(<-l.newEntryCh); got != 3 {
+		t.Fatalf("remaining: got %d, want 3", got)
+	}
+}
+
+// tests that tasks pending in taskCh are executed before
+// storing a batch of FSMTasks
+func TestRaft_executePending(t *testing.T) {
+	r := &Raft{taskCh: make(chan Task, 2), close: make(chan struct{})}
+	r.executePending() // must not block
+
+	executed := 0
+	for i := 0; i < 2; i++ {
+		r.taskCh <- inspect{task: newTask(), fn: func(*Raft) { executed++ }}
+	}
+	r.executePending()
+	if executed != 2 {
+		t.Fatalf("executed: got %d, want 2", executed)
+	}
+}
+
+// tests that tasks are not starved by a burst of FSMTasks,
+// and that PipelineSize is used by replication
+func TestLeader_taskFairness(t *testing.T) {
+	c := newCluster(t)
+	c.opt.PipelineSize = 4
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		for ldr.SubmitTask(ctx, UpdateFSM([]byte("burst"))) == nil {
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := waitTask(ldr, GetInfo(), c.heartbeatTimeout); err != nil {
+			t.Fatalf("getInfo: %v", err)
+		}
+	}
+	err := ldr.inspect(func(r *Raft) {
+		for id, repl := range r.ldr.repls {
+			if repl.pipeline != 4 {
+				t.Errorf("M%d pipeline: got %d, want 4", id, repl.pipeline)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// leader lease:
+//
+// a follower that acknowledged a request sent by the leader at time T,
+// does not start election, or grant vote to others, before T+hbTimeout
+// (see Options.DisableStickiness). So once a quorum of voters has
+// acknowledged requests sent at or after T, no other leader can be
+// elected before T+hbTimeout. This is the lease expiry.
+//
+// this assumes that clocks of nodes run at same rate. To tolerate
+// clocks drifting apart, lease is shortened by Options.MaxClockSkew,
+// and leader warns when measured skew of a follower exceeds it.
+
+// setAck records the time at which a request, that node
+// acknowledged in current term, was sent. It also updates
+// the latency of node, which is used to chose transfer target,
+// and reported in Info.
+//
+// must be called only from replication goroutine.
+func (r *replication) setAck(sent time.Time) {
+	atomic.StoreInt64(&r.ack, sent.UnixNano())
+	r.lastResp = r.clock.Now()
+	rtt := int64(r.lastResp.Sub(sent))
+	if latency := atomic.LoadInt64(&r.latency); latency != 0 {
+		// exponentially weighted moving average
+		rtt = (7*latency + rtt) / 8
+	}
+	if rtt <= 0 {
+		rtt = 1
+	}
+	atomic.StoreInt64(&r.latency, rtt)
+
+	// heartbeats are likely to be late, if timeout is
+	// within 2x of rtt. tell leader to warn about it.
+	if slow := 2*time.Duration(rtt) > r.hbTimeout; slow != r.slowRTT {
+		r.slowRTT = slow
+		r.notifyLdr(slowRTT{time.Duration(rtt), slow})
+	}
+}
+
+// setSkew records the clock skew of node, measured from the time in
+// its response to request sent at given time. The node is assumed to
+// have responded halfway through the round trip, so the measurement
+// is off by atmost half of round trip time. The leader is told when
+// skew beyond that error exceeds Options.MaxClockSkew, or comes back
+// within it.
+//
+// must be called only from replication goroutine.
+func (r *replication) setSkew(sent time.Time, respTime int64) {
+	if respTime == 0 {
+		return // node does not support protocolV6
+	}
+	now := r.clock.Now()
+	halfRTT := now.Sub(sent) / 2
+	skew := time.Unix(0, respTime).Sub(sent.Add(halfRTT))
+	if skew < 0 {
+		skew = -skew
+	}
+	atomic.StoreInt64(&r.skew, int64(skew))
+	if r.maxClockSkew == 0 {
+		return
+	}
+	if exceeded := skew-halfRTT > r.maxClockSkew; exceeded != r.skewExceeded {
+		r.skewExceeded = exceeded
+		r.notifyLdr(clockSkew{skew, exceeded})
+	}
+}
+
+// getSkew returns the clock skew recorded by setSkew.
+func (r *replication) getSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.skew))
+}
+
+// getLatency returns smoothed round trip time of requests
+// to the node. returns zero if nothing is acknowledged yet.
+func (r *replication) getLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.latency))
+}
+
+// getAck returns the time recorded by setAck. returns
+// zero time if nothing is acknowledged yet.
+func (r *replication) getAck() time.Time {
+	if nano := atomic.LoadInt64(&r.ack); nano != 0 {
+		return time.Unix(0, nano)
+	}
+	return time.Time{}
+}
+
+// leaseExpiry returns the time until which this leader is
+// guaranteed that there is no other leader. zero time is
+// returned if lease is not acquired yet, or if stickiness is
+// disabled, because then followers grant votes while they
+// still hear from this leader.
+func (l *leader) leaseExpiry() time.Time {
+	if !l.sticky || l.transfer.leaseExpired {
+		return time.Time{}
+	}
+	var acks []time.Time
+	for id, n := range l.configs.Latest.Nodes {
+		if n.Voter {
+			if id == l.nid {
+				acks = append(acks, l.clock.Now())
+			} else {
+				acks = append(acks, l.repls[id].getAck())
+			}
+		}
+	}
+	if len(acks) == 0 {
+		return time.Time{}
+	}
+	// latest time acknowledged by quorum
+	sort.Slice(acks, func(i, j int) bool {
+		return acks[i].After(acks[j])
+	})
+	ack := acks[len(acks)/2]
+	if ack.IsZero() {
+		return ack
+	}
+	return ack.Add(l.hbTimeout - l.maxClockSkew)
+}
+
+// checkLease raises LeaseExpired alert, if lease has lapsed
+// since last check. It is called on leaseTimer, which is
+// scheduled at lease expiry.
+func (l *leader) checkLease() {
+	now := l.clock.Now()
+	expiry := l.leaseExpiry()
+	if expiry.After(now) {
+		l.lease = expiry
+		l.leaseTimer.reset(expiry.Sub(now))
+		return
+	}
+	if !l.lease.IsZero() {
+		// lease is expired before time, on leadership transfer
+		if l.lease.After(now) {
+			l.lease = now
+		}
+		l.logger.Warn("leader lease expired", "expiry", l.lease)
+		l.alerts.LeaseExpired(l.lease)
+		if tracer.leaseExpired != nil {
+			tracer.leaseExpired(l.Raft, l.lease)
+		}
+		l.lease = time.Time{}
+	}
+	// check again, for acks from quorum
+	l.leaseTimer.reset(l.hbTimeout / 2)
+}
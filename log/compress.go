@@ -0,0 +1,170 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"errors"
+	"os"
+
+	"github.com/golang/snappy"
+)
+
+// ErrCompressAborted is returned by CommitCompress, if segments of the
+// compress are removed after PrepareCompress.
+var ErrCompressAborted = errors.New("log: compress aborted")
+
+// Compress is used to compress sealed segments, that is segments other
+// than the last one, using snappy. Entries of old segments are rarely
+// read, for example by slow followers, so trading cpu for disk space
+// is worth it.
+//
+// Snappy is used instead of zstd, because it is already a dependency
+// for compressing entries in transit, whereas zstd needs new dependency,
+// either cgo bindings or pure Go implementation that may not support
+// the go version of this module. Snappy compresses less than zstd, but
+// is faster to decompress on read.
+//
+// Like merging, compressing is done in three steps, so that compressing
+// entries does not block the writer goroutine:
+//
+//  c := l.PrepareCompress()    // in writer goroutine
+//  err := c.Write(bytesPerSec) // in any goroutine
+//  err = l.CommitCompress(c)   // in writer goroutine
+//
+// Appending entries is allowed during Write, but RemoveLTE, RemoveGTE,
+// Reset and Close are not. Like RemoveLTE, CommitCompress invalidates
+// the data returned previously, and views created before it should no
+// longer be used.
+//
+// Compressed segment is decompressed into memory on first read, and
+// is kept there until it is closed. If RemoveGTE removes entries from
+// compressed segment, it is decompressed to disk.
+type Compress struct {
+	opt  Options
+	runs []*mergeRun
+}
+
+// PrepareCompress finds the segments to be compressed. It returns
+// nil, if there is nothing to compress.
+func (l *Log) PrepareCompress() *Compress {
+	c := &Compress{opt: l.opt}
+	for s := l.first; s != l.last; s = s.next {
+		if s.n > 0 && !s.compressed() {
+			tmp := segmentFile(l.dir, s.prevIndex) + compressSuffix
+			c.runs = append(c.runs, &mergeRun{segs: []*segment{s}, tmp: tmp})
+		}
+	}
+	if len(c.runs) == 0 {
+		return nil
+	}
+	return c
+}
+
+// Write compresses segments into temporary files. The compressing
+// is limited to bytesPerSecond of uncompressed entries. Zero means
+// no limit.
+func (c *Compress) Write(bytesPerSecond int64) error {
+	limit := newRateLimit(bytesPerSecond)
+	for _, r := range c.runs {
+		if err := c.write(r, limit); err != nil {
+			return err
+		}
+		r.written = true
+	}
+	return nil
+}
+
+func (c *Compress) write(r *mergeRun, limit *rateLimit) (err error) {
+	s := r.segs[0]
+	entries, err := s.data.read(0, s.size)
+	if err != nil {
+		return err
+	}
+	block := snappy.Encode(nil, entries)
+
+	// size(8B) block offsets header
+	b := make([]byte, 8+len(block)+(s.n+2)*8)
+	byteOrder.PutUint64(b, uint64(len(block)))
+	copy(b[8:], block)
+	byteOrder.PutUint64(b[len(b)-8:], uint64(s.n)|compressedFlag)
+	for i := 1; i <= s.n+1; i++ {
+		byteOrder.PutUint64(b[len(b)-i*8-8:], s.data.slot(i))
+	}
+
+	f, err := os.OpenFile(r.tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.opt.FileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			_ = os.Remove(r.tmp)
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	limit.wait(len(entries))
+	return f.Sync()
+}
+
+// CommitCompress replaces the segments with the compressed files
+// written by Compress.Write. The segments removed since PrepareCompress,
+// are discarded and ErrCompressAborted is returned.
+func (l *Log) CommitCompress(c *Compress) error {
+	var err error
+	for _, r := range c.runs {
+		if !r.written {
+			continue
+		}
+		if !l.contains(r.segs) {
+			_ = os.Remove(r.tmp)
+			err = ErrCompressAborted
+			continue
+		}
+		if e := l.replace(r); e != nil {
+			_ = os.Remove(r.tmp)
+			return e
+		}
+	}
+	return err
+}
+
+// uncompressLast replaces the last segment, if compressed, with
+// uncompressed segment, so that entries can be removed from it.
+func (l *Log) uncompressLast() error {
+	s := l.last
+	if !s.compressed() {
+		return nil
+	}
+	opt := l.opt
+	if size := s.size + (s.n+2)*8; size > opt.SegmentSize {
+		opt.SegmentSize = size
+	}
+	m := &Merge{opt: opt}
+	r := &mergeRun{segs: []*segment{s}, tmp: segmentFile(l.dir, s.prevIndex) + compressSuffix}
+	if err := m.write(r, newRateLimit(0)); err != nil {
+		return err
+	}
+	if err := l.replace(r); err != nil {
+		_ = os.Remove(r.tmp)
+		return err
+	}
+	return nil
+}
+
+const compressSuffix = ".compress"
@@ -0,0 +1,341 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/santhosh-tekuri/raft/mmap"
+)
+
+// segmentData provides access to the contents of segment file.
+//
+// The offsets and header at the end of file are accessed as slots
+// of 8 bytes. slot i is the i-th uint64 from the end of file, thus
+// header is slot 0 and offset of i-th entry is slot i.
+type segmentData interface {
+	name() string
+	size() int
+	slot(i int) uint64
+	setSlot(i int, v uint64)
+	read(from, to int) ([]byte, error)
+	write(b []byte, off int)
+	sync() error
+	close() error
+}
+
+// compressedFlag is set in header of compressed segment.
+const compressedFlag = 1 << 63
+
+// openData maps the file into memory. If mmap fails or noMmap
+// is true, it falls back to reading and writing file handle.
+// Compressed segment is always read using file handle.
+func openData(name string, flag int, mode os.FileMode, noMmap bool) (segmentData, error) {
+	if !noMmap {
+		f, err := mmap.OpenFile(name, flag, mode)
+		if err == nil {
+			d := mmapData{f}
+			if d.size() < 8 || d.slot(0)&compressedFlag == 0 {
+				return d, nil
+			}
+			if err = d.close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d, err := openFileData(name, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.slots) > 0 && d.slots[0]&compressedFlag != 0 {
+		return openCompressedData(d)
+	}
+	return d, nil
+}
+
+// mmapData ---------------------------------------------
+
+type mmapData struct {
+	f *mmap.File
+}
+
+func (d mmapData) name() string { return d.f.Name() }
+func (d mmapData) size() int    { return len(d.f.Data) }
+
+func (d mmapData) slot(i int) uint64 {
+	return byteOrder.Uint64(d.f.Data[len(d.f.Data)-i*8-8:])
+}
+
+func (d mmapData) setSlot(i int, v uint64) {
+	byteOrder.PutUint64(d.f.Data[len(d.f.Data)-i*8-8:], v)
+}
+
+// read returns mmapped data, without copying.
+func (d mmapData) read(from, to int) ([]byte, error) {
+	return d.f.Data[from:to], nil
+}
+
+func (d mmapData) write(b []byte, off int) {
+	copy(d.f.Data[off:], b)
+}
+
+func (d mmapData) sync() error  { return d.f.Sync() }
+func (d mmapData) close() error { return d.f.Close() }
+
+// fileData ---------------------------------------------
+
+// fileData is used on platforms, where mmap is not available or
+// fails, for example due to low vm.max_map_count. The slots in use
+// are kept in memory. The writes are buffered until sync, so that
+// only sync and read do I/O.
+//
+// Views read concurrently with writer, so fields are guarded by mu.
+type fileData struct {
+	f  *os.File
+	sz int
+
+	mu     sync.Mutex
+	slots  []uint64
+	lo, hi int // range of dirty slots, lo>hi if none
+
+	pending    []byte // data written but not synced
+	pendingOff int
+}
+
+func openFileData(name string, flag int, mode os.FileMode) (*fileData, error) {
+	f, err := os.OpenFile(name, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	d := &fileData{f: f, sz: int(info.Size()), lo: 1, hi: 0}
+	if d.sz >= 8 {
+		// load header and offsets of entries
+		b := make([]byte, 8)
+		if _, err = f.ReadAt(b, int64(d.sz-8)); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		n := byteOrder.Uint64(b) &^ compressedFlag
+		if n > uint64(d.sz/8-2) {
+			n = 0 // open segment fails on invalid header
+		}
+		b = make([]byte, (n+2)*8)
+		if _, err = f.ReadAt(b, int64(d.sz-len(b))); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		d.slots = make([]uint64, n+2)
+		for i := range d.slots {
+			d.slots[i] = byteOrder.Uint64(b[len(b)-i*8-8:])
+		}
+	}
+	return d, nil
+}
+
+func (d *fileData) name() string { return d.f.Name() }
+func (d *fileData) size() int    { return d.sz }
+
+// slot returns zero, for slots beyond the offsets in use.
+func (d *fileData) slot(i int) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i < len(d.slots) {
+		return d.slots[i]
+	}
+	return 0
+}
+
+func (d *fileData) setSlot(i int, v uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.slots) <= i {
+		d.slots = append(d.slots, 0)
+	}
+	d.slots[i] = v
+	if d.lo > d.hi {
+		d.lo, d.hi = i, i
+	} else if i < d.lo {
+		d.lo = i
+	} else if i > d.hi {
+		d.hi = i
+	}
+}
+
+func (d *fileData) read(from, to int) ([]byte, error) {
+	b := make([]byte, to-from)
+	d.mu.Lock()
+	n := 0 // bytes to be read from file
+	if to <= d.pendingOff || len(d.pending) == 0 {
+		n = len(b)
+	} else if from >= d.pendingOff {
+		copy(b, d.pending[from-d.pendingOff:])
+	} else {
+		n = d.pendingOff - from
+		copy(b[n:], d.pending)
+	}
+	d.mu.Unlock()
+	if n > 0 {
+		if _, err := d.f.ReadAt(b[:n], int64(from)); err != nil {
+			return nil, fmt.Errorf("log: read %s: %v", d.f.Name(), err)
+		}
+	}
+	return b, nil
+}
+
+func (d *fileData) write(b []byte, off int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case len(d.pending) == 0 || off < d.pendingOff:
+		d.pending, d.pendingOff = d.pending[:0], off
+	case off < d.pendingOff+len(d.pending):
+		// entries removed by RemoveGTE are overwritten
+		d.pending = d.pending[:off-d.pendingOff]
+	case off > d.pendingOff+len(d.pending):
+		panic(fmt.Sprintf("log: write at %d beyond pending data at %d", off, d.pendingOff+len(d.pending)))
+	}
+	d.pending = append(d.pending, b...)
+}
+
+// flush writes the buffered writes to file.
+func (d *fileData) flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) > 0 {
+		if _, err := d.f.WriteAt(d.pending, int64(d.pendingOff)); err != nil {
+			return err
+		}
+		d.pending = d.pending[:0]
+	}
+	if d.lo <= d.hi {
+		b := make([]byte, (d.hi-d.lo+1)*8)
+		for i := d.lo; i <= d.hi; i++ {
+			byteOrder.PutUint64(b[len(b)-(i-d.lo)*8-8:], d.slots[i])
+		}
+		if _, err := d.f.WriteAt(b, int64(d.sz-(d.hi+1)*8)); err != nil {
+			return err
+		}
+		d.lo, d.hi = 1, 0
+	}
+	return nil
+}
+
+func (d *fileData) sync() error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	return d.f.Sync()
+}
+
+func (d *fileData) close() error {
+	err := d.flush()
+	if e := d.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// compressedData ---------------------------------------
+
+// compressedData is used for segments compressed by Log.CommitCompress.
+// The file has the size of snappy block(8B), the block of entries and
+// then the offsets and header as in uncompressed segment. The header
+// has compressedFlag set.
+//
+// size() reports the size, the segment would have if entries are not
+// compressed, so that offsets are interpreted as usual. The block is
+// decompressed on first read, and kept in memory until close.
+type compressedData struct {
+	*fileData
+	blockSize int
+	vsz       int
+
+	once    sync.Once
+	entries []byte
+	err     error
+}
+
+func openCompressedData(d *fileData) (*compressedData, error) {
+	c := &compressedData{fileData: d}
+	if n := int(c.slot(0)); n+2 <= len(d.slots) {
+		c.vsz = int(c.slot(n+1)) + (n+2)*8
+	}
+	b := make([]byte, 8)
+	if _, err := d.f.ReadAt(b, 0); err != nil {
+		_ = d.f.Close()
+		return nil, err
+	}
+	c.blockSize = int(byteOrder.Uint64(b))
+	return c, nil
+}
+
+func (d *compressedData) size() int { return d.vsz }
+
+func (d *compressedData) slot(i int) uint64 {
+	if i == 0 {
+		return d.fileData.slot(0) &^ compressedFlag
+	}
+	return d.fileData.slot(i)
+}
+
+func (d *compressedData) setSlot(i int, v uint64) {
+	if i == 0 {
+		v |= compressedFlag
+	}
+	d.fileData.setSlot(i, v)
+}
+
+// read returns decompressed data, without copying.
+func (d *compressedData) read(from, to int) ([]byte, error) {
+	d.once.Do(func() {
+		d.entries, d.err = readBlock(d.f)
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	if to > len(d.entries) {
+		return nil, fmt.Errorf("log: read %s: offset %d beyond entries", d.f.Name(), to)
+	}
+	return d.entries[from:to], nil
+}
+
+func (d *compressedData) write(b []byte, off int) {
+	panic(fmt.Sprintf("log: write to compressed segment %s", d.f.Name()))
+}
+
+// readBlock reads and decompresses the entries of compressed segment.
+func readBlock(f *os.File) ([]byte, error) {
+	b := make([]byte, 8)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("log: read %s: %v", f.Name(), err)
+	}
+	b = make([]byte, byteOrder.Uint64(b))
+	if _, err := f.ReadAt(b, 8); err != nil {
+		return nil, fmt.Errorf("log: read %s: %v", f.Name(), err)
+	}
+	entries, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("log: decompress %s: %v", f.Name(), err)
+	}
+	return entries, nil
+}
@@ -28,7 +28,11 @@
 // segment files. The size of each segment file is specified in Options.SegmentSize.
 // The segment file is pre allocated, that means if Options.SegmentSize is 16MB,
 // then when segment file is created its size will be 16MB. The segment files are
-// mapped into memory as read-write.
+// mapped into memory as read-write. If mmap is not available or fails, or Options.NoMmap
+// is set, segment files are read and written using file handle, with the same format.
+// In that case Get, GetN return copies rather than mmapped data. Options.SegmentEntries optionally limits the
+// number of entries in a segment. Log.SetSegmentLimits changes both of them for the
+// segments created later, so segment files in a directory can have different sizes.
 //
 // The segment file name tells prevIndex of the segment. for example segment file named
 // 100.log contains entries from 101. So the first segment file will be named 0.log.
@@ -71,7 +75,9 @@
 //
 // If implicit/explicit commit is not done and program crashes, only entries and offsets in last segment may be lost.
 // Some times the last segment may still has the new entries and offsets, but header will not reflect the new entries.
-// The header is updated only on commit.
+// The header is updated only on commit. On file systems that do not preserve the order of writes, the header
+// might be written before the offsets. So Open truncates the entries of last segment, whose offsets are not
+// increasing or not within bounds. Entries are not checksummed, so torn data with valid offsets is not detected.
 //
 // Removing Entries
 //
@@ -88,6 +94,21 @@
 //
 // Log.Reset(i) clears all entries and resets lastIndex to i. This is used to discard complete log.
 //
+// Merging Segments
+//
+// Segments with few entries still occupy Options.SegmentSize on disk. Log.PrepareMerge finds adjacent
+// segments whose entries fit in single segment. Merge.Write copies their entries into temporary file, at
+// given rate limit, and can be called from another goroutine. Log.CommitMerge then replaces those segments
+// with the merged segment, which is named after the first of them.
+//
+// Compressing Segments
+//
+// Entries of sealed segments, that is segments other than the last one, are rarely read. Log.PrepareCompress
+// finds such segments, Compress.Write compresses their entries as single snappy block into temporary file, and
+// Log.CommitCompress replaces the segments with compressed files. Compressed file has the size of block(8B) and
+// the block, followed by offsets and header as usual. The most significant bit of header marks the segment as
+// compressed. Compressed segment is decompressed into memory on first read, and Get, GetN return slices of it.
+//
 // Getting Entries
 //
 // Log.Get(i) returns i-th entry. If i>LastIndex it panics. If i<=PrevIndex it returns ErrNotFound.
@@ -98,6 +119,13 @@
 // The []byte returned by both Get and Getn are memory mapped. returned []byte is valid until you call one of the method:
 // RemoveGTE, RemoveLTE, Close.
 //
+// Encryption
+//
+// If Options.Cipher is set, each entry is encrypted by Log.Append before it is
+// written to segment file, and decrypted on read. In this case Get, GetN and Reader
+// return decrypted copies rather than mmapped data. The offsets and header are
+// not encrypted.
+//
 // Views
 //
 // Log is not thread safe for use from multiple goroutines. Instead of synchronizing at application end, use views.
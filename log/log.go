@@ -27,10 +27,32 @@ var ErrNotFound = errors.New("log: entry not found")
 // does not fit in empty segment.
 var ErrExceedsSegmentSize = errors.New("log: entry exceeds segment size")
 
+// Cipher encrypts entries before they are written to segment files,
+// and decrypts them when they are read. The index of entry is given,
+// so that it can be authenticated along with the entry.
+//
+// Cipher must be safe for concurrent use, because views share it.
+type Cipher interface {
+	Encrypt(index uint64, b []byte) ([]byte, error)
+	Decrypt(index uint64, b []byte) ([]byte, error)
+}
+
 // Options contains necessary configuration.
 type Options struct {
 	FileMode    os.FileMode
 	SegmentSize int
+
+	// SegmentEntries is the maximum number of entries in a segment.
+	// Zero means no limit.
+	SegmentEntries int
+
+	// Cipher, if not nil, is used to encrypt entries at rest.
+	Cipher Cipher
+
+	// NoMmap, if true, reads and writes segment files using file
+	// handle, rather than mapping them into memory. This is used
+	// automatically, if mmap is not available or fails.
+	NoMmap bool
 }
 
 func (o Options) validate() error {
@@ -40,6 +62,9 @@ func (o Options) validate() error {
 	if o.SegmentSize < 1024 {
 		return fmt.Errorf("log: SegmentSize %d is too smal", o.SegmentSize)
 	}
+	if o.SegmentEntries < 0 {
+		return fmt.Errorf("log: SegmentEntries %d is negative", o.SegmentEntries)
+	}
 	return nil
 }
 
@@ -62,6 +87,9 @@ func Open(dir string, dirMode os.FileMode, opt Options) (*Log, error) {
 	if err := os.MkdirAll(dir, dirMode); err != nil {
 		return nil, err
 	}
+	if err := removeMergeFiles(dir); err != nil {
+		return nil, err
+	}
 	first, last, err := openSegments(dir, opt)
 	if err != nil {
 		for first != nil {
@@ -128,11 +156,39 @@ func (l *Log) LastIndex() uint64 {
 	return l.last.lastIndex()
 }
 
+// SyncedIndex returns the index upto which entries are
+// synced to disk. Entries after it are lost on os crash.
+func (l *Log) SyncedIndex() uint64 {
+	if l.last.synced <= 0 {
+		return l.last.prevIndex
+	}
+	return l.last.prevIndex + uint64(l.last.synced)
+}
+
 // Count returns number of entries in log.
 func (l *Log) Count() uint64 {
 	return l.LastIndex() - l.PrevIndex()
 }
 
+// Size returns number of bytes used by entries in segment files.
+// Note that it includes entries <=PrevIndex in first segment, and
+// for view it includes entries >LastIndex in last segment.
+//
+// For compressed segments, the size of compressed entries is used.
+func (l *Log) Size() int64 {
+	var size int64
+	for s := l.first; ; s = s.next {
+		if d, ok := s.data.(*compressedData); ok {
+			size += int64(d.blockSize)
+		} else {
+			size += int64(s.size)
+		}
+		if s == l.last {
+			return size
+		}
+	}
+}
+
 func (l *Log) segment(i uint64) *segment {
 	if i > l.LastIndex() {
 		panic(fmt.Sprintf("log: %d>lastIndex(%d)", i, l.LastIndex()))
@@ -163,7 +219,8 @@ func (l *Log) Contains(i uint64) bool {
 // The returned []byte is mmapped data. It can be used as long as
 // Close, RemoveLTE, RemoveGTE is not called. Any of these three calls
 // might invalidate the data returned and further use of it will
-// cause errors.
+// cause errors. If Options.Cipher is set, decrypted copy is returned
+// instead.
 //
 // if index is >LastIndex it panics. If index <PrevIndex, it returns
 // ErrNotFound.
@@ -172,7 +229,7 @@ func (l *Log) Get(i uint64) ([]byte, error) {
 	if s == nil {
 		return nil, ErrNotFound
 	}
-	return s.get(i, 1), nil
+	return l.read(s, i, 1)
 }
 
 // GetN returns n entries from i. that is entries i, i+1,...,i+n-1.
@@ -180,7 +237,8 @@ func (l *Log) Get(i uint64) ([]byte, error) {
 // segment file. The returned data can be used as long as Close,
 // RemoveLTE, RemoveGTE is not called. Any of these three calls
 // might invalidate the data returned and further use of it will
-// cause errors.
+// cause errors. If Options.Cipher is set, decrypted copies are
+// returned instead.
 //
 // if index is >LastIndex it panics. If index <PrevIndex, it returns
 // ErrNotFound.
@@ -194,27 +252,63 @@ func (l *Log) GetN(i uint64, n uint64) ([][]byte, error) {
 	}
 	var buffs [][]byte
 	for n > 0 {
-		if s == l.last {
-			buffs = append(buffs, s.get(i, n))
-			break
-		} else {
-			sn := s.lastIndex() - (i - 1)
+		sn := n
+		if s != l.last {
+			sn = s.lastIndex() - (i - 1)
 			if sn > n {
 				sn = n
 			}
-			buffs = append(buffs, s.get(i, sn))
-			i += sn
-			n -= sn
-			s = s.next
 		}
+		b, err := l.read(s, i, sn)
+		if err != nil {
+			return nil, err
+		}
+		buffs = append(buffs, b)
+		if s == l.last {
+			// next of last segment is being written by Append
+			break
+		}
+		i += sn
+		n -= sn
+		s = s.next
 	}
 	return buffs, nil
 }
 
+// read returns n entries from i, in segment s.
+func (l *Log) read(s *segment, i uint64, n uint64) ([]byte, error) {
+	if l.opt.Cipher == nil {
+		return s.get(i, n)
+	}
+	var buf []byte
+	for j := i; j < i+n; j++ {
+		b, err := s.get(j, 1)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = l.opt.Cipher.Decrypt(j, b); err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return b, nil
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
 // Append appends an entry to log. the param []byte
 // is opaque to Log and is not interpreted.
 func (l *Log) Append(b []byte) error {
-	if l.last.available() < len(b) {
+	if l.opt.Cipher != nil {
+		var err error
+		if b, err = l.opt.Cipher.Encrypt(l.LastIndex()+1, b); err != nil {
+			return err
+		}
+	}
+	// compressed segment becomes last, if RemoveGTE removes the segments after it
+	full := l.opt.SegmentEntries > 0 && l.last.n >= l.opt.SegmentEntries || l.last.compressed()
+	if full || l.last.available() < len(b) {
 		if l.last.n == 0 {
 			return ErrExceedsSegmentSize
 		}
@@ -235,6 +329,19 @@ func (l *Log) Append(b []byte) error {
 	return nil
 }
 
+// SetSegmentLimits changes Options.SegmentSize and Options.SegmentEntries.
+// They apply to the segments created after this call. Existing segments
+// retain their size.
+func (l *Log) SetSegmentLimits(size, entries int) error {
+	opt := l.opt
+	opt.SegmentSize, opt.SegmentEntries = size, entries
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	l.opt = opt
+	return nil
+}
+
 // CanLTE tells which entries will be removed if RemoveLTE(i)
 // is called. You can only remove segment completely or not.
 // for example if log has two segments, with first segment
@@ -286,6 +393,9 @@ func (l *Log) RemoveGTE(i uint64) error {
 	for {
 		if i <= l.last.prevIndex+1 {
 			if l.last == l.first && i == l.last.prevIndex+1 {
+				if err := l.uncompressLast(); err != nil {
+					return err
+				}
 				return l.last.removeGTE(l.last.prevIndex + 1) // clear all entries
 			}
 
@@ -313,6 +423,8 @@ func (l *Log) RemoveGTE(i uint64) error {
 		} else if i > l.last.prevIndex {
 			if i > l.last.lastIndex() {
 				i = l.last.lastIndex() + 1
+			} else if err := l.uncompressLast(); err != nil {
+				return err
 			}
 			return l.last.removeGTE(i)
 		} else {
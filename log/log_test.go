@@ -17,12 +17,14 @@ package log
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -57,6 +59,109 @@ func TestSegmentSize(t *testing.T) {
 	}
 	assertInt(t, "numSegments", numSegments(l), 2)
 	assertInt(t, "segmentSize", l.opt.SegmentSize, 1025)
+	assertInt(t, "size", int(l.Size()), 2*len(b)-1)
+}
+
+func TestSegmentEntries(t *testing.T) {
+	l := newLog(t, 1024)
+	if err := l.SetSegmentLimits(1024, -1); err == nil {
+		t.Fatal("error expected for negative SegmentEntries")
+	}
+	if err := l.SetSegmentLimits(2048, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		appendEntry(t, l)
+	}
+	assertInt(t, "numSegments", numSegments(l), 3)
+	assertInt(t, "lastSegment.n", l.last.n, 1)
+	assertInt(t, "segmentSize", l.last.data.size(), 2048)
+
+	// segments of different sizes are opened
+	l.opt.SegmentSize, l.opt.SegmentEntries = 1024, 0
+	l = reopen(t, l)
+	assertInt(t, "numSegments", numSegments(l), 3)
+	assertUint64(t, "lastIndex", l.LastIndex(), 7)
+	checkGet(t, l)
+}
+
+func TestOpen_invalidHeader(t *testing.T) {
+	l := newLog(t, 1024)
+	appendEntry(t, l)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segmentFile(l.dir, 0), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	byteOrder.PutUint64(b, 1000)
+	_, err = f.WriteAt(b, 1024-8)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(l.dir, 0700, l.opt); err == nil {
+		t.Fatal("error expected for invalid header")
+	}
+}
+
+func TestOpen_tornEntries(t *testing.T) {
+	l := newLog(t, 1024)
+	for i := 0; i < 5; i++ {
+		appendEntry(t, l)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	setSlot := func(prevIndex uint64, i int, v uint64) {
+		t.Helper()
+		f, err := os.OpenFile(segmentFile(l.dir, prevIndex), os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 8)
+		byteOrder.PutUint64(b, v)
+		_, err = f.WriteAt(b, info.Size()-int64(i)*8-8)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// end offset of entry 4 is beyond data bounds
+	setSlot(0, 5, 1024)
+	l, err := Open(l.dir, 0700, l.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUint64(t, "lastIndex", l.LastIndex(), 3)
+	checkGet(t, l)
+	appendEntry(t, l)
+	l = reopen(t, l)
+	assertUint64(t, "lastIndex", l.LastIndex(), 4)
+	checkGet(t, l)
+
+	// torn entries in segment other than last, is an error
+	for numSegments(l) != 2 {
+		appendEntry(t, l)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	setSlot(0, l.first.n+1, 2048)
+	if _, err := Open(l.dir, 0700, l.opt); err == nil {
+		t.Fatal("error expected for torn entries in first segment")
+	}
 }
 
 func TestLog_Get(t *testing.T) {
@@ -467,8 +572,152 @@ func TestLog_RemoveLTE_RemoveGTE(t *testing.T) {
 	removeGTE(0, []uint64{0}, 0)
 }
 
+func TestLog_NewReader(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	checkReader := func(i, j uint64) {
+		t.Helper()
+		r, err := l.NewReader(i, j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		for ; i <= j; i++ {
+			got, err := r.Next()
+			if err != nil {
+				t.Fatalf("next(%d): %v", i, err)
+			}
+			if want := msg(i); !bytes.Equal(got, want) {
+				t.Fatalf("next(%d)=%q, want %q", i, string(got), string(want))
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("got %v, want io.EOF", err)
+		}
+	}
+	checkReader(1, l.LastIndex())
+	checkReader(l.LastIndex()-3, l.LastIndex())
+	checkReader(5, 4)
+
+	// reader must work even after segments are removed
+	r, err := l.NewReader(1, l.LastIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	last := l.LastIndex()
+	if err := l.RemoveLTE(last - 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= last; i++ {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("next(%d): %v", i, err)
+		}
+		if want := msg(i); !bytes.Equal(got, want) {
+			t.Fatalf("next(%d)=%q, want %q", i, string(got), string(want))
+		}
+	}
+
+	_, err = l.NewReader(l.PrevIndex(), l.LastIndex())
+	checkErrNotFound(t, err)
+}
+
+func TestLog_Cipher(t *testing.T) {
+	l := newLog(t, 1024)
+	l.opt.Cipher = xorCipher(0x5a)
+	for numSegments(l) != 3 {
+		appendEntry(t, l)
+	}
+	l = reopen(t, l)
+
+	// segment files must not contain entries in plain text
+	for s := l.first; s != nil; s = s.next {
+		b, err := ioutil.ReadFile(s.data.name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, msg(s.prevIndex+1)) {
+			t.Fatalf("segment %d is not encrypted", s.prevIndex)
+		}
+	}
+
+	checkGet(t, l)
+	var want []byte
+	for i := uint64(1); i <= l.LastIndex(); i++ {
+		want = append(want, msg(i)...)
+	}
+	checkGetN(t, l, 1, l.LastIndex(), want)
+
+	r, err := l.NewReader(1, l.LastIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := uint64(1); i <= l.LastIndex(); i++ {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("next(%d): %v", i, err)
+		}
+		if want := msg(i); !bytes.Equal(got, want) {
+			t.Fatalf("next(%d)=%q, want %q", i, string(got), string(want))
+		}
+	}
+
+	// decrypt errors must be reported
+	corruptByte(t, l.segment(1), 0)
+	if _, err := l.Get(1); err == nil {
+		t.Fatal("error expected for corrupted entry")
+	}
+	if _, err := l.GetN(1, 2); err == nil {
+		t.Fatal("error expected for corrupted entry")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 3 {
+		appendEntry(t, l)
+	}
+	segs := getSegments(l)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(l.dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt header of middle segment
+	f := segmentFile(l.dir, segs[1])
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), b...)
+	byteOrder.PutUint64(corrupted[len(corrupted)-8:], 1<<40)
+	if err = ioutil.WriteFile(f, corrupted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(l.dir); err == nil {
+		t.Fatal("error expected for invalid header")
+	}
+
+	// remove middle segment
+	if err = os.Remove(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(l.dir); err == nil {
+		t.Fatal("error expected for missing segment")
+	}
+}
+
 var tempDir string
 
+// noMmap is used by newLog, see TestLog_noMmap
+var noMmap bool
+
 func TestMain(M *testing.M) {
 	temp, err := ioutil.TempDir("", "log")
 	if err != nil {
@@ -488,7 +737,7 @@ func newLog(tb testing.TB, size int) *Log {
 	if err != nil {
 		tb.Fatal(err)
 	}
-	l, err := Open(dir, 0700, Options{0600, size})
+	l, err := Open(dir, 0700, Options{FileMode: 0600, SegmentSize: size, NoMmap: noMmap})
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -583,6 +832,30 @@ func checkGetN(t *testing.T, l *Log, i, n uint64, want []byte) {
 	}
 }
 
+// xorCipher prefixes index to the entry, to check
+// that Decrypt is called with same index as Encrypt.
+type xorCipher byte
+
+func (c xorCipher) Encrypt(index uint64, b []byte) ([]byte, error) {
+	buf := make([]byte, 8+len(b))
+	byteOrder.PutUint64(buf, index)
+	for i := range b {
+		buf[8+i] = b[i] ^ byte(c)
+	}
+	return buf, nil
+}
+
+func (c xorCipher) Decrypt(index uint64, b []byte) ([]byte, error) {
+	if len(b) < 8 || byteOrder.Uint64(b) != index {
+		return nil, fmt.Errorf("xorCipher: index mismatch for entry %d", index)
+	}
+	buf := make([]byte, len(b)-8)
+	for i := range buf {
+		buf[i] = b[8+i] ^ byte(c)
+	}
+	return buf, nil
+}
+
 func assertUint64(t *testing.T, name string, got, want uint64) {
 	t.Helper()
 	if got != want {
@@ -627,3 +900,260 @@ func getSegments(l *Log) []uint64 {
 	}
 	return segs
 }
+
+func TestLog_Merge(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 6 {
+		appendEntry(t, l)
+	}
+	if m := l.PrepareMerge(); m != nil {
+		t.Fatal("full segments must not be merged")
+	}
+
+	// segments created with smaller size can be merged
+	l.opt.SegmentSize = 4 * 1024
+	l = reopen(t, l)
+	if err := l.RemoveLTE(l.first.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+	prevIndex, lastIndex := l.PrevIndex(), l.LastIndex()
+	m := l.PrepareMerge()
+	if m == nil {
+		t.Fatal("nothing to merge")
+	}
+	start := time.Now()
+	if err := m.Write(20 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("merge write took %s, rate limit not honored", d)
+	}
+	appendEntry(t, l) // appends allowed during Write
+	lastIndex++
+	if err := l.CommitMerge(m); err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, "numSegments", numSegments(l), 2)
+	assertUint64(t, "prevIndex", l.PrevIndex(), prevIndex)
+	assertUint64(t, "lastIndex", l.LastIndex(), lastIndex)
+	checkGet(t, l)
+
+	// merged segment survives reopen
+	l = reopen(t, l)
+	assertInt(t, "numSegments", numSegments(l), 2)
+	assertUint64(t, "prevIndex", l.PrevIndex(), prevIndex)
+	assertUint64(t, "lastIndex", l.LastIndex(), lastIndex)
+	checkGet(t, l)
+}
+
+func TestLog_MergeAborted(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	l.opt.SegmentSize = 4 * 1024
+	m := l.PrepareMerge()
+	if err := m.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.RemoveLTE(l.first.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CommitMerge(m); err != ErrMergeAborted {
+		t.Fatalf("got %v, want ErrMergeAborted", err)
+	}
+	assertInt(t, "numSegments", numSegments(l), 3)
+	checkGet(t, l)
+}
+
+// crash after rename of merged segment must
+// remove the segments, that are merged
+func TestLog_MergeCrash(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	lastIndex := l.LastIndex()
+	l.opt.SegmentSize = 4 * 1024
+	m := l.PrepareMerge()
+	if err := m.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := m.runs[0]
+	if err := os.Rename(r.tmp, r.segs[0].data.name()); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(l.dir, 0700, l.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, "numSegments", numSegments(l), 2)
+	assertUint64(t, "lastIndex", l.LastIndex(), lastIndex)
+	checkGet(t, l)
+}
+
+func TestLog_Compress(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	size := l.Size()
+	c := l.PrepareCompress()
+	if c == nil {
+		t.Fatal("nothing to compress")
+	}
+	if err := c.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	appendEntry(t, l) // appends allowed during Write
+	if err := l.CommitCompress(c); err != nil {
+		t.Fatal(err)
+	}
+	if c := l.PrepareCompress(); c != nil {
+		t.Fatal("compressed segments must not be compressed again")
+	}
+	if m := l.PrepareMerge(); m != nil {
+		t.Fatal("compressed segments must not be merged")
+	}
+	if l.Size() >= size {
+		t.Fatalf("size: got %d, want <%d", l.Size(), size)
+	}
+	assertInt(t, "numSegments", numSegments(l), 4)
+	checkGet(t, l)
+	checkGetN(t, l, 1, l.LastIndex(), msgs(1, l.LastIndex()))
+
+	// compressed segments survive reopen
+	l = reopen(t, l)
+	for s := l.first; s != l.last; s = s.next {
+		if !s.compressed() {
+			t.Fatalf("segment %d is not compressed", s.prevIndex)
+		}
+	}
+	checkGet(t, l)
+	if err := Verify(l.dir); err != nil {
+		t.Fatal(err)
+	}
+	r, err := l.NewReader(1, l.LastIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= l.LastIndex(); i++ {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("next(%d): %v", i, err)
+		}
+		if want := msg(i); !bytes.Equal(got, want) {
+			t.Fatalf("next(%d)=%q, want %q", i, string(got), string(want))
+		}
+	}
+	_ = r.Close()
+
+	// removing entries from compressed segment, uncompresses it
+	lastIndex := l.first.next.lastIndex() - 2
+	if err := l.RemoveGTE(lastIndex + 1); err != nil {
+		t.Fatal(err)
+	}
+	assertInt(t, "numSegments", numSegments(l), 2)
+	assertUint64(t, "lastIndex", l.LastIndex(), lastIndex)
+	if l.last.compressed() {
+		t.Fatal("last segment must not be compressed")
+	}
+	for l.LastIndex() < lastIndex+10 {
+		appendEntry(t, l)
+	}
+	checkGet(t, l)
+
+	// appending to compressed segment, creates new segment
+	if err := l.RemoveGTE(l.first.lastIndex() + 1); err != nil {
+		t.Fatal(err)
+	}
+	if !l.last.compressed() {
+		t.Fatal("last segment must be compressed")
+	}
+	appendEntry(t, l)
+	assertInt(t, "numSegments", numSegments(l), 2)
+	checkGet(t, l)
+	l = reopen(t, l)
+	checkGet(t, l)
+}
+
+func TestLog_CompressAborted(t *testing.T) {
+	l := newLog(t, 1024)
+	for numSegments(l) != 4 {
+		appendEntry(t, l)
+	}
+	c := l.PrepareCompress()
+	if err := c.Write(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.RemoveLTE(l.first.lastIndex()); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CommitCompress(c); err != ErrCompressAborted {
+		t.Fatalf("got %v, want ErrCompressAborted", err)
+	}
+	assertInt(t, "numSegments", numSegments(l), 3)
+	checkGet(t, l)
+}
+
+// corruptByte flips the byte at given offset of segment file.
+func corruptByte(t *testing.T, s *segment, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(s.data.name(), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLog_noMmap(t *testing.T) {
+	noMmap = true
+	defer func() { noMmap = false }()
+	tests := map[string]func(*testing.T){
+		"Open":              TestOpen,
+		"SegmentSize":       TestSegmentSize,
+		"SegmentEntries":    TestSegmentEntries,
+		"Get":               TestLog_Get,
+		"GetN":              TestLog_GetN,
+		"ViewAt":            TestLog_ViewAt,
+		"RemoveLTE":         TestLog_RemoveLTE,
+		"RemoveGTE":         TestLog_RemoveGTE,
+		"RemoveLTE_GTE":     TestLog_RemoveLTE_RemoveGTE,
+		"NewReader":         TestLog_NewReader,
+		"Cipher":            TestLog_Cipher,
+		"Merge":             TestLog_Merge,
+		"MergeCrash":        TestLog_MergeCrash,
+		"Compress":          TestLog_Compress,
+		"OpenInvalidHeader": TestOpen_invalidHeader,
+		"OpenTornEntries":   TestOpen_tornEntries,
+	}
+	for name, test := range tests {
+		t.Run(name, test)
+	}
+
+	// directory written without mmap is readable with mmap
+	l := newLog(t, 1024)
+	for numSegments(l) != 3 {
+		appendEntry(t, l)
+	}
+	if _, ok := l.last.data.(*fileData); !ok {
+		t.Fatalf("got %T, want *fileData", l.last.data)
+	}
+	l.opt.NoMmap = false
+	l = reopen(t, l)
+	if _, ok := l.last.data.(mmapData); !ok {
+		t.Fatalf("got %T, want mmapData", l.last.data)
+	}
+	checkGet(t, l)
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrMergeAborted is returned by CommitMerge, if segments of the
+// merge are removed after PrepareMerge.
+var ErrMergeAborted = errors.New("log: merge aborted")
+
+// Merge is used to merge small adjacent segments into single segment.
+//
+// Each segment occupies Options.SegmentSize on disk, even if it has few
+// entries. This happens when an entry does not fit in remaining space of
+// last segment, or when log is reopened with larger SegmentSize. Merging
+// them saves disk space and number of open files.
+//
+// Merging is done in three steps, so that copying entries does not block
+// the writer goroutine:
+//
+//  m := l.PrepareMerge()       // in writer goroutine
+//  err := m.Write(bytesPerSec) // in any goroutine
+//  err = l.CommitMerge(m)      // in writer goroutine
+//
+// Appending entries is allowed during Write, but RemoveLTE, RemoveGTE,
+// Reset and Close are not. Like RemoveLTE, CommitMerge invalidates the
+// data returned previously, and views created before it should no
+// longer be used.
+type Merge struct {
+	opt  Options
+	runs []*mergeRun
+}
+
+// mergeRun is adjacent segments to be merged into tmp file.
+type mergeRun struct {
+	segs    []*segment
+	tmp     string
+	written bool
+}
+
+// PrepareMerge finds adjacent segments, whose entries fit in single
+// segment of Options.SegmentSize. The last segment is never merged,
+// because entries are appended to it. Compressed segments are not
+// merged either. It returns nil, if there is nothing to merge.
+func (l *Log) PrepareMerge() *Merge {
+	m := &Merge{opt: l.opt}
+	var run []*segment
+	size, n := 0, 0
+	flush := func() {
+		if len(run) > 1 {
+			tmp := segmentFile(l.dir, run[0].prevIndex) + mergeSuffix
+			m.runs = append(m.runs, &mergeRun{segs: run, tmp: tmp})
+		}
+		run, size, n = nil, 0, 0
+	}
+	for s := l.first; s != l.last; s = s.next {
+		if s.compressed() {
+			flush()
+			continue
+		}
+		tooMany := l.opt.SegmentEntries > 0 && n+s.n > l.opt.SegmentEntries
+		if tooMany || size+s.size+(n+s.n+2)*8 > l.opt.SegmentSize {
+			flush()
+		}
+		run = append(run, s)
+		size, n = size+s.size, n+s.n
+	}
+	flush()
+	if len(m.runs) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Write copies entries of segments to be merged into temporary files.
+// The copying is limited to bytesPerSecond. Zero means no limit.
+func (m *Merge) Write(bytesPerSecond int64) error {
+	limit := newRateLimit(bytesPerSecond)
+	for _, r := range m.runs {
+		if err := m.write(r, limit); err != nil {
+			return err
+		}
+		r.written = true
+	}
+	return nil
+}
+
+func (m *Merge) write(r *mergeRun, limit *rateLimit) (err error) {
+	// discard leftover from previous attempt
+	if err = os.Remove(r.tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = createSegment(r.tmp, m.opt); err != nil {
+		return err
+	}
+	data, err := openData(r.tmp, os.O_RDWR, m.opt.FileMode, m.opt.NoMmap)
+	if err != nil {
+		_ = os.Remove(r.tmp)
+		return err
+	}
+	s := &segment{prevIndex: r.segs[0].prevIndex, data: data}
+	defer func() {
+		if e := s.close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			_ = os.Remove(r.tmp)
+		}
+	}()
+	for _, src := range r.segs {
+		// entries are copied as is, because cipher
+		// authenticates entry only with its index
+		for i := src.prevIndex + 1; i <= src.lastIndex(); i++ {
+			b, err := src.get(i, 1)
+			if err != nil {
+				return err
+			}
+			s.append(b)
+			limit.wait(len(b))
+		}
+	}
+	return nil
+}
+
+// CommitMerge replaces the merged segments with the files written by
+// Merge.Write. The runs, whose segments are removed since PrepareMerge,
+// are discarded and ErrMergeAborted is returned.
+func (l *Log) CommitMerge(m *Merge) error {
+	var err error
+	for _, r := range m.runs {
+		if !r.written {
+			continue
+		}
+		if !l.contains(r.segs) {
+			_ = os.Remove(r.tmp)
+			err = ErrMergeAborted
+			continue
+		}
+		if e := l.replace(r); e != nil {
+			_ = os.Remove(r.tmp)
+			return e
+		}
+	}
+	return err
+}
+
+// contains tells whether segs are still adjacent
+// segments of log, other than the last segment.
+func (l *Log) contains(segs []*segment) bool {
+	s := l.first
+	for s != nil && s != segs[0] {
+		s = s.next
+	}
+	for _, seg := range segs {
+		if s != seg || s == l.last {
+			return false
+		}
+		s = s.next
+	}
+	return true
+}
+
+func (l *Log) replace(r *mergeRun) error {
+	first, last := r.segs[0], r.segs[len(r.segs)-1]
+	// after rename, segments following the first one are
+	// dangling, so that they are removed by Open on crash
+	if err := os.Rename(r.tmp, first.data.name()); err != nil {
+		return err
+	}
+	s, err := openSegment(l.dir, first.prevIndex, l.opt)
+	if err != nil {
+		return err
+	}
+	if first.prev != nil {
+		connect(first.prev, s)
+	} else {
+		l.first = s
+	}
+	if last == l.last {
+		l.last = s
+	} else {
+		connect(s, last.next)
+	}
+	for i, seg := range r.segs {
+		err = seg.close()
+		if i > 0 && err == nil {
+			err = seg.remove()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimit blocks to limit the bytes copied per second.
+type rateLimit struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+func newRateLimit(bytesPerSecond int64) *rateLimit {
+	return &rateLimit{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (r *rateLimit) wait(n int) {
+	if r.bytesPerSecond <= 0 {
+		return
+	}
+	r.bytes += int64(n)
+	want := time.Duration(r.bytes * int64(time.Second) / r.bytesPerSecond)
+	if d := want - time.Since(r.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+const mergeSuffix = ".merge"
+
+// removeMergeFiles removes temporary files, left by
+// merges and compressions that are not committed before crash.
+func removeMergeFiles(dir string) error {
+	for _, suffix := range []string{mergeSuffix, compressSuffix} {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.log"+suffix))
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if err := os.Remove(m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
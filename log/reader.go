@@ -0,0 +1,157 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reader reads entries from segment files using file handles, rather
+// than mmapped data.
+//
+// The file handles are opened by NewReader, so Reader can be used
+// in another goroutine, even if RemoveLTE or Reset removes the segment
+// files meanwhile. Note that this is true only on platforms that
+// allow removing open files.
+type Reader struct {
+	cipher Cipher
+	segs   []readerSegment
+	next   uint64
+	last   uint64
+}
+
+type readerSegment struct {
+	prevIndex uint64
+	lastIndex uint64
+	file      *os.File
+	size      int64
+
+	// decompressed entries of compressed segment,
+	// read on first use
+	compressed bool
+	entries    []byte
+}
+
+// NewReader returns Reader to read entries from i to j, both inclusive.
+// The entries in this range must not be removed by RemoveGTE, while the
+// reader is in use. It implicitly commits the log.
+//
+// if j is >LastIndex it panics. If i is <=PrevIndex, it returns ErrNotFound.
+func (l *Log) NewReader(i, j uint64) (*Reader, error) {
+	if j > l.LastIndex() {
+		panic(fmt.Sprintf("log: %d>lastIndex(%d)", j, l.LastIndex()))
+	}
+	if i <= l.PrevIndex() {
+		return nil, ErrNotFound
+	}
+	if err := l.Commit(); err != nil {
+		return nil, err
+	}
+	r := &Reader{cipher: l.opt.Cipher, next: i, last: j}
+	if i > j {
+		return r, nil
+	}
+	for s := l.segment(i); s != nil; s = s.next {
+		f, err := os.Open(s.data.name())
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		size := int64(s.data.size())
+		if d, ok := s.data.(*compressedData); ok {
+			size = int64(d.sz)
+		}
+		r.segs = append(r.segs, readerSegment{
+			prevIndex:  s.prevIndex,
+			lastIndex:  s.lastIndex(),
+			file:       f,
+			size:       size,
+			compressed: s.compressed(),
+		})
+		if s == l.last || s.lastIndex() >= j {
+			break
+		}
+	}
+	return r, nil
+}
+
+// Next returns the next entry. It returns io.EOF, if there
+// are no more entries to read.
+func (r *Reader) Next() ([]byte, error) {
+	for len(r.segs) > 0 && r.next > r.segs[0].lastIndex {
+		_ = r.segs[0].file.Close()
+		r.segs = r.segs[1:]
+	}
+	if r.next > r.last || len(r.segs) == 0 {
+		return nil, io.EOF
+	}
+	s := &r.segs[0]
+	if s.compressed && s.entries == nil {
+		entries, err := readBlock(s.file)
+		if err != nil {
+			return nil, err
+		}
+		s.entries = entries
+	}
+	i := int64(r.next - s.prevIndex)
+	b := make([]byte, 16)
+	if _, err := s.file.ReadAt(b, s.size-i*8-16); err != nil {
+		return nil, err
+	}
+	to, from := byteOrder.Uint64(b), byteOrder.Uint64(b[8:])
+	limit := s.size
+	if s.compressed {
+		limit = int64(len(s.entries))
+	}
+	if from > to || int64(to) > limit {
+		return nil, fmt.Errorf("log: corrupted offsets for entry %d in %s", r.next, s.file.Name())
+	}
+	b = make([]byte, to-from)
+	if s.compressed {
+		copy(b, s.entries[from:to])
+	} else if _, err := s.file.ReadAt(b, int64(from)); err != nil {
+		return nil, err
+	}
+	if r.cipher != nil {
+		var err error
+		if b, err = r.cipher.Decrypt(r.next, b); err != nil {
+			return nil, err
+		}
+	}
+	r.next++
+	return b, nil
+}
+
+// Count returns number of entries yet to be read.
+func (r *Reader) Count() uint64 {
+	if r.next > r.last {
+		return 0
+	}
+	return r.last - r.next + 1
+}
+
+// Close closes the underlying segment files.
+func (r *Reader) Close() error {
+	var err error
+	for _, s := range r.segs {
+		if e := s.file.Close(); err == nil {
+			err = e
+		}
+	}
+	r.segs = nil
+	return err
+}
@@ -16,9 +16,8 @@ package log
 
 import (
 	"encoding/binary"
+	"fmt"
 	"os"
-
-	"github.com/santhosh-tekuri/raft/mmap"
 )
 
 var byteOrder = binary.LittleEndian
@@ -28,10 +27,10 @@ type segment struct {
 	prev      *segment
 	next      *segment
 
-	file   *mmap.File // index file
-	n      int        // number of entries
-	size   int        // log size
-	synced int        // number of entries synced, will be -1 on GTE
+	data   segmentData // contents of segment file
+	n      int         // number of entries
+	size   int         // log size
+	synced int         // number of entries synced, will be -1 on GTE
 }
 
 func openSegment(dir string, prevIndex uint64, opt Options) (*segment, error) {
@@ -43,41 +42,86 @@ func openSegment(dir string, prevIndex uint64, opt Options) (*segment, error) {
 			return nil, err
 		}
 	}
-	file, err := mmap.OpenFile(f, os.O_RDWR, opt.FileMode)
+	data, err := openData(f, os.O_RDWR, opt.FileMode, opt.NoMmap)
 	if err != nil {
 		return nil, err
 	}
 	s := &segment{
 		prevIndex: prevIndex,
-		file:      file,
+		data:      data,
+	}
+	// segments can have different sizes, if Options.SegmentSize is
+	// changed. so validate header against size of the file
+	if data.size() < 16 {
+		_ = data.close()
+		return nil, fmt.Errorf("log: segment %s has invalid size %d", f, data.size())
 	}
-	s.n = s.offset(0)
+	n := data.slot(0)
+	if n > uint64(data.size()/8-2) {
+		_ = data.close()
+		return nil, fmt.Errorf("log: segment %s has invalid header %d", f, n)
+	}
+	s.n = int(n)
 	s.synced = s.n
 	s.size = s.offset(s.n + 1)
 	return s, nil
 }
 
+// validEntries returns the number of entries from beginning,
+// whose offsets are increasing and within data bounds.
+func (s *segment) validEntries() int {
+	if s.offset(1) != 0 {
+		return 0
+	}
+	k, prev := 0, 0
+	for k < s.n {
+		to := s.offset(k + 2)
+		if to < prev || to > s.at(k+2) {
+			break
+		}
+		k, prev = k+1, to
+	}
+	return k
+}
+
+// recover truncates the entries after the valid entries. Such entries
+// are torn, if crashed during commit on a file system, that does not
+// preserve the order of writes. Note that torn data of an entry cannot
+// be detected, if its offsets are within bounds.
+func (s *segment) recover() error {
+	k := s.validEntries()
+	if k == s.n {
+		return nil
+	}
+	if k == 0 {
+		s.setOffset(0, 1)
+	}
+	s.setOffset(k, 0)
+	s.n, s.size, s.synced = k, s.offset(k+1), -1
+	return s.sync()
+}
+
 func (s *segment) at(i int) int {
-	return len(s.file.Data) - i*8 - 8
+	return s.data.size() - i*8 - 8
 }
 
 func (s *segment) offset(i int) int {
-	return int(byteOrder.Uint64(s.file.Data[s.at(i):]))
+	return int(s.data.slot(i))
 }
 
 func (s *segment) setOffset(off int, i int) {
-	byteOrder.PutUint64(s.file.Data[s.at(i):], uint64(off))
+	s.data.setSlot(i, uint64(off))
 }
 
 func (s *segment) lastIndex() uint64 {
 	return s.prevIndex + uint64(s.n)
 }
 
-func (s *segment) get(i uint64, n uint64) []byte {
+func (s *segment) get(i uint64, n uint64) ([]byte, error) {
 	if i > s.prevIndex {
 		i := int(i - s.prevIndex)
 		from, to := s.offset(i), s.offset(i+int(n))
-		return s.file.Data[from:to]
+		return s.data.read(from, to)
 	}
 	panic("i<=prevIndex")
 }
@@ -87,7 +131,7 @@ func (s *segment) available() int {
 }
 
 func (s *segment) append(b []byte) {
-	copy(s.file.Data[s.size:], b)
+	s.data.write(b, s.size)
 	size := s.size + len(b)
 	s.setOffset(size, s.n+2)
 	s.n, s.size = s.n+1, size
@@ -102,17 +146,23 @@ func (s *segment) removeGTE(i uint64) error {
 	return s.sync()
 }
 
+// compressed tells whether segment is compressed, see Log.PrepareCompress.
+func (s *segment) compressed() bool {
+	_, ok := s.data.(*compressedData)
+	return ok
+}
+
 func (s *segment) dirty() bool {
 	return s.synced < s.n
 }
 
 func (s *segment) sync() error {
 	if s.dirty() {
-		if err := s.file.Sync(); err != nil {
+		if err := s.data.sync(); err != nil {
 			return err
 		}
 		s.setOffset(s.n, 0)
-		if err := s.file.Sync(); err != nil {
+		if err := s.data.sync(); err != nil {
 			return err
 		}
 		s.synced = s.n
@@ -122,14 +172,14 @@ func (s *segment) sync() error {
 
 func (s *segment) close() error {
 	err := s.sync()
-	if e := s.file.Close(); err == nil {
+	if e := s.data.close(); err == nil {
 		err = e
 	}
 	return err
 }
 
 func (s *segment) remove() error {
-	return os.Remove(s.file.Name())
+	return os.Remove(s.data.name())
 }
 
 func (s *segment) closeAndRemove() error {
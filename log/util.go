@@ -105,6 +105,11 @@ func openSegments(dir string, opt Options) (first, last *segment, err error) {
 	var s *segment
 	for _, off := range offs {
 		if last.n > 0 && off == last.lastIndex() {
+			// only last segment can have torn entries
+			if last.size < 0 || last.size > last.at(last.n+1) {
+				err = fmt.Errorf("log: segment %s has invalid offset %d", last.data.name(), last.size)
+				return
+			}
 			if s, err = openSegment(dir, off, opt); err != nil {
 				return
 			}
@@ -112,11 +117,12 @@ func openSegments(dir string, opt Options) (first, last *segment, err error) {
 			last = s
 		} else {
 			// dangling segment: remove it
-			if err = os.Remove(segmentFile(dir, off)); err == nil {
+			if err = os.Remove(segmentFile(dir, off)); err != nil {
 				return
 			}
 		}
 	}
+	err = last.recover()
 	return
 }
 
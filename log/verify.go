@@ -0,0 +1,78 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"os"
+)
+
+// Verify checks the structure of segment files in given directory,
+// without modifying them. It checks that header and offsets of each
+// segment are within bounds, offsets are in increasing order, and
+// segments have contiguous indexes. It does not interpret entries.
+//
+// Unlike Open, dangling segments are reported as error rather
+// than removed.
+func Verify(dir string) error {
+	offs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	for i, off := range offs {
+		n, err := verifySegment(segmentFile(dir, off))
+		if err != nil {
+			return err
+		}
+		if i+1 < len(offs) {
+			if next := off + uint64(n); offs[i+1] != next {
+				return fmt.Errorf("log: segment %s is not contiguous, want %s", segmentFile(dir, offs[i+1]), segmentFile(dir, next))
+			}
+		}
+	}
+	return nil
+}
+
+// verifySegment checks the segment file and returns
+// number of entries in it.
+func verifySegment(name string) (int, error) {
+	d, err := openData(name, os.O_RDONLY, 0, false)
+	if err != nil {
+		return 0, err
+	}
+	defer d.close()
+
+	s := &segment{data: d}
+	if d.size() < 16 {
+		return 0, fmt.Errorf("log: segment %s: size %d is too small", name, d.size())
+	}
+	s.n = s.offset(0)
+	if s.n < 0 || s.n > d.size()/8-2 {
+		return 0, fmt.Errorf("log: segment %s: invalid header %d", name, s.n)
+	}
+	if off := s.offset(1); off != 0 {
+		return 0, fmt.Errorf("log: segment %s: first offset is %d, want 0", name, off)
+	}
+	for i := 1; i <= s.n; i++ {
+		from, to := s.offset(i), s.offset(i+1)
+		if to < from {
+			return 0, fmt.Errorf("log: segment %s: entry %d has offsets [%d, %d)", name, i, from, to)
+		}
+	}
+	if size := s.offset(s.n + 1); size > s.at(s.n+1) {
+		return 0, fmt.Errorf("log: segment %s: entries overlap offsets at %d", name, size)
+	}
+	return s.n, nil
+}
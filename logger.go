@@ -0,0 +1,58 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+// logger adds context fields to the messages logged by a component,
+// before passing them to Options.Logger.
+type logger struct {
+	delegate Logger
+	fields   []interface{} // node, component and any others
+
+	// if not nil, term and state of r are also added. Such
+	// logger must be used only from raft goroutine.
+	r *Raft
+}
+
+// newLogger returns logger for given component. fields are
+// added to every message, after node and component.
+func newLogger(delegate Logger, nid uint64, component string, fields ...interface{}) *logger {
+	return &logger{
+		delegate: delegate,
+		fields:   append([]interface{}{"node", nid, "component", component}, fields...),
+	}
+}
+
+// withState returns copy of l, which also adds term and state of r.
+func (l *logger) withState(r *Raft) *logger {
+	return &logger{delegate: l.delegate, fields: l.fields, r: r}
+}
+
+func (l *logger) with(args []interface{}) []interface{} {
+	n := len(l.fields) + len(args)
+	if l.r != nil {
+		n += 4
+	}
+	fields := make([]interface{}, 0, n)
+	fields = append(fields, l.fields...)
+	if l.r != nil {
+		fields = append(fields, "term", l.r.term, "state", l.r.state.String())
+	}
+	return append(fields, args...)
+}
+
+func (l *logger) Debug(msg string, args ...interface{}) { l.delegate.Debug(msg, l.with(args)...) }
+func (l *logger) Info(msg string, args ...interface{})  { l.delegate.Info(msg, l.with(args)...) }
+func (l *logger) Warn(msg string, args ...interface{})  { l.delegate.Warn(msg, l.with(args)...) }
+func (l *logger) Error(msg string, args ...interface{}) { l.delegate.Error(msg, l.with(args)...) }
@@ -0,0 +1,50 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package raft
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+var _ Logger = (*slog.Logger)(nil)
+
+func TestLogger_slog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := newCluster(t)
+	c.opt.Logger = slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c.ensureLaunch(1)
+	c.shutdown()
+
+	var won string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, `msg="won election"`) {
+			won = line
+		}
+	}
+	if won == "" {
+		t.Fatalf("won election is not logged:\n%s", buf)
+	}
+	for _, field := range []string{"node=1", "component=raft", "term=", "state=leader"} {
+		if !strings.Contains(won, field) {
+			t.Errorf("field %q missing in %q", field, won)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Membership reconciles the cluster config with a desired set of nodes.
+// It is returned by Raft.ReconcileMembership.
+//
+// Membership changes the config one step at a time, waiting for each
+// step to complete before the next: it updates addresses, adds new
+// nodes as nonvoters and promotes them, promotes and demotes existing
+// nodes, and finally removes the nodes not desired. Data and Tags of
+// nodes are not reconciled.
+//
+// Config can be changed only by leader. So Membership acts only while
+// its node is leader, and continues from where the previous leader left,
+// once its node becomes leader. Run it on every voter, with same desired
+// nodes, so that reconciliation continues across leadership changes.
+type Membership struct {
+	r      *Raft
+	logger *logger
+	retry  time.Duration // wait before checking config again
+
+	mu       sync.Mutex
+	desired  map[uint64]Node
+	gen      uint64 // incremented when desired is changed
+	progress MembershipProgress
+	updated  chan struct{} // closed when progress is updated
+	changed  chan struct{} // signals that desired is changed
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	stopped   chan struct{}
+}
+
+// MembershipProgress reports the progress of Membership.
+type MembershipProgress struct {
+	// Active tells whether node is leader, and reconciling the config.
+	Active bool `json:"active"`
+
+	// Converged tells whether config matches the desired nodes.
+	Converged bool `json:"converged"`
+
+	// Pending is the number of nodes, that do not match
+	// the desired nodes yet.
+	Pending int `json:"pending"`
+
+	// Step describes the config change in progress, if any.
+	Step string `json:"step,omitempty"`
+
+	// Err is the error of last config change, if any.
+	// It is retried after some time.
+	Err error `json:"-"`
+}
+
+func (p MembershipProgress) String() string {
+	switch {
+	case p.Converged:
+		return "converged"
+	case !p.Active:
+		return "inactive"
+	case p.Err != nil:
+		return fmt.Sprintf("%d pending, %s failed: %v", p.Pending, p.Step, p.Err)
+	}
+	return fmt.Sprintf("%d pending, %s", p.Pending, p.Step)
+}
+
+// ReconcileMembership returns Membership, that reconciles the cluster
+// config with desired nodes in the background. Only ID, Addr and Voter
+// of desired nodes are used. At least one desired node must be voter.
+//
+// The Membership must be closed, when no longer needed.
+func (r *Raft) ReconcileMembership(desired []Node) (*Membership, error) {
+	nodes, err := desiredNodes(desired)
+	if err != nil {
+		return nil, err
+	}
+	m := &Membership{
+		r:       r,
+		logger:  newLogger(r.nodeLogger.delegate, r.nid, "membership"),
+		retry:   r.electionMin,
+		desired: nodes,
+		updated: make(chan struct{}),
+		changed: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+func desiredNodes(desired []Node) (map[uint64]Node, error) {
+	nodes := make(map[uint64]Node, len(desired))
+	voter := false
+	for _, n := range desired {
+		if _, ok := nodes[n.ID]; ok {
+			return nil, fmt.Errorf("raft.Membership: duplicate node %d", n.ID)
+		}
+		n = Node{ID: n.ID, Addr: n.Addr, Voter: n.Voter}
+		if err := n.validate(); err != nil {
+			return nil, err
+		}
+		nodes[n.ID] = n
+		voter = voter || n.Voter
+	}
+	if !voter {
+		return nil, errors.New("raft.Membership: at least one voter must be desired")
+	}
+	return nodes, nil
+}
+
+// SetDesired replaces the desired nodes. Any config change
+// in progress is completed, before reconciling with them.
+// Wait called after SetDesired, waits for the new nodes.
+func (m *Membership) SetDesired(desired []Node) error {
+	nodes, err := desiredNodes(desired)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.desired = nodes
+	m.gen++
+	m.progress.Converged = false
+	m.mu.Unlock()
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Progress returns the current progress of m.
+func (m *Membership) Progress() MembershipProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.progress
+}
+
+// Wait blocks until the config of m's node matches the desired nodes,
+// as seen by leader. It returns ErrMembershipClosed if m is closed,
+// and ErrServerClosed if raft is closed.
+func (m *Membership) Wait(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		converged, updated := m.progress.Converged, m.updated
+		m.mu.Unlock()
+		if converged {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.closed:
+			return ErrMembershipClosed
+		case <-m.r.close:
+			return ErrServerClosed
+		case <-updated:
+		}
+	}
+}
+
+// Close stops m, and waits for its background goroutine to exit.
+// Any config change in progress is not cancelled.
+func (m *Membership) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	<-m.stopped
+}
+
+// setProgress updates progress, unless desired nodes are changed
+// after gen, in which case reconcile runs again.
+func (m *Membership) setProgress(gen uint64, p MembershipProgress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if gen != m.gen {
+		return
+	}
+	m.progress = p
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+func (m *Membership) run() {
+	defer close(m.stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.closed:
+		case <-m.r.close:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	for {
+		if !m.reconcile(ctx) {
+			select {
+			case <-ctx.Done():
+			case <-m.changed:
+			case <-time.After(m.retry):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// reconcile performs next step to reconcile config. It returns
+// true if config is changed, and next step can be checked
+// immediately.
+func (m *Membership) reconcile(ctx context.Context) bool {
+	m.mu.Lock()
+	desired, gen, converged := m.desired, m.gen, m.progress.Converged
+	m.mu.Unlock()
+
+	info, err := m.r.Info(ctx)
+	if err != nil || info.State != Leader {
+		m.setProgress(gen, MembershipProgress{})
+		return false
+	}
+	if !info.Configs.Latest.isStable() {
+		// previous step is still in progress
+		m.setProgress(gen, MembershipProgress{Active: true, Step: "waiting for stable config"})
+		_, err := m.r.do(ctx, WaitForStableConfig())
+		return err == nil
+	}
+
+	config := info.Configs.Latest.clone()
+	step, pending, err := nextMembershipStep(&config, desired, m.r.nid)
+	if pending == 0 {
+		if !converged {
+			m.logger.Info("membership converged", "config", config)
+		}
+		m.setProgress(gen, MembershipProgress{Active: true, Converged: true})
+		return false
+	}
+	p := MembershipProgress{Active: true, Pending: pending, Step: step}
+	if err == nil {
+		m.logger.Info("changing membership", "step", step, "pending", pending)
+		m.setProgress(gen, p)
+		err = m.r.ChangeConfig(ctx, config)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			m.logger.Warn("changing membership failed", "step", step, "err", err)
+		}
+		p.Err = err
+		m.setProgress(gen, p)
+		return false
+	}
+	return true
+}
+
+// nextMembershipStep changes config, as per the next step to reconcile
+// it with desired nodes, and returns the description of that step along
+// with the number of nodes pending. It returns zero pending, if config
+// is already reconciled. An error is returned, if the step is invalid,
+// for example when desired address is used by another node.
+//
+// The steps are done in an order, that keeps the number of voters from
+// dropping: addresses are updated first, then new nodes are added and
+// promoted, and finally nodes are demoted and removed. Among nodes,
+// self is demoted or removed last, since leader steps down on it.
+func nextMembershipStep(config *Config, desired map[uint64]Node, self uint64) (step string, pending int, err error) {
+	var addr, add, promote, demote, remove []uint64
+	for id, d := range desired {
+		n, ok := config.Nodes[id]
+		switch {
+		case !ok:
+			add = append(add, id)
+		case n.Addr != d.Addr:
+			addr = append(addr, id)
+		case !n.Voter && d.Voter:
+			promote = append(promote, id)
+		case n.Voter && !d.Voter:
+			demote = append(demote, id)
+		}
+	}
+	for id := range config.Nodes {
+		if _, ok := desired[id]; !ok {
+			remove = append(remove, id)
+		}
+	}
+	pending = len(addr) + len(add) + len(promote) + len(demote) + len(remove)
+
+	first := func(ids []uint64) uint64 {
+		sort.Slice(ids, func(i, j int) bool {
+			if ids[i] == self || ids[j] == self {
+				return ids[j] == self
+			}
+			return ids[i] < ids[j]
+		})
+		return ids[0]
+	}
+	switch {
+	case len(addr) > 0:
+		id := first(addr)
+		step = fmt.Sprintf("set address of M%d", id)
+		err = config.SetAddr(id, desired[id].Addr)
+	case len(add) > 0:
+		id := first(add)
+		step = fmt.Sprintf("add M%d", id)
+		err = config.AddNonvoter(id, desired[id].Addr, desired[id].Voter)
+	case len(promote) > 0:
+		id := first(promote)
+		step = fmt.Sprintf("promote M%d", id)
+		err = config.SetAction(id, Promote)
+	case len(demote) > 0:
+		id := first(demote)
+		step = fmt.Sprintf("demote M%d", id)
+		err = config.SetAction(id, Demote)
+	case len(remove) > 0:
+		id := first(remove)
+		step = fmt.Sprintf("remove M%d", id)
+		err = config.SetAction(id, Remove)
+	}
+	return step, pending, err
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMembership(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.launch(1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+
+	// replace flrs[1] with M4
+	desired := []Node{
+		{ID: ldr.nid, Addr: c.id2Addr(ldr.nid), Voter: true},
+		{ID: flrs[0].nid, Addr: c.id2Addr(flrs[0].nid), Voter: true},
+		{ID: 4, Addr: c.id2Addr(4), Voter: true},
+	}
+	m, err := ldr.ReconcileMembership(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	c.ensure(m.Wait(ctx))
+	if !waitForCondition(flrs[1].isClosed, c.commitTimeout, c.longTimeout) {
+		t.Fatalf("M%d is not shutdown after removal", flrs[1].nid)
+	}
+	if got := c.serveError(flrs[1]); got != ErrNodeRemoved {
+		t.Fatalf("M%d.serve=%v, want ErrNodeRemoved", flrs[1].nid, got)
+	}
+	checkMembers := func() {
+		t.Helper()
+		config := c.info(ldr).Configs.Latest
+		if len(config.Nodes) != len(desired) {
+			t.Fatalf("config: got %v, want %v", config, desired)
+		}
+		for _, d := range desired {
+			if n := config.Nodes[d.ID]; n.Voter != d.Voter || n.Addr != d.Addr || n.Action != None {
+				t.Fatalf("node: got %v, want %v", n, d)
+			}
+		}
+	}
+	checkMembers()
+
+	// demote flrs[0]
+	desired[1].Voter = false
+	c.ensure(m.SetDesired(desired))
+	c.ensure(m.Wait(ctx))
+	checkMembers()
+	if p := m.Progress(); !p.Active || !p.Converged || p.Pending != 0 {
+		t.Fatalf("progress: %v", p)
+	}
+
+	// invalid desired nodes
+	if err := m.SetDesired([]Node{{ID: 1, Addr: c.id2Addr(1)}}); err == nil {
+		t.Fatal("desired nodes without voter must be rejected")
+	}
+
+	// closed
+	m.Close()
+	if err := m.Wait(ctx); err != nil && err != ErrMembershipClosed {
+		t.Fatalf("wait: got %v, want nil or %v", err, ErrMembershipClosed)
+	}
+}
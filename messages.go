@@ -16,6 +16,7 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -30,6 +31,10 @@ const (
 	entryDirtyRead
 	entryNop
 	entryConfig
+	entryBulkBegin
+	entryBulkCommit
+	entryUpdateOnce
+	entryBatch
 )
 
 type entry struct {
@@ -37,11 +42,61 @@ type entry struct {
 	term  uint64
 	typ   entryType
 	data  []byte
+
+	// metadata, set by leader when it appends the entry.
+	// zero values mean entry has no metadata.
+	timestamp int64 // unix nanoseconds
+	leader    uint64
+
+	// client and seq identify entryUpdateOnce, and cacheSize is
+	// the number of results to be cached, see resultCache. they
+	// are encoded as the first 20 bytes of data.
+	client    uint64
+	seq       uint64
+	cacheSize uint32
+}
+
+// entryMeta flag in entryType byte tells that
+// timestamp and leader follow entryType.
+const entryMeta = 0x80
+
+func (t entryType) String() string {
+	switch t {
+	case entryBarrier:
+		return "barrier"
+	case entryUpdate:
+		return "update"
+	case entryRead:
+		return "read"
+	case entryDirtyRead:
+		return "dirtyRead"
+	case entryNop:
+		return "nop"
+	case entryConfig:
+		return "config"
+	case entryBulkBegin:
+		return "bulkBegin"
+	case entryBulkCommit:
+		return "bulkCommit"
+	case entryUpdateOnce:
+		return "updateOnce"
+	case entryBatch:
+		return "batch"
+	}
+	return fmt.Sprintf("entryType(%d)", uint8(t))
+}
+
+func (t entryType) isValid() bool {
+	return t >= entryBarrier && t <= entryBatch
+}
+
+func (e *entry) isUpdate() bool {
+	return e.typ == entryUpdate || e.typ == entryUpdateOnce || e.typ == entryBatch
 }
 
 func (e *entry) isLogEntry() bool {
 	switch e.typ {
-	case entryRead, entryDirtyRead, entryBarrier:
+	case entryRead, entryDirtyRead, entryBarrier, entryBulkBegin, entryBulkCommit:
 		return false
 	default:
 		return true
@@ -49,6 +104,13 @@ func (e *entry) isLogEntry() bool {
 }
 
 func (e *entry) decode(r io.Reader) error {
+	return e.decodeInto(r, nil)
+}
+
+// decodeInto is same as decode, but reuses buf for data, if
+// it has enough capacity. Caller must ensure, that data of
+// previous entry decoded with buf is no longer referenced.
+func (e *entry) decodeInto(r io.Reader, buf []byte) error {
 	var err error
 
 	if e.index, err = readUint64(r); err != nil {
@@ -61,39 +123,252 @@ func (e *entry) decode(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	e.typ = entryType(typ)
-	e.data, err = readBytes(r)
-	return err
+	e.typ = entryType(typ &^ entryMeta)
+	if !e.typ.isValid() {
+		return fmt.Errorf("raft: invalid entryType %d", typ)
+	}
+	e.timestamp, e.leader = 0, 0
+	if typ&entryMeta != 0 {
+		timestamp, err := readUint64(r)
+		if err != nil {
+			return err
+		}
+		e.timestamp = int64(timestamp)
+		if e.leader, err = readUint64(r); err != nil {
+			return err
+		}
+	}
+	if e.data, err = readBytesInto(r, buf); err != nil {
+		return err
+	}
+	e.client, e.seq, e.cacheSize = 0, 0, 0
+	if e.typ == entryUpdateOnce {
+		if len(e.data) < 20 {
+			return errors.New("raft: updateOnce entry without key")
+		}
+		e.client, e.seq = byteOrder.Uint64(e.data), byteOrder.Uint64(e.data[8:])
+		e.cacheSize = byteOrder.Uint32(e.data[16:])
+		e.data = e.data[20:]
+	}
+	return nil
+}
+
+func (e *entry) hasMeta() bool {
+	return e.timestamp != 0 || e.leader != 0
 }
 
 // tells whether entry is completely in buffer
 func isEntryBuffered(r *bufio.Reader) bool {
-	headerLen := 8 + 8 + 1 + 4 // index+term+typ+len(data)
+	headerLen := entryHeaderLen
 	buffered := r.Buffered()
 	if buffered < headerLen {
 		return false
 	}
 	b, err := r.Peek(headerLen)
 	assert(err == nil)
+	if rawEntry(b).hasMeta() {
+		headerLen = entryMetaHeaderLen
+		if buffered < headerLen {
+			return false
+		}
+		b, err = r.Peek(headerLen)
+		assert(err == nil)
+	}
 	dataLen := byteOrder.Uint32(b[headerLen-4:])
 	return buffered >= headerLen+int(dataLen)
 }
 
+// rawEntry is an encoded entry. Entries read from log reference
+// mmapped segment data, and are valid only until the log is truncated
+// or closed. They must be copied, if they are used beyond that.
+type rawEntry []byte
+
+const (
+	entryHeaderLen     = 8 + 8 + 1 + 4          // index+term+typ+len(data)
+	entryMetaHeaderLen = entryHeaderLen + 8 + 8 // +timestamp+leader
+)
+
+func (b rawEntry) index() uint64 { return byteOrder.Uint64(b) }
+func (b rawEntry) term() uint64  { return byteOrder.Uint64(b[8:]) }
+func (b rawEntry) hasMeta() bool { return b[16]&entryMeta != 0 }
+
+// nextEntry returns length of first entry in b, and length
+// of its header. b must have at least entryHeaderLen bytes.
+func nextEntry(b []byte) (n, headerLen int, err error) {
+	if len(b) < entryHeaderLen {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	headerLen = entryHeaderLen
+	if rawEntry(b).hasMeta() {
+		headerLen = entryMetaHeaderLen
+		if len(b) < headerLen {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+	}
+	n = headerLen + int(byteOrder.Uint32(b[headerLen-4:]))
+	if len(b) < n {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return n, headerLen, nil
+}
+
+func (b rawEntry) typ() entryType { return entryType(b[16] &^ entryMeta) }
+
+func (b rawEntry) timestamp() int64 {
+	if !b.hasMeta() {
+		return 0
+	}
+	return int64(byteOrder.Uint64(b[17:]))
+}
+
+// readRawEntry reads an encoded entry from r without decoding it.
+// buf is reused, if it has enough capacity.
+func readRawEntry(r io.Reader, buf []byte) (rawEntry, error) {
+	if cap(buf) < entryMetaHeaderLen {
+		buf = make([]byte, entryMetaHeaderLen, 256)
+	}
+	b := buf[:entryHeaderLen]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	headerLen := entryHeaderLen
+	if rawEntry(b).hasMeta() {
+		headerLen = entryMetaHeaderLen
+		b = buf[:headerLen]
+		if _, err := io.ReadFull(r, b[entryHeaderLen:]); err != nil {
+			return nil, err
+		}
+	}
+	size := byteOrder.Uint32(b[headerLen-4:])
+	if size > maxBytes {
+		return nil, fmt.Errorf("raft: length %d exceeds limit %d", size, maxBytes)
+	}
+	n := headerLen + int(size)
+	if n > cap(buf) {
+		if size > 64*1024 {
+			// large size: allocate as we read, rather than trusting size
+			w := bytes.NewBuffer(make([]byte, 0, headerLen+64*1024))
+			_, _ = w.Write(b)
+			m, err := io.Copy(w, io.LimitReader(r, int64(size)))
+			if err != nil {
+				return nil, err
+			}
+			if m != int64(size) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return w.Bytes(), nil
+		}
+		buf = append(make([]byte, 0, n), b...)
+	}
+	b = buf[:n]
+	if _, err := io.ReadFull(r, b[headerLen:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// encode writes header in single write, followed by data. it
+// does not allocate, so that entries can be written directly
+// to bufio.Writer of conn, or reused buffer of storage.
 func (e *entry) encode(w io.Writer) error {
-	if err := writeUint64(w, e.index); err != nil {
-		return err
+	b := getScratch()
+	defer putScratch(b)
+	byteOrder.PutUint64(b[0:], e.index)
+	byteOrder.PutUint64(b[8:], e.term)
+	n := 17
+	if e.hasMeta() {
+		b[16] = uint8(e.typ) | entryMeta
+		byteOrder.PutUint64(b[17:], uint64(e.timestamp))
+		byteOrder.PutUint64(b[25:], e.leader)
+		n = 33
+	} else {
+		b[16] = uint8(e.typ)
 	}
-	if err := writeUint64(w, e.term); err != nil {
-		return err
+	size := len(e.data)
+	if e.typ == entryUpdateOnce {
+		size += 20
+	}
+	byteOrder.PutUint32(b[n:], uint32(size))
+	n += 4
+	if e.typ == entryUpdateOnce {
+		byteOrder.PutUint64(b[n:], e.client)
+		byteOrder.PutUint64(b[n+8:], e.seq)
+		byteOrder.PutUint32(b[n+16:], e.cacheSize)
+		n += 20
 	}
-	if err := writeUint8(w, uint8(e.typ)); err != nil {
+	if _, err := w.Write(b[:n]); err != nil {
 		return err
 	}
-	return writeBytes(w, e.data)
+	_, err := w.Write(e.data)
+	return err
 }
 
 // ------------------------------------------------------
 
+// Protocol versions. Every request header carries the protocol version,
+// in which the request is encoded. The response is encoded in the same
+// version as its request. This allows nodes running different versions
+// to talk to each other, during rolling upgrades.
+//
+// When connection is established, client sends identityReq with the
+// highest version it supports. Server replies with the version to be
+// used for the connection, which is the highest version supported by
+// both. The format of identityReq and identityResp must never change.
+// The handshake also validates cluster id and node id, and server does
+// not serve any other request on the connection until it succeeds, so
+// that nodes of different clusters never talk to each other, when
+// addresses are reused across clusters.
+//
+// Compatibility matrix:
+//
+//     version  changes
+//     1        initial version
+//     2        appendReq.compressedSize, see Options.CompressEntries
+//     3        entry metadata, see LogEntry.Time
+//     4        ping frame, see Options.PingInterval
+//     5        updateOnce entry, see UpdateFSMOnce
+//     6        appendResp.time, see Options.MaxClockSkew
+//     7        batch entry, see ApplyCompositeBatch
+//     8        framed requests, see frameMagic
+//     9        auth handshake, see Options.PeerKey
+//     10       appendResp.conflictTerm and conflictIndex, see Raft.conflict
+//     11       voteResp log summary, see candidate.lostCause
+//     12       identityUpdate request, see Options.AdvertiseAddr
+//     13       appendResp.peers, see Options.PeerProbeInterval
+//     14       installSnapReq.results, see UpdateFSMOnce
+//
+// New fields must be encoded, only if the request version supports them.
+// Node must support the versions of all nodes in cluster, that it will
+// talk to. minProtocol is raised, only when no node runs older versions.
+const (
+	protocolV1 uint8 = iota + 1
+	protocolV2
+	protocolV3
+	protocolV4
+	protocolV5
+	protocolV6
+	protocolV7
+	protocolV8
+	protocolV9
+	protocolV10
+	protocolV11
+	protocolV12
+	protocolV13
+	protocolV14
+
+	minProtocol = protocolV1
+	maxProtocol = protocolV14
+)
+
+// negotiate returns the protocol version to be used, when
+// client supports protocol versions upto v.
+func negotiate(v uint8) uint8 {
+	if v > maxProtocol {
+		return maxProtocol
+	}
+	return v
+}
+
 type rpcType int
 
 const (
@@ -102,16 +377,66 @@ const (
 	rpcAppendEntries
 	rpcInstallSnap
 	rpcTimeoutNow
+	rpcSendSnap
+	rpcPing           // echoed back by server, without involving raft
+	rpcAuth           // handled by server, without involving raft
+	rpcIdentityUpdate // handled by server, see Options.AdvertiseAddr
 )
 
+func (t rpcType) String() string {
+	switch t {
+	case rpcIdentity:
+		return "identity"
+	case rpcVote:
+		return "vote"
+	case rpcAppendEntries:
+		return "append"
+	case rpcInstallSnap:
+		return "installSnap"
+	case rpcTimeoutNow:
+		return "timeoutNow"
+	case rpcSendSnap:
+		return "sendSnap"
+	case rpcPing:
+		return "ping"
+	case rpcAuth:
+		return "auth"
+	case rpcIdentityUpdate:
+		return "identityUpdate"
+	}
+	return fmt.Sprintf("rpcType(%d)", int(t))
+}
+
 func (t rpcType) isValid() bool {
 	switch t {
-	case rpcIdentity, rpcVote, rpcAppendEntries, rpcInstallSnap, rpcTimeoutNow:
+	case rpcIdentity, rpcVote, rpcAppendEntries, rpcInstallSnap, rpcTimeoutNow, rpcSendSnap, rpcAuth, rpcIdentityUpdate:
 		return true
 	}
 	return false
 }
 
+// rpcPriority is the class of request, which decides the order
+// in which pending requests are replied. Lower value is replied
+// first, so that elections are not delayed by replication.
+type rpcPriority uint8
+
+const (
+	priorityElection rpcPriority = iota // vote, timeoutNow
+	priorityAppend                      // identity, appendEntries
+	prioritySnapshot                    // installSnap
+	numPriorities
+)
+
+func (t rpcType) priority() rpcPriority {
+	switch t {
+	case rpcVote, rpcTimeoutNow:
+		return priorityElection
+	case rpcInstallSnap:
+		return prioritySnapshot
+	}
+	return priorityAppend
+}
+
 func (t rpcType) fromLeader() bool {
 	switch t {
 	case rpcAppendEntries, rpcInstallSnap, rpcTimeoutNow:
@@ -132,23 +457,31 @@ func (t rpcType) createReq() request {
 		return &installSnapReq{}
 	case rpcTimeoutNow:
 		return &timeoutNowReq{}
+	case rpcSendSnap:
+		return &sendSnapReq{}
+	case rpcAuth:
+		return &authReq{}
+	case rpcIdentityUpdate:
+		return &identityUpdateReq{}
 	}
 	panic(fmt.Errorf("raft.createReq(%d)", t))
 }
 
 func (t rpcType) createResp(r *Raft, result rpcResult, err error) response {
-	resp := resp{r.term, result, err}
+	resp := resp{term: r.term, result: result, err: err}
 	switch t {
 	case rpcIdentity:
 		return &identityResp{resp}
 	case rpcVote:
-		return &voteResp{resp}
+		return &voteResp{resp: resp, lastLogIndex: r.lastLogIndex, lastLogTerm: r.lastLogTerm, commitIndex: r.commitIndex}
 	case rpcAppendEntries:
-		return &appendResp{resp, r.lastLogIndex}
+		return &appendResp{resp: resp, lastLogIndex: r.lastLogIndex, time: r.clock.Now().UnixNano(), peers: r.reachablePeers}
 	case rpcInstallSnap:
 		return &installSnapResp{resp}
 	case rpcTimeoutNow:
 		return &timeoutNowResp{resp}
+	case rpcSendSnap:
+		return &sendSnapResp{resp: resp}
 	}
 	panic(fmt.Errorf("raft.createResp(%d)", t))
 }
@@ -167,10 +500,58 @@ const (
 	nonVoter
 	readErr
 	unexpectedErr
+	noSnapshot
+	versionMismatch
+	paused
+	authFailed
+	diskFull
+	notLeader
 )
 
+func (r rpcResult) String() string {
+	switch r {
+	case success:
+		return "success"
+	case identityMismatch:
+		return "identityMismatch"
+	case staleTerm:
+		return "staleTerm"
+	case alreadyVoted:
+		return "alreadyVoted"
+	case leaderKnown:
+		return "leaderKnown"
+	case logNotUptodate:
+		return "logNotUptodate"
+	case prevEntryNotFound:
+		return "prevEntryNotFound"
+	case prevTermMismatch:
+		return "prevTermMismatch"
+	case nonVoter:
+		return "nonVoter"
+	case readErr:
+		return "readErr"
+	case unexpectedErr:
+		return "unexpectedErr"
+	case noSnapshot:
+		return "noSnapshot"
+	case versionMismatch:
+		return "versionMismatch"
+	case paused:
+		return "paused"
+	case authFailed:
+		return "authFailed"
+	case diskFull:
+		return "diskFull"
+	case notLeader:
+		return "notLeader"
+	}
+	return fmt.Sprintf("rpcResult(%d)", r)
+}
+
 type message interface {
 	getTerm() uint64
+	getVersion() uint8
+	setVersion(v uint8)
 	decode(r io.Reader) error
 	encode(w io.Writer) error
 }
@@ -181,29 +562,66 @@ type request interface {
 	rpcType() rpcType
 	message
 	from() uint64
+	getTrace() []byte
+	setTrace(trace []byte)
 }
 
 type req struct {
-	term uint64
-	src  uint64
+	version uint8 // protocol version, set by conn.writeReq
+	term    uint64
+	src     uint64
+	trace   []byte // span context, see Tracer.Inject
 }
 
-func (req *req) getTerm() uint64 { return req.term }
-func (req *req) from() uint64    { return req.src }
+func (req *req) getTerm() uint64       { return req.term }
+func (req *req) getVersion() uint8     { return req.version }
+func (req *req) setVersion(v uint8)    { req.version = v }
+func (req *req) from() uint64          { return req.src }
+func (req *req) getTrace() []byte      { return req.trace }
+func (req *req) setTrace(trace []byte) { req.trace = trace }
 func (req *req) decode(r io.Reader) error {
+	if err := req.decodeHeader(r); err != nil {
+		return err
+	}
+	if req.version < minProtocol || req.version > maxProtocol {
+		return fmt.Errorf("raft: unsupported protocol version %d", req.version)
+	}
+	return nil
+}
+
+// decodeHeader does not check version, because
+// identityReq uses it to negotiate the version.
+func (req *req) decodeHeader(r io.Reader) error {
 	var err error
+	if req.version, err = readUint8(r); err != nil {
+		return err
+	}
 	if req.term, err = readUint64(r); err != nil {
 		return err
 	}
-	req.src, err = readUint64(r)
-	return err
+	if req.src, err = readUint64(r); err != nil {
+		return err
+	}
+	if req.trace, err = readBytes(r); err != nil {
+		return err
+	}
+	if len(req.trace) == 0 {
+		req.trace = nil
+	}
+	return nil
 }
 
 func (req *req) encode(w io.Writer) error {
+	if err := writeUint8(w, req.version); err != nil {
+		return err
+	}
 	if err := writeUint64(w, req.term); err != nil {
 		return err
 	}
-	return writeUint64(w, req.src)
+	if err := writeUint64(w, req.src); err != nil {
+		return err
+	}
+	return writeBytes(w, req.trace)
 }
 
 // ------------------------------------------------------
@@ -216,12 +634,15 @@ type response interface {
 }
 
 type resp struct {
-	term   uint64
-	result rpcResult
-	err    error
+	version uint8 // protocol version of request, not encoded
+	term    uint64
+	result  rpcResult
+	err     error
 }
 
 func (resp *resp) getTerm() uint64      { return resp.term }
+func (resp *resp) getVersion() uint8    { return resp.version }
+func (resp *resp) setVersion(v uint8)   { resp.version = v }
 func (resp *resp) getResult() rpcResult { return resp.result }
 func (resp *resp) getErr() error        { return resp.err }
 func (resp *resp) setErr(err error)     { resp.err = err }
@@ -281,6 +702,8 @@ func (resp *resp) encode(w io.Writer) error {
 
 // ------------------------------------------------------
 
+// identityReq is the first request on connection. its
+// header carries the highest version supported by client.
 type identityReq struct {
 	req // not used
 	cid uint64
@@ -291,7 +714,7 @@ func (req *identityReq) rpcType() rpcType { return rpcIdentity }
 
 func (req *identityReq) decode(r io.Reader) error {
 	var err error
-	if err = req.req.decode(r); err != nil {
+	if err = req.req.decodeHeader(r); err != nil {
 		return err
 	}
 	if req.cid, err = readUint64(r); err != nil {
@@ -313,10 +736,27 @@ func (req *identityReq) encode(w io.Writer) error {
 
 // ------------------------------------------------------
 
+// identityResp carries the negotiated version in resp.version
 type identityResp struct {
 	resp
 }
 
+func (resp *identityResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	resp.version, err = readUint8(r)
+	return err
+}
+
+func (resp *identityResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	return writeUint8(w, resp.version)
+}
+
 // ------------------------------------------------------
 
 type voteReq struct {
@@ -360,6 +800,46 @@ func (req *voteReq) encode(w io.Writer) error {
 
 type voteResp struct {
 	resp
+
+	// summary of voter's log, to diagnose lost elections.
+	// zero before protocolV11
+	lastLogIndex uint64
+	lastLogTerm  uint64
+	commitIndex  uint64
+}
+
+func (resp *voteResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	resp.lastLogIndex, resp.lastLogTerm, resp.commitIndex = 0, 0, 0
+	if resp.version >= protocolV11 {
+		if resp.lastLogIndex, err = readUint64(r); err != nil {
+			return err
+		}
+		if resp.lastLogTerm, err = readUint64(r); err != nil {
+			return err
+		}
+		resp.commitIndex, err = readUint64(r)
+	}
+	return err
+}
+
+func (resp *voteResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	if resp.version >= protocolV11 {
+		if err := writeUint64(w, resp.lastLogIndex); err != nil {
+			return err
+		}
+		if err := writeUint64(w, resp.lastLogTerm); err != nil {
+			return err
+		}
+		return writeUint64(w, resp.commitIndex)
+	}
+	return nil
 }
 
 // ------------------------------------------------------
@@ -370,6 +850,10 @@ type appendReq struct {
 	prevLogTerm    uint64
 	ldrCommitIndex uint64
 	numEntries     uint64
+
+	// if non-zero, entries follow as snappy compressed
+	// block of this size, rather than one after other
+	compressedSize uint32
 }
 
 func (req *appendReq) rpcType() rpcType { return rpcAppendEntries }
@@ -388,7 +872,12 @@ func (req *appendReq) decode(r io.Reader) error {
 	if req.ldrCommitIndex, err = readUint64(r); err != nil {
 		return err
 	}
-	req.numEntries, err = readUint64(r)
+	if req.numEntries, err = readUint64(r); err != nil {
+		return err
+	}
+	if req.version >= protocolV2 {
+		req.compressedSize, err = readUint32(r)
+	}
 	return err
 }
 
@@ -405,7 +894,13 @@ func (req *appendReq) encode(w io.Writer) error {
 	if err := writeUint64(w, req.ldrCommitIndex); err != nil {
 		return err
 	}
-	return writeUint64(w, req.numEntries)
+	if err := writeUint64(w, req.numEntries); err != nil {
+		return err
+	}
+	if req.version >= protocolV2 {
+		return writeUint32(w, req.compressedSize)
+	}
+	return nil
 }
 
 // ------------------------------------------------------
@@ -413,6 +908,16 @@ func (req *appendReq) encode(w io.Writer) error {
 type appendResp struct {
 	resp
 	lastLogIndex uint64
+	time         int64 // clock of follower in unix nanoseconds, zero before protocolV6
+
+	// on prevTermMismatch, the conflicting term and its first index
+	// in follower's log. zero before protocolV10
+	conflictTerm  uint64
+	conflictIndex uint64
+
+	// other nodes reachable by follower, see Raft.probePeers.
+	// nil before protocolV13
+	peers []uint64
 }
 
 func (resp *appendResp) decode(r io.Reader) error {
@@ -420,15 +925,74 @@ func (resp *appendResp) decode(r io.Reader) error {
 	if err = resp.resp.decode(r); err != nil {
 		return err
 	}
-	resp.lastLogIndex, err = readUint64(r)
-	return err
+	if resp.lastLogIndex, err = readUint64(r); err != nil {
+		return err
+	}
+	resp.time = 0
+	if resp.version >= protocolV6 {
+		var time uint64
+		if time, err = readUint64(r); err != nil {
+			return err
+		}
+		resp.time = int64(time)
+	}
+	resp.conflictTerm, resp.conflictIndex = 0, 0
+	if resp.version >= protocolV10 {
+		if resp.conflictTerm, err = readUint64(r); err != nil {
+			return err
+		}
+		if resp.conflictIndex, err = readUint64(r); err != nil {
+			return err
+		}
+	}
+	resp.peers = nil
+	if resp.version >= protocolV13 {
+		var n uint32
+		if n, err = readUint32(r); err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			var id uint64
+			if id, err = readUint64(r); err != nil {
+				return err
+			}
+			resp.peers = append(resp.peers, id)
+		}
+	}
+	return nil
 }
 
 func (resp *appendResp) encode(w io.Writer) error {
 	if err := resp.resp.encode(w); err != nil {
 		return err
 	}
-	return writeUint64(w, resp.lastLogIndex)
+	if err := writeUint64(w, resp.lastLogIndex); err != nil {
+		return err
+	}
+	if resp.version >= protocolV6 {
+		if err := writeUint64(w, uint64(resp.time)); err != nil {
+			return err
+		}
+	}
+	if resp.version >= protocolV10 {
+		if err := writeUint64(w, resp.conflictTerm); err != nil {
+			return err
+		}
+		if err := writeUint64(w, resp.conflictIndex); err != nil {
+			return err
+		}
+	}
+	if resp.version >= protocolV13 {
+		if err := writeUint32(w, uint32(len(resp.peers))); err != nil {
+			return err
+		}
+		for _, id := range resp.peers {
+			if err := writeUint64(w, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // ------------------------------------------------------
@@ -439,6 +1003,10 @@ type installSnapReq struct {
 	lastTerm   uint64 // term of lastIndex
 	lastConfig Config // last config in the snapshot
 	size       int64  // size of the snapshot
+
+	// keys of updateOnce entries cached at lastIndex,
+	// see resultCache. nil before protocolV14
+	results []resultKey
 }
 
 func (req *installSnapReq) rpcType() rpcType { return rpcInstallSnap }
@@ -468,6 +1036,12 @@ func (req *installSnapReq) decode(r io.Reader) error {
 		return err
 	}
 	req.size = int64(size)
+	req.results = nil
+	if req.version >= protocolV14 {
+		if req.results, err = readResultKeys(r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -485,7 +1059,13 @@ func (req *installSnapReq) encode(w io.Writer) error {
 	if err := e.encode(w); err != nil {
 		return err
 	}
-	return writeUint64(w, uint64(req.size))
+	if err := writeUint64(w, uint64(req.size)); err != nil {
+		return err
+	}
+	if req.version >= protocolV14 {
+		return writeResultKeys(w, req.results)
+	}
+	return nil
 }
 
 // ------------------------------------------------------
@@ -507,3 +1087,179 @@ func (req *timeoutNowReq) rpcType() rpcType { return rpcTimeoutNow }
 type timeoutNowResp struct {
 	resp
 }
+
+// ------------------------------------------------------
+
+// sendSnapReq is sent by leader to a follower, asking it to
+// send its latest snapshot to target node on behalf of leader.
+type sendSnapReq struct {
+	req
+	target   uint64 // node to which snapshot to be sent
+	minIndex uint64 // snapshot index must be >= minIndex
+}
+
+func (req *sendSnapReq) rpcType() rpcType { return rpcSendSnap }
+
+func (req *sendSnapReq) decode(r io.Reader) error {
+	var err error
+	if err = req.req.decode(r); err != nil {
+		return err
+	}
+	if req.target, err = readUint64(r); err != nil {
+		return err
+	}
+	req.minIndex, err = readUint64(r)
+	return err
+}
+
+func (req *sendSnapReq) encode(w io.Writer) error {
+	if err := req.req.encode(w); err != nil {
+		return err
+	}
+	if err := writeUint64(w, req.target); err != nil {
+		return err
+	}
+	return writeUint64(w, req.minIndex)
+}
+
+// ------------------------------------------------------
+
+type sendSnapResp struct {
+	resp
+	lastIndex uint64 // last index in the snapshot sent
+}
+
+func (resp *sendSnapResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	resp.lastIndex, err = readUint64(r)
+	return err
+}
+
+func (resp *sendSnapResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	return writeUint64(w, resp.lastIndex)
+}
+
+// ------------------------------------------------------
+
+// authReq is sent twice after identity handshake, if peer
+// authentication is enabled. First carries client nonce, and
+// second carries client mac. see Options.PeerKey
+type authReq struct {
+	req
+	nonce []byte
+	mac   []byte
+}
+
+func (req *authReq) rpcType() rpcType { return rpcAuth }
+
+func (req *authReq) decode(r io.Reader) error {
+	var err error
+	if err = req.req.decode(r); err != nil {
+		return err
+	}
+	if req.nonce, err = readBytes(r); err != nil {
+		return err
+	}
+	req.mac, err = readBytes(r)
+	return err
+}
+
+func (req *authReq) encode(w io.Writer) error {
+	if err := req.req.encode(w); err != nil {
+		return err
+	}
+	if err := writeBytes(w, req.nonce); err != nil {
+		return err
+	}
+	return writeBytes(w, req.mac)
+}
+
+// ------------------------------------------------------
+
+// authResp carries server nonce and server mac,
+// in reply to first authReq.
+type authResp struct {
+	resp
+	nonce []byte
+	mac   []byte
+}
+
+func (resp *authResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	if resp.nonce, err = readBytes(r); err != nil {
+		return err
+	}
+	resp.mac, err = readBytes(r)
+	return err
+}
+
+func (resp *authResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	if err := writeBytes(w, resp.nonce); err != nil {
+		return err
+	}
+	return writeBytes(w, resp.mac)
+}
+
+// ------------------------------------------------------
+
+// identityUpdateReq is sent by a node to leader, asking it to update
+// the node's address in config to addr. see Options.AdvertiseAddr
+type identityUpdateReq struct {
+	req
+	addr string
+}
+
+func (req *identityUpdateReq) rpcType() rpcType { return rpcIdentityUpdate }
+
+func (req *identityUpdateReq) decode(r io.Reader) error {
+	var err error
+	if err = req.req.decode(r); err != nil {
+		return err
+	}
+	req.addr, err = readString(r)
+	return err
+}
+
+func (req *identityUpdateReq) encode(w io.Writer) error {
+	if err := req.req.encode(w); err != nil {
+		return err
+	}
+	return writeString(w, req.addr)
+}
+
+// ------------------------------------------------------
+
+// identityUpdateResp carries the leader known to the node, if
+// it is not leader.
+type identityUpdateResp struct {
+	resp
+	leader uint64
+}
+
+func (resp *identityUpdateResp) decode(r io.Reader) error {
+	var err error
+	if err = resp.resp.decode(r); err != nil {
+		return err
+	}
+	resp.leader, err = readUint64(r)
+	return err
+}
+
+func (resp *identityUpdateResp) encode(w io.Writer) error {
+	if err := resp.resp.encode(w); err != nil {
+		return err
+	}
+	return writeUint64(w, resp.leader)
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+// messages from network must not panic or allocate
+// more than what is received.
+func FuzzRequest(f *testing.F) {
+	for _, req := range []request{
+		&identityReq{req: req{src: 1}, cid: 2, nid: 3},
+		&voteReq{req: req{term: 5, src: 2}, lastLogIndex: 3, lastLogTerm: 5, transfer: true},
+		&appendReq{req: req{term: 5, src: 2, trace: []byte("span")}, prevLogIndex: 3, prevLogTerm: 5, numEntries: 10},
+		&installSnapReq{req: req{term: 5, src: 1}, lastIndex: 3, lastTerm: 5, lastConfig: Config{
+			Nodes: map[uint64]Node{1: {ID: 1, Addr: "localhost:7000", Voter: true}},
+		}},
+		&timeoutNowReq{req{term: 5, src: 3}},
+		&sendSnapReq{req: req{term: 5, src: 1}, target: 4, minIndex: 10},
+		&authReq{req: req{src: 1}, nonce: []byte("nonce"), mac: []byte("mac")},
+	} {
+		req.setVersion(maxProtocol)
+		b := new(bytes.Buffer)
+		_ = writeUint8(b, uint8(req.rpcType()))
+		_ = req.encode(b)
+		f.Add(b.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) == 0 || !rpcType(b[0]).isValid() {
+			return
+		}
+		req := rpcType(b[0]).createReq()
+		if err := req.decode(bytes.NewReader(b[1:])); err != nil {
+			return
+		}
+		// must survive encode/decode
+		buf := new(bytes.Buffer)
+		if err := req.encode(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := rpcType(b[0]).createReq().decode(buf); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzEntry(f *testing.F) {
+	for _, e := range []*entry{
+		{index: 3, term: 5, typ: entryUpdate, data: []byte("sleep")},
+		Config{Nodes: map[uint64]Node{1: {ID: 1, Addr: "localhost:7000", Voter: true}}}.encode(),
+	} {
+		b := new(bytes.Buffer)
+		_ = e.encode(b)
+		f.Add(b.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		e := &entry{}
+		if err := e.decode(bytes.NewReader(b)); err != nil {
+			return
+		}
+		if !e.typ.isValid() {
+			t.Fatalf("invalid type %d decoded", e.typ)
+		}
+		if e.typ == entryConfig {
+			c := Config{}
+			_ = c.decode(e)
+		}
+	})
+}
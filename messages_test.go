@@ -15,10 +15,13 @@
 package raft
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"testing"
 )
@@ -37,35 +40,88 @@ func TestMessage(t *testing.T) {
 	snapshot := "helloworld"
 	tests := []message{
 		&entry{index: 3, term: 5, typ: 2, data: []byte("sleep")},
+		&entry{index: 3, term: 5, typ: 2, data: []byte("sleep"), timestamp: 1234, leader: 2},
 		&voteReq{req: req{term: 5, src: 2}, lastLogIndex: 3, lastLogTerm: 5, transfer: true},
-		&voteResp{resp{term: 5, result: success}},
-		&voteResp{resp{term: 5, result: alreadyVoted}},
+		&voteResp{resp: resp{term: 5, result: success}, lastLogIndex: 9, lastLogTerm: 4, commitIndex: 7},
+		&voteResp{resp: resp{term: 5, result: alreadyVoted}},
+		&voteResp{resp: resp{version: protocolV10, term: 5, result: logNotUptodate}},
 		&appendReq{
 			req: req{term: 5, src: 2}, prevLogIndex: 3, prevLogTerm: 5, numEntries: 10, ldrCommitIndex: 56,
 		},
-		&appendResp{resp: resp{term: 5, result: success}, lastLogIndex: 9},
+		&appendReq{
+			req: req{term: 5, src: 2, trace: []byte("span")}, prevLogIndex: 3, prevLogTerm: 5, numEntries: 10, ldrCommitIndex: 56,
+		},
+		&appendReq{
+			req: req{term: 5, src: 2}, prevLogIndex: 3, prevLogTerm: 5, numEntries: 10, compressedSize: 1024,
+		},
+		&appendReq{
+			req: req{version: protocolV1, term: 5, src: 2}, prevLogIndex: 3, prevLogTerm: 5, numEntries: 10,
+		},
+		&appendResp{resp: resp{term: 5, result: success}, lastLogIndex: 9, time: 1234},
+		&appendResp{resp: resp{version: protocolV5, term: 5, result: success}, lastLogIndex: 9},
+		&appendResp{resp: resp{term: 5, result: prevTermMismatch}, lastLogIndex: 9, time: 1234, conflictTerm: 4, conflictIndex: 6},
+		&appendResp{resp: resp{version: protocolV9, term: 5, result: prevTermMismatch}, lastLogIndex: 9, time: 1234},
+		&appendResp{resp: resp{term: 5, result: success}, lastLogIndex: 9, time: 1234, peers: []uint64{3, 4}},
+		&appendResp{resp: resp{version: protocolV12, term: 5, result: success}, lastLogIndex: 9, time: 1234},
+		&installSnapReq{
+			req: req{term: 5, src: 1}, lastIndex: 3, lastTerm: 5,
+			lastConfig: Config{
+				Nodes: nodes,
+				Index: 1, Term: 2,
+			}, size: int64(len(snapshot)),
+		},
 		&installSnapReq{
 			req: req{term: 5, src: 1}, lastIndex: 3, lastTerm: 5,
 			lastConfig: Config{
 				Nodes: nodes,
 				Index: 1, Term: 2,
 			}, size: int64(len(snapshot)),
+			results: []resultKey{{7, 1}, {7, 2}},
+		},
+		&installSnapReq{
+			req: req{version: protocolV13, term: 5, src: 1}, lastIndex: 3, lastTerm: 5,
+			lastConfig: Config{
+				Nodes: nodes,
+				Index: 1, Term: 2,
+			}, size: int64(len(snapshot)),
 		},
 		&installSnapResp{resp{term: 5, result: success}},
 		&installSnapResp{resp{term: 5, result: unexpectedErr, err: errors.New("notOpErr")}},
 		&installSnapResp{resp{term: 5, result: unexpectedErr, err: OpError{"myop", errors.New("notOpErr")}}},
+		&identityReq{req: req{version: maxProtocol + 1, src: 1}, cid: 2, nid: 3},
+		&identityResp{resp{version: protocolV1, term: 5, result: success}},
 		&timeoutNowReq{req{term: 5, src: 3}},
 		&timeoutNowResp{resp{term: 5, result: success}},
+		&sendSnapReq{req: req{term: 5, src: 1}, target: 4, minIndex: 10},
+		&sendSnapResp{resp: resp{term: 5, result: success}, lastIndex: 12},
+		&sendSnapResp{resp: resp{term: 5, result: noSnapshot}},
+		&authReq{req: req{src: 1}, nonce: []byte("nonce")},
+		&authReq{req: req{src: 1}, mac: []byte("mac")},
+		&authResp{resp: resp{result: success}, nonce: []byte("nonce"), mac: []byte("mac")},
+		&authResp{resp: resp{result: authFailed}},
+		&identityUpdateReq{req: req{term: 5, src: 1}, addr: "localhost:7000"},
+		&identityUpdateResp{resp: resp{term: 5, result: notLeader}, leader: 2},
+		&identityUpdateResp{resp: resp{term: 5, result: unexpectedErr, err: errors.New("precheck failed")}},
 	}
 	for _, test := range tests {
 		name := fmt.Sprintf("%T", test)
 		t.Run(name, func(t *testing.T) {
+			if req, ok := test.(request); ok && req.getVersion() == 0 {
+				req.setVersion(maxProtocol)
+			}
+			if resp, ok := test.(response); ok && resp.getVersion() == 0 {
+				resp.setVersion(maxProtocol)
+			}
 			b := new(bytes.Buffer)
 			if err := test.encode(b); err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
 			typ := reflect.TypeOf(test).Elem()
 			cmd := reflect.New(typ).Interface().(message)
+			if resp, ok := cmd.(response); ok {
+				// response version is not encoded, but known from request
+				resp.setVersion(test.(response).getVersion())
+			}
 			if err := cmd.decode(b); err != nil {
 				t.Fatalf("decode failed: %v", err)
 			}
@@ -107,3 +163,280 @@ func TestMessage(t *testing.T) {
 		})
 	}
 }
+
+// fields not supported by request version, must not be sent
+func TestMessage_version(t *testing.T) {
+	req := &appendReq{req: req{version: protocolV1, term: 5, src: 2}, numEntries: 10, compressedSize: 1024}
+	b := new(bytes.Buffer)
+	if err := req.encode(b); err != nil {
+		t.Fatal(err)
+	}
+	got := &appendReq{}
+	if err := got.decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.compressedSize != 0 {
+		t.Fatalf("compressedSize: got %d, want 0", got.compressedSize)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("bytes left. got %d, want %d", b.Len(), 0)
+	}
+
+	// unsupported versions must be rejected
+	for _, v := range []uint8{0, minProtocol - 1, maxProtocol + 1} {
+		if v >= minProtocol && v <= maxProtocol {
+			continue
+		}
+		req.version = v
+		b.Reset()
+		if err := req.encode(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := got.decode(b); err == nil {
+			t.Fatalf("version %d: error expected", v)
+		}
+	}
+}
+
+// entry metadata must not be sent to nodes, that
+// do not support protocolV3
+func TestMessage_stripEntryMeta(t *testing.T) {
+	entries := []*entry{
+		{index: 3, term: 5, typ: entryUpdate, data: []byte("sleep"), timestamp: 1234, leader: 2},
+		{index: 4, term: 5, typ: entryNop},
+		{index: 5, term: 5, typ: entryUpdate, data: []byte("wakeup"), timestamp: 5678, leader: 2},
+	}
+	var buffs net.Buffers
+	for _, e := range entries {
+		b := new(bytes.Buffer)
+		if err := e.encode(b); err != nil {
+			t.Fatal(err)
+		}
+		// entry with metadata must be buffered only when complete
+		bufr := bufio.NewReader(bytes.NewReader(b.Bytes()[:b.Len()-1]))
+		_, _ = bufr.Peek(b.Len())
+		if isEntryBuffered(bufr) {
+			t.Fatalf("entry %d must not be buffered", e.index)
+		}
+		bufr = bufio.NewReader(bytes.NewReader(b.Bytes()))
+		_, _ = bufr.Peek(b.Len())
+		if !isEntryBuffered(bufr) {
+			t.Fatalf("entry %d must be buffered", e.index)
+		}
+		buffs = append(buffs, b.Bytes())
+	}
+	r := bytes.NewReader(bytes.Join(stripEntryMeta(buffs), nil))
+	for _, want := range entries {
+		got := &entry{}
+		if err := got.decode(r); err != nil {
+			t.Fatal(err)
+		}
+		if got.hasMeta() {
+			t.Fatalf("entry %d: metadata is not stripped", got.index)
+		}
+		if got.index != want.index || got.typ != want.typ || !bytes.Equal(got.data, want.data) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("bytes left. got %d, want %d", r.Len(), 0)
+	}
+}
+
+// updateOnce entries cannot be sent to nodes
+// that do not support protocolV5
+func TestMessage_updateOnceEntry(t *testing.T) {
+	entries := []*entry{
+		{index: 3, term: 5, typ: entryUpdateOnce, data: []byte("sleep"), timestamp: 1234, leader: 2, client: 7, seq: 1, cacheSize: 10},
+		{index: 4, term: 5, typ: entryUpdate, data: []byte("eat")},
+		{index: 5, term: 5, typ: entryUpdateOnce, data: []byte("wakeup"), client: 7, seq: 2},
+	}
+	b := new(bytes.Buffer)
+	for _, e := range entries {
+		if err := e.encode(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bytes.NewReader(b.Bytes())
+	for _, want := range entries {
+		got := &entry{}
+		if err := got.decode(r); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	}
+	if err := checkEntries(net.Buffers{b.Bytes()}, protocolV4); err == nil {
+		t.Fatal("error expected for protocolV4")
+	}
+	if err := checkEntries(net.Buffers{b.Bytes()}, protocolV5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// batch entries cannot be sent to nodes
+// that do not support protocolV7
+func TestMessage_batchEntry(t *testing.T) {
+	cmds := [][]byte{[]byte("sleep"), {}, []byte("wakeup")}
+	got, err := decodeBatch(encodeBatch(cmds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(cmds) {
+		t.Fatalf("len(cmds): got %d, want %d", len(got), len(cmds))
+	}
+	for i := range cmds {
+		if !bytes.Equal(got[i], cmds[i]) {
+			t.Fatalf("cmds[%d]: got %q, want %q", i, got[i], cmds[i])
+		}
+	}
+	if _, err := decodeBatch([]byte{0, 0, 0, 9}); err == nil {
+		t.Fatal("error expected for truncated batch")
+	}
+
+	b := new(bytes.Buffer)
+	for _, e := range []*entry{
+		{index: 3, term: 5, typ: entryUpdate, data: []byte("eat")},
+		{index: 4, term: 5, typ: entryBatch, data: encodeBatch(cmds)},
+	} {
+		if err := e.encode(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkEntries(net.Buffers{b.Bytes()}, protocolV6); err == nil {
+		t.Fatal("error expected for protocolV6")
+	}
+	if err := checkEntries(net.Buffers{b.Bytes()[:24]}, protocolV6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMessage_rawEntry(t *testing.T) {
+	entries := []*entry{
+		{index: 3, term: 5, typ: entryUpdate, data: []byte("sleep"), timestamp: 1234, leader: 2},
+		{index: 4, term: 5, typ: entryNop},
+		{index: 5, term: 6, typ: entryUpdate, data: bytes.Repeat([]byte("x"), 100*1024)},
+	}
+	w := new(bytes.Buffer)
+	for _, e := range entries {
+		if err := e.encode(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := w.Bytes()
+
+	// raw entries must be same as encoded
+	r := bytes.NewReader(b)
+	var buf []byte
+	off := 0
+	for _, e := range entries {
+		raw, err := readRawEntry(r, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = raw
+		n, _, err := nextEntry(b[off:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, b[off:off+n]) {
+			t.Fatalf("entry %d: raw bytes mismatch", e.index)
+		}
+		if raw.index() != e.index || raw.term() != e.term || raw.typ() != e.typ || raw.timestamp() != e.timestamp {
+			t.Fatalf("entry %d: got {%d %d %v %d}", e.index, raw.index(), raw.term(), raw.typ(), raw.timestamp())
+		}
+		off += n
+	}
+	if _, err := readRawEntry(r, buf); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if _, _, err := nextEntry(b[:len(b)-1][off-len(entries[2].data)-21:]); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated entry: got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	// entries without metadata must not be copied
+	stripped := stripEntryMeta(net.Buffers{b})
+	if len(stripped) != 3 {
+		t.Fatalf("stripped buffers: got %d, want 3", len(stripped))
+	}
+	if &stripped[2][0] != &b[entryMetaHeaderLen+len(entries[0].data)] {
+		t.Fatal("entries without metadata must reference original buffer")
+	}
+}
+
+func TestEntry_noAlloc(t *testing.T) {
+	if race {
+		t.Skip("race detector allocates")
+	}
+	e := &entry{index: 5, term: 3, typ: entryUpdate, data: []byte("hello"), timestamp: 7, leader: 2}
+	w := bufio.NewWriter(ioutil.Discard)
+	if n := testing.AllocsPerRun(100, func() { _ = e.encode(w) }); n != 0 {
+		t.Fatalf("encode allocs: got %v, want 0", n)
+	}
+
+	buf := new(bytes.Buffer)
+	_ = e.encode(buf)
+	r := bytes.NewReader(buf.Bytes())
+	ne := &entry{data: make([]byte, 0, 64)}
+	n := testing.AllocsPerRun(100, func() {
+		r.Reset(buf.Bytes())
+		if err := ne.decodeInto(r, ne.data); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n != 0 {
+		t.Fatalf("decodeInto allocs: got %v, want 0", n)
+	}
+	if !reflect.DeepEqual(ne, e) {
+		t.Fatalf("decodeInto: got %#v, want %#v", ne, e)
+	}
+}
+
+func BenchmarkEntry_encode(b *testing.B) {
+	e := &entry{index: 5, term: 3, typ: entryUpdate, data: make([]byte, 256), timestamp: 7, leader: 2}
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = e.encode(w)
+	}
+}
+
+func BenchmarkEntry_decodeInto(b *testing.B) {
+	buf := new(bytes.Buffer)
+	_ = (&entry{index: 5, term: 3, typ: entryUpdate, data: make([]byte, 256)}).encode(buf)
+	r := bytes.NewReader(buf.Bytes())
+	e := &entry{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf.Bytes())
+		_ = e.decodeInto(r, e.data)
+	}
+}
+
+func TestMessage_malformed(t *testing.T) {
+	header := func(typ entryType, dataLen uint32) []byte {
+		b := new(bytes.Buffer)
+		_ = writeUint64(b, 3)
+		_ = writeUint64(b, 5)
+		_ = writeUint8(b, uint8(typ))
+		_ = writeUint32(b, dataLen)
+		return b.Bytes()
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"invalidType", header(entryBulkCommit+1, 0)},
+		{"hugeData", header(entryUpdate, 1<<31)},
+		{"truncatedData", append(header(entryUpdate, 100*1024), "short"...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &entry{}
+			if err := e.decode(bytes.NewReader(test.b)); err == nil {
+				t.Fatal("error expected")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+)
+
+// Migrate copies the state in storageDir src into empty storageDir dst,
+// so that storage options which cannot be changed in place, such as
+// Options.EncryptionKeys or Options.LogSegmentSize, can be changed without
+// rebuilding the node from its peers. srcOpt and dstOpt are used to open
+// src and dst respectively. Neither must be in use by raft.
+//
+// src is verified as in VerifyStorage. Then identity, term, latest snapshot
+// and log entries after it are copied to dst. Finally dst is read back, and
+// its identity, term, configs and checksum of snapshot and log entries are
+// checked against src. On failure, dst must be emptied before retrying.
+func Migrate(srcOpt Options, src string, dstOpt Options, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return errors.New("raft.migrate: src and dst are same")
+	}
+	if err := VerifyStorage(srcOpt, src); err != nil {
+		return err
+	}
+
+	// copy ----------------
+	var want storageSummary
+	err := withStorage(srcOpt, src, func(s *storage) error {
+		pr, pw := io.Pipe()
+		sum := crc32.NewIEEE()
+		errCh := make(chan error, 1)
+		go func() {
+			bufw := bufio.NewWriter(io.MultiWriter(pw, sum))
+			err := s.backup(bufw)
+			if err == nil {
+				err = bufw.Flush()
+			}
+			_ = pw.CloseWithError(err)
+			errCh <- err
+		}()
+		err := Restore(dstOpt, dst, pr)
+		_ = pr.CloseWithError(errors.New("raft.migrate: restore ended"))
+		if werr := <-errCh; err == nil {
+			err = werr
+		}
+		want = s.summary(sum.Sum32())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// validate ----------------
+	var got storageSummary
+	err = withStorage(dstOpt, dst, func(s *storage) error {
+		sum := crc32.NewIEEE()
+		bufw := bufio.NewWriter(sum)
+		if err := s.backup(bufw); err != nil {
+			return err
+		}
+		if err := bufw.Flush(); err != nil {
+			return err
+		}
+		got = s.summary(sum.Sum32())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("raft.migrate: got %+v, want %+v", got, want)
+	}
+	return VerifyStorage(dstOpt, dst)
+}
+
+// storageSummary is used by Migrate to compare storages.
+type storageSummary struct {
+	cid, nid                  uint64
+	term, votedFor            uint64
+	snapIndex, snapTerm       uint64
+	lastLogIndex, lastLogTerm uint64
+	latest, committed         uint64 // index of configs
+	checksum                  uint32 // of backup stream
+}
+
+func (s *storage) summary(checksum uint32) storageSummary {
+	return storageSummary{
+		cid: s.cid, nid: s.nid,
+		term: s.term, votedFor: s.votedFor,
+		snapIndex: s.snaps.index, snapTerm: s.snaps.term,
+		lastLogIndex: s.lastLogIndex, lastLogTerm: s.lastLogTerm,
+		latest: s.configs.Latest.Index, committed: s.configs.Committed.Index,
+		checksum: checksum,
+	}
+}
+
+// backup writes backup stream of storage, with all entries in log
+// after latest snapshot. It is used only when storage is offline.
+func (s *storage) backup(w io.Writer) error {
+	var snap *snapshot
+	if s.snaps.index > 0 {
+		sn, err := s.snaps.open()
+		if err != nil {
+			return opError(err, "snapshots.open")
+		}
+		defer sn.release()
+		snap = sn
+	}
+	from := s.log.PrevIndex() + 1
+	if s.snaps.index >= from {
+		from = s.snaps.index + 1
+	}
+	reader, err := s.log.NewReader(from, s.log.LastIndex())
+	if err != nil {
+		return opError(err, "Log.NewReader(%d, %d)", from, s.log.LastIndex())
+	}
+	defer reader.Close()
+	return writeBackup(w, s.cid, s.nid, s.term, s.votedFor, s.vars.clone(), snap, reader)
+}
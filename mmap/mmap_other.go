@@ -0,0 +1,41 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!solaris,!netbsd,!windows
+
+package mmap
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported is returned by OpenFile, on
+// platforms that do not support mmap.
+var ErrUnsupported = errors.New("mmap: not supported on this platform")
+
+func openFile(file *os.File, flag int, size int) (*File, error) {
+	_ = file.Close()
+	return nil, ErrUnsupported
+}
+
+// Sync commits the current contents of the file to stable storage.
+func (f *File) Sync() error {
+	return ErrUnsupported
+}
+
+// Close closes the File, rendering it unusable for I/O.
+func (f *File) Close() error {
+	return ErrUnsupported
+}
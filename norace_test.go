@@ -12,12 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build !trace
+//go:build !race
+// +build !race
 
 package raft
 
-const (
-	trace = false
-)
-
-func println(args ...interface{}) {}
+const race = false
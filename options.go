@@ -17,6 +17,8 @@ package raft
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,40 +31,324 @@ import (
 type Options struct {
 	HeartbeatTimeout time.Duration
 
+	// ElectionTimeoutMin and ElectionTimeoutMax are the bounds of election
+	// timeout. Each time follower waits for leader, or candidate waits for
+	// votes, the timeout is chosen randomly in range [min, max). This avoids
+	// split votes. Zero values mean HeartbeatTimeout and
+	// ElectionTimeoutFactor*ElectionTimeoutMin. ElectionTimeoutMin must
+	// not be less than HeartbeatTimeout, because leader lease relies on it.
+	// The chosen timeouts are reported in Info.ElectionTimeout.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// ElectionTimeoutFactor widens the range, from which election timeout
+	// is chosen, when ElectionTimeoutMax is zero. Increase it if elections
+	// repeatedly end with split votes. Zero value means 2. Must be greater
+	// than 1.
+	ElectionTimeoutFactor float64
+
+	// MaxClockSkew is the maximum difference in clocks of nodes, that
+	// leader lease tolerates. Lease is shortened by this duration. The
+	// leader measures clock skew of followers from their responses, and
+	// warns when it exceeds this bound, because lease is unsafe then.
+	// Zero value disables the warning. Must be less than HeartbeatTimeout.
+	MaxClockSkew time.Duration
+
 	// PromoteThreshold determines the minimum round duration required
-	// for promoting a nonvoter.
+	// for promoting a nonvoter. It is used only if PromotionPolicy is
+	// nil, or returns nil for the nonvoter.
 	PromoteThreshold time.Duration
 
+	// PromotionPolicy, if not nil, is called with each nonvoter that
+	// is flagged to be promoted. The PromotionPolicy returned decides
+	// when that nonvoter actually becomes voter. Use Node.Data to
+	// override the policy for specific nodes.
+	PromotionPolicy func(n Node) PromotionPolicy
+
 	// SnapshotInterval determines how often snapshot is taken.
 	// The actual interval is staggered between this value and 2x of this value,
 	// to avoid entire cluster from performing snapshot at same time.
 	//
-	// Zero value means don't take any snapshots automatically.
+	// Zero value means don't take snapshots periodically.
 	SnapshotInterval time.Duration
 
 	// SnapshotThreshold determines minimum number of log entries since recent
-	// snapshot, in order to take snapshot.
+	// snapshot, in order to take snapshot. Snapshot is taken as soon as these
+	// many entries are committed, without waiting for SnapshotInterval.
 	//
-	// This is to avoid taking snapshot, for just few additional entries.
+	// Snapshots are taken in background, fsm continues to apply entries
+	// while fsm state is persisted. Zero value means don't take snapshots
+	// based on number of entries.
 	SnapshotThreshold uint64
 
 	// If ShutdownOnRemove is true, server will shutdown
-	// when it is removed from the cluster.
+	// when it is removed from the cluster, and Serve returns
+	// ErrNodeRemoved. Leader continues to replicate to removed
+	// node for HeartbeatTimeout after removal is committed, so
+	// that it learns that it is removed.
 	ShutdownOnRemove bool
 
+	// If HandoffOnShutdown is true, Shutdown of leader transfers the
+	// leadership to another voter before closing, to avoid waiting for
+	// election on every planned restart of leader. Shutdown proceeds to
+	// close, if the transfer is not completed within 2*HeartbeatTimeout
+	// or the context is done.
+	HandoffOnShutdown bool
+
+	// If PrecheckNodes is true, leader runs PrecheckNode on every node
+	// that is added or whose address is changed, before accepting the
+	// ChangeConfig. The change is rejected with PrecheckError, if any
+	// such node is unreachable or incompatible. This avoids committing
+	// configs with dead or mistyped addresses.
+	PrecheckNodes bool
+
+	// AdvertiseAddr is the address, at which other nodes can contact this
+	// node. If set, and it differs from the node's address in config, for
+	// example when node is restarted on another host, the node asks leader
+	// to update its address. Leader verifies the node's identity at the new
+	// address, using the handshake of PrecheckNode, and changes the config.
+	// This avoids manual ChangeConfig with Config.SetAddr.
+	//
+	// The request is sent to the voters in the node's config, until leader
+	// updates the address. Leader must run a version supporting it, and
+	// must have PeerKey set: without authentication, any host knowing the
+	// cluster id and node id could take over the address of a node, so
+	// such leader rejects the request with ErrUnauthenticated.
+	AdvertiseAddr string
+
+	// If Standby is true, node runs as hot standby while it is nonvoter:
+	// it replicates and persists log, but defers restoring snapshot and
+	// applying entries to FSM, until it is promoted to voter or Activate
+	// task is submitted. This keeps a warm spare, whose FSM is expensive
+	// to restore, and pays the cost only on activation.
+	//
+	// Snapshots are not taken in standby, so log is not compacted unless
+	// leader sends a snapshot. DirtyReadFSM and TakeSnapshot tasks are
+	// rejected with ErrStandby.
+	Standby bool
+
+	// Leader stickiness: a node which knows the current leader, rejects
+	// RequestVote from other candidates. A follower forgets the leader,
+	// if it does not hear from it within HeartbeatTimeout. This prevents
+	// a partitioned node from disrupting the healthy leader when it
+	// rejoins. Vote requests sent due to TransferLeadership bypass this
+	// check, because the leader asked the target to start election.
+	//
+	// If DisableStickiness is true, votes are granted as per Raft paper,
+	// irrespective of current leader. Leader does not hold lease in that
+	// case, see Info.LeaseExpiry.
+	DisableStickiness bool
+
+	// TransferReads determines how leader handles read tasks such as
+	// ReadFSM, DirtyReadFSM and BarrierFSM, while leadership transfer
+	// is in progress. Default is RejectReads.
+	TransferReads ReadPolicy
+
+	// SnapshotSource, if not nil, lets leader delegate sending snapshot
+	// to a follower. When a node needs snapshot, leader calls it with
+	// the node and the followers that are reachable and caught up. The
+	// follower returned streams its own latest snapshot to the node.
+	// If it returns 0, or the follower fails to send its snapshot,
+	// leader sends its own snapshot.
+	//
+	// This offloads leader's disk and network during scale-out events.
+	// Use Node.Data to pick the closest follower.
+	SnapshotSource func(target Node, healthy []Node) uint64
+
+	// TransferTargetSelector, if not nil, is used to chose the target
+	// of TransferLeadership, when target is not specified. It is called
+	// with the voters that are reachable, sorted by preference: the most
+	// caught up first, then the ones with least latency. Leadership is
+	// transferred to the voter returned, once it is caught up. If it
+	// returns an id that is not in candidates, the first candidate
+	// is chosen.
+	//
+	// Use Node.Tags to prefer nodes in same zone, see PreferTags.
+	TransferTargetSelector func(candidates []TransferCandidate) uint64
+
+	// Interceptors are called in order by leader, before appending the
+	// updates submitted by FSMTasks, such as UpdateFSM and ApplyBatch.
+	// This allows validation, size limits, quota checks or audit logging
+	// without wrapping every call site. See Interceptor.
+	Interceptors []Interceptor
+
+	// ZoneTag is the key of Node.Tags, whose value is the fault domain
+	// of node, such as zone or rack. Leader warns when the voters cannot
+	// survive the loss of a single zone, see Config.CriticalZones.
+	// Zero value means "zone".
+	ZoneTag string
+
+	// ReplicationThrottle, if not nil, is called with each follower,
+	// when leader starts replicating to it. The Throttle returned limits
+	// replication of log entries to that follower. This avoids catch-up
+	// of a rebuilt node from monopolizing leader's disk reads.
+	ReplicationThrottle func(n Node) Throttle
+
+	// MaxInflightEntries and MaxInflightBytes limit the FSMTasks that
+	// leader holds in memory, until they are committed and handed over
+	// to FSM. Bytes are computed using the data of entries. This avoids
+	// leader's memory growing unboundedly when followers are slow.
+	//
+	// When a limit is reached, SubmitTask of FSMTask blocks, unless
+	// RejectBusy is true. Zero value means no limit.
+	MaxInflightEntries int
+	MaxInflightBytes   int64
+
+	// ApplyConcurrency is the number of goroutines, that apply updates
+	// to FSM concurrently. It is used only if FSM is ShardedFSM. Zero
+	// and one mean updates are applied one at a time.
+	ApplyConcurrency int
+
+	// ResultCacheSize is the number of recent UpdateFSMOnce results
+	// remembered, to reply retries of those updates. It is used when
+	// this node is leader, and is carried in the entries it appends,
+	// so that all nodes evict the same results. It should be same on
+	// all voters. Zero value disables the cache.
+	ResultCacheSize int
+
+	// ApplyQueueSize is the capacity of queue, in which committed entries
+	// and other requests wait for FSM goroutine. When the queue is full,
+	// raft goroutine blocks until FSM catches up. Zero value means 1024.
+	ApplyQueueSize int
+
+	// PipelineSize is the maximum number of AppendEntries requests,
+	// that leader sends to a follower without waiting for their
+	// responses. Zero value means 128.
+	PipelineSize int
+
+	// DuplicateWindow is the duration, for which leader remembers the
+	// id and digest of an update submitted with ApplyWithID, to detect
+	// its duplicates. Zero value disables the detection.
+	DuplicateWindow time.Duration
+
+	// CommitSLO is the maximum time, an entry is expected to take
+	// from being appended by leader till it is committed. Leader raises
+	// Alerts.SlowCommit, when an entry is not committed within CommitSLO.
+	// This helps to alert on replication degradation, before quorum is
+	// lost. Zero value disables the alert.
+	CommitSLO time.Duration
+
+	// MaxApplyLag is the maximum number of committed entries, that
+	// follower's FSM can be behind, before the follower rejects
+	// DirtyReadFSM tasks with ErrApplyLag. Follower applies entries
+	// in background, so that slow FSM does not delay its responses
+	// to leader. Zero value means no limit.
+	MaxApplyLag uint64
+
+	// If RejectBusy is true, FSMTasks are replied with ErrBusy instead
+	// of blocking, when inflight limits are reached. Similarly they are
+	// replied with ErrLogFull, when log is full with BlockApply policy.
+	RejectBusy bool
+
+	// MaxLogBytes is the maximum size of log in bytes, that is not yet
+	// discarded by snapshots. When log exceeds it, snapshot is taken
+	// without waiting for SnapshotThreshold or SnapshotInterval. This
+	// protects disk from filling, when snapshots are infrequent or FSM
+	// snapshot is slow. Log is discarded only in whole segments, so
+	// it should be few times of LogSegmentSize. Zero value means no limit.
+	MaxLogBytes int64
+
+	// LogFullPolicy tells what leader does with FSMTasks, while log
+	// exceeds MaxLogBytes. Default is BlockApply.
+	LogFullPolicy LogFullPolicy
+
+	// ApplyPanicPolicy tells what to do, when FSM panics while applying
+	// a command. Panic is recovered, the UpdateFSM task is replied with
+	// ApplyPanicError and the panic is logged. Default is HaltNode.
+	//
+	// Panics of AsyncFSM are not recovered, since updates are completed
+	// by goroutines owned by FSM.
+	ApplyPanicPolicy ApplyPanicPolicy
+
+	// MinFreeDisk is the minimum free space in bytes, of the filesystems
+	// containing log and snapshots. When free space is below it, disk is
+	// treated as full: Alerts.DiskFull is raised, FSMTasks that append
+	// to log are rejected with ErrDiskFull, the node does not start
+	// election, and leader transfers leadership. This avoids a leader
+	// with full disk, from winning elections repeatedly. Zero value
+	// disables disk monitoring.
+	MinFreeDisk uint64
+
+	// DiskCheckInterval is the interval at which free space is checked,
+	// when MinFreeDisk is non-zero. Zero value means 10 seconds.
+	DiskCheckInterval time.Duration
+
 	// Bandwidth is the network bandwidth in number of bytes per second.
 	// This is used to compute I/O deadlines for AppendEntriesRequest
 	// and InstallSnapshotRequest RPCs
 	Bandwidth int64
 
+	// Backoff configures wait between retries to a follower,
+	// when replication to it fails.
+	Backoff Backoff
+
+	// CircuitBreaker stops leader from repeatedly connecting to
+	// a follower whose address keeps failing. Disabled by default.
+	CircuitBreaker CircuitBreaker
+
+	// RPCTimeouts configures deadlines of requests sent to followers,
+	// per type of request.
+	RPCTimeouts RPCTimeouts
+
+	// PeerRateLimit limits the rate of requests received from each peer,
+	// other than RequestVote and TimeoutNow. Disabled by default.
+	//
+	// Irrespective of this, pending requests are replied in priority
+	// order: RequestVote and TimeoutNow first, then AppendEntries, then
+	// InstallSnapshot. While receiving snapshot, pending RequestVote and
+	// TimeoutNow requests are replied between chunks.
+	PeerRateLimit RateLimit
+
 	// LogSegmentSize is the size of logSegmentFile in bytes. Raft log is
 	// a collection of segment files. When current segment file is full,
 	// new segment file is created. Value must be >=1024.
 	LogSegmentSize int
 
+	// LogSegmentEntries is the maximum number of entries in a segment
+	// file. Zero means no limit.
+	//
+	// Both LogSegmentSize and LogSegmentEntries apply to the segment files
+	// created later, and they can be changed at runtime using
+	// UpdateLogOptions task. Existing segment files retain their size,
+	// but small adjacent segments are merged when node is created.
+	LogSegmentEntries int
+
+	// CompressLog tells to compress sealed log segments, that is all
+	// segments other than the last one, using snappy when node is
+	// created. Compressed segment is decompressed into memory on first
+	// read. This saves disk space, when FSM commands are compressible,
+	// at the cost of cpu and memory when old entries are read. It is
+	// of no use with EncryptionKeys, because encrypted entries do not
+	// compress.
+	CompressLog bool
+
+	// SyncPolicy tells when appended log entries are synced to disk.
+	// Default is SyncAlways. Other policies trade durability for latency,
+	// see SyncPolicy for their safety implications.
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is the interval at which log is synced in background,
+	// when SyncPolicy is SyncPeriodic. Value must be >0 in that case.
+	SyncInterval time.Duration
+
+	// If CheckDurability is true, storage dir is checked at startup,
+	// to persist term and vote as raft requires: a value is written,
+	// reopened as if after crash, and read back. Use this when storage
+	// dir is on network or other unusual filesystem, where rename and
+	// sync of dir may not be durable.
+	CheckDurability bool
+
+	// If StartupCheck is true, storage dir is cross-checked at startup:
+	// term and vote, first and last indexes of log, latest snapshot,
+	// configs and vars must be consistent with each other. New returns
+	// StartupError with the problems found, rather than panicking later
+	// on subtly corrupted storage dir. See CheckStartup.
+	StartupCheck bool
+
 	// SnapshotsRetain is the number of snapshots to be retained locally.
 	// When new snapshot is taken, older snapshots are removed accordingly.
-	// Value must be >=1.
+	// The snapshot that log compaction depends on, and snapshots being
+	// read are never removed. Value must be >=1.
 	SnapshotsRetain int
 
 	// Logger used for logging messages. If nil, nothing is logged.
@@ -73,17 +359,137 @@ type Options struct {
 	Alerts Alerts
 
 	// Resolver used to resolved node id to transport address. If nill,
-	// Node.Address is used.
+	// Node.Address is used. Use DNSResolver, if host names in Node.Addr
+	// must be resolved again when their IPs change.
 	Resolver Resolver
+
+	// Tracer used for distributed tracing. If nil, no spans
+	// are created.
+	Tracer Tracer
+
+	// CompressEntries tells leader to compress entries sent in
+	// AppendEntries requests using snappy, if the follower supports
+	// it. This saves bandwidth, when FSM commands are compressible,
+	// at the cost of cpu on both sides.
+	CompressEntries bool
+
+	// EncryptionKeys, if not nil, is used to encrypt log entries and
+	// snapshots at rest, using AES-GCM. Each log entry is encrypted
+	// separately, and snapshots in blocks of 64KB. Use StaticKey, if
+	// keys are never rotated.
+	//
+	// New data is always encrypted with the current key. To rotate key,
+	// change the current key and take snapshot. The snapshot is written
+	// with the new key, and log compaction discards entries written with
+	// older keys over time. Older keys must be provided by KeyProvider,
+	// as long as data encrypted with them exists.
+	//
+	// Encryption can only be enabled or disabled on empty storage. Data
+	// sent to other nodes and the Backup stream are not encrypted.
+	EncryptionKeys KeyProvider
+
+	// Dial used to connect to other nodes. If nil, net.DialTimeout
+	// is used. network is "unix" for unix:///path addresses, "mem"
+	// for mem://name addresses and "tcp" otherwise. Use
+	// MemNetwork.Dial for in-process transport.
+	Dial func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	// DialNode, if not nil, returns the function used to connect to
+	// node n, instead of Dial. Use it to connect to some nodes
+	// differently, based on hints in Node.Tags. For example to reach
+	// nodes in other data center through SOCKS proxy. Returning nil
+	// means use Dial. When tags of node change, new connections to
+	// it use the new function, existing ones are not closed.
+	DialNode func(n Node) func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	// CaptureFile, if not empty, is the path of file, in which all
+	// requests and responses sent and received by this node are
+	// recorded with timestamps. It is a debug mode, used to reproduce
+	// problems such as election storms: read the file using
+	// ReadCapture, and replay it using Replayer. The file is truncated
+	// at startup.
+	CaptureFile string
+
+	// CaptureSize is the size of CaptureFile, beyond which it is
+	// renamed with ".1" suffix, and new file is started. So at most
+	// twice this size of disk is used. Zero means 64MB.
+	CaptureSize int64
+
+	// If CaptureEntries is true, log entries sent with AppendEntries
+	// requests are also recorded in CaptureFile.
+	CaptureEntries bool
+
+	// PeerKey returns the secret key of node nid, used to authenticate
+	// connections between nodes, with HMAC over random nonces. It is a
+	// lighter-weight alternative to mutual TLS, for trusted networks that
+	// still need to keep rogue processes out. Use SharedKey to use same
+	// key for all nodes. If nil, nodes are not authenticated.
+	//
+	// Nodes that fail to authenticate are treated as unreachable, and
+	// reported with AuthError. Returning empty key for a node, rejects
+	// that node. Enable it only after all nodes support protocol
+	// version 9, with same PeerKey on all nodes.
+	//
+	// PeerKey does not authenticate Client. So if it is set, admin tasks
+	// are not served on listeners that serve PeerRPCs. Serve them on
+	// separate listener restricted to AdminRPCs, that is protected by
+	// other means, for example listening only on localhost. See Restrict.
+	PeerKey func(nid uint64) []byte
+
+	// IdleConnTimeout is the maximum time, a connection to other node
+	// can be idle in pool. Such connections are closed, instead of
+	// being reused. Zero means no limit.
+	IdleConnTimeout time.Duration
+
+	// PingInterval, if non-zero, is the interval at which idle connections
+	// in pool are pinged. This keeps connections through NAT and firewalls
+	// alive, and closes stale connections, before they are used for rpc.
+	// Only nodes with same version support ping.
+	PingInterval time.Duration
+
+	// PeerProbeInterval, if non-zero, is the interval at which followers
+	// probe other nodes in config, and report the nodes they can reach to
+	// leader. This lets leader tell a node that is down from a node that
+	// is only partitioned from leader, see Replication.Partitioned.
+	// Only nodes with same version report reachable nodes.
+	PeerProbeInterval time.Duration
+
+	// TCPKeepAlive is the keep-alive period of tcp connections to other
+	// nodes. Zero means keep-alive set by Dial is not changed. Negative
+	// value disables keep-alive.
+	TCPKeepAlive time.Duration
+
+	// DisableTCPNoDelay enables Nagle's algorithm, on tcp connections
+	// to other nodes. By default, it is disabled to reduce latency.
+	DisableTCPNoDelay bool
+
+	// Clock used for timers, timeouts and current time. If nil,
+	// real clock is used. Use fake clock, such as sim.Clock, to
+	// run raft in tests without real sleeping.
+	Clock Clock
 }
 
 func (o Options) validate() error {
 	if o.HeartbeatTimeout <= 0 {
 		return errors.New("raft.options: invalid HeartbeatTimeout")
 	}
+	if o.ElectionTimeoutFactor != 0 && o.ElectionTimeoutFactor <= 1 {
+		return errors.New("raft.options: ElectionTimeoutFactor must be greater than 1")
+	}
+	if min, max := o.electionTimeout(); min < o.HeartbeatTimeout || max <= min {
+		return errors.New("raft.options: invalid ElectionTimeoutMin or ElectionTimeoutMax")
+	}
+	if o.MaxClockSkew < 0 || o.MaxClockSkew >= o.HeartbeatTimeout {
+		return errors.New("raft.options: MaxClockSkew must be in range [0, HeartbeatTimeout)")
+	}
 	if o.PromoteThreshold <= 0 {
 		return errors.New("raft.options: PromoteThreshold")
 	}
+	if o.AdvertiseAddr != "" {
+		if err := validateAddr(o.AdvertiseAddr); err != nil {
+			return fmt.Errorf("raft.options: AdvertiseAddr: %v", err)
+		}
+	}
 	if o.Bandwidth <= 0 {
 		return errors.New("raft.options: PromoteThreshold is zero")
 	}
@@ -93,9 +499,235 @@ func (o Options) validate() error {
 	if o.LogSegmentSize < 1024 {
 		return fmt.Errorf("raft.options: LogSegmentSize is too smal")
 	}
+	if o.LogSegmentEntries < 0 {
+		return errors.New("raft.options: LogSegmentEntries is negative")
+	}
+	if o.SyncPolicy > SyncNever {
+		return errors.New("raft.options: invalid SyncPolicy")
+	}
+	if o.SyncPolicy == SyncPeriodic && o.SyncInterval <= 0 {
+		return errors.New("raft.options: SyncInterval must be positive for SyncPeriodic")
+	}
+	if o.TransferReads > QueueReads {
+		return errors.New("raft.options: invalid TransferReads")
+	}
+	if o.DiskCheckInterval < 0 {
+		return errors.New("raft.options: DiskCheckInterval must not be negative")
+	}
+	if o.MaxLogBytes < 0 {
+		return errors.New("raft.options: MaxLogBytes must not be negative")
+	}
+	if o.LogFullPolicy > ForceSnapshot {
+		return errors.New("raft.options: invalid LogFullPolicy")
+	}
+	if o.ApplyPanicPolicy > SkipEntry {
+		return errors.New("raft.options: invalid ApplyPanicPolicy")
+	}
+	if o.MaxInflightEntries < 0 || o.MaxInflightBytes < 0 {
+		return errors.New("raft.options: inflight limits must not be negative")
+	}
+	if o.ApplyConcurrency < 0 {
+		return errors.New("raft.options: ApplyConcurrency must not be negative")
+	}
+	if o.ResultCacheSize < 0 {
+		return errors.New("raft.options: ResultCacheSize must not be negative")
+	}
+	if o.ApplyQueueSize < 0 || o.PipelineSize < 0 {
+		return errors.New("raft.options: ApplyQueueSize and PipelineSize must not be negative")
+	}
+	if o.DuplicateWindow < 0 {
+		return errors.New("raft.options: DuplicateWindow must not be negative")
+	}
+	if o.CommitSLO < 0 {
+		return errors.New("raft.options: CommitSLO must not be negative")
+	}
+	if o.CaptureSize < 0 {
+		return errors.New("raft.options: CaptureSize must not be negative")
+	}
+	if o.IdleConnTimeout < 0 || o.PingInterval < 0 {
+		return errors.New("raft.options: IdleConnTimeout and PingInterval must not be negative")
+	}
+	if o.PeerProbeInterval < 0 {
+		return errors.New("raft.options: PeerProbeInterval must not be negative")
+	}
+	if err := o.Backoff.validate(); err != nil {
+		return err
+	}
+	if err := o.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	if err := o.RPCTimeouts.validate(); err != nil {
+		return err
+	}
+	if err := o.PeerRateLimit.validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// electionTimeout returns bounds of election timeout,
+// with zero values replaced by their defaults.
+func (o Options) electionTimeout() (min, max time.Duration) {
+	min, max = o.ElectionTimeoutMin, o.ElectionTimeoutMax
+	if min == 0 {
+		min = o.HeartbeatTimeout
+	}
+	if max == 0 {
+		factor := o.ElectionTimeoutFactor
+		if factor == 0 {
+			factor = 2
+		}
+		max = time.Duration(factor * float64(min))
+	}
+	return
+}
+
+// ReadPolicy tells how read tasks are handled, while
+// leadership transfer is in progress.
+type ReadPolicy uint8
+
+const (
+	// RejectReads rejects reads immediately with
+	// InProgressError("transferLeadership").
+	RejectReads ReadPolicy = iota
+
+	// ServeReads serves reads until the leader sends TimeoutNow
+	// request to the transfer target. Once TimeoutNow is sent,
+	// leader's lease is expired, because target might have become
+	// leader. Any reads received after lease expiry are rejected
+	// with InProgressError("transferLeadership").
+	ServeReads
+
+	// QueueReads queues reads until the transfer is completed.
+	// If the transfer fails, queued reads are served by the same
+	// leader. If the transfer succeeds, queued reads are replied
+	// with NotLeaderError, once the new leader is known.
+	QueueReads
+)
+
+func (p ReadPolicy) String() string {
+	switch p {
+	case RejectReads:
+		return "rejectReads"
+	case ServeReads:
+		return "serveReads"
+	case QueueReads:
+		return "queueReads"
+	}
+	return fmt.Sprintf("ReadPolicy(%d)", p)
+}
+
+// SyncPolicy tells when appended log entries are synced to disk.
+//
+// Raft requires that a node persists entries before acknowledging
+// them. With SyncPeriodic and SyncNever, entries are acknowledged
+// while they may be only in OS page cache. A process crash does not
+// lose them, but an OS crash or power failure does. If a majority of
+// nodes lose acknowledged entries at the same time, committed entries
+// may be lost, and may be overwritten by a new leader. Use these
+// policies only when such loss is acceptable.
+//
+// Term and vote are always synced, irrespective of SyncPolicy.
+// Info.UnsyncedEntries reports the number of entries not yet synced.
+type SyncPolicy uint8
+
+const (
+	// SyncAlways syncs log before acknowledging appended entries.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodic syncs log every Options.SyncInterval, using
+	// a background timer.
+	SyncPeriodic
+
+	// SyncNever never syncs log explicitly, and relies on OS
+	// to flush it. Log is still synced on graceful shutdown.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "syncAlways"
+	case SyncPeriodic:
+		return "syncPeriodic"
+	case SyncNever:
+		return "syncNever"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", p)
+}
+
+// LogFullPolicy tells how FSMTasks are handled by leader,
+// while log exceeds Options.MaxLogBytes.
+type LogFullPolicy uint8
+
+const (
+	// BlockApply blocks FSMTasks that append to log, until snapshot
+	// is taken and log is discarded below the limit. Reads are served
+	// meanwhile. Blocked tasks are held by leader, up to the limits of
+	// MaxInflightEntries and MaxInflightBytes. If RejectBusy is true,
+	// such tasks are replied with ErrLogFull instead.
+	BlockApply LogFullPolicy = iota
+
+	// ForceSnapshot continues to accept FSMTasks, relying only on the
+	// snapshots taken to discard log. Log can still grow beyond the
+	// limit, if FSM snapshot is slower than the updates.
+	ForceSnapshot
+)
+
+func (p LogFullPolicy) String() string {
+	switch p {
+	case BlockApply:
+		return "blockApply"
+	case ForceSnapshot:
+		return "forceSnapshot"
+	}
+	return fmt.Sprintf("LogFullPolicy(%d)", p)
+}
+
+// Interceptor is called by leader with the update to be appended.
+// e.Index, e.Term, e.Time and e.Leader are those of the entry, if it
+// is appended. For ApplyCompositeBatch, it is called for each command
+// with e.Type "update".
+//
+// If it returns error, the update is not appended and the FSMTask is
+// replied with that error, without calling remaining interceptors.
+// It may replace e.Data, which is then appended instead. Because
+// ApplyWithID detects duplicates after interceptors, such changes
+// must be deterministic.
+//
+// Interceptors are called from raft goroutine, so they must be fast
+// and must not submit tasks to raft.
+type Interceptor func(e *LogEntry) error
+
+// ApplyPanicPolicy tells what a node does, when FSM panics
+// while applying a command. see Options.ApplyPanicPolicy
+type ApplyPanicPolicy uint8
+
+const (
+	// HaltNode stops applying entries, and shuts down the node with
+	// ApplyPanicError. The entry is not marked as applied, so that it
+	// is applied again, once the node is restarted with fixed FSM.
+	// Snapshots are not taken after the panic, since FSM state may be
+	// partially updated.
+	HaltNode ApplyPanicPolicy = iota
+
+	// SkipEntry treats the entry as applied with ApplyPanicError as
+	// result, and continues applying next entries. Because every replica
+	// panics on same command, this keeps the cluster available, but FSM
+	// must leave its state unchanged when it panics.
+	SkipEntry
+)
+
+func (p ApplyPanicPolicy) String() string {
+	switch p {
+	case HaltNode:
+		return "haltNode"
+	case SkipEntry:
+		return "skipEntry"
+	}
+	return fmt.Sprintf("ApplyPanicPolicy(%d)", p)
+}
+
 // DefaultOptions returns an Options with usable defaults.
 func DefaultOptions() Options {
 	hbTimeout := 1000 * time.Millisecond
@@ -106,12 +738,61 @@ func DefaultOptions() Options {
 		SnapshotThreshold: 8192,
 		ShutdownOnRemove:  true,
 		Bandwidth:         256 * 1024,
+		Backoff:           Backoff{Jitter: 0.2},
+		IdleConnTimeout:   90 * time.Second,
+		PingInterval:      30 * time.Second,
+		TCPKeepAlive:      30 * time.Second,
 		LogSegmentSize:    16 * 1024 * 1024,
 		SnapshotsRetain:   1,
 		Logger:            new(defaultLogger),
 	}
 }
 
+// LANProfile returns DefaultOptions tuned for nodes in same datacenter,
+// where round trip time is below few milliseconds. Failures are detected
+// faster than with DefaultOptions.
+func LANProfile() Options {
+	o := DefaultOptions()
+	o.HeartbeatTimeout = 500 * time.Millisecond
+	o.PromoteThreshold = o.HeartbeatTimeout
+	o.ElectionTimeoutMin = o.HeartbeatTimeout
+	o.ElectionTimeoutMax = 2 * o.HeartbeatTimeout
+	o.Bandwidth = 10 * 1024 * 1024
+	return o
+}
+
+// WANProfile returns DefaultOptions tuned for nodes spread across regions,
+// where round trip time is hundreds of milliseconds. Timeouts are large
+// enough that slow links do not cause elections, and entries are
+// compressed to save bandwidth.
+func WANProfile() Options {
+	o := DefaultOptions()
+	o.HeartbeatTimeout = 2500 * time.Millisecond
+	o.PromoteThreshold = 2 * o.HeartbeatTimeout
+	o.ElectionTimeoutMin = o.HeartbeatTimeout
+	o.ElectionTimeoutMax = 3 * o.HeartbeatTimeout
+	o.Bandwidth = 64 * 1024
+	o.Backoff.Base = 100 * time.Millisecond
+	o.CompressEntries = true
+	return o
+}
+
+// LocalTestProfile returns DefaultOptions tuned for nodes running on same
+// machine, typically in tests. Elections complete in few tens of
+// milliseconds. Snapshots are not taken periodically, and nothing is
+// logged.
+func LocalTestProfile() Options {
+	o := DefaultOptions()
+	o.HeartbeatTimeout = 50 * time.Millisecond
+	o.PromoteThreshold = o.HeartbeatTimeout
+	o.ElectionTimeoutMin = o.HeartbeatTimeout
+	o.ElectionTimeoutMax = 2 * o.HeartbeatTimeout
+	o.SnapshotInterval = 0
+	o.LogSegmentSize = 1024 * 1024
+	o.Logger = nil
+	return o
+}
+
 // Resolver used to resolve node id to transport address.
 // Without resolver, config must be updated with new address.
 // Resolves becomes handy, when raft is deployed in container or cloud
@@ -122,36 +803,70 @@ type Resolver interface {
 	LookupID(id uint64, timeout time.Duration) (addr string, err error)
 }
 
-// Logger is the interface to be implemented for
-// consuming logs.
+// Logger is the interface to be implemented for consuming logs.
+//
+// Each message is followed by alternating key-value pairs, that
+// describe it. Raft adds "node" and "component" fields to every
+// message. The messages logged by raft goroutine, which are most of
+// them, also carry "term" and "state" fields. Debug messages report
+// the details of elections and replication, that are useful in
+// diagnosing a cluster, but are too many for normal operation.
+//
+// *slog.Logger from log/slog implements Logger, and handles levels
+// as configured in its handler.
 type Logger interface {
+	// Debug consumes debug message.
+	Debug(msg string, args ...interface{})
+
 	// Info consumes information message.
-	Info(v ...interface{})
+	Info(msg string, args ...interface{})
 
 	// Warn consumes warning message.
-	Warn(v ...interface{})
+	Warn(msg string, args ...interface{})
+
+	// Error consumes error message.
+	Error(msg string, args ...interface{})
 }
 
 type nopLogger struct{}
 
-func (nopLogger) Info(v ...interface{}) {}
-func (nopLogger) Warn(v ...interface{}) {}
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
 
+// defaultLogger prints messages other than debug to stdout,
+// with fields formatted as key=value.
 type defaultLogger struct {
 	mu sync.Mutex
 }
 
-func (l *defaultLogger) Info(v ...interface{}) {
-	l.mu.Lock()
-	fmt.Print("[INFO] raft: ")
-	fmt.Println(v...)
-	l.mu.Unlock()
+func (l *defaultLogger) Debug(msg string, args ...interface{}) {}
+
+func (l *defaultLogger) Info(msg string, args ...interface{}) {
+	l.print("INFO", msg, args)
+}
+
+func (l *defaultLogger) Warn(msg string, args ...interface{}) {
+	l.print("WARN", msg, args)
+}
+
+func (l *defaultLogger) Error(msg string, args ...interface{}) {
+	l.print("ERROR", msg, args)
 }
 
-func (l *defaultLogger) Warn(v ...interface{}) {
+func (l *defaultLogger) print(level, msg string, args []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] raft: %s", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+		} else {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		}
+	}
 	l.mu.Lock()
-	fmt.Print("[WARN] raft: ")
-	fmt.Println(v...)
+	fmt.Println(b.String())
 	l.mu.Unlock()
 }
 
@@ -191,6 +906,45 @@ type Alerts interface {
 	// this alert within some configurable time.
 	QuorumUnreachable()
 
+	// LeaseExpired alert is raised by leader, when its lease is expired.
+	// Until the lease expiry, it is guaranteed that no other node is
+	// elected as leader, provided leader stickiness is enabled and
+	// clocks of nodes run at same rate. This alert may be raised while
+	// it is still the leader, i.e. before it steps down. Applications
+	// using raft for leader election, can use this to fence external
+	// resources. Info.LeaseExpiry gives the current lease expiry.
+	//
+	// The lease is also expired, when leader sends TimeoutNow request
+	// during leadership transfer.
+	LeaseExpired(expiry time.Time)
+
+	// CatchupProgress is raised by leader, each time a nonvoter waiting
+	// for promotion completes a round. Tools can use this to show progress
+	// during node replacement. Replication.Catchup in Info gives progress
+	// of the round in progress.
+	CatchupProgress(id uint64, p CatchupProgress)
+
+	// MembershipChanged alert is raised by each node, when config is
+	// changed, committed or reverted. Orchestration layers can use this
+	// to reconcile external state with the cluster. It is not raised
+	// for configs loaded from storage on restart, Info.Configs gives them.
+	MembershipChanged(c MembershipChange)
+
+	// SlowCommit alert is raised by leader, when an entry is not committed
+	// within Options.CommitSLO since it is appended. It is raised once,
+	// for all the entries appended till then. Use SlowCommit.MatchIndex
+	// to find the followers that are lagging.
+	SlowCommit(c SlowCommit)
+
+	// DiskFull alert is raised, when free space of dir is below
+	// Options.MinFreeDisk. dir is the log or snapshots dir, having
+	// least free space.
+	DiskFull(dir string, free uint64)
+
+	// DiskAvailable alert is raised, when free space of dir is no
+	// longer below Options.MinFreeDisk, after DiskFull alert.
+	DiskAvailable(dir string, free uint64)
+
 	// ShuttingDown alert is raised when raft server is shutting down.
 	//
 	// If is recommended to treat this as serious if reason is something other
@@ -201,18 +955,29 @@ type Alerts interface {
 
 type nopAlerts struct{}
 
-func (nopAlerts) Error(err error)                  {}
-func (nopAlerts) Unreachable(id uint64, err error) {}
-func (nopAlerts) Reachable(id uint64)              {}
-func (nopAlerts) QuorumUnreachable()               {}
-func (nopAlerts) ShuttingDown(reason error)        {}
+func (nopAlerts) Error(err error)                              {}
+func (nopAlerts) Unreachable(id uint64, err error)             {}
+func (nopAlerts) Reachable(id uint64)                          {}
+func (nopAlerts) QuorumUnreachable()                           {}
+func (nopAlerts) LeaseExpired(expiry time.Time)                {}
+func (nopAlerts) CatchupProgress(id uint64, p CatchupProgress) {}
+func (nopAlerts) MembershipChanged(c MembershipChange)         {}
+func (nopAlerts) SlowCommit(c SlowCommit)                      {}
+func (nopAlerts) DiskFull(dir string, free uint64)             {}
+func (nopAlerts) DiskAvailable(dir string, free uint64)        {}
+func (nopAlerts) ShuttingDown(reason error)                    {}
 
 var tracer struct {
 	error               func(err error)
 	stateChanged        func(r *Raft)
 	leaderChanged       func(r *Raft)
+	electionTimeout     func(r *Raft, timeout time.Duration)
 	electionStarted     func(r *Raft)
 	electionAborted     func(r *Raft, reason string)
+	voteGranted         func(r *Raft, from uint64, latency time.Duration)
+	voteDenied          func(r *Raft, from uint64, reason string, latency time.Duration)
+	electionWon         func(r *Raft)
+	electionLost        func(r *Raft, reason, cause string)
 	commitReady         func(r *Raft)
 	configChanged       func(r *Raft)
 	configCommitted     func(r *Raft)
@@ -221,6 +986,11 @@ var tracer struct {
 	logCompacted        func(r *Raft)
 	configActionStarted func(r *Raft, id uint64, action Action)
 	unreachable         func(r *Raft, id uint64, since time.Time, err error)
+	slowRTT             func(r *Raft, id uint64, rtt time.Duration, slow bool)
+	clockSkew           func(r *Raft, id uint64, skew time.Duration, exceeded bool)
+	criticalZones       func(r *Raft, zones []string)
 	quorumUnreachable   func(r *Raft, since time.Time)
+	leaseExpired        func(r *Raft, expiry time.Time)
+	applyPanic          func(r *Raft, index uint64, v interface{})
 	shuttingDown        func(r *Raft, reason error)
 }
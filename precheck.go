@@ -0,0 +1,100 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+// maximum number of attempts made by precheck, if the node is
+// unreachable.
+const precheckAttempts = 4
+
+type precheckNode struct {
+	*task
+	nid  uint64
+	addr string
+}
+
+// PrecheckNode task checks whether the node nid, listening at addr, can
+// be added to cluster. It dials addr, and does the same handshake as
+// replication: identity is verified to be of this cluster, protocol
+// version is negotiated, and authenticates if Options.PeerKey is set.
+// Unreachable node is retried with exponential backoff, few times.
+//
+// This can be submitted to any node, but it is typically run on leader
+// before ChangeConfig, to avoid adding dead address to the config. See
+// Options.PrecheckNodes.
+//
+// PrecheckError: if the node is unreachable or incompatible.
+func PrecheckNode(nid uint64, addr string) Task {
+	return precheckNode{task: newTask(), nid: nid, addr: addr}
+}
+
+// precheckNode dials and handshakes with node nid at addr, retrying
+// on network errors. It is safe to call from any goroutine.
+func (r *Raft) precheckNode(nid uint64, addr string) error {
+	pool := &connPool{
+		src:     r.nid,
+		cid:     r.cid,
+		nid:     nid,
+		dialFn:  r.dialFn,
+		clock:   r.clock,
+		tcp:     r.tcp,
+		peerKey: r.peerKey,
+	}
+	rt := newRandTime(r.clock)
+	for failures := uint64(1); ; failures++ {
+		err := func() error {
+			c, err := dial(pool.dialFn, addr, r.hbTimeout, pool.tcp)
+			if err != nil {
+				return err
+			}
+			defer c.rwc.Close()
+			return pool.handshake(c, addr, r.clock.Now().Add(r.hbTimeout))
+		}()
+		if err == nil {
+			return nil
+		}
+		switch err.(type) {
+		case IdentityError, VersionError, AuthError:
+			// retry does not help
+			return PrecheckError{nid, addr, err}
+		}
+		if failures == precheckAttempts {
+			return PrecheckError{nid, addr, err}
+		}
+		select {
+		case <-r.close:
+			return ErrServerClosed
+		case <-after(r.clock, r.backoff.wait(failures, rt)):
+		}
+	}
+}
+
+// precheckConfig runs precheck on given nodes of changeConfig. On
+// success, the task is resubmitted to raft, otherwise it is replied
+// with the error.
+func (r *Raft) precheckConfig(t changeConfig, nodes []Node) {
+	for _, n := range nodes {
+		r.nodeLogger.Debug("prechecking node", "peer", n.ID, "addr", n.Addr)
+		if err := r.precheckNode(n.ID, n.Addr); err != nil {
+			t.reply(err)
+			return
+		}
+	}
+	t.prechecked = true
+	select {
+	case <-r.close:
+		t.reply(ErrServerClosed)
+	case r.taskCh <- t:
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRaft_precheckNode(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+	r2 := c.launch(1, false)[2]
+
+	// node with matching identity
+	if _, err := waitTask(ldr, PrecheckNode(2, c.id2Addr(2)), 0); err != nil {
+		t.Fatalf("precheck(2): got %v, want <nil>", err)
+	}
+
+	// wrong nid at addr
+	_, err := waitTask(ldr, PrecheckNode(3, c.id2Addr(2)), 0)
+	var perr PrecheckError
+	if !errors.As(err, &perr) || perr.Node != 3 {
+		t.Fatalf("precheck(3): got %v, want PrecheckError", err)
+	}
+	if _, ok := perr.Err.(IdentityError); !ok {
+		t.Fatalf("precheck(3): got %v, want IdentityError", perr.Err)
+	}
+
+	// unreachable addr
+	c.shutdown(r2)
+	_, err = waitTask(ldr, PrecheckNode(2, c.id2Addr(2)), 0)
+	if !errors.As(err, &perr) || perr.Node != 2 {
+		t.Fatalf("precheck(2) after shutdown: got %v, want PrecheckError", err)
+	}
+}
+
+func TestChangeConfig_precheckNodes(t *testing.T) {
+	c := newCluster(t)
+	c.opt.PrecheckNodes = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	// dead address must be rejected
+	err := c.waitAddNonvoter(ldr, 2, c.id2Addr(2), false)
+	if _, ok := err.(PrecheckError); !ok {
+		t.Fatalf("addNonvoter(2): got %v, want PrecheckError", err)
+	}
+	if _, ok := c.info(ldr).Configs.Latest.Nodes[2]; ok {
+		t.Fatal("node 2 must not be added to config")
+	}
+
+	// reachable node is added
+	c.launch(1, false)
+	if err = c.waitAddNonvoter(ldr, 2, c.id2Addr(2), false); err != nil {
+		t.Fatalf("addNonvoter(2): got %v, want <nil>", err)
+	}
+	if _, ok := c.info(ldr).Configs.Latest.Nodes[2]; !ok {
+		t.Fatal("node 2 must be added to config")
+	}
+}
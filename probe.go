@@ -0,0 +1,121 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// peer liveness:
+//
+// leader cannot tell whether an unreachable node is down, or only
+// partitioned from leader. so followers probe other nodes in config,
+// and piggyback the nodes they reached in appendResp. leader treats
+// a node as partitioned, if leader cannot reach it, but some reachable
+// follower can. see Options.PeerProbeInterval
+
+// probePeers pings other nodes in config periodically, until raft
+// is closed, and records the nodes that responded in reachablePeers.
+// leader does not probe, since replication tells it reachability.
+func (r *Raft) probePeers(interval time.Duration) {
+	timer := r.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-timer.C():
+		}
+		pools := make(map[uint64]*connPool)
+		_ = r.inspect(func(r *Raft) {
+			if r.state == Leader {
+				return
+			}
+			for id := range r.configs.Latest.Nodes {
+				if id != r.nid && id != r.leader {
+					pools[id] = r.getConnPool(id)
+				}
+			}
+		})
+
+		var (
+			mu    sync.Mutex
+			wg    sync.WaitGroup
+			peers []uint64
+		)
+		for id, pool := range pools {
+			wg.Add(1)
+			go func(id uint64, pool *connPool) {
+				defer wg.Done()
+				if err := r.probe(pool); err != nil {
+					r.nodeLogger.Debug("peer probe failed", "peer", id, "err", err)
+					return
+				}
+				mu.Lock()
+				peers = append(peers, id)
+				mu.Unlock()
+			}(id, pool)
+		}
+		wg.Wait()
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i] < peers[j]
+		})
+		_ = r.inspect(func(r *Raft) {
+			r.reachablePeers = peers
+		})
+		timer.Reset(interval)
+	}
+}
+
+// probe checks that node of pool is reachable, by pinging it
+// on a pooled connection. Nodes that do not support ping are
+// treated reachable, if handshake succeeds.
+func (r *Raft) probe(pool *connPool) error {
+	deadline := r.clock.Now().Add(r.hbTimeout)
+	c, err := pool.getConn(deadline)
+	if err != nil {
+		return err
+	}
+	if c.version >= protocolV4 {
+		if err = c.ping(deadline); err != nil {
+			_ = c.rwc.Close()
+			return err
+		}
+	}
+	pool.returnConn(c)
+	return nil
+}
+
+// partitioned tells whether node id is unreachable from leader,
+// but some reachable follower reported that it can reach the node.
+func (l *leader) partitioned(id uint64) bool {
+	repl, ok := l.repls[id]
+	if !ok || repl.status.noContact.IsZero() {
+		return false
+	}
+	for _, other := range l.repls {
+		if other.status.id == id || !other.status.noContact.IsZero() {
+			continue
+		}
+		for _, peer := range other.status.peers {
+			if peer == id {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// PromotionPolicy decides when a nonvoter, whose action is Promote,
+// actually becomes voter.
+//
+// Leader replicates to such nonvoter in rounds. Each round replicates
+// the entries that leader has at the start of that round. Promote is
+// called each time a round is completed. If it returns false, leader
+// starts new round if there are new entries, otherwise it checks again
+// after some time.
+type PromotionPolicy interface {
+	Promote(p PromotionProgress) bool
+}
+
+// PromotionProgress describes catch-up progress of nonvoter, at
+// the time a round is completed.
+type PromotionProgress struct {
+	Rounds uint64        // number of rounds completed
+	Round  time.Duration // duration of last round
+	Lag    uint64        // number of entries behind leader's log
+	Uptime time.Duration // duration since the node is reachable, as seen by leader
+}
+
+func (p PromotionProgress) String() string {
+	return fmt.Sprintf("rounds: %d, round: %s, lag: %d, uptime: %s", p.Rounds, p.Round, p.Lag, p.Uptime)
+}
+
+// ThresholdPolicy is a PromotionPolicy, which promotes a nonvoter once
+// all of its limits are satisfied. Zero value of any field means no limit
+// on that criteria.
+//
+// If Options.PromotionPolicy is nil, ThresholdPolicy with only
+// RoundThreshold set to Options.PromoteThreshold is used.
+type ThresholdPolicy struct {
+	// RoundThreshold is the maximum duration of last round. It
+	// is not checked, if nonvoter has no lag.
+	RoundThreshold time.Duration
+
+	// MinRounds is the minimum number of rounds to be completed.
+	MinRounds uint64
+
+	// MaxLag is the maximum number of entries, the nonvoter
+	// can be behind leader's log.
+	MaxLag uint64
+
+	// MinUptime is the minimum duration, the nonvoter must
+	// be reachable.
+	MinUptime time.Duration
+}
+
+// Promote implements PromotionPolicy.
+func (t ThresholdPolicy) Promote(p PromotionProgress) bool {
+	switch {
+	case p.Lag > 0 && t.RoundThreshold > 0 && p.Round > t.RoundThreshold:
+		return false
+	case p.Rounds < t.MinRounds:
+		return false
+	case t.MaxLag > 0 && p.Lag > t.MaxLag:
+		return false
+	case p.Uptime < t.MinUptime:
+		return false
+	}
+	return true
+}
+
+// promotionPolicy returns the PromotionPolicy to be used for node n.
+func (r *Raft) promotionPolicy(n Node) PromotionPolicy {
+	if r.promotion != nil {
+		if p := r.promotion(n); p != nil {
+			return p
+		}
+	}
+	return ThresholdPolicy{RoundThreshold: r.promoteThreshold}
+}
+
+// promotionProgress returns catch-up progress of the nonvoter,
+// whose round is finished.
+func (l *leader) promotionProgress(status *replicationStatus) PromotionProgress {
+	p := PromotionProgress{
+		Rounds: status.round.Ordinal,
+		Round:  status.round.Duration(),
+	}
+	if l.lastLogIndex > status.matchIndex {
+		p.Lag = l.lastLogIndex - status.matchIndex
+	}
+	if status.noContact.IsZero() {
+		p.Uptime = l.clock.Now().Sub(status.contact)
+	}
+	return p
+}
@@ -16,6 +16,7 @@ package raft
 
 import (
 	"context"
+	"errors"
 	"net"
 	"path/filepath"
 	"sync"
@@ -27,11 +28,13 @@ var testMode bool
 
 // Raft implements raft node.
 type Raft struct {
+	clock Clock
 	rtime randTime
 	timer *safeTimer
 
-	rpcCh        chan *rpc
-	disconnected chan uint64 // nid
+	rpcCh        [numPriorities]chan *rpc // see rpcPriority
+	rateLimiter  *rateLimiter             // nil, if no Options.PeerRateLimit
+	disconnected chan uint64              // nid
 
 	fsm           *stateMachine
 	fsmRestoredCh chan error // fsm reports any errors during restore on this channel
@@ -39,36 +42,111 @@ type Raft struct {
 	snapInterval  time.Duration
 	snapThreshold uint64
 	snapTakenCh   chan snapTaken // non nil only when snapshot task is in progress
+	syncTimer     *safeTimer     // see Options.SyncPolicy
+	syncInterval  time.Duration  // non zero only for SyncPeriodic
+	stepDown      *task          // see StepDown, replied when new leader is known
+	stepDownTimer *safeTimer     // active only when stepDown is not nil
+
+	// disk monitoring, see Options.MinFreeDisk
+	diskDirs     []string
+	minFreeDisk  uint64
+	diskInterval time.Duration
+	diskTimer    *safeTimer
+	diskFull     bool
 
 	// persistent state
 	*storage
 
 	// volatile state
-	state       State
-	leader      uint64
-	commitIndex uint64
+	state         State
+	leader        uint64
+	commitIndex   uint64
+	paused        bool          // see Pause
+	replLag       time.Duration // see Info.ReplicationLag
+	truncated     uint64        // see Info.TruncatedEntries
+	chosenTimeout time.Duration // see Info.ElectionTimeout
+
+	// lastLogIndex of voters, from vote responses of current
+	// election. used by leader to seed nextIndex of followers
+	voterLogs map[uint64]uint64
 
 	// options
 	hbTimeout        time.Duration
+	maxClockSkew     time.Duration // see Options.MaxClockSkew
+	zoneTag          string        // see Options.ZoneTag
+	electionMin      time.Duration // see Options.ElectionTimeoutMin
+	electionMax      time.Duration // see Options.ElectionTimeoutMax
+	dupWindow        time.Duration // see Options.DuplicateWindow
+	resultCacheSize  uint32        // see Options.ResultCacheSize
+	commitSLO        time.Duration // see Options.CommitSLO
 	quorumWait       time.Duration
 	promoteThreshold time.Duration
+	promotion        func(n Node) PromotionPolicy
 	shutdownOnRemove bool
-	logger           Logger
+	handoff          bool // see Options.HandoffOnShutdown
+	precheck         bool // see Options.PrecheckNodes
+	advertiseAddr    string
+	standby          bool    // see Options.Standby
+	restoreFSM       bool    // fsm restore deferred by standby
+	sticky           bool    // see Options.DisableStickiness
+	compress         bool    // see Options.CompressEntries
+	logger           *logger // adds term and state, use only in raft goroutine
+	nodeLogger       *logger // safe to use from other goroutines
 	alerts           Alerts
+	tracing          Tracer
 	bandwidth        int64
+	pipelineSize     int
+	backoff          Backoff
+	circuitBreaker   CircuitBreaker
+	rpcTimeouts      RPCTimeouts
+	transferReads    ReadPolicy
+	snapshotSource   func(target Node, healthy []Node) uint64
+	transferSelector func(candidates []TransferCandidate) uint64
+	interceptors     []Interceptor
+	replThrottle     func(n Node) Throttle
+
+	// inflight limits, see Options.MaxInflightEntries
+	maxInflight     int
+	maxInflightSize int64
+	rejectBusy      bool
+	maxApplyLag     uint64 // see Options.MaxApplyLag
+
+	// log size limit, see Options.MaxLogBytes
+	maxLogBytes   int64
+	logFullPolicy LogFullPolicy
+
+	// fsmApply of follower, not yet taken by fsm goroutine.
+	// nil if fsm.ch received other messages after it.
+	flrApply *followerApply
+
+	// reads queued during leadership transfer,
+	// waiting for new leader to be known
+	queuedReads []*newEntry
 
 	// dialing
-	resolver  *resolver
-	dialFn    dialFn // used for mocking in tests
-	connPools map[uint64]*connPool
+	resolver        *resolver
+	dialFn          dialFn // used for mocking in tests
+	tcp             tcpOptions
+	idleConnTimeout time.Duration // see Options.IdleConnTimeout
+	pingInterval    time.Duration // see Options.PingInterval
+	probeInterval   time.Duration // see Options.PeerProbeInterval
+	reachablePeers  []uint64      // see probePeers
+	connPools       map[uint64]*connPool
+	peerKey         func(nid uint64) []byte // see Options.PeerKey
+	capture         *capture                // see Options.CaptureFile, nil if disabled
 
 	ldr *leader
 	cnd *candidate
+	flr *follower
 
 	taskCh     chan Task
 	fsmTaskCh  chan FSMTask
 	newEntryCh chan *newEntry
 
+	// see SubscribeCommits
+	subsMu sync.Mutex
+	subs   map[*CommitSubscription]struct{}
+
 	closeOnce   sync.Once
 	closeReason error
 	close       chan struct{}
@@ -88,61 +166,197 @@ func New(opt Options, fsm FSM, storageDir string) (*Raft, error) {
 	if opt.Alerts == nil {
 		opt.Alerts = nopAlerts{}
 	}
-	store, err := openStorage(storageDir, opt)
-	if err != nil {
+	if opt.Tracer == nil {
+		opt.Tracer = nopTracer{}
+	}
+	if opt.Dial == nil {
+		opt.Dial = net.DialTimeout
+	}
+	if opt.Clock == nil {
+		opt.Clock = realClock{}
+	}
+	if opt.ApplyQueueSize == 0 {
+		opt.ApplyQueueSize = 1024
+	}
+	if opt.PipelineSize == 0 {
+		opt.PipelineSize = 128
+	}
+	if opt.DiskCheckInterval == 0 {
+		opt.DiskCheckInterval = 10 * time.Second
+	}
+	var (
+		store *storage
+		err   error
+	)
+	if opt.StartupCheck {
+		var report StartupReport
+		if store, report = openChecked(storageDir, opt); !report.OK() {
+			if store != nil {
+				_ = store.log.Close()
+			}
+			return nil, StartupError{report}
+		}
+	} else if store, err = openStorage(storageDir, opt); err != nil {
 		return nil, err
 	}
 	if store.cid == 0 || store.nid == 0 {
 		return nil, ErrIdentityNotSet
 	}
+	if err = store.mergeSegments(); err == nil && opt.CompressLog {
+		err = store.compressSegments()
+	}
+	if err != nil {
+		_ = store.log.Close()
+		return nil, err
+	}
 	sm := &stateMachine{
-		FSM:   fsm,
-		id:    store.nid,
-		ch:    make(chan interface{}, 1024), // todo configurable capacity
-		snaps: store.snaps,
+		FSM:         fsm,
+		id:          store.nid,
+		tracing:     opt.Tracer,
+		ch:          make(chan interface{}, opt.ApplyQueueSize),
+		snaps:       store.snaps,
+		results:     newResultCache(),
+		panicPolicy: opt.ApplyPanicPolicy,
+	}
+	if async, ok := fsm.(AsyncFSM); ok {
+		sm.async, sm.pending = async, newApplyQueue()
+	}
+	if persistent, ok := fsm.(PersistentFSM); ok {
+		if sm.async != nil {
+			return nil, errors.New("raft: FSM cannot be both AsyncFSM and PersistentFSM")
+		}
+		sm.persistent = persistent
+	}
+	if entries, ok := fsm.(EntryFSM); ok {
+		if sm.async != nil {
+			return nil, errors.New("raft: FSM cannot be both AsyncFSM and EntryFSM")
+		}
+		sm.entries = entries
+	}
+	if fork, ok := fsm.(ForkFSM); ok {
+		if sm.persistent == nil && sm.entries == nil {
+			return nil, errors.New("raft: ForkFSM must be PersistentFSM or EntryFSM")
+		}
+		sm.fork = fork
+	}
+	if sharded, ok := fsm.(ShardedFSM); ok && opt.ApplyConcurrency > 1 {
+		if sm.async != nil || sm.persistent != nil || sm.entries != nil {
+			return nil, errors.New("raft: ShardedFSM cannot be AsyncFSM, PersistentFSM or EntryFSM")
+		}
+		sm.sharded, sm.pending = sharded, newApplyQueue()
+		sm.shards = make([]chan func(), opt.ApplyConcurrency)
+		for i := range sm.shards {
+			sm.shards[i] = make(chan func(), 64)
+		}
 	}
+	electionMin, electionMax := opt.electionTimeout()
 	r := &Raft{
-		rtime:            newRandTime(),
-		timer:            newSafeTimer(),
-		rpcCh:            make(chan *rpc),
+		clock:            opt.Clock,
+		rtime:            newRandTime(opt.Clock),
+		timer:            newSafeTimer(opt.Clock),
+		rateLimiter:      newRateLimiter(opt.PeerRateLimit, opt.Clock),
 		disconnected:     make(chan uint64, 20),
 		fsm:              sm,
 		fsmRestoredCh:    make(chan error, 5),
-		snapTimer:        newSafeTimer(),
+		snapTimer:        newSafeTimer(opt.Clock),
 		snapInterval:     opt.SnapshotInterval,
 		snapThreshold:    opt.SnapshotThreshold,
+		syncTimer:        newSafeTimer(opt.Clock),
+		diskDirs:         []string{filepath.Join(storageDir, "log"), store.snaps.dir},
+		minFreeDisk:      opt.MinFreeDisk,
+		diskInterval:     opt.DiskCheckInterval,
+		diskTimer:        newSafeTimer(opt.Clock),
+		stepDownTimer:    newSafeTimer(opt.Clock),
 		storage:          store,
 		state:            Follower,
 		hbTimeout:        opt.HeartbeatTimeout,
+		maxClockSkew:     opt.MaxClockSkew,
+		zoneTag:          opt.ZoneTag,
+		electionMin:      electionMin,
+		electionMax:      electionMax,
 		promoteThreshold: opt.PromoteThreshold,
+		promotion:        opt.PromotionPolicy,
 		shutdownOnRemove: opt.ShutdownOnRemove,
-		logger:           opt.Logger,
+		handoff:          opt.HandoffOnShutdown,
+		precheck:         opt.PrecheckNodes,
+		advertiseAddr:    opt.AdvertiseAddr,
+		standby:          opt.Standby,
+		dupWindow:        opt.DuplicateWindow,
+		resultCacheSize:  uint32(opt.ResultCacheSize),
+		commitSLO:        opt.CommitSLO,
+		sticky:           !opt.DisableStickiness,
+		compress:         opt.CompressEntries,
 		alerts:           opt.Alerts,
+		tracing:          opt.Tracer,
 		bandwidth:        opt.Bandwidth,
-		dialFn:           net.DialTimeout,
+		backoff:          opt.Backoff.withDefaults(opt.HeartbeatTimeout),
+		circuitBreaker:   opt.CircuitBreaker.withDefaults(opt.HeartbeatTimeout),
+		rpcTimeouts:      opt.RPCTimeouts.withDefaults(opt.HeartbeatTimeout),
+		pipelineSize:     opt.PipelineSize,
+		transferReads:    opt.TransferReads,
+		snapshotSource:   opt.SnapshotSource,
+		transferSelector: opt.TransferTargetSelector,
+		interceptors:     opt.Interceptors,
+		replThrottle:     opt.ReplicationThrottle,
+		maxInflight:      opt.MaxInflightEntries,
+		maxInflightSize:  opt.MaxInflightBytes,
+		rejectBusy:       opt.RejectBusy,
+		maxApplyLag:      opt.MaxApplyLag,
+		maxLogBytes:      opt.MaxLogBytes,
+		logFullPolicy:    opt.LogFullPolicy,
+		dialFn:           opt.Dial,
+		peerKey:          opt.PeerKey,
+		tcp:              tcpOptions{opt.TCPKeepAlive, !opt.DisableTCPNoDelay},
+		idleConnTimeout:  opt.IdleConnTimeout,
+		pingInterval:     opt.PingInterval,
+		probeInterval:    opt.PeerProbeInterval,
 		connPools:        make(map[uint64]*connPool),
 		taskCh:           make(chan Task),
 		fsmTaskCh:        make(chan FSMTask),
 		newEntryCh:       make(chan *newEntry),
+		subs:             make(map[*CommitSubscription]struct{}),
 		close:            make(chan struct{}),
 		closed:           make(chan struct{}),
 	}
+	r.logger = newLogger(opt.Logger, store.nid, "raft").withState(r)
+	r.nodeLogger = newLogger(opt.Logger, store.nid, "server")
+	sm.logger = newLogger(opt.Logger, store.nid, "fsm")
+	sm.onPanic = r.onApplyPanic
+	for i := range r.rpcCh {
+		r.rpcCh[i] = make(chan *rpc)
+	}
+	if opt.SyncPolicy == SyncPeriodic {
+		r.syncInterval = opt.SyncInterval
+	}
 
 	r.resolver = &resolver{
 		delegate: opt.Resolver,
+		dialNode: opt.DialNode,
 		addrs:    make(map[uint64]string),
-		logger:   r.logger,
+		nodes:    make(map[uint64]Node),
+		resolved: make(map[uint64]string),
+		logger:   newLogger(opt.Logger, store.nid, "resolver"),
 		alerts:   r.alerts,
 	}
 	r.resolver.update(store.configs.Latest)
 
+	if opt.CaptureFile != "" {
+		if opt.CaptureSize == 0 {
+			opt.CaptureSize = defaultCaptureSize
+		}
+		if r.capture, err = openCapture(opt.CaptureFile, opt.CaptureSize, opt.CaptureEntries, r.clock, newLogger(opt.Logger, store.nid, "capture")); err != nil {
+			return nil, err
+		}
+	}
+
 	return r, nil
 }
 
 // todo: note that we dont support multiple listeners
 
 // ListenAndServe listens on the TCP network address addr and
-// then calls Serve.
+// then calls Serve. Use unix:///path to listen on unix domain
+// socket.
 //
 // ListenAndServe always returns a non-nil error. If raft is
 // closed by Shutdown call, it returns ErrServerClosed. If
@@ -153,9 +367,9 @@ func New(opt Options, fsm FSM, storageDir string) (*Raft, error) {
 // Note that the address specified here could be different than
 // the address specified in config. The address specified in config
 // is the advertised address, which should be reachable from other
-// nodes in the cluster.
+// nodes in the cluster. see Node.Addr
 func (r *Raft) ListenAndServe(addr string) error {
-	lr, err := net.Listen("tcp", addr)
+	lr, err := net.Listen(splitAddr(addr))
 	if err != nil {
 		panic(err)
 	}
@@ -163,6 +377,9 @@ func (r *Raft) ListenAndServe(addr string) error {
 }
 
 // Serve accepts incoming connections from raft nodes on the listener.
+// If more listeners are given, connections are accepted on all of them
+// simultaneously. Use Restrict to limit the requests served on a
+// listener, for example to serve Client tasks only on localhost.
 //
 // Serve always returns a non-nil error. If raft is
 // closed by Shutdown call, it returns ErrServerClosed. If
@@ -173,8 +390,8 @@ func (r *Raft) ListenAndServe(addr string) error {
 // Note that the address specified here could be different than
 // the address specified in config. The address specified in config
 // is the advertised address, which should be reachable from other
-// nodes in the cluster.
-func (r *Raft) Serve(l net.Listener) error {
+// nodes in the cluster. see Node.Addr
+func (r *Raft) Serve(l net.Listener, more ...net.Listener) error {
 	defer safeClose(r.closed)
 	if r.isClosed() {
 		return ErrServerClosed
@@ -184,14 +401,23 @@ func (r *Raft) Serve(l net.Listener) error {
 		return err
 	}
 	defer unlockDir(storageDir)
-	if trace {
-		println(r, "serving at", l.Addr())
-		defer println(r, "<< shutdown()")
+	r.logger.Info("starting", "storage", filepath.Dir(r.snaps.dir), "cid", r.cid, "config", r.configs.Latest)
+	r.logger.Info("listening", "addr", l.Addr())
+	for _, l := range more {
+		r.logger.Info("listening", "addr", l.Addr())
+	}
+	if self, ok := r.configs.Latest.Nodes[r.nid]; ok {
+		r.logger.Info("advertised address", "addr", self.Addr)
+	}
+
+	// skip restoring fsm, if it already contains applied entries
+	applied, err := r.skipApplied()
+	if err != nil {
+		return err
+	}
+	if applied {
+		r.commitIndex = r.fsm.index
 	}
-	r.logger.Info("storage:", filepath.Dir(r.snaps.dir))
-	r.logger.Info("cid:", r.cid, "nid:", r.nid)
-	r.logger.Info(r.configs.Latest)
-	r.logger.Info("listening at", l.Addr())
 
 	var wg sync.WaitGroup
 	defer wg.Wait()
@@ -200,32 +426,76 @@ func (r *Raft) Serve(l net.Listener) error {
 	go func() {
 		defer wg.Done()
 		r.fsm.runLoop()
-		if trace {
-			println(r, "fsmLoop shutdown")
-		}
+		r.nodeLogger.Debug("fsm loop stopped")
 	}()
 	defer close(r.fsm.ch)
 
+	if r.standby {
+		if r.configs.Latest.isVoter(r.nid) {
+			r.standby = false
+		} else {
+			r.logger.Info("running as standby, fsm is not applied until activated")
+		}
+	}
+
 	// restore fsm from last snapshot, if present
-	if r.snaps.index > 0 {
-		r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
-		if err := <-r.fsmRestoredCh; err != nil {
-			return err
+	if r.snaps.index > 0 && !applied {
+		if r.standby {
+			r.restoreFSM = true
+		} else {
+			r.sendFSM(fsmRestoreReq{r.fsmRestoredCh})
+			if err := <-r.fsmRestoredCh; err != nil {
+				return err
+			}
 		}
 		r.commitIndex = r.snaps.index
 	}
 
-	s := newServer(r, l)
+	s := newServer(r, append([]net.Listener{l}, more...))
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		s.serve()
-		if trace {
-			println(r, "server shutdown")
-		}
+		r.nodeLogger.Debug("server stopped")
 	}()
 	defer s.shutdown()
 
+	if dns, ok := r.resolver.delegate.(*DNSResolver); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.refreshAddrs(dns.refresh())
+		}()
+	}
+
+	if self, ok := r.configs.Latest.Nodes[r.nid]; ok && r.advertiseAddr != "" && self.Addr != r.advertiseAddr {
+		if r.peerKey == nil {
+			r.logger.Warn("requesting address update without PeerKey, leader may reject it", "addr", r.advertiseAddr)
+		}
+		r.logger.Info("requesting address update", "addr", r.advertiseAddr, "old", self.Addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.requestIdentityUpdate()
+		}()
+	}
+
+	if d := idleCheckInterval(r.idleConnTimeout, r.pingInterval); d > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.checkIdleConns(d)
+		}()
+	}
+
+	if r.probeInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.probePeers(r.probeInterval)
+		}()
+	}
+
 	go r.runBatch()
 	r.stateLoop()
 	for ne := range r.newEntryCh {
@@ -242,15 +512,21 @@ func (r *Raft) stateLoop() {
 		f = &follower{Raft: r}
 		c = &candidate{Raft: r}
 		l = &leader{
-			Raft:  r,
-			repls: make(map[uint64]*replication),
+			Raft:         r,
+			repls:        make(map[uint64]*replication),
+			leaseTimer:   newSafeTimer(r.clock),
+			promoteTimer: newSafeTimer(r.clock),
+			removed:      make(map[uint64]*replication),
+			removeTimer:  newSafeTimer(r.clock),
+			sloTimer:     newSafeTimer(r.clock),
+			dedup:        dedup{window: r.dupWindow},
 			transfer: transfer{
-				timer:        newSafeTimer(),
-				newTermTimer: newSafeTimer(),
+				timer:        newSafeTimer(r.clock),
+				newTermTimer: newSafeTimer(r.clock),
 			},
 		}
 	)
-	r.ldr, r.cnd = l, c
+	r.ldr, r.cnd, r.flr = l, c, f
 
 	states := map[State]interface {
 		init()
@@ -266,9 +542,7 @@ func (r *Raft) stateLoop() {
 		if v := recover(); v != nil {
 			r.doClose(recoverErr(v))
 		}
-		if trace {
-			println(r, "stateLoop shutdown")
-		}
+		r.nodeLogger.Debug("state loop stopped")
 	}()
 
 	var state State
@@ -279,18 +553,29 @@ func (r *Raft) stateLoop() {
 	if r.snapInterval > 0 {
 		r.snapTimer.reset(r.rtime.duration(r.snapInterval))
 	}
+	if r.syncInterval > 0 {
+		r.syncTimer.reset(r.syncInterval)
+	}
+	if r.minFreeDisk > 0 {
+		r.diskTimer.reset(0)
+	}
 	for {
 		state = r.state
 		states[state].init()
 		for r.state == state {
+			// stop taking new entries if leader is busy or too many entries
+			// are held while its log is full, so that SubmitTask blocks. see
+			// Options.MaxInflightEntries and Options.MaxLogBytes
+			newEntryCh := r.newEntryCh
+			if r.state == Leader && !r.rejectBusy && (l.busy() || l.heldFull()) {
+				newEntryCh = nil
+			}
 			select {
 			case <-r.close:
 				return
 
 			case err := <-r.fsmRestoredCh:
-				if trace {
-					println(r, "fsm restored err", err)
-				}
+				r.logger.Debug("fsm restored", "err", err)
 				if err != nil {
 					panic(err)
 				}
@@ -299,19 +584,41 @@ func (r *Raft) stateLoop() {
 				r.snapTimer.active = false
 				r.onTakeSnapshot(takeSnapshot{threshold: r.snapThreshold})
 
-			case rpc := <-r.rpcCh:
-				resetTimer := r.replyRPC(rpc)
-				// on receiving AppendEntries from current leader or
-				// granting vote to candidate reset timer
-				if r.state == Follower && resetTimer {
+			case <-r.syncTimer.C:
+				r.syncTimer.active = false
+				if err := r.storage.syncLog(); err != nil {
+					panic(err)
+				}
+				r.syncTimer.reset(r.syncInterval)
+
+			case <-r.diskTimer.C:
+				r.diskTimer.active = false
+				r.checkDisk()
+				if r.minFreeDisk > 0 {
+					r.diskTimer.reset(r.diskInterval)
+				}
+
+			case <-r.stepDownTimer.C:
+				r.stepDownTimer.active = false
+				r.replyStepDown(TimeoutError("stepDown"))
+				if r.state == Follower && f.electionAborted {
 					f.resetTimer()
 				}
 
+			case rpc := <-r.rpcCh[priorityElection]:
+				r.handleRPC(rpc)
+
+			case rpc := <-r.rpcCh[priorityAppend]:
+				r.replyPending(priorityAppend)
+				r.handleRPC(rpc)
+
+			case rpc := <-r.rpcCh[prioritySnapshot]:
+				r.replyPending(prioritySnapshot)
+				r.handleRPC(rpc)
+
 			case nid := <-r.disconnected:
 				if r.leader != 0 && nid != 0 && r.leader == nid {
-					if trace {
-						println(r, "leader got disconnected")
-					}
+					r.logger.Debug("leader got disconnected", "leader", r.leader)
 					r.setLeader(0)
 				}
 
@@ -319,16 +626,23 @@ func (r *Raft) stateLoop() {
 				r.timer.active = false
 				states[r.state].onTimeout()
 
-			case ne, ok := <-r.newEntryCh:
+			case ne, ok := <-newEntryCh:
 				if ok {
+					r.executePending()
 					if r.state == Leader {
-						l.storeEntry(ne)
+						l.storeEntry(l.drainEntries(ne))
 					} else {
 						for ne != nil {
 							if ne.typ == entryDirtyRead {
-								r.fsm.ch <- fsmDirtyRead{ne}
+								if r.standby {
+									ne.reply(ErrStandby)
+								} else if r.maxApplyLag > 0 && r.commitIndex > r.fsm.applied()+r.maxApplyLag {
+									ne.reply(ErrApplyLag)
+								} else {
+									r.sendFSM(fsmDirtyRead{ne})
+								}
 							} else {
-								ne.reply(notLeaderError(r, false))
+								ne.reply(notLeaderError(r, false, true))
 							}
 							ne = ne.next
 						}
@@ -339,7 +653,7 @@ func (r *Raft) stateLoop() {
 				}
 
 			case t := <-r.taskCh:
-				r.executeTask(t)
+				r.executeTasks(t)
 				if r.state == Follower && f.electionAborted {
 					f.resetTimer()
 				}
@@ -368,6 +682,22 @@ func (r *Raft) stateLoop() {
 			case <-l.transfer.newTermTimer.C:
 				l.transfer.newTermTimer.active = false
 				l.onNewTermTimeout()
+
+			case <-l.leaseTimer.C:
+				l.leaseTimer.active = false
+				l.checkLease()
+
+			case <-l.promoteTimer.C:
+				l.promoteTimer.active = false
+				l.checkConfigActions(nil, l.configs.Latest)
+
+			case <-l.removeTimer.C:
+				l.removeTimer.active = false
+				l.stopRemoved()
+
+			case <-l.sloTimer.C:
+				l.sloTimer.active = false
+				l.checkCommitSLO()
 			}
 		}
 		r.timer.stop()
@@ -387,20 +717,38 @@ func (r *Raft) release() {
 	if r.snapTakenCh != nil {
 		r.onSnapshotTaken(<-r.snapTakenCh)
 	}
+
+	r.replyQueuedReads(ErrServerClosed)
+	r.cnd.replyCampaign(ErrServerClosed) // if shutdown before election started
+	r.replyStepDown(ErrServerClosed)
+
+	if err := r.capture.close(); err != nil {
+		r.logger.Warn("capture close failed", "err", err)
+	}
+
+	// sync entries, not yet synced. see Options.SyncPolicy
+	if r.storage.syncPolicy != SyncAlways {
+		if err := r.storage.syncLog(); err != nil {
+			r.logger.Error("log sync on shutdown failed", "err", err)
+			return
+		}
+	}
+
+	// so that next open need not scan log for configs
+	if r.storage.savedConfigs.Latest.Index != 0 {
+		r.saveConfigs(r.storage.savedConfigs)
+	}
 }
 
 func (r *Raft) doClose(reason error) {
 	r.closeOnce.Do(func() {
 		r.closeReason = reason
-		if trace {
-			println(r, ">> shutdown()", reason)
-		}
 		if reason == ErrServerClosed {
-			r.logger.Info("shutting down")
+			r.nodeLogger.Info("shutting down")
 		} else if reason == ErrNodeRemoved {
-			r.logger.Info("node removed, shutting down")
+			r.nodeLogger.Info("node removed, shutting down")
 		} else {
-			r.logger.Warn(trimPrefix(reason), "shutting down")
+			r.nodeLogger.Error("shutting down", "err", reason)
 		}
 		r.alerts.ShuttingDown(reason)
 		if tracer.shuttingDown != nil {
@@ -412,7 +760,13 @@ func (r *Raft) doClose(reason error) {
 
 // Shutdown gracefully shuts down the server. If the provided context expires before
 // the shutdown is complete, Shutdown returns the context's error, otherwise it returns nil
+//
+// If Options.HandoffOnShutdown is true and this node is leader, leadership
+// is transferred to another voter before shutting down.
 func (r *Raft) Shutdown(ctx context.Context) error {
+	if r.handoff {
+		r.handoffLeadership(ctx)
+	}
 	r.doClose(ErrServerClosed)
 	select {
 	case <-ctx.Done():
@@ -422,16 +776,39 @@ func (r *Raft) Shutdown(ctx context.Context) error {
 	}
 }
 
+// handoffLeadership transfers leadership to another voter, if this
+// node is leader. Errors are logged, because shutdown must proceed
+// irrespective of transfer result.
+func (r *Raft) handoffLeadership(ctx context.Context) {
+	t := TransferLeadership(0, 0)
+	select {
+	case <-ctx.Done():
+		return
+	case <-r.close:
+		return
+	case r.taskCh <- t:
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-r.close:
+		return
+	case <-t.Done():
+	}
+	switch err := t.Err().(type) {
+	case nil:
+		r.nodeLogger.Info("leadership handed off on shutdown")
+	case NotLeaderError:
+	default:
+		if err != ErrTransferNoVoter {
+			r.nodeLogger.Warn("leadership handoff on shutdown failed", "err", err)
+		}
+	}
+}
+
 // Closed returns a channel which is closed when the raft
-// initiated shutdown process. You should check this before
-// submitting any task as shown below:
-//
-//     t := raft.GetInfo()
-//     select {
-//         case <-r.Closed():
-//             return nil, ErrServerClosed
-//         case r.Tasks() <-t:
-//     }
+// initiated shutdown process. SubmitTask returns ErrServerClosed
+// after this, instead of blocking.
 func (r *Raft) Closed() <-chan struct{} {
 	return r.close
 }
@@ -444,10 +821,7 @@ func (r *Raft) isClosed() bool {
 
 func (r *Raft) setState(s State) {
 	if s != r.state {
-		if trace {
-			println(r, r.state, "->", s)
-		}
-		r.logger.Info("changing state", r.state, "->", s)
+		r.logger.Info("changing state", "to", s.String())
 		r.state = s
 		if tracer.stateChanged != nil {
 			tracer.stateChanged(r)
@@ -457,16 +831,19 @@ func (r *Raft) setState(s State) {
 
 func (r *Raft) setLeader(id uint64) {
 	if id != r.leader {
-		if trace {
-			println(r, "leader:", id)
-		}
 		r.leader = id
 		if r.leader == 0 {
 			r.logger.Info("no known leader")
 		} else if r.leader == r.nid {
 			r.logger.Info("cluster leadership acquired")
 		} else {
-			r.logger.Info("following leader node", r.leader)
+			r.logger.Info("following leader", "leader", r.leader)
+		}
+		if r.leader != 0 {
+			r.replyQueuedReads(notLeaderError(r, true, true))
+		}
+		if r.leader != 0 && r.leader != r.nid {
+			r.replyStepDown(nil)
 		}
 		if tracer.leaderChanged != nil {
 			tracer.leaderChanged(r)
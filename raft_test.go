@@ -19,12 +19,15 @@ import (
 	"context"
 	"encoding/gob"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -131,6 +134,374 @@ func TestRaft_tripleNode(t *testing.T) {
 
 var tempDir string
 
+func TestRaft_electionEvents(t *testing.T) {
+	c := newCluster(t)
+	electionWon := c.registerFor(eventElectionWon)
+	defer c.unregister(electionWon)
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// leader must have won election
+	for {
+		e, err := electionWon.waitForEvent(c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.src == ldr.nid {
+			break
+		}
+	}
+	c.waitForLeader()
+
+	// block traffic only between leader and flrs[0]
+	voteDenied := c.registerFor(eventVoteDenied, flrs[0])
+	defer c.unregister(voteDenied)
+	electionLost := c.registerFor(eventElectionLost, flrs[0])
+	defer c.unregister(electionLost)
+	network.SetFirewall(blockLink{id2Host(ldr.nid), id2Host(flrs[0].nid)})
+	defer c.connect()
+
+	// flrs[1] still hears from leader, so it denies vote
+	e, err := voteDenied.waitForEvent(c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.target != flrs[1].nid {
+		t.Fatalf("voteDenied.from=M%d, want M%d", e.target, flrs[1].nid)
+	}
+	if e.reason != "leaderKnown" {
+		t.Fatalf("voteDenied.reason=%q, want %q", e.reason, "leaderKnown")
+	}
+
+	// flrs[0] cannot get quorum
+	e, err = electionLost.waitForEvent(c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.reason != "timeout" {
+		t.Fatalf("electionLost.reason=%q, want %q", e.reason, "timeout")
+	}
+}
+
+// tests that candidate with stale log, reports staleLog
+// as the cause of lost election
+func TestRaft_electionLost_staleLog(t *testing.T) {
+	c := newCluster(t)
+	c.opt.DisableStickiness = true
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// flrs[1] must not become leader and catchup flrs[0]
+	c.ensure(waitTask(flrs[1], Pause(c.longTimeout), c.longTimeout))
+
+	// make flrs[0] log stale
+	c.disconnect(flrs[0])
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10, ldr, flrs[1])
+
+	// flrs[0] can reach only flrs[1], which has more up-to-date log
+	electionLost := c.registerFor(eventElectionLost, flrs[0])
+	defer c.unregister(electionLost)
+	network.SetFirewall(blockLink{id2Host(ldr.nid), id2Host(flrs[0].nid)})
+	defer c.connect()
+
+	for {
+		e, err := electionLost.waitForEvent(c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.cause == "staleLog" {
+			break
+		}
+	}
+}
+
+func TestRaft_electionTimeout(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ElectionTimeoutFactor = 4
+	min, max := c.opt.electionTimeout()
+	if min != c.heartbeatTimeout || max != 4*c.heartbeatTimeout {
+		t.Fatalf("bounds: got [%v, %v), want [%v, %v)", min, max, c.heartbeatTimeout, 4*c.heartbeatTimeout)
+	}
+	electionTimeout := c.registerFor(eventElectionTimeout)
+	_, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// chosen timeouts must be spread over the widened range
+	var timeouts []time.Duration
+	for len(timeouts) < 20 {
+		e, err := electionTimeout.waitForEvent(c.longTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.timeout < min || e.timeout >= max {
+			t.Fatalf("M%d timeout: got %v, want in [%v, %v)", e.src, e.timeout, min, max)
+		}
+		timeouts = append(timeouts, e.timeout)
+	}
+	c.unregister(electionTimeout)
+	sort.Slice(timeouts, func(i, j int) bool { return timeouts[i] < timeouts[j] })
+	if spread := timeouts[len(timeouts)-1] - timeouts[0]; spread <= c.heartbeatTimeout {
+		t.Fatalf("spread: got %v, want > %v", spread, c.heartbeatTimeout)
+	}
+
+	// followers must report the last chosen timeout
+	for _, flr := range flrs {
+		if got := c.info(flr).ElectionTimeout; got < min || got >= max {
+			t.Fatalf("M%d info.electionTimeout: got %v, want in [%v, %v)", flr.nid, got, min, max)
+		}
+	}
+
+	c.opt.ElectionTimeoutFactor = 1
+	if err := c.opt.validate(); err == nil {
+		t.Fatal("ElectionTimeoutFactor 1 must be invalid")
+	}
+}
+
+// blockLink is firewall that blocks traffic between two hosts.
+type blockLink [2]string
+
+func (b blockLink) Allow(host1, host2 string) bool {
+	return !(host1 == b[0] && host2 == b[1]) && !(host1 == b[1] && host2 == b[0])
+}
+
+// blockLinks is firewall that blocks traffic of all its links.
+type blockLinks []blockLink
+
+func (b blockLinks) Allow(host1, host2 string) bool {
+	for _, link := range b {
+		if !link.Allow(host1, host2) {
+			return false
+		}
+	}
+	return true
+}
+
+// tests that candidate wins election with quorum of votes,
+// without waiting for vote of slow voter
+func TestRaft_electionQuorum(t *testing.T) {
+	tr := &recordingTracer{}
+	c := newCluster(t)
+	c.opt.Tracer = tr
+	c.opt.ElectionTimeoutMin, c.opt.ElectionTimeoutMax = 2*c.heartbeatTimeout, 3*c.heartbeatTimeout
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// voteReq to flrs[1] takes seconds
+	network.SetBandwidth(id2Host(flrs[0].nid), id2Host(flrs[1].nid), 10)
+	defer network.SetBandwidth(id2Host(flrs[0].nid), id2Host(flrs[1].nid), fnet.NoLimit)
+
+	voteGranted := c.registerFor(eventVoteGranted, flrs[0])
+	defer c.unregister(voteGranted)
+	electionWon := c.registerFor(eventElectionWon, flrs[0])
+	defer c.unregister(electionWon)
+	c.ensure(waitTask(ldr, TransferLeadership(flrs[0].nid, c.longTimeout), c.longTimeout))
+
+	e, err := voteGranted.waitForEvent(c.longTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.target != ldr.nid || e.latency <= 0 || e.latency >= c.heartbeatTimeout {
+		t.Fatalf("voteGranted: got M%d latency %s, want M%d", e.target, e.latency, ldr.nid)
+	}
+	if _, err = electionWon.waitForEvent(c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// election span must tell that vote of flrs[1] is pending
+	won := tr.find(func(s *recordedSpan) bool {
+		return s.name == "raft.election" && s.ended() && s.attr("raft.result") == "won" && s.attr("raft.transfer") == true
+	})
+	if won == nil {
+		t.Fatal("raft.election span not found")
+	}
+	if got := won.attr("raft.votesPending"); got != 1 {
+		t.Fatalf("raft.votesPending: got %v, want 1", got)
+	}
+	if got, ok := won.attr(fmt.Sprintf("raft.vote.%d.latency", ldr.nid)).(time.Duration); !ok || got != e.latency {
+		t.Fatalf("vote latency: got %v, want %s", got, e.latency)
+	}
+}
+
+func TestRaft_campaign(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// leader is already leader
+	c.ensure(waitTask(ldr, Campaign(), c.longTimeout))
+
+	// paused node must not start election
+	c.ensure(waitTask(flrs[0], Pause(c.longTimeout), c.longTimeout))
+	if _, err := waitTask(flrs[0], Campaign(), c.longTimeout); err == nil {
+		t.Fatal("campaign of paused node must fail")
+	}
+	if got := c.getState(flrs[0]); got != Follower {
+		t.Fatalf("state: got %s, want %s", got, Follower)
+	}
+}
+
+func TestRaft_campaign_nonStickiness(t *testing.T) {
+	c := newCluster(t)
+	c.opt.DisableStickiness = true
+	_, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.waitCatchup() // otherwise voters may deny as logNotUptodate
+
+	client := NewClient(c.id2Addr(flrs[0].nid))
+	client.dial = flrs[0].dialFn
+	if err := client.Campaign(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.waitForFollowers(); got != flrs[0] {
+		t.Fatalf("leader: got M%d, want M%d", got.nid, flrs[0].nid)
+	}
+}
+
+func TestRaft_updateLogOptions(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+	numSegments := func() int {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(c.storage[ldr.nid], "log", "*.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(matches)
+	}
+	if _, err := waitTask(ldr, UpdateLogOptions(10, 0), c.longTimeout); err == nil {
+		t.Fatal("error expected for invalid segment size")
+	}
+
+	before := numSegments()
+	c.ensure(waitTask(ldr, UpdateLogOptions(4*1024, 2), c.longTimeout))
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	after := numSegments()
+	if after < before+4 {
+		t.Fatalf("numSegments: got %d, want >=%d", after, before+4)
+	}
+
+	// restart uses segment size from options,
+	// and merges small segments
+	r := c.restart(ldr)
+	c.waitFSMLen(10, r)
+	if got := numSegments(); got >= after {
+		t.Fatalf("numSegments after restart: got %d, want <%d", got, after)
+	}
+	c.sendUpdates(r, 11, 20)
+	c.waitFSMLen(20, r)
+}
+
+func TestRaft_compressLog(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 100)
+	c.waitFSMLen(100)
+
+	// restart compresses sealed segments, which are
+	// smaller than segment size, as they are not preallocated
+	c.opt.CompressLog = true
+	r := c.restart(ldr)
+	c.waitFSMLen(100, r)
+	matches, err := filepath.Glob(filepath.Join(c.storage[r.nid], "log", "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := 0
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() < int64(c.opt.LogSegmentSize) {
+			compressed++
+		}
+	}
+	if compressed == 0 {
+		t.Fatalf("no compressed segments in %d segments", len(matches))
+	}
+
+	// compressed entries are replicated to new node
+	m2 := c.launch(1, false)[2]
+	c.ensure(c.waitAddNonvoter(r, m2.nid, c.id2Addr(m2.nid), false))
+	c.waitFSMLen(100, m2)
+}
+
+func TestRaft_checkDurability(t *testing.T) {
+	c := newCluster(t)
+	c.opt.CheckDurability = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	// term and vote must survive restart
+	term := c.info(ldr).Term
+	r := c.restart(ldr)
+	if got := c.info(r).Term; got < term {
+		t.Fatalf("term: got %d, want >=%d", got, term)
+	}
+	c.waitFSMLen(10, r)
+}
+
+func TestRaft_syncPolicy(t *testing.T) {
+	t.Run("always", func(t *testing.T) {
+		c := newCluster(t)
+		ldr, flrs := c.ensureLaunch(3)
+		defer c.shutdown()
+		c.sendUpdates(ldr, 1, 10)
+		c.waitFSMLen(10)
+		for _, r := range append(flrs, ldr) {
+			if got := c.info(r).UnsyncedEntries; got != 0 {
+				t.Fatalf("%s.unsyncedEntries: got %d, want 0", host(r), got)
+			}
+		}
+	})
+	t.Run("never", func(t *testing.T) {
+		c := newCluster(t)
+		c.opt.SyncPolicy = SyncNever
+		ldr, _ := c.ensureLaunch(1)
+		defer c.shutdown()
+		c.sendUpdates(ldr, 1, 10)
+		c.waitFSMLen(10)
+		if got := c.info(ldr).UnsyncedEntries; got < 10 {
+			t.Fatalf("unsyncedEntries: got %d, want >=10", got)
+		}
+
+		// entries are synced on shutdown
+		r := c.restart(ldr)
+		c.waitFSMLen(10, r)
+	})
+	t.Run("periodic", func(t *testing.T) {
+		c := newCluster(t)
+		c.opt.SyncPolicy = SyncPeriodic
+		c.opt.SyncInterval = 100 * time.Millisecond
+		ldr, _ := c.ensureLaunch(1)
+		defer c.shutdown()
+		c.sendUpdates(ldr, 1, 10)
+		c.waitFSMLen(10)
+		synced := func() bool {
+			return c.info(ldr).UnsyncedEntries == 0
+		}
+		if !waitForCondition(synced, 10*time.Millisecond, c.longTimeout) {
+			t.Fatal("entries are not synced in background")
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		opt := DefaultOptions()
+		opt.SyncPolicy = SyncPeriodic
+		if err := opt.validate(); err == nil {
+			t.Fatal("error expected for zero SyncInterval")
+		}
+		opt.SyncPolicy = SyncNever + 1
+		if err := opt.validate(); err == nil {
+			t.Fatal("error expected for invalid SyncPolicy")
+		}
+	})
+}
+
 func TestMain(m *testing.M) {
 	testMode = true
 	temp, err := ioutil.TempDir("", "log")
@@ -139,7 +510,6 @@ func TestMain(m *testing.M) {
 	}
 	tempDir = temp
 	code := m.Run()
-	println("barrier") // wait until all pending debug traceCh are printed to stdout
 	_ = os.RemoveAll(tempDir)
 	os.Exit(code)
 }
@@ -177,8 +547,6 @@ func newCluster(t *testing.T) *cluster {
 	var testTimeout *time.Timer
 	clusters[t.Name()]++
 	if clusters[t.Name()] == 1 { // first cluster in test, initialize network and checks
-		println()
-		println()
 		testln(t.Name(), "--------------------------")
 		network = fnet.New()
 		checkLeak = leaktest.Check(t)
@@ -220,6 +588,9 @@ func newCluster(t *testing.T) *cluster {
 		SnapshotsRetain:  1,
 		ShutdownOnRemove: true,
 	}
+	if *debug {
+		c.opt.Logger = new(debugLogger)
+	}
 	return c
 }
 
@@ -244,6 +615,12 @@ type cluster struct {
 	opt              Options
 	quorumWait       time.Duration
 	resolverMu       sync.RWMutex
+	asyncFSM         bool // if true, uses asyncFSMMock
+	persistentFSM    bool // if true, uses persistentFSMMock
+	entryFSM         bool // if true, uses entryFSMMock
+	forkFSM          bool // if true, uses forkFSMMock
+	shardedFSM       bool // if true, uses shardedFSMMock
+	shardBlock       chan struct{}
 }
 
 func (c *cluster) LookupID(id uint64, timeout time.Duration) (addr string, err error) {
@@ -314,7 +691,7 @@ func (c *cluster) launch(n int, bootstrap bool) map[uint64]*Raft {
 				c.Fatalf("Storage.bootstrap failed: %v", err)
 			}
 		}
-		fsm := &fsmMock{id: identity{c.id, node.ID}, changed: ee.onFMSChanged}
+		fsm := c.newFSM(identity{c.id, node.ID})
 		c.alerts[node.ID] = new(alerts)
 		opt := c.opt
 		opt.Alerts = c.alerts[node.ID]
@@ -422,7 +799,12 @@ func (c *cluster) restart(r *Raft) *Raft {
 	c.Helper()
 	c.shutdown(r)
 
-	newFSM := &fsmMock{id: identity{r.cid, r.nid}, changed: ee.onFMSChanged}
+	newFSM := c.newFSM(identity{r.cid, r.nid})
+	if old, ok := r.FSM().(*persistentFSMMock); ok {
+		// persistent state survives restart
+		newFSM.(*persistentFSMMock).cmds = old.commands()
+		newFSM.(*persistentFSMMock).applied = old.LastApplied()
+	}
 	storage := c.storage[r.nid]
 	opt := c.opt
 	opt.Alerts = c.alerts[r.nid]
@@ -804,7 +1186,7 @@ func (c *cluster) sendUpdates(r *Raft, from, to int) Task {
 	var t FSMTask
 	for i := from; i <= to; i++ {
 		t = UpdateFSM([]byte(fmt.Sprintf("update:%d", i)))
-		r.FSMTasks() <- t
+		_ = r.SubmitTask(context.Background(), t)
 	}
 	return t
 }
@@ -820,7 +1202,7 @@ func (c *cluster) takeSnapshot(r *Raft, threshold uint64, want error) {
 	c.Helper()
 	testln("takeSnapshot:", host(r), "threshold:", threshold, "want:", want)
 	takeSnap := TakeSnapshot(threshold)
-	r.Tasks() <- takeSnap
+	_ = r.SubmitTask(context.Background(), takeSnap)
 	<-takeSnap.Done()
 	if takeSnap.Err() != want {
 		c.Fatalf("takeSnapshot(M%d).err: got %v, want %v", r.nid, takeSnap.Err(), want)
@@ -829,7 +1211,7 @@ func (c *cluster) takeSnapshot(r *Raft, threshold uint64, want error) {
 
 func (c *cluster) waitForStableConfig(ldr *Raft) {
 	t := WaitForStableConfig()
-	ldr.Tasks() <- t
+	_ = ldr.SubmitTask(context.Background(), t)
 	<-t.Done()
 	if t.Err() != nil {
 		c.Fatalf("waitForStableConfig: %v", t.Err())
@@ -866,25 +1248,34 @@ func (c *cluster) snaps(r *Raft) []uint64 {
 // ---------------------------------------------
 
 func fsm(r *Raft) *fsmMock {
+	switch fsm := r.FSM().(type) {
+	case *asyncFSMMock:
+		return fsm.fsmMock
+	case *persistentFSMMock:
+		return fsm.fsmMock
+	case *entryFSMMock:
+		return fsm.fsmMock
+	case *forkFSMMock:
+		return fsm.fsmMock
+	case *shardedFSMMock:
+		return fsm.fsmMock
+	}
 	return r.FSM().(*fsmMock)
 }
 
 func waitTask(r *Raft, t Task, timeout time.Duration) (interface{}, error) {
 	testln("waitTask:", host(r), t, timeout)
-	var timer <-chan time.Time
-	if timeout > 0 {
-		timer = time.After(timeout)
-	}
-	select {
-	case r.Tasks() <- t:
-		break
-	case <-timer:
+	ctx, cancel := withTimeout(timeout)
+	defer cancel()
+	if err := r.SubmitTask(ctx, t); err == context.DeadlineExceeded {
 		return nil, fmt.Errorf("waitTask(%v): submit timedout", t)
+	} else if err != nil {
+		return nil, err
 	}
 	select {
 	case <-t.Done():
 		return t.Result(), t.Err()
-	case <-timer:
+	case <-ctx.Done():
 		return nil, fmt.Errorf("waitTask(%v): result timedout", t)
 	}
 }
@@ -904,7 +1295,7 @@ func (c *cluster) addNonvoter(ldr *Raft, id uint64, addr string, promote bool) T
 	}
 	newConf.Nodes[id] = Node{ID: id, Addr: addr, Action: action}
 	t := ChangeConfig(newConf)
-	ldr.Tasks() <- t
+	_ = ldr.SubmitTask(context.Background(), t)
 	return t
 }
 
@@ -926,15 +1317,12 @@ func (c *cluster) waitAddNonvoter(ldr *Raft, id uint64, addr string, promote boo
 // use zero timeout, to wait till reply received
 func waitFSMTask(r *Raft, t FSMTask, timeout time.Duration) (fsmReply, error) {
 	testln("waitNewEntry:", host(r), t, timeout)
-	var timer <-chan time.Time
-	if timeout > 0 {
-		timer = time.After(timeout)
-	}
-	select {
-	case r.FSMTasks() <- t:
-		break
-	case <-timer:
+	ctx, cancel := withTimeout(timeout)
+	defer cancel()
+	if err := r.SubmitTask(ctx, t); err == context.DeadlineExceeded {
 		return fsmReply{}, fmt.Errorf("M%d %v: submit timeout", r.nid, t)
+	} else if err != nil {
+		return fsmReply{}, err
 	}
 	select {
 	case <-t.Done():
@@ -946,11 +1334,20 @@ func waitFSMTask(r *Raft, t FSMTask, timeout time.Duration) (fsmReply, error) {
 			result = t.Result().(fsmReply)
 		}
 		return result, nil
-	case <-timer:
+	case <-ctx.Done():
 		return fsmReply{}, fmt.Errorf("M%d %v: result timeout", r.nid, t)
 	}
 }
 
+// withTimeout returns context, that is done after timeout.
+// Zero timeout means no timeout.
+func withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func waitUpdate(r *Raft, cmd string, timeout time.Duration) (fsmReply, error) {
 	return waitFSMTask(r, UpdateFSM([]byte(cmd)), timeout)
 }
@@ -966,7 +1363,7 @@ func waitDirtyRead(r *Raft, read interface{}, timeout time.Duration) (fsmReply,
 func requestVote(from, to *Raft, transfer bool) (granted bool, err error) {
 	fn := func(r *Raft) {
 		req := &voteReq{
-			req:          req{r.term, r.nid},
+			req:          req{term: r.term, src: r.nid},
 			lastLogIndex: r.lastLogIndex,
 			lastLogTerm:  r.lastLogTerm,
 			transfer:     transfer,
@@ -1007,18 +1404,26 @@ const (
 	eventFSMChanged eventType = iota
 	eventStateChanged
 	eventLeaderChanged
+	eventElectionTimeout
 	eventElectionStarted
 	eventElectionAborted
+	eventVoteGranted
+	eventVoteDenied
+	eventElectionWon
+	eventElectionLost
 	eventCommitReady
 	eventConfigChanged
 	eventConfigCommitted
 	eventConfigReverted
 	eventUnreachable
 	eventQuorumUnreachable
+	eventLeaseExpired
 	eventRoundFinished
 	eventLogCompacted
 	eventConfigActionStarted
+	eventCriticalZones
 	eventShuttingDown
+	eventApplyPanic
 
 	eventConfigRelated
 )
@@ -1040,7 +1445,12 @@ type event struct {
 	action     Action
 	numRounds  uint64
 	firstIndex uint64
+	index      uint64
 	reason     string
+	cause      string
+	latency    time.Duration
+	timeout    time.Duration
+	zones      []string
 }
 
 func (e event) matches(typ eventType, cid uint64, rr ...*Raft) bool {
@@ -1203,6 +1613,22 @@ func init() {
 			leader: r.leader,
 		})
 	}
+	tracer.electionTimeout = func(r *Raft, timeout time.Duration) {
+		ee.sendEvent(event{
+			cid:     r.cid,
+			src:     r.nid,
+			typ:     eventElectionTimeout,
+			timeout: timeout,
+		})
+	}
+	tracer.criticalZones = func(r *Raft, zones []string) {
+		ee.sendEvent(event{
+			cid:   r.cid,
+			src:   r.nid,
+			typ:   eventCriticalZones,
+			zones: zones,
+		})
+	}
 	tracer.electionStarted = func(r *Raft) {
 		ee.statusMu.Lock()
 		identity := identity{r.cid, r.nid}
@@ -1224,6 +1650,41 @@ func init() {
 			reason: reason,
 		})
 	}
+	tracer.voteGranted = func(r *Raft, from uint64, latency time.Duration) {
+		ee.sendEvent(event{
+			cid:     r.cid,
+			src:     r.nid,
+			typ:     eventVoteGranted,
+			target:  from,
+			latency: latency,
+		})
+	}
+	tracer.voteDenied = func(r *Raft, from uint64, reason string, latency time.Duration) {
+		ee.sendEvent(event{
+			cid:     r.cid,
+			src:     r.nid,
+			typ:     eventVoteDenied,
+			target:  from,
+			reason:  reason,
+			latency: latency,
+		})
+	}
+	tracer.electionWon = func(r *Raft) {
+		ee.sendEvent(event{
+			cid: r.cid,
+			src: r.nid,
+			typ: eventElectionWon,
+		})
+	}
+	tracer.electionLost = func(r *Raft, reason, cause string) {
+		ee.sendEvent(event{
+			cid:    r.cid,
+			src:    r.nid,
+			typ:    eventElectionLost,
+			reason: reason,
+			cause:  cause,
+		})
+	}
 	tracer.commitReady = func(r *Raft) {
 		ee.statusMu.Lock()
 		identity := identity{r.cid, r.nid}
@@ -1290,6 +1751,24 @@ func init() {
 		})
 	}
 
+	tracer.applyPanic = func(r *Raft, index uint64, v interface{}) {
+		ee.sendEvent(event{
+			cid:   r.cid,
+			src:   r.nid,
+			typ:   eventApplyPanic,
+			index: index,
+		})
+	}
+
+	tracer.leaseExpired = func(r *Raft, expiry time.Time) {
+		ee.sendEvent(event{
+			cid:   r.cid,
+			src:   r.nid,
+			typ:   eventLeaseExpired,
+			since: expiry,
+		})
+	}
+
 	tracer.roundCompleted = func(r *Raft, id uint64, round round) {
 		ee.statusMu.Lock()
 		identity := identity{r.cid, r.nid}
@@ -1338,6 +1817,12 @@ type alerts struct {
 	unreachable       func(id uint64, err error)
 	reachable         func(id uint64)
 	quorumUnreachable func()
+	leaseExpired      func(expiry time.Time)
+	catchupProgress   func(id uint64, p CatchupProgress)
+	membershipChanged func(c MembershipChange)
+	slowCommit        func(c SlowCommit)
+	diskFull          func(dir string, free uint64)
+	diskAvailable     func(dir string, free uint64)
 	shuttingDown      func(error)
 }
 
@@ -1373,6 +1858,54 @@ func (a *alerts) QuorumUnreachable() {
 	}
 }
 
+func (a *alerts) LeaseExpired(expiry time.Time) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.leaseExpired != nil {
+		a.leaseExpired(expiry)
+	}
+}
+
+func (a *alerts) CatchupProgress(id uint64, p CatchupProgress) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.catchupProgress != nil {
+		a.catchupProgress(id, p)
+	}
+}
+
+func (a *alerts) MembershipChanged(c MembershipChange) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.membershipChanged != nil {
+		a.membershipChanged(c)
+	}
+}
+
+func (a *alerts) SlowCommit(c SlowCommit) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.slowCommit != nil {
+		a.slowCommit(c)
+	}
+}
+
+func (a *alerts) DiskFull(dir string, free uint64) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.diskFull != nil {
+		a.diskFull(dir, free)
+	}
+}
+
+func (a *alerts) DiskAvailable(dir string, free uint64) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.diskAvailable != nil {
+		a.diskAvailable(dir, free)
+	}
+}
+
 func (a *alerts) ShuttingDown(reason error) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
@@ -1404,6 +1937,9 @@ func (fsm *fsmMock) Update(cmd []byte) interface{} {
 	fsm.mu.Lock()
 	defer fsm.mu.Unlock()
 	s := string(cmd)
+	if s == "panic" {
+		panic("fsmMock: poison command")
+	}
 	fsm.cmds = append(fsm.cmds, s)
 	if fsm.changed != nil {
 		fsm.changed(fsm.id, uint64(len(fsm.cmds)))
@@ -1414,6 +1950,9 @@ func (fsm *fsmMock) Update(cmd []byte) interface{} {
 func (fsm *fsmMock) Read(cmd interface{}) interface{} {
 	fsm.mu.Lock()
 	defer fsm.mu.Unlock()
+	if b, ok := cmd.([]byte); ok { // LocalQuery
+		cmd = string(b)
+	}
 	if cmd == "last" {
 		sz := len(fsm.cmds)
 		if sz == 0 {
@@ -1479,11 +2018,179 @@ func (fsm *fsmMock) Restore(r io.Reader) error {
 	return nil
 }
 
+func (c *cluster) newFSM(id identity) FSM {
+	fsm := &fsmMock{id: id, changed: ee.onFMSChanged}
+	if c.asyncFSM {
+		return &asyncFSMMock{fsmMock: fsm}
+	}
+	if c.forkFSM {
+		return &forkFSMMock{persistentFSMMock: &persistentFSMMock{fsmMock: fsm}}
+	}
+	if c.shardedFSM {
+		return &shardedFSMMock{fsmMock: fsm, block: c.shardBlock}
+	}
+	if c.persistentFSM {
+		return &persistentFSMMock{fsmMock: fsm}
+	}
+	if c.entryFSM {
+		return &entryFSMMock{fsmMock: fsm}
+	}
+	return fsm
+}
+
+// entryFSMMock records the entries given to UpdateEntry.
+type entryFSMMock struct {
+	*fsmMock
+	entries []LogEntry
+}
+
+var _ EntryFSM = (*entryFSMMock)(nil)
+
+func (fsm *entryFSMMock) UpdateEntry(e LogEntry) interface{} {
+	fsm.mu.Lock()
+	fsm.entries = append(fsm.entries, e)
+	fsm.mu.Unlock()
+	return fsm.Update(e.Data)
+}
+
+func (fsm *entryFSMMock) lastEntry() LogEntry {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return fsm.entries[len(fsm.entries)-1]
+}
+
+// persistentFSMMock records index of last update,
+// and number of times it is restored.
+type persistentFSMMock struct {
+	*fsmMock
+	applied  uint64
+	restores int
+}
+
+var _ PersistentFSM = (*persistentFSMMock)(nil)
+
+func (fsm *persistentFSMMock) UpdateIndex(index uint64, cmd []byte) interface{} {
+	fsm.mu.Lock()
+	fsm.applied = index
+	fsm.mu.Unlock()
+	return fsm.Update(cmd)
+}
+
+func (fsm *persistentFSMMock) LastApplied() uint64 {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return fsm.applied
+}
+
+func (fsm *persistentFSMMock) Restore(r io.Reader) error {
+	fsm.mu.Lock()
+	fsm.restores++
+	fsm.mu.Unlock()
+	return fsm.fsmMock.Restore(r)
+}
+
+func (fsm *persistentFSMMock) numRestores() int {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return fsm.restores
+}
+
+// forkFSMMock forks the commands applied so far. If forking
+// is not nil, Fork sends forked index on it, and waits until
+// it receives from it.
+type forkFSMMock struct {
+	*persistentFSMMock
+	forking chan uint64
+}
+
+var _ ForkFSM = (*forkFSMMock)(nil)
+
+func (fsm *forkFSMMock) Fork() (uint64, FSMState, error) {
+	fsm.mu.RLock()
+	index, state := fsm.applied, stateMock{append([]string(nil), fsm.cmds...)}
+	forking := fsm.forking
+	fsm.mu.RUnlock()
+	if forking != nil {
+		forking <- index
+		<-forking
+	}
+	return index, state, nil
+}
+
+func (fsm *forkFSMMock) Snapshot() (FSMState, error) {
+	panic("Snapshot called on ForkFSM")
+}
+
+// shardedFSMMock uses last byte of command as shard key.
+// If block is not nil, updates with even shard key wait
+// until it is closed.
+type shardedFSMMock struct {
+	*fsmMock
+	block chan struct{}
+}
+
+var _ ShardedFSM = (*shardedFSMMock)(nil)
+
+func (fsm *shardedFSMMock) ShardKey(cmd []byte) uint64 {
+	return uint64(cmd[len(cmd)-1])
+}
+
+func (fsm *shardedFSMMock) Update(cmd []byte) interface{} {
+	if fsm.block != nil && fsm.ShardKey(cmd)%2 == 0 {
+		<-fsm.block
+	}
+	return fsm.fsmMock.Update(cmd)
+}
+
+// asyncFSMMock applies updates immediately, but calls
+// done in reverse order, to check that raft replies
+// them in order.
+type asyncFSMMock struct {
+	*fsmMock
+	donesMu sync.Mutex
+	dones   []func()
+}
+
+var _ AsyncFSM = (*asyncFSMMock)(nil)
+
+func (fsm *asyncFSMMock) UpdateAsync(cmd []byte, done func(result interface{})) {
+	result := fsm.Update(cmd)
+	fsm.donesMu.Lock()
+	defer fsm.donesMu.Unlock()
+	fsm.dones = append(fsm.dones, func() { done(result) })
+	if len(fsm.dones) == 1 {
+		time.AfterFunc(5*time.Millisecond, func() {
+			fsm.donesMu.Lock()
+			dones := fsm.dones
+			fsm.dones = nil
+			fsm.donesMu.Unlock()
+			for i := len(dones) - 1; i >= 0; i-- {
+				dones[i]()
+			}
+		})
+	}
+}
+
 // ------------------------------------------------------------------
 
+// run tests with -debug flag, to print debug logs of all nodes
+// along with test steps. pipe the output to color.sh for readability.
+var debug = flag.Bool("debug", false, "print debug logs")
+
+// debugLogger is defaultLogger that also prints debug messages.
+type debugLogger struct {
+	defaultLogger
+}
+
+func (l *debugLogger) Debug(msg string, args ...interface{}) {
+	l.print("DEBUG", msg, args)
+}
+
 func testln(args ...interface{}) {
-	prefix := "[testing]-----------------------"
-	println(append([]interface{}{prefix}, args...)...)
+	if *debug {
+		prefix := "[testing]-----------------------"
+		fmt.Println(append([]interface{}{prefix}, args...)...)
+	}
 }
 
 func hosts(rr []*Raft) string {
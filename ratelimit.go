@@ -0,0 +1,151 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the rate of requests received from each peer.
+// RequestVote and TimeoutNow requests are never limited, so that
+// a flood of replication requests does not delay elections.
+// Requests beyond the limit wait until they are allowed.
+type RateLimit struct {
+	// PerSecond is the number of requests allowed per second.
+	// Zero value means no limit.
+	PerSecond float64
+
+	// Burst is the number of requests allowed at once, before
+	// the limit applies. Zero value means 1.
+	Burst int
+}
+
+func (l RateLimit) validate() error {
+	if l.PerSecond < 0 || l.Burst < 0 {
+		return errors.New("raft.options: negative RateLimit")
+	}
+	return nil
+}
+
+// rateLimiter implements RateLimit per peer, using
+// generic cell rate algorithm.
+type rateLimiter struct {
+	gcra
+	clock Clock
+
+	mu   sync.Mutex
+	next map[uint64]time.Time // theoretical arrival time, per peer
+}
+
+func newRateLimiter(l RateLimit, clock Clock) *rateLimiter {
+	if l.PerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		gcra:  newGCRA(l),
+		clock: clock,
+		next:  make(map[uint64]time.Time),
+	}
+}
+
+// reserve reserves a request from given peer, and returns
+// the duration to wait before the request is allowed.
+func (l *rateLimiter) reserve(nid uint64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	tat := l.next[nid]
+	if tat.Before(now) {
+		tat = now
+	}
+	l.next[nid] = tat.Add(l.interval)
+	if allowAt := tat.Add(-l.burst); allowAt.After(now) {
+		return allowAt.Sub(now)
+	}
+	return 0
+}
+
+// TenantLimiter returns an Interceptor, that limits the rate of updates
+// of each tenant, see WithTenant. limits gives RateLimit of specific
+// tenants, others are limited by fallback. Updates exceeding the limit
+// are rejected with ErrRateLimited, instead of waiting. Updates without
+// tenant are not limited. Zero PerSecond means no limit.
+//
+// The rates are measured with leader's clock, and start afresh on new
+// leader. Each command of ApplyCompositeBatch counts as an update.
+func TenantLimiter(limits map[string]RateLimit, fallback RateLimit) Interceptor {
+	l := &tenantLimiter{
+		limits:   make(map[string]gcra, len(limits)),
+		fallback: newGCRA(fallback),
+		next:     make(map[string]time.Time),
+	}
+	for tenant, limit := range limits {
+		l.limits[tenant] = newGCRA(limit)
+	}
+	return l.intercept
+}
+
+// gcra is RateLimit in terms of generic cell rate algorithm.
+type gcra struct {
+	interval time.Duration // between requests, zero if no limit
+	burst    time.Duration // interval*(Burst-1)
+}
+
+func newGCRA(l RateLimit) gcra {
+	if l.PerSecond <= 0 {
+		return gcra{}
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / l.PerSecond)
+	return gcra{interval, time.Duration(burst-1) * interval}
+}
+
+type tenantLimiter struct {
+	limits   map[string]gcra
+	fallback gcra
+
+	// interceptor can be shared by nodes running in same process
+	mu   sync.Mutex
+	next map[string]time.Time // theoretical arrival time, per tenant
+}
+
+func (l *tenantLimiter) intercept(e *LogEntry) error {
+	if e.Tenant == "" {
+		return nil
+	}
+	limit, ok := l.limits[e.Tenant]
+	if !ok {
+		limit = l.fallback
+	}
+	if limit.interval == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tat := l.next[e.Tenant]
+	if tat.Before(e.Time) {
+		tat = e.Time
+	}
+	if tat.Add(-limit.burst).After(e.Time) {
+		return ErrRateLimited
+	}
+	l.next[e.Tenant] = tat.Add(limit.interval)
+	return nil
+}
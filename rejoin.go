@@ -0,0 +1,199 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// rejoin:
+//
+// a node restarted at another address, cannot be contacted by leader,
+// since config has its old address. so the node sends identityUpdateReq
+// with Options.AdvertiseAddr to the voters in its config. Non-leader
+// replies with the leader it knows. Leader dials the new address, and
+// does the handshake, which verifies that the node at that address has
+// the same cluster id and node id, and authenticates it with Options.PeerKey.
+// Only then the address is changed in config. Leader without PeerKey rejects
+// the request, since the handshake alone does not prove identity.
+
+// requestIdentityUpdate sends identityUpdateReq to voters, until
+// address of this node in config is Options.AdvertiseAddr.
+func (r *Raft) requestIdentityUpdate() {
+	var leader uint64 // hinted by peers
+	rt := newRandTime(r.clock)
+	for failures := uint64(1); ; failures++ {
+		var peers []uint64
+		updated := false
+		err := r.inspect(func(r *Raft) {
+			self, ok := r.configs.Latest.Nodes[r.nid]
+			updated = !ok || self.Addr == r.advertiseAddr
+			if r.leader != 0 {
+				leader = r.leader
+			}
+			for id, n := range r.configs.Latest.Nodes {
+				if n.Voter && id != r.nid {
+					peers = append(peers, id)
+				}
+			}
+		})
+		if err != nil || updated {
+			return
+		}
+
+		// try leader first
+		sort.Slice(peers, func(i, j int) bool {
+			if peers[i] == leader || peers[j] == leader {
+				return peers[i] == leader
+			}
+			return peers[i] < peers[j]
+		})
+		for _, id := range peers {
+			resp, err := r.sendIdentityUpdate(id)
+			if err == nil && resp.result == success {
+				r.nodeLogger.Info("address updated by leader", "addr", r.advertiseAddr, "leader", id)
+				return
+			}
+			if err == nil && resp.result == unexpectedErr {
+				err = resp.err
+			}
+			if err != nil {
+				r.nodeLogger.Debug("identity update failed", "peer", id, "err", err)
+			}
+			if err == nil && resp.leader != 0 && resp.leader != r.nid {
+				leader = resp.leader
+			}
+		}
+
+		select {
+		case <-r.close:
+			return
+		case <-after(r.clock, r.backoff.wait(failures, rt)):
+		}
+	}
+}
+
+// sendIdentityUpdate sends identityUpdateReq to node nid, on
+// a new connection.
+func (r *Raft) sendIdentityUpdate(nid uint64) (*identityUpdateResp, error) {
+	pool := &connPool{
+		src:     r.nid,
+		cid:     r.cid,
+		nid:     nid,
+		dialFn:  r.resolver.dialFn(nid, r.dialFn),
+		clock:   r.clock,
+		tcp:     r.tcp,
+		peerKey: r.peerKey,
+	}
+	addr := r.resolver.lookupID(nid, r.hbTimeout)
+	c, err := dial(pool.dialFn, addr, r.hbTimeout, pool.tcp)
+	if err != nil {
+		return nil, err
+	}
+	defer c.rwc.Close()
+	if err = pool.handshake(c, addr, r.clock.Now().Add(r.hbTimeout)); err != nil {
+		return nil, err
+	}
+	if c.version < protocolV12 {
+		return nil, VersionError{nid, addr}
+	}
+
+	// leader prechecks new address, and commits config
+	deadline := r.clock.Now().Add(identityUpdateTimeout * r.hbTimeout)
+	req := &identityUpdateReq{req: req{src: r.nid}, addr: r.advertiseAddr}
+	resp := &identityUpdateResp{}
+	if err = c.doRPC(req, resp, deadline); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// identityUpdateTimeout is the number of heartbeat timeouts, node
+// waits for identityUpdateResp.
+const identityUpdateTimeout = 10
+
+// handleIdentityUpdate handles identityUpdateReq from node nid, that
+// is identified by handshake on the connection. The request is handled
+// in server goroutine, because leader dials the node to verify it.
+func (s *server) handleIdentityUpdate(c *conn, nid uint64) error {
+	req := &identityUpdateReq{}
+	if err := c.decodeReq(req); err != nil {
+		return err
+	}
+	s.r.nodeLogger.Debug("received", "req", req)
+	resp := &identityUpdateResp{}
+	if req.src != nid {
+		resp.result = identityMismatch
+	} else {
+		s.r.onIdentityUpdate(req, resp)
+	}
+	resp.version = req.version
+	s.r.nodeLogger.Debug("replying", "resp", resp)
+	if err := resp.encode(c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// onIdentityUpdate changes the address of node req.src in config, after
+// verifying the node at new address. It replies notLeader, if this node
+// is not leader, and ErrUnauthenticated if Options.PeerKey is not set.
+func (r *Raft) onIdentityUpdate(req *identityUpdateReq, resp *identityUpdateResp) {
+	var config Config
+	err := r.inspect(func(r *Raft) {
+		resp.term, resp.leader = r.term, r.leader
+		if r.state != Leader {
+			resp.result = notLeader
+			return
+		}
+		n, ok := r.configs.Latest.Nodes[req.src]
+		switch {
+		case r.peerKey == nil:
+			resp.result, resp.err = unexpectedErr, ErrUnauthenticated
+		case !ok:
+			resp.result, resp.err = unexpectedErr, fmt.Errorf("raft: node %d is not in config", req.src)
+		case n.Addr == req.addr:
+			resp.result = success
+		default:
+			config = r.configs.Latest.clone()
+		}
+	})
+	if err != nil {
+		resp.result, resp.err = unexpectedErr, err
+		return
+	}
+	if config.Nodes == nil {
+		return
+	}
+
+	err = config.SetAddr(req.src, req.addr)
+	if err == nil {
+		r.nodeLogger.Info("updating address of node", "peer", req.src, "addr", req.addr)
+		err = r.precheckNode(req.src, req.addr)
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 4*r.hbTimeout)
+		defer cancel()
+		err = r.ChangeConfig(ctx, config)
+	}
+	if err != nil {
+		r.nodeLogger.Warn("updating address of node failed", "peer", req.src, "addr", req.addr, "err", err)
+		resp.result, resp.err = unexpectedErr, err
+		return
+	}
+	resp.result = success
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+)
+
+// tests that node restarted at different address with
+// Options.AdvertiseAddr, gets its address updated by leader
+func TestRaft_rejoin_addrChange(t *testing.T) {
+	c := newCluster(t)
+	c.opt.PeerKey = SharedKey([]byte("secret"))
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// stop one of follower
+	c.shutdown(flrs[0])
+	_ = c.waitUnreachableDetected(ldr, flrs[0])
+
+	// restart follower at different address, with AdvertiseAddr
+	c.ports[flrs[0].nid] = 9999
+	c.opt.AdvertiseAddr = c.id2Addr(flrs[0].nid)
+	flrs[0] = c.restart(flrs[0])
+	c.opt.AdvertiseAddr = ""
+
+	// leader must update address in config and reach the follower
+	c.waitReachableDetected(ldr, flrs[0])
+	for _, r := range []*Raft{ldr, flrs[0]} {
+		addrUpdated := func() bool {
+			return c.info(r).Configs.Committed.Nodes[flrs[0].nid].Addr == c.id2Addr(flrs[0].nid)
+		}
+		if !waitForCondition(addrUpdated, c.commitTimeout, c.longTimeout) {
+			t.Fatalf("M%d: address is not updated in config", r.nid)
+		}
+	}
+	c.ensure(waitUpdate(ldr, "test", c.longTimeout))
+	c.waitFSMLen(1)
+}
+
+// tests that address is not updated, if the node at
+// AdvertiseAddr is not of same identity
+func TestRaft_rejoin_identityMismatch(t *testing.T) {
+	c := newCluster(t)
+	c.opt.PeerKey = SharedKey([]byte("secret"))
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	flr := flrs[0]
+
+	// M4 is listening at new address
+	c.launch(1, false)
+	resp := &identityUpdateResp{}
+	req := &identityUpdateReq{req: req{src: flr.nid}, addr: c.id2Addr(4)}
+	ldr.onIdentityUpdate(req, resp)
+	if resp.result != unexpectedErr {
+		t.Fatalf("result: got %v, want %v", resp.result, unexpectedErr)
+	}
+	if err, ok := resp.err.(PrecheckError); !ok {
+		t.Fatalf("err: got %T, want PrecheckError", resp.err)
+	} else if _, ok := err.Err.(IdentityError); !ok {
+		t.Fatalf("err: got %v, want IdentityError", err.Err)
+	}
+	if got := c.info(ldr).Configs.Latest.Nodes[flr.nid].Addr; got != c.id2Addr(flr.nid) {
+		t.Fatalf("addr: got %s, want %s", got, c.id2Addr(flr.nid))
+	}
+
+	// non-leader replies with leader
+	resp = &identityUpdateResp{}
+	flrs[1].onIdentityUpdate(req, resp)
+	if resp.result != notLeader || resp.leader != ldr.nid {
+		t.Fatalf("resp: got %v/M%d, want %v/M%d", resp.result, resp.leader, notLeader, ldr.nid)
+	}
+}
+
+// tests that leader without Options.PeerKey rejects address
+// update, since identity of the node is not authenticated
+func TestRaft_rejoin_unauthenticated(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	flr := flrs[0]
+
+	// request to move address of flr to another host
+	resp := &identityUpdateResp{}
+	req := &identityUpdateReq{req: req{src: flr.nid}, addr: c.id2Addr(4)}
+	ldr.onIdentityUpdate(req, resp)
+	if resp.result != unexpectedErr || resp.err != ErrUnauthenticated {
+		t.Fatalf("resp: got %v/%v, want %v/%v", resp.result, resp.err, unexpectedErr, ErrUnauthenticated)
+	}
+	if got := c.info(ldr).Configs.Latest.Nodes[flr.nid].Addr; got != c.id2Addr(flr.nid) {
+		t.Fatalf("addr: got %s, want %s", got, c.id2Addr(flr.nid))
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+// Replayer sends the requests received by a node, as recorded in
+// Options.CaptureFile, to node NID of cluster CID. Requests are sent
+// at the same intervals as they were received, measured using Clock,
+// so that problems such as election storms can be reproduced in test
+// environment. See sim.Cluster.Replay.
+//
+// Requests from each peer are sent on separate connection, which is
+// dialed using Dial. Identity handshake is done with CID and NID,
+// rather than the recorded one. Snapshot requests are not replayed,
+// because snapshot data is not recorded. AppendEntries requests are
+// sent without entries, unless Options.CaptureEntries was set.
+//
+// Responses are read and discarded. Errors in sending a request are
+// ignored, and the connection is dialed again for next request.
+type Replayer struct {
+	CID, NID uint64
+
+	// Dial connects to the node, on behalf of node from.
+	Dial func(from uint64) (net.Conn, error)
+
+	// Clock used to wait between requests. If nil, system clock is used.
+	Clock Clock
+
+	// Timeout for each request. Zero means 5 seconds.
+	Timeout time.Duration
+
+	conns   map[uint64]*conn
+	pending map[uint64]*replayAppend // appendReq waiting for its entries
+}
+
+type replayAppend struct {
+	req     *appendReq
+	entries net.Buffers
+}
+
+// Replay replays the capture read from r. It returns error only
+// if capture could not be read.
+func (rp *Replayer) Replay(r io.Reader) error {
+	if rp.Clock == nil {
+		rp.Clock = realClock{}
+	}
+	if rp.Timeout <= 0 {
+		rp.Timeout = 5 * time.Second
+	}
+	rp.conns = make(map[uint64]*conn)
+	rp.pending = make(map[uint64]*replayAppend)
+	defer func() {
+		for _, c := range rp.conns {
+			_ = c.rwc.Close()
+		}
+	}()
+
+	var last time.Time
+	err := ReadCapture(r, func(rec CaptureRecord) error {
+		if !rec.Inbound || rec.Kind == CaptureResponse {
+			return nil
+		}
+		if !last.IsZero() && rec.Time.After(last) {
+			<-after(rp.Clock, rec.Time.Sub(last))
+		}
+		last = rec.Time
+		return rp.replay(rec)
+	})
+	for peer := range rp.pending {
+		rp.flush(peer)
+	}
+	return err
+}
+
+func (rp *Replayer) replay(rec CaptureRecord) error {
+	if rec.Kind == CaptureEntry {
+		if p, ok := rp.pending[rec.Peer]; ok {
+			p.entries = append(p.entries, rec.Data)
+			if uint64(len(p.entries)) == p.req.numEntries {
+				rp.flush(rec.Peer)
+			}
+		}
+		return nil
+	}
+
+	// entries of pending appendReq are not recorded
+	rp.flush(rec.Peer)
+	m, err := rec.decode()
+	if err != nil {
+		return err
+	}
+	switch req := m.(type) {
+	case *voteReq, *timeoutNowReq:
+		rp.send(rec.Peer, req.(request), nil)
+	case *appendReq:
+		if req.numEntries > 0 {
+			rp.pending[rec.Peer] = &replayAppend{req: req}
+		} else {
+			rp.send(rec.Peer, req, nil)
+		}
+	}
+	return nil
+}
+
+// flush sends pending appendReq of peer, with the entries received so far.
+func (rp *Replayer) flush(peer uint64) {
+	if p, ok := rp.pending[peer]; ok {
+		delete(rp.pending, peer)
+		rp.send(peer, p.req, p.entries)
+	}
+}
+
+func (rp *Replayer) send(peer uint64, req request, entries net.Buffers) {
+	deadline := rp.Clock.Now().Add(rp.Timeout)
+	err := func() error {
+		c, err := rp.getConn(peer, deadline)
+		if err != nil {
+			return err
+		}
+		var resp response
+		switch req := req.(type) {
+		case *voteReq:
+			resp = &voteResp{}
+		case *timeoutNowReq:
+			resp = &timeoutNowResp{}
+		case *appendReq:
+			req.numEntries, req.compressedSize = uint64(len(entries)), 0
+			resp = &appendResp{}
+		}
+		if err = c.writeReq(req, deadline); err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			if _, err = entries.WriteTo(c.rwc); err != nil {
+				return err
+			}
+		}
+		return c.readResp(resp, deadline)
+	}()
+	if err != nil {
+		if c, ok := rp.conns[peer]; ok {
+			_ = c.rwc.Close()
+			delete(rp.conns, peer)
+		}
+	}
+}
+
+func (rp *Replayer) getConn(peer uint64, deadline time.Time) (*conn, error) {
+	if c, ok := rp.conns[peer]; ok {
+		return c, nil
+	}
+	rwc, err := rp.Dial(peer)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		rwc:     rwc,
+		bufr:    bufio.NewReader(rwc),
+		bufw:    bufio.NewWriter(rwc),
+		version: maxProtocol,
+	}
+	pool := &connPool{src: peer, cid: rp.CID, nid: rp.NID, clock: rp.Clock}
+	if err = pool.handshake(c, rwc.RemoteAddr().String(), deadline); err != nil {
+		_ = rwc.Close()
+		return nil, err
+	}
+	rp.conns[peer] = c
+	return c, nil
+}
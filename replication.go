@@ -16,15 +16,29 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/santhosh-tekuri/raft/log"
 )
 
 type replication struct {
+	// see setAck. accessed atomically, and
+	// must be first fields for 64-bit alignment
+	ack     int64
+	latency int64
+	skew    int64  // see setSkew
+	lastAck int64  // see setReplicated
+	rate    uint64 // see setReplicated
+
+	clock  Clock
 	rtime  randTime
 	status replicationStatus // owned by ldr goroutine
 
@@ -34,6 +48,18 @@ type replication struct {
 	hbTimeout time.Duration
 	timer     *safeTimer
 	bandwidth int64
+	backoff   Backoff
+	breaker   breaker
+	timeouts  RPCTimeouts
+	tracing   Tracer
+	logger    *logger
+	pipeline  int // see Options.PipelineSize
+
+	// if true, asks leader for a follower to send snapshot
+	delegateSnaps bool
+
+	// nil, if replication is not throttled
+	throttle *throttle
 
 	ldrStartIndex uint64
 	ldrLastIndex  uint64 // todo: directly use log.lastIndex
@@ -46,15 +72,34 @@ type replication struct {
 	// zero value means node is reachable
 	noContact time.Time
 
+	// last time node responded. noContact is
+	// back-dated to this, when request times out
+	lastResp time.Time
+
+	// true if latency is more than half of hbTimeout
+	slowRTT bool
+
+	// protocol version negotiated by recent conn
+	version uint8
+
+	// entries replicated since rateStart, see setReplicated
+	rateStart   time.Time
+	rateEntries uint64
+
+	// see Options.MaxClockSkew
+	maxClockSkew time.Duration
+	skewExceeded bool
+
+	// other nodes reachable by node, see appendResp.peers
+	peers []uint64
+
 	leaderUpdateCh chan leaderUpdate
 	replUpdateCh   chan<- replUpdate
 	stopCh         chan struct{}
 }
 
 func (r *replication) runLoop(req *appendReq) {
-	if trace {
-		println(r, "repl.start")
-	}
+	r.logger.Debug("replication started")
 	var c *conn
 	defer func() {
 		if c != nil && c.rwc != nil {
@@ -71,23 +116,48 @@ func (r *replication) runLoop(req *appendReq) {
 			if failures == 1 {
 				r.notifyNoContact(err)
 			}
-			r.timer.reset(backOff(failures, r.hbTimeout/2))
+			switch {
+			case r.breaker.state == BreakerOpen:
+				r.timer.reset(r.breaker.Timeout)
+			case isTimeout(err):
+				// node may be just slow, and we already waited
+				// for the timeout. so do not grow the wait
+				r.timer.reset(r.backoff.wait(1, r.rtime))
+			default:
+				r.timer.reset(r.backoff.wait(failures, r.rtime))
+			}
 			select {
 			case <-r.stopCh:
 				return
 			case <-r.timer.C:
 				r.timer.active = false
 			}
+			if r.breaker.state == BreakerOpen {
+				r.breaker.state = BreakerHalfOpen
+				r.notifyLdr(breakerChanged{BreakerHalfOpen})
+			}
 			if _, err = r.checkLeaderUpdate(r.stopCh, req, false); err == errStop {
 				return
 			}
 		}
 
 		if c == nil {
-			if c, err = r.connPool.getConn(r.deadline()); err != nil {
+			if c, err = r.connPool.getConn(r.deadline(r.timeouts.Heartbeat)); err != nil {
 				failures++
+				if r.breaker.onFailure() {
+					r.logger.Debug("breaker opened", "err", err)
+					r.notifyLdr(breakerChanged{BreakerOpen})
+				}
 				continue
 			}
+			r.lastResp = r.clock.Now()
+			if c.version != r.version {
+				r.version = c.version
+				r.notifyLdr(negotiated{c.version})
+			}
+			if r.breaker.onSuccess() {
+				r.notifyLdr(breakerChanged{BreakerClosed})
+			}
 			if failures > 0 {
 				failures = 0
 				r.notifyNoContact(nil)
@@ -120,7 +190,8 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 	for {
 		// find matchIndex ---------------------------------------------------
 		for {
-			err := r.writeAppendEntriesReq(c, req, false)
+			sent := r.clock.Now()
+			_, err := r.writeAppendEntriesReq(c, req, false)
 			if err == log.ErrNotFound {
 				if err = r.sendInstallSnapReq(c, req); err == nil {
 					continue
@@ -130,9 +201,13 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 				return err
 			}
 
-			if err = c.readResp(resp, r.deadline()); err != nil {
+			if err = c.readResp(resp, r.deadline(r.timeouts.Heartbeat)); err != nil {
 				return err
 			}
+			if resp.result != staleTerm {
+				r.setAck(sent)
+				r.setSkew(sent, resp.time)
+			}
 			if err = r.onAppendEntriesResp(resp, r.nextIndex-1); err != nil {
 				return err
 			}
@@ -153,18 +228,22 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 		// todo: before starting pipeline, check if sending snap
 		//       is better than sending lots of entries
 
-		if trace {
-			println(r, "pipelining.............................")
-		}
+		r.logger.Debug("pipelining", "nextIndex", r.nextIndex)
 		// pipelining ---------------------------------------------------------
 		type result struct {
 			lastIndex uint64
+			sent      time.Time
+			timeout   time.Duration
+			span      Span
 			err       error
 		}
 		var (
-			resultCh = make(chan result, 128)
+			resultCh = make(chan result, r.pipeline)
 			stopCh   = make(chan struct{})
 		)
+		if r.throttle != nil {
+			r.throttle.reset(r.matchIndex)
+		}
 		go func() {
 			defer func() {
 				close(resultCh)
@@ -172,17 +251,26 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 					select {
 					case <-stopCh:
 						return
-					case resultCh <- result{0, recoverErr(v)}:
+					case resultCh <- result{0, time.Time{}, 0, nopSpan{}, recoverErr(v)}:
 					}
 				}
 			}()
 			for {
-				err := r.writeAppendEntriesReq(c, req, true)
-				select {
-				case <-stopCh:
-					return
-				case resultCh <- result{r.nextIndex - 1, err}:
+				sendEntries := true
+				if r.throttle != nil && r.nextIndex <= r.ldrLastIndex {
+					// if still throttled, send heartbeat
+					ok, err := r.waitThrottle(stopCh, r.hbTimeout/2)
+					if err != nil {
+						return
+					}
+					sendEntries = ok
 				}
+				sent := r.clock.Now()
+				span, err := r.writeAppendEntriesReq(c, req, sendEntries)
+				// result is sent even if stopped, so that its response
+				// is drained before conn is returned to pool. all paths
+				// that close stopCh, drain resultCh until closed
+				resultCh <- result{r.nextIndex - 1, sent, r.rpcTimeout(req), span, err}
 				if err != nil {
 					return
 				}
@@ -197,16 +285,18 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 					// we have not received responses for all requests yet
 					// so no need to flood him with heartbeat
 					// take a nap and check again
-					if trace {
-						println(r, "no heartbeat, pending resps:", len(resultCh))
-					}
+					r.logger.Debug("skipping heartbeat", "pending", len(resultCh))
 				}
 			}
 		}()
 
 		drainResps := func() error {
-			for range resultCh {
-				if err := c.readResp(resp, r.deadline()); err != nil {
+			for result := range resultCh {
+				result.span.End()
+				if result.err != nil {
+					return result.err
+				}
+				if err := c.readResp(resp, r.deadline(result.timeout)); err != nil {
 					return err
 				}
 			}
@@ -219,22 +309,15 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 			}()
 			select {
 			case err := <-drained:
-				if trace {
-					println(r, "drain completed with error:", err)
-				}
+				r.logger.Debug("drained responses", "err", err)
 				if err != nil {
 					_ = c.rwc.Close()
 					c.rwc = nil // to signal runLoop that we closed the conn
 				}
-			case <-time.After(timeout):
-				if trace {
-					println(r, "drain timeout, closing conn")
-				}
+			case <-after(r.clock, timeout):
+				r.logger.Debug("draining responses timed out, closing connection")
 				_ = c.rwc.Close()
 				<-drained
-				if trace {
-					println(r, "drain completed")
-				}
 				c.rwc = nil // to signal runLoop that we closed the conn
 			}
 		}
@@ -244,28 +327,24 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 			var result result
 			select {
 			case <-r.stopCh:
-				if trace {
-					println(r, "ending pipeline, got stop signal from ldr")
-				}
+				r.logger.Debug("ending pipeline, stopped by leader")
 				close(stopCh)
 				drainRespsTimeout(r.hbTimeout / 2)
 				return errStop
 			case result = <-resultCh:
 			}
 			if result.err != nil {
-				if trace {
-					println(r, "pipeline ended with", result.err)
-				}
+				result.span.End()
+				r.logger.Debug("ending pipeline", "err", result.err)
 				if result.err == log.ErrNotFound {
 					break
 				}
 				return result.err
 			}
-			err = c.readResp(resp, r.deadline())
+			err = c.readResp(resp, r.deadline(result.timeout))
+			result.span.End()
 			if err != nil {
-				if trace {
-					println(r, "ending pipeline, error in reading resp:", err)
-				}
+				r.logger.Debug("ending pipeline, reading response failed", "err", err)
 				close(stopCh)
 				_ = c.rwc.Close()
 				for range resultCh {
@@ -273,12 +352,17 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 				c.rwc = nil
 				return err
 			}
+			if resp.result != staleTerm {
+				r.setAck(result.sent)
+				r.setSkew(result.sent, resp.time)
+			}
 			if resp.result == success {
 				_ = r.onAppendEntriesResp(resp, result.lastIndex)
-			} else {
-				if trace {
-					println(r, "ending pipeline, got resp.result", resp.result)
+				if r.throttle != nil {
+					r.throttle.ack(result.lastIndex)
 				}
+			} else {
+				r.logger.Debug("ending pipeline", "result", resp.result.String())
 				close(stopCh)
 				if resp.result == staleTerm {
 					drainRespsTimeout(r.hbTimeout / 2)
@@ -296,7 +380,7 @@ func (r *replication) replicate(c *conn, req *appendReq) error {
 const maxAppendEntries = 64
 
 // note: never access f.matchIndex in this method, because this is used by pipeline writer also
-func (r *replication) writeAppendEntriesReq(c *conn, req *appendReq, sendEntries bool) error {
+func (r *replication) writeAppendEntriesReq(c *conn, req *appendReq, sendEntries bool) (Span, error) {
 	snapIndex, snapTerm := r.snaps.latest()
 
 	// fill req.prevLogXXX
@@ -308,57 +392,82 @@ func (r *replication) writeAppendEntriesReq(c *conn, req *appendReq, sendEntries
 	} else {
 		term, err := r.getEntryTerm(req.prevLogIndex)
 		if err != nil { // should be in snapshot
-			return err
+			return nopSpan{}, err
 		}
 		req.prevLogTerm = term
 	}
 
-	req.numEntries = 0
+	req.numEntries, req.compressedSize = 0, 0
 	if sendEntries {
 		req.numEntries = min(r.ldrLastIndex-req.prevLogIndex, maxAppendEntries)
 		if req.numEntries > 0 && !r.log.Contains(r.nextIndex) {
-			return log.ErrNotFound
+			return nopSpan{}, log.ErrNotFound
 		}
 	}
-
-	if trace {
-		if sendEntries && req.numEntries == 0 {
-			println(r, ">> heartbeat")
-		} else {
-			println(r, ">>", req)
+	// entries are sent as read from log, without decoding them. buffs
+	// reference mmapped log, which is valid until they are written,
+	// because log is not compacted beyond what replication has sent
+	var buffs net.Buffers
+	if req.numEntries > 0 {
+		buffs = r.getEntries(r.nextIndex, req.numEntries)
+		c.capture.logEntries(false, r.status.id, buffs...)
+		if c.version < protocolV7 {
+			if err := checkEntries(buffs, c.version); err != nil {
+				return nopSpan{}, err
+			}
+		}
+		if c.version < protocolV3 {
+			buffs = stripEntryMeta(buffs)
+		}
+		if c.compress {
+			if block := compressEntries(buffs); block != nil {
+				buffs, req.compressedSize = net.Buffers{block}, uint32(len(block))
+			}
 		}
 	}
-	if err := c.writeReq(req, r.deadline()); err != nil {
-		return err
+
+	// span for requests with entries, ended on response
+	var span Span = nopSpan{}
+	req.trace = nil
+	if req.numEntries > 0 {
+		var ctx context.Context
+		ctx, span = r.tracing.Start(context.Background(), "raft.appendEntries")
+		span.SetAttribute("raft.target", r.status.id)
+		span.SetAttribute("raft.prevLogIndex", req.prevLogIndex)
+		span.SetAttribute("raft.numEntries", req.numEntries)
+		req.trace = r.tracing.Inject(ctx)
+	}
+
+	r.logger.Debug("sending", "req", req)
+	if err := c.writeReq(req, r.deadline(r.rpcTimeout(req))); err != nil {
+		return span, err
 	}
 	if req.numEntries > 0 {
-		if err := r.writeEntriesTo(c, r.nextIndex, req.numEntries); err != nil {
-			return err
+		if err := r.writeEntriesTo(c, buffs); err != nil {
+			return span, err
 		}
 		r.nextIndex += req.numEntries
-		if trace {
-			println(r, "nextIndex:", r.nextIndex)
-		}
 	}
-	return nil
+	return span, nil
 }
 
 func (r *replication) onAppendEntriesResp(resp *appendResp, reqLastIndex uint64) error {
-	if trace {
-		println(r, "<<", resp)
-	}
+	r.logger.Debug("received", "resp", resp)
 	switch resp.result {
 	case staleTerm:
 		r.notifyLdr(newTerm{resp.getTerm()})
 		return errStop
 	case success:
+		r.setPeers(resp.peers)
+		var n uint64
 		if reqLastIndex > r.matchIndex {
-			r.matchIndex = reqLastIndex
-			if trace {
-				println(r, "matchIndex:", r.matchIndex)
+			if r.matchIndex != 0 {
+				n = reqLastIndex - r.matchIndex
 			}
+			r.matchIndex = reqLastIndex
 			r.notifyLdr(matchIndex{r.matchIndex})
 		}
+		r.setReplicated(n)
 		return nil
 	case prevEntryNotFound, prevTermMismatch:
 		if resp.lastLogIndex < r.matchIndex {
@@ -366,9 +475,10 @@ func (r *replication) onAppendEntriesResp(resp *appendResp, reqLastIndex uint64)
 			return ErrFaultyFollower
 		}
 		r.nextIndex = min(r.nextIndex-1, resp.lastLogIndex+1)
-		if trace {
-			println(r, "nextIndex:", r.nextIndex)
+		if resp.conflictTerm != 0 && resp.conflictIndex < r.nextIndex {
+			r.nextIndex = max(r.backtrack(resp.conflictTerm, resp.conflictIndex), r.matchIndex+1)
 		}
+		r.logger.Debug("log mismatch", "result", resp.result.String(), "nextIndex", r.nextIndex, "conflictTerm", resp.conflictTerm)
 		return nil
 	case unexpectedErr:
 		return remoteError{resp.err}
@@ -377,7 +487,80 @@ func (r *replication) onAppendEntriesResp(resp *appendResp, reqLastIndex uint64)
 	}
 }
 
+// setPeers records the nodes reachable by node, and notifies
+// leader if they are changed.
+func (r *replication) setPeers(peers []uint64) {
+	if len(peers) == len(r.peers) {
+		changed := false
+		for i := range peers {
+			changed = changed || peers[i] != r.peers[i]
+		}
+		if !changed {
+			return
+		}
+	}
+	r.peers = peers
+	r.notifyLdr(peerView{peers})
+}
+
+// interval at which rate of replication is sampled
+const rateInterval = time.Second
+
+// setReplicated records that node successfully responded to
+// AppendEntries request, replicating n entries. The rate of replication
+// is sampled every rateInterval, and smoothed with exponentially
+// weighted moving average. Heartbeats are sampled too, so that rate
+// decays when there is nothing to replicate.
+//
+// must be called only from replication goroutine.
+func (r *replication) setReplicated(n uint64) {
+	now := r.clock.Now()
+	atomic.StoreInt64(&r.lastAck, now.UnixNano())
+	if r.rateStart.IsZero() {
+		r.rateStart = now
+		return
+	}
+	r.rateEntries += n
+	elapsed := now.Sub(r.rateStart)
+	if elapsed < rateInterval {
+		return
+	}
+	rate := float64(r.rateEntries) / elapsed.Seconds()
+	if old := r.getRate(); old != 0 {
+		rate = (7*old + rate) / 8
+	}
+	atomic.StoreUint64(&r.rate, math.Float64bits(rate))
+	r.rateStart, r.rateEntries = now, 0
+}
+
+// getRate returns the entries replicated per second,
+// recorded by setReplicated.
+func (r *replication) getRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.rate))
+}
+
+// getLastAck returns the time of last successful AppendEntries
+// response. returns nil if there is no such response.
+func (r *replication) getLastAck() *time.Time {
+	if nano := atomic.LoadInt64(&r.lastAck); nano != 0 {
+		t := time.Unix(0, nano)
+		return &t
+	}
+	return nil
+}
+
 func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
+	if r.delegateSnaps {
+		lastIndex, err := r.delegateInstallSnap(appReq)
+		if err == nil {
+			return r.onSnapInstalled(appReq, lastIndex)
+		} else if err == errStop {
+			return err
+		}
+		r.logger.Warn("delegated snapshot failed", "err", err)
+		// fallback: send our own snapshot
+	}
+
 	snap, err := r.snaps.open()
 	if err != nil {
 		return opError(err, "snapshots.open")
@@ -390,22 +573,28 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 		lastTerm:   snap.meta.term,
 		lastConfig: snap.meta.config,
 		size:       snap.meta.size,
+		results:    snap.meta.results,
 	}
-	if trace {
-		println(r, ">>", req)
-	}
-	if err = c.writeReq(req, r.deadline()); err != nil {
-		return err
-	}
-	if err := c.rwc.SetWriteDeadline(r.deadlineSize(req.size)); err != nil {
+	r.logger.Info("sending snapshot", "index", req.lastIndex, "size", req.size)
+	if err = c.writeReq(req, r.deadline(r.timeouts.SnapshotChunk)); err != nil {
 		return err
 	}
-	if _, err = io.Copy(c.rwc, snap.file); err != nil { // will use sendFile
-		return err
+	for remaining := req.size; remaining > 0; {
+		chunk := remaining
+		if chunk > snapChunkSize {
+			chunk = snapChunkSize
+		}
+		if err := c.rwc.SetWriteDeadline(r.deadlineSize(r.timeouts.SnapshotChunk, chunk)); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(c.rwc, snap.data, chunk); err != nil { // will use sendFile, if not encrypted
+			return err
+		}
+		remaining -= chunk
 	}
 
 	resp := &installSnapResp{}
-	if err = c.readResp(resp, time.Now().Add(4*r.hbTimeout)); err != nil { // todo: is 2*hbTimeout enough for saving snap
+	if err = c.readResp(resp, r.deadline(r.timeouts.InstallSnapshot)); err != nil {
 		return err
 	}
 	switch resp.result {
@@ -413,20 +602,7 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 		r.notifyLdr(newTerm{resp.getTerm()})
 		return errStop
 	case success:
-		// case: snapshot was taken before we got leaderUpdate about lastLogIndex
-		// we should wait until we get our logview gets updated
-		for req.lastIndex > r.ldrLastIndex {
-			if _, err := r.checkLeaderUpdate(r.stopCh, appReq, false); err != nil {
-				return err
-			}
-		}
-		r.matchIndex = req.lastIndex
-		r.nextIndex = r.matchIndex + 1
-		if trace {
-			println(r, "matchIndex:", r.matchIndex, "nextIndex:", r.nextIndex)
-		}
-		r.notifyLdr(matchIndex{r.matchIndex})
-		return nil
+		return r.onSnapInstalled(appReq, req.lastIndex)
 	case unexpectedErr:
 		return remoteError{resp.err}
 	default:
@@ -434,6 +610,21 @@ func (r *replication) sendInstallSnapReq(c *conn, appReq *appendReq) error {
 	}
 }
 
+func (r *replication) onSnapInstalled(appReq *appendReq, lastIndex uint64) error {
+	// case: snapshot was taken before we got leaderUpdate about lastLogIndex
+	// we should wait until we get our logview gets updated
+	for lastIndex > r.ldrLastIndex {
+		if _, err := r.checkLeaderUpdate(r.stopCh, appReq, false); err != nil {
+			return err
+		}
+	}
+	r.matchIndex = lastIndex
+	r.nextIndex = r.matchIndex + 1
+	r.logger.Debug("snapshot installed", "matchIndex", r.matchIndex)
+	r.notifyLdr(matchIndex{r.matchIndex})
+	return nil
+}
+
 func (r *replication) checkLeaderUpdate(stopCh <-chan struct{}, req *appendReq, sendEntries bool) (ldrUpdate bool, err error) {
 	if sendEntries && r.nextIndex > r.ldrLastIndex {
 		// for nonvoter, dont send heartbeats
@@ -469,9 +660,7 @@ func (r *replication) checkLeaderUpdate(stopCh <-chan struct{}, req *appendReq,
 }
 
 func (r *replication) onLeaderUpdate(u leaderUpdate, req *appendReq) {
-	if trace {
-		println(r, u)
-	}
+	r.logger.Debug("leader update", "update", u)
 	if u.log.PrevIndex() > r.log.PrevIndex() {
 		r.notifyLdr(removeLTE{u.log.PrevIndex()})
 	}
@@ -491,20 +680,48 @@ func (r *replication) notifyLdr(u interface{}) {
 
 func (r *replication) notifyNoContact(err error) {
 	if err != nil {
-		r.noContact = time.Now()
-		if trace {
-			println(r, "noContact", err)
+		r.noContact = r.clock.Now()
+		if isTimeout(err) && !r.lastResp.IsZero() {
+			// node did not respond since then
+			r.noContact = r.lastResp
 		}
+		r.logger.Debug("no contact", "err", err)
 		r.notifyLdr(noContact{r.noContact, err})
 	} else {
 		r.noContact = time.Time{} // zeroing
-		if trace {
-			println(r, "yesContact")
-		}
+		r.logger.Debug("contact restored")
 		r.notifyLdr(noContact{r.noContact, nil})
 	}
 }
 
+// backtrack returns nextIndex, when follower's entries from index first
+// upto nextIndex-1 are of given term, and do not match with leader's log.
+// If leader has entries of that term, they start at first as per Log
+// Matching property, so nextIndex is the one after the last of them.
+// Otherwise all entries of that term in follower's log are skipped.
+func (r *replication) backtrack(term, first uint64) uint64 {
+	last := min(r.nextIndex, r.ldrLastIndex+1)
+	if first >= last || !r.log.Contains(first) {
+		return first
+	}
+	// terms in log never decrease, so binary search
+	// for first entry with term greater than given term
+	i := sort.Search(int(last-first), func(i int) bool {
+		t, err := r.getEntryTerm(first + uint64(i))
+		if err != nil {
+			panic(opError(err, "Log.Get(%d)", first+uint64(i)))
+		}
+		return t > term
+	})
+	if i == 0 {
+		return first
+	}
+	if t, _ := r.getEntryTerm(first + uint64(i) - 1); t != term {
+		return first
+	}
+	return first + uint64(i)
+}
+
 func (r *replication) getEntryTerm(i uint64) (uint64, error) {
 	b, err := r.log.Get(i)
 	if err == log.ErrNotFound {
@@ -512,36 +729,117 @@ func (r *replication) getEntryTerm(i uint64) (uint64, error) {
 	} else if err != nil {
 		panic(opError(err, "Log.Get(%d)", i))
 	}
-	e := &entry{}
-	if err = e.decode(bytes.NewReader(b)); err != nil {
-		panic(opError(err, "log.Get(%d).decode()", i))
+	if len(b) < entryHeaderLen {
+		panic(opError(io.ErrUnexpectedEOF, "log.Get(%d).decode()", i))
 	}
-	return e.term, nil
+	return rawEntry(b).term(), nil
 }
 
-func (r *replication) writeEntriesTo(c *conn, from uint64, n uint64) error {
+func (r *replication) getEntries(from uint64, n uint64) net.Buffers {
 	buffs, err := r.log.GetN(from, n)
 	if err != nil {
 		panic(opError(err, "Log.GetN(%d, %d)", from, n))
 	}
-	nbuffs := net.Buffers(buffs)
-	if err := c.rwc.SetWriteDeadline(r.deadlineSize(size(nbuffs))); err != nil {
+	return buffs
+}
+
+func (r *replication) writeEntriesTo(c *conn, buffs net.Buffers) error {
+	if r.throttle != nil {
+		r.throttle.sent(size(buffs))
+	}
+	if err := c.rwc.SetWriteDeadline(r.deadlineSize(r.timeouts.AppendEntries, size(buffs))); err != nil {
 		return err
 	}
-	_, err = nbuffs.WriteTo(c.rwc)
+	_, err := buffs.WriteTo(c.rwc)
 	return err
 }
 
-func (r *replication) deadline() time.Time {
-	return time.Now().Add(2 * r.hbTimeout)
+// stripEntryMeta returns the entries without metadata, for nodes
+// that do not support protocolV3. Only headers of entries with
+// metadata are copied, the rest reference the given buffs.
+func stripEntryMeta(buffs net.Buffers) net.Buffers {
+	var stripped net.Buffers
+	for _, b := range buffs {
+		start := 0 // of entries without metadata, not yet added
+		for off := 0; off < len(b); {
+			n, headerLen, err := nextEntry(b[off:])
+			if err != nil {
+				panic(bug{"nextEntry", err})
+			}
+			if headerLen == entryMetaHeaderLen {
+				if start < off {
+					stripped = append(stripped, b[start:off])
+				}
+				header := make([]byte, entryHeaderLen)
+				copy(header, b[off:off+17])
+				header[16] &^= entryMeta
+				copy(header[17:], b[off+headerLen-4:off+headerLen])
+				stripped = append(stripped, header, b[off+headerLen:off+n])
+				start = off + n
+			}
+			off += n
+		}
+		if start < len(b) {
+			stripped = append(stripped, b[start:])
+		}
+	}
+	return stripped
+}
+
+// checkEntries returns error, if the entries contain batch entry for
+// versions before protocolV7, or updateOnce entry for versions before
+// protocolV5. Such entries cannot be downgraded.
+func checkEntries(buffs net.Buffers, version uint8) error {
+	for _, b := range buffs {
+		for off := 0; off < len(b); {
+			n, _, err := nextEntry(b[off:])
+			if err != nil {
+				panic(bug{"nextEntry", err})
+			}
+			raw := rawEntry(b[off:])
+			if typ := raw.typ(); typ == entryBatch || (typ == entryUpdateOnce && version < protocolV5) {
+				return fmt.Errorf("raft: entry %d of type %s is not supported by protocol version %d", raw.index(), typ, version)
+			}
+			off += n
+		}
+	}
+	return nil
+}
+
+// compressEntries returns the entries as single snappy block.
+// Returns nil, if compression does not save any bytes.
+func compressEntries(buffs net.Buffers) []byte {
+	n := size(buffs)
+	if n > maxBytes {
+		return nil
+	}
+	block := snappy.Encode(nil, bytes.Join(buffs, nil))
+	if int64(len(block)) >= n {
+		return nil
+	}
+	return block
+}
+
+func (r *replication) deadline(timeout time.Duration) time.Time {
+	return r.clock.Now().Add(timeout)
 }
 
-func (r *replication) deadlineSize(size int64) time.Time {
-	timeout := durationFor(r.bandwidth, size)
-	if timeout < 2*r.hbTimeout {
-		timeout = 2 * r.hbTimeout
+// deadlineSize returns deadline for transferring size bytes,
+// which is not earlier than the given timeout.
+func (r *replication) deadlineSize(timeout time.Duration, size int64) time.Time {
+	if d := durationFor(r.bandwidth, size); d > timeout {
+		timeout = d
 	}
-	return time.Now().Add(timeout)
+	return r.clock.Now().Add(timeout)
+}
+
+// rpcTimeout returns the timeout of appendEntries
+// request req, depending on whether it has entries.
+func (r *replication) rpcTimeout(req *appendReq) time.Duration {
+	if req.numEntries > 0 {
+		return r.timeouts.AppendEntries
+	}
+	return r.timeouts.Heartbeat
 }
 
 // ------------------------------------------------
@@ -570,10 +868,28 @@ type removeLTE struct {
 	val uint64
 }
 
+type slowRTT struct {
+	rtt  time.Duration
+	slow bool
+}
+
+type clockSkew struct {
+	skew     time.Duration
+	exceeded bool
+}
+
+type negotiated struct {
+	version uint8
+}
+
 type newTerm struct {
 	val uint64
 }
 
+type peerView struct {
+	peers []uint64
+}
+
 type replicationStatus struct {
 	id uint64
 
@@ -581,6 +897,10 @@ type replicationStatus struct {
 	// used to ignore replUpdate from removed replication
 	removed bool
 
+	// time at which removed replication is stopped. zero
+	// value means removal config is not yet committed
+	stopAt time.Time
+
 	// owned exclusively by leader goroutine
 	// used to compute majorityMatchIndex
 	matchIndex uint64
@@ -589,10 +909,27 @@ type replicationStatus struct {
 	// zero value means it is reachable
 	noContact time.Time
 
+	// from what time the node is reachable, valid
+	// only when noContact is zero
+	contact time.Time
+
 	err error
 
 	node Node
 
+	// protocol version negotiated with node,
+	// zero if not yet connected
+	version uint8
+
+	throttle  Throttle
+	throttled bool
+
+	breaker BreakerState
+
+	// other nodes reachable by this node, as reported
+	// by it. see Options.PeerProbeInterval
+	peers []uint64
+
 	round *round // nil if no promotion required
 
 	removeLTE uint64
@@ -15,7 +15,12 @@
 package raft
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -45,6 +50,107 @@ func TestReplication_behindFollower(t *testing.T) {
 	c.ensureLeader(c.leader().NID())
 }
 
+// follower with entries of stale leader, must remove them and
+// catch up, backtracking by term
+func TestReplication_divergentFollower(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 2 * time.Second // so that isolated leader takes stale entries
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	// isolated leader appends entries, which are never committed
+	c.disconnect(ldr)
+	for i := 0; i < 20; i++ {
+		_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte("stale")))
+	}
+	c.waitForState(ldr, c.longTimeout, Follower, Candidate)
+	info := c.info(ldr)
+	stale := info.LastLogIndex - info.Committed
+	if stale == 0 {
+		t.Fatal("isolated leader must have uncommitted entries")
+	}
+
+	// new leader overwrites all of them
+	newLdr := c.waitForLeader(flrs...)
+	c.sendUpdates(newLdr, 11, 40)
+	c.waitFSMLen(40, flrs...)
+
+	// transfer leadership, so that replication to isolated node
+	// starts from lastLogIndex of leader, rather than where it
+	// was left by newLdr
+	c.ensure(waitTask(newLdr, TransferLeadership(0, c.longTimeout), c.longTimeout))
+	c.waitForLeader(flrs...)
+
+	c.connect()
+	c.waitFSMLen(40)
+	if got := c.info(ldr).TruncatedEntries; got != stale {
+		t.Fatalf("truncatedEntries: got %d, want %d", got, stale)
+	}
+}
+
+// new leader must replicate to voter, starting from lastLogIndex
+// in its vote, without failed AppendEntries to find it
+func TestReplication_nextIndexFromVote(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCluster(t)
+	ldr, flrs := c.ensureLaunch(2)
+	defer c.shutdown()
+
+	// launch M3 with capture enabled, as voter
+	c.opt.CaptureFile = filepath.Join(dir, "m3.cap")
+	m3 := c.launch(1, false)[3]
+	c.opt.CaptureFile = ""
+	c.waitCommitReady(ldr)
+	c.ensure(c.waitAddNonvoter(ldr, 3, c.id2Addr(3), true))
+	c.ensure(waitTask(ldr, WaitForStableConfig(), c.longTimeout))
+
+	// make M3 behind, without it starting elections
+	c.ensure(waitTask(m3, Pause(c.longTimeout), c.longTimeout))
+	c.disconnect(m3)
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10, ldr, flrs[0])
+
+	// flrs[0] needs vote of M3 to become leader
+	c.shutdown(ldr)
+	c.connect()
+	newLdr := c.waitForLeader(flrs[0])
+	term := c.info(newLdr).Term
+	c.waitFSMLen(10, m3)
+	c.shutdown(m3)
+
+	f, err := os.Open(filepath.Join(dir, "m3.cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	appends := 0
+	err = ReadCapture(f, func(rec CaptureRecord) error {
+		if rec.Inbound || rec.Kind != CaptureResponse || rec.Type != "append" || rec.Term != term {
+			return nil
+		}
+		m, err := rec.decode()
+		if err != nil {
+			return err
+		}
+		appends++
+		if resp := m.(*appendResp); resp.result != success {
+			t.Fatalf("appendResp.result: got %v, want %v", resp.result, success)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appends == 0 {
+		t.Fatal("appendResp in new term must be recorded")
+	}
+}
+
 func TestReplication_nonvoter_catchesUp_followsLeader(t *testing.T) {
 	// launch 3 node cluster M1, M2, M3
 	c, ldr, _ := launchCluster(t, 3)
@@ -199,3 +305,407 @@ func testInstallSnapCase(t *testing.T, updateFSMAfterSnap bool) {
 	c.sendUpdates(ldr, 1, 10)
 	c.waitFSMLen(updates)
 }
+
+// leader should delegate sending snapshot to the follower
+// picked by Options.SnapshotSource
+func TestReplication_installSnap_delegate(t *testing.T) {
+	// launch 3 node cluster, with one of the followers as snapshot source
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	var (
+		mu      sync.Mutex
+		src     *Raft
+		targets []uint64
+	)
+	c.opt.SnapshotSource = func(target Node, healthy []Node) uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		targets = append(targets, target.ID)
+		for _, n := range healthy {
+			if n.ID == src.nid {
+				return n.ID
+			}
+		}
+		return 0
+	}
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	mu.Lock()
+	src = flrs[0]
+	mu.Unlock()
+
+	// send 30 updates, wait for them
+	updates := uint64(30)
+	<-c.sendUpdates(ldr, 1, 30).Done()
+
+	// add nonVoter M4; wait all commit them
+	c.ensure(c.waitAddNonvoter(ldr, 4, c.id2Addr(4), false))
+	c.waitCatchup()
+
+	// take snapshot on leader, ensure log compacted
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.takeSnapshot(ldr, 1, nil)
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+
+	// send 10 more updates, and take snapshot on source
+	updates += 10
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(updates)
+	c.takeSnapshot(src, 1, nil)
+	if c.info(src).SnapshotIndex == c.info(ldr).SnapshotIndex {
+		t.Fatal("snapshot index of source must be different from leader")
+	}
+
+	// now launch nonVoter M4; ensure he catches up
+	m4 := c.launch(1, false)[4]
+	c.waitFSMLen(updates, m4)
+
+	// M4 must have got snapshot from source
+	mu.Lock()
+	if len(targets) == 0 || targets[0] != 4 {
+		t.Fatalf("snapshotSource targets: got %v, want [4]", targets)
+	}
+	mu.Unlock()
+	if got, want := c.info(m4).SnapshotIndex, c.info(src).SnapshotIndex; got != want {
+		t.Fatalf("m4.snapshotIndex: got %d, want %d", got, want)
+	}
+
+	// send 10 more updates, ensure all alive get them
+	updates += 10
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(updates)
+}
+
+func TestReplication_throttle(t *testing.T) {
+	c := newCluster(t)
+	c.opt.ReplicationThrottle = func(n Node) Throttle {
+		if n.ID == 4 {
+			return Throttle{Bandwidth: 32 * 1024, MaxInflight: 8}
+		}
+		return Throttle{}
+	}
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// send 64KB of updates, and wait for them to replicate
+	data := make([]byte, 1024)
+	var last FSMTask
+	for i := 0; i < 64; i++ {
+		last = UpdateFSM(data)
+		_ = ldr.SubmitTask(context.Background(), last)
+	}
+	c.waitTaskDone(last, c.longTimeout, nil)
+	c.waitFSMLen(64)
+
+	// add M4 as nonvoter, it catches up with throttle
+	m4 := c.launch(1, false)[4]
+	start := time.Now()
+	c.ensure(c.waitAddNonvoter(ldr, m4.NID(), c.id2Addr(m4.NID()), false))
+
+	// throttled state must be visible in info
+	throttled := waitForCondition(func() bool {
+		repl, ok := c.info(ldr).Followers[m4.NID()]
+		return ok && repl.Throttled
+	}, 10*time.Millisecond, c.longTimeout)
+	if !throttled {
+		t.Fatal("M4 is not throttled")
+	}
+	repl := c.info(ldr).Followers[m4.NID()]
+	if want := (Throttle{Bandwidth: 32 * 1024, MaxInflight: 8}); repl.Throttle != want {
+		t.Fatalf("throttle: got %+v, want %+v", repl.Throttle, want)
+	}
+	c.waitFSMLen(64, m4)
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("catchUp: took %s, want >=1s", d)
+	}
+
+	// other followers are not throttled
+	for id, repl := range c.info(ldr).Followers {
+		if id != m4.NID() && (repl.Throttle != Throttle{} || repl.Throttled) {
+			t.Fatalf("M%d: got %+v", id, repl)
+		}
+	}
+}
+
+func TestReplication_circuitBreaker(t *testing.T) {
+	c := newCluster(t)
+	c.opt.CircuitBreaker = CircuitBreaker{Failures: 2, Timeout: 500 * time.Millisecond}
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	breaker := func(want BreakerState) bool {
+		return waitForCondition(func() bool {
+			return c.info(ldr).Followers[flrs[0].NID()].Breaker == want
+		}, 10*time.Millisecond, c.longTimeout)
+	}
+
+	// shutdown follower, circuit must open
+	c.shutdown(flrs[0])
+	if !breaker(BreakerOpen) {
+		t.Fatal("circuit breaker is not opened")
+	}
+
+	// other followers are not affected
+	if got := c.info(ldr).Followers[flrs[1].NID()].Breaker; got != BreakerClosed {
+		t.Fatalf("M%d.breaker: got %v, want %v", flrs[1].NID(), got, BreakerClosed)
+	}
+
+	// restart follower, circuit must close and follower catches up
+	flrs[0] = c.restart(flrs[0])
+	if !breaker(BreakerClosed) {
+		t.Fatal("circuit breaker is not closed")
+	}
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+}
+
+func TestReplication_rpcTimeouts(t *testing.T) {
+	c := newCluster(t)
+	c.opt.RPCTimeouts = RPCTimeouts{
+		Heartbeat:       c.heartbeatTimeout,
+		AppendEntries:   4 * c.heartbeatTimeout,
+		SnapshotChunk:   4 * c.heartbeatTimeout,
+		InstallSnapshot: 8 * c.heartbeatTimeout,
+	}
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	data := make([]byte, 1024)
+	var last FSMTask
+	for i := 0; i < 500; i++ {
+		last = UpdateFSM(data)
+		_ = ldr.SubmitTask(context.Background(), last)
+	}
+	c.waitTaskDone(last, c.longTimeout, nil)
+	c.waitFSMLen(500)
+
+	// snapshot larger than a chunk is sent to node added later
+	c.takeSnapshot(ldr, 0, nil)
+	m4 := c.launch(1, false)[4]
+	c.ensure(c.waitAddNonvoter(ldr, m4.NID(), c.id2Addr(m4.NID()), false))
+	c.waitFSMLen(500, m4)
+	c.ensureFSMSame(nil)
+}
+
+func TestReplication_compressEntries(t *testing.T) {
+	c := newCluster(t)
+	c.opt.CompressEntries = true
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// connections to followers must negotiate compression
+	err := ldr.inspect(func(r *Raft) {
+		conn, err := r.getConnPool(flrs[0].nid).getConn(time.Now().Add(c.longTimeout))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.rwc.Close()
+		if !conn.compress {
+			t.Error("compression not negotiated")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send compressible updates, and wait for them to replicate
+	data := make([]byte, 1024)
+	var last FSMTask
+	for i := 0; i < 200; i++ {
+		last = UpdateFSM(data)
+		_ = ldr.SubmitTask(context.Background(), last)
+	}
+	c.waitTaskDone(last, c.longTimeout, nil)
+	c.waitFSMLen(200)
+	c.ensureFSMSame(nil)
+
+	// a node added later catches up with compressed entries
+	m4 := c.launch(1, false)[4]
+	c.ensure(c.waitAddNonvoter(ldr, m4.NID(), c.id2Addr(m4.NID()), false))
+	c.waitFSMLen(200, m4)
+	c.ensureFSMSame(nil)
+}
+
+func TestReplication_rtt(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// rtt of followers must be reported in info
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	for _, flr := range flrs {
+		if rtt := c.info(ldr).Followers[flr.NID()].RTT; rtt <= 0 || rtt >= c.heartbeatTimeout {
+			t.Fatalf("M%d rtt: got %v, want in (0, %v)", flr.NID(), rtt, c.heartbeatTimeout)
+		}
+	}
+
+	// leader must be told when rtt crosses half of hbTimeout
+	ch := make(chan replUpdate, 1)
+	r := &replication{clock: realClock{}, hbTimeout: 40 * time.Millisecond, replUpdateCh: ch}
+	r.setAck(time.Now().Add(-30 * time.Millisecond))
+	if u := (<-ch).update.(slowRTT); !u.slow || u.rtt < 30*time.Millisecond {
+		t.Fatalf("got %+v, want slow", u)
+	}
+	for r.getLatency() >= 20*time.Millisecond {
+		r.setAck(time.Now())
+	}
+	if u := (<-ch).update.(slowRTT); u.slow {
+		t.Fatalf("got %+v, want not slow", u)
+	}
+	if len(ch) != 0 {
+		t.Fatal("slowRTT must be notified only when changed")
+	}
+}
+
+func TestReplication_lastAckRate(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// last ack of followers must be reported in info
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	for _, flr := range flrs {
+		ack := c.info(ldr).Followers[flr.NID()].LastAck
+		if ack == nil || time.Since(*ack) > c.heartbeatTimeout {
+			t.Fatalf("M%d lastAck: got %v, want within %v", flr.NID(), ack, c.heartbeatTimeout)
+		}
+	}
+
+	// rate must be sampled every rateInterval, and decay
+	// when nothing is replicated
+	r := &replication{clock: realClock{}}
+	r.setReplicated(0)
+	r.rateStart = r.rateStart.Add(-rateInterval)
+	r.setReplicated(100)
+	if got := r.getRate(); got < 90 || got > 100 {
+		t.Fatalf("rate: got %v, want ~100", got)
+	}
+	r.setReplicated(100)
+	if got := r.getRate(); got > 100 {
+		t.Fatalf("rate: got %v, want unchanged within rateInterval", got)
+	}
+	r.rateStart = r.rateStart.Add(-rateInterval)
+	r.rateEntries = 0
+	r.setReplicated(0)
+	if got := r.getRate(); got >= 90 {
+		t.Fatalf("rate: got %v, want decayed", got)
+	}
+}
+
+func TestReplication_clockSkew(t *testing.T) {
+	c := newCluster(t)
+	c.opt.MaxClockSkew = c.heartbeatTimeout / 4
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// nodes share the clock, so measured skew is just the
+	// measurement error, which is within rtt/2
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	info := c.info(ldr)
+	for _, flr := range flrs {
+		if skew := info.Followers[flr.NID()].ClockSkew; skew >= c.heartbeatTimeout {
+			t.Fatalf("M%d skew: got %v, want < %v", flr.NID(), skew, c.heartbeatTimeout)
+		}
+	}
+
+	// lease must be shortened by MaxClockSkew
+	if info.LeaseExpiry == nil {
+		t.Fatal("lease is not held")
+	}
+	if max := time.Now().Add(c.heartbeatTimeout - c.opt.MaxClockSkew); info.LeaseExpiry.After(max) {
+		t.Fatalf("leaseExpiry: got %v, want <= %v", info.LeaseExpiry, max)
+	}
+
+	// leader must be told when skew crosses MaxClockSkew
+	ch := make(chan replUpdate, 1)
+	r := &replication{clock: realClock{}, maxClockSkew: 10 * time.Millisecond, replUpdateCh: ch}
+	r.setSkew(time.Now(), time.Now().Add(-50*time.Millisecond).UnixNano())
+	if u := (<-ch).update.(clockSkew); !u.exceeded || u.skew < 40*time.Millisecond {
+		t.Fatalf("got %+v, want exceeded", u)
+	}
+	r.setSkew(time.Now(), 0) // node does not support protocolV6
+	r.setSkew(time.Now(), time.Now().UnixNano())
+	if u := (<-ch).update.(clockSkew); u.exceeded {
+		t.Fatalf("got %+v, want not exceeded", u)
+	}
+	if len(ch) != 0 {
+		t.Fatal("clockSkew must be notified only when changed")
+	}
+}
+
+// tests that leader tells partitioned follower, from follower that is down,
+// using the reachable peers reported by other followers
+func TestReplication_partitioned(t *testing.T) {
+	c := newCluster(t)
+	c.opt.PeerProbeInterval = c.heartbeatTimeout / 2
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	reports := func(flr, peer *Raft) func() bool {
+		return func() bool {
+			for _, id := range c.info(ldr).Followers[flr.nid].ReachablePeers {
+				if id == peer.nid {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if !waitForCondition(reports(flrs[1], flrs[0]), 10*time.Millisecond, c.longTimeout) {
+		t.Fatalf("M%d must report M%d as reachable", flrs[1].nid, flrs[0].nid)
+	}
+
+	// block traffic only between leader and flrs[0]
+	network.SetFirewall(blockLink{id2Host(ldr.nid), id2Host(flrs[0].nid)})
+	defer c.connect()
+	_ = c.waitUnreachableDetected(ldr, flrs[0])
+	partitioned := func() bool {
+		return c.info(ldr).Followers[flrs[0].nid].Partitioned
+	}
+	if !waitForCondition(partitioned, 10*time.Millisecond, c.longTimeout) {
+		t.Fatalf("M%d must be partitioned", flrs[0].nid)
+	}
+
+	// flrs[0] is down now
+	c.disconnect(flrs[0])
+	if !waitForCondition(func() bool { return !partitioned() }, 10*time.Millisecond, c.longTimeout) {
+		t.Fatalf("M%d must not be partitioned", flrs[0].nid)
+	}
+	if repl := c.info(ldr).Followers[flrs[0].nid]; repl.Unreachable == nil {
+		t.Fatalf("M%d must be unreachable", flrs[0].nid)
+	}
+}
+
+// tests that leader steps down without waiting for quorumWait,
+// if followers report that quorum is alive
+func TestReplication_partitionedFromQuorum(t *testing.T) {
+	c := newCluster(t)
+	c.quorumWait = 30 * time.Minute
+	c.opt.PeerProbeInterval = c.heartbeatTimeout / 2
+	ldr, flrs := c.ensureLaunch(5)
+	defer c.shutdown()
+
+	reported := func() bool {
+		peers := c.info(ldr).Followers[flrs[0].nid].ReachablePeers
+		return len(peers) == len(flrs)-1
+	}
+	if !waitForCondition(reported, 10*time.Millisecond, c.longTimeout) {
+		t.Fatalf("M%d must report other followers as reachable", flrs[0].nid)
+	}
+
+	// leader can reach only flrs[0], which can reach all.
+	// others must not elect new leader, which makes leader
+	// step down anyway
+	var links blockLinks
+	for _, flr := range flrs[1:] {
+		c.ensure(waitTask(flr, Pause(c.longTimeout), c.longTimeout))
+		links = append(links, blockLink{id2Host(ldr.nid), id2Host(flr.nid)})
+	}
+	network.SetFirewall(links)
+	defer c.connect()
+
+	c.waitForState(ldr, c.longTimeout, Follower, Candidate)
+}
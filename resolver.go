@@ -0,0 +1,130 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DNSResolver is a Resolver, that resolves the host name in Node.Addr
+// using DNS. Use it when nodes are addressed by host names whose IPs
+// may change, such as Kubernetes Services, so that config need not be
+// changed when IPs change.
+//
+// Raft resolves the addresses of nodes again periodically. If the
+// address of a node has changed, idle connections to it are closed,
+// so that new connections are made to the new address.
+//
+// DNSResolver can be shared by Raft instances of same cluster.
+type DNSResolver struct {
+	// Refresh is the interval at which addresses of nodes are resolved
+	// again. Zero value means 30 seconds.
+	Refresh time.Duration
+
+	// LookupHost used to resolve host names. If nil,
+	// net.DefaultResolver.LookupHost is used.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu    sync.RWMutex
+	addrs map[uint64]string // Node.Addr from config
+}
+
+const defaultDNSRefresh = 30 * time.Second
+
+// LookupID implements Resolver.
+func (d *DNSResolver) LookupID(id uint64, timeout time.Duration) (string, error) {
+	d.mu.RLock()
+	addr, ok := d.addrs[id]
+	d.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("raft: no address for node %d", id)
+	}
+	if network, _ := splitAddr(addr); network != "tcp" {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	lookupHost := d.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("raft: no addresses found for host %s", host)
+	}
+
+	// sort, so that address does not change with
+	// the order of records returned
+	sort.Strings(ips)
+	return net.JoinHostPort(ips[0], port), nil
+}
+
+func (d *DNSResolver) update(config Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.addrs == nil {
+		d.addrs = make(map[uint64]string)
+	}
+	for _, n := range config.Nodes {
+		d.addrs[n.ID] = n.Addr
+	}
+}
+
+func (d *DNSResolver) refresh() time.Duration {
+	if d.Refresh <= 0 {
+		return defaultDNSRefresh
+	}
+	return d.Refresh
+}
+
+// refreshAddrs looks up the addresses of nodes periodically, until
+// raft is closed. When the address of node changes, idle connections
+// to it are closed.
+func (r *Raft) refreshAddrs(interval time.Duration) {
+	timer := r.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-timer.C():
+		}
+		r.resolver.refresh(interval, func(id uint64, addr string) {
+			r.resolver.logger.Info("address changed", "peer", id, "addr", addr)
+			_ = r.inspect(func(r *Raft) {
+				if pool, ok := r.connPools[id]; ok {
+					pool.closeAll()
+				}
+			})
+		})
+		timer.Reset(interval)
+	}
+}
@@ -15,11 +15,47 @@
 package raft
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
 )
 
+// handleRPC replies rpc. On receiving AppendEntries from current
+// leader or granting vote to candidate, follower resets its timer.
+func (r *Raft) handleRPC(rpc *rpc) {
+	if r.replyRPC(rpc) && r.state == Follower {
+		r.flr.resetTimer()
+	}
+}
+
+// replyPending replies the requests pending with higher priority than p.
+func (r *Raft) replyPending(p rpcPriority) {
+	for i := priorityElection; i < p; i++ {
+		for pending := true; pending; {
+			select {
+			case rpc := <-r.rpcCh[i]:
+				r.handleRPC(rpc)
+			default:
+				pending = false
+			}
+		}
+	}
+}
+
+// isRelayed tells whether rpc is installSnapReq of leader, relayed by
+// other node acting as snapshot source. see Options.SnapshotSource.
+// Such node need not be in our config, because we may not have any
+// config yet. It is identified, and authenticated if PeerKey is set.
+func isRelayed(rpc *rpc) bool {
+	_, ok := rpc.req.(*installSnapReq)
+	return ok
+}
+
 // resetTimer tells whether follower should reset its electionTimer or not
 //
 // from thesis:
@@ -30,7 +66,10 @@ func (r *Raft) replyRPC(rpc *rpc) (resetTimer bool) {
 	if rpc.req.rpcType().fromLeader() {
 		err := rpc.conn.rwc.SetReadDeadline(r.rtime.deadline(r.hbTimeout))
 		if err == nil {
-			err = rpc.req.decode(rpc.conn.bufr)
+			err = rpc.conn.decodeReq(rpc.req)
+		}
+		if err == nil && rpc.req.from() != rpc.conn.peer && !isRelayed(rpc) {
+			err = errPeerMismatch // see server.handleConn
 		}
 		if err != nil {
 			rpc.readErr = err
@@ -41,26 +80,36 @@ func (r *Raft) replyRPC(rpc *rpc) (resetTimer bool) {
 
 	// handle identity req
 	if req, ok := rpc.req.(*identityReq); ok {
-		if r.cid != req.cid || r.nid != req.nid {
+		switch {
+		case req.version < minProtocol:
+			rpc.resp = rpcIdentity.createResp(r, versionMismatch, nil)
+		case r.cid != req.cid || r.nid != req.nid:
+			// prevents cross-cluster contamination, when addresses
+			// are reused across clusters
+			r.logger.Warn("rejected connection for other identity", "peer", req.src, "cid", req.cid, "nid", req.nid)
 			rpc.resp = rpcIdentity.createResp(r, identityMismatch, nil)
-		} else {
+		default:
 			rpc.resp = rpcIdentity.createResp(r, success, nil)
 		}
+		rpc.resp.setVersion(negotiate(req.version))
 		close(rpc.done)
 		return req.src == r.leader
 	}
 
-	if trace {
-		println(r, "<<", rpc.req)
-	}
+	r.logger.Debug("received", "req", rpc.req)
+	_, span := r.tracing.Start(r.tracing.Extract(rpc.req.getTrace()), "raft.rpc."+rpc.req.rpcType().String())
+	defer span.End()
 	result, err := r.onRequest(rpc.req, rpc.conn)
 	rpc.resp = rpc.req.rpcType().createResp(r, result, err)
+	rpc.resp.setVersion(rpc.req.getVersion())
+	if result == prevTermMismatch {
+		resp := rpc.resp.(*appendResp)
+		resp.conflictTerm, resp.conflictIndex = r.conflict(rpc.req.(*appendReq).prevLogIndex)
+	}
 	if result == readErr {
 		rpc.readErr = err
 	}
-	if trace {
-		println(r, ">>", rpc.resp)
-	}
+	r.logger.Debug("replying", "resp", rpc.resp)
 	close(rpc.done)
 
 	if result == unexpectedErr {
@@ -84,7 +133,7 @@ func (r *Raft) onRequest(req request, c *conn) (result rpcResult, err error) {
 	case *installSnapReq:
 		return r.onInstallSnapRequest(req, c)
 	case *timeoutNowReq:
-		return r.onTimeoutNowRequest()
+		return r.onTimeoutNowRequest(req)
 	default:
 		panic(fmt.Errorf("[BUG] raft.onRequest(%T)", req))
 	}
@@ -107,7 +156,9 @@ func (r *Raft) onVoteRequest(req *voteReq) (rpcResult, error) {
 	// RequestVote requests used for leadership transfer can include
 	// a special flag to indicate this behavior:
 	// "I have permission to disrupt the leader—it told me to!"
-	if !req.transfer && r.leader != 0 {
+	//
+	// see Options.DisableStickiness
+	if r.sticky && !req.transfer && r.leader != 0 {
 		if req.src == r.leader {
 			return success, nil
 		}
@@ -142,6 +193,12 @@ func (r *Raft) onVoteRequest(req *voteReq) (rpcResult, error) {
 
 func (r *Raft) onAppendEntriesRequest(req *appendReq, c *conn) (rpcResult, error) {
 	drain := func(result rpcResult, err error) (rpcResult, error) {
+		if req.compressedSize > 0 {
+			if _, errr := io.CopyN(ioutil.Discard, c.bufr, int64(req.compressedSize)); errr != nil {
+				return readErr, errr
+			}
+			return result, err
+		}
 		for req.numEntries > 0 {
 			req.numEntries--
 			ne := &entry{}
@@ -192,9 +249,7 @@ func (r *Raft) onAppendEntriesRequest(req *appendReq, c *conn) (rpcResult, error
 	if req.numEntries > 0 {
 		defer func() {
 			if syncLog {
-				if trace {
-					println(r, "log.Commit", r.lastLogIndex)
-				}
+				r.logger.Debug("appended entries", "lastLogIndex", r.lastLogIndex)
 				r.storage.commitLog(r.lastLogIndex)
 				if r.canCommit(req, index, term) {
 					r.setCommitIndex(index)
@@ -203,56 +258,129 @@ func (r *Raft) onAppendEntriesRequest(req *appendReq, c *conn) (rpcResult, error
 			}
 		}()
 	}
+	var src io.Reader = c.bufr
+	if req.compressedSize > 0 {
+		data, err := r.readCompressed(req, c)
+		if err != nil {
+			return readErr, err
+		}
+		src = bytes.NewReader(data)
+	}
+	// entries are appended to log as received, without decoding and
+	// encoding them again. buf is reused for all entries, because
+	// appendRaw copies the entry into log
+	var buf []byte
 	for req.numEntries > 0 {
 		req.numEntries--
-		if !isEntryBuffered(c.bufr) {
+		if req.compressedSize == 0 && !isEntryBuffered(c.bufr) {
 			if err := c.rwc.SetReadDeadline(r.rtime.deadline(r.hbTimeout)); err != nil {
 				return readErr, err
 			}
 		}
-		ne := &entry{}
-		if err := ne.decode(c.bufr); err != nil {
+		raw, err := readRawEntry(src, buf)
+		if err != nil {
 			return readErr, err
 		}
+		c.capture.logEntries(true, req.src, raw)
+		buf = raw
+		// entries from a bad peer must not crash us
+		typ := raw.typ()
+		if raw.index() != index+1 || raw.term() < term || raw.term() > req.term || !typ.isValid() {
+			return readErr, fmt.Errorf("raft: invalid entry{index: %d, term: %d, type: %d} after {index: %d, term: %d}", raw.index(), raw.term(), typ, index, term)
+		}
+		var newConfig Config
+		if typ == entryConfig {
+			ne := &entry{}
+			if err := ne.decode(bytes.NewReader(raw)); err != nil {
+				return readErr, err
+			}
+			if err := newConfig.decode(ne); err != nil {
+				return readErr, err
+			}
+		}
 		prevTerm := term
-		index, term = ne.index, ne.term
-		if ne.index <= r.snaps.index {
+		index, term = raw.index(), raw.term()
+		if index <= r.snaps.index {
 			continue
 		}
-		if ne.index <= r.lastLogIndex {
+		if index <= r.lastLogIndex {
 			me := &entry{}
-			r.storage.mustGetEntry(ne.index, me)
-			if me.term == ne.term {
+			r.storage.mustGetEntry(index, me)
+			if me.term == term {
 				continue
 			}
 
 			// new entry conflicts with our entry
 			// delete it and all that follow it
-			if trace {
-				println(r, "log.removeGTE", ne.index)
-			}
-			r.storage.removeGTE(ne.index, prevTerm)
-			if ne.index <= r.configs.Latest.Index {
+			n := r.lastLogIndex - index + 1
+			r.logger.Info("removing entries that conflict with leader", "from", index, "count", n)
+			r.truncated += n
+			r.storage.removeGTE(index, prevTerm)
+			if index <= r.configs.Latest.Index {
 				r.revertConfig()
 			}
 		}
 		// new entry not in the log, append it
-		if trace {
-			println(r, "log.append", ne.typ, ne.index)
-		}
-		r.storage.appendEntry(ne)
+		r.storage.appendRaw(raw)
 		syncLog = true
-		if ne.typ == entryConfig {
-			var newConfig Config
-			if err := newConfig.decode(ne); err != nil {
-				return unexpectedErr, err
-			}
+		if timestamp := raw.timestamp(); timestamp != 0 {
+			r.replLag = r.clock.Now().Sub(time.Unix(0, timestamp))
+		}
+		if typ == entryConfig {
 			r.changeConfig(newConfig)
 		}
 	}
 	return success, nil
 }
 
+// conflict returns the term of entry at given index, that does not match
+// with leader's log, and the first index of that term in log. Leader uses
+// them to skip all entries of that term in single AppendEntries round
+// trip, instead of probing one entry at a time. see replication.backtrack
+func (r *Raft) conflict(index uint64) (term, first uint64) {
+	term, err := r.storage.getEntryTerm(index)
+	if err != nil {
+		panic(bug{fmt.Sprintf("storage.getEntryTerm(%d)", index), err})
+	}
+	// terms in log never decrease, so binary search for first index of term
+	from := r.snaps.index + 1
+	i := sort.Search(int(index-from), func(i int) bool {
+		t, err := r.storage.getEntryTerm(from + uint64(i))
+		if err != nil {
+			panic(bug{fmt.Sprintf("storage.getEntryTerm(%d)", from+uint64(i)), err})
+		}
+		return t >= term
+	})
+	return term, from + uint64(i)
+}
+
+// readCompressed reads the snappy block of entries
+// and returns it decompressed.
+func (r *Raft) readCompressed(req *appendReq, c *conn) ([]byte, error) {
+	if req.compressedSize > maxBytes {
+		return nil, fmt.Errorf("raft: compressed entries too large: %d", req.compressedSize)
+	}
+	timeout := durationFor(r.bandwidth, int64(req.compressedSize))
+	if timeout < r.hbTimeout {
+		timeout = r.hbTimeout
+	}
+	if err := c.rwc.SetReadDeadline(r.rtime.deadline(timeout)); err != nil {
+		return nil, err
+	}
+	block := new(bytes.Buffer)
+	if _, err := io.CopyN(block, c.bufr, int64(req.compressedSize)); err != nil {
+		return nil, err
+	}
+	n, err := snappy.DecodedLen(block.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBytes {
+		return nil, fmt.Errorf("raft: decompressed entries too large: %d", n)
+	}
+	return snappy.Decode(nil, block.Bytes())
+}
+
 func (r *Raft) canCommit(req *appendReq, index, term uint64) bool {
 	return req.ldrCommitIndex >= index && // did leader committed it ?
 		term == req.term && // don't commit any entry, until leader has committed an entry with his term
@@ -262,15 +390,46 @@ func (r *Raft) canCommit(req *appendReq, index, term uint64) bool {
 // if commitIndex > lastApplied: increment lastApplied, apply
 // log[lastApplied] to state machine
 func (r *Raft) applyCommitted(ne *entry) {
+	if r.standby {
+		return // applied on activation
+	}
 	apply := fsmApply{log: r.log.ViewAt(r.log.PrevIndex(), r.commitIndex)}
-	if trace {
-		println(r, apply)
+	r.logger.Debug("applying", "apply", apply)
+	// coalesce with previous apply, if fsm has not taken it yet,
+	// so that slow fsm does not block AppendEntries handling
+	if r.flrApply == nil || !r.flrApply.update(apply) {
+		r.flrApply = &followerApply{apply: apply}
+		r.fsm.ch <- r.flrApply
 	}
-	r.fsm.ch <- apply
+	r.checkSnapThreshold()
 }
 
 // onInstallSnapRequest -------------------------------------------------
 
+// snapChunkSize is the size of snapshot data received, before
+// replying pending election requests.
+const snapChunkSize = 256 * 1024
+
+// receiveSnapshot copies size bytes of snapshot data from r to w, in
+// chunks. Pending election requests are replied between chunks, so
+// that receiving large snapshot does not cause spurious elections.
+func (r *Raft) receiveSnapshot(w io.Writer, rd io.Reader, size int64) (int64, error) {
+	var n int64
+	for n < size {
+		chunk := size - n
+		if chunk > snapChunkSize {
+			chunk = snapChunkSize
+		}
+		m, err := io.CopyN(w, rd, chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		r.replyPending(priorityAppend)
+	}
+	return n, nil
+}
+
 func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, error) {
 	drain := func(result rpcResult, err error) (rpcResult, error) {
 		if req.size > 0 {
@@ -294,14 +453,23 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 	if err != nil {
 		return unexpectedErr, opError(err, "snapshots.new")
 	}
-	n, err := io.CopyN(sink.file, c.bufr, req.size)
+	sink.meta.results = req.results
+	n, err := r.receiveSnapshot(sink.data, c.bufr, req.size)
 	req.size -= n
-	meta, doneErr := sink.done(err)
+	if err == nil && req.term != r.term {
+		// vote request replied while receiving, changed the term
+		_, _ = sink.finish(errStaleTerm)
+		return staleTerm, nil
+	}
+	meta, doneErr := sink.finish(err)
 	if err != nil {
 		return readErr, err
 	}
 	if doneErr != nil {
-		return unexpectedErr, opError(doneErr, "snapshotSink.done")
+		return unexpectedErr, opError(doneErr, "snapshotSink.finish")
+	}
+	if err = r.snaps.setLatest(meta.index, meta.term); err != nil {
+		r.logger.Warn("applying snapshots retain failed", "err", err)
 	}
 
 	discardLog := true
@@ -317,6 +485,10 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 				return unexpectedErr, err
 			}
 			discardLog = false
+			if r.standby {
+				// entries before meta.index are no longer in log
+				r.restoreFSM = true
+			}
 		}
 	}
 	if discardLog {
@@ -329,7 +501,11 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 		//       if takeSnap req came meanwhile, reply inProgress(restoreFSM)
 
 		// restore fsm from this snapshot
-		r.fsm.ch <- fsmRestoreReq{r.fsmRestoredCh}
+		if r.standby {
+			r.restoreFSM = true
+		} else {
+			r.sendFSM(fsmRestoreReq{r.fsmRestoredCh})
+		}
 		r.commitIndex = r.snaps.index
 
 		// load snapshot config as cluster configuration
@@ -342,10 +518,23 @@ func (r *Raft) onInstallSnapRequest(req *installSnapReq, c *conn) (rpcResult, er
 
 // onTimeoutNowRequest -------------------------------------------------
 
-func (r *Raft) onTimeoutNowRequest() (rpcResult, error) {
+// onTimeoutNowRequest starts election immediately. the voteReqs
+// sent are flagged as transfer, to bypass leader stickiness.
+func (r *Raft) onTimeoutNowRequest(req *timeoutNowReq) (rpcResult, error) {
+	// ignore delayed request from old leader, otherwise
+	// we disrupt the current leader
+	if req.term < r.term {
+		return staleTerm, nil
+	}
 	if !r.configs.Latest.isVoter(r.nid) {
 		return nonVoter, nil
 	}
+	if r.paused {
+		return paused, nil
+	}
+	if r.diskFull {
+		return diskFull, nil
+	}
 	r.setState(Candidate)
 	r.setLeader(0)
 	r.cnd.transfer = true
@@ -47,6 +47,49 @@ func TestRaft_voteReq_leaderKnown(t *testing.T) {
 	}
 }
 
+// tests the behavior of voteReq when raft.leader!=0 and stickiness is disabled
+func TestRaft_voteReq_disableStickiness(t *testing.T) {
+	c := newCluster(t)
+	c.opt.DisableStickiness = true
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	// wait until all nodes know who is leader
+	c.waitForLeader()
+
+	// wait until follower's log is same as leader
+	c.waitBarrier(ldr, 0)
+	lastLogIndex := c.info(ldr).LastLogIndex
+	if !waitForCondition(func() bool {
+		return c.info(flrs[0]).LastLogIndex == lastLogIndex
+	}, 10*time.Millisecond, c.longTimeout) {
+		t.Fatal("follower's log is not same as leader")
+	}
+
+	// a follower that thinks there's a leader should vote for
+	// candidate in higher term, with up-to-date log
+	info := c.info(flrs[0])
+	var result rpcResult
+	err := flrs[1].inspect(func(r *Raft) {
+		req := &voteReq{
+			req:          req{term: info.Term + 1, src: r.nid},
+			lastLogIndex: info.LastLogIndex,
+			lastLogTerm:  info.LastLogTerm,
+		}
+		resp := &voteResp{}
+		if err := r.getConnPool(flrs[0].nid).doRPC(req, resp, time.Now().Add(time.Second)); err != nil {
+			t.Errorf("requestVote failed: %v", err)
+		}
+		result = resp.getResult()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != success {
+		t.Fatalf("follower should grant vote, when stickiness is disabled: got %d", result)
+	}
+}
+
 func TestRPC_voteReq_opError(t *testing.T) {
 	f := grantingVote
 	failNow := make(chan struct{})
@@ -86,3 +129,86 @@ func TestRPC_voteReq_opError(t *testing.T) {
 		t.Fatal("one of the follower is expected to shutdown")
 	}
 }
+
+// tests that invalid entries from bad peer, does not crash node
+func TestRPC_appendReq_invalidEntry(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	c.waitBarrier(ldr, 0)
+	caughtUp := func() bool {
+		return c.info(flrs[0]).LastLogIndex == c.info(ldr).LastLogIndex
+	}
+	if !waitForCondition(caughtUp, c.commitTimeout, c.longTimeout) {
+		t.Fatal("follower not caught up")
+	}
+
+	// send entry with gap in index from leader's term
+	info := c.info(flrs[0])
+	err := ldr.inspect(func(r *Raft) {
+		pool := r.getConnPool(flrs[0].nid)
+		conn, err := pool.getConn(time.Now().Add(c.longTimeout))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.rwc.Close()
+		req := &appendReq{
+			req:          req{term: info.Term, src: r.nid},
+			prevLogIndex: info.LastLogIndex,
+			prevLogTerm:  info.LastLogTerm,
+			numEntries:   1,
+		}
+		ne := &entry{index: info.LastLogIndex + 2, term: info.Term, typ: entryUpdate}
+		if err := conn.writeReq(req, time.Now().Add(c.longTimeout)); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := ne.encode(conn.bufw); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := conn.bufw.Flush(); err != nil {
+			t.Error(err)
+			return
+		}
+		resp := &appendResp{}
+		if err := conn.readResp(resp, time.Now().Add(c.longTimeout)); err == nil && resp.result == success {
+			t.Error("invalid entry must not be accepted")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// follower must be still alive, with log unchanged
+	if got := c.info(flrs[0]).LastLogIndex; got != info.LastLogIndex {
+		t.Fatalf("lastLogIndex=%d, want %d", got, info.LastLogIndex)
+	}
+	c.waitBarrier(ldr, 0)
+}
+
+func TestRPC_peerRateLimit(t *testing.T) {
+	l := newRateLimiter(RateLimit{PerSecond: 10, Burst: 2}, realClock{})
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(1); d != 0 {
+			t.Fatalf("burst request %d: got wait %v, want 0", i, d)
+		}
+	}
+	if d := l.reserve(1); d <= 0 || d > 100*time.Millisecond {
+		t.Fatalf("request beyond burst: got wait %v, want (0, 100ms]", d)
+	}
+	if d := l.reserve(2); d != 0 {
+		t.Fatalf("other peer: got wait %v, want 0", d)
+	}
+	if l := newRateLimiter(RateLimit{}, realClock{}); l != nil {
+		t.Fatal("zero RateLimit must not limit")
+	}
+
+	// cluster must work within rate limit
+	c := newCluster(t)
+	c.opt.PeerRateLimit = RateLimit{PerSecond: 1000, Burst: 100}
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 100)
+	c.waitFSMLen(100)
+}
@@ -16,6 +16,7 @@ package raft
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -30,43 +31,101 @@ type rpc struct {
 	done    chan struct{}
 }
 
+// RPCSet tells the requests that are served on a listener.
+type RPCSet uint8
+
+const (
+	// PeerRPCs are the requests from other raft nodes.
+	PeerRPCs RPCSet = 1 << iota
+
+	// AdminRPCs are the tasks submitted using Client.
+	AdminRPCs
+
+	// AllRPCs are all requests. This is the default.
+	AllRPCs = PeerRPCs | AdminRPCs
+)
+
+// restricted is the listener returned by Restrict.
+type restricted struct {
+	net.Listener
+	allow RPCSet
+}
+
+// Restrict returns listener, which serves only the requests
+// in set, when given to Raft.Serve. Connections sending other
+// requests are closed. Ping requests are always served.
+//
+// If Options.PeerKey is set, AdminRPCs are served only on listeners
+// restricted to AdminRPCs, because Client does not authenticate.
+//
+// For example, to serve nodes on private interconnect and
+// admin clients only on localhost:
+//
+//     r.Serve(raft.Restrict(private, raft.PeerRPCs), raft.Restrict(local, raft.AdminRPCs))
+func Restrict(l net.Listener, set RPCSet) net.Listener {
+	if rl, ok := l.(restricted); ok {
+		l = rl.Listener
+	}
+	return restricted{Listener: l, allow: set}
+}
+
 type server struct {
 	r      *Raft
-	lr     net.Listener
+	lrs    []restricted
 	stopCh chan struct{}
 }
 
-func newServer(r *Raft, lr net.Listener) *server {
-	return &server{
+func newServer(r *Raft, lrs []net.Listener) *server {
+	s := &server{
 		r:      r,
-		lr:     lr,
 		stopCh: make(chan struct{}),
 	}
+	for _, l := range lrs {
+		rl, ok := l.(restricted)
+		if !ok {
+			rl = restricted{Listener: l, allow: AllRPCs}
+		}
+		if r.peerKey != nil && rl.allow == AllRPCs {
+			// Client does not authenticate, see Options.PeerKey
+			r.logger.Warn("admin tasks are not served on listener with peers, as PeerKey is set", "addr", rl.Addr())
+			rl.allow = PeerRPCs
+		}
+		s.lrs = append(s.lrs, rl)
+	}
+	return s
 }
 
 func (s *server) serve() {
 	var wg sync.WaitGroup
 	var mu sync.RWMutex
 	conns := make(map[net.Conn]struct{})
-	for !isClosed(s.stopCh) {
-		conn, err := s.lr.Accept()
-		if err != nil {
-			continue
-		}
-		mu.Lock()
-		conns[conn] = struct{}{}
-		mu.Unlock()
-
-		wg.Add(1)
-		go func() {
-			_ = s.handleConn(conn)
-			mu.Lock()
-			delete(conns, conn)
-			mu.Unlock()
-			_ = conn.Close()
-			wg.Done()
-		}()
+	var lwg sync.WaitGroup
+	for _, l := range s.lrs {
+		lwg.Add(1)
+		go func(l restricted) {
+			defer lwg.Done()
+			for !isClosed(s.stopCh) {
+				conn, err := l.Accept()
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				conns[conn] = struct{}{}
+				mu.Unlock()
+
+				wg.Add(1)
+				go func() {
+					_ = s.handleConn(conn, l.allow)
+					mu.Lock()
+					delete(conns, conn)
+					mu.Unlock()
+					_ = conn.Close()
+					wg.Done()
+				}()
+			}
+		}(l)
 	}
+	lwg.Wait()
 
 	mu.RLock()
 	for conn := range conns {
@@ -74,17 +133,21 @@ func (s *server) serve() {
 	}
 	mu.RUnlock()
 	wg.Wait()
-	close(s.r.rpcCh)
+	for _, ch := range s.r.rpcCh {
+		close(ch)
+	}
 }
 
-func (s *server) handleConn(rwc net.Conn) error {
+func (s *server) handleConn(rwc net.Conn, allow RPCSet) error {
 	c := &conn{
-		rwc:  rwc,
-		bufr: bufio.NewReader(rwc),
-		bufw: bufio.NewWriter(rwc),
+		rwc:     rwc,
+		bufr:    bufio.NewReader(rwc),
+		bufw:    bufio.NewWriter(rwc),
+		capture: s.r.capture,
 	}
 
 	var nid uint64
+	var auth authState // see Options.PeerKey
 	defer func() {
 		if nid != 0 {
 			select {
@@ -93,7 +156,7 @@ func (s *server) handleConn(rwc net.Conn) error {
 			}
 		}
 	}()
-	for !isClosed(s.stopCh) {
+	for first := true; !isClosed(s.stopCh); first = false {
 		// clear deadline
 		if err := c.rwc.SetReadDeadline(time.Time{}); err != nil {
 			return err
@@ -102,9 +165,19 @@ func (s *server) handleConn(rwc net.Conn) error {
 		if err != nil {
 			return err
 		}
+		if b == frameMagic[0] {
+			typ, frame, err := readFrame(c.bufr, &c.frameBuf)
+			if err != nil {
+				return err
+			}
+			b, c.frame = uint8(typ), frame
+		}
 
 		ttype := taskType(b)
 		if ttype.isValid() {
+			if allow&AdminRPCs == 0 {
+				return errNotAllowed
+			}
 			if err = s.handleTask(ttype, c); err != nil {
 				return err
 			}
@@ -112,7 +185,54 @@ func (s *server) handleConn(rwc net.Conn) error {
 		}
 
 		rtype := rpcType(b)
+		if rtype == rpcPing {
+			if err = writeUint8(c.bufw, b); err != nil {
+				return err
+			}
+			if err = c.bufw.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if allow&PeerRPCs == 0 && rtype.isValid() {
+			return errNotAllowed
+		}
+		if nid == 0 && rtype.isValid() && rtype != rpcIdentity {
+			// requests are served only after identity handshake,
+			// which validates cluster id. see rpcIdentity
+			return errNoIdentity
+		}
+		if rtype == rpcIdentity && nid != 0 {
+			// identity of connection must not change after handshake,
+			// because it is trusted by auth, rate limiter and rejoin
+			return errPeerMismatch
+		}
+		if rtype == rpcAuth {
+			if err = s.handleAuth(c, nid, &auth); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.r.peerKey != nil && !auth.done && rtype.isValid() && rtype != rpcIdentity {
+			return errAuthFailed
+		}
+		if rtype == rpcSendSnap {
+			if err = s.handleSendSnap(c, nid); err != nil {
+				return err
+			}
+			continue
+		}
+		if rtype == rpcIdentityUpdate {
+			if err = s.handleIdentityUpdate(c, nid); err != nil {
+				return err
+			}
+			continue
+		}
 		if !rtype.isValid() {
+			if first {
+				// not a raft client, no need to panic in testMode
+				return errNotRaft
+			}
 			err = fmt.Errorf("raft: server.handleRpc got rpcType %d", b)
 			if testMode {
 				panic(err)
@@ -127,16 +247,31 @@ func (s *server) handleConn(rwc net.Conn) error {
 		// that leader has contacted as soon as possible. so raft reads the
 		// actual request with deadline
 		if !rtype.fromLeader() {
-			if err := rpc.req.decode(c.bufr); err != nil {
+			if err := c.decodeReq(rpc.req); err != nil {
 				return err
 			}
+			if nid != 0 && rpc.req.from() != nid {
+				return errPeerMismatch
+			}
+		}
+
+		// wait for rate limit
+		p := rtype.priority()
+		if s.r.rateLimiter != nil && nid != 0 && p != priorityElection {
+			if d := s.r.rateLimiter.reserve(nid); d > 0 {
+				select {
+				case <-s.stopCh:
+					return ErrServerClosed
+				case <-after(s.r.clock, d):
+				}
+			}
 		}
 
 		// send request for processing
 		select {
 		case <-s.stopCh:
 			return ErrServerClosed
-		case s.r.rpcCh <- rpc:
+		case s.r.rpcCh[p] <- rpc:
 		}
 
 		// wait for response
@@ -151,8 +286,9 @@ func (s *server) handleConn(rwc net.Conn) error {
 			return rpc.readErr
 		}
 		if rpc.req.rpcType() == rpcIdentity && rpc.resp.getResult() == success {
-			nid = rpc.req.from()
+			nid, c.peer = rpc.req.from(), rpc.req.from()
 		}
+		c.capture.message(false, CaptureResponse, rtype, rpc.req.from(), rpc.resp)
 		// todo: set write deadline
 		if err = rpc.resp.encode(c.bufw); err != nil {
 			return err
@@ -200,6 +336,36 @@ func (s *server) handleTask(typ taskType, c *conn) error {
 			return err
 		}
 		t = TransferLeadership(target, time.Duration(int64(d)))
+	case taskGetLogEntries:
+		from, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		to, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = GetLogEntries(from, to)
+	case taskPause:
+		d, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = Pause(time.Duration(int64(d)))
+	case taskResume:
+		t = Resume()
+	case taskCampaign:
+		t = Campaign()
+	case taskStepDown:
+		transfer, err := readBool(c.bufr)
+		if err != nil {
+			return err
+		}
+		d, err := readUint64(c.bufr)
+		if err != nil {
+			return err
+		}
+		t = StepDown(transfer, time.Duration(int64(d)))
 	default:
 		panic(unreachable())
 	}
@@ -211,16 +377,16 @@ func (s *server) handleTask(typ taskType, c *conn) error {
 }
 
 func (s *server) executeTask(t Task) {
-	select {
-	case <-s.r.Closed():
-		t.reply(ErrServerClosed)
+	if err := s.r.SubmitTask(context.Background(), t); err != nil {
+		t.reply(err)
 		return
-	case s.r.Tasks() <- t:
 	}
 	<-t.Done()
 }
 
 func (s *server) shutdown() {
 	close(s.stopCh)
-	_ = s.lr.Close()
+	for _, l := range s.lrs {
+		_ = l.Close()
+	}
 }
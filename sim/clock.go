@@ -0,0 +1,200 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// Clock is a fake clock, whose time moves only when
+// Advance is called. Timers fire in the order of their
+// expiry, ties are broken by creation order.
+//
+// Clock can be used as raft.Options.Clock.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+}
+
+var _ raft.Clock = (*Clock)(nil)
+
+// NewClock creates fake clock with given time as its current time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates timer that fires when the clock is
+// advanced by at least d.
+func (c *Clock) NewTimer(d time.Duration) raft.Timer {
+	t := &timer{clock: c, ch: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc calls f when the clock is advanced by at least d.
+// f is called synchronously from Advance.
+func (c *Clock) AfterFunc(d time.Duration, f func()) raft.Timer {
+	t := &timer{clock: c, fn: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers
+// that expire on the way in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for c.fireNext(end) {
+	}
+	c.mu.Lock()
+	if c.now.Before(end) {
+		c.now = end
+	}
+	c.mu.Unlock()
+}
+
+// fires the earliest timer, if it expires at or before end.
+func (c *Clock) fireNext(end time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		c.mu.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*timer)
+	if c.now.Before(t.when) {
+		c.now = t.when
+	}
+	now := c.now
+	c.mu.Unlock()
+	if t.fn != nil {
+		t.fn()
+	} else {
+		select {
+		case t.ch <- now:
+		default:
+		}
+	}
+	return true
+}
+
+// Run advances the clock by step until cond returns true, or
+// the clock is advanced by max. After each step, it yields the
+// processor, so that goroutines woken by fired timers can run.
+// Reports whether cond returned true.
+//
+// Note that goroutine scheduling is not controlled by the
+// clock. The step should be small compared to the timeouts
+// in raft.Options, so that raft does not observe spurious
+// timeouts while it is busy with disk or cpu.
+func (c *Clock) Run(step, max time.Duration, cond func() bool) bool {
+	for elapsed := time.Duration(0); ; elapsed += step {
+		if cond() {
+			return true
+		}
+		if elapsed >= max {
+			return false
+		}
+		c.Advance(step)
+		runtime.Gosched()
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// timer ----------------------------------------------
+
+type timer struct {
+	clock *Clock
+	when  time.Time
+	seq   uint64
+	ch    chan time.Time
+	fn    func()
+	index int // in clock.timers, -1 if not scheduled
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&c.timers, t.index)
+	}
+	c.seq++
+	t.when, t.seq = c.now.Add(d), c.seq
+	heap.Push(&c.timers, t)
+	return active
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// ErrTimeout is returned when the condition is not met within
+// the given duration on fake clock.
+var ErrTimeout = errors.New("sim: timeout")
+
+// Cluster runs raft nodes on simulated network and clock.
+type Cluster struct {
+	Clock   *Clock
+	Network *Network
+
+	// Step is the duration by which clock is advanced, while
+	// waiting for something. Defaults to HeartbeatTimeout/20.
+	Step time.Duration
+
+	Nodes map[uint64]*raft.Raft
+
+	serveErr map[uint64]chan error
+}
+
+// NewCluster launches and bootstraps n node cluster, with storage
+// under dir. opt is used for all nodes, except its Clock and Dial.
+// If opt.CaptureFile is set, host of node is appended to it, so
+// that each node records into its own file.
+func NewCluster(dir string, n int, seed int64, opt raft.Options, newFSM func(nid uint64) raft.FSM) (*Cluster, error) {
+	clock := NewClock(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := &Cluster{
+		Clock:    clock,
+		Network:  NewNetwork(clock, seed),
+		Step:     opt.HeartbeatTimeout / 20,
+		Nodes:    make(map[uint64]*raft.Raft),
+		serveErr: make(map[uint64]chan error),
+	}
+	config := raft.Config{Nodes: make(map[uint64]raft.Node)}
+	for id := uint64(1); id <= uint64(n); id++ {
+		if err := config.AddVoter(id, c.Addr(id)); err != nil {
+			return nil, err
+		}
+	}
+	for id := uint64(1); id <= uint64(n); id++ {
+		storageDir := filepath.Join(dir, fmt.Sprintf("n%d", id))
+		if err := os.MkdirAll(storageDir, 0700); err != nil {
+			return nil, err
+		}
+		if err := raft.SetIdentity(storageDir, 1, id); err != nil {
+			return nil, err
+		}
+		o := opt
+		o.Clock, o.Dial = c.Clock, c.Network.Dialer(c.Addr(id))
+		if o.CaptureFile != "" {
+			o.CaptureFile += "." + c.Host(id)
+		}
+		r, err := raft.New(o, newFSM(id), storageDir)
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+		l, err := c.Network.Listen(c.Addr(id))
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+		serveErr := make(chan error, 1)
+		c.Nodes[id], c.serveErr[id] = r, serveErr
+		go func() {
+			serveErr <- r.Serve(l)
+		}()
+	}
+	if _, err := c.Do(c.Nodes[1], raft.ChangeConfig(config), opt.HeartbeatTimeout); err != nil {
+		c.Shutdown()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Addr returns the address of node with given id.
+func (c *Cluster) Addr(id uint64) string {
+	return fmt.Sprintf("n%d:7000", id)
+}
+
+// Host returns the host of node with given id, as used by
+// Network.Partition and Network.SetFaults.
+func (c *Cluster) Host(id uint64) string {
+	return fmt.Sprintf("n%d", id)
+}
+
+// Do submits task t to r, and returns its result. The clock is
+// advanced until the task is done, but not more than max.
+func (c *Cluster) Do(r *raft.Raft, t raft.Task, max time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- r.SubmitTask(ctx, t)
+	}()
+	var err error
+	done := c.Clock.Run(c.Step, max, func() bool {
+		select {
+		case err = <-submitted:
+		default:
+		}
+		return err != nil || isClosed(t.Done())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, ErrTimeout
+	}
+	return t.Result(), t.Err()
+}
+
+// Replay sends the requests received by a node, as recorded in
+// raft.Options.CaptureFile, to node id, at the recorded intervals.
+// The requests are sent from the hosts of recorded nodes, so that
+// partitions and faults apply to them. The clock is advanced until
+// replay completes, but not more than max. See raft.Replayer.
+func (c *Cluster) Replay(id uint64, capture io.Reader, max time.Duration) error {
+	rp := &raft.Replayer{
+		CID:   1,
+		NID:   id,
+		Clock: c.Clock,
+		Dial: func(from uint64) (net.Conn, error) {
+			return c.Network.dial(c.Addr(from), c.Addr(id))
+		},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rp.Replay(capture)
+	}()
+	var err error
+	done := c.Clock.Run(c.Step, max, func() bool {
+		select {
+		case err = <-errCh:
+			return true
+		default:
+			return false
+		}
+	})
+	if !done {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Leader waits until cluster has a leader, known to all nodes,
+// advancing clock by not more than max.
+func (c *Cluster) Leader(max time.Duration) (*raft.Raft, error) {
+	var ldr *raft.Raft
+	deadline := c.Clock.Now().Add(max)
+	for c.Clock.Now().Before(deadline) {
+		ldr = nil
+		agree := true
+		for _, r := range c.Nodes {
+			result, err := c.Do(r, raft.GetInfo(), max)
+			if err != nil {
+				return nil, err
+			}
+			info := result.(raft.Info)
+			if info.Leader == 0 || (ldr != nil && ldr.NID() != info.Leader) {
+				agree = false
+				break
+			}
+			ldr = c.Nodes[info.Leader]
+		}
+		if agree && ldr != nil {
+			return ldr, nil
+		}
+		c.Clock.Run(c.Step, c.Step, func() bool { return false })
+	}
+	return nil, ErrTimeout
+}
+
+// Shutdown shuts down all nodes.
+func (c *Cluster) Shutdown() {
+	stop := make(chan struct{})
+	go func() {
+		// keep the time moving, while nodes shutdown
+		for !isClosed(stop) {
+			c.Clock.Run(c.Step, c.Step, func() bool { return false })
+		}
+	}()
+	for id, r := range c.Nodes {
+		_ = r.Shutdown(context.Background())
+		<-c.serveErr[id]
+	}
+	close(stop)
+}
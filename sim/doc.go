@@ -0,0 +1,40 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sim is a simulation test harness for raft, and for
+// FSMs built on it.
+//
+// Raft nodes run on fake Clock and in-memory Network. The test
+// moves the clock and decides the fate of each message: dropped,
+// duplicated, delayed or blocked by partition. Since time moves
+// only when the test says so, hundreds of elections take few
+// real milliseconds.
+//
+// Clients record the operations they perform in History, which
+// is then checked with CheckLinearizable against the sequential
+// Model of FSM:
+//
+//   c, err := sim.NewCluster(dir, 3, seed, opt, newFSM)
+//   ...
+//   op := h.Call(input)
+//   // submit task, and advance c.Clock until it is done
+//   op.Return(output)
+//   ...
+//   if !sim.CheckLinearizable(model, h) { ... }
+//
+// Given the seed, network faults and message delays are repeatable.
+// Goroutine scheduling and raft's election timeouts are random, so
+// a run is not replayed exactly; run tests many times, with
+// different seeds.
+package sim
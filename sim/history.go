@@ -0,0 +1,243 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import "sync"
+
+// Model is the sequential specification of the system
+// whose History is checked for linearizability.
+type Model struct {
+	// Init returns the initial state.
+	Init func() interface{}
+
+	// Step applies operation with given input on state. It returns
+	// false, if the output is not possible in given state. Otherwise
+	// it returns the new state. output is nil, for operations that
+	// never returned, such as the ones that failed with timeout.
+	Step func(state, input, output interface{}) (bool, interface{})
+
+	// Equal tells whether two states are same. If nil,
+	// states are compared using ==.
+	Equal func(s1, s2 interface{}) bool
+}
+
+// History records the operations performed by concurrent
+// clients, in the order they are called and returned.
+type History struct {
+	mu    sync.Mutex
+	seq   int
+	ops   []*Op
+	value int // last value given by nextValue
+}
+
+// nextValue returns unique value, to be written by an operation.
+func (h *History) nextValue() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.value++
+	return h.value
+}
+
+// Op is an operation recorded in History.
+type Op struct {
+	h      *History
+	id     int
+	Input  interface{}
+	Output interface{}
+	call   int
+	ret    int // 0 if not returned
+}
+
+// Call records the invocation of operation with given input.
+func (h *History) Call(input interface{}) *Op {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	op := &Op{h: h, id: len(h.ops), Input: input, call: h.seq}
+	h.ops = append(h.ops, op)
+	return op
+}
+
+// Return records that the operation returned with given output.
+// Operations whose outcome is unknown, should not be returned.
+func (op *Op) Return(output interface{}) {
+	h := op.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	op.Output, op.ret = output, h.seq
+}
+
+// CheckLinearizable reports whether the history is linearizable
+// with respect to model m. Operations that never returned may or
+// may not have taken effect.
+//
+// It implements the algorithm of Wing & Gong, as improved by Lowe.
+func CheckLinearizable(m Model, h *History) bool {
+	h.mu.Lock()
+	ops := append([]*Op(nil), h.ops...)
+	h.mu.Unlock()
+	equal := m.Equal
+	if equal == nil {
+		equal = func(s1, s2 interface{}) bool { return s1 == s2 }
+	}
+
+	// entries sorted by seq, in doubly linked list
+	type entry struct {
+		op         *Op
+		isCall     bool
+		match      *entry // return entry of call
+		prev, next *entry
+	}
+	bySeq := make(map[int]*entry)
+	pending := 0 // number of returned ops yet to be linearized
+	for _, op := range ops {
+		call := &entry{op: op, isCall: true}
+		bySeq[op.call] = call
+		if op.ret != 0 {
+			ret := &entry{op: op}
+			call.match = ret
+			bySeq[op.ret] = ret
+			pending++
+		}
+	}
+	head := &entry{}
+	prev := head
+	for seq := 1; seq <= h.seq; seq++ {
+		if e, ok := bySeq[seq]; ok {
+			prev.next, e.prev = e, prev
+			prev = e
+		}
+	}
+	lift := func(e *entry) {
+		e.prev.next = e.next
+		if e.next != nil {
+			e.next.prev = e.prev
+		}
+		if m := e.match; m != nil {
+			m.prev.next = m.next
+			if m.next != nil {
+				m.next.prev = m.prev
+			}
+		}
+	}
+	unlift := func(e *entry) {
+		if m := e.match; m != nil {
+			m.prev.next = m
+			if m.next != nil {
+				m.next.prev = m
+			}
+		}
+		e.prev.next = e
+		if e.next != nil {
+			e.next.prev = e
+		}
+	}
+
+	type frame struct {
+		e     *entry
+		state interface{}
+	}
+	type cached struct {
+		linearized bitset
+		state      interface{}
+	}
+	cache := make(map[uint64][]cached)
+	seen := func(b bitset, state interface{}) bool {
+		for _, c := range cache[b.hash()] {
+			if c.linearized.equal(b) && equal(c.state, state) {
+				return true
+			}
+		}
+		cache[b.hash()] = append(cache[b.hash()], cached{b.clone(), state})
+		return false
+	}
+
+	var stack []frame
+	linearized := newBitset(len(ops))
+	state := m.Init()
+	e := head.next
+	for pending > 0 {
+		if e != nil && e.isCall {
+			var output interface{}
+			if e.match != nil {
+				output = e.op.Output
+			}
+			if ok, next := m.Step(state, e.op.Input, output); ok {
+				linearized.set(e.op.id)
+				if !seen(linearized, next) {
+					stack = append(stack, frame{e, state})
+					state = next
+					if e.match != nil {
+						pending--
+					}
+					lift(e)
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op.id)
+			}
+			e = e.next
+			continue
+		}
+		// return entry reached, or no more calls: backtrack
+		if len(stack) == 0 {
+			return false
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = f.state
+		linearized.clear(f.e.op.id)
+		if f.e.match != nil {
+			pending++
+		}
+		unlift(f.e)
+		e = f.e.next
+	}
+	return true
+}
+
+// bitset ---------------------------------------------
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equal(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	var h uint64 = 14695981039346656037 // fnv-1a
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sim
+
+package sim
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// Long running linearizability checks, under random partitions and
+// faults. Run them with:
+//
+//   go test -tags sim ./sim -sim.seeds=100
+
+var numSeeds = flag.Int("sim.seeds", 10, "number of seeds to run linearizability checks")
+
+func TestLinearizable_partitions(t *testing.T) {
+	for seed := int64(1); seed <= int64(*numSeeds); seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			testLinearizable(t, seed)
+		})
+	}
+}
+
+func testLinearizable(t *testing.T, seed int64) {
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = 100 * time.Millisecond
+	opt.PromoteThreshold = opt.HeartbeatTimeout
+	c, err := NewCluster(dir, 5, seed, opt, NewRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	if _, err = c.Leader(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(seed))
+	var hosts []string
+	for id := range c.Nodes {
+		hosts = append(hosts, c.Host(id))
+	}
+	h := &History{}
+	c.RunRegister(h, 30, 2*time.Second, func(round int) {
+		if round%3 != 0 {
+			return
+		}
+		c.Network.Heal()
+		rnd.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+		switch rnd.Intn(4) {
+		case 0:
+			// isolate a node
+			c.Network.Partition(hosts[:1], hosts[1:])
+		case 1:
+			// split into minority and majority
+			c.Network.Partition(hosts[:2], hosts[2:])
+		case 2:
+			// lossy and slow network
+			c.Network.SetFaults("", "", Faults{Drop: 0.05, Delay: 20 * time.Millisecond})
+		default:
+			// healthy network
+		}
+	})
+	if !CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history is not linearizable")
+	}
+}
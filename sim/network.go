@@ -0,0 +1,502 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults tells how messages sent on a link are mistreated.
+// Each Write on a connection is a message.
+//
+// Raft connections are byte streams, like TCP. So a dropped
+// message black holes rest of the stream, and the receiver
+// notices it only by read timeout, just like a lost TCP
+// connection. A duplicated message corrupts the stream,
+// exercising the handling of protocol errors.
+type Faults struct {
+	// Drop is the probability that a message is dropped.
+	Drop float64
+
+	// Duplicate is the probability that a message is
+	// delivered twice.
+	Duplicate float64
+
+	// Delay is the maximum delay in delivering a message.
+	// Actual delay is random in [0, Delay]. Messages are
+	// never reordered within a connection.
+	Delay time.Duration
+}
+
+// Network is an in-memory network, whose message delivery is
+// controlled by the test. Delays are measured using the fake
+// clock, and random decisions are made using the seed given,
+// so that faults can be replayed.
+//
+// Hosts are identified by the host part of their addresses.
+type Network struct {
+	clock *Clock
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	listeners map[string]*listener // addr -> listener
+	faults    map[link]Faults
+	groups    map[string]int // host -> partition group
+	conns     map[*conn]struct{}
+}
+
+type link struct {
+	from, to string
+}
+
+// NewNetwork creates network, that uses clock c for delays.
+func NewNetwork(c *Clock, seed int64) *Network {
+	return &Network{
+		clock:     c,
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*listener),
+		faults:    make(map[link]Faults),
+		conns:     make(map[*conn]struct{}),
+	}
+}
+
+// SetFaults sets the faults for messages sent from host from
+// to host to. Empty host matches any host.
+func (n *Network) SetFaults(from, to string, f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults[link{from, to}] = f
+}
+
+// Partition splits the network into given groups of hosts.
+// Hosts in different groups cannot talk to each other, and
+// existing connections between them are broken. Hosts not
+// in any group can talk to everyone.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, host := range g {
+			n.groups[host] = i
+		}
+	}
+	for c := range n.conns {
+		if !n.allowed(c.local, c.remote) {
+			c.breakLink(errPartitioned)
+		}
+	}
+}
+
+// Heal removes all partitions and faults.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = nil
+	n.faults = make(map[link]Faults)
+}
+
+// Listen announces on the given address.
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	if _, err := host(addr); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("sim: listen %s: address already in use", addr)
+	}
+	l := &listener{
+		network: n,
+		addr:    addr,
+		connCh:  make(chan net.Conn, 16),
+		closeCh: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dialer returns function to be used as raft.Options.Dial
+// by the node listening on addr.
+func (n *Network) Dialer(addr string) func(network, address string, timeout time.Duration) (net.Conn, error) {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return n.dial(addr, address)
+	}
+}
+
+func (n *Network) dial(from, to string) (net.Conn, error) {
+	local, err := host(from)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := host(to)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l, ok := n.listeners[to]
+	if !ok || isClosed(l.closeCh) {
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: addr(to), Err: errRefused}
+	}
+	if !n.allowed(local, remote) {
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: addr(to), Err: errPartitioned}
+	}
+	c1 := newConn(n, local, remote, addr(from), addr(to))
+	c2 := newConn(n, remote, local, addr(to), addr(from))
+	c1.peer, c2.peer = c2, c1
+	select {
+	case l.connCh <- c2:
+	default:
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: addr(to), Err: errRefused}
+	}
+	n.conns[c1], n.conns[c2] = struct{}{}, struct{}{}
+	return c1, nil
+}
+
+// must be called with n.mu locked.
+func (n *Network) allowed(from, to string) bool {
+	if n.groups == nil {
+		return true
+	}
+	g1, ok1 := n.groups[from]
+	g2, ok2 := n.groups[to]
+	return !ok1 || !ok2 || g1 == g2
+}
+
+// must be called with n.mu locked.
+func (n *Network) faultsFor(from, to string) Faults {
+	for _, l := range []link{{from, to}, {from, ""}, {"", to}, {"", ""}} {
+		if f, ok := n.faults[l]; ok {
+			return f
+		}
+	}
+	return Faults{}
+}
+
+// send decides the fate of message b sent on c, and
+// schedules its delivery to c.peer.
+func (n *Network) send(c *conn, b []byte) {
+	n.mu.Lock()
+	f := n.faultsFor(c.local, c.remote)
+	drop := f.Drop > 0 && n.rand.Float64() < f.Drop
+	dup := f.Duplicate > 0 && n.rand.Float64() < f.Duplicate
+	var delay time.Duration
+	if f.Delay > 0 {
+		delay = time.Duration(n.rand.Int63n(int64(f.Delay) + 1))
+	}
+	n.mu.Unlock()
+
+	if drop {
+		c.blackhole()
+		return
+	}
+	msg := append([]byte(nil), b...)
+	if dup {
+		msg = append(msg, b...)
+	}
+	at := n.clock.Now().Add(delay)
+	c.mu.Lock()
+	if at.Before(c.lastAt) { // no reordering within connection
+		at = c.lastAt
+	}
+	c.lastAt = at
+	c.mu.Unlock()
+	if d := at.Sub(n.clock.Now()); d > 0 {
+		n.clock.AfterFunc(d, func() { c.peer.deliver(msg) })
+	} else {
+		c.peer.deliver(msg)
+	}
+}
+
+func (n *Network) removeConn(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c)
+}
+
+// listener ----------------------------------------------
+
+type listener struct {
+	network *Network
+	addr    string
+	connCh  chan net.Conn
+	closeCh chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, &net.OpError{Op: "accept", Net: "sim", Addr: l.Addr(), Err: errClosed}
+	}
+}
+
+func (l *listener) Close() error {
+	n := l.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if isClosed(l.closeCh) {
+		return &net.OpError{Op: "close", Net: "sim", Addr: l.Addr(), Err: errClosed}
+	}
+	close(l.closeCh)
+	delete(n.listeners, l.addr)
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.addr)
+}
+
+// conn ----------------------------------------------
+
+type conn struct {
+	network       *Network
+	local, remote string // hosts
+	laddr, raddr  net.Addr
+	peer          *conn
+
+	mu            sync.Mutex
+	buf           []byte
+	wake          chan struct{} // closed on any change
+	lastAt        time.Time     // delivery time of last message sent
+	eof           bool          // peer closed
+	closed        bool
+	broken        error // link is broken
+	blackholed    bool  // messages are dropped silently
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(n *Network, local, remote string, laddr, raddr net.Addr) *conn {
+	return &conn{
+		network: n,
+		local:   local,
+		remote:  remote,
+		laddr:   laddr,
+		raddr:   raddr,
+		wake:    make(chan struct{}),
+	}
+}
+
+// must be called with c.mu locked.
+func (c *conn) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *conn) deliver(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed && c.broken == nil {
+		c.buf = append(c.buf, b...)
+		c.notify()
+	}
+}
+
+func (c *conn) blackhole() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blackholed = true
+}
+
+func (c *conn) breakLink(err error) {
+	for _, c := range []*conn{c, c.peer} {
+		c.mu.Lock()
+		if c.broken == nil {
+			c.broken = err
+			c.notify()
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+			c.mu.Unlock()
+			return 0, c.opError("read", errClosed)
+		case len(c.buf) > 0:
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		case c.broken != nil:
+			err := c.broken
+			c.mu.Unlock()
+			return 0, c.opError("read", err)
+		case c.eof:
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if err := c.wait(c.readDeadline, "read"); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait waits for change in conn or deadline.
+// must be called with c.mu locked, returns with c.mu unlocked.
+func (c *conn) wait(deadline time.Time, op string) error {
+	wake := c.wake
+	c.mu.Unlock()
+	if deadline.IsZero() {
+		<-wake
+		return nil
+	}
+	d := deadline.Sub(c.network.clock.Now())
+	if d <= 0 {
+		return c.opError(op, errTimeout)
+	}
+	t := c.network.clock.NewTimer(d)
+	select {
+	case <-wake:
+		t.Stop()
+	case <-t.C():
+	}
+	return nil
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	switch {
+	case c.closed:
+		c.mu.Unlock()
+		return 0, c.opError("write", errClosed)
+	case c.broken != nil:
+		err := c.broken
+		c.mu.Unlock()
+		return 0, c.opError("write", err)
+	case !c.writeDeadline.IsZero() && !c.network.clock.Now().Before(c.writeDeadline):
+		c.mu.Unlock()
+		return 0, c.opError("write", errTimeout)
+	case c.blackholed:
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	c.mu.Unlock()
+	if len(b) > 0 {
+		c.network.send(c, b)
+	}
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.opError("close", errClosed)
+	}
+	c.closed = true
+	c.notify()
+	lastAt := c.lastAt
+	c.mu.Unlock()
+
+	// peer sees eof after the messages in flight
+	eof := func() {
+		p := c.peer
+		p.mu.Lock()
+		p.eof = true
+		p.notify()
+		p.mu.Unlock()
+	}
+	if d := lastAt.Sub(c.network.clock.Now()); d > 0 {
+		c.network.clock.AfterFunc(d, eof)
+	} else {
+		eof()
+	}
+
+	c.network.removeConn(c)
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.laddr }
+func (c *conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "sim", Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+// errors ----------------------------------------------
+
+var (
+	errClosed      = errors.New("use of closed network connection")
+	errRefused     = errors.New("connection refused")
+	errPartitioned = errors.New("network is partitioned")
+	errTimeout     = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// -----------------------------------------------------
+
+type addr string
+
+func (a addr) Network() string { return "sim" }
+func (a addr) String() string  { return string(a) }
+
+func host(addr string) (string, error) {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("sim: %v", err)
+	}
+	return h, nil
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+// Register is an FSM holding single integer, used to verify that
+// raft is linearizable. UpdateFSM sets it to the integer in command,
+// and ReadFSM returns it. Use Cluster.RunRegister to record History
+// of operations on it, and check it against RegisterModel:
+//
+//   c, err := sim.NewCluster(dir, 5, seed, opt, sim.NewRegister)
+//   ...
+//   h := &sim.History{}
+//   c.RunRegister(h, rounds, max, func(round int) {
+//       // inject partitions and faults
+//   })
+//   if !sim.CheckLinearizable(sim.RegisterModel, h) { ... }
+type Register struct {
+	mu sync.Mutex
+	v  int
+}
+
+// NewRegister returns new Register. Its signature allows it to be
+// passed to NewCluster.
+func NewRegister(nid uint64) raft.FSM {
+	return &Register{}
+}
+
+// Update implements raft.FSM.
+func (r *Register) Update(cmd []byte) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := fmt.Sscan(string(cmd), &r.v)
+	return err
+}
+
+// Read implements raft.FSM.
+func (r *Register) Read(cmd interface{}) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.v
+}
+
+// Snapshot implements raft.FSM.
+func (r *Register) Snapshot() (raft.FSMState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return registerState(r.v), nil
+}
+
+// Restore implements raft.FSM.
+func (r *Register) Restore(rd io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := fmt.Fscan(rd, &r.v)
+	if err == io.EOF {
+		return errors.New("sim: empty register snapshot")
+	}
+	return err
+}
+
+type registerState int
+
+func (s registerState) Persist(w io.Writer) error {
+	_, err := fmt.Fprint(w, int(s))
+	return err
+}
+
+func (s registerState) Release() {}
+
+// RegisterWrite is the input of operation, that writes the value
+// into Register. Its output is true.
+type RegisterWrite int
+
+// RegisterRead is the input of operation, that reads the value of
+// Register. Its output is the value read.
+type RegisterRead struct{}
+
+// RegisterModel is the Model of Register.
+var RegisterModel = Model{
+	Init: func() interface{} { return 0 },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		if w, ok := input.(RegisterWrite); ok {
+			return true, int(w)
+		}
+		return output == nil || output == state, state
+	},
+}
+
+// RunRegister runs rounds of concurrent operations on Register FSM
+// of nodes, recording them in h. In each round, every node is given
+// a write of unique value and a read, and the clock is advanced until
+// all of them are done, but not more than max. Operations that fail,
+// are recorded as never returned, because their outcome is unknown.
+//
+// If before is not nil, it is called at the start of each round,
+// to inject partitions and faults.
+func (c *Cluster) RunRegister(h *History, rounds int, max time.Duration, before func(round int)) {
+	for round := 0; round < rounds; round++ {
+		if before != nil {
+			before(round)
+		}
+		var wg sync.WaitGroup
+		var ops []func() bool
+		for _, r := range c.Nodes {
+			for _, input := range []interface{}{RegisterWrite(h.nextValue()), RegisterRead{}} {
+				var t raft.FSMTask
+				if w, ok := input.(RegisterWrite); ok {
+					t = raft.UpdateFSM([]byte(fmt.Sprint(int(w))))
+				} else {
+					t = raft.ReadFSM(nil)
+				}
+				input, op := input, h.Call(input)
+				wg.Add(1)
+				go func(r *raft.Raft) {
+					defer wg.Done()
+					_ = r.SubmitTask(context.Background(), t)
+				}(r)
+				returned := false
+				ops = append(ops, func() bool {
+					if !returned && isClosed(t.Done()) {
+						returned = true
+						if t.Err() == nil { // on error, outcome is unknown
+							if _, ok := input.(RegisterWrite); ok {
+								op.Return(true)
+							} else {
+								op.Return(t.Result())
+							}
+						}
+					}
+					return returned
+				})
+			}
+		}
+		c.Clock.Run(c.Step, max, func() bool {
+			done := true
+			for _, op := range ops {
+				done = op() && done
+			}
+			return done
+		})
+		wg.Wait()
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/raft"
+)
+
+func TestClock(t *testing.T) {
+	c := NewClock(time.Unix(0, 0))
+	var fired []int
+	c.AfterFunc(3*time.Second, func() { fired = append(fired, 3) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	timer := c.NewTimer(2 * time.Second)
+	if !stopped.Stop() {
+		t.Fatal("stop must return true for active timer")
+	}
+
+	c.Advance(2 * time.Second)
+	if fmt.Sprint(fired) != "[1]" {
+		t.Fatalf("fired=%v, want [1]", fired)
+	}
+	select {
+	case now := <-timer.C():
+		if want := time.Unix(2, 0); !now.Equal(want) {
+			t.Fatalf("timer.time=%v, want %v", now, want)
+		}
+	default:
+		t.Fatal("timer not fired")
+	}
+	if timer.Stop() {
+		t.Fatal("stop must return false for expired timer")
+	}
+
+	c.Advance(time.Hour)
+	if fmt.Sprint(fired) != "[1 3]" {
+		t.Fatalf("fired=%v, want [1 3]", fired)
+	}
+	if want := time.Unix(3602, 0); !c.Now().Equal(want) {
+		t.Fatalf("now=%v, want %v", c.Now(), want)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	c := NewClock(time.Unix(0, 0))
+	n := NewNetwork(c, 1)
+	l, err := n.Listen("b:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dial := n.Dialer("a:1")
+	if _, err = dial("tcp", "c:1", time.Second); err == nil {
+		t.Fatal("dial to unknown address must fail")
+	}
+	c1, err := dial("tcp", "b:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delayed message
+	n.SetFaults("a", "b", Faults{Delay: time.Second})
+	if _, err = c1.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(c2)
+		received <- string(b)
+	}()
+	_ = c1.Close()
+	select {
+	case <-received:
+		t.Fatal("message must not be delivered before advancing clock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	if s := <-received; s != "hello" {
+		t.Fatalf("received %q, want %q", s, "hello")
+	}
+
+	// read deadline
+	c1, err = dial("tcp", "b:1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c2.SetReadDeadline(c.Now().Add(time.Second))
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := c2.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Advance(time.Second)
+	if err := <-readErr; err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("read error: got %v, want timeout", err)
+	}
+
+	// partition
+	n.Partition([]string{"a"}, []string{"b"})
+	if _, err = c1.Write([]byte("x")); err == nil {
+		t.Fatal("write must fail after partition")
+	}
+	if _, err = dial("tcp", "b:1", time.Second); err == nil {
+		t.Fatal("dial must fail after partition")
+	}
+	n.Heal()
+	if _, err = dial("tcp", "b:1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	// a: RegisterWrite(1) |--------|
+	// b:             read()=1 |-----|
+	// c:   read()=0 |----|
+	h := &History{}
+	a := h.Call(RegisterWrite(1))
+	c := h.Call(RegisterRead{})
+	c.Return(0)
+	b := h.Call(RegisterRead{})
+	a.Return(true)
+	b.Return(1)
+	if !CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history must be linearizable")
+	}
+
+	// read after write returned, must see the write
+	h = &History{}
+	a = h.Call(RegisterWrite(1))
+	a.Return(true)
+	b = h.Call(RegisterRead{})
+	b.Return(0)
+	if CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history must not be linearizable")
+	}
+
+	// write never returned, may or may not take effect
+	h = &History{}
+	h.Call(RegisterWrite(1))
+	b = h.Call(RegisterRead{})
+	b.Return(1)
+	c = h.Call(RegisterRead{})
+	c.Return(0)
+	if CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history must not be linearizable")
+	}
+	h = &History{}
+	h.Call(RegisterWrite(1))
+	b = h.Call(RegisterRead{})
+	b.Return(0)
+	c = h.Call(RegisterRead{})
+	c.Return(1)
+	if !CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history must be linearizable")
+	}
+}
+
+func TestCluster_linearizable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = 100 * time.Millisecond
+	opt.PromoteThreshold = opt.HeartbeatTimeout
+	c, err := NewCluster(dir, 3, 1, opt, NewRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.Network.SetFaults("", "", Faults{Delay: 5 * time.Millisecond})
+
+	ldr, err := c.Leader(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &History{}
+	c.RunRegister(h, 20, 2*time.Second, func(round int) {
+		switch round {
+		case 7:
+			// isolate leader, and let others elect new leader
+			c.Network.Partition([]string{c.Host(ldr.NID())}, others(c, ldr))
+			c.Clock.Run(c.Step, time.Second, func() bool { return false })
+		case 14:
+			c.Network.Heal()
+			c.Network.SetFaults("", "", Faults{Delay: 5 * time.Millisecond})
+			c.Clock.Run(c.Step, time.Second, func() bool { return false })
+		}
+	})
+
+	if !CheckLinearizable(RegisterModel, h) {
+		t.Fatal("history is not linearizable")
+	}
+}
+
+// tests that fake clock runs many elections, without real sleeping
+func TestCluster_elections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = time.Second
+	opt.PromoteThreshold = opt.HeartbeatTimeout
+	c, err := NewCluster(dir, 3, 1, opt, NewRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	start, realStart := c.Clock.Now(), time.Now()
+	var term uint64
+	for i := 0; i < 20; i++ {
+		ldr, err := c.Leader(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.Do(ldr, raft.GetInfo(), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.(raft.Info).Term; got <= term {
+			t.Fatalf("term=%d, want >%d", got, term)
+		}
+		term = info.(raft.Info).Term
+
+		// isolate leader, to force election
+		c.Network.Partition([]string{c.Host(ldr.NID())}, others(c, ldr))
+		c.Clock.Run(c.Step, 5*time.Second, func() bool { return false })
+		c.Network.Heal()
+	}
+	elapsed, realElapsed := c.Clock.Now().Sub(start), time.Since(realStart)
+	t.Logf("fake time: %v, real time: %v", elapsed, realElapsed)
+	if realElapsed > elapsed {
+		t.Fatalf("real time %v > fake time %v", realElapsed, elapsed)
+	}
+}
+
+func TestCluster_replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := raft.DefaultOptions()
+	opt.Logger = nil
+	opt.HeartbeatTimeout = time.Second
+	opt.PromoteThreshold = opt.HeartbeatTimeout
+
+	// record elections, as seen by n1
+	opt.CaptureFile = filepath.Join(dir, "capture")
+	c, err := NewCluster(filepath.Join(dir, "recorded"), 3, 1, opt, NewRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		ldr, err := c.Leader(time.Minute)
+		if err != nil {
+			c.Shutdown()
+			t.Fatal(err)
+		}
+		c.Network.Partition([]string{c.Host(ldr.NID())}, others(c, ldr))
+		c.Clock.Run(c.Step, 5*time.Second, func() bool { return false })
+		c.Network.Heal()
+	}
+	c.Shutdown()
+	recorded := filepath.Join(dir, "capture."+c.Host(1))
+	want, err := capturedRequests(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		t.Fatal("no requests recorded")
+	}
+
+	// replay into n1 of new cluster, which records too
+	opt.CaptureFile = filepath.Join(dir, "replay")
+	c, err = NewCluster(filepath.Join(dir, "replayed"), 3, 1, opt, NewRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(recorded)
+	if err != nil {
+		c.Shutdown()
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = c.Replay(1, f, 5*time.Minute)
+	c.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// n1 must have received all recorded requests
+	got, err := capturedRequests(filepath.Join(dir, "replay."+c.Host(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for req := range want {
+		if !got[req] {
+			t.Fatalf("request %s not replayed", req)
+		}
+	}
+}
+
+// capturedRequests returns the vote and append requests received,
+// as recorded in capture file.
+func capturedRequests(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reqs := make(map[string]bool)
+	err = raft.ReadCapture(f, func(rec raft.CaptureRecord) error {
+		if rec.Inbound && rec.Kind == raft.CaptureRequest && (rec.Type == "vote" || rec.Type == "append") {
+			reqs[fmt.Sprintf("%s from n%d in term %d", rec.Type, rec.Peer, rec.Term)] = true
+		}
+		return nil
+	})
+	return reqs, err
+}
+
+// returns hosts of nodes other than r.
+func others(c *Cluster, r *raft.Raft) []string {
+	var hosts []string
+	for id := range c.Nodes {
+		if id != r.NID() {
+			hosts = append(hosts, c.Host(id))
+		}
+	}
+	return hosts
+}
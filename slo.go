@@ -0,0 +1,112 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"fmt"
+	"time"
+)
+
+// appendTime is the time at which leader appended entries
+// in range [first, last].
+type appendTime struct {
+	first, last uint64
+	time        time.Time
+}
+
+// SlowCommit describes an entry, that is not committed within
+// Options.CommitSLO. It is raised by Alerts.SlowCommit.
+type SlowCommit struct {
+	// Index of the oldest entry, that is not committed.
+	Index uint64
+
+	// Appended is the time at which leader appended the entry at Index.
+	Appended time.Time
+
+	// Latency is the time elapsed since Appended, when the alert is raised.
+	Latency time.Duration
+
+	// CommitIndex and LastIndex of leader, when the alert is raised.
+	CommitIndex uint64
+	LastIndex   uint64
+
+	// MatchIndex of each follower, including nonvoters, when the
+	// alert is raised.
+	MatchIndex map[uint64]uint64
+}
+
+func (c SlowCommit) String() string {
+	return fmt.Sprintf("index:%d latency:%s commitIndex:%d lastIndex:%d matchIndex:%v",
+		c.Index, c.Latency, c.CommitIndex, c.LastIndex, c.MatchIndex)
+}
+
+// recordAppend remembers the time at which entries starting from
+// index first, till lastLogIndex are appended.
+func (l *leader) recordAppend(first uint64) {
+	if l.commitSLO <= 0 {
+		return
+	}
+	l.appends = append(l.appends, appendTime{first, l.lastLogIndex, l.clock.Now()})
+	if !l.sloTimer.active {
+		l.checkCommitSLO()
+	}
+}
+
+// checkCommitSLO raises SlowCommit alert, if the oldest entry that is
+// not committed, is appended before CommitSLO. Otherwise sloTimer is
+// scheduled to check again, when CommitSLO of that entry elapses.
+//
+// this is called:
+// - from leader.recordAppend, if sloTimer is not active
+// - from leader.onMajorityCommit
+// - on leader.sloTimer
+func (l *leader) checkCommitSLO() {
+	if l.commitSLO <= 0 {
+		return
+	}
+	i := 0
+	for i < len(l.appends) && l.appends[i].last <= l.commitIndex {
+		i++
+	}
+	l.appends = l.appends[i:]
+	if len(l.appends) == 0 {
+		l.sloTimer.stop()
+		return
+	}
+
+	now, oldest := l.clock.Now(), l.appends[0]
+	if deadline := oldest.time.Add(l.commitSLO); now.Before(deadline) {
+		l.sloTimer.reset(deadline.Sub(now))
+		return
+	}
+	c := SlowCommit{
+		Index:       max(oldest.first, l.commitIndex+1),
+		Appended:    oldest.time,
+		Latency:     now.Sub(oldest.time),
+		CommitIndex: l.commitIndex,
+		LastIndex:   l.lastLogIndex,
+		MatchIndex:  make(map[uint64]uint64, len(l.repls)),
+	}
+	for id, repl := range l.repls {
+		c.MatchIndex[id] = repl.status.matchIndex
+	}
+	l.logger.Warn("entry is not committed within CommitSLO", "index", c.Index, "latency", c.Latency,
+		"commitIndex", c.CommitIndex, "lastIndex", c.LastIndex, "matchIndex", c.MatchIndex)
+	l.alerts.SlowCommit(c)
+
+	// raise once for all entries appended till now
+	l.appends = nil
+	l.sloTimer.stop()
+}
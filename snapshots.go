@@ -15,6 +15,7 @@
 package raft
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -30,6 +31,7 @@ import (
 type snapshots struct {
 	dir    string
 	retain int
+	crypt  *crypter // nil, if not encrypted
 
 	mu    sync.RWMutex
 	index uint64
@@ -39,7 +41,7 @@ type snapshots struct {
 	used   map[uint64]int // map[index]numUses
 }
 
-func openSnapshots(dir string, opt Options) (*snapshots, error) {
+func openSnapshots(dir string, opt Options, crypt *crypter) (*snapshots, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -50,6 +52,7 @@ func openSnapshots(dir string, opt Options) (*snapshots, error) {
 	s := &snapshots{
 		dir:    dir,
 		retain: opt.SnapshotsRetain,
+		crypt:  crypt,
 		used:   make(map[uint64]int),
 	}
 	if len(snaps) > 0 {
@@ -60,6 +63,9 @@ func openSnapshots(dir string, opt Options) (*snapshots, error) {
 		}
 		s.term = meta.term
 	}
+	if err = s.removeOrphans(snaps); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -69,28 +75,59 @@ func (s *snapshots) latest() (index, term uint64) {
 	return s.index, s.term
 }
 
+// setLatest makes snapshot at index the latest, and removes
+// older snapshots as per retain policy. The error returned is
+// from applying retain policy, snapshot is made latest anyway.
+func (s *snapshots) setLatest(index, term uint64) error {
+	s.mu.Lock()
+	s.index, s.term = index, term
+	s.mu.Unlock()
+	return s.applyRetain()
+}
+
 func (s *snapshots) meta() (snapshotMeta, error) {
-	if s.index == 0 {
+	return s.metaAt(s.index)
+}
+
+func (s *snapshots) metaAt(index uint64) (snapshotMeta, error) {
+	if index == 0 {
 		return snapshotMeta{index: 0, term: 0}, nil
 	}
-	f, err := os.Open(metaFile(s.dir, s.index))
-	if err != nil {
+	f, err := os.Open(metaFile(s.dir, index))
+	if os.IsNotExist(err) {
+		return snapshotMeta{}, fmt.Errorf("raft: snapshot %d not found", index)
+	} else if err != nil {
 		return snapshotMeta{}, err
 	}
 	defer f.Close()
 	meta := snapshotMeta{}
-	return meta, meta.decode(f)
+	if err = meta.decode(f); err != nil {
+		return meta, err
+	}
+	// meta written by older versions has no results
+	if meta.results, err = readResultKeys(f); err == io.EOF {
+		err = nil
+	}
+	return meta, err
 }
 
+// applyRetain removes snapshots older than latest s.retain snapshots.
+// Snapshots in use, and the snapshot that log compaction depends on
+// are never removed.
+//
+// The meta file is removed before snap file, so that snapshot disappears
+// in single step. If we crash in between, the orphaned snap file is
+// removed on next openSnapshots.
 func (s *snapshots) applyRetain() error {
 	snaps, err := findSnapshots(s.dir)
 	if err != nil {
 		return err
 	}
+	latest, _ := s.latest()
 	s.usedMu.RLock()
 	defer s.usedMu.RUnlock()
 	for i, index := range snaps {
-		if i >= s.retain && s.used[index] == 0 {
+		if i >= s.retain && index != latest && s.used[index] == 0 {
 			if e := os.Remove(metaFile(s.dir, index)); e == nil {
 				if e := os.Remove(snapFile(s.dir, index)); err == nil {
 					err = e
@@ -103,10 +140,41 @@ func (s *snapshots) applyRetain() error {
 	return err
 }
 
+// removeOrphans removes snap files without meta file, and meta.tmp.
+// These are left behind, if we crash while taking snapshot or while
+// applying retention. Must be called only when no snapshot is being
+// taken.
+func (s *snapshots) removeOrphans(snaps []uint64) error {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.snap"))
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, index := range snaps {
+		exists[snapFile(s.dir, index)] = true
+	}
+	for _, m := range matches {
+		if !exists[m] {
+			if err = os.Remove(m); err != nil {
+				return err
+			}
+		}
+	}
+	if err = os.Remove(filepath.Join(s.dir, "meta.tmp")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // snapshot ----------------------------------------------------
 
 func (s *snapshots) open() (*snapshot, error) {
-	meta, err := s.meta()
+	index, _ := s.latest()
+	return s.openAt(index)
+}
+
+func (s *snapshots) openAt(index uint64) (*snapshot, error) {
+	meta, err := s.metaAt(index)
 	if err != nil {
 		return nil, err
 	}
@@ -117,26 +185,38 @@ func (s *snapshots) open() (*snapshot, error) {
 	if err != nil {
 		return nil, err
 	}
-	if info.Size() != meta.size {
-		return nil, fmt.Errorf("raft: size of %q is %d, want %d", file, info.Size(), meta.size)
+	size := meta.size
+	if s.crypt != nil {
+		size = sealedSize(meta.size)
+	}
+	if info.Size() != size {
+		return nil, fmt.Errorf("raft: size of %q is %d, want %d", file, info.Size(), size)
 	}
 
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
+	s.usedMu.Lock()
 	s.used[meta.index]++
-	return &snapshot{
+	s.usedMu.Unlock()
+	snap := &snapshot{
 		snaps: s,
 		meta:  meta,
 		file:  f,
-	}, nil
+		data:  f,
+	}
+	if s.crypt != nil {
+		snap.data = newOpenReader(s.crypt, f, meta.index)
+	}
+	return snap, nil
 }
 
 type snapshot struct {
 	snaps *snapshots
 	meta  snapshotMeta
 	file  *os.File
+	data  io.Reader // decrypted contents of file
 }
 
 func (s *snapshot) release() {
@@ -150,6 +230,117 @@ func (s *snapshot) release() {
 	}
 }
 
+// offline access ----------------------------------------------------
+
+// SnapshotInfo describes a snapshot retained in storage.
+type SnapshotInfo struct {
+	// Index is the index of last log entry included in snapshot.
+	Index uint64 `json:"index"`
+
+	// Term is the term of last log entry included in snapshot.
+	Term uint64 `json:"term"`
+
+	// Config is the latest configuration included in snapshot.
+	Config Config `json:"config"`
+
+	// Size is the size of fsm state in bytes.
+	Size int64 `json:"size"`
+}
+
+func (m snapshotMeta) info() SnapshotInfo {
+	return SnapshotInfo{Index: m.index, Term: m.term, Config: m.config, Size: m.size}
+}
+
+// ListSnapshots returns the snapshots retained in storageDir, from
+// latest to oldest. It is meant for backup tooling, and must not
+// be called while the storageDir is in use by raft.
+func ListSnapshots(opt Options, storageDir string) ([]SnapshotInfo, error) {
+	var list []SnapshotInfo
+	err := withSnapshots(opt, storageDir, func(s *snapshots) error {
+		snaps, err := findSnapshots(s.dir)
+		if err != nil {
+			return err
+		}
+		for _, index := range snaps {
+			meta, err := s.metaAt(index)
+			if err != nil {
+				return err
+			}
+			list = append(list, meta.info())
+		}
+		return nil
+	})
+	return list, err
+}
+
+// OpenSnapshot opens the snapshot at given index in storageDir. If
+// index is zero, latest snapshot is opened. The returned reader
+// provides the fsm state, decrypted if Options.EncryptionKeys is set.
+//
+// The storageDir remains locked until the reader is closed. It
+// must not be called while the storageDir is in use by raft.
+func OpenSnapshot(opt Options, storageDir string, index uint64) (info SnapshotInfo, r io.ReadCloser, err error) {
+	if err := opt.validate(); err != nil {
+		return info, nil, err
+	}
+	if err := lockStorage(storageDir); err != nil {
+		return info, nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = unlockDir(storageDir)
+		}
+	}()
+	s, err := openSnapshots(filepath.Join(storageDir, "snapshots"), opt, newCrypter(opt.EncryptionKeys))
+	if err != nil {
+		return info, nil, err
+	}
+	if index == 0 {
+		if index = s.index; index == 0 {
+			return info, nil, errors.New("raft: no snapshots found")
+		}
+	}
+	snap, err := s.openAt(index)
+	if err != nil {
+		return info, nil, err
+	}
+	return snap.meta.info(), &snapshotReader{snap, storageDir}, nil
+}
+
+// withSnapshots opens snapshots in storageDir and calls fn with it.
+func withSnapshots(opt Options, storageDir string, fn func(s *snapshots) error) (err error) {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	if err := lockStorage(storageDir); err != nil {
+		return err
+	}
+	defer func() {
+		if e := unlockDir(storageDir); err == nil {
+			err = e
+		}
+	}()
+	s, err := openSnapshots(filepath.Join(storageDir, "snapshots"), opt, newCrypter(opt.EncryptionKeys))
+	if err != nil {
+		return err
+	}
+	return fn(s)
+}
+
+type snapshotReader struct {
+	snap *snapshot
+	dir  string
+}
+
+func (r *snapshotReader) Read(b []byte) (int, error) {
+	return r.snap.data.Read(b)
+}
+
+func (r *snapshotReader) Close() error {
+	r.snap.release()
+	return unlockDir(r.dir)
+}
+
 // snapshotSink ----------------------------------------------------
 
 func (s *snapshots) new(index, term uint64, config Config) (*snapshotSink, error) {
@@ -157,20 +348,43 @@ func (s *snapshots) new(index, term uint64, config Config) (*snapshotSink, error
 	if err != nil {
 		return nil, err
 	}
-	return &snapshotSink{
+	sink := &snapshotSink{
 		snaps: s,
 		meta:  snapshotMeta{index: index, term: term, config: config},
 		file:  f,
-	}, nil
+		data:  f,
+	}
+	if s.crypt != nil {
+		sink.seal = newSealWriter(s.crypt, f, index)
+		sink.data = sink.seal
+	}
+	return sink, nil
 }
 
 type snapshotSink struct {
 	snaps *snapshots
 	meta  snapshotMeta
 	file  *os.File
+	data  io.Writer   // encrypts into file, if required
+	seal  *sealWriter // nil, if not encrypted
 }
 
+// done finishes the snapshot, and makes it the latest snapshot.
 func (s *snapshotSink) done(err error) (snapshotMeta, error) {
+	meta, err := s.finish(err)
+	if err == nil {
+		err = s.snaps.setLatest(meta.index, meta.term)
+	}
+	return meta, err
+}
+
+// finish writes meta file of snapshot. The snapshot is not used,
+// until setLatest is called. Snapshot taken in background is made
+// latest by raft goroutine, so that it can read index without lock.
+func (s *snapshotSink) finish(err error) (snapshotMeta, error) {
+	if err == nil && s.seal != nil {
+		err = s.seal.close()
+	}
 	if err != nil {
 		_ = s.file.Close()
 		_ = os.Remove(s.file.Name())
@@ -184,11 +398,15 @@ func (s *snapshotSink) done(err error) (snapshotMeta, error) {
 	if err = s.file.Close(); err != nil {
 		return s.meta, err
 	}
-	info, err := os.Stat(s.file.Name())
-	if err != nil {
-		return s.meta, err
+	if s.seal != nil {
+		s.meta.size = s.seal.size
+	} else {
+		var info os.FileInfo
+		if info, err = os.Stat(s.file.Name()); err != nil {
+			return s.meta, err
+		}
+		s.meta.size = info.Size()
 	}
-	s.meta.size = info.Size()
 
 	file := filepath.Join(s.snaps.dir, "meta.tmp")
 	temp, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -204,6 +422,9 @@ func (s *snapshotSink) done(err error) (snapshotMeta, error) {
 	if err = s.meta.encode(temp); err != nil {
 		return s.meta, err
 	}
+	if err = writeResultKeys(temp, s.meta.results); err != nil {
+		return s.meta, err
+	}
 	if err = temp.Close(); err != nil {
 		return s.meta, err
 	}
@@ -212,10 +433,6 @@ func (s *snapshotSink) done(err error) (snapshotMeta, error) {
 		return s.meta, err
 	}
 	temp = nil
-	s.snaps.mu.Lock()
-	s.snaps.index, s.snaps.term = s.meta.index, s.meta.term
-	s.snaps.mu.Unlock()
-	_ = s.snaps.applyRetain() // todo: trace error
 	return s.meta, nil
 }
 
@@ -226,6 +443,10 @@ type snapshotMeta struct {
 	term   uint64
 	config Config
 	size   int64
+
+	// keys of updateOnce entries cached at index, see resultCache.
+	// encoded separately, see metaAt and writeBackup
+	results []resultKey
 }
 
 func (m *snapshotMeta) encode(w io.Writer) error {
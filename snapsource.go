@@ -0,0 +1,221 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// snapshot delegation:
+//
+// when a node needs snapshot, its replication asks leader for a
+// snapshot source. leader picks one of the healthy followers using
+// Options.SnapshotSource. replication then sends sendSnapReq to that
+// follower, which streams its latest snapshot to the node using
+// installSnapReq with leader's term and id, and replies the result.
+// if anything fails, replication falls back to sending leader's snapshot.
+
+var errNoSnapSource = errors.New("raft: no snapshot source")
+
+// replUpdate sent by replication to get snapshot source.
+// leader replies connPool of the source or nil.
+type snapSourceReq struct {
+	ch chan<- *connPool
+}
+
+// snapSource returns connPool of a healthy follower, which can
+// send snapshot to target on behalf of leader. returns nil if no
+// such follower is found.
+func (l *leader) snapSource(target uint64) *connPool {
+	if l.snapshotSource == nil {
+		return nil
+	}
+	var healthy []Node
+	for id, repl := range l.repls {
+		status := repl.status
+		if id == target || !status.noContact.IsZero() || status.err != nil {
+			continue
+		}
+		if status.matchIndex < l.log.PrevIndex() {
+			continue
+		}
+		healthy = append(healthy, status.node)
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	sort.Slice(healthy, func(i, j int) bool {
+		return healthy[i].ID < healthy[j].ID
+	})
+	id := l.snapshotSource(l.repls[target].status.node, healthy)
+	for _, n := range healthy {
+		if n.ID == id {
+			l.logger.Debug("chose snapshot source", "peer", target, "source", id)
+			return l.getConnPool(id)
+		}
+	}
+	return nil
+}
+
+// delegateInstallSnap asks a follower to send its snapshot to this
+// node. returns the last index of the snapshot sent.
+func (r *replication) delegateInstallSnap(appReq *appendReq) (uint64, error) {
+	ch := make(chan *connPool, 1)
+	r.notifyLdr(snapSourceReq{ch})
+	var pool *connPool
+	select {
+	case <-r.stopCh:
+		return 0, errStop
+	case pool = <-ch:
+	}
+	if pool == nil {
+		return 0, errNoSnapSource
+	}
+
+	// use size of our snapshot as an estimate for deadline
+	meta, err := r.snaps.meta()
+	if err != nil {
+		return 0, opError(err, "snapshots.meta")
+	}
+	req := &sendSnapReq{
+		req:      appReq.req,
+		target:   r.status.id,
+		minIndex: r.log.PrevIndex(),
+	}
+	r.logger.Debug("requesting snapshot source", "source", pool.nid, "req", req)
+	resp := &sendSnapResp{}
+	deadline := r.deadlineSize(r.timeouts.SnapshotChunk, meta.size).Add(r.timeouts.InstallSnapshot)
+	if err := pool.doRPC(req, resp, deadline); err != nil {
+		return 0, err
+	}
+	switch resp.result {
+	case staleTerm:
+		r.notifyLdr(newTerm{resp.getTerm()})
+		return 0, errStop
+	case success:
+		return resp.lastIndex, nil
+	case unexpectedErr:
+		return 0, remoteError{resp.err}
+	default:
+		return 0, errNoSnapSource
+	}
+}
+
+// handleSendSnap handles sendSnapReq from leader. The snapshot is
+// streamed in server goroutine, so that raft continues to serve.
+func (s *server) handleSendSnap(c *conn, nid uint64) error {
+	req := &sendSnapReq{}
+	if err := c.decodeReq(req); err != nil {
+		return err
+	}
+	if req.src != nid {
+		return errPeerMismatch
+	}
+	s.r.nodeLogger.Debug("received", "req", req)
+	resp := s.sendSnap(req)
+	resp.version = req.version
+	s.r.nodeLogger.Debug("replying", "resp", resp)
+	if err := resp.encode(c.bufw); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+func (s *server) sendSnap(req *sendSnapReq) *sendSnapResp {
+	resp := &sendSnapResp{}
+	var (
+		snap *snapshot
+		pool *connPool
+	)
+	err := s.r.inspect(func(r *Raft) {
+		resp.term = r.term
+		if req.term < r.term {
+			resp.result = staleTerm
+			return
+		}
+		if index, _ := r.snaps.latest(); index == 0 || index < req.minIndex {
+			resp.result = noSnapshot
+			return
+		}
+		var err error
+		if snap, err = r.snaps.open(); err != nil {
+			resp.result, resp.err = unexpectedErr, opError(err, "snapshots.open")
+			return
+		}
+		pool = r.getConnPool(req.target)
+	})
+	if err != nil {
+		resp.result, resp.err = unexpectedErr, err
+	}
+	if snap == nil {
+		return resp
+	}
+	defer snap.release()
+
+	installReq := &installSnapReq{
+		req:        req.req,
+		lastIndex:  snap.meta.index,
+		lastTerm:   snap.meta.term,
+		lastConfig: snap.meta.config,
+		size:       snap.meta.size,
+		results:    snap.meta.results,
+	}
+	installResp := &installSnapResp{}
+	if err = s.installSnap(pool, installReq, snap, installResp); err != nil {
+		resp.result, resp.err = unexpectedErr, err
+		return resp
+	}
+	switch installResp.result {
+	case success:
+		resp.result, resp.lastIndex = success, snap.meta.index
+	case staleTerm:
+		resp.term, resp.result = installResp.term, staleTerm
+	default:
+		resp.result, resp.err = unexpectedErr, installResp.err
+		if resp.err == nil {
+			resp.err = fmt.Errorf("raft: installSnapResp.result==%v", installResp.result)
+		}
+	}
+	return resp
+}
+
+func (s *server) installSnap(pool *connPool, req *installSnapReq, snap *snapshot, resp *installSnapResp) error {
+	hbTimeout := s.r.hbTimeout
+	c, err := pool.getConn(s.r.clock.Now().Add(2 * hbTimeout))
+	if err != nil {
+		return err
+	}
+	if err = c.writeReq(req, s.r.clock.Now().Add(2*hbTimeout)); err == nil {
+		timeout := durationFor(s.r.bandwidth, req.size)
+		if timeout < 2*hbTimeout {
+			timeout = 2 * hbTimeout
+		}
+		if err = c.rwc.SetWriteDeadline(s.r.clock.Now().Add(timeout)); err == nil {
+			_, err = io.Copy(c.rwc, snap.data) // will use sendFile, if not encrypted
+		}
+	}
+	if err == nil {
+		err = c.readResp(resp, s.r.clock.Now().Add(4*hbTimeout))
+	}
+	if err != nil {
+		_ = c.rwc.Close()
+		return err
+	}
+	pool.returnConn(c)
+	return nil
+}
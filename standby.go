@@ -0,0 +1,51 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+type activate struct {
+	*task
+}
+
+// Activate task ends standby of the node, see Options.Standby. FSM is
+// restored from latest snapshot, and committed entries are applied.
+// The task is replied once activation is started, it does not wait for
+// FSM to catch up; use Info.LastApplied to track it. This task returns
+// just error if any.
+//
+// Standby is also ended, when the node is promoted to voter. Activating
+// a node that is not in standby is no-op.
+func Activate() Task {
+	return activate{task: newTask()}
+}
+
+func (r *Raft) onActivate(t activate) {
+	if r.standby {
+		r.activate("activate task")
+	}
+	t.reply(nil)
+}
+
+// activate ends standby, and sends committed entries to fsm.
+func (r *Raft) activate(reason string) {
+	r.standby = false
+	r.logger.Info("standby activated", "reason", reason)
+	if r.restoreFSM {
+		r.sendFSM(fsmRestoreReq{r.fsmRestoredCh})
+		r.restoreFSM = false
+	}
+	if r.commitIndex > r.snaps.index {
+		r.applyCommitted(nil)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRaft_standby(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.opt.Standby = true
+
+	// waitCommitted waits till r commits all entries of leader
+	waitCommitted := func(r *Raft) {
+		t.Helper()
+		want := c.info(ldr).LastLogIndex
+		waitForCondition(func() bool {
+			return c.info(r).Committed >= want
+		}, c.commitTimeout, c.longTimeout)
+		if got := c.info(r).Committed; got < want {
+			t.Fatalf("M%d.committed: got %d, want %d", r.nid, got, want)
+		}
+	}
+
+	// standby replicates, but does not apply
+	m2 := c.launch(1, false)[2]
+	c.ensure(c.waitAddNonvoter(ldr, 2, c.id2Addr(2), false))
+	waitCommitted(m2)
+	time.Sleep(c.commitTimeout)
+	if info := c.info(m2); !info.Standby || info.LastApplied != 0 || fsm(m2).len() != 0 {
+		t.Fatalf("M2: got standby %v lastApplied %d fsmLen %d, want true 0 0", info.Standby, info.LastApplied, fsm(m2).len())
+	}
+	if _, err := waitFSMTask(m2, DirtyReadFSM("last"), 0); err != ErrStandby {
+		t.Fatalf("dirtyRead: got %v, want ErrStandby", err)
+	}
+	if _, err := waitTask(m2, TakeSnapshot(0), 0); err != ErrStandby {
+		t.Fatalf("takeSnapshot: got %v, want ErrStandby", err)
+	}
+
+	// activate task applies the entries
+	if _, err := waitTask(m2, Activate(), 0); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFSMLen(10, m2)
+	if c.info(m2).Standby {
+		t.Fatal("M2 must not be standby after activation")
+	}
+
+	// promotion to voter ends standby
+	m3 := c.launch(1, false)[3]
+	c.ensure(c.waitAddNonvoter(ldr, 3, c.id2Addr(3), true))
+	c.waitFSMLen(10, m3)
+	if c.info(m3).Standby {
+		t.Fatal("M3 must not be standby after promotion")
+	}
+}
+
+// tests that standby defers restoring snapshot, till activation
+func TestRaft_standby_snapshot(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+	<-c.sendUpdates(ldr, 1, 30).Done()
+	c.waitFSMLen(30)
+
+	// take snapshot, ensure log compacted
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.takeSnapshot(ldr, 1, nil)
+	c.ensure(logCompacted.waitForEvent(c.longTimeout))
+	c.sendUpdates(ldr, 1, 5)
+	c.waitFSMLen(35)
+	c.opt.Standby = true
+
+	// leader sends snapshot, which is not restored
+	m2 := c.launch(1, false)[2]
+	c.ensure(c.waitAddNonvoter(ldr, 2, c.id2Addr(2), false))
+	want := c.info(ldr).LastLogIndex
+	waitForCondition(func() bool {
+		return c.info(m2).Committed >= want
+	}, c.commitTimeout, c.longTimeout)
+	if info := c.info(m2); info.SnapshotIndex == 0 || info.LastApplied != 0 {
+		t.Fatalf("M2: got snapshotIndex %d lastApplied %d, want >0 0", info.SnapshotIndex, info.LastApplied)
+	}
+
+	// restarted standby does not restore either
+	m2 = c.restart(m2)
+	time.Sleep(c.commitTimeout)
+	if info := c.info(m2); !info.Standby || info.LastApplied != 0 {
+		t.Fatalf("M2 after restart: got standby %v lastApplied %d, want true 0", info.Standby, info.LastApplied)
+	}
+
+	// activation restores snapshot
+	if _, err := waitTask(m2, Activate(), 0); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFSMLen(30, m2)
+
+	// nonvoters get no heartbeats, so send more updates to
+	// ensure that it applies new entries
+	c.sendUpdates(ldr, 1, 5)
+	c.waitFSMLen(40, m2)
+}
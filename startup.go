@@ -0,0 +1,183 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StartupReport is the result of cross-checking storage dir at
+// startup, see Options.StartupCheck and CheckStartup.
+type StartupReport struct {
+	CID      uint64 `json:"cid"`
+	NID      uint64 `json:"nid"`
+	Term     uint64 `json:"term"`
+	VotedFor uint64 `json:"votedFor,omitempty"`
+
+	// FirstLogIndex and LastLogIndex are the indexes of first and
+	// last entries in log. If log is empty, FirstLogIndex is one
+	// more than LastLogIndex.
+	FirstLogIndex uint64 `json:"firstLogIndex"`
+	LastLogIndex  uint64 `json:"lastLogIndex"`
+	LastLogTerm   uint64 `json:"lastLogTerm"`
+
+	SnapshotIndex uint64 `json:"snapshotIndex,omitempty"`
+	SnapshotTerm  uint64 `json:"snapshotTerm,omitempty"`
+
+	Configs Configs `json:"configs"`
+
+	// Problems are the mismatches found. Empty if storage
+	// dir is consistent.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK tells whether no problems are found.
+func (r StartupReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *StartupReport) problem(format string, v ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, v...))
+}
+
+// StartupError is returned by New, if Options.StartupCheck
+// finds problems in storage dir.
+type StartupError struct {
+	Report StartupReport
+}
+
+func (e StartupError) Error() string {
+	return fmt.Sprintf("raft: startup check failed: %s", strings.Join(e.Report.Problems, "; "))
+}
+
+// CheckStartup cross-checks storageDir as in Options.StartupCheck, and
+// returns the report. Unlike VerifyStorage, it does not read all log
+// entries. It must not be called while the storageDir is in use by raft.
+func CheckStartup(opt Options, storageDir string) (StartupReport, error) {
+	if err := opt.validate(); err != nil {
+		return StartupReport{}, err
+	}
+	if err := lockStorage(storageDir); err != nil {
+		return StartupReport{}, err
+	}
+	s, report := openChecked(storageDir, opt)
+	if s != nil {
+		if err := s.log.Close(); err != nil {
+			report.problem("close log: %v", err)
+		}
+	}
+	return report, unlockDir(storageDir)
+}
+
+// openChecked opens storage in dir, and cross-checks term, log,
+// snapshot and configs. Failure to open, including panic from
+// storage, is reported as problem, in which case storage is nil.
+func openChecked(dir string, opt Options) (s *storage, report StartupReport) {
+	func() {
+		defer func() {
+			if v := recover(); v != nil {
+				s = nil
+				report.problem("open: %v", v)
+			}
+		}()
+		var err error
+		if s, err = openStorage(dir, opt); err != nil {
+			report.problem("open: %v", err)
+		}
+	}()
+	if s == nil {
+		return nil, report
+	}
+
+	report.CID, report.NID = s.cid, s.nid
+	report.Term, report.VotedFor = s.term, s.votedFor
+	report.FirstLogIndex, report.LastLogIndex = s.log.PrevIndex()+1, s.log.LastIndex()
+	report.LastLogTerm = s.lastLogTerm
+	report.SnapshotIndex, report.SnapshotTerm = s.snaps.index, s.snaps.term
+	report.Configs = s.configs
+	s.check(&report)
+	return s, report
+}
+
+// check cross-checks storage, and adds the problems found to report.
+// Identity is not checked, because New reports it as ErrIdentityNotSet.
+func (s *storage) check(report *StartupReport) {
+	// term ----------------
+	if s.votedFor != 0 && s.term == 0 {
+		report.problem("voted for M%d in term 0", s.votedFor)
+	}
+
+	// log and snapshot ----------------
+	prevIndex, lastIndex := s.log.PrevIndex(), s.log.LastIndex()
+	if prevIndex > s.snaps.index {
+		report.problem("log starts at %d, after snapshot index %d", prevIndex+1, s.snaps.index)
+	}
+	if lastIndex < s.snaps.index {
+		report.problem("log ends at %d, before snapshot index %d", lastIndex, s.snaps.index)
+	}
+	if s.lastLogTerm > s.term {
+		report.problem("last entry term %d is beyond current term %d", s.lastLogTerm, s.term)
+	}
+	if s.lastLogTerm < s.snaps.term {
+		report.problem("last entry term %d is less than snapshot term %d", s.lastLogTerm, s.snaps.term)
+	}
+	if s.snaps.index > 0 && s.log.Contains(s.snaps.index) {
+		if e, err := s.readEntry(s.snaps.index); err != nil {
+			report.problem("entry %d: %v", s.snaps.index, err)
+		} else if e.term != s.snaps.term {
+			report.problem("entry %d: term %d does not match snapshot term %d", s.snaps.index, e.term, s.snaps.term)
+		}
+	}
+
+	// configs ----------------
+	latest, committed := s.configs.Latest, s.configs.Committed
+	if latest.Index == 0 && s.lastLogIndex > 0 {
+		report.problem("log is not empty, but config is not bootstrapped")
+	}
+	if latest.Index > s.lastLogIndex {
+		report.problem("latest config %d is beyond last log index %d", latest.Index, s.lastLogIndex)
+	}
+	if committed.Index > latest.Index {
+		report.problem("committed config %d is after latest config %d", committed.Index, latest.Index)
+	}
+	for _, c := range []Config{latest, committed} {
+		if c.Index <= s.snaps.index || !s.log.Contains(c.Index) {
+			continue
+		}
+		if e, err := s.readEntry(c.Index); err != nil {
+			report.problem("entry %d: %v", c.Index, err)
+		} else if e.typ != entryConfig || e.term != c.Term {
+			report.problem("entry %d: not config of term %d", c.Index, c.Term)
+		}
+	}
+
+	// vars ----------------
+	if s.vars.get(configsVar) != nil {
+		meta, err := s.snaps.meta()
+		if err != nil {
+			report.problem("snapshot meta: %v", err)
+			return
+		}
+		saved, _, ok := s.readConfigsVar(meta.config)
+		switch {
+		case !ok:
+			report.problem("var %s does not match log", configsVar)
+		case saved.Latest.Index != latest.Index || saved.Committed.Index != committed.Index:
+			report.problem("var %s has configs (%d, %d), but log has (%d, %d)", configsVar,
+				saved.Latest.Index, saved.Committed.Index, latest.Index, committed.Index)
+		}
+	}
+}
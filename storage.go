@@ -29,6 +29,10 @@ import (
 // identity matches with given identity. It is recommended
 // to call SetIdentity before using storageDir.
 //
+// The cluster id cid is validated when nodes connect to each other.
+// Requests from nodes with different cluster id are rejected, so use
+// distinct cluster id for each environment, when addresses are reused.
+//
 // If the storageDir is already in use, returns ErrLockExists.
 // If the stored identity does not match given identity, returns ErrIdentityAlreadySet.
 func SetIdentity(storageDir string, cid, nid uint64) (err error) {
@@ -73,16 +77,26 @@ type storage struct {
 	term     uint64
 	votedFor uint64
 
+	vars *vars // state other than identity and term
+
 	log          *log.Log
 	lastLogIndex uint64
 	lastLogTerm  uint64
+	syncPolicy   SyncPolicy // see Options.SyncPolicy
 
-	snaps   *snapshots
-	configs Configs
+	snaps        *snapshots
+	configs      Configs
+	savedConfigs Configs // in configsVar, zero if not saved
+
+	// reused by appendEntry, to avoid allocation per entry
+	entryBuf bytes.Buffer
 }
 
+// fileMode is the mode of log, value and var files in storage dir.
+const fileMode os.FileMode = 0600
+
 func openStorage(dir string, opt Options) (*storage, error) {
-	s, err := &storage{}, error(nil)
+	s, err := &storage{syncPolicy: opt.SyncPolicy}, error(nil)
 	defer func() {
 		if err != nil {
 			if s.log != nil {
@@ -91,6 +105,12 @@ func openStorage(dir string, opt Options) (*storage, error) {
 		}
 	}()
 
+	if opt.CheckDurability {
+		if err = checkDurability(dir); err != nil {
+			return nil, err
+		}
+	}
+
 	// open identity value ----------------
 	if s.idVal, err = openValue(dir, ".id"); err != nil {
 		return nil, err
@@ -103,8 +123,14 @@ func openStorage(dir string, opt Options) (*storage, error) {
 	}
 	s.term, s.votedFor = s.termVal.get()
 
+	// open vars ----------------
+	if s.vars, err = openVars(dir); err != nil {
+		return nil, err
+	}
+
 	// open snapshots ----------------
-	if s.snaps, err = openSnapshots(filepath.Join(dir, "snapshots"), opt); err != nil {
+	crypt := newCrypter(opt.EncryptionKeys)
+	if s.snaps, err = openSnapshots(filepath.Join(dir, "snapshots"), opt, crypt); err != nil {
 		return nil, err
 	}
 	s.lastLogIndex, s.lastLogTerm = s.snaps.index, s.snaps.term
@@ -115,12 +141,34 @@ func openStorage(dir string, opt Options) (*storage, error) {
 
 	// open log ----------------
 	logOpt := log.Options{
-		FileMode:    0600,
-		SegmentSize: opt.LogSegmentSize,
+		FileMode:       fileMode,
+		SegmentSize:    opt.LogSegmentSize,
+		SegmentEntries: opt.LogSegmentEntries,
+	}
+	if crypt != nil {
+		logOpt.Cipher = crypt
 	}
 	if s.log, err = log.Open(filepath.Join(dir, "log"), 0700, logOpt); err != nil {
 		return nil, err
 	}
+
+	// check encryption ----------------
+	cryptVal, err := openValue(dir, ".crypt")
+	if err != nil {
+		return nil, err
+	}
+	var encrypted uint64
+	if crypt != nil {
+		encrypted = 1
+	}
+	if v, _ := cryptVal.get(); v != encrypted {
+		if s.snaps.index != 0 || s.log.LastIndex() != 0 {
+			return nil, errors.New("raft: cannot change encryption of non-empty storage")
+		}
+		if err = cryptVal.set(encrypted, 0); err != nil {
+			return nil, err
+		}
+	}
 	if s.log.Count() > 0 {
 		data, err := s.log.Get(s.log.LastIndex())
 		if err != nil {
@@ -135,11 +183,43 @@ func openStorage(dir string, opt Options) (*storage, error) {
 	}
 
 	// load configs ----------------
+	if err = s.loadConfigs(meta.config); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// configs var:
+//
+// configs are the last two config entries in log, filled with snapshot
+// config if not found. finding them needs log to be scanned backwards,
+// which takes long for huge log, if config is changed rarely. so they
+// are also saved in var configsVar, along with the log index upto which
+// they are current. on open, only the entries after that index are
+// scanned. the var is saved after config entry is appended, so on crash
+// it can be behind log, which is fixed by the scan, or ahead of log, if
+// log was not synced, which is detected by checking it against log.
+const configsVar = "raft.configs"
+
+// loadConfigs loads configs from entries after configsVar, and takes
+// the configs not found there from the var. If the var is not set, for
+// example in storage dirs of older versions, or does not match with log,
+// whole log is scanned as before, and the var is saved for next open.
+func (s *storage) loadConfigs(snapConfig Config) error {
+	saved, from, ok := s.readConfigsVar(snapConfig)
+	if !ok || from < s.snaps.index {
+		from = s.snaps.index
+	}
 	need := 2
-	for i := s.lastLogIndex; i > s.snaps.index; i-- {
+	for i := s.lastLogIndex; i > from; i-- {
+		data, err := s.log.Get(i)
+		if err != nil {
+			return opError(err, "Log.Get(%d)", i)
+		}
 		e := &entry{}
-		if err = s.getEntry(i, e); err != nil {
-			return nil, err
+		if err = e.decode(bytes.NewReader(data)); err != nil {
+			return opError(err, "Log.Get(%d).decode", i)
 		}
 		if e.typ == entryConfig {
 			if need == 2 {
@@ -148,7 +228,7 @@ func openStorage(dir string, opt Options) (*storage, error) {
 				err = s.configs.Committed.decode(e)
 			}
 			if err != nil {
-				return nil, err
+				return err
 			}
 			need--
 			if need == 0 {
@@ -156,15 +236,87 @@ func openStorage(dir string, opt Options) (*storage, error) {
 			}
 		}
 	}
+	if !ok {
+		saved = Configs{Latest: snapConfig, Committed: snapConfig}
+	}
 	if need == 2 {
-		s.configs.Latest = meta.config
-		need--
+		s.configs.Latest = saved.Latest
+		s.configs.Committed = saved.Committed
+	} else if need == 1 {
+		s.configs.Committed = saved.Latest
 	}
-	if need == 1 {
-		s.configs.Committed = meta.config
+	if !ok || from < s.lastLogIndex {
+		return s.saveConfigs(s.configs)
 	}
+	s.savedConfigs = s.configs
+	return nil
+}
 
-	return s, nil
+// readConfigsVar returns the configs in configsVar, and the log index
+// upto which they are current. ok is false, if the var is not set, or
+// does not match with log or snapshot.
+func (s *storage) readConfigsVar(snapConfig Config) (configs Configs, index uint64, ok bool) {
+	b := s.vars.get(configsVar)
+	if b == nil {
+		return Configs{}, 0, false
+	}
+	r := bytes.NewReader(b)
+	index, err := readUint64(r)
+	for _, c := range []*Config{&configs.Latest, &configs.Committed} {
+		e := &entry{}
+		if err == nil {
+			err = e.decode(r)
+		}
+		if err == nil {
+			err = c.decode(e)
+		}
+	}
+	if err != nil || index < configs.Latest.Index || configs.Latest.Index < configs.Committed.Index || configs.Latest.Index < snapConfig.Index {
+		return Configs{}, 0, false
+	}
+	for _, c := range []*Config{&configs.Latest, &configs.Committed} {
+		if c.Index <= s.snaps.index {
+			// compacted into snapshot
+			*c = snapConfig
+			continue
+		}
+		if !s.log.Contains(c.Index) {
+			return Configs{}, 0, false
+		}
+		e, err := s.readEntry(c.Index)
+		if err != nil || e.typ != entryConfig || e.term != c.Term {
+			return Configs{}, 0, false
+		}
+		if !bytes.Equal(e.data, c.encode().data) {
+			return Configs{}, 0, false
+		}
+	}
+	return configs, index, true
+}
+
+// saveConfigs saves configs in configsVar, as current upto lastLogIndex.
+// configs must be the last two config entries in log. Zero configs
+// deletes the var, so that configs are loaded from log on next open.
+func (s *storage) saveConfigs(configs Configs) error {
+	s.savedConfigs = Configs{}
+	if configs.Latest.Index == 0 {
+		return s.vars.set(configsVar, nil)
+	}
+	buf := new(bytes.Buffer)
+	if err := writeUint64(buf, s.lastLogIndex); err != nil {
+		return err
+	}
+	if err := configs.Latest.encode().encode(buf); err != nil {
+		return err
+	}
+	if err := configs.Committed.encode().encode(buf); err != nil {
+		return err
+	}
+	if err := s.vars.set(configsVar, buf.Bytes()); err != nil {
+		return err
+	}
+	s.savedConfigs = configs
+	return nil
 }
 
 func (s *storage) setTerm(term uint64) {
@@ -179,6 +331,10 @@ func (s *storage) setTerm(term uint64) {
 
 var grantingVote = func(s *storage, term, candidate uint64) error { return nil }
 
+// setVotedFor persists term and vote. Both are written in single rename
+// of termVal, followed by sync of dir, so that they are never persisted
+// partially. It panics on failure, so the vote is granted only after
+// it is durable.
 func (s *storage) setVotedFor(term, candidate uint64) {
 	if term != s.term || candidate != s.votedFor {
 		assert(term >= s.term)
@@ -193,6 +349,48 @@ func (s *storage) setVotedFor(term, candidate uint64) {
 	}
 }
 
+// checkDurability checks that values written to dir, are read back
+// after reopen, the way term and vote are persisted. It also checks
+// vars in the same way. See Options.CheckDurability.
+func checkDurability(dir string) error {
+	const ext, key = ".selftest", "raft.selftest"
+	val, err := openValue(dir, ext)
+	if err != nil {
+		return err
+	}
+	for i := uint64(1); i <= 3; i++ {
+		v1, v2 := val.get()
+		if err = val.set(v1+1, v2+i); err != nil {
+			return err
+		}
+		// reopen, as if after crash
+		if val, err = openValue(dir, ext); err != nil {
+			return err
+		}
+		if g1, g2 := val.get(); g1 != v1+1 || g2 != v2+i {
+			return fmt.Errorf("raft: storage dir %s is not durable: wrote %d-%d, read %d-%d", dir, v1+1, v2+i, g1, g2)
+		}
+	}
+	if err = os.Remove(valueFile(dir, ext, val.v1, val.v2)); err != nil {
+		return err
+	}
+
+	vars, err := openVars(dir)
+	if err != nil {
+		return err
+	}
+	if err = vars.setUint64(key, 42); err != nil {
+		return err
+	}
+	if vars, err = openVars(dir); err != nil {
+		return err
+	}
+	if v, ok, err := vars.getUint64(key); err != nil || !ok || v != 42 {
+		return fmt.Errorf("raft: storage dir %s is not durable: var %s not read back", dir, key)
+	}
+	return vars.set(key, nil)
+}
+
 // NOTE: this should not be called with snapIndex
 func (s *storage) getEntryTerm(index uint64) (uint64, error) {
 	e := &entry{}
@@ -218,6 +416,23 @@ func (s *storage) getEntry(index uint64, e *entry) error {
 	return nil
 }
 
+// readEntry is same as getEntry, but returns error instead of
+// panicking, for use when storage may be corrupted.
+func (s *storage) readEntry(index uint64) (*entry, error) {
+	data, err := s.log.Get(index)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	if err = e.decode(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if e.index != index {
+		return nil, fmt.Errorf("got index %d", e.index)
+	}
+	return e, nil
+}
+
 func (s *storage) mustGetEntry(index uint64, e *entry) {
 	if err := s.getEntry(index, e); err != nil {
 		panic(bug{fmt.Sprintf("storage.MustGetEntry(%d)", index), err})
@@ -227,22 +442,53 @@ func (s *storage) mustGetEntry(index uint64, e *entry) {
 // called by raft.runLoop. getEntry call can be called during this
 func (s *storage) appendEntry(e *entry) {
 	assert(e.index == s.lastLogIndex+1)
-	w := new(bytes.Buffer)
-	if err := e.encode(w); err != nil {
+	s.entryBuf.Reset()
+	if err := e.encode(&s.entryBuf); err != nil {
 		panic(bug{fmt.Sprintf("entry.encode(%d)", e.index), err})
 	}
-	if err := s.log.Append(w.Bytes()); err != nil {
+	if err := s.log.Append(s.entryBuf.Bytes()); err != nil {
 		panic(opError(err, "Log.Append"))
 	}
 	s.lastLogIndex, s.lastLogTerm = e.index, e.term
 }
 
+// appendRaw is same as appendEntry, but takes encoded entry.
+func (s *storage) appendRaw(e rawEntry) {
+	assert(e.index() == s.lastLogIndex+1)
+	if err := s.log.Append(e); err != nil {
+		panic(opError(err, "Log.Append"))
+	}
+	s.lastLogIndex, s.lastLogTerm = e.index(), e.term()
+}
+
+// commitLog syncs log upto index n, only if
+// syncPolicy is SyncAlways. see syncLog.
 func (s *storage) commitLog(n uint64) {
+	if s.syncPolicy != SyncAlways {
+		return
+	}
 	if err := s.log.CommitN(n); err != nil {
 		panic(opError(err, "Log.CommitN(%d)", n))
 	}
 }
 
+// syncLog syncs all appended entries, irrespective of syncPolicy.
+func (s *storage) syncLog() error {
+	if err := s.log.Commit(); err != nil {
+		return opError(err, "Log.Commit")
+	}
+	return nil
+}
+
+// unsyncedEntries returns number of appended entries,
+// that are not yet synced. see Info.UnsyncedEntries.
+func (s *storage) unsyncedEntries() uint64 {
+	if synced := s.log.SyncedIndex(); s.lastLogIndex > synced {
+		return s.lastLogIndex - synced
+	}
+	return 0
+}
+
 // never called with invalid index
 func (s *storage) removeLTE(index uint64) error {
 	// todo: trace log compaction
@@ -253,21 +499,52 @@ func (s *storage) removeLTE(index uint64) error {
 }
 
 func (r *Raft) compactLog(lte uint64) error {
-	if trace {
-		println(r, "compactLog", lte)
-	}
 	if err := r.storage.removeLTE(lte); err != nil {
-		r.logger.Warn(trimPrefix(err))
+		r.logger.Error("log compaction failed", "err", err)
 		r.alerts.Error(err)
 		return err
 	}
-	r.logger.Info("log upto index ", r.log.PrevIndex(), "is discarded")
+	r.logger.Info("log discarded", "upto", r.log.PrevIndex())
 	if tracer.logCompacted != nil {
 		tracer.logCompacted(r)
 	}
 	return nil
 }
 
+// mergeSegments merges small adjacent segments of log. It is done
+// when node is created, before any view of log is taken, because
+// merge replaces segments, that views of replication and fsm may be
+// reading. see log.Merge
+func (s *storage) mergeSegments() error {
+	m := s.log.PrepareMerge()
+	if m == nil {
+		return nil
+	}
+	if err := m.Write(0); err != nil {
+		return opError(err, "Merge.Write")
+	}
+	if err := s.log.CommitMerge(m); err != nil {
+		return opError(err, "Log.CommitMerge")
+	}
+	return nil
+}
+
+// compressSegments compresses sealed segments of log. Like
+// mergeSegments, it is done when node is created. see log.Compress
+func (s *storage) compressSegments() error {
+	c := s.log.PrepareCompress()
+	if c == nil {
+		return nil
+	}
+	if err := c.Write(0); err != nil {
+		return opError(err, "Compress.Write")
+	}
+	if err := s.log.CommitCompress(c); err != nil {
+		return opError(err, "Log.CommitCompress")
+	}
+	return nil
+}
+
 // no replication is going on when this called
 // todo: are you sure about this ???
 func (s *storage) clearLog() error {
@@ -297,7 +574,9 @@ func (s *storage) bootstrap(config Config) (err error) {
 		}
 	}()
 	s.appendEntry(config.encode())
-	s.commitLog(1)
+	if err := s.syncLog(); err != nil {
+		panic(err)
+	}
 	s.setTerm(1)
 	s.lastLogIndex, s.lastLogTerm = config.Index, config.Term
 	return nil
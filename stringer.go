@@ -0,0 +1,161 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import "fmt"
+
+// String methods of messages and tasks, that are logged at debug level.
+
+func (resp resp) String() string {
+	if resp.result == unexpectedErr {
+		return fmt.Sprintf("T%d %s %v", resp.term, resp.result, resp.err)
+	}
+	return fmt.Sprintf("T%d %s", resp.term, resp.result)
+}
+
+func (req *identityReq) String() string {
+	format := "identityReq{v%d T%d M%d C%d M%d}"
+	return fmt.Sprintf(format, req.version, req.term, req.src, req.cid, req.nid)
+}
+
+func (resp *identityResp) String() string {
+	return fmt.Sprintf("identityResp{%v v%d}", resp.resp, resp.version)
+}
+
+func (req *voteReq) String() string {
+	format := "voteReq{T%d M%d last:(%d,%d) transfer:%v}"
+	return fmt.Sprintf(format, req.term, req.src, req.lastLogIndex, req.lastLogTerm, req.transfer)
+}
+
+func (resp *voteResp) String() string {
+	format := "voteResp{%s last:(%d,%d) commit:%d}"
+	return fmt.Sprintf(format, resp.resp, resp.lastLogIndex, resp.lastLogTerm, resp.commitIndex)
+}
+
+func (req *appendReq) String() string {
+	format := "appendReq{T%d M%d prev:(%d,%d), #entries: %d, compressed: %d, commit:%d}"
+	return fmt.Sprintf(format, req.term, req.src, req.prevLogIndex, req.prevLogTerm, req.numEntries, req.compressedSize, req.ldrCommitIndex)
+}
+
+func (resp *appendResp) String() string {
+	format := "appendResp{%v last:%d conflict:(%d,%d) peers:%v}"
+	return fmt.Sprintf(format, resp.resp, resp.lastLogIndex, resp.conflictIndex, resp.conflictTerm, resp.peers)
+}
+
+func (req *installSnapReq) String() string {
+	format := "installSnapReq{T%d M%d last:(%d,%d), size:%d}"
+	return fmt.Sprintf(format, req.term, req.src, req.lastIndex, req.lastTerm, req.size)
+}
+
+func (resp *installSnapResp) String() string {
+	return fmt.Sprintf("installSnapResp{%v}", resp.resp)
+}
+
+func (req *timeoutNowReq) String() string {
+	return fmt.Sprintf("timeoutNowReq{T%d M%d}", req.term, req.src)
+}
+
+func (resp *timeoutNowResp) String() string {
+	return fmt.Sprintf("timeoutNowResp{%v}", resp.resp)
+}
+
+func (req *sendSnapReq) String() string {
+	format := "sendSnapReq{T%d M%d target:M%d min:%d}"
+	return fmt.Sprintf(format, req.term, req.src, req.target, req.minIndex)
+}
+
+func (resp *sendSnapResp) String() string {
+	return fmt.Sprintf("sendSnapResp{%v last:%d}", resp.resp, resp.lastIndex)
+}
+
+func (req *authReq) String() string {
+	return fmt.Sprintf("authReq{M%d nonce:%t mac:%t}", req.src, len(req.nonce) > 0, len(req.mac) > 0)
+}
+
+func (resp *authResp) String() string {
+	return fmt.Sprintf("authResp{%v}", resp.resp)
+}
+
+func (req *identityUpdateReq) String() string {
+	return fmt.Sprintf("identityUpdateReq{T%d M%d addr:%s}", req.term, req.src, req.addr)
+}
+
+func (resp *identityUpdateResp) String() string {
+	return fmt.Sprintf("identityUpdateResp{%v leader:M%d}", resp.resp, resp.leader)
+}
+
+func (u leaderUpdate) String() string {
+	return fmt.Sprintf("leaderUpdate{last:%d, commit:%d, config: %v}", u.log.LastIndex(), u.commitIndex, u.config)
+}
+
+func (u replUpdate) String() string {
+	id := u.status.id
+	switch u := u.update.(type) {
+	case matchIndex:
+		return fmt.Sprintf("replUpdate{M%d matchIndex:%d}", id, u.val)
+	case newTerm:
+		return fmt.Sprintf("replUpdate{M%d newTerm:%d}", id, u.val)
+	case noContact:
+		if u.time.IsZero() {
+			return fmt.Sprintf("replUpdate{M%d yesContact}", id)
+		}
+		return fmt.Sprintf("replUpdate{M%d noContact err:%v}", id, u.err)
+	case removeLTE:
+		return fmt.Sprintf("replUpdate{M%d removeLTE:%d}", id, u.val)
+	case breakerChanged:
+		return fmt.Sprintf("replUpdate{M%d breaker:%v}", id, u.state)
+	case slowRTT:
+		return fmt.Sprintf("replUpdate{M%d rtt:%v slow:%v}", id, u.rtt, u.slow)
+	case clockSkew:
+		return fmt.Sprintf("replUpdate{M%d skew:%v exceeded:%v}", id, u.skew, u.exceeded)
+	case snapSourceReq:
+		return fmt.Sprintf("replUpdate{M%d snapSource}", id)
+	case error:
+		return fmt.Sprintf("replUpdate{M%d error:%v}", id, u)
+	default:
+		return fmt.Sprintf("replUpdate{M%d %T}", id, u)
+	}
+}
+
+func (t fsmApply) String() string {
+	var newEntries string
+	if t.neHead != nil {
+		first := t.neHead.index
+		var last uint64
+		for ne := t.neHead; ne != nil; ne = ne.next {
+			last = ne.index
+		}
+		newEntries = fmt.Sprintf(", newEntries[%d..%d]", first, last)
+	}
+	return fmt.Sprintf("fsmApply{commitIndex:%d%s}", t.log.LastIndex(), newEntries)
+}
+
+func (t fsmSnapReq) String() string {
+	return fmt.Sprintf("fsmSnapReq{index:%d}", t.index)
+}
+
+func (t fsmViewReq) String() string {
+	return "fsmViewReq{}"
+}
+
+func (t fsmRestoreReq) String() string {
+	return "fsmRestoreReq{}"
+}
+
+func (a *followerApply) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return fmt.Sprintf("followerApply{commitIndex:%d}", a.apply.log.LastIndex())
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// SubmitTask submits the task t to r. FSMTasks and other tasks are
+// submitted to their respective queues, so callers need not know the
+// difference. It blocks until r accepts t, and returns ErrServerClosed
+// if r is closed, or ctx.Err() if ctx is done before that.
+//
+// SubmitTask does not wait for t to complete. Use t.Done() for that,
+// or the methods such as Apply, which submit the task and wait for
+// its result.
+func (r *Raft) SubmitTask(ctx context.Context, t Task) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ft, ok := t.(FSMTask); ok {
+		select {
+		case <-r.close:
+			return ErrServerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case r.fsmTaskCh <- ft:
+			return nil
+		}
+	}
+	select {
+	case <-r.close:
+		return ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case r.taskCh <- t:
+		return nil
+	}
+}
+
+// do submits t and waits for its result. If ctx is done after t is
+// submitted, ctx.Err() is returned, but t is not cancelled.
+func (r *Raft) do(ctx context.Context, t Task) (interface{}, error) {
+	if err := r.SubmitTask(ctx, t); err != nil {
+		return nil, err
+	}
+	select {
+	case <-t.Done():
+		return t.Result(), t.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Apply submits UpdateFSM task with cmd, and returns the value
+// returned by FSM.Update. Spans of the task are children of the
+// span in ctx, see WithContext.
+//
+// Note that if ctx is done after the task is submitted, cmd may
+// still be applied.
+func (r *Raft) Apply(ctx context.Context, cmd []byte) (interface{}, error) {
+	return r.do(ctx, WithContext(ctx, UpdateFSM(cmd)))
+}
+
+// Query submits ReadFSM task with cmd, and returns the value returned
+// by FSM.Read. The read is linearizable.
+func (r *Raft) Query(ctx context.Context, cmd interface{}) (interface{}, error) {
+	return r.do(ctx, WithContext(ctx, ReadFSM(cmd)))
+}
+
+// Barrier submits BarrierFSM task, and waits until all preceding
+// commands are applied to FSM.
+func (r *Raft) Barrier(ctx context.Context) error {
+	_, err := r.do(ctx, WithContext(ctx, BarrierFSM()))
+	return err
+}
+
+// ChangeConfig submits ChangeConfig task with config, and waits
+// for it to complete.
+func (r *Raft) ChangeConfig(ctx context.Context, config Config) error {
+	_, err := r.do(ctx, ChangeConfig(config))
+	return err
+}
+
+// PlanConfigChange submits PlanConfigChange task with config, and
+// returns the steps leader would take to apply it.
+func (r *Raft) PlanConfigChange(ctx context.Context, config Config) ([]ConfigStep, error) {
+	result, err := r.do(ctx, PlanConfigChange(config))
+	if err != nil {
+		return nil, err
+	}
+	return result.([]ConfigStep), nil
+}
+
+// Transfer submits TransferLeadership task, and waits until the
+// leadership is transferred to target. If target is 0, leadership
+// is transferred to most eligible voter.
+func (r *Raft) Transfer(ctx context.Context, target uint64, timeout time.Duration) error {
+	_, err := r.do(ctx, TransferLeadership(target, timeout))
+	return err
+}
+
+// Snapshot submits TakeSnapshot task with threshold, and returns the
+// index at which snapshot is taken.
+func (r *Raft) Snapshot(ctx context.Context, threshold uint64) (uint64, error) {
+	result, err := r.do(ctx, TakeSnapshot(threshold))
+	if err != nil {
+		return 0, err
+	}
+	return result.(uint64), nil
+}
+
+// Info returns information about r, as given by GetInfo task.
+func (r *Raft) Info(ctx context.Context) (Info, error) {
+	result, err := r.do(ctx, GetInfo())
+	if err != nil {
+		return Info{}, err
+	}
+	return result.(Info), nil
+}
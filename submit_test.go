@@ -0,0 +1,87 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRaft_taskMethods(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+
+	result, err := ldr.Apply(ctx, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result, (fsmReply{"hello", 1}); got != want {
+		t.Fatalf("apply: got %v, want %v", got, want)
+	}
+	if err := ldr.Barrier(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ldr.Query(ctx, "last"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result, (fsmReply{"hello", 0}); got != want {
+		t.Fatalf("query: got %v, want %v", got, want)
+	}
+
+	// FSMTasks are rejected by follower
+	if _, err := flrs[0].Apply(ctx, []byte("hello")); err == nil {
+		t.Fatal("apply on follower must fail")
+	}
+
+	index, err := ldr.Snapshot(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ldr.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SnapshotIndex != index {
+		t.Fatalf("snapshotIndex: got %d, want %d", info.SnapshotIndex, index)
+	}
+
+	if err := ldr.Transfer(ctx, flrs[0].NID(), c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForLeader(flrs[0])
+}
+
+func TestRaft_SubmitTask(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	// done ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ldr.SubmitTask(ctx, GetInfo()); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// closed raft
+	c.shutdown(ldr)
+	if err := ldr.SubmitTask(context.Background(), UpdateFSM(nil)); err != ErrServerClosed {
+		t.Fatalf("got %v, want %v", err, ErrServerClosed)
+	}
+	if _, err := ldr.Info(context.Background()); err != ErrServerClosed {
+		t.Fatalf("got %v, want %v", err, ErrServerClosed)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"sync"
+)
+
+// commitsBatch is the max number of entries, a
+// CommitSubscription fetches from log at once.
+const commitsBatch = 64
+
+// CommitSubscription delivers committed log entries in log order.
+// It is returned by Raft.SubscribeCommits.
+//
+// All committed entries are delivered, including config and nop
+// entries. Use LogEntry.Type to filter them.
+type CommitSubscription struct {
+	r      *Raft
+	next   uint64     // index of entry to be returned by Next
+	buf    []LogEntry // fetched entries, starting from next
+	notify chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// SubscribeCommits returns a subscription to the log entries committed
+// on this node, starting from fromIndex. This lets sidecar processes
+// build secondary indexes or CDC pipelines, without being the FSM.
+//
+// Entries are read from log, so fromIndex must not be compacted into
+// snapshot. The subscription must be closed, when no longer needed.
+func (r *Raft) SubscribeCommits(fromIndex uint64) *CommitSubscription {
+	if fromIndex == 0 {
+		fromIndex = 1
+	}
+	s := &CommitSubscription{
+		r:      r,
+		next:   fromIndex,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	r.subsMu.Lock()
+	r.subs[s] = struct{}{}
+	r.subsMu.Unlock()
+	return s
+}
+
+// Next returns the next committed entry. It blocks until that entry
+// is committed. It is not safe to call Next concurrently.
+//
+// Next returns ErrCompacted, if the entry is compacted into snapshot.
+// It returns ErrSubscriptionClosed if subscription is closed, and
+// ErrServerClosed if raft is closed.
+func (s *CommitSubscription) Next(ctx context.Context) (LogEntry, error) {
+	for len(s.buf) == 0 {
+		if err := s.fetch(); err != nil {
+			return LogEntry{}, err
+		}
+		if len(s.buf) > 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return LogEntry{}, ctx.Err()
+		case <-s.closed:
+			return LogEntry{}, ErrSubscriptionClosed
+		case <-s.r.close:
+			return LogEntry{}, ErrServerClosed
+		case <-s.notify:
+		}
+	}
+	e := s.buf[0]
+	s.buf, s.next = s.buf[1:], e.Index+1
+	return e, nil
+}
+
+// fetch reads next batch of committed entries into s.buf. Entries
+// are read in raft goroutine, because log compaction may remove
+// segments at any time.
+func (s *CommitSubscription) fetch() error {
+	select {
+	case <-s.closed:
+		return ErrSubscriptionClosed
+	default:
+	}
+	var err error
+	ierr := s.r.inspect(func(r *Raft) {
+		if s.next <= r.log.PrevIndex() {
+			err = ErrCompacted
+			return
+		}
+		to := min(r.commitIndex, s.next+commitsBatch-1)
+		for i := s.next; i <= to; i++ {
+			e := &entry{}
+			if err = r.storage.getEntry(i, e); err != nil {
+				err = opError(err, "Log.Get(%d)", i)
+				return
+			}
+			s.buf = append(s.buf, e.logEntry())
+		}
+	})
+	if ierr != nil {
+		return ierr
+	}
+	return err
+}
+
+// Close closes the subscription. Any blocked Next call
+// returns ErrSubscriptionClosed.
+func (s *CommitSubscription) Close() {
+	s.closeOnce.Do(func() {
+		s.r.subsMu.Lock()
+		delete(s.r.subs, s)
+		s.r.subsMu.Unlock()
+		close(s.closed)
+	})
+}
+
+// notifySubs signals subscriptions that commitIndex is changed.
+func (r *Raft) notifySubs() {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+	for s := range r.subs {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
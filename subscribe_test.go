@@ -0,0 +1,107 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRaft_SubscribeCommits(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	sub := flrs[0].SubscribeCommits(0)
+	defer sub.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), c.longTimeout)
+	defer cancel()
+	next := func() LogEntry {
+		t.Helper()
+		e, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	nextUpdate := func() LogEntry {
+		t.Helper()
+		for {
+			if e := next(); e.Type == "update" {
+				return e
+			}
+		}
+	}
+
+	// committed entries are delivered from first index
+	if e := next(); e.Index != 1 || e.Type != "config" {
+		t.Fatalf("first: got %d %s, want 1 config", e.Index, e.Type)
+	}
+	for i := 1; i <= 10; i++ {
+		if e, want := nextUpdate(), fmt.Sprintf("update:%d", i); string(e.Data) != want {
+			t.Fatalf("got %q, want %q", e.Data, want)
+		}
+	}
+
+	// entries committed later are delivered
+	c.sendUpdates(ldr, 11, 20)
+	for i := 11; i <= 20; i++ {
+		if e, want := nextUpdate(), fmt.Sprintf("update:%d", i); string(e.Data) != want {
+			t.Fatalf("got %q, want %q", e.Data, want)
+		}
+	}
+
+	// next blocks until entry is committed
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+	for {
+		if _, err := sub.Next(shortCtx); err == context.DeadlineExceeded {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub.Close()
+	if _, err := sub.Next(ctx); err != ErrSubscriptionClosed {
+		t.Fatalf("got %v, want ErrSubscriptionClosed", err)
+	}
+}
+
+func TestRaft_SubscribeCommits_compacted(t *testing.T) {
+	c := newCluster(t)
+	c.opt.LogSegmentSize = 1024
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	logCompacted := c.registerFor(eventLogCompacted, ldr)
+	defer c.unregister(logCompacted)
+	c.sendUpdates(ldr, 1, 100)
+	c.waitBarrier(ldr, 0)
+	c.takeSnapshot(ldr, 0, nil)
+	if _, err := logCompacted.waitForEvent(c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := ldr.SubscribeCommits(1)
+	defer sub.Close()
+	if _, err := sub.Next(context.Background()); err != ErrCompacted {
+		t.Fatalf("got %v, want ErrCompacted", err)
+	}
+}
@@ -15,21 +15,13 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"io"
+	"math"
 	"time"
 )
 
-// Tasks returns a channel to which non-FSMTasks
-// has to be submitted. Should be used as below:
-// 	 select {
-//       case <-r.Closed():
-//       case r.Tasks() <- t:
-//   }
-func (r *Raft) Tasks() chan<- Task {
-	return r.taskCh
-}
-
 // Task represents a raft task.
 type Task interface {
 	// Done returns a channel that is closed when task is completed.
@@ -87,6 +79,19 @@ func (t *task) reply(result interface{}) {
 // FSMTask represents FSM related task.
 type FSMTask interface {
 	Task
+
+	// Index returns the index of log entry, appended for UpdateFSM,
+	// UpdateFSMOnce and ApplyWithID tasks. For ApplyBatch, it is the
+	// index of last entry of the batch. Once such task is completed
+	// without error, the entry is committed and applied, so Index can
+	// be used as read-your-writes token, see WithMinIndex. It returns
+	// zero for other tasks. Must be called only on completed task.
+	Index() uint64
+
+	// Term returns the term of log entry, whose index is returned
+	// by Index. Must be called only on completed task.
+	Term() uint64
+
 	newEntry() *newEntry
 }
 
@@ -95,26 +100,75 @@ type newEntry struct {
 	*task
 	*entry
 	next *newEntry
+
+	batch *batch // not nil, if entry is part of ApplyBatch
+	pos   int    // of command in batch, -1 if composite
+
+	reqID string      // see ApplyWithID
+	dups  []*newEntry // duplicates of this entry, replied along with it
+
+	ctx  context.Context // see WithContext
+	span Span            // raft.entry span, nil if not started
+
+	minIndex uint64 // see WithMinIndex
+	tenant   string // see WithTenant
 }
 
 func (ne *newEntry) newEntry() *newEntry {
 	return ne
 }
 
-// FSMTasks returns a channel to which FSMTasks
-// has to be submitted. Should be used as below:
-// 	 select {
-//       case <-r.Closed():
-//       case r.FSMTasks() <- t:
-//   }
-func (r *Raft) FSMTasks() chan<- FSMTask {
-	return r.fsmTaskCh
+func (ne *newEntry) Index() uint64 {
+	if !ne.isLogEntry() {
+		return 0
+	}
+	return ne.index
+}
+
+func (ne *newEntry) Term() uint64 {
+	if !ne.isLogEntry() {
+		return 0
+	}
+	return ne.term
+}
+
+// maxDrain is the maximum number of batches or tasks, taken
+// from their channels at once, when they are readily available.
+const maxDrain = 64
+
+// executeTasks executes given task, and tasks that are readily
+// available in taskCh, as long as the state does not change.
+func (r *Raft) executeTasks(t Task) {
+	state := r.state
+	r.executeTask(t)
+	for i := 1; i < maxDrain && r.state == state && !r.isClosed(); i++ {
+		select {
+		case t = <-r.taskCh:
+			r.executeTask(t)
+			continue
+		default:
+		}
+		break
+	}
+}
+
+// executePending executes tasks that are readily available in taskCh.
+// It is called before storing a batch of FSMTasks, so that tasks such as
+// TransferLeadership, ChangeConfig and GetInfo are not starved by a
+// long burst of FSMTasks.
+func (r *Raft) executePending() {
+	select {
+	case t := <-r.taskCh:
+		r.executeTasks(t)
+	default:
+	}
 }
 
 func (r *Raft) runBatch() {
 	var neHead, neTail *newEntry
 	var newEntryCh chan *newEntry
-	i := 0
+	fsmTaskCh := r.fsmTaskCh
+	i, size := 0, int64(0)
 	for {
 		select {
 		case <-r.close:
@@ -123,26 +177,42 @@ func (r *Raft) runBatch() {
 			}
 			close(r.newEntryCh)
 			return
-		case t := <-r.fsmTaskCh:
-			i++
+		case t := <-fsmTaskCh:
 			ne := t.newEntry()
 			if neTail != nil {
-				neTail.next, neTail = ne, ne
+				neTail.next = ne
 			} else {
-				neHead, neTail = ne, ne
+				neHead = ne
 				newEntryCh = r.newEntryCh
 			}
-		case newEntryCh <- neHead:
-			if trace {
-				println(r, "got batch of", i, "entries")
+			// ApplyBatch task has chain of entries
+			for neTail = ne; ; neTail = neTail.next {
+				i++
+				size += int64(len(neTail.data))
+				if neTail.next == nil {
+					break
+				}
+			}
+			if !r.rejectBusy && r.busy(i, size) {
+				// block FSMTasks, until leader takes the batch
+				fsmTaskCh = nil
 			}
-			i = 0
+		case newEntryCh <- neHead:
+			r.nodeLogger.Debug("submitted batch", "entries", i)
+			i, size = 0, 0
 			neHead, neTail = nil, nil
 			newEntryCh = nil
+			fsmTaskCh = r.fsmTaskCh
 		}
 	}
 }
 
+// busy tells whether given entries exceed inflight limits.
+func (r *Raft) busy(entries int, bytes int64) bool {
+	return (r.maxInflight > 0 && entries >= r.maxInflight) ||
+		(r.maxInflightSize > 0 && bytes >= r.maxInflightSize)
+}
+
 func fsmTask(typ entryType, cmd interface{}, data []byte) FSMTask {
 	return &newEntry{
 		task:  newTask(),
@@ -157,6 +227,28 @@ func UpdateFSM(data []byte) FSMTask {
 	return fsmTask(entryUpdate, nil, data)
 }
 
+// UpdateFSMOnce task is same as UpdateFSM, but identified by client
+// and seq. If an update with same client and seq is already applied,
+// FSM.Update is not called again, and the task is replied with the
+// result of that update. This allows client to retry an update after
+// NotLeaderError or timeout, without applying it twice.
+//
+// Results are remembered for the last Options.ResultCacheSize updates,
+// of the leader that appended the entry. The results are cached on every
+// node as the entries are applied, so the retry can be submitted to the
+// new leader. The keys are saved in snapshot, but not the results. So
+// the retry of update compacted into snapshot is replied with
+// ErrResultUnknown, when node is restored from snapshot.
+//
+// The leader replies ErrUpdateOnceUnsupported, while any node runs
+// older version that does not support this task. If ResultCacheSize
+// is zero, this behaves same as UpdateFSM.
+func UpdateFSMOnce(client, seq uint64, data []byte) FSMTask {
+	ne := fsmTask(entryUpdateOnce, nil, data).newEntry()
+	ne.client, ne.seq = client, seq
+	return ne
+}
+
 // ReadFSM task is used to read state from FSM.
 // This eventually calls FSM.Read(cmd).
 func ReadFSM(cmd interface{}) FSMTask {
@@ -170,6 +262,59 @@ func DirtyReadFSM(cmd interface{}) FSMTask {
 	return fsmTask(entryDirtyRead, cmd, nil)
 }
 
+// WithMinIndex sets the minimum index of entry, that must be applied
+// to FSM, before DirtyReadFSM task t is served by non-leader. Use the
+// Index of a completed update task, so that the read reflects that
+// update, even if it is served by another node. The read waits until
+// the node applies the entry, so caller should give up after some time.
+//
+// ReadFSM and the reads served by leader, reflect all committed entries,
+// so minIndex is always satisfied for them.
+func WithMinIndex(minIndex uint64, t FSMTask) FSMTask {
+	t.newEntry().minIndex = minIndex
+	return t
+}
+
+// WithTenant sets the tenant, on whose behalf the updates of task t
+// are submitted. Tenant is given to Options.Interceptors in
+// LogEntry.Tenant, for example to limit the updates of each tenant
+// with TenantLimiter. It is not stored in log.
+func WithTenant(tenant string, t FSMTask) FSMTask {
+	for ne := t.newEntry(); ne != nil; ne = ne.next {
+		ne.tenant = tenant
+	}
+	return t
+}
+
+// LocalQuery task is used to read state from FSM of the node, to which
+// it is submitted, bypassing the log entirely. This eventually calls
+// FSM.Read(cmd) with cmd of type []byte. It can be submitted to any
+// node, including nonvoters.
+//
+// This is a dirty read: the state read reflects at least the entries
+// applied to FSM of this node, which can be behind the leader. Unlike
+// DirtyReadFSM, it does not wait for preceding FSMTasks, and it is not
+// rejected by Options.MaxApplyLag. This task returns QueryResult, whose
+// Index lets the caller reason about staleness.
+func LocalQuery(cmd []byte) Task {
+	return localQuery{newTask(), cmd}
+}
+
+type localQuery struct {
+	*task
+	cmd []byte
+}
+
+// QueryResult is the result of LocalQuery task.
+type QueryResult struct {
+	// Index is the index of last entry applied to FSM,
+	// when it was read.
+	Index uint64
+
+	// Result is the value returned by FSM.Read.
+	Result interface{}
+}
+
 // BarrierFSM is used to issue a command that blocks until all preceding
 // commands have been applied to the FSM. It can be used to ensure the
 // FSM reflects all queued commands.
@@ -177,6 +322,34 @@ func BarrierFSM() FSMTask {
 	return fsmTask(entryBarrier, nil, nil)
 }
 
+// BeginBulkFSM task puts leader in bulk mode, which is meant for initial
+// data loads. In bulk mode, UpdateFSM tasks are replied with nil result as
+// soon as they are appended to log, and applying them to FSM is deferred
+// until CommitBulkFSM. This allows leader to batch large number of entries
+// for disk and network.
+//
+// Note that in bulk mode, reply to UpdateFSM task does not mean that it is
+// committed. Use CommitBulkFSM to ensure that all of them are committed.
+// ReadFSM and BarrierFSM tasks submitted in bulk mode are replied only
+// after CommitBulkFSM.
+//
+// InProgressError: if leader is already in bulk mode.
+func BeginBulkFSM() FSMTask {
+	return fsmTask(entryBulkBegin, nil, nil)
+}
+
+// CommitBulkFSM task ends the bulk mode started by BeginBulkFSM.
+// It blocks until all entries appended in bulk mode are committed
+// and applied to FSM. After this, leader resumes normal per-entry
+// semantics.
+//
+// ErrBulkAborted: if leader is not in bulk mode, for example due to
+// leadership change after BeginBulkFSM. In this case, some of the
+// entries appended in bulk mode might have been lost.
+func CommitBulkFSM() FSMTask {
+	return fsmTask(entryBulkCommit, nil, nil)
+}
+
 // ------------------------------------------------------------------------
 
 type infoTask struct {
@@ -191,7 +364,14 @@ func GetInfo() Task {
 
 func (r *Raft) info() Info {
 	var flrs map[uint64]Replication
+	var lease *time.Time
+	replLag := r.replLag
 	if r.state == Leader {
+		replLag = 0
+		if expiry := r.ldr.leaseExpiry(); expiry.After(r.clock.Now()) {
+			t := time.Unix(0, expiry.UnixNano())
+			lease = &t
+		}
 		flrs = make(map[uint64]Replication)
 		for id, repl := range r.ldr.repls {
 			errMessage := ""
@@ -199,38 +379,61 @@ func (r *Raft) info() Info {
 				errMessage = repl.status.err.Error()
 			}
 			var round uint64
+			var catchup *CatchupProgress
 			if repl.status.round != nil {
 				round = repl.status.round.Ordinal
+				if r.configs.Latest.Nodes[id].nextAction() == Promote {
+					p := r.ldr.catchupProgress(&repl.status)
+					catchup = &p
+				}
 			}
 			var unreachable *time.Time
 			if !repl.status.noContact.IsZero() {
 				unreachable = &repl.status.noContact
 			}
 			flrs[id] = Replication{
-				ID:          id,
-				MatchIndex:  repl.status.matchIndex,
-				Unreachable: unreachable,
-				Err:         repl.status.err,
-				ErrMessage:  errMessage,
-				Round:       round,
+				ID:            id,
+				MatchIndex:    repl.status.matchIndex,
+				Unreachable:   unreachable,
+				Err:           repl.status.err,
+				ErrMessage:    errMessage,
+				Round:         round,
+				Throttle:      repl.status.throttle,
+				Throttled:     repl.status.throttled,
+				Breaker:       repl.status.breaker,
+				Catchup:       catchup,
+				RTT:           repl.getLatency(),
+				ClockSkew:     repl.getSkew(),
+				LastAck:       repl.getLastAck(),
+				EntriesPerSec: repl.getRate(),
+
+				ReachablePeers: repl.status.peers,
+				Partitioned:    r.ldr.partitioned(id),
 			}
 		}
 	}
 	return Info{
-		CID:           r.cid,
-		NID:           r.nid,
-		Addr:          r.addr(),
-		Term:          r.term,
-		State:         r.state,
-		Leader:        r.leader,
-		SnapshotIndex: r.snaps.index,
-		FirstLogIndex: r.log.PrevIndex() + 1,
-		LastLogIndex:  r.lastLogIndex,
-		LastLogTerm:   r.lastLogTerm,
-		Committed:     r.commitIndex,
-		LastApplied:   r.lastApplied(),
-		Configs:       r.configs.clone(),
-		Followers:     flrs,
+		CID:              r.cid,
+		NID:              r.nid,
+		Addr:             r.addr(),
+		Term:             r.term,
+		State:            r.state,
+		Leader:           r.leader,
+		LeaseExpiry:      lease,
+		Paused:           r.paused,
+		ReplicationLag:   replLag,
+		SnapshotIndex:    r.snaps.index,
+		FirstLogIndex:    r.log.PrevIndex() + 1,
+		LastLogIndex:     r.lastLogIndex,
+		LastLogTerm:      r.lastLogTerm,
+		Committed:        r.commitIndex,
+		LastApplied:      r.fsm.applied(),
+		Configs:          r.configs.clone(),
+		Followers:        flrs,
+		ElectionTimeout:  r.chosenTimeout,
+		UnsyncedEntries:  r.unsyncedEntries(),
+		Standby:          r.standby,
+		TruncatedEntries: r.truncated,
 	}
 }
 
@@ -242,6 +445,48 @@ type Replication struct {
 	Err         error      `json:"-"`
 	ErrMessage  string     `json:"error,omitempty"`
 	Round       uint64     `json:"round,omitempty"`
+
+	// Throttle is the limit on replication to this node.
+	// Throttled tells whether replication is currently
+	// waiting because of that limit.
+	Throttle  Throttle `json:"throttle"`
+	Throttled bool     `json:"throttled,omitempty"`
+
+	// Breaker is the state of circuit breaker of this
+	// node, see Options.CircuitBreaker.
+	Breaker BreakerState `json:"breaker,omitempty"`
+
+	// Catchup is the progress of current round, if this
+	// node is nonvoter waiting for promotion.
+	Catchup *CatchupProgress `json:"catchup,omitempty"`
+
+	// RTT is the smoothed round trip time of AppendEntries
+	// requests to this node. Zero if no response is received.
+	RTT time.Duration `json:"rtt,omitempty"`
+
+	// ClockSkew is the measured difference between clocks of leader
+	// and this node, see Options.MaxClockSkew. It is off by atmost
+	// half of RTT. Zero if not measured.
+	ClockSkew time.Duration `json:"clockSkew,omitempty"`
+
+	// LastAck is the time at which leader received last successful
+	// AppendEntries response from this node. Nil if no such response
+	// is received.
+	LastAck *time.Time `json:"lastAck,omitempty"`
+
+	// EntriesPerSec is the smoothed rate at which entries are
+	// replicated to this node.
+	EntriesPerSec float64 `json:"entriesPerSec,omitempty"`
+
+	// ReachablePeers are the other nodes, this node reported
+	// as reachable, see Options.PeerProbeInterval.
+	ReachablePeers []uint64 `json:"reachablePeers,omitempty"`
+
+	// Partitioned tells whether this node is unreachable from
+	// leader, but reachable from some follower. It means that
+	// the node is alive, and network between leader and node
+	// is partitioned.
+	Partitioned bool `json:"partitioned,omitempty"`
 }
 
 func (repl *Replication) decode(r io.Reader) error {
@@ -266,8 +511,68 @@ func (repl *Replication) decode(r io.Reader) error {
 	if repl.ErrMessage != "" {
 		repl.Err = errors.New(repl.ErrMessage)
 	}
-	repl.Round, err = readUint64(r)
-	return err
+	if repl.Round, err = readUint64(r); err != nil {
+		return err
+	}
+	bandwidth, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	repl.Throttle.Bandwidth = int64(bandwidth)
+	if repl.Throttle.MaxInflight, err = readUint64(r); err != nil {
+		return err
+	}
+	if repl.Throttled, err = readBool(r); err != nil {
+		return err
+	}
+	breaker, err := readUint8(r)
+	if err != nil {
+		return err
+	}
+	repl.Breaker = BreakerState(breaker)
+	rtt, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	repl.RTT = time.Duration(rtt)
+	skew, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	repl.ClockSkew = time.Duration(skew)
+	lastAck, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	if lastAck != 0 {
+		t := time.Unix(0, int64(lastAck))
+		repl.LastAck = &t
+	}
+	rate, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	repl.EntriesPerSec = math.Float64frombits(rate)
+	npeers, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	for ; npeers > 0; npeers-- {
+		peer, err := readUint64(r)
+		if err != nil {
+			return err
+		}
+		repl.ReachablePeers = append(repl.ReachablePeers, peer)
+	}
+	if repl.Partitioned, err = readBool(r); err != nil {
+		return err
+	}
+	catchup, err := readBool(r)
+	if err != nil || !catchup {
+		return err
+	}
+	repl.Catchup = new(CatchupProgress)
+	return repl.Catchup.decode(r)
 }
 
 func (repl *Replication) encode(w io.Writer) error {
@@ -287,7 +592,55 @@ func (repl *Replication) encode(w io.Writer) error {
 	if err := writeString(w, repl.ErrMessage); err != nil {
 		return err
 	}
-	return writeUint64(w, repl.Round)
+	if err := writeUint64(w, repl.Round); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(repl.Throttle.Bandwidth)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, repl.Throttle.MaxInflight); err != nil {
+		return err
+	}
+	if err := writeBool(w, repl.Throttled); err != nil {
+		return err
+	}
+	if err := writeUint8(w, uint8(repl.Breaker)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(repl.RTT)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(repl.ClockSkew)); err != nil {
+		return err
+	}
+	var lastAck uint64
+	if repl.LastAck != nil {
+		lastAck = uint64(repl.LastAck.UnixNano())
+	}
+	if err := writeUint64(w, lastAck); err != nil {
+		return err
+	}
+	if err := writeUint64(w, math.Float64bits(repl.EntriesPerSec)); err != nil {
+		return err
+	}
+	if err := writeUint32(w, uint32(len(repl.ReachablePeers))); err != nil {
+		return err
+	}
+	for _, peer := range repl.ReachablePeers {
+		if err := writeUint64(w, peer); err != nil {
+			return err
+		}
+	}
+	if err := writeBool(w, repl.Partitioned); err != nil {
+		return err
+	}
+	if err := writeBool(w, repl.Catchup != nil); err != nil {
+		return err
+	}
+	if repl.Catchup == nil {
+		return nil
+	}
+	return repl.Catchup.encode(w)
 }
 
 // Info captures state of a node.
@@ -306,6 +659,39 @@ type Info struct {
 	LastApplied   uint64                 `json:"lastApplied"`
 	Configs       Configs                `json:"configs"`
 	Followers     map[uint64]Replication `json:"followers,omitempty"`
+
+	// LeaseExpiry is the expiry of leader's lease, see Alerts.LeaseExpired.
+	// It is nil, if this node is not leader or its lease is expired.
+	// It is always nil, if Options.DisableStickiness is true.
+	LeaseExpiry *time.Time `json:"leaseExpiry,omitempty"`
+
+	// Paused tells whether the node is paused, see Pause.
+	Paused bool `json:"paused,omitempty"`
+
+	// ReplicationLag is the time taken by the last entry appended to
+	// this follower, since leader appended it. It is computed using
+	// clocks of both nodes, so it is accurate only if their clocks are
+	// synchronized. It is zero on leader.
+	ReplicationLag time.Duration `json:"replicationLag,omitempty"`
+
+	// ElectionTimeout is the last election timeout, chosen randomly by
+	// this node as follower or candidate. Comparing it across nodes helps
+	// to verify the randomization, when elections repeatedly split votes.
+	ElectionTimeout time.Duration `json:"electionTimeout,omitempty"`
+
+	// UnsyncedEntries is the number of log entries appended, but not yet
+	// synced to disk. It is always zero with SyncAlways, except while
+	// appending. See Options.SyncPolicy.
+	UnsyncedEntries uint64 `json:"unsyncedEntries,omitempty"`
+
+	// Standby tells whether the node is in standby, see Options.Standby.
+	Standby bool `json:"standby,omitempty"`
+
+	// TruncatedEntries is the number of log entries removed by this
+	// node since it started, because they conflicted with leader's log.
+	// Non zero value tells that the node had uncommitted entries from
+	// an older term, that were replaced when its log was repaired.
+	TruncatedEntries uint64 `json:"truncatedEntries,omitempty"`
 }
 
 func (info *Info) decode(r io.Reader) error {
@@ -376,6 +762,36 @@ func (info *Info) decode(r io.Reader) error {
 			info.Followers[repl.ID] = repl
 		}
 	}
+	unixNano, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	if unixNano != 0 {
+		t := time.Unix(0, int64(unixNano))
+		info.LeaseExpiry = &t
+	}
+	if info.Paused, err = readBool(r); err != nil {
+		return err
+	}
+	lag, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	info.ReplicationLag = time.Duration(lag)
+	timeout, err := readUint64(r)
+	if err != nil {
+		return err
+	}
+	info.ElectionTimeout = time.Duration(timeout)
+	if info.UnsyncedEntries, err = readUint64(r); err != nil {
+		return err
+	}
+	if info.Standby, err = readBool(r); err != nil {
+		return err
+	}
+	if info.TruncatedEntries, err = readUint64(r); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -431,7 +847,29 @@ func (info Info) encode(w io.Writer) error {
 			return err
 		}
 	}
-	return nil
+	var unixNano uint64
+	if info.LeaseExpiry != nil {
+		unixNano = uint64(info.LeaseExpiry.UnixNano())
+	}
+	if err := writeUint64(w, unixNano); err != nil {
+		return err
+	}
+	if err := writeBool(w, info.Paused); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(info.ReplicationLag)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, uint64(info.ElectionTimeout)); err != nil {
+		return err
+	}
+	if err := writeUint64(w, info.UnsyncedEntries); err != nil {
+		return err
+	}
+	if err := writeBool(w, info.Standby); err != nil {
+		return err
+	}
+	return writeUint64(w, info.TruncatedEntries)
 }
 
 // ------------------------------------------------------------------------
@@ -456,7 +894,8 @@ func (r *Raft) inspect(fn func(r *Raft)) error {
 
 type changeConfig struct {
 	*task
-	newConf Config
+	newConf    Config
+	prechecked bool // see Options.PrecheckNodes
 }
 
 // ChangeConfig task applies changes to cluster provides by the actions
@@ -473,6 +912,26 @@ func ChangeConfig(newConf Config) Task {
 	}
 }
 
+type planConfigChange struct {
+	*task
+	newConf Config
+}
+
+// PlanConfigChange task validates newConf, as ChangeConfig task would,
+// but does not apply it. This task returns the sequence of ConfigSteps,
+// that leader would take to apply newConf.
+//
+// It returns the same errors, that ChangeConfig task returns on
+// validation. Note that the plan may change, if latest config is changed
+// before newConf is submitted with ChangeConfig task. In that case
+// ChangeConfig task fails with ErrStaleConfig.
+func PlanConfigChange(newConf Config) Task {
+	return planConfigChange{
+		task:    newTask(),
+		newConf: newConf.clone(),
+	}
+}
+
 type waitForStableConfig struct {
 	*task
 }
@@ -504,8 +963,10 @@ func TakeSnapshot(threshold uint64) Task {
 
 type transferLdr struct {
 	*task
-	target  uint64 // whom to transfer. 0 means not specified
-	timeout time.Duration
+	target   uint64 // whom to transfer. 0 means not specified
+	timeout  time.Duration
+	pause    bool // pause on success, see Pause
+	stepDown bool // await new leader on success, see StepDown
 }
 
 // TransferLeadership task trasfers current leadership to given target server.
@@ -513,6 +974,7 @@ type transferLdr struct {
 // This task returns just error if any.
 //
 // During trasfer, leader rejects any new FSMTasks with InProgressError("transferLeadership").
+// Read tasks are handled as per Options.TransferReads.
 //
 // TimeoutError: leadership failed to transfer in specified timeout.
 // ErrTransferNoVoter: number of voters in cluster is one.
@@ -530,6 +992,200 @@ func TransferLeadership(target uint64, timeout time.Duration) Task {
 
 // ------------------------------------------------------------------------
 
+type stepDown struct {
+	*task
+	transfer bool
+	timeout  time.Duration
+}
+
+// StepDown task makes the leader voluntarily convert to follower. The
+// node does not start election until another node becomes leader, or
+// timeout passes. If timeout is zero, twice the maximum election timeout
+// is used. This task returns just error if any, when new leader is known.
+//
+// If transfer is true, leadership is transferred to most eligible voter
+// as in TransferLeadership(0, timeout), and the leader steps down only
+// if transfer succeeds. Otherwise, the leader steps down immediately,
+// and remaining voters elect new leader once they stop hearing from it.
+//
+// TimeoutError: no new leader is known within timeout.
+// ErrTransferNoVoter: number of voters in cluster is one.
+// Errors returned by TransferLeadership task, if transfer is true.
+func StepDown(transfer bool, timeout time.Duration) Task {
+	return stepDown{task: newTask(), transfer: transfer, timeout: timeout}
+}
+
+// ------------------------------------------------------------------------
+
+type pause struct {
+	*task
+	timeout time.Duration
+}
+
+// Pause task puts the node in maintenance mode, so that it can be
+// drained before restart. Paused node continues to serve as follower,
+// but it neither starts election nor accepts TimeoutNow requests. So
+// it does not become leader, until it is resumed.
+//
+// If the node is leader, leadership is transferred to most eligible
+// voter as in TransferLeadership(0, timeout), and the node is paused
+// only if transfer succeeds. This task returns just error if any.
+//
+// Node is not paused, when it is restarted.
+func Pause(timeout time.Duration) Task {
+	return pause{task: newTask(), timeout: timeout}
+}
+
+type resume struct {
+	*task
+}
+
+// Resume task resumes the node, paused by Pause task.
+// This task returns just error if any.
+func Resume() Task {
+	return resume{task: newTask()}
+}
+
+// ------------------------------------------------------------------------
+
+type campaign struct {
+	*task
+}
+
+// Campaign task makes the node start election immediately, instead of
+// waiting for election timeout. It is useful after manual recovery of
+// cluster, to choose which node becomes leader. Votes are requested as
+// in regular election, so voters that recently heard from a leader
+// deny them, unless Options.DisableStickiness is true. Note that the
+// term is incremented even if the election is lost, which may make
+// current leader step down. This task returns just error if any, when
+// the election is over.
+//
+// If the node is already leader, this task succeeds immediately. If the
+// node is candidate, this task waits for the outcome of current election.
+//
+// ErrCampaignLost: the election did not make the node leader.
+// InProgressError: if there is already another Campaign task in progress.
+// Any other error tells why the node cannot start election, i.e. it is
+// not voter, not part of cluster, not yet bootstrapped or paused.
+func Campaign() Task {
+	return campaign{task: newTask()}
+}
+
+// ------------------------------------------------------------------------
+
+type updateLogOptions struct {
+	*task
+	segmentSize, segmentEntries int
+}
+
+// UpdateLogOptions task changes Options.LogSegmentSize and
+// Options.LogSegmentEntries of the node, to which it is submitted.
+// They apply to the segment files created later. The change is not
+// persisted: the node uses Options given to New, when restarted.
+// This task returns just error if any.
+func UpdateLogOptions(segmentSize, segmentEntries int) Task {
+	return updateLogOptions{task: newTask(), segmentSize: segmentSize, segmentEntries: segmentEntries}
+}
+
+func (r *Raft) onUpdateLogOptions(t updateLogOptions) {
+	if err := r.log.SetSegmentLimits(t.segmentSize, t.segmentEntries); err != nil {
+		t.reply(err)
+		return
+	}
+	r.logger.Info("log segment limits changed", "segmentSize", t.segmentSize, "segmentEntries", t.segmentEntries)
+	t.reply(nil)
+}
+
+// ------------------------------------------------------------------------
+
+// LogEntry is a raft log entry as returned by GetLogEntries task.
+type LogEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"`
+	Data  []byte `json:"data,omitempty"`
+
+	// Time is the time at which leader appended the entry, as per
+	// leader's clock. Leader is the id of that leader. They are zero,
+	// if the entry is appended by a version that does not record them.
+	Time   time.Time `json:"time"`
+	Leader uint64    `json:"leader,omitempty"`
+
+	// Client and Seq identify the update submitted with UpdateFSMOnce.
+	// They are zero for other entries.
+	Client uint64 `json:"client,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+
+	// Tenant is the one given by WithTenant. It is set only for
+	// Options.Interceptors, since it is not stored in log.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func (e *entry) logEntry() LogEntry {
+	le := LogEntry{Index: e.index, Term: e.term, Type: e.typ.String(), Data: e.data, Leader: e.leader}
+	if e.typ == entryUpdateOnce {
+		le.Type, le.Client, le.Seq = entryUpdate.String(), e.client, e.seq
+	}
+	if e.timestamp != 0 {
+		le.Time = time.Unix(0, e.timestamp)
+	}
+	return le
+}
+
+type getLogEntries struct {
+	*task
+	from, to uint64
+}
+
+// GetLogEntries task returns log entries from index from to index to,
+// both inclusive. The range is trimmed to the entries currently available
+// in log, i.e. entries compacted into snapshot are not returned.
+// This task returns []LogEntry.
+func GetLogEntries(from, to uint64) Task {
+	return getLogEntries{task: newTask(), from: from, to: to}
+}
+
+func (r *Raft) onGetLogEntries(t getLogEntries) {
+	from, to := t.from, t.to
+	if first := r.log.PrevIndex() + 1; from < first {
+		from = first
+	}
+	if to > r.lastLogIndex {
+		to = r.lastLogIndex
+	}
+	entries := []LogEntry{}
+	for i := from; i <= to; i++ {
+		e := &entry{}
+		if err := r.storage.getEntry(i, e); err != nil {
+			t.reply(opError(err, "Log.Get(%d)", i))
+			return
+		}
+		entries = append(entries, e.logEntry())
+	}
+	t.reply(entries)
+}
+
+// ------------------------------------------------------------------------
+
+type backup struct {
+	*task
+	w io.Writer
+}
+
+// Backup task streams a consistent copy of storage to w. The copy
+// contains identity, term, vars, latest snapshot and log entries upto
+// commitIndex. This task returns the last log index in the copy.
+//
+// The copy is written in another goroutine, so the node continues
+// to serve while the backup is in progress. Use Restore to restore
+// storageDir from the copy.
+func Backup(w io.Writer) Task {
+	return backup{task: newTask(), w: w}
+}
+
+// ------------------------------------------------------------------------
+
 // todo: reply tasks even on panic
 func (r *Raft) executeTask(t Task) {
 	switch t := t.(type) {
@@ -541,16 +1197,38 @@ func (r *Raft) executeTask(t Task) {
 		} else {
 			r.bootstrap(t)
 		}
+	case precheckNode:
+		go func() {
+			t.reply(r.precheckNode(t.nid, t.addr))
+		}()
 	case takeSnapshot:
 		r.onTakeSnapshot(t)
+	case backup:
+		r.onBackup(t)
+	case getLogEntries:
+		r.onGetLogEntries(t)
+	case exportState:
+		r.onExportState(t)
+	case pause:
+		r.onPause(t)
+	case resume:
+		r.onResume(t)
+	case campaign:
+		r.onCampaign(t)
+	case activate:
+		r.onActivate(t)
 	case inspect:
 		t.fn(r)
 		t.reply(nil)
+	case localQuery:
+		r.sendFSM(t)
+	case updateLogOptions:
+		r.onUpdateLogOptions(t)
 	default:
 		if r.state == Leader {
 			r.ldr.executeTask(t)
 		} else {
-			t.reply(notLeaderError(r, false))
+			t.reply(notLeaderError(r, false, true))
 		}
 	}
 }
@@ -558,13 +1236,17 @@ func (r *Raft) executeTask(t Task) {
 func (l *leader) executeTask(t Task) {
 	switch t := t.(type) {
 	case FSMTask:
-		t.reply(errors.New("raft: use Raft.FSMTasks() for FSMTask"))
+		t.reply(errors.New("raft: use Raft.SubmitTask for FSMTask"))
 	case changeConfig:
 		l.onChangeConfig(t)
+	case planConfigChange:
+		l.onPlanConfigChange(t)
 	case waitForStableConfig:
 		l.onWaitForStableConfig(t)
 	case transferLdr:
 		l.onTransfer(t)
+	case stepDown:
+		l.onStepDown(t)
 	default:
 		t.reply(errInvalidTask)
 	}
@@ -0,0 +1,128 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import "time"
+
+// Throttle limits replication of log entries to a follower.
+// Zero value means no limit. see Options.ReplicationThrottle
+type Throttle struct {
+	// Bandwidth is the maximum number of bytes of entries sent
+	// per second.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+
+	// MaxInflight is the maximum number of entries sent, but
+	// not yet acknowledged by the follower.
+	MaxInflight uint64 `json:"maxInflight,omitempty"`
+}
+
+// throttle is used by pipeline writer. pipeline reader
+// reports acknowledged index using ackCh.
+type throttle struct {
+	Throttle
+	clock     Clock
+	until     time.Time   // entries can be sent after this time
+	ackIndex  uint64      // entries upto this are acknowledged
+	ackCh     chan uint64 // latest acknowledged index
+	throttled bool        // as notified to leader
+}
+
+func newThrottle(t Throttle, c Clock) *throttle {
+	if t.Bandwidth <= 0 && t.MaxInflight == 0 {
+		return nil
+	}
+	return &throttle{Throttle: t, clock: c, ackCh: make(chan uint64, 1)}
+}
+
+// sent accounts size bytes of entries sent.
+func (t *throttle) sent(size int64) {
+	if t.Bandwidth > 0 {
+		now := t.clock.Now()
+		if t.until.Before(now) {
+			t.until = now
+		}
+		t.until = t.until.Add(durationFor(t.Bandwidth, size))
+	}
+}
+
+// ack is called by pipeline reader, when follower
+// acknowledges entries upto index.
+func (t *throttle) ack(index uint64) {
+	select {
+	case t.ackCh <- index:
+	case <-t.ackCh:
+		t.ackCh <- index
+	}
+}
+
+// reset is called before pipeline starts.
+func (t *throttle) reset(matchIndex uint64) {
+	select {
+	case <-t.ackCh:
+	default:
+	}
+	t.ackIndex = matchIndex
+}
+
+// waitThrottle waits until entries can be sent, but not longer than
+// max. returns false, if entries still cannot be sent.
+func (r *replication) waitThrottle(stopCh <-chan struct{}, max time.Duration) (bool, error) {
+	t := r.throttle
+	deadline := r.clock.Now().Add(max)
+	for {
+		select {
+		case t.ackIndex = <-t.ackCh:
+		default:
+		}
+		now := r.clock.Now()
+		var wait time.Duration
+		if t.MaxInflight > 0 && r.nextIndex-1-t.ackIndex >= t.MaxInflight {
+			wait = deadline.Sub(now) // until ack
+		} else if now.Before(t.until) {
+			wait = t.until.Sub(now)
+		} else {
+			r.notifyThrottled(false)
+			return true, nil
+		}
+		r.notifyThrottled(true)
+		if now.After(deadline) {
+			return false, nil
+		}
+		if d := deadline.Sub(now); wait > d {
+			wait = d
+		}
+		timer := r.clock.NewTimer(wait)
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return false, errStop
+		case t.ackIndex = <-t.ackCh:
+			timer.Stop()
+		case <-timer.C():
+		}
+	}
+}
+
+func (r *replication) notifyThrottled(b bool) {
+	if r.throttle.throttled != b {
+		r.logger.Debug("throttle changed", "throttled", b)
+		r.throttle.throttled = b
+		r.notifyLdr(throttled{b})
+	}
+}
+
+type throttled struct {
+	val bool
+}
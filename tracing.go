@@ -0,0 +1,108 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import "context"
+
+// Tracer is the interface to be implemented for distributed
+// tracing, such as OpenTelemetry. The methods are called
+// concurrently from multiple goroutines.
+//
+// Following spans are created:
+//
+//   raft.entry           by leader, from receiving FSMTask till it is
+//                        replied. i.e. append, replication, commit and apply
+//   raft.apply           applying an entry to FSM
+//   raft.appendEntries   by leader, from sending appendEntries request
+//                        with entries to a follower till its response
+//   raft.rpc.<type>      rpc sent by Raft using connection pool, and
+//                        handling of rpc by receiver
+//   raft.election        by candidate, from starting election till it
+//                        is won or lost. attributes raft.result,
+//                        raft.votesGranted and raft.votesDenied tell
+//                        the outcome. denied votes with reason are
+//                        also logged
+//
+// Span context is propagated in rpc requests using Inject and Extract.
+// Use WithContext to make raft.entry span child of client's span.
+type Tracer interface {
+	// Start starts a new span as child of span in ctx if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+
+	// Inject encodes span context in ctx, to propagate it in rpc.
+	Inject(ctx context.Context) []byte
+
+	// Extract decodes span context encoded by Inject.
+	Extract(b []byte) context.Context
+}
+
+// Span represents an operation being traced.
+type Span interface {
+	// SetAttribute sets attribute on span.
+	SetAttribute(key string, value interface{})
+
+	// End completes the span.
+	End()
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+func (nopTracer) Inject(ctx context.Context) []byte { return nil }
+func (nopTracer) Extract(b []byte) context.Context  { return context.Background() }
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) End()                                       {}
+
+// WithContext sets given context for the FSMTask. The spans
+// created for this task becomes child of the span in ctx.
+func WithContext(ctx context.Context, t FSMTask) FSMTask {
+	t.newEntry().ctx = ctx
+	return t
+}
+
+// starts raft.entry span for given entry. the span is
+// ended when the entry is replied.
+func (ne *newEntry) startSpan(t Tracer) {
+	ctx := ne.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ne.ctx, ne.span = t.Start(ctx, "raft.entry")
+	ne.span.SetAttribute("raft.type", ne.typ.String())
+	ne.span.SetAttribute("raft.index", ne.index)
+	ne.span.SetAttribute("raft.term", ne.term)
+}
+
+func (ne *newEntry) reply(result interface{}) {
+	if ne.span != nil {
+		ne.span.End()
+		ne.span = nil
+	}
+	for _, dup := range ne.dups {
+		dup.index, dup.term = ne.index, ne.term
+		dup.reply(result)
+	}
+	ne.dups = nil
+	if ne.batch != nil {
+		ne.batch.set(ne, result)
+		return
+	}
+	ne.task.reply(result)
+}
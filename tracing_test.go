@@ -0,0 +1,153 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	tr := &recordingTracer{}
+	c := newCluster(t)
+	c.opt.Tracer = tr
+	ldr, _ := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	ctx, root := tr.Start(context.Background(), "client")
+	task := WithContext(ctx, UpdateFSM([]byte("hello")))
+	_ = ldr.SubmitTask(context.Background(), task)
+	c.waitTaskDone(task, c.longTimeout, nil)
+	root.End()
+	c.waitFSMLen(1)
+
+	entry := tr.find(func(s *recordedSpan) bool {
+		return s.name == "raft.entry" && s.parent == root.(*recordedSpan).id
+	})
+	if entry == nil {
+		t.Fatal("raft.entry span with client parent not found")
+	}
+	if !entry.ended() {
+		t.Fatal("raft.entry span not ended")
+	}
+	if got := entry.attr("raft.type"); got != "update" {
+		t.Fatalf("raft.type: got %v, want update", got)
+	}
+	if tr.find(func(s *recordedSpan) bool { return s.name == "raft.apply" && s.parent == entry.id }) == nil {
+		t.Fatal("raft.apply span with raft.entry parent not found")
+	}
+
+	// appendEntries span context must reach followers
+	var appends []*recordedSpan
+	tr.mu.Lock()
+	for _, s := range tr.spans {
+		if s.name == "raft.appendEntries" {
+			appends = append(appends, s)
+		}
+	}
+	tr.mu.Unlock()
+	if len(appends) == 0 {
+		t.Fatal("raft.appendEntries span not found")
+	}
+	for _, a := range appends {
+		if tr.find(func(s *recordedSpan) bool { return s.name == "raft.rpc.append" && s.parent == a.id }) == nil {
+			t.Fatalf("raft.rpc.append span with parent %d not found", a.id)
+		}
+	}
+}
+
+// recordingTracer ---------------------------------------------
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type spanKey struct{}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	s := &recordedSpan{id: uint64(len(tr.spans) + 1), name: name, attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(uint64); ok {
+		s.parent = parent
+	}
+	tr.spans = append(tr.spans, s)
+	return context.WithValue(ctx, spanKey{}, s.id), s
+}
+
+func (tr *recordingTracer) Inject(ctx context.Context) []byte {
+	id, ok := ctx.Value(spanKey{}).(uint64)
+	if !ok {
+		return nil
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func (tr *recordingTracer) Extract(b []byte) context.Context {
+	ctx := context.Background()
+	if len(b) == 8 {
+		ctx = context.WithValue(ctx, spanKey{}, binary.BigEndian.Uint64(b))
+	}
+	return ctx
+}
+
+func (tr *recordingTracer) find(match func(s *recordedSpan) bool) *recordedSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.spans {
+		if match(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+type recordedSpan struct {
+	id, parent uint64
+	name       string
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	end   bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = true
+}
+
+func (s *recordedSpan) attr(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attrs[key]
+}
+
+func (s *recordedSpan) ended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end
+}
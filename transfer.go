@@ -16,6 +16,7 @@ package raft
 
 import (
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -45,6 +46,14 @@ type transfer struct {
 	//
 	// on timeout, we try another target
 	newTermTimer *safeTimer
+
+	// true if timeoutNowReq is sent to any target.
+	// leader lease is treated as expired from then
+	leaseExpired bool
+
+	// voters that rejected timeoutNowReq, for example
+	// because they are paused. they are not chosen again
+	rejected map[uint64]bool
 }
 
 func (t transfer) inProgress() bool {
@@ -56,25 +65,20 @@ func (t transfer) targetChosen() bool {
 }
 
 func (t *transfer) reply(err error) {
-	if trace {
-		println("transferLdr.reply err:", err)
-	}
 	t.task.reply(err)
 	t.timer.stop()
 	t.respCh = nil
 	t.newTermTimer.stop()
+	t.leaseExpired = false
+	t.rejected = nil
 }
 
 // ----------------------------------------------------
 
 func (l *leader) onTransfer(t transferLdr) {
-	if trace {
-		println(l, "got", t)
-	}
+	l.logger.Debug("leadership transfer requested", "target", t.target, "timeout", t.timeout)
 	if err := l.validateTransfer(t); err != nil {
-		if trace {
-			println(l, "transferLdr invalid:", err)
-		}
+		l.logger.Debug("leadership transfer rejected", "err", err)
 		t.reply(err)
 		return
 	}
@@ -84,7 +88,7 @@ func (l *leader) onTransfer(t transferLdr) {
 		t.timeout = 2 * l.hbTimeout
 	}
 	l.transfer.timer.reset(t.timeout)
-	l.transfer.deadline = time.Now().Add(t.timeout)
+	l.transfer.deadline = l.clock.Now().Add(t.timeout)
 	l.tryTransfer()
 }
 
@@ -121,23 +125,15 @@ func (l *leader) tryTransfer() {
 			}
 		}
 	} else {
-		for id, n := range l.configs.Latest.Nodes {
-			if id != l.nid && n.Voter {
-				repl := l.repls[id]
-				if repl.status.noContact.IsZero() && repl.status.matchIndex == l.lastLogIndex {
-					target = id
-					break
-				}
-			}
-		}
+		target = l.choseTransferTarget()
 	}
 
 	if target != 0 {
+		l.transfer.leaseExpired = true
+		l.checkLease()
 		l.transfer.respCh = make(chan rpcResponse, 1)
-		req := &timeoutNowReq{req{l.term, l.nid}}
-		if trace {
-			println(l, target, ">>", req)
-		}
+		req := &timeoutNowReq{req{term: l.term, src: l.nid}}
+		l.logger.Debug("sending timeoutNow", "peer", target)
 		pool := l.getConnPool(target)
 		go func(ch chan<- rpcResponse, deadline time.Time) {
 			resp := &timeoutNowResp{}
@@ -147,24 +143,147 @@ func (l *leader) tryTransfer() {
 	}
 }
 
+// TransferCandidate is a voter, to which leadership can be transferred.
+// see Options.TransferTargetSelector
+type TransferCandidate struct {
+	Node
+
+	// MatchIndex is the index of highest log entry, known to be
+	// replicated on the node.
+	MatchIndex uint64
+
+	// CaughtUp is true, if the node has all entries of leader's log.
+	// Leadership is transferred, only when the target is caught up.
+	CaughtUp bool
+
+	// Latency is the smoothed round trip time of recent AppendEntries
+	// requests to the node. Zero value means, it is not known yet.
+	Latency time.Duration
+}
+
+// PreferTags returns TransferTargetSelector, that chooses the most
+// preferred candidate having all given tags. If no candidate has
+// them, the most preferred candidate is chosen. For example, to keep
+// leadership in the same zone:
+//
+//     opt.TransferTargetSelector = raft.PreferTags(map[string]string{"zone": "us-east-1a"})
+func PreferTags(tags map[string]string) func(candidates []TransferCandidate) uint64 {
+	return func(candidates []TransferCandidate) uint64 {
+		for _, c := range candidates {
+			if c.hasTags(tags) {
+				return c.ID
+			}
+		}
+		return 0
+	}
+}
+
+// transferCandidates returns reachable voters, that are not rejected
+// transfer in this attempt. the result is sorted by preference:
+// most caught up, least latency.
+func (l *leader) transferCandidates() []TransferCandidate {
+	var candidates []TransferCandidate
+	for id, n := range l.configs.Latest.Nodes {
+		if id == l.nid || !n.Voter || l.transfer.rejected[id] {
+			continue
+		}
+		repl := l.repls[id]
+		if !repl.status.noContact.IsZero() {
+			continue
+		}
+		candidates = append(candidates, TransferCandidate{
+			Node:       n,
+			MatchIndex: repl.status.matchIndex,
+			CaughtUp:   repl.status.matchIndex == l.lastLogIndex,
+			Latency:    repl.getLatency(),
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.MatchIndex != cj.MatchIndex {
+			return ci.MatchIndex > cj.MatchIndex
+		}
+		if ci.Latency != cj.Latency {
+			if ci.Latency == 0 || cj.Latency == 0 {
+				return cj.Latency == 0
+			}
+			return ci.Latency < cj.Latency
+		}
+		return ci.ID < cj.ID
+	})
+	return candidates
+}
+
+// choseTransferTarget returns the voter to which leadership is to be
+// transferred, when target is not specified. returns 0, if chosen
+// voter is not caught up yet.
+func (l *leader) choseTransferTarget() uint64 {
+	candidates := l.transferCandidates()
+	if len(candidates) == 0 {
+		return 0
+	}
+	chosen := candidates[0]
+	if l.transferSelector != nil {
+		id := l.transferSelector(candidates)
+		for _, c := range candidates {
+			if c.ID == id {
+				chosen = c
+				break
+			}
+		}
+	}
+	l.logger.Debug("chose transfer target", "peer", chosen.ID, "caughtUp", chosen.CaughtUp)
+	if !chosen.CaughtUp {
+		return 0
+	}
+	return chosen.ID
+}
+
 func (l *leader) onTransferTimeout() {
 	l.replyTransfer(TimeoutError("transferLeadership"))
 }
 
 func (l *leader) replyTransfer(err error) {
+	l.logger.Debug("leadership transfer finished", "err", err)
 	l.transfer.reply(err)
 	l.checkConfigActions(nil, l.configs.Latest)
+
+	// we are still leader, serve queued reads
+	if len(l.queuedReads) > 0 {
+		head := l.queuedReads[0]
+		for i := 1; i < len(l.queuedReads); i++ {
+			l.queuedReads[i-1].next = l.queuedReads[i]
+		}
+		l.queuedReads = nil
+		l.storeEntry(head)
+	}
 }
 
-func (l *leader) onTimeoutNowResult(rpc rpcResponse) {
-	if trace {
-		println(l, rpc)
+// tells whether given entry can be served, while
+// leadership transfer is in progress
+func (l *leader) canServeDuringTransfer(ne *newEntry) bool {
+	return !ne.isLogEntry() && l.transferReads == ServeReads && !l.transfer.leaseExpired
+}
+
+func (r *Raft) replyQueuedReads(err error) {
+	for _, ne := range r.queuedReads {
+		ne.reply(err)
 	}
+	r.queuedReads = nil
+}
+
+func (l *leader) onTimeoutNowResult(rpc rpcResponse) {
+	l.logger.Debug("received timeoutNow response", "peer", rpc.from, "err", rpc.err)
 	l.transfer.respCh = nil
 	if rpc.err != nil {
+		if !l.clock.Now().Before(l.transfer.deadline) {
+			// rpc timed out along with transfer, node
+			// need not be unreachable. see onTransferTimeout
+			return
+		}
 		repl := l.repls[rpc.from]
 		if repl.status.noContact.IsZero() {
-			repl.status.noContact = time.Now()
+			repl.status.noContact = l.clock.Now()
 			repl.status.err = rpc.err
 		}
 		if l.transfer.target == 0 {
@@ -172,10 +291,25 @@ func (l *leader) onTimeoutNowResult(rpc rpcResponse) {
 		}
 		return
 	}
+	if rpc.response.getResult() == staleTerm {
+		// if response contains term T > currentTerm:
+		// set currentTerm = T, convert to follower
+		l.setState(Follower)
+		l.setLeader(0)
+		l.setTerm(rpc.response.getTerm())
+		return
+	}
 	if rpc.response.getResult() != success {
 		if l.transfer.target == 0 {
-			l.replyTransfer(fmt.Errorf("raft.transferLeadership: target rejected with %v", rpc.response.getResult()))
-			return
+			// try another target
+			if l.transfer.rejected == nil {
+				l.transfer.rejected = make(map[uint64]bool)
+			}
+			l.transfer.rejected[rpc.from] = true
+			if len(l.transferCandidates()) == 0 {
+				l.replyTransfer(fmt.Errorf("raft.transferLeadership: target rejected with %v", rpc.response.getResult()))
+				return
+			}
 		}
 		l.tryTransfer()
 		return
@@ -187,3 +321,69 @@ func (l *leader) onTimeoutNowResult(rpc rpcResponse) {
 func (l *leader) onNewTermTimeout() {
 	l.tryTransfer()
 }
+
+// ----------------------------------------------------
+
+func (l *leader) onStepDown(t stepDown) {
+	if l.configs.Latest.numVoters() == 1 {
+		t.reply(ErrTransferNoVoter)
+		return
+	}
+	timeout := t.timeout
+	if timeout <= 0 {
+		timeout = 2 * l.electionMax
+	}
+	if t.transfer {
+		// awaits new leader on successful transfer, see leader.release
+		l.onTransfer(transferLdr{task: t.task, timeout: timeout, stepDown: true})
+		return
+	}
+	l.logger.Info("stepping down")
+	l.setState(Follower)
+	l.setLeader(0)
+	l.awaitLeader(t.task, l.clock.Now().Add(timeout))
+}
+
+// awaitLeader prevents the node from starting election, until another
+// node becomes leader or deadline passes. t is replied accordingly.
+func (r *Raft) awaitLeader(t *task, deadline time.Time) {
+	if r.leader != 0 && r.leader != r.nid {
+		t.reply(nil)
+		return
+	}
+	r.stepDown = t
+	r.stepDownTimer.reset(deadline.Sub(r.clock.Now()))
+}
+
+// replyStepDown replies the pending StepDown task, if any.
+func (r *Raft) replyStepDown(err error) {
+	if r.stepDown != nil {
+		r.stepDown.reply(err)
+		r.stepDown = nil
+		r.stepDownTimer.stop()
+	}
+}
+
+func (r *Raft) onPause(t pause) {
+	if r.state == Leader {
+		// paused on successful transfer, see leader.release
+		r.ldr.onTransfer(transferLdr{task: t.task, timeout: t.timeout, pause: true})
+		return
+	}
+	if r.state == Candidate {
+		r.setState(Follower)
+	}
+	if !r.paused {
+		r.paused = true
+		r.logger.Info("paused")
+	}
+	t.reply(nil)
+}
+
+func (r *Raft) onResume(t resume) {
+	if r.paused {
+		r.paused = false
+		r.logger.Info("resumed")
+	}
+	t.reply(nil)
+}
@@ -15,6 +15,9 @@
 package raft
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -184,12 +187,12 @@ func setupTransferTimeout(t *testing.T, quorumWait, taskTimeout time.Duration) (
 	c.shutdown(flrs...)
 
 	// send an update, this makes sure that no transfer target is available
-	ldr.FSMTasks() <- UpdateFSM([]byte("test"))
+	_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte("test")))
 
 	// request leadership transfer, with given timeout,
 	// this will not complete within this timeout
 	transfer = TransferLeadership(0, taskTimeout)
-	ldr.Tasks() <- transfer
+	_ = ldr.SubmitTask(context.Background(), transfer)
 
 	return
 }
@@ -256,6 +259,32 @@ func TestTransfer_newTermDetected(t *testing.T) {
 	c.waitTaskDone(transfer, 2*time.Second, nil)
 }
 
+// delayed timeoutNow from old leader must not start election
+func TestTransfer_timeoutNow_staleTerm(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	var result rpcResult
+	err := ldr.inspect(func(r *Raft) {
+		req := &timeoutNowReq{req{term: r.term - 1, src: r.nid}}
+		resp := &timeoutNowResp{}
+		if err := r.getConnPool(flrs[0].nid).doRPC(req, resp, time.Now().Add(time.Second)); err != nil {
+			t.Errorf("timeoutNow failed: %v", err)
+		}
+		result = resp.getResult()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != staleTerm {
+		t.Fatalf("timeoutNow: got %d, want staleTerm", result)
+	}
+	if got := c.info(flrs[0]).State; got != Follower {
+		t.Fatalf("state: got %s, want %s", got, Follower)
+	}
+	c.ensureLeader(ldr.NID())
+}
+
 func TestTransfer_onShutdownReplyServerClosed(t *testing.T) {
 	c, ldr, _, transfer := setupTransferTimeout(t, time.Second, 5*time.Second)
 	defer c.shutdown()
@@ -266,3 +295,285 @@ func TestTransfer_onShutdownReplyServerClosed(t *testing.T) {
 	// transfer reply must be ErrServerClosed
 	c.waitTaskDone(transfer, 2*time.Second, ErrServerClosed)
 }
+
+// leader should handle read tasks during transferLeadership
+// as per Options.TransferReads
+func TestTransfer_readPolicy(t *testing.T) {
+	setup := func(t *testing.T, policy ReadPolicy) (c *cluster, ldr *Raft, flrs []*Raft, transfer Task) {
+		c = newCluster(t)
+		c.opt.TransferReads = policy
+		c.quorumWait = 5 * time.Second
+		ldr, flrs = c.ensureLaunch(3)
+		c.waitForCommitted(c.info(ldr).LastLogIndex)
+		c.shutdown(flrs...)
+
+		// send an update, and wait till it is appended
+		lastLogIndex := c.info(ldr).LastLogIndex
+		_ = ldr.SubmitTask(context.Background(), UpdateFSM([]byte("test")))
+		appended := func() bool {
+			return c.info(ldr).LastLogIndex > lastLogIndex
+		}
+		if !waitForCondition(appended, 5*time.Millisecond, c.longTimeout) {
+			c.Fatal("update not appended")
+		}
+
+		transfer = TransferLeadership(0, 500*time.Millisecond)
+		_ = ldr.SubmitTask(context.Background(), transfer)
+		return
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		c, ldr, _, _ := setup(t, RejectReads)
+		defer c.shutdown()
+
+		// read must be rejected with InProgressError
+		_, err := waitRead(ldr, "last", 5*time.Millisecond)
+		if _, ok := err.(InProgressError); !ok {
+			t.Fatalf("err: got %#v, want InProgressError", err)
+		}
+	})
+
+	for _, policy := range []ReadPolicy{ServeReads, QueueReads} {
+		t.Run(policy.String(), func(t *testing.T) {
+			c, ldr, flrs, transfer := setup(t, policy)
+			defer c.shutdown()
+
+			// read must not be rejected
+			read := ReadFSM("last")
+			_ = ldr.SubmitTask(context.Background(), read)
+			select {
+			case <-read.Done():
+				c.Fatalf("read.Err: got %v, want no reply", read.Err())
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			// transfer fails, ldr still remains leader
+			c.waitTaskDone(transfer, 2*time.Second, TimeoutError("transferLeadership"))
+
+			// once the update is committed, read must be served
+			c.restart(flrs[0])
+			c.waitTaskDone(read, c.longTimeout, nil)
+		})
+	}
+}
+
+func TestTransfer_pause(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// pausing leader, must transfer leadership
+	client := NewClient(c.id2Addr(ldr.nid))
+	client.dial = ldr.dialFn
+	if err := client.Pause(c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	newLdr := c.waitForLeader(flrs...)
+	if info := c.info(ldr); !info.Paused || info.State != Follower {
+		t.Fatalf("got paused=%v state=%s, want paused follower", info.Paused, info.State)
+	}
+
+	// ensure all nodes have log of newLdr, otherwise
+	// paused node may reject vote as logNotUptodate
+	c.sendUpdates(newLdr, 1, 1)
+	c.waitFSMLen(1)
+
+	// paused node must not become leader, but must vote
+	c.shutdown(newLdr)
+	other := flrs[0]
+	if other == newLdr {
+		other = flrs[1]
+	}
+	c.waitForLeader(other)
+	c.sendUpdates(other, 2, 11)
+	c.waitFSMLen(11, ldr, other)
+
+	// paused node must reject transfer
+	if _, err := waitTask(other, TransferLeadership(ldr.nid, time.Second), c.longTimeout); err == nil {
+		t.Fatal("transfer to paused node must fail")
+	}
+
+	if err := client.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if info := c.info(ldr); info.Paused {
+		t.Fatal("must be resumed")
+	}
+	c.ensure(waitTask(other, TransferLeadership(ldr.nid, c.longTimeout), c.longTimeout))
+	c.waitForLeader(ldr)
+}
+
+// leader must not be paused, if transfer fails
+func TestTransfer_pause_noVoter(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	if _, err := waitTask(ldr, Pause(c.longTimeout), c.longTimeout); err != ErrTransferNoVoter {
+		t.Fatalf("err: got %v, want %v", err, ErrTransferNoVoter)
+	}
+	if info := c.info(ldr); info.Paused {
+		t.Fatal("leader must not be paused")
+	}
+}
+
+func TestTransfer_stepDown(t *testing.T) {
+	c, ldr, flrs := launchCluster(t, 3)
+	defer c.shutdown()
+
+	// only leader can step down
+	if _, err := waitTask(flrs[0], StepDown(false, c.longTimeout), c.longTimeout); err == nil {
+		t.Fatal("err: got nil, want NotLeaderError")
+	} else if _, ok := err.(NotLeaderError); !ok {
+		t.Fatalf("err: got %v, want NotLeaderError", err)
+	}
+
+	// stepped down leader must not start election
+	c.ensure(waitTask(ldr, StepDown(false, 0), 2*c.longTimeout))
+	if got := c.waitForFollowers(); got == ldr {
+		t.Fatal("stepped down node must not be leader")
+	}
+	if info := c.info(ldr); info.State != Follower {
+		t.Fatalf("state: got %s, want %s", info.State, Follower)
+	}
+
+	// step down with transfer
+	ldr = c.leader()
+	client := NewClient(c.id2Addr(ldr.nid))
+	client.dial = ldr.dialFn
+	if err := client.StepDown(true, c.longTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.waitForFollowers(); got == ldr {
+		t.Fatal("stepped down node must not be leader")
+	}
+}
+
+func TestTransfer_stepDown_noVoter(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	if _, err := waitTask(ldr, StepDown(false, c.longTimeout), c.longTimeout); err != ErrTransferNoVoter {
+		t.Fatalf("err: got %v, want %v", err, ErrTransferNoVoter)
+	}
+	if info := c.info(ldr); info.State != Leader {
+		t.Fatalf("state: got %s, want leader", info.State)
+	}
+}
+
+func TestTransfer_handoffOnShutdown(t *testing.T) {
+	c := newCluster(t)
+	c.opt.HandoffOnShutdown = true
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+	term := c.info(ldr).Term
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	// new leader must be elected without waiting for election timeout
+	start := time.Now()
+	c.shutdown(ldr)
+	newLdr := c.waitForLeader(flrs...)
+	if d := time.Since(start); d >= c.heartbeatTimeout {
+		t.Fatalf("handoff took %s", d)
+	}
+	if got := c.info(newLdr).Term; got != term+1 {
+		t.Fatalf("newLdr.term: got %d, want %d", got, term+1)
+	}
+}
+
+func TestTransfer_targetSelector(t *testing.T) {
+	c := newCluster(t)
+	var mu sync.Mutex
+	var got []TransferCandidate
+	c.opt.TransferTargetSelector = func(candidates []TransferCandidate) uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		got = candidates
+		// prefer node with highest id
+		var id uint64
+		for _, cand := range candidates {
+			if cand.ID > id {
+				id = cand.ID
+			}
+		}
+		return id
+	}
+	ldr, flrs := c.ensureLaunch(5)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	want := flrs[0].nid
+	for _, flr := range flrs {
+		if flr.nid > want {
+			want = flr.nid
+		}
+	}
+	c.ensure(waitTask(ldr, TransferLeadership(0, c.longTimeout), c.longTimeout))
+	if newLdr := c.waitForLeader(); newLdr.nid != want {
+		t.Fatalf("newLdr: got M%d, want M%d", newLdr.nid, want)
+	}
+
+	// candidates must be reachable voters, sorted by preference
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(flrs) {
+		t.Fatalf("#candidates: got %d, want %d", len(got), len(flrs))
+	}
+	for i, cand := range got {
+		if cand.ID == ldr.nid || !cand.Voter {
+			t.Fatalf("invalid candidate %v", cand)
+		}
+		if i > 0 && cand.MatchIndex > got[i-1].MatchIndex {
+			t.Fatalf("candidates not sorted by matchIndex: %v", got)
+		}
+		if cand.CaughtUp && cand.Latency <= 0 {
+			t.Fatalf("candidate M%d: latency must be known", cand.ID)
+		}
+	}
+}
+
+func TestTransfer_preferTags(t *testing.T) {
+	c := newCluster(t)
+	c.opt.TransferTargetSelector = PreferTags(map[string]string{"zone": "b"})
+	ldr, flrs := c.ensureLaunch(5)
+	defer c.shutdown()
+	c.waitCommitReady(ldr)
+
+	// tag a follower, which is not preferred otherwise
+	want := flrs[len(flrs)-1]
+	config := c.info(ldr).Configs.Latest
+	if err := config.SetTags(want.nid, map[string]string{"zone": "b", "rack": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	c.ensure(waitTask(ldr, ChangeConfig(config), c.longTimeout))
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	c.ensure(waitTask(ldr, TransferLeadership(0, c.longTimeout), c.longTimeout))
+	if newLdr := c.waitForLeader(); newLdr.nid != want.nid {
+		t.Fatalf("newLdr: got M%d, want M%d", newLdr.nid, want.nid)
+	}
+
+	// no candidate with tags, chooses most preferred
+	selector := PreferTags(map[string]string{"zone": "c"})
+	if got := selector([]TransferCandidate{{Node: Node{ID: 2}}, {Node: Node{ID: 3}}}); got != 0 {
+		t.Fatalf("got M%d, want 0", got)
+	}
+}
+
+// when target is not specified, voters rejecting
+// timeoutNow must be skipped
+func TestTransfer_skipRejectedTarget(t *testing.T) {
+	c := newCluster(t)
+	var paused uint64
+	c.opt.TransferTargetSelector = func(candidates []TransferCandidate) uint64 {
+		return atomic.LoadUint64(&paused)
+	}
+	ldr, flrs := c.ensureLaunch(3)
+	defer c.shutdown()
+
+	atomic.StoreUint64(&paused, flrs[0].nid)
+	c.ensure(waitTask(flrs[0], Pause(c.longTimeout), c.longTimeout))
+	c.ensure(waitTask(ldr, TransferLeadership(0, c.longTimeout), c.longTimeout))
+	c.waitForLeader(flrs[1])
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	unixScheme = "unix://"
+	memScheme  = "mem://"
+)
+
+// splitAddr returns the network and address to be
+// used for dialing and listening on given addr.
+func splitAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, unixScheme):
+		return "unix", addr[len(unixScheme):]
+	case strings.HasPrefix(addr, memScheme):
+		return "mem", addr[len(memScheme):]
+	}
+	return "tcp", addr
+}
+
+// MemNetwork is an in-process network, which connects raft
+// nodes running in the same process without using sockets.
+// It is useful for testing, and for running multiple raft
+// clusters in a single process.
+//
+// Nodes on MemNetwork use addresses of form "mem://name".
+// Serve each node on listener returned by Listen, and set
+// Options.Dial to MemNetwork.Dial.
+//
+// The zero value is an empty network ready to use.
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+// Listen announces on the given address. addr can be
+// either of form "mem://name" or just "name".
+func (n *MemNetwork) Listen(addr string) (net.Listener, error) {
+	name := strings.TrimPrefix(addr, memScheme)
+	if name == "" {
+		return nil, fmt.Errorf("raft: invalid address %q", addr)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners == nil {
+		n.listeners = make(map[string]*memListener)
+	}
+	if _, ok := n.listeners[name]; ok {
+		return nil, fmt.Errorf("raft: address %s already in use", addr)
+	}
+	l := &memListener{
+		n:     n,
+		addr:  memAddr(name),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.listeners[name] = l
+	return l, nil
+}
+
+// Dial connects to the address on the network. It has the
+// signature of Options.Dial.
+func (n *MemNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	if network == "tcp" {
+		// address without scheme
+		network, address = splitAddr(memScheme + address)
+	}
+	if network != "mem" {
+		return nil, fmt.Errorf("raft: network %s not supported by MemNetwork", network)
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[address]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("raft: dial mem://%s: connection refused", address)
+	}
+
+	client, server := net.Pipe()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("raft: dial mem://%s: connection refused", address)
+	case <-timer.C:
+		return nil, fmt.Errorf("raft: dial mem://%s: i/o timeout", address)
+	}
+}
+
+type memListener struct {
+	n     *MemNetwork
+	addr  memAddr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+var errListenerClosed = errors.New("raft: listener closed")
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.n.mu.Lock()
+		delete(l.n.listeners, string(l.addr))
+		l.n.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return memScheme + string(a) }
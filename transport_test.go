@@ -0,0 +1,285 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitAddr(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"localhost:7000", "tcp", "localhost:7000"},
+		{"unix:///tmp/raft.sock", "unix", "/tmp/raft.sock"},
+		{"mem://node1", "mem", "node1"},
+	}
+	for _, test := range tests {
+		network, address := splitAddr(test.addr)
+		if network != test.network || address != test.address {
+			t.Errorf("splitAddr(%q): got (%q, %q), want (%q, %q)", test.addr, network, address, test.network, test.address)
+		}
+		if err := validateAddr(test.addr); err != nil {
+			t.Errorf("validateAddr(%q): %v", test.addr, err)
+		}
+	}
+	for _, addr := range []string{"unix://", "mem://"} {
+		if err := validateAddr(addr); err == nil {
+			t.Errorf("validateAddr(%q): error expected", addr)
+		}
+	}
+}
+
+func TestMemNetwork(t *testing.T) {
+	n := new(MemNetwork)
+	testTransport(t, func(id uint64) string {
+		return fmt.Sprintf("mem://node%d", id)
+	}, n.Listen, n.Dial)
+
+	if _, err := n.Dial("mem", "node1", time.Second); err == nil {
+		t.Fatal("dial must fail after listener is closed")
+	}
+}
+
+func TestRaft_unixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, func(id uint64) string {
+		return fmt.Sprintf("unix://%s", filepath.Join(dir, fmt.Sprintf("node%d.sock", id)))
+	}, func(addr string) (net.Listener, error) {
+		return net.Listen(splitAddr(addr))
+	}, net.DialTimeout)
+}
+
+// testTransport launches 3 node cluster using given transport,
+// and checks that updates are replicated and Client works.
+func testTransport(t *testing.T, addr func(id uint64) string, listen func(addr string) (net.Listener, error), dial dialFn) {
+	t.Helper()
+	opt := DefaultOptions()
+	opt.HeartbeatTimeout = 100 * time.Millisecond
+	opt.Dial = dial
+
+	nodes := make(map[uint64]Node)
+	for id := uint64(1); id <= 3; id++ {
+		nodes[id] = Node{ID: id, Addr: addr(id), Voter: true}
+	}
+	var rr []*Raft
+	var fsms []*fsmMock
+	serveErr := make(chan error, len(nodes))
+	for id := range nodes {
+		storageDir, err := ioutil.TempDir(tempDir, "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = SetIdentity(storageDir, 1234, id); err != nil {
+			t.Fatal(err)
+		}
+		if err = bootstrapStorage(storageDir, opt, nodes); err != nil {
+			t.Fatal(err)
+		}
+		fsm := &fsmMock{id: identity{1234, id}}
+		r, err := New(opt, fsm, storageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := listen(addr(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { serveErr <- r.Serve(l) }()
+		rr, fsms = append(rr, r), append(fsms, fsm)
+	}
+	defer func() {
+		for _, r := range rr {
+			_ = r.Shutdown(context.Background())
+		}
+		for range rr {
+			if err := <-serveErr; err != ErrServerClosed {
+				t.Errorf("serve: got %v, want %v", err, ErrServerClosed)
+			}
+		}
+	}()
+
+	// update must succeed on leader
+	updated := waitForCondition(func() bool {
+		for _, r := range rr {
+			if _, err := waitUpdate(r, "hello", time.Second); err == nil {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Millisecond, 5*time.Second)
+	if !updated {
+		t.Fatal("update failed")
+	}
+	replicated := waitForCondition(func() bool {
+		for _, fsm := range fsms {
+			if fsm.lastCommand() != "hello" {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Millisecond, 5*time.Second)
+	if !replicated {
+		t.Fatal("update is not replicated")
+	}
+
+	client := NewClient(addr(1))
+	client.dial = dial
+	info, err := client.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Addr != addr(1) {
+		t.Fatalf("info.Addr: got %s, want %s", info.Addr, addr(1))
+	}
+}
+
+func TestRaft_multipleListeners(t *testing.T) {
+	n := new(MemNetwork)
+	opt := DefaultOptions()
+	opt.HeartbeatTimeout = 100 * time.Millisecond
+	opt.Dial = n.Dial
+
+	peerAddr := func(id uint64) string { return fmt.Sprintf("mem://node%d", id) }
+	adminAddr := func(id uint64) string { return fmt.Sprintf("mem://admin%d", id) }
+	nodes := make(map[uint64]Node)
+	for id := uint64(1); id <= 2; id++ {
+		nodes[id] = Node{ID: id, Addr: peerAddr(id), Voter: true}
+	}
+	var rr []*Raft
+	serveErr := make(chan error, len(nodes))
+	for id := range nodes {
+		storageDir, err := ioutil.TempDir(tempDir, "storage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = SetIdentity(storageDir, 1234, id); err != nil {
+			t.Fatal(err)
+		}
+		if err = bootstrapStorage(storageDir, opt, nodes); err != nil {
+			t.Fatal(err)
+		}
+		r, err := New(opt, &fsmMock{id: identity{1234, id}}, storageDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := n.Listen(peerAddr(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin, err := n.Listen(adminAddr(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { serveErr <- r.Serve(Restrict(peer, PeerRPCs), Restrict(admin, AdminRPCs)) }()
+		rr = append(rr, r)
+	}
+	defer func() {
+		for _, r := range rr {
+			_ = r.Shutdown(context.Background())
+		}
+		for range rr {
+			if err := <-serveErr; err != ErrServerClosed {
+				t.Errorf("serve: got %v, want %v", err, ErrServerClosed)
+			}
+		}
+	}()
+
+	// peers talk on peer listener
+	updated := waitForCondition(func() bool {
+		for _, r := range rr {
+			if _, err := waitUpdate(r, "hello", time.Second); err == nil {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Millisecond, 5*time.Second)
+	if !updated {
+		t.Fatal("update failed")
+	}
+
+	// tasks are served only on admin listener
+	client := NewClient(adminAddr(1))
+	client.dial = n.Dial
+	if _, err := client.GetInfo(); err != nil {
+		t.Fatal(err)
+	}
+	client = NewClient(peerAddr(1))
+	client.dial = n.Dial
+	if _, err := client.GetInfo(); err == nil {
+		t.Fatal("GetInfo on peer listener must fail")
+	}
+
+	// peer requests are not served on admin listener
+	conn, err := dial(n.Dial, adminAddr(1), time.Second, tcpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.rwc.Close()
+	pool := &connPool{src: 2, cid: 1234, nid: 1, dialFn: n.Dial, clock: realClock{}}
+	if err = pool.handshake(conn, adminAddr(1), time.Now().Add(time.Second)); err == nil {
+		t.Fatal("identity handshake on admin listener must fail")
+	}
+}
+
+func TestRaft_dialNode(t *testing.T) {
+	// nodes tagged with dc=remote are dialed through proxy host
+	var mu sync.Mutex
+	proxied := make(map[string]bool)
+	c := newCluster(t)
+	c.opt.DialNode = func(n Node) func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if n.Tags["dc"] != "remote" {
+			return nil
+		}
+		return func(nw, address string, timeout time.Duration) (net.Conn, error) {
+			mu.Lock()
+			proxied[address] = true
+			mu.Unlock()
+			return network.Host("proxy").DialTimeout(nw, address, timeout)
+		}
+	}
+	ldr, _ := c.ensureLaunch(2)
+	defer c.shutdown()
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+
+	// add nonvoter M3 in remote dc
+	config := c.info(ldr).Configs.Latest
+	if err := config.AddNonvoter(3, c.id2Addr(3), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SetTags(3, map[string]string{"dc": "remote"}); err != nil {
+		t.Fatal(err)
+	}
+	m3 := c.launch(1, false)[3]
+	c.ensure(waitTask(ldr, ChangeConfig(config), c.longTimeout))
+	c.waitFSMLen(10, m3)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 1 || !proxied[c.id2Addr(3)] {
+		t.Fatalf("proxied: got %v, want only %s", proxied, c.id2Addr(3))
+	}
+}
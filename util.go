@@ -37,6 +37,25 @@ func min(a, b uint64) uint64 {
 	return b
 }
 
+func max(a, b uint64) uint64 {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func safeClose(ch chan struct{}) {
 	select {
 	case <-ch:
@@ -81,7 +100,7 @@ func size(buffs net.Buffers) int64 {
 // safeTimer ------------------------------------------------------
 
 type safeTimer struct {
-	timer *time.Timer
+	timer Timer
 	C     <-chan time.Time
 
 	// active is true if timer is started, but not yet received from channel.
@@ -90,12 +109,12 @@ type safeTimer struct {
 }
 
 // newSafeTimer creates stopped timer
-func newSafeTimer() *safeTimer {
-	t := time.NewTimer(0)
+func newSafeTimer(c Clock) *safeTimer {
+	t := c.NewTimer(0)
 	if !t.Stop() {
-		<-t.C
+		<-t.C()
 	}
-	return &safeTimer{t, t.C, false}
+	return &safeTimer{t, t.C(), false}
 }
 
 func (t *safeTimer) stop() {
@@ -113,56 +132,38 @@ func (t *safeTimer) reset(d time.Duration) {
 	t.active = true
 }
 
-// backOff ------------------------------------------------
-
-const (
-	maxFailureScale = 12
-	failureWait     = 10 * time.Millisecond
-)
-
-// backOff is used to compute an exponential backOff
-// duration. Base time is scaled by the current round,
-// up to some maximum scale factor. If backOff exceeds
-// given max, it returns max
-func backOff(round uint64, max time.Duration) time.Duration {
-	base, limit := failureWait, uint64(maxFailureScale)
-	power := min(round, limit)
-	for power > 2 {
-		base *= 2
-		power--
-	}
-	if base > max {
-		return max
-	}
-	return base
-}
-
 // randTime -----------------------------------------------------------------
 
 type randTime struct {
-	r *rand.Rand
+	r     *rand.Rand
+	clock Clock
 }
 
-func newRandTime() randTime {
+func newRandTime(c Clock) randTime {
 	var seed int64
 	if r, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64)); err != nil {
 		seed = time.Now().UnixNano()
 	} else {
 		seed = r.Int64()
 	}
-	return randTime{rand.New(rand.NewSource(seed))}
+	return randTime{rand.New(rand.NewSource(seed)), c}
 }
 
 func (rt randTime) duration(min time.Duration) time.Duration {
 	return min + time.Duration(rt.r.Int63())%min
 }
 
+// between returns random duration in range [min, max).
+func (rt randTime) between(min, max time.Duration) time.Duration {
+	return min + time.Duration(rt.r.Int63n(int64(max-min)))
+}
+
 func (rt randTime) deadline(min time.Duration) time.Time {
-	return time.Now().Add(rt.duration(min))
+	return rt.clock.Now().Add(rt.duration(min))
 }
 
 func (rt randTime) after(min time.Duration) <-chan time.Time {
-	return time.After(rt.duration(min))
+	return after(rt.clock, rt.duration(min))
 }
 
 // -------------------------------------------------------------------------
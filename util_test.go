@@ -15,12 +15,13 @@
 package raft
 
 import (
+	"net"
 	"testing"
 	"time"
 )
 
 func TestRandTime_duration(t *testing.T) {
-	rt1, rt2 := newRandTime(), newRandTime()
+	rt1, rt2 := newRandTime(realClock{}), newRandTime(realClock{})
 	same := true
 	for i := 0; i < 10; i++ {
 		d1, d2 := rt1.duration(time.Second), rt2.duration(time.Second)
@@ -32,3 +33,106 @@ func TestRandTime_duration(t *testing.T) {
 		t.Fatal("got same values for 10 times")
 	}
 }
+
+func TestRandTime_between(t *testing.T) {
+	rt := newRandTime(realClock{})
+	for i := 0; i < 100; i++ {
+		if d := rt.between(time.Second, 2*time.Second); d < time.Second || d >= 2*time.Second {
+			t.Fatalf("got %s, want in range [1s, 2s)", d)
+		}
+	}
+}
+
+func TestBackoff_wait(t *testing.T) {
+	rt := newRandTime(realClock{})
+	b := Backoff{}.withDefaults(time.Second)
+	tests := []struct {
+		failures uint64
+		want     time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{6, 320 * time.Millisecond},
+		{7, 500 * time.Millisecond},
+		{100, 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := b.wait(test.failures, rt); got != test.want {
+			t.Errorf("wait(%d): got %s, want %s", test.failures, got, test.want)
+		}
+	}
+
+	// with jitter, wait is reduced by atmost given fraction
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := b.wait(100, rt); got > 500*time.Millisecond || got < 250*time.Millisecond {
+			t.Fatalf("wait: got %s, want in range [250ms, 500ms]", got)
+		}
+	}
+}
+
+func TestRPCTimeouts_withDefaults(t *testing.T) {
+	got := RPCTimeouts{AppendEntries: time.Second}.withDefaults(100 * time.Millisecond)
+	want := RPCTimeouts{
+		Heartbeat:       200 * time.Millisecond,
+		AppendEntries:   time.Second,
+		SnapshotChunk:   200 * time.Millisecond,
+		InstallSnapshot: 400 * time.Millisecond,
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if err := (RPCTimeouts{Heartbeat: -1}).validate(); err == nil {
+		t.Fatal("negative timeout must be invalid")
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	_ = c1.SetReadDeadline(time.Now())
+	_, err := c1.Read(make([]byte, 1))
+	if !isTimeout(err) {
+		t.Fatalf("deadline exceeded: isTimeout(%v) is false", err)
+	}
+
+	// connection refused is not timeout
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	if _, err = net.Dial("tcp", addr); err == nil || isTimeout(err) {
+		t.Fatalf("connection refused: isTimeout(%v) is true", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := breaker{CircuitBreaker: CircuitBreaker{Failures: 2}}
+	if b.onFailure() || b.state != BreakerClosed {
+		t.Fatalf("after 1 failure: got %v, want %v", b.state, BreakerClosed)
+	}
+	if !b.onFailure() || b.state != BreakerOpen {
+		t.Fatalf("after 2 failures: got %v, want %v", b.state, BreakerOpen)
+	}
+
+	// single failure in halfOpen, opens again
+	b.state = BreakerHalfOpen
+	if !b.onFailure() || b.state != BreakerOpen {
+		t.Fatalf("halfOpen failure: got %v, want %v", b.state, BreakerOpen)
+	}
+	b.state = BreakerHalfOpen
+	if !b.onSuccess() || b.state != BreakerClosed {
+		t.Fatalf("halfOpen success: got %v, want %v", b.state, BreakerClosed)
+	}
+
+	// disabled breaker never opens
+	b = breaker{}
+	for i := 0; i < 100; i++ {
+		if b.onFailure() {
+			t.Fatal("disabled breaker opened")
+		}
+	}
+}
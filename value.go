@@ -16,6 +16,7 @@ package raft
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -35,7 +36,7 @@ func openValue(dir, ext string) (*value, error) {
 		return nil, err
 	}
 	if len(matches) == 0 {
-		f, err := os.OpenFile(valueFile(dir, ext, 0, 0), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		f, err := os.OpenFile(valueFile(dir, ext, 0, 0), os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
 		if err != nil {
 			return nil, err
 		}
@@ -94,3 +95,140 @@ func (v *value) set(v1, v2 uint64) error {
 func valueFile(dir, ext string, v1, v2 uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%d-%d%s", v1, v2, ext))
 }
+
+// vars ----------------------------------------------------------
+
+// vars is a keyspace of small values persisted in storage dir. Unlike
+// value, which has fixed format, vars can hold any state, so that new
+// state such as hints and epochs can be persisted without changing the
+// format of existing files.
+//
+// Keys are namespaced as "namespace.name", for example "fsm.applied".
+// Each key is stored in its own file with ext ".var", which is replaced
+// atomically on set. vars are included in Backup, and restored by
+// Restore.
+type vars struct {
+	dir string
+	m   map[string][]byte
+}
+
+const varExt = ".var"
+
+func openVars(dir string) (*vars, error) {
+	temps, err := filepath.Glob(filepath.Join(dir, "*"+varExt+".tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, temp := range temps {
+		if err = os.Remove(temp); err != nil {
+			return nil, err
+		}
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+varExt))
+	if err != nil {
+		return nil, err
+	}
+	v := &vars{dir: dir, m: make(map[string][]byte)}
+	for _, match := range matches {
+		key := strings.TrimSuffix(filepath.Base(match), varExt)
+		if err = validateVarKey(key); err != nil {
+			return nil, fmt.Errorf("raft: invalid var file %s", match)
+		}
+		if v.m[key], err = ioutil.ReadFile(match); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func validateVarKey(key string) error {
+	i := strings.IndexByte(key, '.')
+	if i <= 0 || i == len(key)-1 {
+		return fmt.Errorf("raft: var key %q is not namespaced", key)
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return fmt.Errorf("raft: var key %q has invalid char %q", key, c)
+		}
+	}
+	return nil
+}
+
+// clone returns copy of all keys and values. values are not
+// copied, because set never modifies them in place.
+func (v *vars) clone() map[string][]byte {
+	m := make(map[string][]byte, len(v.m))
+	for key, val := range v.m {
+		m[key] = val
+	}
+	return m
+}
+
+// get returns the value of key. returns nil, if key is not set.
+func (v *vars) get(key string) []byte {
+	return v.m[key]
+}
+
+// set persists val for key. nil val deletes the key.
+func (v *vars) set(key string, val []byte) error {
+	if err := validateVarKey(key); err != nil {
+		return err
+	}
+	file := filepath.Join(v.dir, key+varExt)
+	if val == nil {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(v.m, key)
+		return syncDir(v.dir)
+	}
+	temp, err := os.OpenFile(file+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if temp != nil {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+		}
+	}()
+	if _, err = temp.Write(val); err != nil {
+		return err
+	}
+	if err = temp.Sync(); err != nil {
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(temp.Name(), file); err != nil {
+		return err
+	}
+	temp = nil
+	if err = syncDir(v.dir); err != nil {
+		return err
+	}
+	v.m[key] = append([]byte(nil), val...)
+	return nil
+}
+
+// getUint64 returns the value of key, set by setUint64.
+// returns false, if key is not set.
+func (v *vars) getUint64(key string) (uint64, bool, error) {
+	b := v.get(key)
+	if b == nil {
+		return 0, false, nil
+	}
+	if len(b) != 8 {
+		return 0, false, fmt.Errorf("raft: var %s is not uint64", key)
+	}
+	return byteOrder.Uint64(b), true, nil
+}
+
+func (v *vars) setUint64(key string, val uint64) error {
+	b := make([]byte, 8)
+	byteOrder.PutUint64(b, val)
+	return v.set(key, b)
+}
@@ -50,6 +50,73 @@ func TestValue(t *testing.T) {
 	}
 }
 
+func TestVars(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := openVars(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.get("test.str"); got != nil {
+		t.Fatalf("get: got %q, want nil", got)
+	}
+	for _, key := range []string{"", "nons", ".name", "ns.", "ns.a/b"} {
+		if err = v.set(key, []byte("x")); err == nil {
+			t.Fatalf("set(%q): got nil, want error", key)
+		}
+	}
+	if err = v.set("test.str", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.setUint64("test.num", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.set("test.del", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.set("test.del", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen
+	if v, err = openVars(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(v.get("test.str")); got != "hello" {
+		t.Fatalf("get: got %q, want hello", got)
+	}
+	if got, ok, err := v.getUint64("test.num"); err != nil || !ok || got != 42 {
+		t.Fatalf("getUint64: got %d %v %v, want 42 true <nil>", got, ok, err)
+	}
+	if _, ok, err := v.getUint64("test.del"); err != nil || ok {
+		t.Fatalf("getUint64: got %v %v, want false <nil>", ok, err)
+	}
+	if _, _, err := v.getUint64("test.str"); err == nil {
+		t.Fatal("getUint64 of non uint64 must fail")
+	}
+}
+
+func TestCheckDurability(t *testing.T) {
+	dir, err := ioutil.TempDir(tempDir, "durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = checkDurability(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("files left in dir: got %d, want 0", len(files))
+	}
+}
+
 func BenchmarkValue_set(b *testing.B) {
 	dir, err := ioutil.TempDir(tempDir, "val")
 	if err != nil {
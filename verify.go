@@ -0,0 +1,165 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/santhosh-tekuri/raft/log"
+)
+
+// VerifyStorage checks consistency of log in storageDir. It is meant
+// for debugging divergence reports, and must not be called while
+// the storageDir is in use by raft.
+//
+// It checks that segment files are well formed and have contiguous
+// indexes, each entry decodes with its index, terms are monotonic and
+// not beyond current term, and log is consistent with snapshot.
+//
+// Log entries have no checksums. If Options.EncryptionKeys is set,
+// integrity of each entry is verified by its authentication tag.
+func VerifyStorage(opt Options, storageDir string) error {
+	if err := log.Verify(filepath.Join(storageDir, "log")); err != nil {
+		return err
+	}
+	return withStorage(opt, storageDir, func(s *storage) error {
+		return s.verify()
+	})
+}
+
+// ReadLogEntries calls fn with each log entry in storageDir, from index
+// from to index to, both inclusive. The range is trimmed to the entries
+// available in log. It must not be called while the storageDir is in
+// use by raft.
+func ReadLogEntries(opt Options, storageDir string, from, to uint64, fn func(e LogEntry) error) error {
+	return withStorage(opt, storageDir, func(s *storage) error {
+		if first := s.log.PrevIndex() + 1; from < first {
+			from = first
+		}
+		if to > s.lastLogIndex {
+			to = s.lastLogIndex
+		}
+		for i := from; i <= to; i++ {
+			e := &entry{}
+			if err := s.getEntry(i, e); err != nil {
+				return opError(err, "Log.Get(%d)", i)
+			}
+			if err := fn(e.logEntry()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// withStorage opens storage in storageDir and calls fn with it.
+// Any panic from storage is returned as error, because the
+// storage being inspected may be corrupted.
+func withStorage(opt Options, storageDir string, fn func(s *storage) error) (err error) {
+	if err := opt.validate(); err != nil {
+		return err
+	}
+	if err := lockStorage(storageDir); err != nil {
+		return err
+	}
+	defer func() {
+		if e := unlockDir(storageDir); err == nil {
+			err = e
+		}
+	}()
+	defer func() {
+		if v := recover(); v != nil {
+			if e, ok := v.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("raft: %v", v)
+			}
+		}
+	}()
+	s, err := openStorage(storageDir, opt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := s.log.Close(); err == nil {
+			err = e
+		}
+	}()
+	return fn(s)
+}
+
+// lockStorage locks storageDir for offline access.
+func lockStorage(storageDir string) error {
+	d, err := os.Stat(storageDir)
+	if err != nil {
+		return err
+	}
+	if !d.IsDir() {
+		return fmt.Errorf("raft: %q is not a diretory", storageDir)
+	}
+	return lockDir(storageDir)
+}
+
+// verify checks consistency of entries in log, with
+// each other and with snapshot.
+func (s *storage) verify() error {
+	prevIndex, lastIndex := s.log.PrevIndex(), s.log.LastIndex()
+	if prevIndex > s.snaps.index {
+		return fmt.Errorf("raft.verify: log starts at %d, after snapshot index %d", prevIndex+1, s.snaps.index)
+	}
+	if lastIndex < s.snaps.index {
+		return fmt.Errorf("raft.verify: log ends at %d, before snapshot index %d", lastIndex, s.snaps.index)
+	}
+	var prevTerm uint64
+	if prevIndex == s.snaps.index {
+		prevTerm = s.snaps.term
+	}
+	for i := prevIndex + 1; i <= lastIndex; i++ {
+		b, err := s.log.Get(i)
+		if err != nil {
+			return fmt.Errorf("raft.verify: entry %d: %v", i, err)
+		}
+		r := bytes.NewReader(b)
+		e := &entry{}
+		if err = e.decode(r); err != nil {
+			return fmt.Errorf("raft.verify: entry %d: decode: %v", i, err)
+		}
+		if r.Len() != 0 {
+			return fmt.Errorf("raft.verify: entry %d: %d trailing bytes", i, r.Len())
+		}
+		if e.index != i {
+			return fmt.Errorf("raft.verify: entry %d: got index %d", i, e.index)
+		}
+		if e.term < prevTerm {
+			return fmt.Errorf("raft.verify: entry %d: term %d is less than previous term %d", i, e.term, prevTerm)
+		}
+		if e.term > s.term {
+			return fmt.Errorf("raft.verify: entry %d: term %d is beyond current term %d", i, e.term, s.term)
+		}
+		if i == s.snaps.index && e.term != s.snaps.term {
+			return fmt.Errorf("raft.verify: entry %d: term %d does not match snapshot term %d", i, e.term, s.snaps.term)
+		}
+		if e.typ == entryConfig {
+			if err = new(Config).decode(e); err != nil {
+				return fmt.Errorf("raft.verify: entry %d: config: %v", i, err)
+			}
+		}
+		prevTerm = e.term
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyStorage(t *testing.T) {
+	c, ldr, _ := launchCluster(t, 1)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.takeSnapshot(ldr, 0, nil)
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20)
+	first, last := ldr.log.PrevIndex()+1, ldr.lastLogIndex
+	c.shutdown(ldr)
+
+	dir := c.storage[ldr.nid]
+	if err := VerifyStorage(c.opt, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// read all entries
+	var entries []LogEntry
+	err := ReadLogEntries(c.opt, dir, 0, math.MaxUint64, func(e LogEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uint64(len(entries)), last-first+1; got != want {
+		t.Fatalf("numEntries: got %d, want %d", got, want)
+	}
+	for i, e := range entries {
+		if e.Index != first+uint64(i) {
+			t.Fatalf("entries[%d].Index: got %d, want %d", i, e.Index, first+uint64(i))
+		}
+	}
+	if e := entries[len(entries)-1]; e.Type != "update" || string(e.Data) != "update:20" {
+		t.Fatalf("lastEntry: got %s %q, want update %q", e.Type, e.Data, "update:20")
+	}
+
+	// replace last entry with entry of older term
+	s, err := openStorage(dir, c.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.removeGTE(last, 0)
+	s.appendEntry(&entry{index: last, term: 0, typ: entryNop})
+	if err = s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyStorage(c.opt, dir)
+	if err == nil || !strings.Contains(err.Error(), "less than previous term") {
+		t.Fatalf("got %v, want term error", err)
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	c := newCluster(t)
+	c.opt.SnapshotsRetain = 2
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	for i := 0; i < 3; i++ {
+		c.sendUpdates(ldr, 10*i+1, 10*i+10)
+		c.waitFSMLen(uint64(10*i + 10))
+		c.takeSnapshot(ldr, 0, nil)
+	}
+	latest := ldr.snaps.index
+	c.shutdown(ldr)
+
+	// simulate crash while taking snapshot
+	dir := c.storage[ldr.nid]
+	snapsDir := filepath.Join(dir, "snapshots")
+	for _, f := range []string{snapFile(snapsDir, latest+100), filepath.Join(snapsDir, "meta.tmp")} {
+		if err := ioutil.WriteFile(f, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snaps, err := ListSnapshots(c.opt, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 {
+		t.Fatalf("numSnapshots: got %d, want 2", len(snaps))
+	}
+	if snaps[0].Index != latest {
+		t.Fatalf("snaps[0].Index: got %d, want %d", snaps[0].Index, latest)
+	}
+	if snaps[1].Index >= snaps[0].Index {
+		t.Fatalf("snapshots not sorted: %d, %d", snaps[0].Index, snaps[1].Index)
+	}
+	if _, err := os.Stat(snapFile(snapsDir, latest+100)); !os.IsNotExist(err) {
+		t.Fatalf("orphan snap file not removed: %v", err)
+	}
+
+	// open older snapshot
+	info, r, err := OpenSnapshot(c.opt, dir, snaps[1].Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Index != snaps[1].Index {
+		t.Fatalf("info.Index: got %d, want %d", info.Index, snaps[1].Index)
+	}
+	if _, err := ListSnapshots(c.opt, dir); err == nil {
+		t.Fatal("ListSnapshots should fail, while snapshot is open")
+	}
+	var cmds []string
+	if err := gob.NewDecoder(r).Decode(&cmds); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 20 || cmds[19] != "update:20" {
+		t.Fatalf("cmds: got %d, want 20", len(cmds))
+	}
+
+	if _, _, err := OpenSnapshot(c.opt, dir, latest+100); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("got %v, want not found error", err)
+	}
+}
+
+func TestSnapshots_applyRetain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openSnapshots(dir, Options{SnapshotsRetain: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot 5 is installed after 10, so log compaction depends on 5
+	for _, index := range []uint64{10, 3, 5} {
+		sink, err := s.new(index, 1, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = sink.done(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snaps, err := findSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snaps, []uint64{10, 5}) {
+		t.Fatalf("snapshots: got %v, want [10 5]", snaps)
+	}
+}
+
+func TestCheckStartup(t *testing.T) {
+	c := newCluster(t)
+	c.opt.StartupCheck = true
+	ldr, _ := c.ensureLaunch(1)
+	defer c.shutdown()
+
+	c.sendUpdates(ldr, 1, 10)
+	c.waitFSMLen(10)
+	c.takeSnapshot(ldr, 0, nil)
+	c.sendUpdates(ldr, 11, 20)
+	c.waitFSMLen(20)
+
+	// consistent storage passes the check
+	ldr = c.restart(ldr)
+	c.waitCommitReady(ldr)
+	info := c.info(ldr)
+	c.shutdown(ldr)
+	dir := c.storage[ldr.nid]
+	report, err := CheckStartup(c.opt, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("problems: %v", report.Problems)
+	}
+	if report.LastLogIndex != info.LastLogIndex || report.SnapshotIndex != info.SnapshotIndex {
+		t.Fatalf("report: got (%d, %d), want (%d, %d)", report.LastLogIndex, report.SnapshotIndex, info.LastLogIndex, info.SnapshotIndex)
+	}
+	if report.Configs.Latest.Index != info.Configs.Latest.Index {
+		t.Fatalf("latest config: got %d, want %d", report.Configs.Latest.Index, info.Configs.Latest.Index)
+	}
+
+	// term behind log, as if term is restored from older backup
+	s, err := openStorage(dir, c.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.termVal.set(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(c.opt, c.newFSM(identity{ldr.cid, ldr.nid}), dir)
+	serr, ok := err.(StartupError)
+	if !ok {
+		t.Fatalf("got %v, want StartupError", err)
+	}
+	if len(serr.Report.Problems) != 1 || !strings.Contains(serr.Report.Problems[0], "beyond current term 1") {
+		t.Fatalf("problems: %v", serr.Report.Problems)
+	}
+}